@@ -0,0 +1,191 @@
+// Scheduled backup to a backup target.
+//
+// A scheduler takes a backup of a database at regular intervals and streams it to a target - a local directory or
+// S3-compatible object storage - without staging it on local disk. The first backup taken by a scheduler is full, the
+// following ones are incremental (see db.BackupSince), and every FullEvery-th one is full again. Once a backup is
+// stored, the changes it covers are discarded from the change log of the database.
+//
+// Backups are named after the UTC time they were taken at, followed by "-full" or "-incr", so that listing the
+// backups in name order and concatenating them from the last full backup onwards gives a stream for db.RestoreCol.
+
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+const (
+	BACKUP_FILE_EXT = ".jsonl" // Extension of backup names.
+)
+
+// Target stores backups.
+type Target interface {
+	// Begin storing a backup of the name.
+	Create(name string) (Upload, error)
+}
+
+// Upload receives the content of a backup. The backup is stored once Close succeeds; Abort discards it instead.
+type Upload interface {
+	io.Writer
+	Close() error
+	Abort() error
+}
+
+// DirTarget stores backups as files in a local directory.
+type DirTarget struct {
+	Dir string
+}
+
+// A backup file being written, it is renamed into place once complete.
+type fileUpload struct {
+	*os.File
+	path string
+}
+
+// Begin writing a backup file.
+func (target DirTarget) Create(name string) (Upload, error) {
+	if err := os.MkdirAll(target.Dir, 0700); err != nil {
+		return nil, err
+	}
+	filePath := path.Join(target.Dir, name)
+	file, err := os.OpenFile(filePath+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileUpload{File: file, path: filePath}, nil
+}
+
+// Flush the backup file to disk and rename it into place.
+func (upload *fileUpload) Close() error {
+	err := upload.File.Sync()
+	if closeErr := upload.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(upload.File.Name(), upload.path)
+	}
+	if err != nil {
+		os.Remove(upload.File.Name())
+	}
+	return err
+}
+
+// Remove the incomplete backup file.
+func (upload *fileUpload) Abort() error {
+	upload.File.Close()
+	return os.Remove(upload.File.Name())
+}
+
+// Config describes a backup schedule.
+type Config struct {
+	Interval  time.Duration // Time between backups.
+	FullEvery int           // Every FullEvery-th backup is full, the others are incremental. 0 - only the first backup is full.
+}
+
+// Scheduler takes backups of a database to a target.
+type Scheduler struct {
+	target  Target
+	conf    Config
+	lock    *sync.Mutex
+	db      *db.DB
+	since   int // Sequence number covered by the last backup, 0 if the next backup is full
+	taken   int // Number of backups taken
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Return a scheduler of backups to the target. It does nothing until started.
+func NewScheduler(target Target, conf Config) *Scheduler {
+	return &Scheduler{target: target, conf: conf, lock: new(sync.Mutex)}
+}
+
+// Take backups of the database at the configured interval until stopped. The first backup is taken right away.
+func (sched *Scheduler) Start(database *db.DB) {
+	sched.lock.Lock()
+	defer sched.lock.Unlock()
+	if sched.stop != nil {
+		return
+	}
+	sched.db, sched.since, sched.taken = database, 0, 0
+	sched.stop, sched.stopped = make(chan struct{}), make(chan struct{})
+	go func(stop, stopped chan struct{}) {
+		defer close(stopped)
+		ticker := time.NewTicker(sched.conf.Interval)
+		defer ticker.Stop()
+		for {
+			if name, err := sched.Run(); err != nil {
+				tdlog.Noticef("Scheduled backup failed: %v", err)
+			} else {
+				tdlog.Infof("Scheduled backup %s is stored", name)
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(sched.stop, sched.stopped)
+}
+
+// Stop taking backups, waiting for a backup in progress to finish.
+func (sched *Scheduler) Stop() {
+	sched.lock.Lock()
+	stop, stopped := sched.stop, sched.stopped
+	sched.stop = nil
+	sched.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+}
+
+// Take a backup of the database right away, and return its name.
+func (sched *Scheduler) Run() (name string, err error) {
+	sched.lock.Lock()
+	defer sched.lock.Unlock()
+	if sched.db == nil {
+		return "", dberr.New(dberr.ErrorMissing, "database")
+	}
+	since := sched.since
+	if sched.conf.FullEvery > 0 && sched.taken%sched.conf.FullEvery == 0 {
+		since = 0
+	}
+	kind := "incr"
+	if since == 0 {
+		kind = "full"
+	}
+	name = fmt.Sprintf("%s-%s%s", time.Now().UTC().Format("20060102T150405.000000000Z"), kind, BACKUP_FILE_EXT)
+	upload, err := sched.target.Create(name)
+	if err != nil {
+		return "", err
+	}
+	seq, err := sched.db.BackupSince(since, upload)
+	if err != nil {
+		if abortErr := upload.Abort(); abortErr != nil {
+			tdlog.Noticef("Failed to abort backup %s: %v", name, abortErr)
+		}
+		if dberr.Type(err) == dberr.ErrorChangesDiscarded {
+			// The next backup cannot be incremental
+			sched.since, sched.taken = 0, 0
+		}
+		return "", err
+	} else if err = upload.Close(); err != nil {
+		return "", err
+	}
+	sched.since = seq
+	sched.taken++
+	if err = sched.db.TruncateChanges(seq); err != nil {
+		// The changes may have been discarded up to a later backup taken by other means
+		tdlog.Noticef("Backup %s is stored, but failed to discard the changes it covers: %v", name, err)
+	}
+	return name, nil
+}
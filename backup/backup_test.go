@@ -0,0 +1,131 @@
+package backup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/db"
+)
+
+// Concatenate the backups from the last full one onwards.
+func backupChain(t *testing.T, dir string) []byte {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	sort.Strings(names)
+	var chain []byte
+	for _, name := range names {
+		if strings.HasSuffix(name, "-full"+BACKUP_FILE_EXT) {
+			chain = nil
+		}
+		content, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, content...)
+	}
+	return chain
+}
+
+func TestScheduler(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tiedot_backup_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	database, err := db.OpenDB(path.Join(tmp, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if err = database.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := database.Use("col")
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backupDir := path.Join(tmp, "backup")
+	sched := NewScheduler(DirTarget{backupDir}, Config{Interval: time.Hour, FullEvery: 3})
+	if _, err = sched.Run(); err == nil {
+		t.Fatal("ran before start")
+	}
+	// The first backup is taken upon start
+	sched.Start(database)
+	sched.Stop()
+	files, err := ioutil.ReadDir(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(files) != 1 || !strings.HasSuffix(files[0].Name(), "-full"+BACKUP_FILE_EXT) {
+		t.Fatal(files)
+	}
+	// Incremental backups follow, then a full one again
+	if err = col.Update(id, map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	}
+	for i, kind := range []string{"incr", "incr", "full", "incr"} {
+		if _, err = col.Insert(map[string]interface{}{"i": i}); err != nil {
+			t.Fatal(err)
+		}
+		name, err := sched.Run()
+		if err != nil {
+			t.Fatal(err)
+		} else if !strings.HasSuffix(name, "-"+kind+BACKUP_FILE_EXT) {
+			t.Fatal(i, name)
+		}
+	}
+	// The changes covered by backups are discarded
+	if err = database.TruncateChanges(database.ChangeSeq() - 1); err == nil {
+		t.Fatal("changes are not discarded")
+	}
+	// The backups restore the collection
+	if err = col.Delete(id); err != nil {
+		t.Fatal(err)
+	} else if err = database.RestoreCol("col", bytes.NewReader(backupChain(t, backupDir))); err != nil {
+		t.Fatal(err)
+	}
+	col = database.Use("col")
+	if doc, err := col.Read(id); err != nil || doc["a"] != float64(2) {
+		t.Fatal(doc, err)
+	}
+	count := 0
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		count++
+		return true
+	})
+	if count != 5 {
+		t.Fatal(count)
+	}
+	// A backup after changes were discarded by other means is full
+	if _, err = col.Insert(map[string]interface{}{"b": 1}); err != nil {
+		t.Fatal(err)
+	} else if err = database.TruncateChanges(database.ChangeSeq()); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.Insert(map[string]interface{}{"b": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sched.Run(); err == nil {
+		t.Fatal("incremental backup of discarded changes")
+	} else if name, err := sched.Run(); err != nil || !strings.HasSuffix(name, "-full"+BACKUP_FILE_EXT) {
+		t.Fatal(name, err)
+	}
+	// Failed backups leave no file behind
+	files, _ = ioutil.ReadDir(backupDir)
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".tmp") {
+			t.Fatal(file.Name())
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// S3-compatible object storage target.
+//
+// A backup is streamed to the object storage in a multipart upload: the content is buffered in memory up to the part
+// size, and each full part is uploaded as soon as it is written, so that a backup of any size needs no more than one
+// part of memory and no local disk. Requests are authenticated by AWS signature version 4 and address the bucket in
+// the path (https://endpoint/bucket/key), which both AWS S3 and S3-compatible storage such as MinIO understand.
+
+package backup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	S3_DEFAULT_PART_SIZE = 8 * 1048576 // Default size of an uploaded part, S3 requires at least 5 MiB except for the last part.
+	S3_DEFAULT_REGION    = "us-east-1" // Default region in request signatures.
+)
+
+// S3Target stores backups as objects in a bucket of S3-compatible object storage.
+type S3Target struct {
+	Endpoint     string       // Base URL of the object storage, e.g. https://s3.eu-west-1.amazonaws.com
+	Region       string       // Region in request signatures, S3_DEFAULT_REGION if empty.
+	Bucket       string       // Bucket name.
+	Prefix       string       // Prefix of object keys, e.g. "tiedot/".
+	AccessKey    string       // Access key ID.
+	SecretKey    string       // Secret access key.
+	SessionToken string       // Session token of temporary credentials, optional.
+	PartSize     int          // Size of an uploaded part, S3_DEFAULT_PART_SIZE if 0.
+	Client       *http.Client // HTTP client, http.DefaultClient if nil.
+}
+
+// A multipart upload in progress.
+type s3Upload struct {
+	target   *S3Target
+	key      string
+	uploadID string
+	buf      []byte
+	etags    []string // ETag of each uploaded part
+	err      error    // Failure of an earlier part, the upload cannot complete
+}
+
+// Error response of the object storage.
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+// Begin a multipart upload of a backup.
+func (target *S3Target) Create(name string) (Upload, error) {
+	upload := &s3Upload{target: target, key: target.Prefix + name}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := target.do("POST", upload.key, url.Values{"uploads": {""}}, nil, &result); err != nil {
+		return nil, err
+	}
+	upload.uploadID = result.UploadID
+	return upload, nil
+}
+
+// Buffer the content and upload every full part.
+func (upload *s3Upload) Write(p []byte) (int, error) {
+	if upload.err != nil {
+		return 0, upload.err
+	}
+	partSize := upload.target.PartSize
+	if partSize <= 0 {
+		partSize = S3_DEFAULT_PART_SIZE
+	}
+	upload.buf = append(upload.buf, p...)
+	for len(upload.buf) >= partSize {
+		if upload.err = upload.uploadPart(upload.buf[:partSize]); upload.err != nil {
+			return 0, upload.err
+		}
+		upload.buf = append(upload.buf[:0], upload.buf[partSize:]...)
+	}
+	return len(p), nil
+}
+
+// Upload the next part.
+func (upload *s3Upload) uploadPart(part []byte) error {
+	query := url.Values{"partNumber": {strconv.Itoa(len(upload.etags) + 1)}, "uploadId": {upload.uploadID}}
+	resp, err := upload.target.request("PUT", upload.key, query, part)
+	if err != nil {
+		return err
+	}
+	upload.etags = append(upload.etags, resp.Header.Get("ETag"))
+	return nil
+}
+
+// Upload the remaining content and complete the upload.
+func (upload *s3Upload) Close() error {
+	if upload.err == nil && (len(upload.buf) > 0 || len(upload.etags) == 0) {
+		upload.err = upload.uploadPart(upload.buf)
+	}
+	if upload.err != nil {
+		upload.Abort()
+		return upload.err
+	}
+	type completedPart struct {
+		PartNumber int
+		ETag       string
+	}
+	complete := struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{}
+	for i, etag := range upload.etags {
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err == nil {
+		err = upload.target.do("POST", upload.key, url.Values{"uploadId": {upload.uploadID}}, body, nil)
+	}
+	if err != nil {
+		upload.Abort()
+	}
+	return err
+}
+
+// Abort the upload, the object storage discards the uploaded parts.
+func (upload *s3Upload) Abort() error {
+	return upload.target.do("DELETE", upload.key, url.Values{"uploadId": {upload.uploadID}}, nil, nil)
+}
+
+// Make a request and decode the XML response into result, unless result is nil.
+func (target *S3Target) do(method, key string, query url.Values, body []byte, result interface{}) error {
+	resp, err := target.request(method, key, query, body)
+	if err != nil {
+		return err
+	}
+	// Completing an upload may fail after the response status is sent, the error is in the body
+	var errResp s3Error
+	if xml.Unmarshal(resp.body, &errResp) == nil && errResp.Code != "" {
+		return fmt.Errorf("S3 %s %s: %s %s", method, key, errResp.Code, errResp.Message)
+	} else if result != nil {
+		if err = xml.Unmarshal(resp.body, result); err != nil {
+			return fmt.Errorf("S3 %s %s: %v", method, key, err)
+		}
+	}
+	return nil
+}
+
+// A successful response.
+type s3Response struct {
+	*http.Response
+	body []byte
+}
+
+// Make a signed request, and return an error if the object storage does not respond with success.
+func (target *S3Target) request(method, key string, query url.Values, body []byte) (resp s3Response, err error) {
+	endpoint, err := url.Parse(target.Endpoint)
+	if err != nil {
+		return
+	}
+	uri := strings.TrimSuffix(endpoint.Path, "/") + "/" + s3Escape(target.Bucket, false) + "/" + s3Escape(key, true)
+	rawQuery := s3Query(query)
+	req, err := http.NewRequest(method, endpoint.Scheme+"://"+endpoint.Host+uri+"?"+rawQuery, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	target.sign(req, uri, rawQuery, body, time.Now())
+	client := target.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if resp.Response, err = client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	if resp.StatusCode/100 != 2 {
+		var errResp s3Error
+		xml.Unmarshal(resp.body, &errResp)
+		err = fmt.Errorf("S3 %s %s: %s %s %s", method, key, resp.Status, errResp.Code, errResp.Message)
+	}
+	return
+}
+
+// Sign the request by AWS signature version 4. The host and every header set on the request are signed.
+func (target *S3Target) sign(req *http.Request, uri, rawQuery string, body []byte, now time.Time) {
+	region := target.Region
+	if region == "" {
+		region = S3_DEFAULT_REGION
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if target.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", target.SessionToken)
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{req.Method, uri, rawQuery, canonicalHeaders.String(), signedHeaders,
+		hex.EncodeToString(payloadHash[:])}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + target.SecretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		target.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// URI-encode a string as required by AWS signatures, optionally leaving slashes as they are.
+func s3Escape(str string, keepSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(str) {
+		if b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '-' || b == '.' || b == '_' || b == '~' || keepSlash && b == '/' {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// Encode a query string in the canonical form of AWS signatures - sorted by name.
+func s3Query(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
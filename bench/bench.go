@@ -0,0 +1,344 @@
+// Configurable benchmark for evaluating database configuration on the hardware at hand.
+//
+// A benchmark run prepares a collection with sample documents, then keeps a number of goroutines busy with a mix of
+// document operations for a duration, and reports throughput and latency of each kind of operation. Results serialise
+// into JSON for comparison across runs.
+
+package bench
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cankansin/tiedot/db"
+)
+
+// Names of benchmark operations.
+const (
+	OP_INSERT = "insert"
+	OP_READ   = "read"
+	OP_QUERY  = "query"
+	OP_UPDATE = "update"
+	OP_DELETE = "delete"
+)
+
+var allOps = []string{OP_INSERT, OP_READ, OP_QUERY, OP_UPDATE, OP_DELETE}
+
+// Mix is the relative weight of each benchmark operation, an operation of zero weight does not run.
+type Mix map[string]int
+
+// Config describes a benchmark run.
+type Config struct {
+	Dir         string        // Database directory, it must not exist or be empty, and is removed after the run unless KeepData is true. A temporary directory is used if empty.
+	KeepData    bool          // Keep the database directory after the run.
+	InitialDocs int           // Number of documents inserted before the run begins.
+	DocSize     int           // Approximate size (in bytes) of each sample document.
+	Mix         Mix           // Relative weight of each operation.
+	Concurrency int           // Number of goroutines running operations.
+	Duration    time.Duration // Duration of the run.
+	Indexes     bool          // Index the attributes of the sample documents, which sample queries look up.
+}
+
+// OpResult is the performance of one kind of operation in a benchmark run.
+type OpResult struct {
+	Op        string  `json:"op"`
+	Count     int64   `json:"count"`      // Number of successful operations
+	Errors    int64   `json:"errors"`     // Number of failed operations, updates and deletes of documents deleted in the meantime fail
+	Misses    int64   `json:"misses"`     // Number of reads, updates and deletes skipped as there was no document to work on
+	PerSecond float64 `json:"per_second"` // Successful operations per second
+	MeanNs    int64   `json:"mean_ns"`    // Mean latency in nanoseconds
+	P50Ns     int64   `json:"p50_ns"`     // Median latency in nanoseconds
+	P99Ns     int64   `json:"p99_ns"`     // 99th percentile latency in nanoseconds
+	MaxNs     int64   `json:"max_ns"`     // Maximum latency in nanoseconds
+}
+
+// Result is the outcome of a benchmark run.
+type Result struct {
+	InitialDocs int        `json:"initial_docs"`
+	DocSize     int        `json:"doc_size"`
+	Mix         Mix        `json:"mix"`
+	Concurrency int        `json:"concurrency"`
+	Indexes     bool       `json:"indexes"`
+	DurationNs  int64      `json:"duration_ns"`   // Actual duration of the run
+	Total       int64      `json:"total"`         // Total number of successful operations
+	PerSecond   float64    `json:"per_second"`    // Successful operations per second
+	Ops         []OpResult `json:"ops"`           // Performance of each operation, in the order of insert, read, query, update and delete
+	Dir         string     `json:"dir,omitempty"` // Database directory, if it is kept
+}
+
+// Return the default benchmark configuration: 10 seconds of mixed operations made by 4 goroutines, mostly reads.
+func DefaultConfig() Config {
+	return Config{
+		InitialDocs: 10000,
+		DocSize:     512,
+		Mix:         Mix{OP_INSERT: 1, OP_READ: 6, OP_QUERY: 1, OP_UPDATE: 1, OP_DELETE: 1},
+		Concurrency: 4,
+		Duration:    10 * time.Second,
+		Indexes:     true,
+	}
+}
+
+// Parse an operation mix such as "insert:1,read:6,query:1" - operations not mentioned do not run.
+func ParseMix(str string) (mix Mix, err error) {
+	mix = make(Mix)
+	for _, entry := range strings.Split(str, ",") {
+		opWeight := strings.Split(strings.TrimSpace(entry), ":")
+		if len(opWeight) != 2 {
+			return nil, fmt.Errorf("Operation mix entry %q is not in the format of operation:weight", entry)
+		}
+		op := strings.TrimSpace(opWeight[0])
+		if !isOp(op) {
+			return nil, fmt.Errorf("Unknown operation %q, expecting one of %v", op, allOps)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(opWeight[1]))
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("Weight of operation %q must be a non-negative integer, but %q given", op, opWeight[1])
+		}
+		mix[op] = weight
+	}
+	return
+}
+
+// Return true if the name is a benchmark operation.
+func isOp(name string) bool {
+	for _, op := range allOps {
+		if op == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate the benchmark configuration.
+func (conf Config) validate() error {
+	if conf.Concurrency < 1 {
+		return fmt.Errorf("Concurrency must be at least 1, but %d given", conf.Concurrency)
+	} else if conf.Duration <= 0 {
+		return fmt.Errorf("Duration must be positive, but %v given", conf.Duration)
+	} else if conf.InitialDocs < 0 || conf.DocSize < 0 {
+		return fmt.Errorf("Number of initial documents and document size may not be negative")
+	}
+	totalWeight := 0
+	for op, weight := range conf.Mix {
+		if !isOp(op) {
+			return fmt.Errorf("Unknown operation %q, expecting one of %v", op, allOps)
+		} else if weight < 0 {
+			return fmt.Errorf("Weight of operation %q may not be negative", op)
+		}
+		totalWeight += weight
+	}
+	if totalWeight == 0 {
+		return fmt.Errorf("Operation mix %v does not run any operation", conf.Mix)
+	}
+	return nil
+}
+
+// Document IDs available to read, update and delete operations.
+type docIDs struct {
+	lock *sync.Mutex
+	ids  []int
+}
+
+func (set *docIDs) add(id int) {
+	set.lock.Lock()
+	set.ids = append(set.ids, id)
+	set.lock.Unlock()
+}
+
+// Return a random document ID, or -1 if there is none.
+func (set *docIDs) pick(rnd *rand.Rand) int {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	if len(set.ids) == 0 {
+		return -1
+	}
+	return set.ids[rnd.Intn(len(set.ids))]
+}
+
+// Remove a random document ID and return it, or return -1 if there is none.
+func (set *docIDs) take(rnd *rand.Rand) int {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	if len(set.ids) == 0 {
+		return -1
+	}
+	i := rnd.Intn(len(set.ids))
+	id := set.ids[i]
+	set.ids[i] = set.ids[len(set.ids)-1]
+	set.ids = set.ids[:len(set.ids)-1]
+	return id
+}
+
+// Latency samples and counters of an operation made by one goroutine.
+type opStats struct {
+	latencies []int64
+	errors    int64
+	misses    int64
+}
+
+// Run a benchmark and return its result.
+func Run(conf Config) (result *Result, err error) {
+	if err = conf.validate(); err != nil {
+		return
+	}
+	// Never erase data that is not the benchmark's own
+	dir := conf.Dir
+	if dir == "" {
+		if dir, err = ioutil.TempDir("", "tiedot_bench_run"); err != nil {
+			return
+		}
+	} else if content, readErr := ioutil.ReadDir(dir); readErr == nil && len(content) > 0 {
+		return nil, fmt.Errorf("Benchmark database directory %s is not empty, please remove it or choose another", dir)
+	}
+	if !conf.KeepData {
+		defer os.RemoveAll(dir)
+	}
+	benchDB, err := db.OpenDB(dir)
+	if err != nil {
+		return
+	}
+	defer benchDB.Close()
+	if err = benchDB.Create("bench"); err != nil {
+		return
+	}
+	col := benchDB.Use("bench")
+	if conf.Indexes {
+		for _, idxPath := range [][]string{{"nested", "nested", "str"}, {"nested", "nested", "int"}, {"nested", "nested", "float"}, {"strs"}, {"ints"}, {"floats"}} {
+			if err = col.Index(idxPath); err != nil {
+				return
+			}
+		}
+	}
+	// Sample values range over the number of documents, so that lookups find a few documents each
+	valueRange := conf.InitialDocs
+	if valueRange < 1000 {
+		valueRange = 1000
+	}
+	filler := strings.Repeat("x", conf.DocSize)
+	newDoc := func() map[string]interface{} {
+		doc := sampleDoc(valueRange)
+		doc["filler"] = filler
+		return doc
+	}
+	ids := &docIDs{lock: new(sync.Mutex), ids: make([]int, 0, conf.InitialDocs)}
+	for i := 0; i < conf.InitialDocs; i++ {
+		id, err := col.Insert(newDoc())
+		if err != nil {
+			return nil, err
+		}
+		ids.add(id)
+	}
+	// Each goroutine picks operations by weight at random and records their latency
+	weighted := make([]string, 0)
+	for _, op := range allOps {
+		for i := 0; i < conf.Mix[op]; i++ {
+			weighted = append(weighted, op)
+		}
+	}
+	var stop int32
+	stats := make([]map[string]*opStats, conf.Concurrency)
+	wg := new(sync.WaitGroup)
+	start := time.Now()
+	for worker := 0; worker < conf.Concurrency; worker++ {
+		stats[worker] = make(map[string]*opStats)
+		for _, op := range allOps {
+			stats[worker][op] = new(opStats)
+		}
+		wg.Add(1)
+		go func(workerStats map[string]*opStats, rnd *rand.Rand) {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				op := weighted[rnd.Intn(len(weighted))]
+				// Reads, updates and deletes work on an existing document
+				id := -1
+				switch op {
+				case OP_READ, OP_UPDATE:
+					id = ids.pick(rnd)
+				case OP_DELETE:
+					id = ids.take(rnd)
+				}
+				if id == -1 && op != OP_INSERT && op != OP_QUERY {
+					workerStats[op].misses++
+					continue
+				}
+				opStart := time.Now()
+				var opErr error
+				switch op {
+				case OP_INSERT:
+					var id int
+					if id, opErr = col.Insert(newDoc()); opErr == nil {
+						ids.add(id)
+					}
+				case OP_READ:
+					_, opErr = col.Read(id)
+				case OP_QUERY:
+					queryResult := make(map[int]struct{})
+					opErr = db.EvalQuery(sampleQuery(valueRange), col, &queryResult)
+				case OP_UPDATE:
+					opErr = col.Update(id, newDoc())
+				case OP_DELETE:
+					opErr = col.Delete(id)
+				}
+				if opErr != nil {
+					workerStats[op].errors++
+				} else {
+					workerStats[op].latencies = append(workerStats[op].latencies, int64(time.Since(opStart)))
+				}
+			}
+		}(stats[worker], rand.New(rand.NewSource(time.Now().UnixNano()+int64(worker))))
+	}
+	time.Sleep(conf.Duration)
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+	elapsed := time.Since(start)
+	// Summarise the operations of all goroutines
+	result = &Result{
+		InitialDocs: conf.InitialDocs,
+		DocSize:     conf.DocSize,
+		Mix:         conf.Mix,
+		Concurrency: conf.Concurrency,
+		Indexes:     conf.Indexes,
+		DurationNs:  int64(elapsed),
+		Ops:         make([]OpResult, 0, len(allOps)),
+	}
+	for _, op := range allOps {
+		if conf.Mix[op] == 0 {
+			continue
+		}
+		opResult := OpResult{Op: op}
+		latencies := make([]int64, 0)
+		for _, workerStats := range stats {
+			latencies = append(latencies, workerStats[op].latencies...)
+			opResult.Errors += workerStats[op].errors
+			opResult.Misses += workerStats[op].misses
+		}
+		opResult.Count = int64(len(latencies))
+		opResult.PerSecond = float64(opResult.Count) / elapsed.Seconds()
+		if len(latencies) > 0 {
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			var sum int64
+			for _, latency := range latencies {
+				sum += latency
+			}
+			opResult.MeanNs = sum / int64(len(latencies))
+			opResult.P50Ns = latencies[len(latencies)*50/100]
+			opResult.P99Ns = latencies[len(latencies)*99/100]
+			opResult.MaxNs = latencies[len(latencies)-1]
+		}
+		result.Total += opResult.Count
+		result.Ops = append(result.Ops, opResult)
+	}
+	result.PerSecond = float64(result.Total) / elapsed.Seconds()
+	if conf.KeepData {
+		result.Dir = dir
+	}
+	return
+}
@@ -0,0 +1,93 @@
+package bench
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseMix(t *testing.T) {
+	mix, err := ParseMix("insert:1, read:6,query:0")
+	if err != nil || len(mix) != 3 || mix[OP_INSERT] != 1 || mix[OP_READ] != 6 || mix[OP_QUERY] != 0 {
+		t.Fatal(mix, err)
+	}
+	for _, bad := range []string{"", "read", "read:x", "read:-1", "scan:1"} {
+		if _, err := ParseMix(bad); err == nil {
+			t.Fatal("Did not error", bad)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Dir = "/tmp/tiedot_test_bench_run"
+	conf.InitialDocs = 200
+	conf.DocSize = 100
+	conf.Mix = Mix{OP_INSERT: 1, OP_READ: 2, OP_QUERY: 1, OP_UPDATE: 1, OP_DELETE: 1}
+	conf.Concurrency = 2
+	conf.Duration = 200 * time.Millisecond
+	result, err := Run(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Ops) != 5 || result.Total == 0 || result.PerSecond <= 0 || result.DurationNs < int64(conf.Duration) {
+		t.Fatal(result)
+	}
+	for _, op := range result.Ops {
+		if op.Count == 0 || op.P50Ns > op.P99Ns || op.P99Ns > op.MaxNs {
+			t.Fatal(op)
+		}
+	}
+	if _, err = json.Marshal(result); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(conf.Dir); !os.IsNotExist(err) {
+		t.Fatal("Benchmark data is left behind")
+	}
+	// Only the operations in the mix run
+	conf.Mix = Mix{OP_READ: 1}
+	if result, err = Run(conf); err != nil || len(result.Ops) != 1 || result.Ops[0].Op != OP_READ {
+		t.Fatal(result, err)
+	}
+	conf.Mix = Mix{OP_READ: 0}
+	if _, err = Run(conf); err == nil {
+		t.Fatal("Did not error")
+	}
+	// Without documents to work on, reads and deletes are counted as misses
+	conf.InitialDocs = 0
+	conf.Mix = Mix{OP_READ: 1, OP_DELETE: 1}
+	if result, err = Run(conf); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range result.Ops {
+		if op.Count != 0 || op.Misses == 0 {
+			t.Fatal(op)
+		}
+	}
+	// A temporary directory is used unless specified
+	conf.Dir = ""
+	if result, err = Run(conf); err != nil || result.Dir != "" {
+		t.Fatal(result, err)
+	}
+}
+
+func TestRunNonEmptyDir(t *testing.T) {
+	dir := "/tmp/tiedot_test_bench_nonempty"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(dir+"/precious", []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf := DefaultConfig()
+	conf.Dir = dir
+	conf.Duration = 10 * time.Millisecond
+	if _, err := Run(conf); err == nil {
+		t.Fatal("Did not error")
+	} else if _, err = os.Stat(dir + "/precious"); err != nil {
+		t.Fatal("Existing data is erased", err)
+	}
+}
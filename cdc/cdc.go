@@ -0,0 +1,293 @@
+// Change data capture export.
+//
+// An exporter tails the change log of a database and publishes a JSON event for every change to Kafka or NATS, so that
+// downstream pipelines follow the documents of the database. The changes are read as an incremental backup stream (see
+// db.BackupSince), thus an event carries the current content of a changed document rather than each of its versions:
+//
+//     {"seq": 42, "col": "Feeds", "id": 123, "doc": {"title": "abc"}}
+//     {"seq": 42, "col": "Votes", "id": 456, "deleted": true}
+//     {"seq": 42, "col": "Feeds", "reset": true}
+//     {"seq": 42, "col": "Votes", "dropped": true}
+//
+// A reset event tells that the collection was created, renamed into or truncated, it is followed by the events of all
+// documents of the collection. A dropped event tells that the collection was dropped or renamed away. The events of a
+// collection are published to the topic (NATS subject) of the topic prefix followed by the collection name, and are
+// keyed by the collection name and document ID.
+//
+// Delivery is at-least-once: once the publisher acknowledges all events up to a sequence number, the sequence number is
+// saved to the checkpoint file, and the export resumes from there after a restart - possibly publishing some events
+// again. Without a checkpoint, and whenever the changes since the checkpoint were discarded from the change log (such
+// as by a scheduled backup), the entire database is published again, starting with reset events.
+
+package cdc
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+const (
+	DEFAULT_TOPIC_PREFIX = "tiedot." // Default prefix of topic names.
+	DEFAULT_BATCH_SIZE   = 500       // Default number of events published at once.
+)
+
+// Event describes a change of a collection.
+type Event struct {
+	Seq     int             `json:"seq"`
+	Col     string          `json:"col"`
+	ID      int             `json:"id,omitempty"`
+	Doc     json.RawMessage `json:"doc,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+	Reset   bool            `json:"reset,omitempty"`
+	Dropped bool            `json:"dropped,omitempty"`
+}
+
+// Message is an event to be published.
+type Message struct {
+	Topic string
+	Key   string // Collection name and document ID separated by slash, or the collection name alone
+	Value []byte // Serialised Event
+}
+
+// Publisher delivers messages to a message broker.
+type Publisher interface {
+	// Publish the messages in order, return nil only once the broker acknowledged all of them.
+	Publish(msgs []Message) error
+}
+
+// Config describes the export.
+type Config struct {
+	Interval    time.Duration // Time between polls of the change log.
+	TopicPrefix string        // Prefix of topic names, DEFAULT_TOPIC_PREFIX if empty.
+	Checkpoint  string        // File that keeps the sequence number published up to, empty - the export always begins with the entire database.
+	BatchSize   int           // Number of events published at once, DEFAULT_BATCH_SIZE if 0.
+}
+
+// The content of checkpoint file.
+type checkpoint struct {
+	Seq  int      `json:"seq"`
+	Cols []string `json:"cols"` // Collections that existed at the sequence number
+}
+
+// Exporter publishes the changes of a database.
+type Exporter struct {
+	publisher Publisher
+	conf      Config
+	lock      *sync.Mutex
+	db        *db.DB
+	done      checkpoint // Published up to here
+	hasDone   bool       // Whether anything was published, otherwise the entire database is to be published
+	loaded    bool       // Whether the checkpoint file was read
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+// Return an exporter of changes to the publisher. It does nothing until started.
+func NewExporter(publisher Publisher, conf Config) *Exporter {
+	if conf.TopicPrefix == "" {
+		conf.TopicPrefix = DEFAULT_TOPIC_PREFIX
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = DEFAULT_BATCH_SIZE
+	}
+	return &Exporter{publisher: publisher, conf: conf, lock: new(sync.Mutex)}
+}
+
+// Publish the changes of the database at the configured interval until stopped. The first export runs right away.
+func (exp *Exporter) Start(database *db.DB) {
+	exp.lock.Lock()
+	defer exp.lock.Unlock()
+	if exp.stop != nil {
+		return
+	}
+	exp.db = database
+	exp.stop, exp.stopped = make(chan struct{}), make(chan struct{})
+	go func(stop, stopped chan struct{}) {
+		defer close(stopped)
+		ticker := time.NewTicker(exp.conf.Interval)
+		defer ticker.Stop()
+		for {
+			if published, err := exp.Run(); err != nil {
+				tdlog.Noticef("Change data capture export failed: %v", err)
+			} else if published > 0 {
+				tdlog.Infof("Published %d change events", published)
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(exp.stop, exp.stopped)
+}
+
+// Stop publishing changes, waiting for an export in progress to finish.
+func (exp *Exporter) Stop() {
+	exp.lock.Lock()
+	stop, stopped := exp.stop, exp.stopped
+	exp.stop = nil
+	exp.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+}
+
+// Publish the changes made since the last export right away, and return the number of events published.
+func (exp *Exporter) Run() (published int, err error) {
+	exp.lock.Lock()
+	defer exp.lock.Unlock()
+	if exp.db == nil {
+		return 0, dberr.New(dberr.ErrorMissing, "database")
+	} else if !exp.loaded {
+		if err = exp.loadCheckpoint(); err != nil {
+			return 0, err
+		}
+		exp.loaded = true
+	}
+	// Nothing to publish unless a change was made or a collection was dropped
+	cols := exp.db.AllCols()
+	sort.Strings(cols)
+	if exp.hasDone && exp.done.Seq == exp.db.ChangeSeq() && equalCols(exp.done.Cols, cols) {
+		return 0, nil
+	}
+	published, err = exp.export(exp.done.Seq)
+	if dberr.Type(err) == dberr.ErrorChangesDiscarded {
+		tdlog.Noticef("Changes since %d are no longer recorded, publishing the entire database again", exp.done.Seq)
+		published, err = exp.export(0)
+	}
+	return
+}
+
+// Publish the changes made after the sequence number, and save the checkpoint once they are acknowledged.
+func (exp *Exporter) export(since int) (published int, err error) {
+	reader, writer := io.Pipe()
+	exported := make(chan error, 1)
+	go func() {
+		_, err := exp.db.BackupSince(since, writer)
+		writer.CloseWithError(err)
+		exported <- err
+	}()
+	// The reader is closed upon failure to publish, so that the export stops as well
+	defer func() {
+		reader.CloseWithError(err)
+		if exportErr := <-exported; err == nil {
+			err = exportErr
+		}
+	}()
+	decoder := json.NewDecoder(reader)
+	var header struct {
+		Seq  int      `json:"seq"`
+		Cols []string `json:"cols"`
+	}
+	if err = decoder.Decode(&header); err != nil {
+		return
+	}
+	sort.Strings(header.Cols)
+	batch := make([]Message, 0, exp.conf.BatchSize)
+	publish := func(event Event) error {
+		event.Seq = header.Seq
+		key := event.Col
+		if event.ID != 0 {
+			key += "/" + strconv.Itoa(event.ID)
+		}
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, Message{Topic: exp.conf.TopicPrefix + event.Col, Key: key, Value: value})
+		if len(batch) < exp.conf.BatchSize {
+			return nil
+		} else if err = exp.publisher.Publish(batch); err != nil {
+			return err
+		}
+		published += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	for _, col := range exp.done.Cols {
+		if i := sort.SearchStrings(header.Cols, col); i == len(header.Cols) || header.Cols[i] != col {
+			if err = publish(Event{Col: col, Dropped: true}); err != nil {
+				return
+			}
+		}
+	}
+	for {
+		var event Event
+		if err = decoder.Decode(&event); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		} else if err = publish(event); err != nil {
+			return
+		}
+	}
+	if len(batch) > 0 {
+		if err = exp.publisher.Publish(batch); err != nil {
+			return
+		}
+		published += len(batch)
+	}
+	err = exp.saveCheckpoint(checkpoint{Seq: header.Seq, Cols: header.Cols})
+	return
+}
+
+// Read the sequence number published up to from the checkpoint file, if there is one.
+func (exp *Exporter) loadCheckpoint() error {
+	if exp.conf.Checkpoint == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(exp.conf.Checkpoint)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if err = json.Unmarshal(content, &exp.done); err != nil {
+		return dberr.New(dberr.ErrorInvalidJSON, string(content), "of change data capture checkpoint")
+	}
+	sort.Strings(exp.done.Cols)
+	exp.hasDone = true
+	return nil
+}
+
+// Remember the sequence number published up to, and write it into the checkpoint file if there is one.
+func (exp *Exporter) saveCheckpoint(done checkpoint) error {
+	if exp.conf.Checkpoint != "" {
+		content, err := json.Marshal(done)
+		if err != nil {
+			return err
+		}
+		tmpPath := exp.conf.Checkpoint + ".tmp"
+		if err = ioutil.WriteFile(tmpPath, content, 0600); err != nil {
+			return err
+		} else if err = os.Rename(tmpPath, exp.conf.Checkpoint); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	exp.done, exp.hasDone = done, true
+	return nil
+}
+
+// Return true only if both sorted lists of collection names are the same.
+func equalCols(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
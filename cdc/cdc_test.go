@@ -0,0 +1,161 @@
+package cdc
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/db"
+)
+
+// A publisher that keeps the messages, it fails to publish while failing is true.
+type memPublisher struct {
+	msgs    []Message
+	batches int
+	failing bool
+}
+
+func (pub *memPublisher) Publish(msgs []Message) error {
+	if pub.failing {
+		return errors.New("broker is down")
+	}
+	pub.msgs = append(pub.msgs, msgs...)
+	pub.batches++
+	return nil
+}
+
+// Return the published events and forget them.
+func (pub *memPublisher) events(t *testing.T) (events []Event) {
+	for _, msg := range pub.msgs {
+		var event Event
+		if err := json.Unmarshal(msg.Value, &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	pub.msgs = nil
+	return
+}
+
+func TestExporter(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tiedot_cdc_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	database, err := db.OpenDB(path.Join(tmp, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if err = database.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := database.Use("col")
+	id1, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := &memPublisher{}
+	checkpointPath := path.Join(tmp, "checkpoint")
+	exp := NewExporter(pub, Config{Checkpoint: checkpointPath, BatchSize: 1})
+	if _, err = exp.Run(); err == nil {
+		t.Fatal("did not error")
+	}
+	exp.db = database
+	// The first export publishes the entire database
+	if published, err := exp.Run(); err != nil || published != 2 || pub.batches != 2 {
+		t.Fatal(published, err, pub.batches)
+	}
+	if msgs := pub.msgs; msgs[0].Topic != "tiedot.col" || msgs[0].Key != "col" || msgs[1].Key != "col/"+strconv.Itoa(id1) {
+		t.Fatal(msgs)
+	}
+	seq := database.ChangeSeq()
+	if events := pub.events(t); len(events) != 2 || !events[0].Reset || events[0].Seq != seq ||
+		events[1].ID != id1 || string(events[1].Doc) != `{"a":1}` {
+		t.Fatal(events)
+	} else if content, err := ioutil.ReadFile(checkpointPath); err != nil || string(content) != `{"seq":`+strconv.Itoa(seq)+`,"cols":["col"]}` {
+		t.Fatal(string(content), err)
+	}
+	// Nothing is published without changes
+	if published, err := exp.Run(); err != nil || published != 0 {
+		t.Fatal(published, err)
+	}
+	// Changes are published once the broker is back
+	id2, err := col.Insert(map[string]interface{}{"a": 2})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(id1); err != nil {
+		t.Fatal(err)
+	}
+	pub.failing = true
+	if _, err = exp.Run(); err == nil {
+		t.Fatal("did not error")
+	}
+	pub.failing = false
+	if published, err := exp.Run(); err != nil || published != 2 {
+		t.Fatal(published, err)
+	}
+	events := pub.events(t)
+	if len(events) != 2 {
+		t.Fatal(events)
+	}
+	for _, event := range events {
+		if event.ID == id1 && !event.Deleted || event.ID == id2 && string(event.Doc) != `{"a":2}` {
+			t.Fatal(events)
+		}
+	}
+	// Another exporter resumes from the checkpoint, and tells dropped collections
+	if err = database.Rename("col", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	exp = NewExporter(pub, Config{Checkpoint: checkpointPath})
+	exp.db = database
+	if published, err := exp.Run(); err != nil || published != 3 {
+		t.Fatal(published, err)
+	} else if events := pub.events(t); !events[0].Dropped || events[0].Col != "col" || !events[1].Reset || events[1].Col != "renamed" ||
+		events[2].ID != id2 {
+		t.Fatal(events)
+	}
+	// Once the changes since the checkpoint are discarded, the entire database is published again
+	if _, err = database.Use("renamed").Insert(map[string]interface{}{"a": 3}); err != nil {
+		t.Fatal(err)
+	} else if err = database.TruncateChanges(database.ChangeSeq()); err != nil {
+		t.Fatal(err)
+	}
+	if published, err := exp.Run(); err != nil || published != 3 {
+		t.Fatal(published, err)
+	} else if events := pub.events(t); !events[0].Reset {
+		t.Fatal(events)
+	}
+}
+
+func TestExporterStartStop(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tiedot_cdc_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	database, err := db.OpenDB(path.Join(tmp, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if err = database.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	pub := &memPublisher{}
+	exp := NewExporter(pub, Config{Interval: time.Second})
+	exp.Start(database)
+	exp.Start(database)
+	exp.Stop()
+	exp.Stop()
+	if events := pub.events(t); len(events) != 1 || !events[0].Reset {
+		t.Fatal(events)
+	}
+}
@@ -0,0 +1,204 @@
+// Elasticsearch publisher.
+//
+// Instead of publishing events, the publisher mirrors collections into Elasticsearch (or OpenSearch) indexes over
+// the bulk API: document events index the document under its ID, deletion events delete it. A reset event
+// creates the index if it does not exist yet - with the configured mappings - and deletes the documents it held, so
+// that the documents of the collection that follow replace them; a dropped event deletes all documents of the index.
+// The batch is published once Elasticsearch confirmed every action of it, thus the index follows the collection
+// at-least-once.
+
+package cdc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/cankansin/tiedot/db"
+)
+
+const (
+	ES_DEFAULT_INDEX_PREFIX = "tiedot-" // Default prefix of index names.
+)
+
+// ESIndex describes how a collection is mirrored into an index.
+type ESIndex struct {
+	Index    string              `json:"index"`    // Name of the index, the index prefix followed by the lower case collection name if empty.
+	Fields   map[string][]string `json:"fields"`   // Field name - path of the document attribute it takes, nil - documents are indexed as they are.
+	Mappings json.RawMessage     `json:"mappings"` // Mappings of the index, used when the index is created, nil - dynamic mapping.
+}
+
+// ElasticsearchPublisher mirrors collections into Elasticsearch indexes.
+type ElasticsearchPublisher struct {
+	Endpoint    string             // Base URL of Elasticsearch, e.g. http://localhost:9200
+	User        string             // User name for basic authentication, optional.
+	Password    string             // Password of the user.
+	Client      *http.Client       // HTTP client, http.DefaultClient if nil.
+	IndexPrefix string             // Prefix of index names, ES_DEFAULT_INDEX_PREFIX if empty.
+	Cols        map[string]ESIndex // Collections to mirror by name, nil - all collections with their documents as they are.
+}
+
+// A bulk response.
+type esBulkResult struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// Apply the events to the indexes in order.
+func (es *ElasticsearchPublisher) Publish(msgs []Message) error {
+	bulk := new(bytes.Buffer)
+	for _, msg := range msgs {
+		var event Event
+		if err := json.Unmarshal(msg.Value, &event); err != nil {
+			return err
+		}
+		conf, mirrored := es.Cols[event.Col]
+		if !mirrored && es.Cols != nil {
+			continue
+		}
+		index := conf.Index
+		if index == "" {
+			prefix := es.IndexPrefix
+			if prefix == "" {
+				prefix = ES_DEFAULT_INDEX_PREFIX
+			}
+			index = prefix + strings.ToLower(event.Col)
+		}
+		switch {
+		case event.Reset || event.Dropped:
+			// The documents indexed so far must be gone before the collection's documents are indexed again
+			if err := es.bulk(bulk); err != nil {
+				return err
+			} else if event.Reset {
+				if err := es.createIndex(index, conf.Mappings); err != nil {
+					return err
+				}
+			}
+			if err := es.clearIndex(index); err != nil {
+				return err
+			}
+		case event.Deleted:
+			fmt.Fprintf(bulk, `{"delete":{"_index":%q,"_id":"%d"}}`+"\n", index, event.ID)
+		default:
+			doc := []byte(event.Doc)
+			if conf.Fields != nil {
+				var err error
+				if doc, err = mapFields(event.Doc, conf.Fields); err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(bulk, `{"index":{"_index":%q,"_id":"%d"}}`+"\n%s\n", index, event.ID, doc)
+		}
+	}
+	return es.bulk(bulk)
+}
+
+// Return the document made of the fields taken from the attributes of the document.
+func mapFields(docJS json.RawMessage, fields map[string][]string) ([]byte, error) {
+	var doc interface{}
+	if err := json.Unmarshal(docJS, &doc); err != nil {
+		return nil, err
+	}
+	mapped := make(map[string]interface{})
+	for field, path := range fields {
+		values := make([]interface{}, 0)
+		for _, value := range db.GetIn(doc, path) {
+			if value != nil {
+				values = append(values, value)
+			}
+		}
+		switch len(values) {
+		case 0:
+		case 1:
+			mapped[field] = values[0]
+		default:
+			mapped[field] = values
+		}
+	}
+	return json.Marshal(mapped)
+}
+
+// Send the bulk actions accumulated in the buffer, and verify that all of them succeeded. The buffer is emptied.
+func (es *ElasticsearchPublisher) bulk(actions *bytes.Buffer) error {
+	if actions.Len() == 0 {
+		return nil
+	}
+	status, body, err := es.request("POST", "/_bulk", "application/x-ndjson", actions.Bytes())
+	actions.Reset()
+	if err != nil {
+		return err
+	} else if status/100 != 2 {
+		return fmt.Errorf("Elasticsearch failed to apply bulk actions: %d %s", status, body)
+	}
+	var result esBulkResult
+	if err = json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("Elasticsearch answered bulk actions with malformed response: %v", err)
+	} else if !result.Errors {
+		return nil
+	}
+	for _, item := range result.Items {
+		for action, outcome := range item {
+			// Deleting a document that is not indexed is fine
+			if outcome.Status/100 != 2 && !(action == "delete" && outcome.Status == http.StatusNotFound) {
+				return fmt.Errorf("Elasticsearch failed to %s a document: %d %s", action, outcome.Status, outcome.Error)
+			}
+		}
+	}
+	return nil
+}
+
+// Create the index with the mappings, unless it already exists.
+func (es *ElasticsearchPublisher) createIndex(index string, mappings json.RawMessage) error {
+	settings := []byte("{}")
+	if mappings != nil {
+		settings, _ = json.Marshal(map[string]json.RawMessage{"mappings": mappings})
+	}
+	status, body, err := es.request("PUT", "/"+index, "application/json", settings)
+	if err != nil {
+		return err
+	} else if status/100 != 2 && !bytes.Contains(body, []byte("resource_already_exists_exception")) {
+		return fmt.Errorf("Elasticsearch failed to create index %s: %d %s", index, status, body)
+	}
+	return nil
+}
+
+// Delete all documents of the index, if it exists.
+func (es *ElasticsearchPublisher) clearIndex(index string) error {
+	status, body, err := es.request("POST", "/"+index+"/_delete_by_query?conflicts=proceed&refresh=true", "application/json",
+		[]byte(`{"query":{"match_all":{}}}`))
+	if err != nil {
+		return err
+	} else if status/100 != 2 && status != http.StatusNotFound {
+		return fmt.Errorf("Elasticsearch failed to clear index %s: %d %s", index, status, body)
+	}
+	return nil
+}
+
+// Make a request to Elasticsearch and return the response status and body.
+func (es *ElasticsearchPublisher) request(method, path, contentType string, content []byte) (status int, body []byte, err error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(es.Endpoint, "/")+path, bytes.NewReader(content))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", contentType)
+	if es.User != "" {
+		req.SetBasicAuth(es.User, es.Password)
+	}
+	client := es.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
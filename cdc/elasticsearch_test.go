@@ -0,0 +1,197 @@
+package cdc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cankansin/tiedot/db"
+)
+
+// Elasticsearch that keeps indexed documents in memory, it fails to index documents into index failIndex.
+type fakeES struct {
+	lock      sync.Mutex
+	indexes   map[string]map[string]string // Index - document ID - document
+	mappings  map[string]string
+	failIndex string
+}
+
+func newFakeES() *fakeES {
+	return &fakeES{indexes: make(map[string]map[string]string), mappings: make(map[string]string)}
+}
+
+func (es *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	if user, pass, _ := r.BasicAuth(); user != "elastic" || pass != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	segs := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "PUT" && len(segs) == 1:
+		if _, exists := es.indexes[segs[0]]; exists {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"type":"resource_already_exists_exception"},"status":400}`)
+			return
+		}
+		es.indexes[segs[0]] = make(map[string]string)
+		es.mappings[segs[0]] = string(body)
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	case r.Method == "POST" && len(segs) == 2 && segs[1] == "_delete_by_query":
+		if _, exists := es.indexes[segs[0]]; !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"deleted":%d}`, len(es.indexes[segs[0]]))
+		es.indexes[segs[0]] = make(map[string]string)
+	case r.Method == "POST" && segs[0] == "_bulk" && r.Header.Get("Content-Type") == "application/x-ndjson":
+		items := make([]string, 0)
+		failed := false
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			var action map[string]struct {
+				Index string `json:"_index"`
+				ID    string `json:"_id"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if target, isIndex := action["index"]; isIndex {
+				scanner.Scan()
+				if target.Index == es.failIndex {
+					failed = true
+					items = append(items, `{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}`)
+					continue
+				}
+				if es.indexes[target.Index] == nil {
+					es.indexes[target.Index] = make(map[string]string)
+				}
+				es.indexes[target.Index][target.ID] = scanner.Text()
+				items = append(items, `{"index":{"status":201}}`)
+			} else if target, isDelete := action["delete"]; isDelete {
+				if _, exists := es.indexes[target.Index][target.ID]; !exists {
+					failed = true
+					items = append(items, `{"delete":{"status":404}}`)
+					continue
+				}
+				delete(es.indexes[target.Index], target.ID)
+				items = append(items, `{"delete":{"status":200}}`)
+			}
+		}
+		fmt.Fprintf(w, `{"errors":%v,"items":[%s]}`, failed, strings.Join(items, ","))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestElasticsearchPublisher(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tiedot_cdc_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	database, err := db.OpenDB(path.Join(tmp, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	for _, name := range []string{"Feeds", "Votes", "Other"} {
+		if err = database.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	feeds := database.Use("Feeds")
+	id1, err := feeds.Insert(map[string]interface{}{"title": "abc", "tags": []interface{}{map[string]interface{}{"name": "x"}, map[string]interface{}{"name": "y"}}, "secret": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	voteID, err := database.Use("Votes").Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = database.Use("Other").Insert(map[string]interface{}{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	es := newFakeES()
+	server := httptest.NewServer(es)
+	defer server.Close()
+	pub := &ElasticsearchPublisher{Endpoint: server.URL, User: "elastic", Password: "secret", Cols: map[string]ESIndex{
+		"Feeds": {Fields: map[string][]string{"title": {"title"}, "tag": {"tags", "name"}, "none": {"absent"}},
+			Mappings: json.RawMessage(`{"properties":{"title":{"type":"text"}}}`)},
+		"Votes": {Index: "votes"},
+	}}
+	exp := NewExporter(pub, Config{})
+	exp.db = database
+	// The entire collections are mirrored at first
+	if _, err = exp.Run(); err != nil {
+		t.Fatal(err)
+	}
+	id1Str := strconv.Itoa(id1)
+	if docs := es.indexes["tiedot-feeds"]; len(docs) != 1 || docs[id1Str] != `{"tag":["x","y"],"title":"abc"}` {
+		t.Fatal(docs)
+	} else if es.mappings["tiedot-feeds"] != `{"mappings":{"properties":{"title":{"type":"text"}}}}` || es.mappings["votes"] != "{}" {
+		t.Fatal(es.mappings)
+	} else if docs := es.indexes["votes"]; len(docs) != 1 || docs[strconv.Itoa(voteID)] != `{"a":1}` {
+		t.Fatal(docs)
+	} else if len(es.indexes) != 2 {
+		t.Fatal(es.indexes)
+	}
+	// Followed by changes
+	id2, err := feeds.Insert(map[string]interface{}{"title": "def"})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = feeds.Update(id1, map[string]interface{}{"title": "updated"}); err != nil {
+		t.Fatal(err)
+	} else if err = database.Use("Votes").Delete(voteID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = exp.Run(); err != nil {
+		t.Fatal(err)
+	} else if docs := es.indexes["tiedot-feeds"]; len(docs) != 2 || docs[id1Str] != `{"title":"updated"}` || docs[strconv.Itoa(id2)] != `{"title":"def"}` {
+		t.Fatal(docs)
+	} else if docs := es.indexes["votes"]; len(docs) != 0 {
+		t.Fatal(docs)
+	}
+	// Truncated collection replaces the documents of the index, failures are retried
+	if err = database.Truncate("Feeds"); err != nil {
+		t.Fatal(err)
+	}
+	id3, err := feeds.Insert(map[string]interface{}{"title": "ghi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	es.failIndex = "tiedot-feeds"
+	if _, err = exp.Run(); err == nil || !strings.Contains(err.Error(), "mapper_parsing_exception") {
+		t.Fatal(err)
+	}
+	es.failIndex = ""
+	if _, err = exp.Run(); err != nil {
+		t.Fatal(err)
+	} else if docs := es.indexes["tiedot-feeds"]; len(docs) != 1 || docs[strconv.Itoa(id3)] != `{"title":"ghi"}` {
+		t.Fatal(docs)
+	}
+	// Dropped collection leaves an empty index behind
+	if err = database.Drop("Feeds"); err != nil {
+		t.Fatal(err)
+	} else if _, err = exp.Run(); err != nil {
+		t.Fatal(err)
+	} else if docs, exists := es.indexes["tiedot-feeds"]; !exists || len(docs) != 0 {
+		t.Fatal(docs)
+	}
+	pub.Password = "wrong"
+	if err = pub.Publish([]Message{{Value: []byte(`{"col":"Votes","reset":true}`)}}); err == nil {
+		t.Fatal("did not error")
+	}
+}
@@ -0,0 +1,104 @@
+// Kafka publisher.
+//
+// Messages are produced through a Kafka REST proxy speaking REST API v2 (such as Confluent REST Proxy), which spares
+// tiedot a Kafka client: the messages of each topic are posted in one request, and the proxy answers once Kafka
+// acknowledged them, telling the partition and offset - or the error - of every message.
+
+package cdc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	KAFKA_CONTENT_TYPE = "application/vnd.kafka.json.v2+json" // Content type of produce requests with JSON keys and values.
+)
+
+// KafkaPublisher produces messages to Kafka topics through a Kafka REST proxy.
+type KafkaPublisher struct {
+	Endpoint string       // Base URL of the REST proxy, e.g. http://localhost:8082
+	Client   *http.Client // HTTP client, http.DefaultClient if nil.
+}
+
+// A produce request of REST API v2.
+type kafkaProduce struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// A produce response of REST API v2.
+type kafkaProduced struct {
+	Offsets []struct {
+		Partition int     `json:"partition"`
+		Offset    int64   `json:"offset"`
+		ErrorCode *int    `json:"error_code"`
+		Error     *string `json:"error"`
+	} `json:"offsets"`
+}
+
+// Produce the messages, the messages of each topic in one request.
+func (kafka *KafkaPublisher) Publish(msgs []Message) error {
+	topics := make([]string, 0)
+	records := make(map[string][]kafkaRecord)
+	for _, msg := range msgs {
+		if _, exists := records[msg.Topic]; !exists {
+			topics = append(topics, msg.Topic)
+		}
+		records[msg.Topic] = append(records[msg.Topic], kafkaRecord{Key: msg.Key, Value: msg.Value})
+	}
+	for _, topic := range topics {
+		if err := kafka.produce(topic, records[topic]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Produce the records to the topic, and verify that every one of them is acknowledged.
+func (kafka *KafkaPublisher) produce(topic string, records []kafkaRecord) error {
+	body, err := json.Marshal(kafkaProduce{Records: records})
+	if err != nil {
+		return err
+	}
+	client := kafka.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(strings.TrimSuffix(kafka.Endpoint, "/")+"/topics/"+url.PathEscape(topic), KAFKA_CONTENT_TYPE, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	} else if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Kafka REST proxy failed to produce to %s: %s %s", topic, resp.Status, respBody)
+	}
+	var produced kafkaProduced
+	if err = json.Unmarshal(respBody, &produced); err != nil {
+		return fmt.Errorf("Kafka REST proxy answered to %s with malformed response: %v", topic, err)
+	} else if len(produced.Offsets) != len(records) {
+		return fmt.Errorf("Kafka REST proxy acknowledged %d of %d messages to %s", len(produced.Offsets), len(records), topic)
+	}
+	for _, offset := range produced.Offsets {
+		if offset.ErrorCode != nil || offset.Error != nil {
+			msg := ""
+			if offset.Error != nil {
+				msg = *offset.Error
+			}
+			return fmt.Errorf("Kafka failed to store a message to %s: %s", topic, msg)
+		}
+	}
+	return nil
+}
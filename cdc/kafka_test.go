@@ -0,0 +1,84 @@
+package cdc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A Kafka REST proxy that keeps the produced records, it fails to store records of the topic failTopic.
+type fakeKafka struct {
+	lock      sync.Mutex
+	records   map[string][]kafkaRecord
+	failTopic string
+	dropAck   bool // Acknowledge one record less than produced
+}
+
+func (kafka *fakeKafka) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kafka.lock.Lock()
+	defer kafka.lock.Unlock()
+	if r.Method != "POST" || !strings.HasPrefix(r.URL.Path, "/topics/") || r.Header.Get("Content-Type") != KAFKA_CONTENT_TYPE {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	topic := strings.TrimPrefix(r.URL.Path, "/topics/")
+	body, _ := ioutil.ReadAll(r.Body)
+	var produce kafkaProduce
+	if err := json.Unmarshal(body, &produce); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	offsets := make([]string, 0)
+	for i, record := range produce.Records {
+		if topic == kafka.failTopic {
+			offsets = append(offsets, `{"partition":null,"offset":null,"error_code":50003,"error":"Kafka error"}`)
+			continue
+		}
+		kafka.records[topic] = append(kafka.records[topic], record)
+		offsets = append(offsets, fmt.Sprintf(`{"partition":0,"offset":%d}`, i))
+	}
+	if kafka.dropAck {
+		offsets = offsets[1:]
+	}
+	fmt.Fprintf(w, `{"offsets":[%s]}`, strings.Join(offsets, ","))
+}
+
+func TestKafkaPublisher(t *testing.T) {
+	kafka := &fakeKafka{records: make(map[string][]kafkaRecord)}
+	server := httptest.NewServer(kafka)
+	defer server.Close()
+	pub := &KafkaPublisher{Endpoint: server.URL + "/"}
+	msgs := []Message{
+		{Topic: "tiedot.a", Key: "a", Value: []byte(`{"seq":1,"col":"a","reset":true}`)},
+		{Topic: "tiedot.b", Key: "b/1", Value: []byte(`{"seq":1,"col":"b","id":1,"doc":{}}`)},
+		{Topic: "tiedot.a", Key: "a/2", Value: []byte(`{"seq":1,"col":"a","id":2,"doc":{}}`)},
+	}
+	if err := pub.Publish(msgs); err != nil {
+		t.Fatal(err)
+	}
+	if records := kafka.records["tiedot.a"]; len(records) != 2 || records[0].Key != "a" || records[1].Key != "a/2" ||
+		string(records[1].Value) != `{"seq":1,"col":"a","id":2,"doc":{}}` {
+		t.Fatal(records)
+	} else if records := kafka.records["tiedot.b"]; len(records) != 1 || records[0].Key != "b/1" {
+		t.Fatal(records)
+	}
+	// Errors of individual records and missing acknowledgements fail the batch
+	kafka.failTopic = "tiedot.b"
+	if err := pub.Publish(msgs); err == nil || !strings.Contains(err.Error(), "Kafka error") {
+		t.Fatal(err)
+	}
+	kafka.failTopic = ""
+	kafka.dropAck = true
+	if err := pub.Publish(msgs); err == nil {
+		t.Fatal("did not error")
+	}
+	pub.Endpoint = server.URL + "/nonsense"
+	if err := pub.Publish(msgs); err == nil {
+		t.Fatal("did not error")
+	}
+}
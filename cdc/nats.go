@@ -0,0 +1,198 @@
+// NATS publisher.
+//
+// Messages are published over the NATS client protocol, which is plain text over TCP, so that tiedot needs no NATS
+// client. Core NATS only confirms that the server received the messages - subscribers that are not connected at the
+// time miss them. For delivery at-least-once, bind the subjects to a JetStream stream and enable JetStream: every
+// message then carries a reply subject, and the batch is published once JetStream acknowledged each message on it.
+
+package cdc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	NATS_DEFAULT_TIMEOUT = 10 * time.Second // Default time to wait for the server to acknowledge a batch of messages.
+)
+
+// NATSPublisher publishes messages to NATS subjects. It is not safe for concurrent use.
+type NATSPublisher struct {
+	Addr      string        // Address of the NATS server, e.g. localhost:4222
+	User      string        // User name, optional.
+	Password  string        // Password of the user.
+	Token     string        // Authentication token, optional.
+	JetStream bool          // Wait for JetStream to acknowledge every message.
+	Timeout   time.Duration // Time to wait for the server to acknowledge a batch, NATS_DEFAULT_TIMEOUT if 0.
+
+	conn    net.Conn
+	reader  *bufio.Reader
+	inbox   string // Prefix of reply subjects of JetStream acknowledgements
+	batches int    // Number of batches published over the connection
+}
+
+// Publish the messages, connecting to the server first if necessary. The connection is closed upon failure.
+func (nats *NATSPublisher) Publish(msgs []Message) error {
+	if nats.conn == nil {
+		if err := nats.connect(); err != nil {
+			return err
+		}
+	}
+	err := nats.publish(msgs)
+	if err != nil {
+		nats.conn.Close()
+		nats.conn = nil
+	}
+	return err
+}
+
+// Close the connection to the server.
+func (nats *NATSPublisher) Close() error {
+	if nats.conn == nil {
+		return nil
+	}
+	err := nats.conn.Close()
+	nats.conn = nil
+	return err
+}
+
+// Return the time to wait for the server.
+func (nats *NATSPublisher) timeout() time.Duration {
+	if nats.Timeout > 0 {
+		return nats.Timeout
+	}
+	return NATS_DEFAULT_TIMEOUT
+}
+
+// Connect and authenticate to the server, and subscribe to JetStream acknowledgements if necessary.
+func (nats *NATSPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", nats.Addr, nats.timeout())
+	if err != nil {
+		return err
+	}
+	nats.conn, nats.reader, nats.batches = conn, bufio.NewReader(conn), 0
+	conn.SetDeadline(time.Now().Add(nats.timeout()))
+	if line, err := nats.reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		nats.conn = nil
+		return fmt.Errorf("NATS server %s did not introduce itself: %q %v", nats.Addr, line, err)
+	}
+	opts := map[string]interface{}{"verbose": false, "pedantic": false, "name": "tiedot", "lang": "go", "protocol": 1,
+		"headers": nats.JetStream, "no_responders": nats.JetStream}
+	if nats.User != "" {
+		opts["user"], opts["pass"] = nats.User, nats.Password
+	}
+	if nats.Token != "" {
+		opts["auth_token"] = nats.Token
+	}
+	optsJS, _ := json.Marshal(opts)
+	handshake := "CONNECT " + string(optsJS) + "\r\n"
+	if nats.JetStream {
+		nats.inbox = fmt.Sprintf("_INBOX.tiedot%x", rand.Int63())
+		handshake += "SUB " + nats.inbox + ".> 1\r\n"
+	}
+	if _, err = io.WriteString(conn, handshake+"PING\r\n"); err == nil {
+		_, err = nats.await(0)
+	}
+	if err != nil {
+		conn.Close()
+		nats.conn = nil
+	}
+	return err
+}
+
+// Publish the messages and wait for the server to acknowledge them.
+func (nats *NATSPublisher) publish(msgs []Message) error {
+	nats.conn.SetDeadline(time.Now().Add(nats.timeout()))
+	nats.batches++
+	writer := bufio.NewWriter(nats.conn)
+	for i, msg := range msgs {
+		if nats.JetStream {
+			fmt.Fprintf(writer, "PUB %s %s.%d.%d %d\r\n", msg.Topic, nats.inbox, nats.batches, i, len(msg.Value))
+		} else {
+			fmt.Fprintf(writer, "PUB %s %d\r\n", msg.Topic, len(msg.Value))
+		}
+		writer.Write(msg.Value)
+		writer.WriteString("\r\n")
+	}
+	writer.WriteString("PING\r\n")
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	expectAcks := 0
+	if nats.JetStream {
+		expectAcks = len(msgs)
+	}
+	_, err := nats.await(expectAcks)
+	return err
+}
+
+// Read from the server until it answers PING, and until the number of JetStream acknowledgements of the current batch
+// arrive. Return the number of acknowledgements.
+func (nats *NATSPublisher) await(expectAcks int) (acked int, err error) {
+	ackPrefix := fmt.Sprintf("%s.%d.", nats.inbox, nats.batches)
+	seen := make(map[string]bool)
+	for pong := false; !pong || acked < expectAcks; {
+		line, err := nats.reader.ReadString('\n')
+		if err != nil {
+			return acked, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			if _, err = io.WriteString(nats.conn, "PONG\r\n"); err != nil {
+				return acked, err
+			}
+		case "PONG":
+			pong = true
+		case "-ERR":
+			return acked, fmt.Errorf("NATS server %s: %s", nats.Addr, strings.TrimSpace(strings.TrimPrefix(line, fields[0])))
+		case "MSG", "HMSG":
+			// MSG <subject> <sid> [reply-to] <size>, HMSG <subject> <sid> [reply-to] <header size> <total size>
+			headerSize, size := 0, 0
+			if size, err = strconv.Atoi(fields[len(fields)-1]); err != nil || size < 0 {
+				return acked, fmt.Errorf("NATS server %s sent malformed message: %s", nats.Addr, line)
+			} else if fields[0] == "HMSG" && len(fields) > 4 {
+				headerSize, _ = strconv.Atoi(fields[len(fields)-2])
+			}
+			payload := make([]byte, size+2)
+			if _, err = io.ReadFull(nats.reader, payload); err != nil {
+				return acked, err
+			} else if headerSize > size {
+				return acked, fmt.Errorf("NATS server %s sent malformed message: %s", nats.Addr, line)
+			}
+			header, body := payload[:headerSize], payload[headerSize:size]
+			if len(fields) < 2 || !strings.HasPrefix(fields[1], ackPrefix) || seen[fields[1]] {
+				// An acknowledgement of an earlier batch or a duplicate
+				continue
+			} else if bytes.Contains(header, []byte(" 503")) {
+				return acked, fmt.Errorf("No JetStream stream of NATS server %s stores subject of %s", nats.Addr, fields[1])
+			}
+			var ack struct {
+				Error *struct {
+					Description string `json:"description"`
+				} `json:"error"`
+			}
+			if err = json.Unmarshal(body, &ack); err != nil {
+				return acked, fmt.Errorf("NATS server %s sent malformed acknowledgement: %s", nats.Addr, body)
+			} else if ack.Error != nil {
+				return acked, fmt.Errorf("JetStream of NATS server %s failed to store a message: %s", nats.Addr, ack.Error.Description)
+			}
+			seen[fields[1]] = true
+			acked++
+		}
+	}
+	return acked, nil
+}
@@ -0,0 +1,163 @@
+package cdc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A NATS server that keeps published messages. Running as JetStream, it acknowledges every message that carries a
+// reply subject, with an error for subject failAck, and with "no responders" for subject noStream.
+type fakeNATS struct {
+	lock      sync.Mutex
+	listener  net.Listener
+	jetStream bool
+	failAck   string
+	noStream  string
+	received  map[string][]string // Subject - payloads
+	connects  []string
+}
+
+func newFakeNATS(t *testing.T, jetStream bool) *fakeNATS {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nats := &fakeNATS{listener: listener, jetStream: jetStream, received: make(map[string][]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go nats.serve(conn)
+		}
+	}()
+	return nats
+}
+
+func (nats *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	io.WriteString(conn, `INFO {"server_id":"fake","version":"2.9.0","headers":true,"jetstream":true}`+"\r\n")
+	sid := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		nats.lock.Lock()
+		switch fields[0] {
+		case "CONNECT":
+			nats.connects = append(nats.connects, strings.TrimSpace(strings.TrimPrefix(line, "CONNECT")))
+		case "SUB":
+			sid = fields[len(fields)-1]
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err = io.ReadFull(reader, payload); err != nil {
+				nats.lock.Unlock()
+				return
+			}
+			subject := fields[1]
+			nats.received[subject] = append(nats.received[subject], string(payload[:size]))
+			if len(fields) == 4 && nats.jetStream {
+				reply := fields[2]
+				switch subject {
+				case nats.noStream:
+					header := "NATS/1.0 503\r\n\r\n"
+					fmt.Fprintf(conn, "HMSG %s %s %d %d\r\n%s\r\n", reply, sid, len(header), len(header), header)
+				case nats.failAck:
+					ack := `{"error":{"code":500,"description":"insufficient resources"}}`
+					fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", reply, sid, len(ack), ack)
+				default:
+					ack := fmt.Sprintf(`{"stream":"tiedot","seq":%d}`, len(nats.received[subject]))
+					// Acknowledge twice to verify that duplicates are ignored
+					fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", reply, sid, len(ack), ack)
+					fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", reply, sid, len(ack), ack)
+				}
+			}
+		case "PING":
+			io.WriteString(conn, "PING\r\nPONG\r\n")
+		}
+		nats.lock.Unlock()
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	msgs := []Message{
+		{Topic: "tiedot.a", Key: "a", Value: []byte(`{"seq":1,"col":"a","reset":true}`)},
+		{Topic: "tiedot.b", Key: "b/1", Value: []byte(`{"seq":1,"col":"b","id":1,"doc":{}}`)},
+		{Topic: "tiedot.a", Key: "a/2", Value: []byte(`{"seq":1,"col":"a","id":2,"doc":{}}`)},
+	}
+	// Core NATS
+	core := newFakeNATS(t, false)
+	defer core.listener.Close()
+	pub := &NATSPublisher{Addr: core.listener.Addr().String(), Token: "secret"}
+	defer pub.Close()
+	for i := 0; i < 2; i++ {
+		if err := pub.Publish(msgs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	core.lock.Lock()
+	if received := core.received["tiedot.a"]; len(received) != 4 || received[1] != `{"seq":1,"col":"a","id":2,"doc":{}}` {
+		t.Fatal(received)
+	} else if len(core.connects) != 1 || !strings.Contains(core.connects[0], `"auth_token":"secret"`) {
+		t.Fatal(core.connects)
+	}
+	core.lock.Unlock()
+	// JetStream acknowledges every message
+	js := newFakeNATS(t, true)
+	defer js.listener.Close()
+	pub = &NATSPublisher{Addr: js.listener.Addr().String(), User: "u", Password: "p", JetStream: true}
+	defer pub.Close()
+	for i := 0; i < 2; i++ {
+		if err := pub.Publish(msgs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	js.lock.Lock()
+	if received := js.received["tiedot.b"]; len(received) != 2 {
+		t.Fatal(received)
+	} else if len(js.connects) != 1 || !strings.Contains(js.connects[0], `"headers":true`) || !strings.Contains(js.connects[0], `"user":"u"`) {
+		t.Fatal(js.connects)
+	}
+	// Failed and missing acknowledgements fail the batch, and the next batch reconnects
+	js.failAck = "tiedot.b"
+	js.lock.Unlock()
+	if err := pub.Publish(msgs); err == nil || !strings.Contains(err.Error(), "insufficient resources") {
+		t.Fatal(err)
+	}
+	js.lock.Lock()
+	js.failAck, js.noStream = "", "tiedot.a"
+	js.lock.Unlock()
+	if err := pub.Publish(msgs); err == nil || !strings.Contains(err.Error(), "No JetStream stream") {
+		t.Fatal(err)
+	}
+	js.lock.Lock()
+	js.noStream = ""
+	js.lock.Unlock()
+	if err := pub.Publish(msgs); err != nil {
+		t.Fatal(err)
+	}
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	if len(js.connects) != 3 {
+		t.Fatal(js.connects)
+	}
+	// Unreachable server
+	pub = &NATSPublisher{Addr: "127.0.0.1:1"}
+	if err := pub.Publish(msgs); err == nil {
+		t.Fatal("did not error")
+	}
+}
@@ -0,0 +1,324 @@
+// Server configuration file.
+//
+// Given -config=file, the settings are read from a configuration file in a subset of TOML: [section] headers followed
+// by "key = value" lines, where a value is a quoted string, an integer, true or false, or a single-line array of
+// strings (joined by commas for the settings taking comma separated lists); durations are strings such as "30s". Each
+// setting of the file stands for a command-line flag (see configEntries), the flags given on the command line override
+// the file. Unknown sections and keys, settings given twice and values the flag does not accept are refused with the
+// line number, so that a typo does not silently leave a setting at its default.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Setting of the configuration file and the command-line flag it stands for.
+type configEntry struct {
+	section, key, flag string
+	secret             bool // The value is not printed along with the effective configuration
+}
+
+// Settings of the configuration file, in the order they are printed.
+var configEntries = []configEntry{
+	{section: "server", key: "mode", flag: "mode"},
+	{section: "server", key: "dir", flag: "dir"},
+	{section: "server", key: "db_profile", flag: "dbprofile"},
+	{section: "server", key: "gomaxprocs", flag: "gomaxprocs"},
+	{section: "server", key: "warmup", flag: "warmup"},
+	{section: "server", key: "manifest", flag: "manifest"},
+
+	{section: "listen", key: "bind", flag: "bind"},
+	{section: "listen", key: "port", flag: "port"},
+	{section: "listen", key: "unix_socket", flag: "unixsocket"},
+	{section: "listen", key: "unix_socket_mode", flag: "unixsocketmode"},
+	{section: "listen", key: "tls_crt", flag: "tlscrt"},
+	{section: "listen", key: "tls_key", flag: "tlskey"},
+	{section: "listen", key: "no_http2", flag: "nohttp2"},
+	{section: "listen", key: "no_keepalive", flag: "nokeepalive"},
+	{section: "listen", key: "compress_min_size", flag: "compressminsize"},
+	{section: "listen", key: "cors_origins", flag: "corsorigins"},
+	{section: "listen", key: "cors_methods", flag: "corsmethods"},
+	{section: "listen", key: "cors_headers", flag: "corsheaders"},
+	{section: "listen", key: "cors_max_age", flag: "corsmaxage"},
+
+	{section: "auth", key: "token", flag: "authtoken", secret: true},
+	{section: "auth", key: "jwt_pub_key", flag: "jwtpubkey"},
+	{section: "auth", key: "jwt_private_key", flag: "jwtprivatekey"},
+	{section: "auth", key: "doc_acl", flag: "docacl"},
+	{section: "auth", key: "stored_queries_only", flag: "storedqueriesonly"},
+	{section: "auth", key: "strict_queries", flag: "strictqueries"},
+
+	{section: "limits", key: "max_conns", flag: "maxconns"},
+	{section: "limits", key: "read_timeout", flag: "readtimeout"},
+	{section: "limits", key: "read_header_timeout", flag: "readheadertimeout"},
+	{section: "limits", key: "write_timeout", flag: "writetimeout"},
+	{section: "limits", key: "idle_timeout", flag: "idletimeout"},
+	{section: "limits", key: "freshness_wait", flag: "freshnesswait"},
+	{section: "limits", key: "idempotency_ttl", flag: "idempotencyttl"},
+
+	{section: "durability", key: "backup_dest", flag: "backupdest"},
+	{section: "durability", key: "backup_interval", flag: "backupinterval"},
+	{section: "durability", key: "backup_full_every", flag: "backupfullevery"},
+	{section: "durability", key: "backup_s3_endpoint", flag: "backups3endpoint"},
+	{section: "durability", key: "backup_s3_region", flag: "backups3region"},
+	{section: "durability", key: "follow_dir", flag: "followdir"},
+	{section: "durability", key: "follow_interval", flag: "followinterval"},
+
+	{section: "logging", key: "verbose", flag: "verbose"},
+	{section: "logging", key: "debug", flag: "debug"},
+	{section: "logging", key: "profile", flag: "profile"},
+	{section: "logging", key: "audit_log", flag: "auditlog"},
+	{section: "logging", key: "audit_col", flag: "auditcol"},
+	{section: "logging", key: "diagnostics", flag: "diagnostics"},
+	{section: "logging", key: "mutex_profile_fraction", flag: "mutexprofilefraction"},
+	{section: "logging", key: "block_profile_rate", flag: "blockprofilerate"},
+
+	{section: "cdc", key: "kafka", flag: "cdckafka"},
+	{section: "cdc", key: "nats", flag: "cdcnats"},
+	{section: "cdc", key: "nats_user", flag: "cdcnatsuser"},
+	{section: "cdc", key: "nats_password", flag: "cdcnatspassword", secret: true},
+	{section: "cdc", key: "nats_token", flag: "cdcnatstoken", secret: true},
+	{section: "cdc", key: "jetstream", flag: "cdcjetstream"},
+	{section: "cdc", key: "topic_prefix", flag: "cdctopicprefix"},
+	{section: "cdc", key: "interval", flag: "cdcinterval"},
+	{section: "cdc", key: "checkpoint", flag: "cdccheckpoint"},
+
+	{section: "essync", key: "url", flag: "essync"},
+	{section: "essync", key: "user", flag: "essyncuser"},
+	{section: "essync", key: "password", flag: "essyncpassword", secret: true},
+	{section: "essync", key: "index_prefix", flag: "essyncindexprefix"},
+	{section: "essync", key: "config", flag: "essyncconfig"},
+	{section: "essync", key: "interval", flag: "essyncinterval"},
+	{section: "essync", key: "checkpoint", flag: "essynccheckpoint"},
+
+	{section: "shadow", key: "targets", flag: "shadow"},
+	{section: "shadow", key: "token", flag: "shadowtoken", secret: true},
+
+	{section: "bench", key: "size", flag: "benchsize"},
+	{section: "bench", key: "cleanup", flag: "benchcleanup"},
+	{section: "bench", key: "dir", flag: "benchdir"},
+	{section: "bench", key: "docs", flag: "benchdocs"},
+	{section: "bench", key: "doc_size", flag: "benchdocsize"},
+	{section: "bench", key: "mix", flag: "benchmix"},
+	{section: "bench", key: "concurrency", flag: "benchconcurrency"},
+	{section: "bench", key: "duration", flag: "benchduration"},
+	{section: "bench", key: "indexes", flag: "benchindexes"},
+}
+
+// Value of a setting read from the configuration file.
+type configValue struct {
+	value string
+	line  int
+}
+
+// Return the settings of the configuration file content keyed by flag name.
+func parseConfig(content string) (values map[string]configValue, err error) {
+	values = make(map[string]configValue)
+	section := ""
+	for i, line := range strings.Split(content, "\n") {
+		lineNum := i + 1
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 || !isComment(line[end+1:]) {
+				return nil, fmt.Errorf("line %d: malformed section header %s", lineNum, line)
+			}
+			section = strings.TrimSpace(line[1:end])
+			if !isConfigSection(section) {
+				return nil, fmt.Errorf("line %d: unknown section [%s]", lineNum, section)
+			}
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expecting key = value, got %s", lineNum, line)
+		}
+		key := strings.TrimSpace(line[:eq])
+		entry, found := lookupConfigEntry(section, key)
+		if !found {
+			return nil, fmt.Errorf("line %d: unknown key %s in section [%s]", lineNum, key, section)
+		}
+		value, err := parseConfigValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", lineNum, key, err)
+		}
+		if prev, dup := values[entry.flag]; dup {
+			return nil, fmt.Errorf("line %d: %s is already set on line %d", lineNum, key, prev.line)
+		}
+		values[entry.flag] = configValue{value: value, line: lineNum}
+	}
+	return
+}
+
+// Return true if the remainder of a line is blank or a comment.
+func isComment(rest string) bool {
+	rest = strings.TrimSpace(rest)
+	return rest == "" || rest[0] == '#'
+}
+
+// Return true if there are settings in the section.
+func isConfigSection(section string) bool {
+	for _, entry := range configEntries {
+		if entry.section == section {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the setting of the key in the section.
+func lookupConfigEntry(section, key string) (configEntry, bool) {
+	for _, entry := range configEntries {
+		if entry.section == section && entry.key == key {
+			return entry, true
+		}
+	}
+	return configEntry{}, false
+}
+
+// Return the value in flag syntax: strings unquoted, arrays joined by commas, integers and booleans as they are.
+func parseConfigValue(raw string) (string, error) {
+	if raw == "" {
+		return "", fmt.Errorf("missing value")
+	}
+	switch raw[0] {
+	case '"', '\'':
+		value, rest, err := parseConfigString(raw)
+		if err != nil {
+			return "", err
+		} else if !isComment(rest) {
+			return "", fmt.Errorf("unexpected %s after the string", rest)
+		}
+		return value, nil
+	case '[':
+		var items []string
+		rest := strings.TrimSpace(raw[1:])
+		for {
+			if strings.HasPrefix(rest, "]") {
+				break
+			}
+			item, after, err := parseConfigString(rest)
+			if err != nil {
+				return "", fmt.Errorf("array items must be strings: %v", err)
+			}
+			items = append(items, item)
+			rest = strings.TrimSpace(after)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return "", fmt.Errorf("unterminated array, arrays must be on a single line")
+			}
+		}
+		if !isComment(rest[1:]) {
+			return "", fmt.Errorf("unexpected %s after the array", rest[1:])
+		}
+		return strings.Join(items, ","), nil
+	}
+	value := raw
+	if comment := strings.IndexByte(value, '#'); comment >= 0 {
+		value = strings.TrimSpace(value[:comment])
+	}
+	if value == "true" || value == "false" {
+		return value, nil
+	} else if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return value, nil
+	}
+	return "", fmt.Errorf("%s is not a quoted string, an integer, true or false, or an array of strings", value)
+}
+
+// Parse the quoted string at the beginning, and return its content along with the remainder.
+func parseConfigString(raw string) (value, rest string, err error) {
+	if raw == "" || raw[0] != '"' && raw[0] != '\'' {
+		return "", "", fmt.Errorf("expecting a quoted string, got %s", raw)
+	}
+	if raw[0] == '\'' {
+		// Literal string without escapes
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string %s", raw)
+		}
+		return raw[1 : end+1], raw[end+2:], nil
+	}
+	for i := 1; i < len(raw); i++ {
+		switch raw[i] {
+		case '\\':
+			i++
+		case '"':
+			if value, err = strconv.Unquote(raw[:i+1]); err != nil {
+				return "", "", fmt.Errorf("malformed string %s", raw[:i+1])
+			}
+			return value, raw[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string %s", raw)
+}
+
+// Read the configuration file and set the flags it configures, except those given on the command line.
+func loadConfig(flags *flag.FlagSet, path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values, err := parseConfig(string(content))
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for _, entry := range configEntries {
+		value, configured := values[entry.flag]
+		if !configured || given[entry.flag] {
+			continue
+		}
+		if err = flags.Set(entry.flag, value.value); err != nil {
+			return fmt.Errorf("%s: line %d: %s: %v", path, value.line, entry.key, err)
+		}
+	}
+	return nil
+}
+
+// Write the effective settings - defaults, overridden by the configuration file, overridden by the command line - in
+// the format of the configuration file. Secrets that are set are written as comments without their values.
+func printEffectiveConfig(flags *flag.FlagSet, w io.Writer) {
+	section := ""
+	for _, entry := range configEntries {
+		f := flags.Lookup(entry.flag)
+		if f == nil {
+			continue
+		}
+		if entry.section != section {
+			if section != "" {
+				fmt.Fprintln(w)
+			}
+			section = entry.section
+			fmt.Fprintf(w, "[%s]\n", section)
+		}
+		if entry.secret && f.Value.String() != "" {
+			fmt.Fprintf(w, "# %s = (set, not shown)\n", entry.key)
+			continue
+		}
+		fmt.Fprintf(w, "%s = %s\n", entry.key, formatConfigValue(f.Value))
+	}
+}
+
+// Return the flag value in the syntax of the configuration file.
+func formatConfigValue(value flag.Value) string {
+	if getter, ok := value.(flag.Getter); ok {
+		switch getter.Get().(type) {
+		case bool, int, int64, uint, uint64:
+			return value.String()
+		}
+	}
+	return strconv.Quote(value.String())
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	values, err := parseConfig(`# tiedot
+[server]
+mode = "httpd"   # run the server
+dir = '/var/lib/tiedot'
+
+[listen]
+port = 8080
+nohttp2 = true
+cors_origins = ["https://a.example.com", 'https://b.example.com']
+no_http2 = true
+bind = "a\"b"
+
+[limits]
+read_timeout = "30s"
+`)
+	if err == nil || !strings.Contains(err.Error(), "line 8") {
+		t.Fatal(err)
+	}
+	values, err = parseConfig(`[server]
+mode = "httpd"   # run the server
+dir = '/var/lib/tiedot'
+
+[listen]
+port = 8080
+cors_origins = ["https://a.example.com", 'https://b.example.com']
+no_http2 = true
+bind = "a\"b"
+
+[limits]
+read_timeout = "30s"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for flagName, value := range map[string]string{"mode": "httpd", "dir": "/var/lib/tiedot", "port": "8080", "nohttp2": "true",
+		"corsorigins": "https://a.example.com,https://b.example.com", "bind": `a"b`, "readtimeout": "30s"} {
+		if values[flagName].value != value {
+			t.Fatal(flagName, values[flagName])
+		}
+	}
+	if values["readtimeout"].line != 12 {
+		t.Fatal(values["readtimeout"])
+	}
+	for _, malformed := range []string{
+		"mode = \"httpd\"",                    // Outside of a section
+		"[nosuch]",                            // Unknown section
+		"[server\nmode = \"httpd\"",           // Malformed header
+		"[server]\nmode",                      // Missing value
+		"[server]\nmode =",                    // Missing value
+		"[server]\nmode = httpd",              // Unquoted string
+		"[server]\nmode = \"httpd",            // Unterminated string
+		"[server]\nmode = \"httpd\" x",        // Trailing content
+		"[listen]\nport = 1\nport = 2",        // Set twice
+		"[listen]\ncors_origins = [\"a\", 1]", // Array of other than strings
+		"[listen]\ncors_origins = [\"a\",",    // Multi-line array
+	} {
+		if _, err = parseConfig(malformed); err == nil {
+			t.Fatal("Did not refuse", malformed)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tiedot_config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "tiedot.toml")
+	flags := flag.NewFlagSet("tiedot", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	mode := flags.String("mode", "", "")
+	port := flags.Int("port", 8080, "")
+	readTimeout := flags.Duration("readtimeout", 0, "")
+	verbose := flags.Bool("verbose", false, "")
+	authToken := flags.String("authtoken", "", "")
+	if err = flags.Parse([]string{"-port=9090"}); err != nil {
+		t.Fatal(err)
+	}
+	// The command line overrides the file
+	content := "[server]\nmode = \"httpd\"\n[listen]\nport = 8081\n[limits]\nread_timeout = \"30s\"\n[logging]\nverbose = true\n" +
+		"[auth]\ntoken = \"secret\"\n"
+	if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = loadConfig(flags, path); err != nil {
+		t.Fatal(err)
+	} else if *mode != "httpd" || *port != 9090 || *readTimeout != 30*time.Second || !*verbose || *authToken != "secret" {
+		t.Fatal(*mode, *port, *readTimeout, *verbose, *authToken)
+	}
+	// Values the flag does not accept
+	badFlags := flag.NewFlagSet("tiedot", flag.ContinueOnError)
+	badFlags.SetOutput(ioutil.Discard)
+	badFlags.Duration("readtimeout", 0, "")
+	if err = ioutil.WriteFile(path, []byte("[limits]\nread_timeout = \"soon\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = loadConfig(badFlags, path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatal(err)
+	}
+	if err = loadConfig(flags, filepath.Join(tmp, "nosuch.toml")); err == nil {
+		t.Fatal("Did not fail")
+	}
+	// The effective settings read back the same, except for secrets
+	var out bytes.Buffer
+	printEffectiveConfig(flags, &out)
+	if !strings.Contains(out.String(), "# token = (set, not shown)") || strings.Contains(out.String(), "secret") {
+		t.Fatal(out.String())
+	}
+	values, err := parseConfig(out.String())
+	if err != nil {
+		t.Fatal(err, out.String())
+	}
+	for flagName, value := range map[string]string{"mode": "httpd", "port": "9090", "readtimeout": "30s", "verbose": "true"} {
+		if values[flagName].value != value {
+			t.Fatal(flagName, values[flagName], out.String())
+		}
+	}
+}
@@ -3,10 +3,12 @@
 // Every document has a binary header and UTF-8 text content.
 //
 // Documents are inserted one after another, and occupies 2x original document
-// size to leave room for future updates.
+// size to leave room for future updates (less with DocPadding of Config).
 //
 // Deleted documents are marked as deleted and the space is irrecoverable until
-// a "scrub" action (in DB logic) is carried out.
+// a "scrub" action (in DB logic) is carried out. On Linux, the disk space of
+// deleted documents is released by punching holes into the file, though the
+// file keeps its length.
 //
 // When update takes place, the new document may overwrite original document if
 // there is enough space, otherwise the original document is marked as deleted
@@ -18,6 +20,7 @@ import (
 	"encoding/binary"
 
 	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
 )
 
 // Collection file contains document headers and document text data.
@@ -29,14 +32,34 @@ type Collection struct {
 // Open a collection file.
 func (conf *Config) OpenCollection(path string) (col *Collection, err error) {
 	col = new(Collection)
-	col.DataFile, err = OpenDataFile(path, conf.ColFileGrowth)
+	if col.DataFile, err = conf.openDataFile(path, conf.ColFileGrowth, conf.ColInitialSize); err != nil {
+		return
+	} else if err = col.Advise(mapAdvice(conf.ColMapAdvice)); err != nil {
+		return
+	}
 	col.Config = conf
 	col.Config.CalculateConfigConstants()
 	return
 }
 
+// Apply the current memory usage settings to the open collection file.
+func (col *Collection) ApplySettings() error {
+	return col.applyFileSettings(col.DataFile, col.ColFileGrowth, col.ColInitialSize, col.ColMapAdvice)
+}
+
 // Find and retrieve a document by ID (physical document location). Return value is a copy of the document.
 func (col *Collection) Read(id int) []byte {
+	if doc := col.view(id); doc != nil {
+		docCopy := make([]byte, len(doc))
+		copy(docCopy, doc)
+		return docCopy
+	}
+	return nil
+}
+
+// Return the document at the ID (physical document location) as a slice of the mapped file, or nil if there is none.
+// The slice is only valid until the collection is modified.
+func (col *Collection) view(id int) []byte {
 	if id < 0 || id > col.Used-DocHeader || col.Buf[id] != 1 {
 		return nil
 	} else if room, _ := binary.Varint(col.Buf[id+1 : id+11]); room > int64(col.DocMaxRoom) {
@@ -44,15 +67,23 @@ func (col *Collection) Read(id int) []byte {
 	} else if docEnd := id + DocHeader + int(room); docEnd >= col.Size {
 		return nil
 	} else {
-		docCopy := make([]byte, room)
-		copy(docCopy, col.Buf[id+DocHeader:docEnd])
-		return docCopy
+		return col.Buf[id+DocHeader : docEnd]
 	}
 }
 
 // Insert a new document, return the new document ID.
 func (col *Collection) Insert(data []byte) (id int, err error) {
-	room := len(data) << 1
+	torn, err := injectFault(FAULT_WRITE, col.Path)
+	if err != nil && !torn {
+		return 0, err
+	}
+	return col.insert(data, err)
+}
+
+// Insert a new document, return the new document ID. With a torn write error, only the first half of the document is
+// written before failing with the error.
+func (col *Collection) insert(data []byte, tornErr error) (id int, err error) {
+	room := len(data) + len(data)*col.docPadding()/100
 	if room > col.DocMaxRoom {
 		return 0, dberr.New(dberr.ErrorDocTooLarge, col.DocMaxRoom, room)
 	}
@@ -65,6 +96,11 @@ func (col *Collection) Insert(data []byte) (id int, err error) {
 	// Write validity, room, document data and padding
 	col.Buf[id] = 1
 	binary.PutVarint(col.Buf[id+1:id+11], int64(room))
+	if tornErr != nil {
+		copy(col.Buf[id+DocHeader:col.Used], data[:len(data)/2])
+		col.MarkDirty(id, col.Used)
+		return id, tornErr
+	}
 	copy(col.Buf[id+DocHeader:col.Used], data)
 	for padding := id + DocHeader + len(data); padding < col.Used; padding += col.LenPadding {
 		copySize := col.LenPadding
@@ -73,6 +109,7 @@ func (col *Collection) Insert(data []byte) (id int, err error) {
 		}
 		copy(col.Buf[padding:padding+copySize], col.Padding)
 	}
+	col.MarkDirty(id, col.Used)
 	return
 }
 
@@ -92,9 +129,18 @@ func (col *Collection) Update(id int, data []byte) (newID int, err error) {
 	if docEnd := id + DocHeader + int(currentDocRoom); docEnd >= col.Size {
 		return 0, dberr.New(dberr.ErrorNoDoc, id)
 	}
+	torn, err := injectFault(FAULT_WRITE, col.Path)
+	if err != nil && !torn {
+		return 0, err
+	}
 	if dataLen <= int(currentDocRoom) {
 		padding := id + DocHeader + len(data)
 		paddingEnd := id + DocHeader + int(currentDocRoom)
+		if torn {
+			copy(col.Buf[id+DocHeader:padding], data[:dataLen/2])
+			col.MarkDirty(id+DocHeader, padding)
+			return id, err
+		}
 		// Overwrite data and then overwrite padding
 		copy(col.Buf[id+DocHeader:padding], data)
 		for ; padding < paddingEnd; padding += col.LenPadding {
@@ -104,12 +150,13 @@ func (col *Collection) Update(id int, data []byte) (newID int, err error) {
 			}
 			copy(col.Buf[padding:padding+copySize], col.Padding)
 		}
+		col.MarkDirty(id+DocHeader, paddingEnd)
 		return id, nil
 	}
 
 	// No enough room - re-insert the document
 	col.Delete(id)
-	return col.Insert(data)
+	return col.insert(data, err)
 }
 
 // Delete a document by ID.
@@ -121,8 +168,50 @@ func (col *Collection) Delete(id int) error {
 
 	if col.Buf[id] == 1 {
 		col.Buf[id] = 0
+		col.MarkDirty(id, id+1)
 	}
+	// Release the whole pages of a large document right away, the header remains for scanning the file
+	if room, _ := binary.Varint(col.Buf[id+1 : id+11]); room > 0 && room <= int64(col.DocMaxRoom) && id+DocHeader+int(room) <= col.Used {
+		if err := col.PunchHole(id+DocHeader, id+DocHeader+int(room)); err != nil {
+			tdlog.CritNoRepeat("Failed to release space of deleted document in %s: %v", col.Path, err)
+		}
+	}
+
+	return nil
+}
 
+// Release the disk space of deleted documents, where the platform and file system support punching holes. Runs of
+// adjacent deleted documents are merged into one deleted document - up to the maximum document room - so that the space
+// of small documents is released as well. Only the headers of deleted documents remain, for scanning the file.
+func (col *Collection) PunchHoles() error {
+	for id := 0; id < col.Used-DocHeader; {
+		validity := col.Buf[id]
+		room, _ := binary.Varint(col.Buf[id+1 : id+11])
+		docEnd := id + DocHeader + int(room)
+		if validity > 1 || room <= 0 || room > int64(col.DocMaxRoom) || docEnd > col.Used {
+			// Leave the rest of a corrupted file alone, scrub recovers its documents
+			return nil
+		} else if validity == 1 {
+			id = docEnd
+			continue
+		}
+		for docEnd < col.Used-DocHeader && col.Buf[docEnd] == 0 {
+			nextRoom, _ := binary.Varint(col.Buf[docEnd+1 : docEnd+11])
+			nextEnd := docEnd + DocHeader + int(nextRoom)
+			if nextRoom <= 0 || nextEnd > col.Used || nextEnd-id-DocHeader > col.DocMaxRoom {
+				break
+			}
+			docEnd = nextEnd
+		}
+		if merged := int64(docEnd - id - DocHeader); merged != room {
+			binary.PutVarint(col.Buf[id+1:id+11], merged)
+			col.MarkDirty(id+1, id+11)
+		}
+		if err := col.PunchHole(id+DocHeader, docEnd); err != nil {
+			return err
+		}
+		id = docEnd
+	}
 	return nil
 }
 
@@ -6,13 +6,22 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/gommap"
+	"github.com/cankansin/tiedot/tdlog"
 )
 
 const (
-	DefaultDocMaxRoom = 2 * 1048576 // DefaultDocMaxRoom is the default maximum size a single document may never exceed.
-	DocHeader         = 1 + 10      // DocHeader is the size of document header fields.
-	EntrySize         = 1 + 10 + 10 // EntrySize is the size of a single hash table entry.
-	BucketHeader      = 10          // BucketHeader is the size of hash table bucket's header fields.
+	DefaultDocMaxRoom      = 2 * 1048576 // DefaultDocMaxRoom is the default maximum size a single document may never exceed.
+	DefaultMaxDocDepth     = 100         // DefaultMaxDocDepth is the maximum nesting depth of objects and arrays in a document of a new database.
+	DefaultFlushInterval   = 2000        // DefaultFlushInterval is the default interval (in milliseconds) between background flushes of written data to disk.
+	DefaultGroupCommitWait = 1000        // DefaultGroupCommitWait is the default time (in microseconds) a durable write waits for concurrent writes to flush together.
+	DefaultMapReserve      = 1 << 30     // DefaultMapReserve is the default address space (in bytes) reserved for the growth of each file map.
+	DefaultMaxOpenFiles    = 512         // DefaultMaxOpenFiles is the default number of data file handles kept open at a time.
+	DocHeader              = 1 + 10      // DocHeader is the size of document header fields.
+	EntrySize              = 1 + 10 + 10 // EntrySize is the size of a single hash table entry.
+	BucketHeader           = 10          // BucketHeader is the size of hash table bucket's header fields.
 )
 
 /*
@@ -26,23 +35,126 @@ type Config struct {
 	HTFileGrowth  int  /// HTFileGrowth is the size (in bytes) to grow hash table file to fit in more entries.
 	HashBits      uint // HashBits is the number of bits to consider for hashing indexed key, also determines the initial number of buckets in a hash table file.
 
+	// The following parameters only influence memory usage, they may be adjusted at any time and take effect upon next start or Reload.
+	ColMapAdvice      string // ColMapAdvice is the access pattern ("normal", "random" or "sequential") advised for collection data file maps.
+	HTMapAdvice       string // HTMapAdvice is the access pattern ("normal", "random" or "sequential") advised for hash table file maps.
+	DontNeedAfterScan bool   // DontNeedAfterScan releases memory pages of collection data after scanning all documents.
+	MaxPrealloc       int    // MaxPrealloc caps the size (in bytes) pre-allocated to a file at a time, 0 means the entire file growth.
+	SparseFiles       bool   // SparseFiles pre-allocates space without writing to disk, so that the space occupies disk only once it is used.
+	ColInitialSize    int    // ColInitialSize is the size (in bytes) of a new collection data file, 0 means ColFileGrowth.
+	HTInitialSize     int    // HTInitialSize is the size (in bytes) of a new hash table file, 0 means HTFileGrowth.
+	FlushInterval     int    // FlushInterval is the interval (in milliseconds) between background flushes of written data to disk, 0 means no background flush.
+	MapReserve        int    // MapReserve is the address space (in bytes) reserved beyond each file map, so that a file grows without being mapped again, 0 means no reservation.
+	MaxOpenFiles      int    // MaxOpenFiles is the number of data file handles kept open at a time, the least recently used are closed and opened again on use, 0 means unlimited.
+
+	// The following parameters control durability of writes, they may be adjusted at any time and take effect upon next start or Reload.
+	DurableWrites   bool // DurableWrites makes every write return only once the data it wrote is flushed to disk.
+	GroupCommitWait int  // GroupCommitWait is the time (in microseconds) a durable write waits for concurrent writes to join its flush.
+
+	// The following parameters limit the documents accepted into database, they may be adjusted at any time and take effect upon next start or Reload.
+	MaxDocSize  int // MaxDocSize is the maximum size (in bytes) of a serialised document, 0 means DocMaxRoom.
+	MaxDocDepth int // MaxDocDepth is the maximum nesting depth of objects and arrays in a document, 0 means unlimited.
+
+	// The following parameter limits waiting for locks, it may be adjusted at any time and takes effect upon next start or Reload.
+	LockTimeout int // LockTimeout is the time (in milliseconds) a document read or write waits for a lock before it fails, 0 means indefinitely.
+
+	// The following parameter controls the room of new documents, it may be adjusted at any time and takes effect upon next start or Reload.
+	DocPadding int // DocPadding is the room (in percent of the document size) reserved for a new document to grow by updates, 0 means 100.
+
+	// The following parameter controls opening the database, it may be adjusted at any time and takes effect upon next start.
+	OpenWorkers int // OpenWorkers is the number of files opened at a time while collections are opened, 0 means the number of CPUs.
+
 	InitialBuckets int    `json:"-"` // InitialBuckets is the number of buckets initially allocated in a hash table file.
 	Padding        string `json:"-"` // Padding is pre-allocated filler (space characters) for new documents.
 	LenPadding     int    `json:"-"` // LenPadding is the calculated length of Padding string.
 	BucketSize     int    `json:"-"` // BucketSize is the calculated size of each hash table bucket.
+
+	handles *handleBudget // Open handles of the data files opened with the configuration
+}
+
+// Return the mmap advice by its name in configuration, unknown names are treated as "normal".
+func mapAdvice(name string) gommap.Advice {
+	switch name {
+	case "random":
+		return gommap.ADVICE_RANDOM
+	case "sequential":
+		return gommap.ADVICE_SEQUENTIAL
+	case "", "normal":
+		return gommap.ADVICE_NORMAL
+	}
+	tdlog.CritNoRepeat("Unknown mmap advice \"%s\", using \"normal\" instead", name)
+	return gommap.ADVICE_NORMAL
+}
+
+// Open a data file according to the pre-allocation settings.
+func (conf *Config) openDataFile(path string, growth, initialSize int) (file *DataFile, err error) {
+	file = &DataFile{Path: path, Growth: conf.cappedGrowth(growth), Sparse: conf.SparseFiles, InitialSize: initialSize, MapReserve: conf.MapReserve, handles: conf.handles}
+	err = file.open()
+	return
+}
+
+// Apply the memory usage settings to an open data file, the file is not mapped again.
+func (conf *Config) applyFileSettings(file *DataFile, growth, initialSize int, advice string) error {
+	file.Growth, file.InitialSize, file.MapReserve = conf.cappedGrowth(growth), initialSize, conf.MapReserve
+	if conf.SparseFiles && !file.Sparse {
+		if err := file.useHandle(); err != nil {
+			return err
+		}
+		err := markSparse(file.Fh)
+		file.doneHandle()
+		if err != nil {
+			return err
+		}
+	}
+	file.Sparse = conf.SparseFiles
+	return file.Advise(mapAdvice(advice))
+}
+
+// Return the file growth capped by pre-allocation limit.
+func (conf *Config) cappedGrowth(growth int) int {
+	if conf.MaxPrealloc > 0 && growth > conf.MaxPrealloc {
+		return conf.MaxPrealloc
+	}
+	return growth
+}
+
+// Return the room reserved for a new document to grow, in percent of the document size.
+func (conf *Config) docPadding() int {
+	if conf.DocPadding > 0 {
+		return conf.DocPadding
+	}
+	return 100
 }
 
 // CalculateConfigConstants assignes internal field values to calculation results derived from other fields.
+// Files of a collection are opened concurrently, each calculating the values again, so that a value is only assigned if
+// it changed.
 func (conf *Config) CalculateConfigConstants() {
-	conf.Padding = strings.Repeat(" ", 128)
-	conf.LenPadding = len(conf.Padding)
+	if conf.LenPadding != 128 {
+		conf.Padding = strings.Repeat(" ", 128)
+		conf.LenPadding = len(conf.Padding)
+	}
 
-	conf.BucketSize = BucketHeader + conf.PerBucket*EntrySize
-	conf.InitialBuckets = 1 << conf.HashBits
+	if bucketSize := BucketHeader + conf.PerBucket*EntrySize; conf.BucketSize != bucketSize {
+		conf.BucketSize = bucketSize
+	}
+	if initialBuckets := 1 << conf.HashBits; conf.InitialBuckets != initialBuckets {
+		conf.InitialBuckets = initialBuckets
+	}
+	if conf.handles == nil {
+		conf.handles = newHandleBudget()
+	}
+	conf.handles.setMax(conf.MaxOpenFiles)
 }
 
 // CreateOrReadConfig creates default performance configuration underneath the input database directory.
 func CreateOrReadConfig(path string) (conf *Config, err error) {
+	return CreateOrReadProfileConfig(path, PROFILE_DEFAULT)
+}
+
+// CreateOrReadProfileConfig creates performance configuration of the profile underneath the input database directory.
+// The profile is only used if the directory does not have a configuration yet.
+func CreateOrReadProfileConfig(path, profile string) (conf *Config, err error) {
 	var file *os.File
 	var j []byte
 
@@ -54,6 +166,10 @@ func CreateOrReadConfig(path string) (conf *Config, err error) {
 
 	// set the default dataConfig
 	conf = defaultConfig()
+	profileConf, err := ProfileConfig(profile)
+	if err != nil {
+		return nil, err
+	}
 
 	// try to open the file
 	if file, err = os.OpenFile(filePath, os.O_RDONLY, 0644); err != nil {
@@ -61,6 +177,9 @@ func CreateOrReadConfig(path string) (conf *Config, err error) {
 			// if we could not find the file because it doesn't exist, lets create it
 			// so the database always runs with these settings
 			err = nil
+			conf = profileConf
+			// new databases limit document depth, existing ones without the setting are left unlimited
+			conf.MaxDocDepth = DefaultMaxDocDepth
 
 			if file, err = os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644); err != nil {
 				return
@@ -97,17 +216,64 @@ func CreateOrReadConfig(path string) (conf *Config, err error) {
 	return
 }
 
+// Reload re-reads the memory usage settings and document limits from the configuration file underneath the database
+// directory. Changes to the other settings only take effect upon next start and are left alone. (Use ApplySettings of
+// each partition and hash table to apply the reloaded settings to open files.)
+func (conf *Config) Reload(path string) error {
+	content, err := ioutil.ReadFile(fmt.Sprintf("%s/data-config.json", path))
+	if err != nil {
+		return err
+	}
+	newConf := defaultConfig()
+	if err = json.Unmarshal(content, newConf); err != nil {
+		return err
+	}
+	// Refuse the entire file if any of the reloaded settings is invalid
+	for name, val := range map[string]int{"MaxPrealloc": newConf.MaxPrealloc, "ColInitialSize": newConf.ColInitialSize, "HTInitialSize": newConf.HTInitialSize, "MaxDocSize": newConf.MaxDocSize, "MaxDocDepth": newConf.MaxDocDepth, "FlushInterval": newConf.FlushInterval,
+		"MapReserve": newConf.MapReserve, "MaxOpenFiles": newConf.MaxOpenFiles, "GroupCommitWait": newConf.GroupCommitWait, "LockTimeout": newConf.LockTimeout, "DocPadding": newConf.DocPadding} {
+		if val < 0 {
+			return dberr.New(dberr.ErrorInvalidParam, name, val)
+		}
+	}
+	if newConf.DocMaxRoom != conf.DocMaxRoom || newConf.ColFileGrowth != conf.ColFileGrowth || newConf.PerBucket != conf.PerBucket ||
+		newConf.HTFileGrowth != conf.HTFileGrowth || newConf.HashBits != conf.HashBits {
+		tdlog.Noticef("Configuration of %s changed, DocMaxRoom, ColFileGrowth, PerBucket, HTFileGrowth and HashBits take effect upon next start", path)
+	}
+	conf.ColMapAdvice = newConf.ColMapAdvice
+	conf.HTMapAdvice = newConf.HTMapAdvice
+	conf.DontNeedAfterScan = newConf.DontNeedAfterScan
+	conf.MaxPrealloc = newConf.MaxPrealloc
+	conf.SparseFiles = newConf.SparseFiles
+	conf.ColInitialSize = newConf.ColInitialSize
+	conf.HTInitialSize = newConf.HTInitialSize
+	conf.FlushInterval = newConf.FlushInterval
+	conf.MapReserve = newConf.MapReserve
+	conf.MaxOpenFiles = newConf.MaxOpenFiles
+	conf.handles.setMax(conf.MaxOpenFiles)
+	conf.DurableWrites = newConf.DurableWrites
+	conf.GroupCommitWait = newConf.GroupCommitWait
+	conf.MaxDocSize = newConf.MaxDocSize
+	conf.MaxDocDepth = newConf.MaxDocDepth
+	conf.LockTimeout = newConf.LockTimeout
+	conf.DocPadding = newConf.DocPadding
+	return nil
+}
+
 func defaultConfig() *Config {
 	/*
 		The default configuration matches the constants defined in tiedot version 3.2 and older. They correspond to ~16MB
 		of space per computer CPU core being pre-allocated to each collection.
 	*/
 	ret := &Config{
-		DocMaxRoom:    DefaultDocMaxRoom,
-		ColFileGrowth: COL_FILE_GROWTH,
-		PerBucket:     16,
-		HTFileGrowth:  HT_FILE_GROWTH,
-		HashBits:      HASH_BITS,
+		DocMaxRoom:      DefaultDocMaxRoom,
+		ColFileGrowth:   COL_FILE_GROWTH,
+		PerBucket:       16,
+		HTFileGrowth:    HT_FILE_GROWTH,
+		HashBits:        HASH_BITS,
+		FlushInterval:   DefaultFlushInterval,
+		MapReserve:      DefaultMapReserve,
+		MaxOpenFiles:    DefaultMaxOpenFiles,
+		GroupCommitWait: DefaultGroupCommitWait,
 	}
 
 	ret.CalculateConfigConstants()
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"testing"
+
+	"github.com/cankansin/tiedot/gommap"
 )
 
 /*
@@ -26,6 +28,10 @@ func TestEmtpyJsonConfig(t *testing.T) {
 	if err := verifyConfigFromPath(tmp, d); err != nil {
 		t.Fatal(err)
 	}
+	// A new database limits document depth
+	if conf, err := CreateOrReadConfig(tmp); err != nil || conf.MaxDocDepth != DefaultMaxDocDepth {
+		t.Fatal(conf, err)
+	}
 }
 
 /*
@@ -65,6 +71,10 @@ func TestConfiguredJsonConfig(t *testing.T) {
 	if err := verifyConfigFromPath(tmp, d); err != nil {
 		t.Fatal(err)
 	}
+	// An existing database without document limits stays unlimited
+	if conf, err := CreateOrReadConfig(tmp); err != nil || conf.MaxDocDepth != 0 {
+		t.Fatal(conf, err)
+	}
 }
 
 func verifyConfigFromPath(path string, assertData *Config) (err error) {
@@ -112,3 +122,20 @@ func matchConfig(d1, d2 *Config) error {
 
 	return nil
 }
+
+func TestMapAdviceAndCappedGrowth(t *testing.T) {
+	for name, advice := range map[string]gommap.Advice{"": gommap.ADVICE_NORMAL, "normal": gommap.ADVICE_NORMAL,
+		"random": gommap.ADVICE_RANDOM, "sequential": gommap.ADVICE_SEQUENTIAL, "bogus": gommap.ADVICE_NORMAL} {
+		if mapAdvice(name) != advice {
+			t.Fatal(name, mapAdvice(name))
+		}
+	}
+	conf := defaultConfig()
+	if conf.cappedGrowth(1048576) != 1048576 {
+		t.Fatal("Capped growth without limit")
+	}
+	conf.MaxPrealloc = 4096
+	if conf.cappedGrowth(1048576) != 4096 || conf.cappedGrowth(1024) != 1024 {
+		t.Fatal("Incorrect capped growth")
+	}
+}
@@ -0,0 +1,129 @@
+// Fault injection.
+//
+// For testing only: applications embedding tiedot may inject faults into the storage operations of data files, to test
+// how they handle errors and recover from them. A fault fails or delays the operations it matches - by operation and
+// by a part of the data file path, such as the database directory or a collection name - optionally only after a
+// number of operations, a number of times, or at random. A torn document write writes the first half of the document
+// and fails, as would a crash in the middle of the write.
+//
+// Injected faults apply to all databases of the process until removed. Without faults, each storage operation costs an
+// extra atomic load.
+
+package data
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+const (
+	FAULT_OPEN   = "open"   // Opening a data file
+	FAULT_GROW   = "grow"   // Growing a data file
+	FAULT_FLUSH  = "flush"  // Flushing a data file to disk
+	FAULT_READ   = "read"   // Reading a document
+	FAULT_WRITE  = "write"  // Inserting or updating a document, may be torn
+	FAULT_DELETE = "delete" // Deleting a document
+)
+
+// Fault describes the failure or delay of storage operations.
+type Fault struct {
+	Op          string        // Operation, one of FAULT_*; empty - all operations
+	Path        string        // Only data files whose path contains this, empty - all data files
+	Err         error         // Error of the operation, nil - the operation only waits for Latency (or fails with ErrorInjected if Torn)
+	Latency     time.Duration // Time the operation waits before it proceeds or fails
+	Torn        bool          // A document write writes the first half of the document before it fails
+	After       int           // Number of matching operations that proceed before the fault is injected
+	Times       int           // Number of times the fault is injected, 0 - until removed
+	Probability float64       // Chance of injecting the fault into a matching operation, 0 - always
+}
+
+// Injection is a fault injected into storage operations.
+type Injection struct {
+	fault    Fault
+	matched  int // Number of operations matched so far, guarded by faultsLock
+	injected int // Number of times the fault was injected, guarded by faultsLock
+}
+
+var (
+	faultsLock   = new(sync.Mutex)
+	faults       []*Injection
+	faultsActive int32 // Number of injected faults, checked without the lock
+)
+
+// Inject the fault into the matching storage operations of all data files, until removed.
+func InjectFault(fault Fault) *Injection {
+	injection := &Injection{fault: fault}
+	faultsLock.Lock()
+	faults = append(faults, injection)
+	atomic.StoreInt32(&faultsActive, int32(len(faults)))
+	faultsLock.Unlock()
+	return injection
+}
+
+// Remove all injected faults.
+func ClearFaults() {
+	faultsLock.Lock()
+	faults = nil
+	atomic.StoreInt32(&faultsActive, 0)
+	faultsLock.Unlock()
+}
+
+// Stop injecting the fault.
+func (injection *Injection) Remove() {
+	faultsLock.Lock()
+	defer faultsLock.Unlock()
+	for i, injected := range faults {
+		if injected == injection {
+			faults = append(faults[:i:i], faults[i+1:]...)
+			break
+		}
+	}
+	atomic.StoreInt32(&faultsActive, int32(len(faults)))
+}
+
+// Return the number of times the fault was injected.
+func (injection *Injection) Count() int {
+	faultsLock.Lock()
+	defer faultsLock.Unlock()
+	return injection.injected
+}
+
+// Wait for the latency of the faults matching the operation on the file, and return whether a document write is to be
+// torn and the error of the first failing fault.
+func injectFault(op, path string) (torn bool, err error) {
+	if atomic.LoadInt32(&faultsActive) == 0 {
+		return false, nil
+	}
+	var latency time.Duration
+	faultsLock.Lock()
+	for _, injection := range faults {
+		fault := &injection.fault
+		if fault.Op != "" && fault.Op != op || !strings.Contains(path, fault.Path) {
+			continue
+		} else if injection.matched++; injection.matched <= fault.After {
+			continue
+		} else if fault.Times > 0 && injection.injected >= fault.Times {
+			continue
+		} else if fault.Probability > 0 && rand.Float64() >= fault.Probability {
+			continue
+		}
+		injection.injected++
+		latency += fault.Latency
+		if err == nil {
+			if err = fault.Err; err == nil && fault.Torn {
+				err = dberr.New(dberr.ErrorInjected, op, path)
+			}
+			torn = fault.Torn && op == FAULT_WRITE
+		}
+	}
+	faultsLock.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	return
+}
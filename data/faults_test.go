@@ -0,0 +1,101 @@
+package data
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestFaults(t *testing.T) {
+	colPath := "/tmp/tiedot_test_faults_col"
+	htPath := "/tmp/tiedot_test_faults_ht"
+	os.Remove(colPath)
+	os.Remove(htPath)
+	defer os.Remove(colPath)
+	defer os.Remove(htPath)
+	defer ClearFaults()
+	d := defaultConfig()
+	eio := errors.New("input/output error")
+	// Opening fails, only for the matching path
+	open := InjectFault(Fault{Op: FAULT_OPEN, Path: "faults_col", Err: eio})
+	if _, err := d.OpenPartition(colPath, htPath); err != eio {
+		t.Fatal(err)
+	} else if ht, err := d.OpenHashTable(htPath); err != nil {
+		t.Fatal(err)
+	} else if err = ht.Close(); err != nil {
+		t.Fatal(err)
+	} else if open.Count() != 1 {
+		t.Fatal(open.Count())
+	}
+	open.Remove()
+	part, err := d.OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.Close()
+	// Writes fail after the first two, twice
+	write := InjectFault(Fault{Op: FAULT_WRITE, Err: eio, After: 2, Times: 2})
+	for id := 1; id <= 5; id++ {
+		_, err := part.Insert(id, []byte("doc"))
+		if failing := id == 3 || id == 4; failing && err != eio || !failing && err != nil {
+			t.Fatal(id, err)
+		}
+	}
+	if write.Count() != 2 {
+		t.Fatal(write.Count())
+	}
+	write.Remove()
+	// A torn insert or update writes half of the document
+	InjectFault(Fault{Op: FAULT_WRITE, Torn: true, Times: 2})
+	physID, err := part.col.Insert([]byte("abcdef"))
+	if dberr.Type(err) != dberr.ErrorInjected {
+		t.Fatal(err)
+	} else if doc := part.col.Read(physID); !strings.HasPrefix(string(doc), "abc\x00") {
+		t.Fatalf("%q", doc)
+	} else if err = part.Update(1, []byte("123456")); dberr.Type(err) != dberr.ErrorInjected {
+		t.Fatal(err)
+	} else if doc, _ := part.Read(1); string(doc) != "123   " {
+		t.Fatalf("%q", doc)
+	}
+	// Reads, deletions, growth and flushes fail, latency delays the operation
+	ClearFaults()
+	InjectFault(Fault{Op: FAULT_READ, Err: eio, Times: 1})
+	InjectFault(Fault{Op: FAULT_DELETE, Err: eio, Times: 1})
+	InjectFault(Fault{Op: FAULT_GROW, Err: eio, Times: 1})
+	InjectFault(Fault{Op: FAULT_FLUSH, Err: eio, Times: 1})
+	if _, err = part.Read(1); err != eio {
+		t.Fatal(err)
+	} else if err = part.Delete(1); err != eio {
+		t.Fatal(err)
+	} else if _, err = part.Read(1); err != nil {
+		t.Fatal(err)
+	} else if err = part.col.EnsureSize(part.col.Size); err != eio {
+		t.Fatal(err)
+	} else if err = part.col.Flush(); err != eio {
+		t.Fatal(err)
+	} else if err = part.col.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	InjectFault(Fault{Op: FAULT_READ, Latency: 50 * time.Millisecond})
+	start := time.Now()
+	if _, err = part.Read(1); err != nil || time.Since(start) < 50*time.Millisecond {
+		t.Fatal(err, time.Since(start))
+	}
+	// A fault injected at random is injected into some of the operations
+	ClearFaults()
+	random := InjectFault(Fault{Op: FAULT_READ, Err: eio, Probability: 0.5})
+	for i := 0; i < 1000; i++ {
+		part.Read(1)
+	}
+	if n := random.Count(); n < 300 || n > 700 {
+		t.Fatal(n)
+	}
+	ClearFaults()
+	if _, err = part.Read(1); err != nil {
+		t.Fatal(err)
+	}
+}
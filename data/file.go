@@ -3,20 +3,52 @@
 package data
 
 import (
+	"container/list"
+	"fmt"
 	"os"
+	"runtime"
+	"sort"
+	"sync"
 
+	"github.com/cankansin/tiedot/dberr"
 	"github.com/cankansin/tiedot/gommap"
 	"github.com/cankansin/tiedot/tdlog"
 )
 
+const (
+	FLUSH_EXTENT = 65536 // Size of the extents of a data file that are tracked as written and flushed to disk.
+)
+
 // Data file keeps track of the amount of total and used space.
 type DataFile struct {
 	Path               string
 	Size, Used, Growth int
 	Fh                 *os.File
 	Buf                gommap.MMap
+	Advice             gommap.Advice // Access pattern advised for the file buffer, re-applied whenever it is mapped again
+	Sparse             bool          // Pre-allocate space by extending file length instead of writing zeros
+	InitialSize        int           // Size of a new or cleared file, 0 - Growth
+	MapReserve         int           // Address space reserved beyond the end of the file buffer for growth, 0 - the file is mapped again as it grows
+
+	reserved   gommap.MMap      // Address space the file is mapped into, nil if none is reserved
+	mapLock    sync.RWMutex     // Held for reading while the buffer is flushed, so that it is not mapped again meanwhile
+	dirtyLock  sync.Mutex       // Guard dirty
+	dirty      map[int]struct{} // Extents written since the last flush, by offset divided by FLUSH_EXTENT
+	handles    *handleBudget    // Budget the file handle counts towards, nil - the handle stays open until the file is closed
+	handleLock sync.Mutex       // Held while the file handle is used, so that the budget does not close it meanwhile
+	inBudget   *list.Element    // Position of the file among the open handles of the budget, guarded by the budget
+	info       os.FileInfo      // Identity of the file on disk, guarded by openFilesLock
+	locked     bool             // The handle holds the lock of this process on the file, guarded by openFilesLock
 }
 
+// Data files this process has open. The file lock keeps other processes out, while this process may open a file again
+// (e.g. a database opened twice): the second handle goes without the lock the first handle holds, as it did with POSIX
+// record locks, which belong to the process.
+var (
+	openFiles     = make(map[*DataFile]struct{})
+	openFilesLock = new(sync.Mutex)
+)
+
 // Return true if the buffer begins with 64 consecutive zero bytes.
 func LooksEmpty(buf gommap.MMap) bool {
 	upTo := 1024
@@ -34,29 +66,124 @@ func LooksEmpty(buf gommap.MMap) bool {
 // Open a data file that grows by the specified size.
 func OpenDataFile(path string, growth int) (file *DataFile, err error) {
 	file = &DataFile{Path: path, Growth: growth}
-	if file.Fh, err = os.OpenFile(file.Path, os.O_CREATE|os.O_RDWR, 0600); err != nil {
+	err = file.open()
+	return
+}
+
+// Open a sparse data file that grows by the specified size, pre-allocated space occupies disk only once it is written.
+func OpenSparseDataFile(path string, growth int) (file *DataFile, err error) {
+	file = &DataFile{Path: path, Growth: growth, Sparse: true}
+	err = file.open()
+	return
+}
+
+// Open the file handle, creating the file and placing an exclusive lock unless the handle is opened again for a mapped
+// file, so that the file may not be opened by another process. The caller holds handleLock.
+func (file *DataFile) openHandle(reopen bool) (err error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if reopen {
+		// A file removed meanwhile is not created again, and the lock placed upon opening it is kept by its map
+		flag = os.O_RDWR
+	}
+	if file.Fh, err = os.OpenFile(file.Path, flag, 0600); err != nil {
+		return
+	} else if reopen {
+		return
+	} else if err = file.lock(); err != nil {
+		file.Fh.Close()
+		file.Fh = nil
+		return
+	} else if file.Sparse {
+		return markSparse(file.Fh)
+	}
+	return
+}
+
+// Place the lock of this process on the newly opened file unless another handle of this process holds it already.
+func (file *DataFile) lock() (err error) {
+	if file.info, err = file.Fh.Stat(); err != nil {
+		return
+	}
+	openFilesLock.Lock()
+	defer openFilesLock.Unlock()
+	for open := range openFiles {
+		if open.locked && os.SameFile(open.info, file.info) {
+			openFiles[file] = struct{}{}
+			return nil
+		}
+	}
+	if err = lockFile(file.Fh); err != nil {
+		tdlog.Noticef("Failed to lock %s: %v", file.Path, err)
+		return dberr.New(dberr.ErrorFileLocked, file.Path)
+	}
+	file.locked = true
+	openFiles[file] = struct{}{}
+	return nil
+}
+
+// Forget the file as its handle is closed, which releases the lock it holds.
+func (file *DataFile) unlock() {
+	openFilesLock.Lock()
+	delete(openFiles, file)
+	file.locked = false
+	openFilesLock.Unlock()
+}
+
+// Open the file handle again if the budget closed it, and keep it open until doneHandle.
+func (file *DataFile) useHandle() (err error) {
+	file.handleLock.Lock()
+	if file.Fh == nil {
+		if err = file.openHandle(true); err != nil {
+			file.handleLock.Unlock()
+			return
+		}
+	}
+	if file.handles != nil {
+		file.handles.touch(file)
+	}
+	return
+}
+
+// Let the budget close the file handle again.
+func (file *DataFile) doneHandle() {
+	file.handleLock.Unlock()
+}
+
+// Open the file, ensure its initial size, map it into memory and find out how much space is in-use.
+func (file *DataFile) open() (err error) {
+	if _, err = injectFault(FAULT_OPEN, file.Path); err != nil {
 		return
 	}
+	file.handleLock.Lock()
+	defer file.handleLock.Unlock()
+	if err = file.openHandle(false); err != nil {
+		return
+	} else if file.handles != nil {
+		defer file.handles.touch(file)
+	}
 	var size int64
 	if size, err = file.Fh.Seek(0, os.SEEK_END); err != nil {
 		return
 	}
-	// Ensure the file is not smaller than file growth
-	if file.Size = int(size); file.Size < file.Growth {
-		if err = file.EnsureSize(file.Growth); err != nil {
+	// Pre-allocate a new file, an existing file may have been shrunk below its initial size
+	if file.Size = int(size); file.Size == 0 {
+		if err = file.preallocate(0, file.initialSize()); err != nil {
 			return
 		}
+		file.Size = file.initialSize()
 	}
 	if file.Buf == nil {
-		file.Buf, err = gommap.Map(file.Fh)
+		if err = file.mapFile(); err != nil {
+			return
+		}
 	}
 	defer tdlog.Infof("%s opened: %d of %d bytes in-use", file.Path, file.Used, file.Size)
 	// Bi-sect file buffer to find out how much space is in-use
 	for low, mid, high := 0, file.Size/2, file.Size; ; {
 		switch {
 		case high-mid == 1:
-			if LooksEmpty(file.Buf[mid:]) {
-				if mid > 0 && LooksEmpty(file.Buf[mid-1:]) {
+			if file.looksEmpty(mid) {
+				if mid > 0 && file.looksEmpty(mid-1) {
 					file.Used = mid - 1
 				} else {
 					file.Used = mid
@@ -65,7 +192,7 @@ func OpenDataFile(path string, growth int) (file *DataFile, err error) {
 			}
 			file.Used = high
 			return
-		case LooksEmpty(file.Buf[mid:]):
+		case file.looksEmpty(mid):
 			high = mid
 			mid = low + (mid-low)/2
 		default:
@@ -76,6 +203,38 @@ func OpenDataFile(path string, growth int) (file *DataFile, err error) {
 	return
 }
 
+// Return true if the file buffer looks empty from the offset on. A hole punched into the file reads as 0s although
+// data follows it, so that the file is looked at from the end of the hole instead.
+func (file *DataFile) looksEmpty(offset int) bool {
+	if offset = skipHole(file.Fh, offset); offset < 0 || offset >= len(file.Buf) {
+		return true
+	}
+	return LooksEmpty(file.Buf[offset:])
+}
+
+// Deallocate the whole pages between the offsets, so that they no longer occupy disk and read as 0s, where the
+// platform and file system support punching holes.
+func (file *DataFile) PunchHole(from, to int) error {
+	pageSize := os.Getpagesize()
+	if from, to = (from+pageSize-1)/pageSize*pageSize, to/pageSize*pageSize; from >= to {
+		return nil
+	} else if err := file.useHandle(); err != nil {
+		return err
+	}
+	defer file.doneHandle()
+	return punchHole(file.Fh, from, to-from)
+}
+
+// Pre-allocate portion of a file (up to the end of file), the space reads as 0s.
+func (file *DataFile) preallocate(from int, size int) (err error) {
+	if !file.Sparse {
+		return file.overwriteWithZero(from, size)
+	} else if err = file.Fh.Truncate(int64(from + size)); err != nil {
+		return
+	}
+	return file.Fh.Sync()
+}
+
 // Fill up portion of a file with 0s.
 func (file *DataFile) overwriteWithZero(from int, size int) (err error) {
 	if _, err = file.Fh.Seek(int64(from), os.SEEK_SET); err != nil {
@@ -97,47 +256,297 @@ func (file *DataFile) overwriteWithZero(from int, size int) (err error) {
 	return file.Fh.Sync()
 }
 
-// Ensure there is enough room for that many bytes of data.
+// Map the file into memory. Unless MapReserve is 0, the file is mapped into address space reserved MapReserve bytes
+// beyond its size, so that it may grow by mapping only the grown space. The caller holds mapLock or has the file to itself.
+func (file *DataFile) mapFile() (err error) {
+	if file.MapReserve > 0 {
+		if reserved, reserveErr := gommap.Reserve(file.Size + file.MapReserve); reserveErr == nil {
+			if reserveErr = reserved.MapFile(file.Fh, 0, file.Size); reserveErr == nil {
+				file.reserved, file.Buf = reserved, reserved[:file.Size:file.Size]
+				return file.Buf.Advise(file.Advice)
+			}
+			reserved.Unmap()
+		}
+		// Map the file on its own instead
+	}
+	if file.Buf, err = gommap.Map(file.Fh); err != nil {
+		return
+	}
+	return file.Buf.Advise(file.Advice)
+}
+
+// Un-map the file buffer along with the address space reserved for it. The caller holds mapLock.
+func (file *DataFile) unmapFile() (err error) {
+	if file.reserved == nil {
+		return file.Buf.Unmap()
+	}
+	err = file.reserved.Unmap()
+	file.reserved, file.Buf = nil, nil
+	return
+}
+
+// Ensure there is enough room for that many bytes of data. The grown space is mapped next to the file buffer if there
+// is address space reserved for it, which leaves the buffer valid and flushes undisturbed; otherwise the entire file
+// is mapped again.
 func (file *DataFile) EnsureSize(more int) (err error) {
 	if file.Used+more <= file.Size {
 		return
-	} else if file.Buf != nil {
-		if err = file.Buf.Unmap(); err != nil {
+	}
+	// Grow by as many times of file growth as necessary, so that the file is re-mapped only once
+	growth := file.Growth
+	for file.Used+more > file.Size+growth {
+		growth += file.Growth
+	}
+	if _, err = injectFault(FAULT_GROW, file.Path); err != nil {
+		return
+	}
+	if err = file.useHandle(); err != nil {
+		return
+	}
+	defer file.doneHandle()
+	if file.reserved != nil && file.Size+growth <= len(file.reserved) {
+		if err = file.preallocate(file.Size, growth); err != nil {
+			return
+		} else if err = file.reserved.MapFile(file.Fh, file.Size, growth); err != nil {
 			return
 		}
+		size := file.Size + growth
+		file.Buf = file.reserved[:size:size]
+		if err = file.Buf[file.Size-file.Size%os.Getpagesize():].Advise(file.Advice); err != nil {
+			return
+		}
+		file.Size = size
+		tdlog.Infof("%s grown in place: %d -> %d bytes (%d bytes in-use)", file.Path, file.Size-growth, file.Size, file.Used)
+		return
 	}
-	if err = file.overwriteWithZero(file.Size, file.Growth); err != nil {
+	file.mapLock.Lock()
+	defer file.mapLock.Unlock()
+	if file.Buf != nil {
+		if err = file.unmapFile(); err != nil {
+			return
+		}
+	}
+	if err = file.preallocate(file.Size, growth); err != nil {
 		return
-	} else if file.Buf, err = gommap.Map(file.Fh); err != nil {
+	}
+	file.Size += growth
+	if err = file.mapFile(); err != nil {
+		file.Size -= growth
 		return
 	}
-	file.Size += file.Growth
-	tdlog.Infof("%s grown: %d -> %d bytes (%d bytes in-use)", file.Path, file.Size-file.Growth, file.Size, file.Used)
-	return file.EnsureSize(more)
+	tdlog.Infof("%s grown: %d -> %d bytes (%d bytes in-use)", file.Path, file.Size-growth, file.Size, file.Used)
+	return
+}
+
+// Return the size of a new or cleared file.
+func (file *DataFile) initialSize() int {
+	if file.InitialSize > 0 {
+		return file.InitialSize
+	}
+	return file.Growth
+}
+
+// Trim the pre-allocated space beyond the space in-use, so that it no longer occupies disk. Less than a memory page is
+// kept beyond the space in-use, the file grows again by Growth once more space is needed. The caller must hold the
+// lock guarding the file.
+func (file *DataFile) Shrink() (err error) {
+	pageSize := os.Getpagesize()
+	size := (file.Used/pageSize + 1) * pageSize
+	if size >= file.Size {
+		return
+	} else if err = file.useHandle(); err != nil {
+		return
+	}
+	defer file.doneHandle()
+	file.mapLock.Lock()
+	defer file.mapLock.Unlock()
+	if err = file.unmapFile(); err != nil {
+		return
+	}
+	// The file is mapped again whether or not it could be truncated
+	oldSize := file.Size
+	truncateErr := file.Fh.Truncate(int64(size))
+	if truncateErr == nil {
+		file.Size = size
+	}
+	if err = file.mapFile(); err != nil {
+		return
+	} else if truncateErr != nil {
+		return truncateErr
+	}
+	tdlog.Infof("%s shrunk: %d -> %d bytes (%d bytes in-use)", file.Path, oldSize, size, file.Used)
+	return
+}
+
+// Advise the operating system about the access pattern of the file buffer.
+func (file *DataFile) Advise(advice gommap.Advice) error {
+	file.Advice = advice
+	return file.Buf.Advise(advice)
+}
+
+// Release memory pages of the file buffer, the pages are read back from the file when they are accessed again.
+func (file *DataFile) DontNeed() (err error) {
+	if err = file.Buf.Advise(gommap.ADVICE_DONTNEED); err != nil {
+		return
+	}
+	// Releasing pages may reset the advised access pattern
+	return file.Buf.Advise(file.Advice)
+}
+
+// Read the pages of the file buffer between the offsets, up to the end of the space in-use, into memory ahead of their
+// use, so that their first access neither waits for the disk nor faults. Return the number of bytes read in. The caller
+// must hold the lock guarding the file for reading.
+func (file *DataFile) Warmup(from, to int) int {
+	if to > file.Used {
+		to = file.Used
+	}
+	pageSize := os.Getpagesize()
+	if from -= from % pageSize; from >= to {
+		return 0
+	}
+	region := file.Buf[from:to]
+	// Let the operating system read the pages ahead, then touch each of them to wait for it
+	region.Advise(gommap.ADVICE_WILLNEED)
+	var sum byte
+	for i := 0; i < len(region); i += pageSize {
+		sum += region[i]
+	}
+	runtime.KeepAlive(sum)
+	return len(region)
+}
+
+// Verify that the file handle is open, still refers to the file on disk, and the file is mapped entirely. The caller
+// must hold the lock guarding the file for reading, as growing the file maps it again.
+func (file *DataFile) Check() error {
+	if file.Buf == nil {
+		return fmt.Errorf("%s is not open", file.Path)
+	} else if err := file.useHandle(); err != nil {
+		return err
+	}
+	defer file.doneHandle()
+	handleInfo, err := file.Fh.Stat()
+	if err != nil {
+		return err
+	}
+	pathInfo, err := os.Stat(file.Path)
+	if err != nil {
+		return err
+	} else if !os.SameFile(handleInfo, pathInfo) {
+		return fmt.Errorf("%s was replaced or removed while it is open", file.Path)
+	} else if handleInfo.Size() < int64(file.Size) || len(file.Buf) != file.Size {
+		return fmt.Errorf("%s is %d bytes long and %d bytes are mapped, expecting %d bytes", file.Path, handleInfo.Size(), len(file.Buf), file.Size)
+	}
+	return nil
 }
 
 // Un-map the file buffer and close the file handle.
 func (file *DataFile) Close() (err error) {
-	if err = file.Buf.Unmap(); err != nil {
+	file.handleLock.Lock()
+	defer file.handleLock.Unlock()
+	file.mapLock.Lock()
+	defer file.mapLock.Unlock()
+	return file.close()
+}
+
+// Un-map the file buffer and close the file handle. The caller holds mapLock.
+func (file *DataFile) close() (err error) {
+	if err = file.unmapFile(); err != nil {
 		return
 	}
-	return file.Fh.Close()
+	// The map keeps the lock of a file whose handle the budget closed
+	file.unlock()
+	if file.Fh == nil {
+		return
+	} else if file.handles != nil {
+		file.handles.remove(file)
+	}
+	err, file.Fh = file.Fh.Close(), nil
+	return
 }
 
-// Clear the entire file and resize it to initial size.
+// Clear the entire file and resize it to initial size. The caller must hold the lock guarding the file; a flush meanwhile
+// finds the file closed and has nothing to write.
 func (file *DataFile) Clear() (err error) {
+	file.dirtyLock.Lock()
+	file.dirty = nil
+	file.dirtyLock.Unlock()
 	if err = file.Close(); err != nil {
 		return
-	} else if err = os.Truncate(file.Path, 0); err != nil {
+	}
+	file.handleLock.Lock()
+	defer file.handleLock.Unlock()
+	file.mapLock.Lock()
+	defer file.mapLock.Unlock()
+	if err = os.Truncate(file.Path, 0); err != nil {
 		return
-	} else if file.Fh, err = os.OpenFile(file.Path, os.O_CREATE|os.O_RDWR, 0600); err != nil {
+	} else if err = file.openHandle(false); err != nil {
 		return
-	} else if err = file.overwriteWithZero(0, file.Growth); err != nil {
+	} else if file.handles != nil {
+		file.handles.touch(file)
+	}
+	if err = file.preallocate(0, file.initialSize()); err != nil {
 		return
-	} else if file.Buf, err = gommap.Map(file.Fh); err != nil {
+	}
+	file.Used, file.Size = 0, file.initialSize()
+	if err = file.mapFile(); err != nil {
 		return
 	}
-	file.Used, file.Size = 0, file.Growth
 	tdlog.Infof("%s cleared: %d of %d bytes in-use", file.Path, file.Used, file.Size)
 	return
 }
+
+// Remember that the file buffer was written between the offsets, so that the next flush writes it to disk.
+func (file *DataFile) MarkDirty(from, to int) {
+	file.dirtyLock.Lock()
+	if file.dirty == nil {
+		file.dirty = make(map[int]struct{})
+	}
+	for extent := from / FLUSH_EXTENT; extent*FLUSH_EXTENT < to; extent++ {
+		file.dirty[extent] = struct{}{}
+	}
+	file.dirtyLock.Unlock()
+}
+
+// Write the extents of the file buffer written since the last flush to disk, and wait for the writes to complete.
+// Adjacent extents are written at once. Writers may continue writing to the buffer meanwhile; the caller does not need
+// to hold the lock guarding the file, only the file must not be re-mapped (e.g. by growth), which waits for the flush.
+// Growth into reserved address space does not wait, the flush covers the reserved space throughout.
+func (file *DataFile) Flush() error {
+	if _, err := injectFault(FAULT_FLUSH, file.Path); err != nil {
+		// The extents written remain to be flushed next time
+		return err
+	}
+	file.mapLock.RLock()
+	defer file.mapLock.RUnlock()
+	file.dirtyLock.Lock()
+	dirty := file.dirty
+	file.dirty = nil
+	file.dirtyLock.Unlock()
+	buf := file.reserved
+	if buf == nil {
+		buf = file.Buf
+	}
+	if len(dirty) == 0 || buf == nil {
+		return nil
+	}
+	extents := make([]int, 0, len(dirty))
+	for extent := range dirty {
+		extents = append(extents, extent)
+	}
+	sort.Ints(extents)
+	for i := 0; i < len(extents); {
+		end := i + 1
+		for end < len(extents) && extents[end] == extents[end-1]+1 {
+			end++
+		}
+		if err := buf.Flush(extents[i]*FLUSH_EXTENT, (extents[end-1]-extents[i]+1)*FLUSH_EXTENT); err != nil {
+			// The extents not yet flushed are flushed next time
+			for _, extent := range extents[i:] {
+				file.MarkDirty(extent*FLUSH_EXTENT, extent*FLUSH_EXTENT+1)
+			}
+			return err
+		}
+		i = end
+	}
+	return nil
+}
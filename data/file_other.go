@@ -0,0 +1,19 @@
+//go:build !darwin && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package data
+
+import (
+	"os"
+)
+
+// Platforms without file locks (e.g. WebAssembly) do not keep other processes out, only this process keeps track of
+// the lock files it holds.
+func lockFile(fh *os.File) error {
+	return nil
+}
+
+// Unwritten regions of a file are left to the file system.
+func markSparse(fh *os.File) error {
+	return nil
+}
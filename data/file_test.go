@@ -2,11 +2,14 @@ package data
 
 import (
 	"errors"
+	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	"bou.ke/monkey"
+	"github.com/cankansin/tiedot/dberr"
 	"github.com/cankansin/tiedot/gommap"
 )
 
@@ -119,6 +122,96 @@ func TestFileGrow(t *testing.T) {
 	tmpFile.Buf[11] = 1
 	tmpFile.Close()
 }
+func TestFileGrowInPlace(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	tmpFile := &DataFile{Path: tmp, Growth: 4096, MapReserve: 8192}
+	if err := tmpFile.open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gommap.Reserve(4096); err == gommap.ErrNoReserve {
+		tmpFile.Close()
+		t.Skip(err)
+	}
+	// Growth within the reserved space leaves the buffer in place, and earlier slices of it valid
+	before := tmpFile.Buf
+	before[4000] = 1
+	tmpFile.Used = 4001
+	if err := tmpFile.EnsureSize(6000); err != nil || tmpFile.Size != 12288 || len(tmpFile.Buf) != 12288 {
+		t.Fatal(err, tmpFile.Size, len(tmpFile.Buf))
+	} else if &tmpFile.Buf[0] != &before[0] || before[4000] != 1 || tmpFile.Buf[4000] != 1 {
+		t.Fatal("Buffer moved")
+	}
+	tmpFile.Buf[12287] = 2
+	tmpFile.MarkDirty(12287, 12288)
+	if err := tmpFile.Flush(); err != nil {
+		t.Fatal(err)
+	} else if err = tmpFile.Check(); err != nil {
+		t.Fatal(err)
+	}
+	// Growth beyond the reserved space maps the file again, with space reserved anew
+	tmpFile.Used = 12288
+	if err := tmpFile.EnsureSize(1); err != nil || tmpFile.Size != 16384 || len(tmpFile.reserved) != 16384+8192 {
+		t.Fatal(err, tmpFile.Size, len(tmpFile.reserved))
+	} else if tmpFile.Buf[4000] != 1 || tmpFile.Buf[12287] != 2 {
+		t.Fatal("Lost data")
+	}
+	tmpFile.Used = 5000
+	if err := tmpFile.Shrink(); err != nil || tmpFile.Size != 8192 || len(tmpFile.reserved) != 8192+8192 {
+		t.Fatal(err, tmpFile.Size, len(tmpFile.reserved))
+	} else if err = tmpFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The data written is in the file
+	content, err := ioutil.ReadFile(tmp)
+	if err != nil || len(content) != 8192 || content[4000] != 1 {
+		t.Fatal(len(content), err)
+	}
+}
+func TestFileInitialSizeAndShrink(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	pageSize := os.Getpagesize()
+	tmpFile := &DataFile{Path: tmp, Growth: 4 * pageSize, InitialSize: pageSize}
+	if err := tmpFile.open(); err != nil {
+		t.Fatal(err)
+	} else if tmpFile.Size != pageSize || len(tmpFile.Buf) != pageSize {
+		t.Fatal("Incorrect initial size", tmpFile.Size)
+	}
+	// Grown by file growth, then shrunk to less than a page beyond the space in-use
+	if err := tmpFile.EnsureSize(pageSize + 1); err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Used = pageSize + 1
+	tmpFile.Buf[pageSize] = 1
+	if tmpFile.Size != 5*pageSize {
+		t.Fatal("Incorrect size", tmpFile.Size)
+	} else if err := tmpFile.Shrink(); err != nil {
+		t.Fatal(err)
+	} else if info, _ := os.Stat(tmp); tmpFile.Size != 2*pageSize || len(tmpFile.Buf) != 2*pageSize || info.Size() != int64(2*pageSize) {
+		t.Fatal("Incorrect shrunk size", tmpFile.Size, len(tmpFile.Buf), info.Size())
+	} else if tmpFile.Buf[pageSize] != 1 {
+		t.Fatal("Lost data")
+	}
+	// Shrinking again changes nothing
+	if err := tmpFile.Shrink(); err != nil || tmpFile.Size != 2*pageSize {
+		t.Fatal(err, tmpFile.Size)
+	}
+	// A shrunk file is not grown upon opening it again, while clearing it restores the initial size
+	if err := tmpFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened := &DataFile{Path: tmp, Growth: 4 * pageSize, InitialSize: 3 * pageSize}
+	if err := reopened.open(); err != nil {
+		t.Fatal(err)
+	} else if reopened.Size != 2*pageSize || reopened.Used != pageSize+1 {
+		t.Fatal("Incorrect reopened size", reopened.Size, reopened.Used)
+	} else if err = reopened.Clear(); err != nil || reopened.Size != 3*pageSize || reopened.Used != 0 {
+		t.Fatal(err, reopened.Size, reopened.Used)
+	}
+	reopened.Close()
+}
+
 func TestCloseErr(t *testing.T) {
 	os.Remove(tmp)
 	defer os.Remove(tmp)
@@ -213,24 +306,17 @@ func TestOpenDataSeekErr(t *testing.T) {
 		t.Error("Expected error when call Seek struct file ")
 	}
 }
-func TestFileSmallerThanGrowth(t *testing.T) {
+func TestNewFilePreallocateErr(t *testing.T) {
 	os.Remove(tmp)
 	defer os.Remove(tmp)
-	errMessage := "error not ensure size file"
-	var d *DataFile
+	errMessage := "error write"
 	var fh *os.File
-	patchSeek := monkey.PatchInstanceMethod(reflect.TypeOf(fh), "Seek", func(_ *os.File, offset int64, whence int) (ret int64, err error) {
-		return 10, nil
-	})
-	defer patchSeek.Unpatch()
-
-	patch := monkey.PatchInstanceMethod(reflect.TypeOf(d), "EnsureSize", func(_ *DataFile, more int) (err error) {
-		return errors.New(errMessage)
+	patchWrite := monkey.PatchInstanceMethod(reflect.TypeOf(fh), "Write", func(_ *os.File, b []byte) (n int, err error) {
+		return 0, errors.New(errMessage)
 	})
-	defer patch.Unpatch()
-
-	if _, err := OpenDataFile(tmp, 1024); err.Error() != errMessage {
-		t.Error("Expected error when call EnsureSize function")
+	defer patchWrite.Unpatch()
+	if _, err := OpenDataFile(tmp, 1024); err == nil || err.Error() != errMessage {
+		t.Error("Expected error when pre-allocating new file", err)
 	}
 }
 func TestOverWriteWithZeroErrorFileWrite(t *testing.T) {
@@ -294,3 +380,261 @@ func TestEnsureSizeMapErr(t *testing.T) {
 		t.Error("Expected error `gommap.Map` in inner function `EnsureSize`")
 	}
 }
+func TestAdviseAndDontNeed(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	tmpFile, err := OpenDataFile(tmp, 4096)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer tmpFile.Close()
+	if err = tmpFile.Advise(gommap.ADVICE_RANDOM); err != nil || tmpFile.Advice != gommap.ADVICE_RANDOM {
+		t.Fatal(err)
+	}
+	tmpFile.Buf[100] = 1
+	tmpFile.Used = 101
+	// Released pages are read back from the file
+	if err = tmpFile.DontNeed(); err != nil {
+		t.Fatal(err)
+	}
+	if tmpFile.Buf[100] != 1 {
+		t.Fatal("Lost data after releasing memory")
+	}
+	// The advice survives re-mapping
+	if err = tmpFile.EnsureSize(8192); err != nil || tmpFile.Advice != gommap.ADVICE_RANDOM || tmpFile.Buf[100] != 1 {
+		t.Fatal(err)
+	}
+}
+func TestCappedPrealloc(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	conf := defaultConfig()
+	conf.MaxPrealloc = 65536
+	conf.ColMapAdvice = "sequential"
+	col, err := conf.OpenCollection(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer col.Close()
+	if col.Size != 65536 || col.Growth != 65536 || col.Advice != gommap.ADVICE_SEQUENTIAL {
+		t.Fatal(col.Size, col.Growth, col.Advice)
+	}
+	if _, err = col.Insert([]byte(strings.Repeat("a", 40000))); err != nil {
+		t.Fatal(err)
+	}
+	if col.Size != 2*65536 {
+		t.Fatal(col.Size)
+	}
+}
+func TestSparseFileGrow(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	tmpFile, err := OpenSparseDataFile(tmp, 1024)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer tmpFile.Close()
+	if tmpFile.Size != 1024 || len(tmpFile.Buf) != 1024 || !tmpFile.Sparse {
+		t.Fatal(tmpFile.Size, len(tmpFile.Buf))
+	}
+	tmpFile.Buf[10] = 1
+	tmpFile.Used = 11
+	if err = tmpFile.EnsureSize(3000); err != nil {
+		t.Fatal(err)
+	}
+	if tmpFile.Size != 3072 || len(tmpFile.Buf) != 3072 || tmpFile.Buf[10] != 1 || !LooksEmpty(tmpFile.Buf[11:]) {
+		t.Fatal(tmpFile.Size, len(tmpFile.Buf))
+	}
+	if err = tmpFile.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if tmpFile.Size != 1024 || tmpFile.Used != 0 || !LooksEmpty(tmpFile.Buf) {
+		t.Fatal(tmpFile.Size, tmpFile.Used)
+	}
+}
+func TestFileLockedErr(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	patch := monkey.Patch(lockFile, func(fh *os.File) error {
+		return errors.New("resource temporarily unavailable")
+	})
+	defer patch.Unpatch()
+	if _, err := OpenDataFile(tmp, 1024); dberr.Type(err) != dberr.ErrorFileLocked {
+		t.Fatal(err)
+	}
+}
+func TestFileCheck(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	tmpFile, err := OpenDataFile(tmp, 1024)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	if err = tmpFile.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tmpFile.Close(); err != nil {
+		t.Fatal(err)
+	} else if err = tmpFile.Check(); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+func TestFileLockKeptByOtherHandle(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	tmpFile, err := OpenDataFile(tmp, 1024)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer tmpFile.Close()
+	// Reading the file through another handle (e.g. in a database dump) does not release the lock
+	if content, err := ioutil.ReadFile(tmp); err != nil || len(content) != 1024 {
+		t.Fatal(len(content), err)
+	}
+	if err = lockAsOtherProcess(tmp); err == nil {
+		t.Fatal("Did not error")
+	}
+}
+func TestFileOpenedAgainByThisProcess(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	first, err := OpenDataFile(tmp, 1024)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	// This process may open the file again, other processes may not
+	second, err := OpenDataFile(tmp, 1024)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = lockAsOtherProcess(tmp); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err = second.Close(); err != nil {
+		t.Fatal(err)
+	} else if err = lockAsOtherProcess(tmp); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err = first.Close(); err != nil {
+		t.Fatal(err)
+	} else if err = lockAsOtherProcess(tmp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Lock the file through a handle of its own, as another process would, and return the error.
+func lockAsOtherProcess(path string) error {
+	fh, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	return lockFile(fh)
+}
+func TestFlushDirtyExtents(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	file, err := OpenDataFile(tmp, 4*FLUSH_EXTENT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.Buf[10] = 1
+	file.MarkDirty(10, 11)
+	file.Buf[FLUSH_EXTENT-1] = 1
+	file.MarkDirty(FLUSH_EXTENT-1, FLUSH_EXTENT+1)
+	file.MarkDirty(3*FLUSH_EXTENT, 3*FLUSH_EXTENT+FLUSH_EXTENT)
+	if len(file.dirty) != 3 {
+		t.Fatal(file.dirty)
+	}
+	if err = file.Flush(); err != nil {
+		t.Fatal(err)
+	} else if len(file.dirty) != 0 {
+		t.Fatal(file.dirty)
+	}
+	// Growing the file keeps track of the extents written before
+	file.MarkDirty(0, 1)
+	file.Used = file.Size
+	if err = file.EnsureSize(1); err != nil {
+		t.Fatal(err)
+	} else if len(file.dirty) != 1 {
+		t.Fatal(file.dirty)
+	} else if err = file.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is flushed once the file is cleared or closed
+	file.MarkDirty(0, 1)
+	if err = file.Clear(); err != nil {
+		t.Fatal(err)
+	} else if len(file.dirty) != 0 {
+		t.Fatal(file.dirty)
+	}
+	file.MarkDirty(0, 1)
+	if err = file.Close(); err != nil {
+		t.Fatal(err)
+	} else if err = file.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+func TestFileWarmup(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	tmpFile, err := OpenDataFile(tmp, 4*os.Getpagesize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	pageSize := os.Getpagesize()
+	tmpFile.Used = pageSize + 100
+	// The region is extended to the page boundary before it and capped by the space in-use
+	if size := tmpFile.Warmup(0, 4*pageSize); size != pageSize+100 {
+		t.Fatal(size)
+	} else if size = tmpFile.Warmup(pageSize+10, 4*pageSize); size != 100 {
+		t.Fatal(size)
+	} else if size = tmpFile.Warmup(2*pageSize, 4*pageSize); size != 0 {
+		t.Fatal(size)
+	}
+}
+func TestPortableBackend(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	defer gommap.SetBackend(gommap.SetBackend(gommap.Portable))
+	file, err := OpenDataFile(tmp, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.MapReserve = 1 << 20
+	file.Buf[10] = 1
+	file.MarkDirty(10, 11)
+	if err = file.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// A flushed region reaches the file, even if the handle used to map the file is closed
+	file.Fh.Close()
+	if content, err := ioutil.ReadFile(tmp); err != nil || len(content) != 4096 || content[10] != 1 {
+		t.Fatal(len(content), err)
+	}
+	if file.Fh, err = os.OpenFile(tmp, os.O_RDWR, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Growth without address space reservation copies the file again
+	file.Buf[4095] = 2
+	file.Used = file.Size
+	if err = file.EnsureSize(1); err != nil {
+		t.Fatal(err)
+	} else if file.reserved != nil || len(file.Buf) != 8192 || file.Buf[10] != 1 || file.Buf[4095] != 2 {
+		t.Fatal(file.reserved != nil, len(file.Buf))
+	}
+	file.Buf[8000] = 3
+	if err = file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The copy is written back upon close
+	gommap.SetBackend(gommap.Platform)
+	if file, err = OpenDataFile(tmp, 4096); err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if file.Size != 8192 || file.Buf[10] != 1 || file.Buf[4095] != 2 || file.Buf[8000] != 3 {
+		t.Fatal(file.Size)
+	}
+}
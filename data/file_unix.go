@@ -0,0 +1,20 @@
+// +build darwin freebsd linux netbsd openbsd
+
+package data
+
+import (
+	"os"
+	"syscall"
+)
+
+// Place an exclusive lock on the file, fail immediately if another process holds the lock.
+// Unlike POSIX record locks, which are released as soon as the process closes any handle of the file, flock locks
+// belong to the file handle - reading the file through another handle (e.g. to dump the database) keeps the lock.
+func lockFile(fh *os.File) error {
+	return syscall.Flock(int(fh.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// Unix file systems create holes for unwritten regions of a file without special treatment.
+func markSparse(fh *os.File) error {
+	return nil
+}
@@ -0,0 +1,31 @@
+package data
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	LOCKFILE_FAIL_IMMEDIATELY = 0x00000001
+	LOCKFILE_EXCLUSIVE_LOCK   = 0x00000002
+	FSCTL_SET_SPARSE          = 0x000900c4
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// Place an exclusive lock on the file, fail immediately if another process holds the lock.
+// Windows locks are mandatory, hence the locked byte lies far beyond the end of file, where it does not get in the way of reading and writing.
+func lockFile(fh *os.File) error {
+	overlapped := syscall.Overlapped{Offset: 0xffffffff, OffsetHigh: 0x7fffffff}
+	if r1, _, err := procLockFileEx.Call(fh.Fd(), LOCKFILE_EXCLUSIVE_LOCK|LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped))); r1 == 0 {
+		return err
+	}
+	return nil
+}
+
+// Mark the file sparse, so that unwritten regions do not occupy disk space.
+func markSparse(fh *os.File) error {
+	var returned uint32
+	return syscall.DeviceIoControl(syscall.Handle(fh.Fd()), FSCTL_SET_SPARSE, nil, 0, nil, 0, &returned, nil)
+}
@@ -0,0 +1,86 @@
+// Budget of open data file handles.
+//
+// A data file is accessed through its memory map, which stays valid after the file handle is closed; the handle is
+// only needed to grow, shrink, clear or check the file. A database of many collections × partitions × indexes would
+// otherwise hold a handle of every file for as long as it is open, and may run out of file descriptors. The handles of
+// the files opened by a Config therefore count towards its budget of MaxOpenFiles: beyond it, the handles used the
+// longest time ago are closed, and each is opened again once its file needs it. A handle in use is never closed. The lock
+// placed on a file as it is opened is not placed again: on Linux the file map keeps it, elsewhere the file is no longer
+// locked against other processes on its own while its handle is closed, the database directory still is.
+
+package data
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+// Open file handles counting towards a budget.
+type handleBudget struct {
+	lock *sync.Mutex
+	max  int        // Maximum number of open handles, 0 - unlimited
+	open *list.List // Files with open handles, the least recently used first
+}
+
+// Return a new budget of unlimited open handles.
+func newHandleBudget() *handleBudget {
+	return &handleBudget{lock: new(sync.Mutex), open: list.New()}
+}
+
+// Change the maximum number of open handles (0 - unlimited), closing the handles beyond it.
+func (budget *handleBudget) setMax(max int) {
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	budget.max = max
+	budget.closeExcess(nil)
+}
+
+// Return the number of open handles.
+func (budget *handleBudget) count() int {
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	return budget.open.Len()
+}
+
+// Record that the file's handle is open and was just used, and close the least recently used handles beyond the
+// budget. The caller holds the file's handleLock.
+func (budget *handleBudget) touch(file *DataFile) {
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	if file.inBudget != nil {
+		budget.open.MoveToBack(file.inBudget)
+	} else {
+		file.inBudget = budget.open.PushBack(file)
+	}
+	budget.closeExcess(file)
+}
+
+// Stop counting the file's handle, which is about to be closed. The caller holds the file's handleLock.
+func (budget *handleBudget) remove(file *DataFile) {
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	if file.inBudget != nil {
+		budget.open.Remove(file.inBudget)
+		file.inBudget = nil
+	}
+}
+
+// Close the least recently used handles beyond the budget, other than the one of the file (optional) and those in
+// use. The caller holds budget lock.
+func (budget *handleBudget) closeExcess(except *DataFile) {
+	for elem := budget.open.Front(); elem != nil && budget.max > 0 && budget.open.Len() > budget.max; {
+		file, next := elem.Value.(*DataFile), elem.Next()
+		if file != except && file.handleLock.TryLock() {
+			budget.open.Remove(elem)
+			file.inBudget = nil
+			if err := file.Fh.Close(); err != nil {
+				tdlog.Noticef("Failed to close the handle of %s: %v", file.Path, err)
+			}
+			file.Fh = nil
+			file.handleLock.Unlock()
+		}
+		elem = next
+	}
+}
@@ -0,0 +1,60 @@
+package data
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestHandleBudget(t *testing.T) {
+	conf := defaultConfig()
+	conf.MaxOpenFiles = 2
+	conf.CalculateConfigConstants()
+	files := make([]*DataFile, 4)
+	for i := range files {
+		path := fmt.Sprintf("%s_%d", tmp, i)
+		os.Remove(path)
+		defer os.Remove(path)
+		var err error
+		if files[i], err = conf.openDataFile(path, 4096, 0); err != nil {
+			t.Fatal(err)
+		}
+		defer files[i].Close()
+	}
+	// Only the handles used last are open, the files stay mapped
+	if n := conf.handles.count(); n != 2 {
+		t.Fatal(n)
+	} else if files[0].Fh != nil || files[1].Fh != nil || files[3].Fh == nil {
+		t.Fatal(files)
+	}
+	files[0].Buf[0] = 1
+	if runtime.GOOS == "linux" {
+		// The map keeps the lock of a file whose handle was closed
+		if err := lockAsOtherProcess(files[1].Path); err == nil {
+			t.Fatal("Did not error")
+		}
+	}
+	// A file whose handle was closed opens it again on use
+	files[0].Used = 4096
+	if err := files[0].EnsureSize(1); err != nil || files[0].Size != 8192 {
+		t.Fatal(err, files[0].Size)
+	} else if err = files[0].Check(); err != nil {
+		t.Fatal(err)
+	} else if files[0].Fh == nil || files[2].Fh != nil || files[0].Buf[0] != 1 {
+		t.Fatal("Wrong handle closed")
+	}
+	if n := conf.handles.count(); n != 2 {
+		t.Fatal(n)
+	}
+	// Closed files no longer count, and a larger budget closes nothing
+	if err := files[0].Close(); err != nil {
+		t.Fatal(err)
+	} else if n := conf.handles.count(); n != 1 {
+		t.Fatal(n)
+	}
+	conf.handles.setMax(0)
+	if err := files[1].Check(); err != nil || conf.handles.count() != 2 || files[3].Fh == nil {
+		t.Fatal(err, conf.handles.count())
+	}
+}
@@ -29,7 +29,9 @@ type HashTable struct {
 // Open a hash table file.
 func (conf *Config) OpenHashTable(path string) (ht *HashTable, err error) {
 	ht = &HashTable{Config: conf, Lock: new(sync.RWMutex)}
-	if ht.DataFile, err = OpenDataFile(path, ht.HTFileGrowth); err != nil {
+	if ht.DataFile, err = conf.openDataFile(path, ht.HTFileGrowth, ht.HTInitialSize); err != nil {
+		return
+	} else if err = ht.Advise(mapAdvice(conf.HTMapAdvice)); err != nil {
 		return
 	}
 	conf.CalculateConfigConstants()
@@ -37,6 +39,18 @@ func (conf *Config) OpenHashTable(path string) (ht *HashTable, err error) {
 	return
 }
 
+// Apply the current memory usage settings to the open hash table file.
+func (ht *HashTable) ApplySettings() error {
+	return ht.applyFileSettings(ht.DataFile, ht.HTFileGrowth, ht.HTInitialSize, ht.HTMapAdvice)
+}
+
+// Verify that the hash table file is open and intact. Places the hash table's read lock.
+func (ht *HashTable) Check() error {
+	ht.Lock.RLock()
+	defer ht.Lock.RUnlock()
+	return ht.DataFile.Check()
+}
+
 // Follow the longest bucket chain to calculate total number of buckets, hence the "used size" of hash table file.
 func (ht *HashTable) calculateNumBuckets() {
 	ht.numBuckets = ht.Size / ht.BucketSize
@@ -91,6 +105,7 @@ func (ht *HashTable) growBucket(bucket int) {
 	ht.EnsureSize(ht.BucketSize)
 	lastBucketAddr := ht.lastBucket(bucket) * ht.BucketSize
 	binary.PutVarint(ht.Buf[lastBucketAddr:lastBucketAddr+10], int64(ht.numBuckets))
+	ht.MarkDirty(lastBucketAddr, lastBucketAddr+10)
 	ht.Used += ht.BucketSize
 	ht.numBuckets++
 }
@@ -112,6 +127,7 @@ func (ht *HashTable) Put(key, val int) {
 			ht.Buf[entryAddr] = 1
 			binary.PutVarint(ht.Buf[entryAddr+1:entryAddr+11], int64(key))
 			binary.PutVarint(ht.Buf[entryAddr+11:entryAddr+21], int64(val))
+			ht.MarkDirty(entryAddr, entryAddr+EntrySize)
 			return
 		}
 		if entry++; entry == ht.PerBucket {
@@ -164,6 +180,7 @@ func (ht *HashTable) Remove(key, val int) {
 		if ht.Buf[entryAddr] == 1 {
 			if int(entryKey) == key && int(entryVal) == val {
 				ht.Buf[entryAddr] = 0
+				ht.MarkDirty(entryAddr, entryAddr+1)
 				return
 			}
 		} else if entryKey == 0 && entryVal == 0 {
@@ -200,40 +217,52 @@ func (conf *Config) GetPartitionRange(partNum, totalParts int) (start int, end i
 	return
 }
 
-// Collect entries all the way from "head" bucket to the end of its chained buckets.
-func (ht *HashTable) collectEntries(head int) (keys, vals []int) {
-	keys = make([]int, 0, ht.PerBucket)
-	vals = make([]int, 0, ht.PerBucket)
+// Run the function on entries all the way from "head" bucket to the end of its chained buckets, until the function
+// returns false.
+func (ht *HashTable) forEachEntry(head int, fun func(key, val int) bool) (moveOn bool) {
 	var entry, bucket int = 0, head
 	for {
 		entryAddr := bucket*ht.BucketSize + BucketHeader + entry*EntrySize
 		entryKey, _ := binary.Varint(ht.Buf[entryAddr+1 : entryAddr+11])
 		entryVal, _ := binary.Varint(ht.Buf[entryAddr+11 : entryAddr+21])
 		if ht.Buf[entryAddr] == 1 {
-			keys = append(keys, int(entryKey))
-			vals = append(vals, int(entryVal))
+			if !fun(int(entryKey), int(entryVal)) {
+				return false
+			}
 		} else if entryKey == 0 && entryVal == 0 {
-			return
+			return true
 		}
 		if entry++; entry == ht.PerBucket {
 			entry = 0
 			if bucket = ht.nextBucket(bucket); bucket == 0 {
-				return
+				return true
 			}
 		}
 	}
 }
 
+// Run the function on every entry in the chosen partition one by one, until the function returns false. Unlike
+// GetPartition, entries are not collected up front, and the function must not modify the hash table.
+func (ht *HashTable) ForEachEntry(partNum, partSize int, fun func(key, val int) bool) (moveOn bool) {
+	rangeStart, rangeEnd := ht.GetPartitionRange(partNum, partSize)
+	for head := rangeStart; head < rangeEnd; head++ {
+		if !ht.forEachEntry(head, fun) {
+			return false
+		}
+	}
+	return true
+}
+
 // Return all entries in the chosen partition.
 func (ht *HashTable) GetPartition(partNum, partSize int) (keys, vals []int) {
 	rangeStart, rangeEnd := ht.GetPartitionRange(partNum, partSize)
 	prealloc := (rangeEnd - rangeStart) * ht.PerBucket
 	keys = make([]int, 0, prealloc)
 	vals = make([]int, 0, prealloc)
-	for head := rangeStart; head < rangeEnd; head++ {
-		k, v := ht.collectEntries(head)
-		keys = append(keys, k...)
-		vals = append(vals, v...)
-	}
+	ht.ForEachEntry(partNum, partSize, func(key, val int) bool {
+		keys = append(keys, key)
+		vals = append(vals, val)
+		return true
+	})
 	return
 }
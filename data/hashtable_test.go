@@ -176,9 +176,50 @@ func TestPartitionEntries(t *testing.T) {
 		}
 	}
 }
+func TestForEachEntry(t *testing.T) {
+	tmp := "/tmp/tiedot_test_hash"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	d := defaultConfig()
+	ht, err := d.OpenHashTable(tmp)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+		return
+	}
+	defer ht.Close()
+	number := 100000
+	for i := 1; i <= number; i++ {
+		ht.Put(i, i*2)
+	}
+	ht.Remove(7, 14)
+	// Entries visited one by one are the same as those collected
+	for i := 0; i < 3; i++ {
+		keys, vals := ht.GetPartition(i, 3)
+		visited := 0
+		if !ht.ForEachEntry(i, 3, func(key, val int) bool {
+			if key != keys[visited] || val != vals[visited] || key == 7 {
+				t.Fatal("Wrong entry", key, val)
+			}
+			visited++
+			return true
+		}) || visited != len(keys) {
+			t.Fatal("Did not visit all entries", visited, len(keys))
+		}
+	}
+	// Iteration stops once the function returns false
+	visited := 0
+	if ht.ForEachEntry(0, 1, func(key, val int) bool {
+		visited++
+		return visited < 10
+	}) || visited != 10 {
+		t.Fatal("Did not stop", visited)
+	}
+}
+
 func TestOpenHashTableErr(t *testing.T) {
 	errMessage := "Error open data file"
-	patch := monkey.Patch(OpenDataFile, func(path string, growth int) (file *DataFile, err error) {
+	// Hash tables open their files by the configuration, which opens the file handle in the end
+	patch := monkey.Patch(os.OpenFile, func(name string, flag int, perm os.FileMode) (*os.File, error) {
 		return nil, errors.New(errMessage)
 	})
 	defer patch.Unpatch()
@@ -0,0 +1,34 @@
+package data
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	FALLOC_FL_KEEP_SIZE  = 0x01 // Keep file length while deallocating space.
+	FALLOC_FL_PUNCH_HOLE = 0x02 // Deallocate space, the range reads as zeros afterwards.
+	SEEK_DATA            = 3    // Seek to the next region holding data.
+)
+
+// Deallocate the file region, so that it no longer occupies disk and reads as zeros. File systems unable to punch
+// holes are silently left alone.
+func punchHole(fh *os.File, offset, size int) error {
+	err := syscall.Fallocate(int(fh.Fd()), FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, int64(offset), int64(size))
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return nil
+	}
+	return err
+}
+
+// Return the offset of the data following the hole at the offset, or -1 if there is no more data. Return the offset
+// itself if it is not in a hole, or if the file system does not tell holes apart.
+func skipHole(fh *os.File, offset int) int {
+	next, err := fh.Seek(int64(offset), SEEK_DATA)
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENXIO {
+		return -1
+	} else if err != nil {
+		return offset
+	}
+	return int(next)
+}
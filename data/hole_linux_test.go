@@ -0,0 +1,97 @@
+package data
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestPunchHoles(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	conf := defaultConfig()
+	conf.SparseFiles = true
+	col, err := conf.OpenCollection(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocated := func() int64 {
+		info, err := os.Stat(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Sys().(*syscall.Stat_t).Blocks * 512
+	}
+	// Small documents are deleted in a run, large ones on their own, among documents that are kept
+	var kept, deleted []int
+	for i := 0; i < 400; i++ {
+		size := 100
+		if i%50 == 0 {
+			size = 20000
+		}
+		id, err := col.Insert([]byte(strings.Repeat("x", size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%100 < 60 || i%100 == 99 {
+			deleted = append(deleted, id)
+		} else {
+			kept = append(kept, id)
+		}
+	}
+	col.Flush()
+	before := allocated()
+	for _, id := range deleted {
+		if err = col.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	afterDelete := allocated()
+	if err = col.PunchHoles(); err != nil {
+		t.Fatal(err)
+	}
+	afterPunch := allocated()
+	t.Log("Allocated", before, afterDelete, afterPunch)
+	if afterDelete >= before || afterPunch >= afterDelete {
+		t.Skip("File system does not punch holes")
+	}
+	// Punching again changes nothing
+	if err = col.PunchHoles(); err != nil || allocated() != afterPunch {
+		t.Fatal(err, allocated())
+	}
+	verify := func(col *Collection) {
+		for _, id := range kept {
+			if doc := col.Read(id); doc == nil || strings.Trim(string(doc), "x ") != "" || len(strings.TrimSpace(string(doc))) < 100 {
+				t.Fatal("Kept document is lost", id)
+			}
+		}
+		for _, id := range deleted {
+			if col.Read(id) != nil {
+				t.Fatal("Deleted document is read", id)
+			}
+		}
+		scanned := 0
+		col.ForEachDoc(func(id int, doc []byte) bool {
+			scanned++
+			return true
+		})
+		if scanned != len(kept) {
+			t.Fatal("Scanned", scanned)
+		}
+	}
+	verify(col)
+	// The space in-use is found beyond the holes upon opening the file again
+	used := col.Used
+	if err = col.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if col, err = conf.OpenCollection(tmp); err != nil {
+		t.Fatal(err)
+	}
+	defer col.Close()
+	if col.Used != used {
+		t.Fatal("Used", col.Used, used)
+	}
+	verify(col)
+}
@@ -0,0 +1,17 @@
+// +build !linux
+
+package data
+
+import (
+	"os"
+)
+
+// Punching holes is only supported on Linux.
+func punchHole(fh *os.File, offset, size int) error {
+	return nil
+}
+
+// Without holes, data always continues at the offset.
+func skipHole(fh *os.File, offset int) int {
+	return offset
+}
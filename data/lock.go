@@ -0,0 +1,162 @@
+// Lock wait timeouts and lock diagnostics of a partition.
+//
+// Besides the locks currently held, a partition counts the waits for the update locks of its documents since it was
+// opened: how many writes waited and for how long, in total and for each of the CONTENTION_TRACKED_DOCS documents
+// waited for the most. Once that many documents are tracked, a newly waited for document takes the place of the one
+// waited for the least, so that the documents waited for again and again - the hotspots - remain tracked.
+
+package data
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CONTENTION_TRACKED_DOCS = 1000 // Number of documents whose lock waits are tracked in each partition.
+)
+
+// A document locked for exclusive update.
+type updateLock struct {
+	released chan struct{} // Closed once the document is unlocked
+	since    time.Time     // Time the document was locked
+	waiters  int           // Number of callers waiting for the document
+}
+
+// UpdateLock describes a document locked for exclusive update.
+type UpdateLock struct {
+	ID      int       // Document ID
+	Since   time.Time // Time the document was locked
+	Waiters int       // Number of callers waiting for the document
+}
+
+// DocContention counts the waits for the update lock of a document.
+type DocContention struct {
+	ID    int           // Document ID
+	Waits int64         // Number of times the lock was waited for
+	Wait  time.Duration // Total time waited
+}
+
+// Waits for the update locks of the documents of a partition.
+type lockContention struct {
+	waits int64                  // Number of times a lock was waited for
+	wait  time.Duration          // Total time waited
+	docs  map[int]*DocContention // Waits of the documents waited for the most
+}
+
+// Count a wait for the update lock of the document.
+func (lc *lockContention) count(id int, wait time.Duration) {
+	lc.waits++
+	lc.wait += wait
+	doc, tracked := lc.docs[id]
+	if !tracked {
+		if len(lc.docs) >= CONTENTION_TRACKED_DOCS {
+			var least *DocContention
+			for _, other := range lc.docs {
+				if least == nil || other.Waits < least.Waits {
+					least = other
+				}
+			}
+			delete(lc.docs, least.ID)
+		}
+		doc = &DocContention{ID: id}
+		lc.docs[id] = doc
+	}
+	doc.Waits++
+	doc.Wait += wait
+}
+
+// Return the configured lock wait timeout, 0 - wait indefinitely.
+func (part *Partition) lockTimeout() time.Duration {
+	return time.Duration(part.LockTimeout) * time.Millisecond
+}
+
+// Place the write lock of DataLock, unless it remains locked for longer than LockTimeout or the done channel (optional)
+// is closed meanwhile. Return true if the lock is placed.
+func (part *Partition) LockData(done <-chan struct{}) (locked bool) {
+	return part.lockData(done, part.DataLock.TryLock, part.DataLock.Lock, part.DataLock.Unlock)
+}
+
+// Place the read lock of DataLock, unless it remains write locked for longer than LockTimeout or the done channel
+// (optional) is closed meanwhile. Return true if the lock is placed.
+func (part *Partition) RLockData(done <-chan struct{}) (locked bool) {
+	return part.lockData(done, part.DataLock.TryRLock, part.DataLock.RLock, part.DataLock.RUnlock)
+}
+
+// Place a lock of DataLock by the functions, waiting for at most LockTimeout and until the done channel is closed. The
+// lock waited for is placed by a goroutine of its own, so that a writer waiting for the lock still holds off new
+// readers; the goroutine releases the lock should it be placed after the wait is given up.
+func (part *Partition) lockData(done <-chan struct{}, tryLock func() bool, lock, unlock func()) bool {
+	if tryLock() {
+		return true
+	}
+	timeout := part.lockTimeout()
+	atomic.AddInt32(&part.dataWaiters, 1)
+	defer atomic.AddInt32(&part.dataWaiters, -1)
+	if timeout == 0 && done == nil {
+		lock()
+		return true
+	}
+	var handover sync.Mutex
+	placed, abandoned := make(chan struct{}), false
+	go func() {
+		lock()
+		handover.Lock()
+		defer handover.Unlock()
+		if abandoned {
+			unlock()
+		} else {
+			close(placed)
+		}
+	}()
+	var expiry <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expiry = timer.C
+	}
+	select {
+	case <-placed:
+		return true
+	case <-expiry:
+	case <-done:
+	}
+	handover.Lock()
+	defer handover.Unlock()
+	select {
+	case <-placed:
+		return true
+	default:
+		abandoned = true
+		return false
+	}
+}
+
+// Return the documents locked for exclusive update, and the number of LockData and RLockData calls waiting for
+// DataLock.
+func (part *Partition) Locks() (docs []UpdateLock, dataWaiters int) {
+	part.exclUpdateLock.Lock()
+	for id, held := range part.exclUpdate {
+		docs = append(docs, UpdateLock{ID: id, Since: held.since, Waiters: held.waiters})
+	}
+	part.exclUpdateLock.Unlock()
+	return docs, int(atomic.LoadInt32(&part.dataWaiters))
+}
+
+// Return the number of times the update locks of documents were waited for and the total time waited, and the waits of
+// the documents waited for the most, in no particular order. Counting starts over if reset is true.
+func (part *Partition) Contention(reset bool) (waits int64, wait time.Duration, docs []DocContention) {
+	part.exclUpdateLock.Lock()
+	defer part.exclUpdateLock.Unlock()
+	lc := &part.contention
+	waits, wait = lc.waits, lc.wait
+	docs = make([]DocContention, 0, len(lc.docs))
+	for _, doc := range lc.docs {
+		docs = append(docs, *doc)
+	}
+	if reset {
+		*lc = lockContention{docs: make(map[int]*DocContention)}
+	}
+	return
+}
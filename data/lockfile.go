@@ -0,0 +1,85 @@
+// Lock file guards a directory against concurrent use by multiple processes.
+
+package data
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+// LockFile is an exclusively locked file that identifies its owner process.
+type LockFile struct {
+	Path string
+	Fh   *os.File
+	info os.FileInfo
+}
+
+// Lock files held by this process. File system locks do not reliably tell apart handles of the same process (e.g.
+// flock emulated by POSIX record locks on network file systems), hence the process keeps track of its lock files.
+var (
+	heldLocks     = make(map[*LockFile]struct{})
+	heldLocksLock = new(sync.Mutex)
+)
+
+// Lock the file exclusively and write the process ID and host name into it. If another process, or this process, holds
+// the lock, fail immediately with an error that names the owner process. A lock file left behind by a terminated
+// process is reused.
+func AcquireLockFile(path string) (lock *LockFile, err error) {
+	lock = &LockFile{Path: path}
+	if lock.Fh, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600); err != nil {
+		return nil, err
+	} else if lock.info, err = lock.Fh.Stat(); err != nil {
+		lock.Fh.Close()
+		return nil, err
+	}
+	heldLocksLock.Lock()
+	defer heldLocksLock.Unlock()
+	for held := range heldLocks {
+		if os.SameFile(held.info, lock.info) {
+			lock.Fh.Close()
+			host, _ := os.Hostname()
+			return nil, dberr.New(dberr.ErrorDirLocked, path, os.Getpid(), host)
+		}
+	}
+	if err = lockFile(lock.Fh); err != nil {
+		lock.Fh.Close()
+		tdlog.Noticef("Failed to lock %s: %v", path, err)
+		pid, host := "unknown", "unknown"
+		if owner, readErr := ioutil.ReadFile(path); readErr == nil {
+			if fields := strings.Fields(string(owner)); len(fields) == 2 {
+				pid, host = fields[0], fields[1]
+			}
+		}
+		return nil, dberr.New(dberr.ErrorDirLocked, path, pid, host)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	if err = lock.Fh.Truncate(0); err != nil {
+		lock.Fh.Close()
+		return nil, err
+	} else if _, err = lock.Fh.WriteAt([]byte(fmt.Sprintf("%d %s\n", os.Getpid(), host)), 0); err != nil {
+		lock.Fh.Close()
+		return nil, err
+	}
+	heldLocks[lock] = struct{}{}
+	return lock, nil
+}
+
+// Release the lock, the lock file is left in place for the next owner. Releasing the lock again does nothing.
+func (lock *LockFile) Release() error {
+	heldLocksLock.Lock()
+	defer heldLocksLock.Unlock()
+	if _, held := heldLocks[lock]; !held {
+		return nil
+	}
+	delete(heldLocks, lock)
+	return lock.Fh.Close()
+}
@@ -0,0 +1,63 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestAcquireLockFile(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	// A lock file left behind carries stale owner information, it is overwritten
+	if err := ioutil.WriteFile(tmp, []byte("123456789 stale-host-name\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := AcquireLockFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, err := ioutil.ReadFile(tmp)
+	if err != nil || !strings.HasPrefix(string(owner), fmt.Sprintf("%d ", os.Getpid())) {
+		t.Fatal(string(owner), err)
+	}
+	patch := monkey.Patch(lockFile, func(fh *os.File) error {
+		return errors.New("resource temporarily unavailable")
+	})
+	_, err = AcquireLockFile(tmp)
+	patch.Unpatch()
+	if dberr.Type(err) != dberr.ErrorDirLocked || !strings.Contains(err.Error(), fmt.Sprint(os.Getpid())) {
+		t.Fatal(err)
+	}
+	if err = lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockFileHeldByThisProcess(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	lock, err := AcquireLockFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = AcquireLockFile(tmp); dberr.Type(err) != dberr.ErrorDirLocked || !strings.Contains(err.Error(), fmt.Sprint(os.Getpid())) {
+		t.Fatal(err)
+	}
+	if err = lock.Release(); err != nil {
+		t.Fatal(err)
+	} else if err = lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if lock, err = AcquireLockFile(tmp); err != nil {
+		t.Fatal(err)
+	} else if err = lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,7 +6,12 @@
 package data
 
 import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/cankansin/tiedot/dberr"
 	"github.com/cankansin/tiedot/tdlog"
@@ -17,10 +22,13 @@ type Partition struct {
 	*Config
 	col      *Collection
 	lookup   *HashTable
+	count    int           // Exact number of documents
 	DataLock *sync.RWMutex // guard against concurrent document updates
 
-	exclUpdate     map[int]chan struct{}
-	exclUpdateLock *sync.Mutex // guard against concurrent exclusive locking of documents
+	exclUpdate     map[int]*updateLock
+	exclUpdateLock *sync.Mutex    // guard against concurrent exclusive locking of documents
+	dataWaiters    int32          // Number of LockData and RLockData calls waiting for DataLock
+	contention     lockContention // Waits for the update locks of documents, protected by exclUpdateLock
 }
 
 func (conf *Config) newPartition() *Partition {
@@ -28,8 +36,9 @@ func (conf *Config) newPartition() *Partition {
 	return &Partition{
 		Config:         conf,
 		exclUpdateLock: new(sync.Mutex),
-		exclUpdate:     make(map[int]chan struct{}),
+		exclUpdate:     make(map[int]*updateLock),
 		DataLock:       new(sync.RWMutex),
+		contention:     lockContention{docs: make(map[int]*DocContention)},
 	}
 }
 
@@ -45,6 +54,11 @@ func (conf *Config) OpenPartition(colPath, lookupPath string) (part *Partition,
 	return
 }
 
+// Return the collection data file and the lookup hash table file of the partition.
+func (part *Partition) DataFiles() []*DataFile {
+	return []*DataFile{part.col.DataFile, part.lookup.DataFile}
+}
+
 // Insert a document. The ID may be used to retrieve/update/delete the document later on.
 func (part *Partition) Insert(id int, data []byte) (physID int, err error) {
 	physID, err = part.col.Insert(data)
@@ -52,6 +66,7 @@ func (part *Partition) Insert(id int, data []byte) (physID int, err error) {
 		return
 	}
 	part.lookup.Put(id, physID)
+	part.count++
 	return
 }
 
@@ -68,10 +83,31 @@ func (part *Partition) Read(id int) ([]byte, error) {
 	if data == nil {
 		return nil, dberr.New(dberr.ErrorNoDoc, id)
 	}
+	// Faults are injected into reading the document found from its data file
+	if _, err := injectFault(FAULT_READ, part.col.Path); err != nil {
+		return nil, err
+	}
 
 	return data, nil
 }
 
+// Run the function on a document without copying it out of the data file. The document is only valid during the
+// call, the function must neither retain nor modify it.
+func (part *Partition) ReadView(id int, fun func(doc []byte)) error {
+	physID := part.lookup.Get(id, 1)
+	if len(physID) == 0 {
+		return dberr.New(dberr.ErrorNoDoc, id)
+	}
+	data := part.col.view(physID[0])
+	if data == nil {
+		return dberr.New(dberr.ErrorNoDoc, id)
+	} else if _, err := injectFault(FAULT_READ, part.col.Path); err != nil {
+		return err
+	}
+	fun(data)
+	return nil
+}
+
 // Update a document.
 func (part *Partition) Update(id int, data []byte) (err error) {
 	physID := part.lookup.Get(id, 1)
@@ -89,19 +125,58 @@ func (part *Partition) Update(id int, data []byte) (err error) {
 	return
 }
 
-// Lock a document for exclusive update.
+// Lock a document for exclusive update. The lock is waited for indefinitely, as giving up on index maintenance after a
+// write would leave the indexes inconsistent; a wait beyond LockTimeout is logged.
 func (part *Partition) LockUpdate(id int) {
+	timeout := part.lockTimeout()
+	if timeout > 0 && part.LockUpdateTimeout(id, timeout) {
+		return
+	} else if timeout > 0 {
+		tdlog.Noticef("Waited over %v for the update lock of document %d, still waiting", timeout, id)
+	}
+	part.LockUpdateTimeout(id, 0)
+}
+
+// Lock a document for exclusive update, unless it remains locked for longer than the timeout (0 - wait indefinitely).
+// Return true if the document is locked.
+func (part *Partition) LockUpdateTimeout(id int, timeout time.Duration) (locked bool) {
+	var expiry <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expiry = timer.C
+	}
+	var waitSince time.Time
 	for {
 		part.exclUpdateLock.Lock()
-		ch, ok := part.exclUpdate[id]
+		held, ok := part.exclUpdate[id]
 		if !ok {
-			part.exclUpdate[id] = make(chan struct{})
+			now := time.Now()
+			part.exclUpdate[id] = &updateLock{released: make(chan struct{}), since: now}
+			if !waitSince.IsZero() {
+				part.contention.count(id, now.Sub(waitSince))
+			}
+			part.exclUpdateLock.Unlock()
+			return true
+		} else if waitSince.IsZero() {
+			waitSince = time.Now()
 		}
+		held.waiters++
 		part.exclUpdateLock.Unlock()
-		if ok {
-			<-ch
-		} else {
-			break
+		timedOut := false
+		select {
+		case <-held.released:
+		case <-expiry:
+			timedOut = true
+		}
+		part.exclUpdateLock.Lock()
+		held.waiters--
+		if timedOut {
+			part.contention.count(id, time.Since(waitSince))
+		}
+		part.exclUpdateLock.Unlock()
+		if timedOut {
+			return false
 		}
 	}
 }
@@ -109,35 +184,86 @@ func (part *Partition) LockUpdate(id int) {
 // Unlock a document to make it ready for the next update.
 func (part *Partition) UnlockUpdate(id int) {
 	part.exclUpdateLock.Lock()
-	ch := part.exclUpdate[id]
+	held := part.exclUpdate[id]
 	delete(part.exclUpdate, id)
 	part.exclUpdateLock.Unlock()
-	close(ch)
+	close(held.released)
 }
 
 // Delete a document.
 func (part *Partition) Delete(id int) (err error) {
+	if _, err = injectFault(FAULT_DELETE, part.col.Path); err != nil {
+		return
+	}
 	physID := part.lookup.Get(id, 1)
 	if len(physID) == 0 {
 		return dberr.New(dberr.ErrorNoDoc, id)
 	}
 	part.col.Delete(physID[0])
 	part.lookup.Remove(id, physID[0])
+	part.count--
 	return
 }
 
 // Partition documents into roughly equally sized portions, and run the function on every document in the portion.
 func (part *Partition) ForEachDoc(partNum, totalPart int, fun func(id int, doc []byte) bool) (moveOn bool) {
-	ids, physIDs := part.lookup.GetPartition(partNum, totalPart)
-	for i, id := range ids {
-		data := part.col.Read(physIDs[i])
-		if data != nil {
-			if !fun(id, data) {
-				return false
-			}
+	return part.forEachDoc(partNum, totalPart, part.col.Read, fun)
+}
+
+// Like ForEachDoc, but documents are not copied out of the data file. Each document is only valid during the call to
+// the function, which must neither retain nor modify it.
+func (part *Partition) ForEachDocView(partNum, totalPart int, fun func(id int, doc []byte) bool) (moveOn bool) {
+	return part.forEachDoc(partNum, totalPart, part.col.view, fun)
+}
+
+func (part *Partition) forEachDoc(partNum, totalPart int, read func(physID int) []byte, fun func(id int, doc []byte) bool) (moveOn bool) {
+	return part.lookup.ForEachEntry(partNum, totalPart, func(id, physID int) bool {
+		if data := read(physID); data != nil {
+			return fun(id, data)
 		}
+		return true
+	})
+}
+
+// Return the IDs of all documents and their physical locations, so that ReadSnapshot may read the documents after
+// the partition is unlocked in between.
+func (part *Partition) Snapshot() (ids, physIDs []int) {
+	return part.lookup.GetPartition(0, 1)
+}
+
+// Read a document captured by Snapshot. The document is read from its captured location, unless an update has moved
+// it since; a document deleted since is not found.
+func (part *Partition) ReadSnapshot(id, physID int) ([]byte, error) {
+	if data := part.col.Read(physID); data != nil {
+		return data, nil
 	}
-	return true
+	return part.Read(id)
+}
+
+// Release memory pages of document data after a one-off scan of all documents, if configured to do so.
+func (part *Partition) AfterScan() error {
+	if part.DontNeedAfterScan {
+		return part.col.DontNeed()
+	}
+	return nil
+}
+
+// Apply the current memory usage settings to the open data file and lookup hash table.
+func (part *Partition) ApplySettings() error {
+	if err := part.col.ApplySettings(); err != nil {
+		return err
+	}
+	return part.lookup.ApplySettings()
+}
+
+// Verify that the data file and lookup hash table are open and intact. Places the partition's read lock.
+func (part *Partition) Check() error {
+	part.DataLock.RLock()
+	defer part.DataLock.RUnlock()
+	if err := part.col.Check(); err != nil {
+		return err
+	}
+	return part.lookup.Check()
 }
 
 // Return approximate number of documents in the partition.
@@ -157,6 +283,51 @@ func (part *Partition) ApproxDocCount() int {
 	}
 }
 
+// Return the exact number of documents in the partition.
+func (part *Partition) Count() int {
+	return part.count
+}
+
+// Load the number of documents saved by SaveCount upon closing the partition, or count the entries of the lookup hash
+// table if the number was not saved, such as after a crash. The saved number is removed once loaded, so that it is
+// not trusted again should the process crash before saving it anew.
+func (part *Partition) LoadCount(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err = os.Remove(path); err != nil {
+			return err
+		} else if count, err := strconv.Atoi(strings.TrimSpace(string(content))); err == nil && count >= 0 {
+			part.count = count
+			return nil
+		}
+		tdlog.Noticef("Will recount documents of %s, the saved number %q is invalid", part.col.Path, content)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	part.count = 0
+	part.lookup.ForEachEntry(0, 1, func(_, _ int) bool {
+		part.count++
+		return true
+	})
+	return nil
+}
+
+// Save the number of documents for LoadCount, the partition must not be written to afterwards.
+func (part *Partition) SaveCount(path string) error {
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(part.count)), 0600)
+}
+
+// Release the disk space of deleted documents, and trim pre-allocated space beyond the space in-use of the data file
+// and lookup hash table.
+func (part *Partition) Shrink() error {
+	if err := part.col.PunchHoles(); err != nil {
+		return err
+	} else if err := part.col.Shrink(); err != nil {
+		return err
+	}
+	return part.lookup.Shrink()
+}
+
 // Clear data file and lookup hash table.
 func (part *Partition) Clear() error {
 
@@ -173,6 +344,7 @@ func (part *Partition) Clear() error {
 
 		err = dberr.New(dberr.ErrorIO)
 	}
+	part.count = 0
 
 	return err
 }
@@ -3,6 +3,7 @@ package data
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"reflect"
@@ -77,6 +78,52 @@ func TestPartitionDocCRUD(t *testing.T) {
 }
 
 // Lock & unlock
+func TestPartitionReadView(t *testing.T) {
+	colPath := "/tmp/tiedot_test_col"
+	htPath := "/tmp/tiedot_test_ht"
+	os.Remove(colPath)
+	os.Remove(htPath)
+	defer os.Remove(colPath)
+	defer os.Remove(htPath)
+	d := defaultConfig()
+	part, err := d.OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.Close()
+	for i := 0; i < 10; i++ {
+		if _, err = part.Insert(i, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var viewed string
+	if err = part.ReadView(3, func(doc []byte) { viewed = string(doc) }); err != nil || viewed != "3 " {
+		t.Fatal(err, viewed)
+	}
+	if err = part.ReadView(123, func([]byte) { t.Fatal("viewed nonexistent document") }); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	// Scanned documents are the same with and without copying
+	copied := make(map[int]string)
+	part.ForEachDoc(0, 1, func(id int, doc []byte) bool {
+		copied[id] = string(doc)
+		return true
+	})
+	if len(copied) != 10 {
+		t.Fatal(copied)
+	}
+	part.ForEachDocView(0, 1, func(id int, doc []byte) bool {
+		if copied[id] != string(doc) {
+			t.Fatal(id, string(doc))
+		}
+		delete(copied, id)
+		return true
+	})
+	if len(copied) != 0 {
+		t.Fatal(copied)
+	}
+}
+
 func TestLock(t *testing.T) {
 	d := defaultConfig()
 	part := d.newPartition()
@@ -99,6 +146,98 @@ func TestLock(t *testing.T) {
 	}
 }
 
+func TestLockTimeout(t *testing.T) {
+	d := defaultConfig()
+	d.LockTimeout = 20
+	part := d.newPartition()
+	part.LockUpdate(1)
+	if part.LockUpdateTimeout(1, 10*time.Millisecond) {
+		t.Fatal("locked twice")
+	}
+	locked := make(chan bool)
+	go func() {
+		locked <- part.LockUpdateTimeout(1, 0)
+	}()
+	for waiters := 0; waiters == 0; {
+		time.Sleep(time.Millisecond)
+		docs, _ := part.Locks()
+		if len(docs) != 1 || docs[0].ID != 1 || docs[0].Since.IsZero() {
+			t.Fatal(docs)
+		}
+		waiters = docs[0].Waiters
+	}
+	part.UnlockUpdate(1)
+	if !<-locked {
+		t.Fatal("not locked")
+	}
+	part.UnlockUpdate(1)
+	// Data lock waits give up after LockTimeout, the lock placed afterwards is released
+	part.DataLock.Lock()
+	if part.LockData(nil) || part.RLockData(nil) {
+		t.Fatal("locked while write locked")
+	}
+	go func() {
+		locked <- part.RLockData(nil)
+	}()
+	for waiters := 0; waiters == 0; _, waiters = part.Locks() {
+		time.Sleep(time.Millisecond)
+	}
+	part.DataLock.Unlock()
+	if !<-locked {
+		t.Fatal("not locked")
+	}
+	part.DataLock.RUnlock()
+	if !part.LockData(nil) {
+		t.Fatal("not locked")
+	}
+	part.DataLock.Unlock()
+}
+
+func TestLockContention(t *testing.T) {
+	part := defaultConfig().newPartition()
+	part.LockUpdate(1)
+	part.UnlockUpdate(1)
+	if waits, _, docs := part.Contention(false); waits != 0 || len(docs) != 0 {
+		t.Fatal(waits, docs)
+	}
+	// A wait is counted once it is over, whether or not the lock is placed
+	part.LockUpdate(1)
+	if part.LockUpdateTimeout(1, 10*time.Millisecond) {
+		t.Fatal("locked twice")
+	}
+	locked := make(chan bool)
+	go func() {
+		locked <- part.LockUpdateTimeout(1, 0)
+	}()
+	for waiters := 0; waiters == 0; {
+		time.Sleep(time.Millisecond)
+		docs, _ := part.Locks()
+		waiters = docs[0].Waiters
+	}
+	part.UnlockUpdate(1)
+	<-locked
+	part.UnlockUpdate(1)
+	waits, wait, docs := part.Contention(true)
+	if waits != 2 || wait < 10*time.Millisecond || len(docs) != 1 || docs[0].ID != 1 || docs[0].Waits != 2 || docs[0].Wait != wait {
+		t.Fatal(waits, wait, docs)
+	}
+	if waits, _, docs = part.Contention(false); waits != 0 || len(docs) != 0 {
+		t.Fatal(waits, docs)
+	}
+	// The documents waited for the least make room for others
+	for id := 0; id <= CONTENTION_TRACKED_DOCS; id++ {
+		part.contention.count(id, time.Millisecond)
+		if id == 0 {
+			part.contention.count(id, time.Millisecond)
+		}
+	}
+	if _, _, docs = part.Contention(false); len(docs) != CONTENTION_TRACKED_DOCS {
+		t.Fatal(len(docs))
+	} else if tracked := part.contention.docs; tracked[0] == nil || tracked[CONTENTION_TRACKED_DOCS] == nil {
+		t.Fatal("Hot document is not tracked")
+	}
+}
+
 func TestApproxDocCount(t *testing.T) {
 	rand.Seed(time.Now().UnixNano())
 	colPath := "/tmp/tiedot_test_col"
@@ -154,6 +293,64 @@ func TestApproxDocCount(t *testing.T) {
 		t.Fatal("Algorithm is way too slow")
 	}
 }
+func TestPartitionCount(t *testing.T) {
+	colPath := "/tmp/tiedot_test_col"
+	htPath := "/tmp/tiedot_test_ht"
+	countPath := "/tmp/tiedot_test_cnt"
+	os.Remove(colPath)
+	os.Remove(htPath)
+	os.Remove(countPath)
+	defer os.Remove(colPath)
+	defer os.Remove(htPath)
+	defer os.Remove(countPath)
+	d := defaultConfig()
+	part, err := d.OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err = part.Insert(i, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = part.Update(1, []byte("abc")); err != nil {
+		t.Fatal(err)
+	} else if err = part.Delete(2); err != nil {
+		t.Fatal(err)
+	} else if err = part.Delete(2); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if part.Count() != 9 {
+		t.Fatal(part.Count())
+	}
+	// Without a saved number the documents are counted
+	if err = part.LoadCount(countPath); err != nil || part.Count() != 9 {
+		t.Fatal(err, part.Count())
+	}
+	// The saved number is trusted once
+	part.count = 5
+	if err = part.SaveCount(countPath); err != nil {
+		t.Fatal(err)
+	} else if err = part.LoadCount(countPath); err != nil || part.Count() != 5 {
+		t.Fatal(err, part.Count())
+	} else if _, err = os.Stat(countPath); !os.IsNotExist(err) {
+		t.Fatal("saved number was not removed", err)
+	} else if err = part.LoadCount(countPath); err != nil || part.Count() != 9 {
+		t.Fatal(err, part.Count())
+	}
+	// An invalid number is ignored
+	if err = ioutil.WriteFile(countPath, []byte("-1"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = part.LoadCount(countPath); err != nil || part.Count() != 9 {
+		t.Fatal(err, part.Count())
+	}
+	if err = part.Clear(); err != nil || part.Count() != 0 {
+		t.Fatal(err, part.Count())
+	}
+	if err = part.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestOpenPartitionErrOpenCol(t *testing.T) {
 	var d *Config
 	errMessage := "error open collection"
@@ -241,8 +438,14 @@ func TestUpdateErr(t *testing.T) {
 func TestForEachDocIfCallbackTrue(t *testing.T) {
 	var hash *HashTable
 	var col *Collection
-	patchHash := monkey.PatchInstanceMethod(reflect.TypeOf(hash), "GetPartition", func(_ *HashTable, partNum, partSize int) (keys, vals []int) {
-		return []int{1, 2, 3}, []int{1, 2, 3}
+	// Documents are streamed from the lookup entries
+	patchHash := monkey.PatchInstanceMethod(reflect.TypeOf(hash), "ForEachEntry", func(_ *HashTable, partNum, partSize int, fun func(key, val int) bool) bool {
+		for _, entry := range []int{1, 2, 3} {
+			if !fun(entry, entry) {
+				return false
+			}
+		}
+		return true
 	})
 	defer patchHash.Unpatch()
 	patchCol := monkey.PatchInstanceMethod(reflect.TypeOf(col), "Read", func(_ *Collection, id int) []byte {
@@ -259,6 +462,54 @@ func TestForEachDocIfCallbackTrue(t *testing.T) {
 		t.Error("Expected bool false")
 	}
 }
+func TestPartitionSnapshot(t *testing.T) {
+	colPath := "/tmp/tiedot_test_col"
+	htPath := "/tmp/tiedot_test_ht"
+	os.Remove(colPath)
+	os.Remove(htPath)
+	defer os.Remove(colPath)
+	defer os.Remove(htPath)
+	d := defaultConfig()
+	part, err := d.OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := 1; id <= 3; id++ {
+		if _, err = part.Insert(id, []byte(strconv.Itoa(id))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids, physIDs := part.Snapshot()
+	if len(ids) != 3 || len(physIDs) != 3 {
+		t.Fatal(ids, physIDs)
+	}
+	// Document 1 is moved by the update, document 2 is deleted
+	if err = part.Update(1, []byte("abcdef")); err != nil {
+		t.Fatal(err)
+	} else if err = part.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		readback, err := part.ReadSnapshot(id, physIDs[i])
+		switch id {
+		case 1:
+			if err != nil || string(readback) != "abcdef      " {
+				t.Fatal(err, readback)
+			}
+		case 2:
+			if dberr.Type(err) != dberr.ErrorNoDoc {
+				t.Fatal(err, readback)
+			}
+		case 3:
+			if err != nil || string(readback) != "3 " {
+				t.Fatal(err, readback)
+			}
+		}
+	}
+	if err = part.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
 func TestApproxDocCountKeysEqualZero(t *testing.T) {
 	var hash *HashTable
 	patchHash := monkey.PatchInstanceMethod(reflect.TypeOf(hash), "GetPartition", func(_ *HashTable, partNum, partSize int) (keys, vals []int) {
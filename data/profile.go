@@ -0,0 +1,45 @@
+// Configuration profiles.
+//
+// The default configuration pre-allocates tens of megabytes to each file of a collection, and reserves a gigabyte of
+// address space beyond each file map, which is a fine trade for a server but prohibitive on a small ARM board or an
+// embedded device. A profile is a set of settings chosen at the creation of a database; the "small" profile starts the
+// files with a few kilobytes, grows them in small steps, uses fewer and smaller hash table buckets and reserves less
+// room for documents to grow. The settings are written into the configuration file of the new database like the
+// default ones, so that they may be adjusted later, and an existing database keeps its own settings whatever the
+// profile it is opened with.
+
+package data
+
+import (
+	"github.com/cankansin/tiedot/dberr"
+)
+
+const (
+	PROFILE_DEFAULT = "default" // PROFILE_DEFAULT is the configuration profile of servers, matching the built-in defaults.
+	PROFILE_SMALL   = "small"   // PROFILE_SMALL is the configuration profile of small devices, keeping files and memory maps small.
+)
+
+// Return the configuration of a new database of the profile, "" meaning the default profile. Fail with
+// ErrorInvalidParam if the profile is unknown.
+func ProfileConfig(profile string) (*Config, error) {
+	conf := defaultConfig()
+	switch profile {
+	case "", PROFILE_DEFAULT:
+	case PROFILE_SMALL:
+		conf.ColFileGrowth = 1048576
+		conf.ColInitialSize = 65536
+		conf.HTFileGrowth = 262144
+		conf.HTInitialSize = 65536
+		// 256 buckets of 8 entries occupy 45KB, they fit into a new hash table file
+		conf.HashBits = 8
+		conf.PerBucket = 8
+		conf.DocPadding = 25
+		conf.SparseFiles = true
+		conf.MapReserve = 0
+		conf.MaxOpenFiles = 64
+		conf.CalculateConfigConstants()
+	default:
+		return nil, dberr.New(dberr.ErrorInvalidParam, "configuration profile", profile)
+	}
+	return conf, nil
+}
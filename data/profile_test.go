@@ -0,0 +1,52 @@
+package data
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestProfileConfig(t *testing.T) {
+	if _, err := ProfileConfig("tiny"); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+	if conf, err := ProfileConfig(""); err != nil || matchConfig(conf, defaultConfig()) != nil || conf.DocPadding != 0 {
+		t.Fatal(conf, err)
+	}
+	small, err := ProfileConfig(PROFILE_SMALL)
+	if err != nil {
+		t.Fatal(err)
+	} else if small.InitialBuckets*small.BucketSize > small.HTInitialSize || small.MapReserve != 0 {
+		t.Fatal(small)
+	}
+	// The profile applies to a new database only
+	dir := "/tmp/tiedot_config_test_profile"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	if conf, err := CreateOrReadProfileConfig(dir, PROFILE_SMALL); err != nil || matchConfig(conf, small) != nil || conf.MaxDocDepth != DefaultMaxDocDepth {
+		t.Fatal(conf, err)
+	}
+	if conf, err := CreateOrReadProfileConfig(dir, PROFILE_DEFAULT); err != nil || matchConfig(conf, small) != nil || conf.DocPadding != small.DocPadding {
+		t.Fatal(conf, err)
+	}
+	// New documents reserve room by the padding
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	col, err := small.OpenCollection(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer col.Close()
+	if col.Size != small.ColInitialSize {
+		t.Fatal(col.Size)
+	}
+	id, err := col.Insert(make([]byte, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room, _ := binary.Varint(col.Buf[id+1 : id+11]); room != 125 {
+		t.Fatal(room)
+	}
+}
@@ -0,0 +1,77 @@
+// Time series segment file contains time-stamped documents.
+//
+// Every document has a binary header - validity, time and length - followed by UTF-8 text content. Documents are
+// appended one after another without room for updates; the space of a segment is reclaimed only when the entire
+// segment is dropped.
+
+package data
+
+import (
+	"encoding/binary"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+const (
+	SegmentDocHeader = 1 + 10 + 10 // SegmentDocHeader is the size of segment document header fields.
+)
+
+// Segment file contains time-stamped document headers and document text data.
+type Segment struct {
+	*DataFile
+	*Config
+}
+
+// Open a segment file.
+func (conf *Config) OpenSegment(path string) (seg *Segment, err error) {
+	seg = new(Segment)
+	if seg.DataFile, err = conf.openDataFile(path, conf.ColFileGrowth, conf.ColInitialSize); err != nil {
+		return
+	} else if err = seg.Advise(mapAdvice(conf.ColMapAdvice)); err != nil {
+		return
+	}
+	seg.Config = conf
+	return
+}
+
+// Apply the current memory usage settings to the open segment file.
+func (seg *Segment) ApplySettings() error {
+	return seg.applyFileSettings(seg.DataFile, seg.ColFileGrowth, seg.ColInitialSize, seg.ColMapAdvice)
+}
+
+// Append a document with its time (Unix nanoseconds).
+func (seg *Segment) Append(nanos int64, data []byte) error {
+	if len(data) > seg.DocMaxRoom {
+		return dberr.New(dberr.ErrorDocTooLarge, seg.DocMaxRoom, len(data))
+	}
+	pos := seg.Used
+	docSize := SegmentDocHeader + len(data)
+	if err := seg.EnsureSize(docSize); err != nil {
+		return err
+	}
+	seg.Used += docSize
+	// Write validity, time, length and document data
+	seg.Buf[pos] = 1
+	binary.PutVarint(seg.Buf[pos+1:pos+11], nanos)
+	binary.PutVarint(seg.Buf[pos+11:pos+21], int64(len(data)))
+	copy(seg.Buf[pos+SegmentDocHeader:seg.Used], data)
+	seg.MarkDirty(pos, seg.Used)
+	return nil
+}
+
+// Run the function on every document in the order of appending; stop when the function returns false. The document
+// data is valid only until the function returns.
+func (seg *Segment) ForEachDoc(fun func(nanos int64, doc []byte) bool) {
+	for pos := 0; pos < seg.Used-SegmentDocHeader && pos >= 0; {
+		nanos, _ := binary.Varint(seg.Buf[pos+1 : pos+11])
+		length, _ := binary.Varint(seg.Buf[pos+11 : pos+21])
+		docEnd := pos + SegmentDocHeader + int(length)
+		if seg.Buf[pos] != 1 || length < 0 || length > int64(seg.DocMaxRoom) || docEnd > seg.Used {
+			// Corrupted document - nothing after it can be located
+			return
+		} else if !fun(nanos, seg.Buf[pos+SegmentDocHeader:docEnd]) {
+			return
+		}
+		pos = docEnd
+	}
+}
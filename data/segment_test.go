@@ -0,0 +1,55 @@
+package data
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestSegmentAppend(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	conf := defaultConfig()
+	conf.ColFileGrowth = 1024
+	seg, err := conf.OpenSegment(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Documents grow the file, and are read back in the order of appending
+	for i := 0; i < 100; i++ {
+		if err = seg.Append(int64(100-i), []byte(fmt.Sprintf(`{"i":%d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = seg.Append(0, make([]byte, conf.DocMaxRoom+1)); dberr.Type(err) != dberr.ErrorDocTooLarge {
+		t.Fatal(err)
+	}
+	check := func(seg *Segment) {
+		i := 0
+		seg.ForEachDoc(func(nanos int64, doc []byte) bool {
+			if nanos != int64(100-i) || string(doc) != fmt.Sprintf(`{"i":%d}`, i) {
+				t.Fatal(i, nanos, string(doc))
+			}
+			i++
+			return i < 50
+		})
+		if i != 50 {
+			t.Fatal(i)
+		}
+	}
+	check(seg)
+	// Appended documents are found after reopening
+	used := seg.Used
+	if err = seg.Close(); err != nil {
+		t.Fatal(err)
+	} else if seg, err = conf.OpenSegment(tmp); err != nil {
+		t.Fatal(err)
+	}
+	defer seg.Close()
+	if seg.Used != used {
+		t.Fatal(seg.Used, used)
+	}
+	check(seg)
+}
@@ -0,0 +1,198 @@
+// Document access control lists.
+//
+// A collection with an ACL path (see ColConfig) keeps the principals allowed to access each document in the attribute
+// at the path - a string, or an array of strings. The ...As functions act on behalf of a principal: documents that do
+// not list the principal appear not to exist, and writes may not leave a document without the principal. Documents
+// inserted without the attribute are owned by the inserting principal, and updated documents without the attribute
+// keep the principals of their original. Queries made on behalf of a principal are restricted by a lookup of the
+// principal at the ACL path, which must therefore be indexed.
+
+package db
+
+import (
+	"context"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Return true if the document lists the principal at the ACL path, or if the collection has no ACL path. Does not
+// place schema lock.
+func (col *Col) allows(principal string, doc map[string]interface{}) bool {
+	if len(col.conf.ACLPath) == 0 {
+		return true
+	}
+	for _, val := range GetIn(doc, col.conf.ACLPath) {
+		if val == principal {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if the principal may access the document.
+func (col *Col) Allows(principal string, doc map[string]interface{}) bool {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	return col.allows(principal, doc)
+}
+
+// Return the document to be written on behalf of the principal. A document without the ACL attribute takes the value
+// of the original document, or the principal if there is no original; either way the principal must be allowed to
+// access the result. The input document is not modified. Does not place schema lock.
+func (col *Col) aclWrite(principal string, doc, original map[string]interface{}) (map[string]interface{}, error) {
+	if len(col.conf.ACLPath) == 0 {
+		return doc, nil
+	}
+	if _, found := aclValue(doc, col.conf.ACLPath); !found {
+		var val interface{} = principal
+		if original != nil {
+			val, _ = aclValue(original, col.conf.ACLPath)
+		}
+		doc = setACL(doc, col.conf.ACLPath, val)
+	}
+	if !col.allows(principal, doc) {
+		return nil, dberr.New(dberr.ErrorACLDenied, principal)
+	}
+	return doc, nil
+}
+
+// Return the value at the path, and false if the path ends at a missing attribute of an object. A path leading through
+// a value other than an object is found, so that the value in the way is never replaced.
+func aclValue(doc map[string]interface{}, path []string) (val interface{}, found bool) {
+	val = doc
+	for _, seg := range path {
+		aMap, isMap := val.(map[string]interface{})
+		if !isMap {
+			return val, true
+		}
+		if val = aMap[seg]; val == nil {
+			return nil, false
+		}
+	}
+	return val, true
+}
+
+// Return a copy of the document with the value set at the path, the objects along the path are copied or created.
+func setACL(doc map[string]interface{}, path []string, val interface{}) map[string]interface{} {
+	docCopy := make(map[string]interface{}, len(doc)+1)
+	for key, attr := range doc {
+		docCopy[key] = attr
+	}
+	if len(path) == 1 {
+		docCopy[path[0]] = val
+	} else {
+		nested, _ := doc[path[0]].(map[string]interface{})
+		docCopy[path[0]] = setACL(nested, path[1:], val)
+	}
+	return docCopy
+}
+
+// Return the query restricted to the documents the principal may access.
+func (col *Col) ACLQuery(principal string, q interface{}) interface{} {
+	col.db.schemaLock.RLock()
+	aclPath := col.conf.ACLPath
+	col.db.schemaLock.RUnlock()
+	if len(aclPath) == 0 {
+		return q
+	}
+	in := make([]interface{}, len(aclPath))
+	for i, seg := range aclPath {
+		in[i] = seg
+	}
+	return map[string]interface{}{"n": []interface{}{q, map[string]interface{}{"eq": principal, "in": in}}}
+}
+
+// Insert a document on behalf of the principal, who owns the document unless it has the ACL attribute already.
+func (col *Col) InsertAs(principal string, doc map[string]interface{}) (id int, err error) {
+	col.db.schemaLock.RLock()
+	doc, err = col.aclWrite(principal, doc, nil)
+	col.db.schemaLock.RUnlock()
+	if err != nil {
+		return
+	}
+	return col.Insert(doc)
+}
+
+// Find and retrieve a document by ID on behalf of the principal.
+func (col *Col) ReadAs(principal string, id int) (doc map[string]interface{}, err error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if doc, err = col.read(context.Background(), id, false); err == nil && !col.allows(principal, doc) {
+		return nil, dberr.New(dberr.ErrorNoDoc, id)
+	}
+	return
+}
+
+// Update a document on behalf of the principal. The document is checked and updated under the partition lock, like
+// UpdateFunc does.
+func (col *Col) UpdateAs(principal string, id int, doc map[string]interface{}) error {
+	return col.UpdateAsIf(principal, id, doc, nil)
+}
+
+// Update a document on behalf of the principal like UpdateAs, provided that the condition function (optional) returns
+// true for the document as it is right before the update; otherwise the document is left alone and the error is
+// ErrorDocChanged.
+func (col *Col) UpdateAsIf(principal string, id int, doc map[string]interface{}, cond func(original map[string]interface{}) bool) error {
+	if doc == nil {
+		return dberr.New(dberr.ErrorMissing, "document")
+	}
+	return col.UpdateFunc(id, func(original map[string]interface{}) (map[string]interface{}, error) {
+		if !col.allows(principal, original) {
+			return nil, dberr.New(dberr.ErrorNoDoc, id)
+		} else if cond != nil && !cond(original) {
+			return nil, dberr.New(dberr.ErrorDocChanged, id)
+		}
+		return col.aclWrite(principal, doc, original)
+	})
+}
+
+// Delete a document on behalf of the principal.
+func (col *Col) DeleteAs(principal string, id int) error {
+	release, err := col.throttleWrite()
+	if err != nil {
+		return err
+	}
+	defer release()
+	_, err = col.deleteIf(context.Background(), id, release, true, func(original map[string]interface{}) bool {
+		return col.allows(principal, original)
+	})
+	return err
+}
+
+// Analyse the documents accessible to the principal, see Analyze.
+func (col *Col) AnalyzeAs(principal string, paths [][]string, percentiles []float64) (Analysis, error) {
+	return col.analyze(paths, percentiles, func(doc map[string]interface{}) bool {
+		return col.allows(principal, doc)
+	})
+}
+
+// Delete all documents matching the query on behalf of the principal, see DeleteByQuery.
+func (col *Col) DeleteByQueryAs(principal string, q interface{}, progress func(QueryOpProgress)) (QueryOpProgress, error) {
+	return col.byQuery(context.Background(), col.ACLQuery(principal, q), func(ids []int) []error {
+		return col.deleteBatch(context.Background(), ids, col.aclGuard(principal))
+	}, progress)
+}
+
+// Patch all documents matching the query on behalf of the principal, see UpdateByQuery. Patched documents must remain
+// accessible to the principal.
+func (col *Col) UpdateByQueryAs(principal string, q interface{}, patch map[string]interface{}, progress func(QueryOpProgress)) (QueryOpProgress, error) {
+	if err := checkPatch(patch); err != nil {
+		return QueryOpProgress{}, err
+	}
+	return col.byQuery(context.Background(), col.ACLQuery(principal, q), func(ids []int) []error {
+		return col.patchBatch(context.Background(), ids, patch, col.aclGuard(principal))
+	}, progress)
+}
+
+// Return the guard of batch writes on behalf of the principal: the original document must be accessible to the
+// principal, and so must the updated document (nil if the document is deleted). The guard does not place schema lock.
+func (col *Col) aclGuard(principal string) batchGuard {
+	return func(id int, original, doc map[string]interface{}) error {
+		if !col.allows(principal, original) {
+			return dberr.New(dberr.ErrorNoDoc, id)
+		} else if doc != nil && !col.allows(principal, doc) {
+			return dberr.New(dberr.ErrorACLDenied, principal)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestDocACL(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.SetConfig(ColConfig{ACLPath: []string{"meta", ""}}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if err = col.SetConfig(ColConfig{ACLPath: []string{"meta", "owners"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Without the attribute, the inserting principal owns the document
+	doc := map[string]interface{}{"a": 1.0, "meta": map[string]interface{}{"kind": "note"}}
+	aliceID, err := col.InsertAs("alice", doc)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, modified := doc["meta"].(map[string]interface{})["owners"]; modified {
+		t.Fatal(doc)
+	}
+	if doc, err := col.ReadAs("alice", aliceID); err != nil || GetIn(doc, []string{"meta", "owners"})[0] != "alice" ||
+		GetIn(doc, []string{"meta", "kind"})[0] != "note" {
+		t.Fatal(doc, err)
+	} else if _, err = col.ReadAs("bob", aliceID); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	sharedID, err := col.InsertAs("bob", map[string]interface{}{"a": 2.0, "meta": map[string]interface{}{"owners": []interface{}{"bob", "alice"}}})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = col.InsertAs("bob", map[string]interface{}{"meta": map[string]interface{}{"owners": "alice"}}); dberr.Type(err) != dberr.ErrorACLDenied {
+		t.Fatal(err)
+	} else if _, err = col.InsertAs("bob", map[string]interface{}{"meta": "in the way"}); dberr.Type(err) != dberr.ErrorACLDenied {
+		t.Fatal(err)
+	}
+	// Updates keep the principals of the original
+	if err = col.UpdateAs("alice", sharedID, map[string]interface{}{"a": 3.0}); err != nil {
+		t.Fatal(err)
+	} else if doc, err := col.Read(sharedID); err != nil || len(GetIn(doc, []string{"meta", "owners"})) != 2 {
+		t.Fatal(doc, err)
+	} else if err = col.UpdateAs("bob", aliceID, map[string]interface{}{"a": 4.0}); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if err = col.UpdateAs("alice", aliceID, map[string]interface{}{"meta": map[string]interface{}{"owners": "bob"}}); dberr.Type(err) != dberr.ErrorACLDenied {
+		t.Fatal(err)
+	}
+	// Queries need the ACL path indexed
+	result := make(map[int]struct{})
+	if err = EvalQuery(col.ACLQuery("bob", "all"), col, &result); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"meta", "owners"}); err != nil {
+		t.Fatal(err)
+	}
+	for principal, count := range map[string]int{"alice": 2, "bob": 1, "carol": 0} {
+		result := make(map[int]struct{})
+		if err = EvalQuery(col.ACLQuery(principal, "all"), col, &result); err != nil || len(result) != count {
+			t.Fatal(principal, result, err)
+		}
+	}
+	// Writes by query leave alone the documents the principal may not access, or would lose access to
+	if prog, err := col.UpdateByQueryAs("bob", "all", map[string]interface{}{"meta": nil}, nil); err != nil || prog.Matched != 1 || prog.Failed != 1 {
+		t.Fatal(prog, err)
+	} else if prog, err = col.UpdateByQueryAs("bob", "all", map[string]interface{}{"b": true}, nil); err != nil || prog.Done != 1 {
+		t.Fatal(prog, err)
+	} else if prog, err = col.DeleteByQueryAs("carol", "all", nil); err != nil || prog.Matched != 0 {
+		t.Fatal(prog, err)
+	}
+	if err = col.DeleteAs("bob", aliceID); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if err = col.DeleteAs("bob", sharedID); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.Read(aliceID); err != nil {
+		t.Fatal(err)
+	}
+	// The guard of batch writes is checked under the partition lock
+	if errs := col.deleteBatch(context.Background(), []int{aliceID}, col.aclGuard("bob")); dberr.Type(errs[0]) != dberr.ErrorNoDoc {
+		t.Fatal(errs)
+	} else if errs = col.deleteBatch(context.Background(), []int{aliceID}, col.aclGuard("alice")); errs[0] != nil {
+		t.Fatal(errs)
+	}
+	// Without an ACL path, everyone may access everything
+	if err = col.SetConfig(ColConfig{}); err != nil {
+		t.Fatal(err)
+	} else if id, err := col.InsertAs("bob", map[string]interface{}{"a": 5.0}); err != nil {
+		t.Fatal(err)
+	} else if doc, err := col.ReadAs("carol", id); err != nil || doc["meta"] != nil {
+		t.Fatal(doc, err)
+	} else if q := col.ACLQuery("carol", "all"); q != "all" {
+		t.Fatal(q)
+	}
+}
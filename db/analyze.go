@@ -0,0 +1,288 @@
+// Approximate analytics of document values.
+//
+// An analysis scans all documents of a collection once, the partitions in parallel, and summarises the values along
+// each of the given paths in fixed-size sketches: a HyperLogLog counts the distinct values (within about 1% with 2^14
+// registers), and a t-digest estimates percentiles of the numeric values (most accurately near the extremes). Values
+// are told apart by their text, like indexes do, and the paths may start with index functions, e.g. ["@lower", "email"].
+// The sketches of the partitions are merged in the end, so that the result does not depend on the number of partitions
+// beyond the approximation.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/cankansin/tiedot/data"
+	"github.com/cankansin/tiedot/dberr"
+)
+
+const (
+	HLL_PRECISION       = 14  // Number of hash bits choosing a HyperLogLog register, there are 2^HLL_PRECISION registers.
+	TDIGEST_COMPRESSION = 100 // Compression of t-digests, roughly the number of centroids kept.
+)
+
+// Approximate number of distinct values.
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, 1<<HLL_PRECISION)}
+}
+
+// Count the value by its text.
+func (hll *hyperLogLog) add(str string) {
+	hash := fnv.New64a()
+	hash.Write([]byte(str))
+	// Mix the bits (splitmix64 finaliser), the register index comes from the highest ones
+	sum := hash.Sum64()
+	sum = (sum ^ sum>>30) * 0xbf58476d1ce4e5b9
+	sum = (sum ^ sum>>27) * 0x94d049bb133111eb
+	sum ^= sum >> 31
+	register := sum >> (64 - HLL_PRECISION)
+	rank := uint8(bits.LeadingZeros64(sum<<HLL_PRECISION|1<<(HLL_PRECISION-1))) + 1
+	if rank > hll.registers[register] {
+		hll.registers[register] = rank
+	}
+}
+
+// Count the values counted by the other as well.
+func (hll *hyperLogLog) merge(other *hyperLogLog) {
+	for i, rank := range other.registers {
+		if rank > hll.registers[i] {
+			hll.registers[i] = rank
+		}
+	}
+}
+
+// Return the estimated number of distinct values.
+func (hll *hyperLogLog) count() int {
+	m := float64(len(hll.registers))
+	sum, zeros := 0.0, 0
+	for _, rank := range hll.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for few values
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int(estimate + 0.5)
+}
+
+// A centroid of a t-digest summarises values near its mean.
+type centroid struct {
+	mean, weight float64
+}
+
+// Approximate distribution of numbers (merging t-digest).
+type tDigest struct {
+	centroids []centroid // In ascending order of mean
+	buffer    []centroid // Values added since the centroids were last compressed
+	total     float64
+	min, max  float64
+}
+
+func newTDigest() *tDigest {
+	return &tDigest{min: math.Inf(1), max: math.Inf(-1)}
+}
+
+// Add the number.
+func (digest *tDigest) add(val float64) {
+	digest.buffer = append(digest.buffer, centroid{val, 1})
+	digest.total++
+	digest.min = math.Min(digest.min, val)
+	digest.max = math.Max(digest.max, val)
+	if len(digest.buffer) >= 5*TDIGEST_COMPRESSION {
+		digest.compress()
+	}
+}
+
+// Add the numbers added to the other as well.
+func (digest *tDigest) merge(other *tDigest) {
+	digest.buffer = append(append(digest.buffer, other.centroids...), other.buffer...)
+	digest.total += other.total
+	digest.min = math.Min(digest.min, other.min)
+	digest.max = math.Max(digest.max, other.max)
+	digest.compress()
+}
+
+// Return the position of the quantile on the k-scale (k1 of the t-digest paper).
+func tDigestK(q float64) float64 {
+	return TDIGEST_COMPRESSION / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+// Return the quantile at the position of the k-scale, the inverse of tDigestK.
+func tDigestQ(k float64) float64 {
+	if k >= TDIGEST_COMPRESSION/4 {
+		return 1
+	}
+	return (math.Sin(k*2*math.Pi/TDIGEST_COMPRESSION) + 1) / 2
+}
+
+// Merge the buffered values into the centroids. A centroid grows until it spans a unit of the k-scale, so that
+// centroids are small near the extremes.
+func (digest *tDigest) compress() {
+	if len(digest.buffer) == 0 {
+		return
+	}
+	all := append(digest.centroids, digest.buffer...)
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].mean < all[j].mean
+	})
+	merged := []centroid{all[0]}
+	weightBefore := 0.0 // Weight of the centroids before the last merged one
+	weightLimit := digest.total * tDigestQ(tDigestK(0)+1)
+	for _, next := range all[1:] {
+		last := &merged[len(merged)-1]
+		if weightBefore+last.weight+next.weight <= weightLimit {
+			last.mean += (next.mean - last.mean) * next.weight / (last.weight + next.weight)
+			last.weight += next.weight
+			continue
+		}
+		weightBefore += last.weight
+		weightLimit = digest.total * tDigestQ(tDigestK(weightBefore/digest.total)+1)
+		merged = append(merged, next)
+	}
+	digest.centroids = merged
+	digest.buffer = nil
+}
+
+// Return the estimated quantile (0 - 1) of the numbers, which must not be empty.
+func (digest *tDigest) quantile(q float64) float64 {
+	digest.compress()
+	target := q * digest.total
+	// Values are interpolated between the centres of neighbouring centroids, and the extremes
+	prevCentre, prevMean := 0.0, digest.min
+	cumulative := 0.0
+	for _, c := range digest.centroids {
+		centre := cumulative + c.weight/2
+		if target < centre {
+			if centre == prevCentre {
+				return c.mean
+			}
+			return prevMean + (c.mean-prevMean)*(target-prevCentre)/(centre-prevCentre)
+		}
+		prevCentre, prevMean = centre, c.mean
+		cumulative += c.weight
+	}
+	if digest.total == prevCentre {
+		return digest.max
+	}
+	return prevMean + (digest.max-prevMean)*(target-prevCentre)/(digest.total-prevCentre)
+}
+
+// PathAnalysis summarises the values along a path.
+type PathAnalysis struct {
+	Path        []string           `json:"path"`
+	Values      int                `json:"values"`                // Number of values along the path
+	Distinct    int                `json:"distinct"`              // Approximate number of distinct values
+	Numbers     int                `json:"numbers"`               // Number of numeric values
+	Min         float64            `json:"min"`                   // Smallest numeric value, 0 without numeric values
+	Max         float64            `json:"max"`                   // Largest numeric value, 0 without numeric values
+	Percentiles map[string]float64 `json:"percentiles,omitempty"` // Approximate percentiles of the numeric values, keyed by "p" and the percentage, e.g. "p99.9"
+}
+
+// Analysis summarises the documents of a collection.
+type Analysis struct {
+	Docs  int            `json:"docs"` // Number of documents analysed
+	Paths []PathAnalysis `json:"paths"`
+}
+
+// Sketches of the values along a path.
+type pathSketch struct {
+	values, numbers int
+	distinct        *hyperLogLog
+	digest          *tDigest
+}
+
+// Analyse the values along the paths in all documents, estimating the percentiles (0 - 100) of the numeric values.
+func (col *Col) Analyze(paths [][]string, percentiles []float64) (Analysis, error) {
+	return col.analyze(paths, percentiles, nil)
+}
+
+// Analyse the documents for which the function (optional) returns true, see Analyze.
+func (col *Col) analyze(paths [][]string, percentiles []float64, match func(doc map[string]interface{}) bool) (result Analysis, err error) {
+	for _, percentile := range percentiles {
+		if !(percentile >= 0 && percentile <= 100) {
+			return result, dberr.New(dberr.ErrorInvalidParam, "percentile", percentile)
+		}
+	}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	// Each partition is scanned into sketches of its own
+	docs := make([]int, col.db.numParts)
+	sketches := make([][]*pathSketch, col.db.numParts)
+	var wg sync.WaitGroup
+	for partNum, part := range col.parts {
+		partSketches := make([]*pathSketch, len(paths))
+		for i := range paths {
+			partSketches[i] = &pathSketch{distinct: newHyperLogLog(), digest: newTDigest()}
+		}
+		sketches[partNum] = partSketches
+		wg.Add(1)
+		go func(partNum int, part *data.Partition) {
+			defer wg.Done()
+			part.DataLock.RLock()
+			defer part.DataLock.RUnlock()
+			part.ForEachDocView(0, 1, func(_ int, docB []byte) bool {
+				var doc map[string]interface{}
+				if json.Unmarshal(docB, &doc) != nil || match != nil && !match(doc) {
+					return true
+				}
+				docs[partNum]++
+				for i, path := range paths {
+					sketch := partSketches[i]
+					for _, val := range indexValues(doc, path) {
+						if val == nil {
+							continue
+						}
+						sketch.values++
+						sketch.distinct.add(fmt.Sprint(val))
+						if num, isNum := val.(float64); isNum {
+							sketch.numbers++
+							sketch.digest.add(num)
+						}
+					}
+				}
+				return true
+			})
+		}(partNum, part)
+	}
+	wg.Wait()
+	// Merge the sketches of the partitions
+	result.Paths = make([]PathAnalysis, len(paths))
+	for i, path := range paths {
+		merged := &pathSketch{distinct: newHyperLogLog(), digest: newTDigest()}
+		for partNum := range sketches {
+			sketch := sketches[partNum][i]
+			merged.values += sketch.values
+			merged.numbers += sketch.numbers
+			merged.distinct.merge(sketch.distinct)
+			merged.digest.merge(sketch.digest)
+		}
+		analysis := PathAnalysis{Path: path, Values: merged.values, Distinct: merged.distinct.count(), Numbers: merged.numbers}
+		if merged.numbers > 0 {
+			analysis.Min, analysis.Max = merged.digest.min, merged.digest.max
+			analysis.Percentiles = make(map[string]float64)
+			for _, percentile := range percentiles {
+				analysis.Percentiles["p"+strconv.FormatFloat(percentile, 'f', -1, 64)] = merged.digest.quantile(percentile / 100)
+			}
+		}
+		result.Paths[i] = analysis
+	}
+	for _, partDocs := range docs {
+		result.Docs += partDocs
+	}
+	return result, nil
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestSketches(t *testing.T) {
+	// Distinct counts are within a few percent, also of merged sketches
+	hll, other := newHyperLogLog(), newHyperLogLog()
+	for i := 0; i < 100000; i++ {
+		hll.add(string(rune(i)) + "x")
+		other.add(string(rune(i+50000)) + "x")
+	}
+	if count := hll.count(); math.Abs(float64(count)-100000) > 3000 {
+		t.Fatal(count)
+	}
+	hll.merge(other)
+	if count := hll.count(); math.Abs(float64(count)-150000) > 4500 {
+		t.Fatal(count)
+	} else if count = newHyperLogLog().count(); count != 0 {
+		t.Fatal(count)
+	}
+	small := newHyperLogLog()
+	for _, str := range []string{"a", "b", "c", "a"} {
+		small.add(str)
+	}
+	if count := small.count(); count != 3 {
+		t.Fatal(count)
+	}
+	// Percentiles of uniformly distributed numbers, merged from two digests
+	digest, otherDigest := newTDigest(), newTDigest()
+	for i := 0; i < 100000; i++ {
+		if i%2 == 0 {
+			digest.add(rand.Float64() * 1000)
+		} else {
+			otherDigest.add(rand.Float64() * 1000)
+		}
+	}
+	digest.merge(otherDigest)
+	for _, q := range []float64{0.01, 0.5, 0.9, 0.99, 0.999} {
+		if estimate := digest.quantile(q); math.Abs(estimate-q*1000) > 10 {
+			t.Fatal(q, estimate)
+		}
+	}
+	if len(digest.centroids) > 2*TDIGEST_COMPRESSION {
+		t.Fatal(len(digest.centroids))
+	} else if digest.quantile(0) != digest.min || digest.quantile(1) != digest.max {
+		t.Fatal(digest.min, digest.max)
+	}
+	single := newTDigest()
+	single.add(5)
+	if single.quantile(0.5) != 5 {
+		t.Fatal(single.quantile(0.5))
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	for i := 0; i < 1000; i++ {
+		doc := map[string]interface{}{"n": float64(i), "kind": []interface{}{"k" + string(rune('a'+i%5)), "K" + string(rune('A'+i%5))}}
+		if i%2 == 0 {
+			doc["owner"] = "ann"
+		}
+		if _, err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = col.Analyze([][]string{{"n"}}, []float64{101}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+	analysis, err := col.Analyze([][]string{{"n"}, {"@lower", "kind"}, {"missing"}}, []float64{0, 50, 99.9, 100})
+	if err != nil || analysis.Docs != 1000 || len(analysis.Paths) != 3 {
+		t.Fatal(analysis, err)
+	}
+	if n := analysis.Paths[0]; n.Values != 1000 || n.Numbers != 1000 || math.Abs(float64(n.Distinct)-1000) > 20 ||
+		n.Min != 0 || n.Max != 999 || n.Percentiles["p0"] != 0 || n.Percentiles["p100"] != 999 ||
+		math.Abs(n.Percentiles["p50"]-500) > 10 || math.Abs(n.Percentiles["p99.9"]-999) > 2 {
+		t.Fatal(n)
+	} else if kind := analysis.Paths[1]; kind.Values != 2000 || kind.Distinct != 5 || kind.Numbers != 0 || kind.Percentiles != nil {
+		t.Fatal(kind)
+	} else if missing := analysis.Paths[2]; missing.Values != 0 || missing.Distinct != 0 {
+		t.Fatal(missing)
+	}
+	// Documents inaccessible to the principal are left out
+	if err = col.SetConfig(ColConfig{ACLPath: []string{"owner"}}); err != nil {
+		t.Fatal(err)
+	} else if analysis, err = col.AnalyzeAs("ann", [][]string{{"n"}}, nil); err != nil || analysis.Docs != 500 || analysis.Paths[0].Numbers != 500 {
+		t.Fatal(analysis, err)
+	}
+}
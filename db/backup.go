@@ -0,0 +1,360 @@
+// Incremental backup.
+//
+// Every document mutation is assigned a sequence number from a counter of the database, and recorded along with the
+// collection name and document ID in the change log - file CHANGE_LOG_FILE in the database directory. Creating,
+// renaming or truncating a collection is recorded as a reset of the collection. BackupSince exports what changed after
+// a sequence number: the current content of the documents changed since, the documents deleted since, and the
+// entire content of the collections reset since. A backup since sequence number 0 exports the entire database.
+//
+// The change log grows with every mutation. Once a backup is taken, TruncateChanges discards the changes recorded up
+// to it; incremental backups since an earlier sequence number fail with ErrorChangesDiscarded afterwards.
+//
+// The backup stream is made of JSON lines. The first line tells the sequence numbers the backup covers and the
+// collections that exist - collections absent from it were dropped or renamed away:
+//
+//     {"since": 10, "seq": 42, "cols": ["Feeds", "Votes"]}
+//
+// The following lines tell a collection reset since, a document changed since, and a document deleted since:
+//
+//     {"col": "Feeds", "reset": true}
+//     {"col": "Feeds", "id": 123, "doc": {"title": "abc"}}
+//     {"col": "Votes", "id": 456, "deleted": true}
+
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+const (
+	CHANGE_LOG_FILE = "changes" // Change log file name in the database directory.
+)
+
+// A line of the change log. The first line carries only the sequence number up to which changes are discarded.
+type changeEntry struct {
+	Seq   int    `json:"seq,omitempty"`
+	Since int    `json:"since,omitempty"`
+	Col   string `json:"col,omitempty"`
+	ID    int    `json:"id,omitempty"`
+	Reset bool   `json:"reset,omitempty"`
+}
+
+// The header line of a backup stream.
+type backupHeader struct {
+	Since int      `json:"since"`
+	Seq   int      `json:"seq"`
+	Cols  []string `json:"cols"`
+}
+
+// A line of a backup stream following the header.
+type backupRecord struct {
+	Col     string          `json:"col"`
+	ID      int             `json:"id,omitempty"`
+	Reset   bool            `json:"reset,omitempty"`
+	Doc     json.RawMessage `json:"doc,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+}
+
+// Sequence numbers and the change log file of a database.
+type changeLog struct {
+	lock  *sync.Mutex
+	path  string
+	file  *os.File // Opened for appending
+	since int      // Changes up to this sequence number are discarded
+	seq   int      // Sequence number of the last change
+	err   error    // A change that could not be recorded, incremental backups fail until changes are truncated
+}
+
+// Open the change log of a database, creating the log if it does not yet exist.
+func openChangeLog(dbPath string) (changes *changeLog, err error) {
+	changes = &changeLog{lock: new(sync.Mutex), path: path.Join(dbPath, CHANGE_LOG_FILE)}
+	if _, statErr := os.Stat(changes.path); os.IsNotExist(statErr) {
+		if err = changes.rewrite(nil); err != nil {
+			return nil, err
+		}
+	}
+	lines := 0
+	err = changes.forEach(func(entry changeEntry) {
+		if lines++; lines == 1 {
+			changes.since, changes.seq = entry.Since, entry.Since
+		} else if entry.Seq > changes.seq {
+			changes.seq = entry.Seq
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if changes.file, err = os.OpenFile(changes.path, os.O_RDWR|os.O_APPEND, 0600); err != nil {
+		return nil, err
+	}
+	// A line cut short by a crash is ended, so that the following lines remain intact
+	if info, err := changes.file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err = changes.file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			_, err = changes.file.Write([]byte{'\n'})
+		}
+		if err != nil {
+			changes.file.Close()
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// Run the function on every line of the change log. A line that cannot be parsed is skipped, and incremental backups
+// fail until changes are truncated.
+func (changes *changeLog) forEach(fun func(entry changeEntry)) error {
+	file, err := os.Open(changes.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry changeEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			tdlog.CritNoRepeat("Change log %s has a malformed line: %v", changes.path, err)
+			changes.err = err
+			continue
+		}
+		fun(entry)
+	}
+	return scanner.Err()
+}
+
+// Replace the change log by one that holds the entries, discarding the changes up to changes.since.
+func (changes *changeLog) rewrite(entries []changeEntry) error {
+	tmpPath := changes.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	if err = encoder.Encode(changeEntry{Since: changes.since}); err == nil {
+		for _, entry := range entries {
+			if err = encoder.Encode(entry); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, changes.path)
+}
+
+// Record a change and assign it the next sequence number.
+func (changes *changeLog) record(entry changeEntry) {
+	changes.lock.Lock()
+	defer changes.lock.Unlock()
+	changes.seq++
+	entry.Seq = changes.seq
+	line, _ := json.Marshal(entry)
+	if _, err := changes.file.Write(append(line, '\n')); err != nil && changes.err == nil {
+		tdlog.CritNoRepeat("Failed to record change in %s: %v", changes.path, err)
+		changes.err = err
+	}
+}
+
+// Return the documents changed and the collections reset after the sequence number, along with the sequence number
+// of the last change.
+func (changes *changeLog) after(since int) (changed map[string]map[int]struct{}, reset map[string]bool, seq int, err error) {
+	changes.lock.Lock()
+	defer changes.lock.Unlock()
+	if since < 0 || since > changes.seq {
+		return nil, nil, 0, dberr.New(dberr.ErrorInvalidParam, "since", since)
+	} else if since < changes.since || changes.err != nil {
+		return nil, nil, 0, dberr.New(dberr.ErrorChangesDiscarded, since)
+	}
+	changed, reset = make(map[string]map[int]struct{}), make(map[string]bool)
+	err = changes.forEach(func(entry changeEntry) {
+		if entry.Seq <= since || entry.Col == "" {
+			return
+		} else if entry.Reset {
+			reset[entry.Col] = true
+			delete(changed, entry.Col)
+		} else if !reset[entry.Col] {
+			if changed[entry.Col] == nil {
+				changed[entry.Col] = make(map[int]struct{})
+			}
+			changed[entry.Col][entry.ID] = struct{}{}
+		}
+	})
+	if err == nil && changes.err != nil {
+		err = dberr.New(dberr.ErrorChangesDiscarded, since)
+	}
+	return changed, reset, changes.seq, err
+}
+
+// Discard the changes up to the sequence number.
+func (changes *changeLog) truncate(seq int) error {
+	changes.lock.Lock()
+	defer changes.lock.Unlock()
+	if seq < changes.since || seq > changes.seq {
+		return dberr.New(dberr.ErrorInvalidParam, "seq", seq)
+	}
+	// If some change was not recorded, the log is incomplete and all changes are discarded
+	kept := make([]changeEntry, 0)
+	if changes.err != nil {
+		tdlog.Noticef("Discarding all changes recorded in %s, as the log is incomplete", changes.path)
+		seq = changes.seq
+	} else if err := changes.forEach(func(entry changeEntry) {
+		if entry.Seq > seq {
+			kept = append(kept, entry)
+		}
+	}); err != nil {
+		return err
+	} else if changes.err != nil {
+		tdlog.Noticef("Discarding all changes recorded in %s, as the log is incomplete", changes.path)
+		kept, seq = kept[:0], changes.seq
+	}
+	since := changes.since
+	changes.since = seq
+	if err := changes.file.Close(); err != nil {
+		tdlog.Noticef("Failed to close %s: %v", changes.path, err)
+	}
+	err := changes.rewrite(kept)
+	if err != nil {
+		changes.since = since
+	} else {
+		changes.err = nil
+	}
+	var openErr error
+	if changes.file, openErr = os.OpenFile(changes.path, os.O_RDWR|os.O_APPEND, 0600); openErr != nil {
+		tdlog.CritNoRepeat("Failed to reopen %s: %v", changes.path, openErr)
+		changes.err = openErr
+		if err == nil {
+			err = openErr
+		}
+	}
+	return err
+}
+
+// Close the change log file, unless it is already closed.
+func (changes *changeLog) close() error {
+	changes.lock.Lock()
+	defer changes.lock.Unlock()
+	if changes.file == nil {
+		return nil
+	}
+	err := changes.file.Close()
+	changes.file = nil
+	return err
+}
+
+// Record a document change of the collection.
+func (col *Col) logChange(id int) {
+	col.db.changes.record(changeEntry{Col: col.name, ID: id})
+}
+
+// Record that the collection was created, renamed into or truncated. Does not place schema lock.
+func (db *DB) logReset(name string) {
+	db.changes.record(changeEntry{Col: name, Reset: true})
+}
+
+// Return the sequence number of the last change made to the database.
+func (db *DB) ChangeSeq() int {
+	db.changes.lock.Lock()
+	defer db.changes.lock.Unlock()
+	return db.changes.seq
+}
+
+// Export the changes made after the sequence number to the writer, and return the sequence number up to which the
+// backup covers the changes, which is to be given to the next incremental backup. Since sequence number 0 the entire
+// database is exported. Changes made while the backup is taken may or may not be included in it.
+func (db *DB) BackupSince(since int, w io.Writer) (seq int, err error) {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	var changed map[string]map[int]struct{}
+	reset := make(map[string]bool)
+	if since == 0 {
+		seq = db.ChangeSeq()
+		for name := range db.cols {
+			reset[name] = true
+		}
+	} else if changed, reset, seq, err = db.changes.after(since); err != nil {
+		return 0, err
+	}
+	header := backupHeader{Since: since, Seq: seq, Cols: make([]string, 0, len(db.cols))}
+	for name := range db.cols {
+		header.Cols = append(header.Cols, name)
+	}
+	sort.Strings(header.Cols)
+	out := bufio.NewWriter(w)
+	encoder := json.NewEncoder(out)
+	if err = encoder.Encode(header); err != nil {
+		return 0, err
+	}
+	for _, name := range header.Cols {
+		col := db.cols[name]
+		if reset[name] {
+			if err = encoder.Encode(backupRecord{Col: name, Reset: true}); err != nil {
+				return 0, err
+			}
+			col.forEachDocSnapshot(func(id int, doc []byte) bool {
+				if !json.Valid(doc) {
+					tdlog.Noticef("Backup: skipped corrupted document %d of %s", id, name)
+					return true
+				}
+				err = encoder.Encode(backupRecord{Col: name, ID: id, Doc: doc})
+				return err == nil
+			}, false)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		ids := make([]int, 0, len(changed[name]))
+		for id := range changed[name] {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for start := 0; start < len(ids); start += SNAPSHOT_READ_BATCH {
+			end := start + SNAPSHOT_READ_BATCH
+			if end > len(ids) {
+				end = len(ids)
+			}
+			docs := col.readBatch(ids[start:end])
+			for _, id := range ids[start:end] {
+				record := backupRecord{Col: name, ID: id, Deleted: true}
+				if doc, exists := docs[id]; !exists {
+				} else if !json.Valid(doc) {
+					tdlog.Noticef("Backup: skipped corrupted document %d of %s", id, name)
+					continue
+				} else {
+					record.Doc, record.Deleted = doc, false
+				}
+				if err = encoder.Encode(record); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	return seq, out.Flush()
+}
+
+// Discard the changes recorded up to the sequence number, typically the one returned by a backup. Incremental backups
+// since an earlier sequence number are no longer possible.
+func (db *DB) TruncateChanges(seq int) error {
+	return db.changes.truncate(seq)
+}
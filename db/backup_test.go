@@ -0,0 +1,154 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Take a backup and return its header and records.
+func backupSince(t *testing.T, db *DB, since int) (header backupHeader, records []backupRecord) {
+	var out bytes.Buffer
+	seq, err := db.BackupSince(since, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := json.NewDecoder(&out)
+	if err = decoder.Decode(&header); err != nil {
+		t.Fatal(err)
+	} else if header.Seq != seq || header.Since != since {
+		t.Fatal(header, seq)
+	}
+	for decoder.More() {
+		var record backupRecord
+		if err = decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return
+}
+
+func TestBackupSince(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+	}()
+	for _, name := range []string{"a", "b"} {
+		if err = db.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := db.Use("a"), db.Use("b")
+	ids := make([]int, 3)
+	for i := range ids {
+		if ids[i], err = a.Insert(map[string]interface{}{"i": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bID, err := b.Insert(map[string]interface{}{"b": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Full backup
+	header, records := backupSince(t, db, 0)
+	if !reflect.DeepEqual(header.Cols, []string{"a", "b"}) || header.Seq != db.ChangeSeq() {
+		t.Fatal(header)
+	} else if len(records) != 6 || !records[0].Reset || records[0].Col != "a" || !records[4].Reset || records[4].Col != "b" {
+		t.Fatal(records)
+	}
+	full := header.Seq
+	// Incremental backup holds the documents changed since, and the deleted ones
+	if err = a.Update(ids[0], map[string]interface{}{"i": "updated"}); err != nil {
+		t.Fatal(err)
+	} else if err = a.Update(ids[0], map[string]interface{}{"i": "updated again"}); err != nil {
+		t.Fatal(err)
+	} else if err = a.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	header, records = backupSince(t, db, full)
+	if header.Seq != full+3 || len(records) != 2 {
+		t.Fatal(header, records)
+	}
+	for _, record := range records {
+		var doc map[string]interface{}
+		if record.Col != "a" {
+			t.Fatal(record)
+		} else if record.ID == ids[1] && !record.Deleted {
+			t.Fatal(record)
+		} else if record.ID == ids[0] && (json.Unmarshal(record.Doc, &doc) != nil || doc["i"] != "updated again") {
+			t.Fatal(record)
+		}
+	}
+	// Collections created, renamed into and truncated since are exported in full, dropped ones are absent
+	incremental := header.Seq
+	if err = db.Truncate("b"); err != nil {
+		t.Fatal(err)
+	} else if _, err = b.Insert(map[string]interface{}{"b": 2}); err != nil {
+		t.Fatal(err)
+	} else if err = db.Rename("a", "c"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("d"); err != nil {
+		t.Fatal(err)
+	}
+	header, records = backupSince(t, db, incremental)
+	if !reflect.DeepEqual(header.Cols, []string{"b", "c", "d"}) || len(records) != 6 {
+		t.Fatal(header, records)
+	}
+	for _, record := range records {
+		if record.ID == bID || record.Deleted || record.Col == "c" && !record.Reset && record.Doc == nil {
+			t.Fatal(record)
+		}
+	}
+	// Sequence numbers continue after reopening
+	seq := db.ChangeSeq()
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	} else if db.ChangeSeq() != seq {
+		t.Fatal(db.ChangeSeq(), seq)
+	}
+	if _, err = db.Use("d").Insert(map[string]interface{}{"d": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if header, records = backupSince(t, db, seq); header.Seq != seq+1 || len(records) != 1 || records[0].Col != "d" {
+		t.Fatal(header, records)
+	}
+	// Discarded changes are no longer available to incremental backups
+	if err = db.TruncateChanges(seq); err != nil {
+		t.Fatal(err)
+	} else if _, err = db.BackupSince(incremental, ioutil.Discard); dberr.Type(err) != dberr.ErrorChangesDiscarded {
+		t.Fatal(err)
+	} else if _, err = db.BackupSince(seq+2, ioutil.Discard); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if err = db.TruncateChanges(seq - 1); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+	if header, records = backupSince(t, db, seq); len(records) != 1 || records[0].Col != "d" {
+		t.Fatal(header, records)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	} else if _, err = db.BackupSince(incremental, ioutil.Discard); dberr.Type(err) != dberr.ErrorChangesDiscarded {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,24 @@
+// Binary values.
+//
+// A document attribute may hold a byte string ([]byte), such as a hash, a key or a small image, which is serialised
+// as its standard base64 encoding like encoding/json does; unlike a Go string holding the same bytes, it is not mangled
+// when the bytes are not valid UTF-8. Indexes and queries compare a byte string by that encoding, so that it is found
+// by a lookup of the same bytes, or of their base64 encoding given as a string - as the HTTP API does - and by no other
+// bytes. The attribute reads back as the base64 string, which BinaryValue decodes.
+
+package db
+
+import "encoding/base64"
+
+// Return the bytes of a byte string attribute, given as []byte or as read back - its standard base64 encoding. Return
+// false if the value is neither.
+func BinaryValue(val interface{}) (bytes []byte, ok bool) {
+	switch val := val.(type) {
+	case []byte:
+		return val, true
+	case string:
+		bytes, err := base64.StdEncoding.DecodeString(val)
+		return bytes, err == nil
+	}
+	return nil, false
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"testing"
+)
+
+func TestBinaryValues(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"key"}); err != nil {
+		t.Fatal(err)
+	}
+	// Bytes that are not valid UTF-8 tell apart as strings they would not
+	key, other := []byte{0xff, 0x00, 0xfe}, []byte{0xfd, 0x00, 0xfe}
+	id, err := col.Insert(map[string]interface{}{"key": key})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = col.Insert(map[string]interface{}{"key": other}); err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(value interface{}) map[int]struct{} {
+		result, err := col.Query(map[string]interface{}{"eq": value, "in": []interface{}{"key"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	if result := lookup(key); len(result) != 1 {
+		t.Fatal(result)
+	} else if _, found := lookup(base64.StdEncoding.EncodeToString(key))[id]; !found {
+		t.Fatal("Lookup by base64 encoding")
+	} else if doc, err := col.Read(id); err != nil {
+		t.Fatal(err)
+	} else if value, ok := BinaryValue(doc["key"]); !ok || !bytes.Equal(value, key) {
+		t.Fatal(doc)
+	} else if _, ok = BinaryValue(1); ok {
+		t.Fatal("Number is no byte string")
+	}
+	// Indexed bytes are unindexed by update
+	if err = col.Update(id, map[string]interface{}{"key": []byte{1}}); err != nil {
+		t.Fatal(err)
+	} else if result := lookup(key); len(result) != 0 {
+		t.Fatal(result)
+	} else if _, found := lookup([]byte{1})[id]; !found {
+		t.Fatal("Lookup of updated bytes")
+	}
+}
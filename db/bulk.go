@@ -0,0 +1,250 @@
+// Bulk writes.
+//
+// A bulk write applies a list of inserts, updates and deletes of documents in any collections, each write on its own:
+// unlike in a transaction, a failed write neither stops nor undoes the others, and the outcome of every write is
+// returned. The writes are grouped by collection and partition, and the writes of a group are applied in a batch under
+// a single lock of the partition, in the order they were given. A batch counts as one write towards the collection's
+// write limits. Writes of the same document fall into the same batch and so take effect in order.
+//
+// A string ID given to an inserted or updated document is checked before its batch is applied, against the documents
+// as they were then and the string IDs given earlier in the batch; a string ID freed by a delete of the same batch is
+// still taken for the remainder of the batch.
+
+package db
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+// Apply the writes (see TxWrite) each on its own. Return the ID of every written document and the error of every write
+// (nil if the write is done), in the order of writes.
+func (db *DB) Bulk(writes []TxWrite) (ids []int, errs []error) {
+	ids, errs = make([]int, len(writes)), make([]error, len(writes))
+	if err := db.checkWritable(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return
+	}
+	type batchKey struct {
+		col  *Col
+		part int
+	}
+	var keys []batchKey
+	batches := make(map[batchKey][]int) // Positions of the writes of each batch
+	for i, write := range writes {
+		col := db.Use(write.Col)
+		switch {
+		case col == nil || write.Col == TX_COL:
+			errs[i] = dberr.New(dberr.ErrorNoCol, write.Col)
+		case write.Op != TX_INSERT && write.Op != TX_UPDATE && write.Op != TX_DELETE:
+			errs[i] = dberr.New(dberr.ErrorInvalidParam, "write", write.Op)
+		case write.Op != TX_DELETE && write.Doc == nil:
+			errs[i] = dberr.New(dberr.ErrorMissing, "document")
+		case write.Op != TX_INSERT && write.ID < 0:
+			errs[i] = dberr.New(dberr.ErrorNoDoc, write.ID)
+		}
+		if errs[i] != nil {
+			continue
+		}
+		if ids[i] = write.ID; write.Op == TX_INSERT {
+			ids[i] = rand.Int()
+		}
+		key := batchKey{col: col, part: ids[i] % db.numParts}
+		if _, exists := batches[key]; !exists {
+			keys = append(keys, key)
+		}
+		batches[key] = append(batches[key], i)
+	}
+	for _, key := range keys {
+		positions := batches[key]
+		batch := make([]TxWrite, len(positions))
+		for j, i := range positions {
+			batch[j] = writes[i]
+			batch[j].ID = ids[i]
+		}
+		for j, err := range key.col.writeBatch(context.Background(), batch) {
+			errs[positions[j]] = err
+		}
+	}
+	for i := range ids {
+		if errs[i] != nil {
+			ids[i] = 0
+		}
+	}
+	return
+}
+
+// Apply the writes of a partition in order, the partition is locked once for the entire batch. The IDs of inserted
+// documents are chosen by the caller. Referring documents are found before locking the partition, and deleted along
+// (cascade) after the batch is done.
+func (col *Col) writeBatch(ctx context.Context, writes []TxWrite) (errs []error) {
+	errs = make([]error, len(writes))
+	// The string IDs given to documents are locked first, each lock once and in order so that batches do not deadlock
+	var strIDLocks []int
+	for _, write := range writes {
+		if strID, hasStrID := write.Doc[STR_ID_ATTR].(string); hasStrID {
+			strIDLocks = append(strIDLocks, StrHash(strID)%col.db.numParts)
+		}
+	}
+	sort.Ints(strIDLocks)
+	var locked []int
+	for _, lock := range strIDLocks {
+		if len(locked) == 0 || locked[len(locked)-1] != lock {
+			col.strIDLocks[lock].Lock()
+			locked = append(locked, lock)
+		}
+	}
+	unlockStrIDs := func() {
+		for _, lock := range locked {
+			col.strIDLocks[lock].Unlock()
+		}
+		locked = nil
+	}
+	defer unlockStrIDs()
+	release, err := col.throttleWriteCtx(ctx)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return
+	}
+	defer release()
+	col.db.schemaLock.RLock()
+	docs := make([]map[string]interface{}, len(writes))
+	originals := make([]map[string]interface{}, len(writes))
+	sizes := make([]int, len(writes))
+	cascades := make([]map[*Col][]int, len(writes))
+	strIDs := make(map[string]int) // String IDs given earlier in the batch
+	for i, write := range writes {
+		if write.Op == TX_DELETE {
+			cascades[i], errs[i] = col.checkReferrers(write.ID)
+			continue
+		}
+		if strID, hasStrID := write.Doc[STR_ID_ATTR].(string); hasStrID {
+			other, found := strIDs[strID]
+			if !found {
+				other, found = col.strIDLookup(strID)
+			}
+			if strID == "" {
+				errs[i] = dberr.New(dberr.ErrorMissing, STR_ID_ATTR)
+			} else if found && (other != write.ID || write.Op == TX_INSERT) {
+				errs[i] = dberr.New(dberr.ErrorDupStrID, strID)
+			} else {
+				strIDs[strID] = write.ID
+			}
+		}
+		if errs[i] == nil {
+			errs[i] = col.checkRefs(write.Doc)
+		}
+		if docs[i] = write.Doc; write.Op == TX_INSERT {
+			docs[i] = col.stampInsert(write.Doc)
+		}
+	}
+	part := col.parts[writes[0].ID%col.db.numParts]
+	buf := getDocBuf()
+	defer buf.free()
+
+	// Place lock, read back original documents and write
+	if !part.LockData(ctx.Done()) {
+		col.db.schemaLock.RUnlock()
+		for i, write := range writes {
+			errs[i] = col.lockGivenUp(ctx, write.ID)
+		}
+		return
+	}
+	for i, write := range writes {
+		if errs[i] != nil {
+			continue
+		}
+		var originalB []byte
+		if write.Op != TX_INSERT {
+			if originalB, errs[i] = part.Read(write.ID); errs[i] != nil {
+				continue
+			}
+			col.unmarshalDoc(originalB, &originals[i])
+		}
+		switch write.Op {
+		case TX_INSERT, TX_UPDATE:
+			if write.Op == TX_UPDATE {
+				docs[i] = col.stampUpdate(docs[i], originals[i])
+			}
+			docJS, err := buf.marshal(docs[i])
+			if err == nil {
+				err = col.db.checkDocLimits(docJS)
+			}
+			if err == nil && write.Op == TX_INSERT {
+				_, err = part.Insert(write.ID, docJS)
+			} else if err == nil {
+				err = part.Update(write.ID, docJS)
+				col.cache.invalidate(write.ID)
+				col.ext.update(write.ID, docJS, err)
+			}
+			errs[i], sizes[i] = err, len(docJS)
+		case TX_DELETE:
+			errs[i] = part.Delete(write.ID)
+			col.cache.invalidate(write.ID)
+			col.ext.update(write.ID, nil, errs[i])
+		}
+	}
+	part.DataLock.Unlock()
+
+	// Done with the collection data, next is to maintain indexed values
+	inserted := false
+	for i, write := range writes {
+		if errs[i] != nil {
+			continue
+		}
+		switch write.Op {
+		case TX_INSERT:
+			inserted = true
+			col.cappedPut(write.ID, sizes[i])
+			col.putStrID(write.ID, docs[i])
+		case TX_UPDATE:
+			col.cappedPut(write.ID, sizes[i])
+			col.moveStrID(write.ID, originals[i], docs[i])
+		case TX_DELETE:
+			col.cappedRemove(write.ID)
+			if originals[i] != nil {
+				col.removeStrID(write.ID, originals[i])
+			}
+		}
+		part.LockUpdate(write.ID)
+		if originals[i] != nil {
+			col.unindexDoc(write.ID, originals[i])
+		} else if write.Op != TX_INSERT {
+			tdlog.Noticef("Will not attempt to unindex document %d during bulk %s", write.ID, write.Op)
+		}
+		if docs[i] != nil {
+			col.indexDoc(write.ID, docs[i])
+		}
+		part.UnlockUpdate(write.ID)
+	}
+	col.db.schemaLock.RUnlock()
+	release()
+	unlockStrIDs()
+	for i, write := range writes {
+		if errs[i] != nil {
+			continue
+		}
+		switch write.Op {
+		case TX_INSERT:
+			col.fireHooks(hookInsert, write.ID, docs[i], nil)
+		case TX_UPDATE:
+			col.fireHooks(hookUpdate, write.ID, docs[i], originals[i])
+		case TX_DELETE:
+			col.fireHooks(hookDelete, write.ID, nil, originals[i])
+			errs[i] = cascadeDelete(cascades[i])
+		}
+	}
+	if inserted {
+		col.evictCapped()
+	}
+	col.db.commitBatchWrite(errs)
+	return
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestBulk(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	apple, err := col.Insert(map[string]interface{}{"_id": "apple", "n": 1.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone, err := col.Insert(map[string]interface{}{"n": 2.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := []TxWrite{
+		{Op: TX_UPDATE, Col: "col", ID: apple, Doc: map[string]interface{}{"_id": "apple", "n": 3.0}},
+		{Op: TX_DELETE, Col: "col", ID: gone},
+		{Op: TX_INSERT, Col: "col", Doc: map[string]interface{}{"_id": "pear", "n": 4.0}},
+		{Op: TX_INSERT, Col: "col", Doc: map[string]interface{}{"_id": "pear"}},
+		{Op: TX_INSERT, Col: "col", Doc: map[string]interface{}{"_id": "apple"}},
+		{Op: TX_DELETE, Col: "col", ID: gone},
+		{Op: TX_INSERT, Col: "nope", Doc: map[string]interface{}{}},
+		{Op: "upsert", Col: "col", ID: apple},
+		{Op: TX_UPDATE, Col: "col", ID: apple},
+	}
+	for i := 0; i < 100; i++ {
+		writes = append(writes, TxWrite{Op: TX_INSERT, Col: "col", Doc: map[string]interface{}{"n": 5.0}})
+	}
+	ids, errs := db.Bulk(writes)
+	if len(ids) != len(writes) || len(errs) != len(writes) {
+		t.Fatal(ids, errs)
+	}
+	for i, expected := range []string{"", "", "", "dup_id", "dup_id", "no_doc", "no_col", "invalid_param", "missing"} {
+		if dberr.Code(errs[i]) != expected {
+			t.Fatal(i, errs[i])
+		} else if (errs[i] == nil) != (ids[i] != 0) {
+			t.Fatal(i, ids[i])
+		}
+	}
+	for i := 9; i < len(writes); i++ {
+		if errs[i] != nil {
+			t.Fatal(i, errs[i])
+		}
+	}
+	// The documents, string IDs and indexes reflect the writes
+	if doc, err := col.ReadStrID("apple"); err != nil || doc["n"] != 3.0 {
+		t.Fatal(doc, err)
+	} else if doc, err := col.ReadStrID("pear"); err != nil || doc["n"] != 4.0 {
+		t.Fatal(doc, err)
+	} else if _, err = col.Read(gone); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if count := col.Count(); count != 102 {
+		t.Fatal(count)
+	}
+	for n, expected := range map[float64]int{1: 0, 2: 0, 3: 1, 4: 1, 5: 100} {
+		result := make(map[int]struct{})
+		if err = EvalQuery(map[string]interface{}{"eq": n, "in": []interface{}{"n"}}, col, &result); err != nil || len(result) != expected {
+			t.Fatal(n, result, err)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// Delete and update documents by query.
+//
+// The query is evaluated once, then the matching documents are deleted or patched in batches - one batch for each
+// partition, applied under a single lock of the partition. A batch counts as one write towards the collection's write
+// limits. Progress is reported after each batch. Documents inserted or changed by others during the operation are
+// not re-evaluated against the query, and matching documents deleted in the meantime are skipped. An operation made with
+// a context stops before the next batch once the context is done; the batches done by then remain done.
+
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+// Progress of an operation made on the documents matching a query.
+type QueryOpProgress struct {
+	Matched     int    `json:"matched"`               // Number of documents matching the query
+	Done        int    `json:"done"`                  // Number of documents deleted/updated so far
+	Skipped     int    `json:"skipped"`               // Number of matching documents that no longer exist
+	Failed      int    `json:"failed"`                // Number of documents that could not be deleted/updated
+	FirstErr    string `json:"first_error,omitempty"` // Error of the first failed document
+	Batches     int    `json:"batches"`               // Total number of batches
+	BatchesDone int    `json:"batches_done"`          // Number of batches done so far
+	Finished    bool   `json:"finished"`              // True once all batches are done
+}
+
+// Delete all documents matching the query. The progress function (optional) is called after each batch.
+func (col *Col) DeleteByQuery(q interface{}, progress func(QueryOpProgress)) (QueryOpProgress, error) {
+	return col.byQuery(context.Background(), q, func(ids []int) []error {
+		return col.deleteBatch(context.Background(), ids, nil)
+	}, progress)
+}
+
+// Patch all documents matching the query. The patch is merged into each document: attributes of the patch replace
+// attributes of the document, nested objects are merged likewise, and null removes the attribute. The string ID
+// attribute may not be patched. The progress function (optional) is called after each batch.
+func (col *Col) UpdateByQuery(q interface{}, patch map[string]interface{}, progress func(QueryOpProgress)) (QueryOpProgress, error) {
+	if err := checkPatch(patch); err != nil {
+		return QueryOpProgress{}, err
+	}
+	return col.byQuery(context.Background(), q, func(ids []int) []error {
+		return col.patchBatch(context.Background(), ids, patch, nil)
+	}, progress)
+}
+
+// Return an error if the patch may not be applied by query.
+func checkPatch(patch map[string]interface{}) error {
+	if _, patchesStrID := patch[STR_ID_ATTR]; patchesStrID {
+		return fmt.Errorf("Patch may not change string ID attribute %s", STR_ID_ATTR)
+	}
+	return nil
+}
+
+// A batch guard returns an error if the document may not be written, given its original and the updated document (nil
+// if the document is deleted). The document is then left alone.
+type batchGuard func(id int, original, doc map[string]interface{}) error
+
+// Evaluate the query and run the batch function on the matching documents of each partition. The batch function
+// returns the error of each document, nil if the document is done. Once the context is done, the remaining batches are
+// left alone and the error is the context's error.
+func (col *Col) byQuery(ctx context.Context, q interface{}, batch func(ids []int) []error, progress func(QueryOpProgress)) (prog QueryOpProgress, err error) {
+	result := make(map[int]struct{})
+	if err = evalQuery(ctx, q, col, &result, true); err != nil {
+		return
+	}
+	partIDs := make([][]int, col.db.numParts)
+	for id := range result {
+		if id >= 0 {
+			partIDs[id%col.db.numParts] = append(partIDs[id%col.db.numParts], id)
+		}
+	}
+	prog.Matched = len(result)
+	for _, ids := range partIDs {
+		if len(ids) > 0 {
+			prog.Batches++
+		}
+	}
+	for _, ids := range partIDs {
+		if len(ids) == 0 {
+			continue
+		} else if err = ctx.Err(); err != nil {
+			return
+		}
+		for _, err := range batch(ids) {
+			switch {
+			case err == nil:
+				prog.Done++
+			case dberr.Type(err) == dberr.ErrorNoDoc:
+				prog.Skipped++
+			default:
+				if prog.Failed == 0 {
+					prog.FirstErr = err.Error()
+				}
+				prog.Failed++
+			}
+		}
+		prog.BatchesDone++
+		prog.Finished = prog.BatchesDone == prog.Batches
+		if progress != nil {
+			progress(prog)
+		}
+	}
+	prog.Finished = true
+	return
+}
+
+// Return the same error for each document of a batch.
+func batchErrors(ids []int, err error) []error {
+	errs := make([]error, len(ids))
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Delete the documents of a partition, the partition is locked once for the entire batch. Referring documents are
+// found before locking the partition, and deleted along (cascade) after the batch is done. The guard is optional.
+func (col *Col) deleteBatch(ctx context.Context, ids []int, guard batchGuard) (errs []error) {
+	release, err := col.throttleWriteCtx(ctx)
+	if err != nil {
+		return batchErrors(ids, err)
+	}
+	defer release()
+	errs = make([]error, len(ids))
+	cascades := make([]map[*Col][]int, len(ids))
+	originals := make([]map[string]interface{}, len(ids))
+	col.db.schemaLock.RLock()
+	for i, id := range ids {
+		cascades[i], errs[i] = col.checkReferrers(id)
+	}
+	part := col.parts[ids[0]%col.db.numParts]
+
+	// Place lock, read back original documents and delete documents
+	if !part.LockData(ctx.Done()) {
+		col.db.schemaLock.RUnlock()
+		for i, id := range ids {
+			errs[i] = col.lockGivenUp(ctx, id)
+		}
+		return
+	}
+	for i, id := range ids {
+		if errs[i] != nil {
+			continue
+		}
+		originalB, err := part.Read(id)
+		if err == nil && guard != nil {
+			var original map[string]interface{}
+			if err = col.unmarshalDoc(originalB, &original); err == nil {
+				err = guard(id, original, nil)
+			}
+		}
+		if err == nil {
+			err = part.Delete(id)
+			col.cache.invalidate(id)
+			col.ext.update(id, nil, err)
+		}
+		if errs[i] = err; err == nil {
+			var original map[string]interface{}
+			if col.unmarshalDoc(originalB, &original) == nil {
+				originals[i] = original
+			}
+		}
+	}
+	part.DataLock.Unlock()
+
+	// Done with the collection data, next is to remove indexed values
+	for i, id := range ids {
+		if errs[i] != nil {
+			continue
+		}
+		col.cappedRemove(id)
+		if original := originals[i]; original != nil {
+			col.removeStrID(id, original)
+			part.LockUpdate(id)
+			col.unindexDoc(id, original)
+			part.UnlockUpdate(id)
+		} else {
+			tdlog.Noticef("Will not attempt to unindex document %d during delete", id)
+		}
+	}
+	col.db.schemaLock.RUnlock()
+	release()
+	for i, id := range ids {
+		if errs[i] == nil {
+			col.fireHooks(hookDelete, id, nil, originals[i])
+			errs[i] = cascadeDelete(cascades[i])
+		}
+	}
+	col.db.commitBatchWrite(errs)
+	return
+}
+
+// Merge the patch into the documents of a partition, the partition is locked once for the entire batch. The guard is
+// optional.
+func (col *Col) patchBatch(ctx context.Context, ids []int, patch map[string]interface{}, guard batchGuard) (errs []error) {
+	release, err := col.throttleWriteCtx(ctx)
+	if err != nil {
+		return batchErrors(ids, err)
+	}
+	defer release()
+	col.db.schemaLock.RLock()
+	// The patched documents refer to what the patch and their originals refer to, the originals' references were
+	// verified when they were written. The patch is verified before locking the partition, which it may refer to.
+	if err = col.checkRefs(patch); err != nil {
+		col.db.schemaLock.RUnlock()
+		return batchErrors(ids, err)
+	}
+	errs = make([]error, len(ids))
+	docs := make([]map[string]interface{}, len(ids))
+	originals := make([]map[string]interface{}, len(ids))
+	sizes := make([]int, len(ids))
+	part := col.parts[ids[0]%col.db.numParts]
+	buf := getDocBuf()
+	defer buf.free()
+
+	// Place lock, read back original documents and update
+	if !part.LockData(ctx.Done()) {
+		col.db.schemaLock.RUnlock()
+		for i, id := range ids {
+			errs[i] = col.lockGivenUp(ctx, id)
+		}
+		return
+	}
+	for i, id := range ids {
+		originalB, err := part.Read(id)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		var original map[string]interface{}
+		if errs[i] = col.unmarshalDoc(originalB, &original); errs[i] != nil {
+			continue
+		}
+		doc := col.stampUpdate(mergePatch(original, patch), original)
+		if guard != nil {
+			if errs[i] = guard(id, original, doc); errs[i] != nil {
+				continue
+			}
+		}
+		docJS, err := buf.marshal(doc)
+		if err == nil {
+			err = col.db.checkDocLimits(docJS)
+		}
+		if err == nil {
+			err = part.Update(id, docJS)
+			col.cache.invalidate(id)
+			col.ext.update(id, docJS, err)
+		}
+		if errs[i] = err; err == nil {
+			docs[i], originals[i], sizes[i] = doc, original, len(docJS)
+		}
+	}
+	part.DataLock.Unlock()
+
+	// Done with the collection data, next is to maintain indexed values. The patch does not change string IDs.
+	for i, id := range ids {
+		if errs[i] != nil {
+			continue
+		}
+		col.cappedPut(id, sizes[i])
+		part.LockUpdate(id)
+		col.unindexDoc(id, originals[i])
+		col.indexDoc(id, docs[i])
+		part.UnlockUpdate(id)
+	}
+	col.db.schemaLock.RUnlock()
+	release()
+	for i, id := range ids {
+		if errs[i] == nil {
+			col.fireHooks(hookUpdate, id, docs[i], originals[i])
+		}
+	}
+	col.db.commitBatchWrite(errs)
+	return
+}
+
+// Return a copy of the document with the patch merged into it. Nested objects are merged recursively, null removes
+// the attribute.
+func mergePatch(doc, patch map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(doc)+len(patch))
+	for key, val := range doc {
+		merged[key] = val
+	}
+	for key, patchVal := range patch {
+		if patchVal == nil {
+			delete(merged, key)
+		} else if patchObj, isObj := patchVal.(map[string]interface{}); isObj {
+			docObj, _ := merged[key].(map[string]interface{})
+			merged[key] = mergePatch(docObj, patchObj)
+		} else {
+			merged[key] = patchVal
+		}
+	}
+	return merged
+}
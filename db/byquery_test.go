@@ -0,0 +1,133 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	doc := map[string]interface{}{"a": 1, "b": map[string]interface{}{"c": 2, "d": 3}, "e": 4}
+	patch := map[string]interface{}{"a": 5, "b": map[string]interface{}{"c": nil, "f": 6}, "e": nil, "g": map[string]interface{}{"h": 7}}
+	merged := mergePatch(doc, patch)
+	expected := map[string]interface{}{"a": 5, "b": map[string]interface{}{"d": 3, "f": 6}, "g": map[string]interface{}{"h": 7}}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Fatal(merged)
+	}
+	// The original document is not modified
+	if !reflect.DeepEqual(doc, map[string]interface{}{"a": 1, "b": map[string]interface{}{"c": 2, "d": 3}, "e": 4}) {
+		t.Fatal(doc)
+	}
+}
+
+func TestDeleteAndUpdateByQuery(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"kind"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		kind := "even"
+		if i%2 == 1 {
+			kind = "odd"
+		}
+		if _, err = col.Insert(map[string]interface{}{"kind": kind, "n": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Update the odd documents, move them to another kind
+	var reports []QueryOpProgress
+	prog, err := col.UpdateByQuery(map[string]interface{}{"eq": "odd", "in": []interface{}{"kind"}},
+		map[string]interface{}{"kind": "odd2", "patched": true}, func(p QueryOpProgress) {
+			reports = append(reports, p)
+		})
+	if err != nil {
+		t.Fatal(err)
+	} else if prog.Matched != 50 || prog.Done != 50 || prog.Failed != 0 || !prog.Finished || prog.Batches != 2 || prog.BatchesDone != 2 {
+		t.Fatal(prog)
+	} else if len(reports) != 2 || reports[0].Finished || !reports[1].Finished || reports[1].Done != 50 {
+		t.Fatal(reports)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": "odd2", "in": []interface{}{"kind"}}, col, &result); err != nil || len(result) != 50 {
+		t.Fatal(result, err)
+	}
+	for id := range result {
+		if doc, err := col.Read(id); err != nil || doc["patched"] != true || int(doc["n"].(float64))%2 != 1 {
+			t.Fatal(doc, err)
+		}
+	}
+	// Delete the even documents
+	prog, err = col.DeleteByQuery(map[string]interface{}{"eq": "even", "in": []interface{}{"kind"}}, nil)
+	if err != nil || prog.Matched != 50 || prog.Done != 50 || !prog.Finished {
+		t.Fatal(prog, err)
+	}
+	result = make(map[int]struct{})
+	if err = EvalQuery("all", col, &result); err != nil || len(result) != 50 {
+		t.Fatal(len(result), err)
+	}
+	// Nonexistent documents are skipped
+	prog, err = col.DeleteByQuery([]interface{}{"12345"}, nil)
+	if err != nil || prog.Matched != 1 || prog.Done != 0 || prog.Skipped != 1 {
+		t.Fatal(prog, err)
+	}
+	// Failed updates are counted
+	db.Config.MaxDocSize = 60
+	prog, err = col.UpdateByQuery("all", map[string]interface{}{"long": strings.Repeat("x", 60)}, nil)
+	if err != nil || prog.Matched != 50 || prog.Failed != 50 || !strings.HasPrefix(prog.FirstErr, "Document is too large") {
+		t.Fatal(prog, err)
+	}
+	db.Config.MaxDocSize = 0
+	// Hooks are fired for each document of a batch, and referenced documents are not deleted
+	if err = db.Create("refs"); err != nil {
+		t.Fatal(err)
+	}
+	refs := db.Use("refs")
+	if err = refs.SetConfig(ColConfig{Relations: []Relation{{Path: []string{"to"}, Target: "col"}}}); err != nil {
+		t.Fatal(err)
+	}
+	var referenced int
+	for id := range result {
+		referenced = id
+		break
+	}
+	if _, err = refs.Insert(map[string]interface{}{"to": strconv.Itoa(referenced)}); err != nil {
+		t.Fatal(err)
+	}
+	hooked := 0
+	col.OnDelete(func(id int, original map[string]interface{}) {
+		if original["kind"] == "odd2" {
+			hooked++
+		}
+	}, false)
+	prog, err = col.DeleteByQuery("all", nil)
+	if err != nil || prog.Matched != 50 || prog.Done != 49 || prog.Failed != 1 || !strings.Contains(prog.FirstErr, "is referenced") || hooked != 49 {
+		t.Fatal(prog, err, hooked)
+	} else if _, err = col.Read(referenced); err != nil {
+		t.Fatal(err)
+	}
+	// Malformed query and string ID patch are refused
+	if _, err = col.DeleteByQuery(map[string]interface{}{"eq": 1}, nil); err == nil {
+		t.Fatal("Did not error")
+	} else if _, err = col.UpdateByQuery("all", map[string]interface{}{STR_ID_ATTR: "a"}, nil); err == nil {
+		t.Fatal("Did not error")
+	}
+}
@@ -0,0 +1,178 @@
+// Capped collections.
+//
+// A capped collection holds at most a number of documents and/or bytes of documents; once the cap is exceeded by an
+// insert, the oldest documents are evicted. Each document of a capped collection carries its insertion sequence number
+// in the reserved attribute "_seq", the insertion order is tracked in memory and rebuilt from "_seq" when the
+// collection is opened. Documents inserted before the collection was capped are considered the oldest.
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+const (
+	SEQ_ATTR = "_seq" // Reserved document attribute holding the document's insertion sequence number in a capped collection.
+)
+
+// Documents of a capped collection in insertion order.
+type cappedDocs struct {
+	lock  *sync.Mutex
+	order []int       // Document IDs in insertion order, including those deleted meanwhile
+	stale int         // Number of deleted documents in the insertion order
+	sizes map[int]int // Size of each document in the collection
+	bytes int         // Total size of documents in the collection
+	seq   float64     // Sequence number of the next inserted document
+}
+
+// Return true if the settings cap the number or size of documents.
+func (conf ColConfig) Capped() bool {
+	return conf.MaxDocs > 0 || conf.MaxBytes > 0
+}
+
+// Return true if the settings need the insertion order of documents, which capped collections, collections ordering
+// query results by insertion and those asked to track it do.
+func (conf ColConfig) tracksOrder() bool {
+	return conf.Capped() || conf.ResultOrder == RESULT_ORDER_INSERTION || conf.InsertOrder
+}
+
+// Rebuild the insertion order of documents if the collection tracks it. Does not place schema lock.
+func (col *Col) loadCapped() {
+	col.capped = nil
+	if !col.conf.tracksOrder() {
+		return
+	}
+	type seqDoc struct {
+		id   int
+		seq  float64
+		size int
+	}
+	docs := make([]seqDoc, 0, col.approxDocCount(false))
+	capped := &cappedDocs{lock: new(sync.Mutex), sizes: make(map[int]int)}
+	col.scanOnce(func(id int, doc []byte) bool {
+		var seqOnly struct {
+			Seq *float64 `json:"_seq"`
+		}
+		// Size excludes the padding that follows the document data
+		entry := seqDoc{id: id, seq: -1, size: len(bytes.TrimRight(doc, " "))}
+		if err := json.Unmarshal(doc, &seqOnly); err == nil && seqOnly.Seq != nil {
+			entry.seq = *seqOnly.Seq
+		}
+		if entry.seq >= capped.seq {
+			capped.seq = entry.seq + 1
+		}
+		docs = append(docs, entry)
+		return true
+	}, false)
+	// Documents without sequence number, inserted before the order was tracked, are in the order of their IDs
+	sort.Slice(docs, func(i, j int) bool {
+		return docs[i].seq < docs[j].seq || docs[i].seq == docs[j].seq && docs[i].id < docs[j].id
+	})
+	capped.order = make([]int, 0, len(docs))
+	for _, doc := range docs {
+		capped.order = append(capped.order, doc.id)
+		capped.sizes[doc.id] = doc.size
+		capped.bytes += doc.size
+	}
+	col.capped = capped
+}
+
+// Stamp the next insertion sequence number on a new document if the collection tracks insertion order. Does not place
+// schema lock.
+func (col *Col) stampSeq(doc map[string]interface{}) {
+	if col.capped != nil {
+		col.capped.lock.Lock()
+		doc[SEQ_ATTR] = col.capped.seq
+		col.capped.seq++
+		col.capped.lock.Unlock()
+	}
+}
+
+// Record a newly inserted document, or the new size of an updated document. Does not place schema lock.
+func (col *Col) cappedPut(id, size int) {
+	if col.capped == nil {
+		return
+	}
+	capped := col.capped
+	capped.lock.Lock()
+	if oldSize, exists := capped.sizes[id]; exists {
+		capped.bytes -= oldSize
+	} else {
+		capped.order = append(capped.order, id)
+	}
+	capped.sizes[id] = size
+	capped.bytes += size
+	capped.lock.Unlock()
+}
+
+// Forget a deleted document. Does not place schema lock.
+func (col *Col) cappedRemove(id int) {
+	if col.capped == nil {
+		return
+	}
+	capped := col.capped
+	capped.lock.Lock()
+	if size, exists := capped.sizes[id]; exists {
+		capped.bytes -= size
+		delete(capped.sizes, id)
+		// Deleted documents are taken off the insertion order once they outnumber the documents in the collection
+		if capped.stale++; capped.stale > len(capped.sizes) {
+			capped.compact()
+		}
+	}
+	capped.lock.Unlock()
+}
+
+// Take the deleted documents off the insertion order. Caller must hold the lock.
+func (capped *cappedDocs) compact() {
+	live := make([]int, 0, len(capped.sizes))
+	for _, id := range capped.order {
+		if _, exists := capped.sizes[id]; exists {
+			live = append(live, id)
+		}
+	}
+	capped.order = live
+	capped.stale = 0
+}
+
+// Take the oldest documents off the insertion order until the collection is within its cap, and return their IDs.
+// The most recently inserted document is never taken, even if it alone exceeds the byte cap.
+func (capped *cappedDocs) overflow(conf ColConfig) (evict []int) {
+	capped.lock.Lock()
+	defer capped.lock.Unlock()
+	for len(capped.sizes) > 0 &&
+		(conf.MaxDocs > 0 && len(capped.sizes) > conf.MaxDocs || conf.MaxBytes > 0 && capped.bytes > conf.MaxBytes && len(capped.sizes) > 1) {
+		id := capped.order[0]
+		capped.order = capped.order[1:]
+		if size, exists := capped.sizes[id]; exists {
+			capped.bytes -= size
+			delete(capped.sizes, id)
+			evict = append(evict, id)
+		} else if capped.stale > 0 {
+			capped.stale--
+		}
+	}
+	// Let go of the space held by IDs taken off the front
+	if cap(capped.order) > 2*len(capped.order)+1024 {
+		capped.order = append(make([]int, 0, len(capped.order)), capped.order...)
+	}
+	return
+}
+
+// Delete the oldest documents until the collection is within its cap.
+func (col *Col) evictCapped() {
+	col.db.schemaLock.RLock()
+	capped, conf := col.capped, col.conf
+	col.db.schemaLock.RUnlock()
+	if capped == nil {
+		return
+	}
+	for _, id := range capped.overflow(conf) {
+		// The document may have been deleted by others meanwhile. Eviction is not subject to write limits, as the
+		// document is already taken off the insertion order.
+		col.delete(id, func() {}, true)
+	}
+}
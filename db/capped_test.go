@@ -0,0 +1,155 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func countDocs(col *Col) (count, size int) {
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		count++
+		size += len(bytes.TrimRight(doc, " "))
+		return true
+	})
+	return
+}
+
+func TestCappedCol(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if col.Config().Capped() {
+		t.Fatal(col.Config())
+	}
+	// Documents inserted before capping are the oldest
+	uncappedID, err := col.Insert(map[string]interface{}{"n": -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = col.SetConfig(ColConfig{MaxDocs: -1}); err == nil {
+		t.Fatal("Did not error")
+	} else if err = col.SetConfig(ColConfig{MaxDocs: 5}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 0, 10)
+	for i := 0; i < 10; i++ {
+		id, err := col.Insert(map[string]interface{}{"n": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// Only the 5 most recent documents remain
+	if _, err = col.Read(uncappedID); err == nil {
+		t.Fatal("Did not evict")
+	}
+	for i, id := range ids {
+		doc, err := col.Read(id)
+		if i < 5 && err == nil {
+			t.Fatal("Did not evict", i)
+		} else if i >= 5 && (err != nil || doc[SEQ_ATTR] != float64(i)) {
+			t.Fatal(i, doc, err)
+		}
+	}
+	// Updates retain insertion order
+	if err = col.Update(ids[5], map[string]interface{}{"n": 5, SEQ_ATTR: 100}); err != nil {
+		t.Fatal(err)
+	} else if doc, _ := col.Read(ids[5]); doc[SEQ_ATTR] != float64(5) {
+		t.Fatal(doc)
+	}
+	// Deleted documents no longer count towards the cap
+	if err = col.Delete(ids[9]); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"n": 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = append(ids, id)
+	if _, err = col.Read(ids[5]); err != nil {
+		t.Fatal(err)
+	}
+	// The insertion order survives reopening the database
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col = db.Use("col")
+	if id, err = col.Insert(map[string]interface{}{"n": 11}); err != nil {
+		t.Fatal(err)
+	} else if doc, _ := col.Read(id); doc[SEQ_ATTR] != float64(11) {
+		t.Fatal(doc)
+	}
+	if _, err = col.Read(ids[5]); err == nil {
+		t.Fatal("Did not evict")
+	} else if _, err = col.Read(ids[6]); err != nil {
+		t.Fatal(err)
+	}
+	// Lowering the cap evicts right away, byte cap keeps the most recent document
+	if err = col.SetConfig(ColConfig{MaxDocs: 5, MaxBytes: 1}); err != nil {
+		t.Fatal(err)
+	} else if count, _ := countDocs(col); count != 1 {
+		t.Fatal(count)
+	} else if _, err = col.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.SetConfig(ColConfig{MaxBytes: 100}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err = col.Insert(map[string]interface{}{"s": strings.Repeat("x", 20)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, total := countDocs(col); count != 2 || total > 100 {
+		t.Fatal(count, total)
+	}
+	// Truncated collection starts over
+	if err = db.Truncate("col"); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.Insert(map[string]interface{}{"n": 0}); err != nil {
+		t.Fatal(err)
+	} else if count, _ := countDocs(col); count != 1 {
+		t.Fatal(count)
+	}
+}
+
+func TestCappedOrderCompacted(t *testing.T) {
+	col := &Col{capped: &cappedDocs{lock: new(sync.Mutex), sizes: make(map[int]int)}}
+	for round := 0; round < 100; round++ {
+		for id := 0; id < 10; id++ {
+			col.cappedPut(round*10+id, 1)
+		}
+		// Deleted documents do not accumulate in the insertion order
+		for id := 0; id < 9; id++ {
+			col.cappedRemove(round*10 + id)
+		}
+		if len(col.capped.order) > 2*len(col.capped.sizes)+10 {
+			t.Fatal(round, len(col.capped.order), len(col.capped.sizes))
+		}
+	}
+	// The insertion order of the remaining documents is kept
+	if evict := col.capped.overflow(ColConfig{MaxDocs: 98}); len(evict) != 2 || evict[0] != 9 || evict[1] != 19 {
+		t.Fatal(evict)
+	}
+}
@@ -3,20 +3,24 @@
 package db
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/cankansin/tiedot/data"
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
 )
 
 const (
 	DOC_DATA_FILE   = "dat_" // Prefix of partition collection data file name.
 	DOC_LOOKUP_FILE = "id_"  // Prefix of partition hash table (ID lookup) file name.
+	DOC_COUNT_FILE  = "cnt_" // Prefix of partition document count file name, the count is saved upon closing.
 	INDEX_PATH_SEP  = "!"    // Separator between index keys in index directory name.
 )
 
@@ -27,11 +31,29 @@ type Col struct {
 	parts      []*data.Partition            // Collection partitions
 	hts        []map[string]*data.HashTable // Index partitions
 	indexPaths map[string][]string          // Index names and paths
+	strIDs     []*data.HashTable            // String ID lookup partitions
+	strIDLocks []*sync.Mutex                // Guard against concurrent assignment of the same string ID
+	conf       ColConfig                    // Collection settings
+	fileConf   *data.Config                 // Settings of the collection's files, derived from database and collection settings
+	plans      map[string]*queryPlan        // Cached query plans by query shape
+	planLock   *sync.Mutex                  // Protect query plan cache
+	building   map[string]*indexBuild       // Indexes being built and not yet available to queries
+	idxUsage   map[string]*indexUsage       // Index usage statistics
+	capped     *cappedDocs                  // Documents in insertion order, nil unless the collection tracks insertion order
+	hooks      *colHooks                    // Document mutation hooks
+	throttle   *writeThrottle               // Write limits
+	cache      *docCache                    // Decoded documents, nil unless the collection caches documents
+	ext        *extCache                    // External document cache, nil unless plugged in by the application
+	leases     *docLeases                   // Documents leased by FindOneAndLock
+	retention  *retentionStats              // Documents removed by retention
+	dicts      *compressDicts               // Compression dictionaries of archived documents
+	eventual   *eventualQueue               // Queued changes of eventual indexes
 }
 
 // Open a collection and load all indexes.
 func OpenCol(db *DB, name string) (*Col, error) {
-	col := &Col{db: db, name: name}
+	col := &Col{db: db, name: name, hooks: newColHooks(), throttle: newWriteThrottle(), leases: newDocLeases(),
+		retention: &retentionStats{lock: new(sync.Mutex)}, eventual: newEventualQueue()}
 	return col, col.load()
 }
 
@@ -39,6 +61,10 @@ func OpenCol(db *DB, name string) (*Col, error) {
 func (col *Col) load() error {
 	if err := os.MkdirAll(path.Join(col.db.path, col.name), 0700); err != nil {
 		return err
+	} else if err := col.loadConfig(); err != nil {
+		return err
+	} else if err := col.loadDicts(); err != nil {
+		return err
 	}
 	col.parts = make([]*data.Partition, col.db.numParts)
 	col.hts = make([]map[string]*data.HashTable, col.db.numParts)
@@ -46,45 +72,128 @@ func (col *Col) load() error {
 		col.hts[i] = make(map[string]*data.HashTable)
 	}
 	col.indexPaths = make(map[string][]string)
-	// Open collection document partitions
+	col.idxUsage = make(map[string]*indexUsage)
+	col.strIDLocks = make([]*sync.Mutex, col.db.numParts)
 	for i := 0; i < col.db.numParts; i++ {
-		var err error
-		if col.parts[i], err = col.db.Config.OpenPartition(
-			path.Join(col.db.path, col.name, DOC_DATA_FILE+strconv.Itoa(i)),
-			path.Join(col.db.path, col.name, DOC_LOOKUP_FILE+strconv.Itoa(i))); err != nil {
-			return err
+		col.strIDLocks[i] = new(sync.Mutex)
+	}
+	col.plans = make(map[string]*queryPlan)
+	col.planLock = new(sync.Mutex)
+	col.building = make(map[string]*indexBuild)
+	// Open collection document partitions
+	partJobs := make([]func() error, col.db.numParts)
+	for i := range partJobs {
+		i := i
+		partJobs[i] = func() error {
+			part, err := col.fileConf.OpenPartition(
+				path.Join(col.db.path, col.name, DOC_DATA_FILE+strconv.Itoa(i)),
+				path.Join(col.db.path, col.name, DOC_LOOKUP_FILE+strconv.Itoa(i)))
+			if err != nil {
+				return err
+			}
+			col.parts[i] = part
+			return part.LoadCount(path.Join(col.db.path, col.name, DOC_COUNT_FILE+strconv.Itoa(i)))
 		}
 	}
+	if err := runJobs(col.db.openSlots, partJobs); err != nil {
+		return err
+	} else if err := col.loadStrIDs(); err != nil {
+		return err
+	}
 	// Look for index directories
 	colDirContent, err := ioutil.ReadDir(path.Join(col.db.path, col.name))
 	if err != nil {
 		return err
 	}
+	var htJobs []func() error
+	idxTables := make(map[string][]*data.HashTable)
 	for _, htDir := range colDirContent {
 		if !htDir.IsDir() {
 			continue
+		} else if strings.HasPrefix(htDir.Name(), INDEX_BUILD_PREFIX) || strings.HasPrefix(htDir.Name(), INDEX_DROP_PREFIX) {
+			// Discard the leftover of an unfinished index build or removal
+			if err := os.RemoveAll(path.Join(col.db.path, col.name, htDir.Name())); err != nil {
+				return err
+			}
+			continue
 		}
 		// Open index partitions
 		idxName := htDir.Name()
 		idxPath := strings.Split(idxName, INDEX_PATH_SEP)
+		if err := checkIndexFuncs(idxPath); err != nil {
+			tdlog.Noticef("Index %v of collection %s is not maintained until its function is registered: %v", idxPath, col.name, err)
+		}
 		col.indexPaths[idxName] = idxPath
-		for i := 0; i < col.db.numParts; i++ {
-			if col.hts[i][idxName], err = col.db.Config.OpenHashTable(
-				path.Join(col.db.path, col.name, idxName, strconv.Itoa(i))); err != nil {
-				return err
+		col.idxUsage[idxName] = new(indexUsage)
+		tables := make([]*data.HashTable, col.db.numParts)
+		idxTables[idxName] = tables
+		for i := range tables {
+			i := i
+			htJobs = append(htJobs, func() (err error) {
+				tables[i], err = col.fileConf.OpenHashTable(path.Join(col.db.path, col.name, idxName, strconv.Itoa(i)))
+				return
+			})
+		}
+	}
+	err = runJobs(col.db.openSlots, htJobs)
+	// The index partitions opened are kept even if others failed, so that closing the collection closes them
+	for idxName, tables := range idxTables {
+		for i, ht := range tables {
+			if ht != nil {
+				col.hts[i][idxName] = ht
 			}
 		}
 	}
+	if err != nil {
+		return err
+	}
+	col.loadCapped()
 	return nil
 }
 
+// Delete all documents and clear indexes. Does not place schema lock.
+func (col *Col) truncate() error {
+	for i := 0; i < col.db.numParts; i++ {
+		if err := col.parts[i].Clear(); err != nil {
+			return err
+		} else if err := col.strIDs[i].Clear(); err != nil {
+			return err
+		}
+		for _, ht := range col.hts[i] {
+			if err := ht.Clear(); err != nil {
+				return err
+			}
+		}
+	}
+	col.eventual.discard("")
+	col.loadCapped()
+	col.cache.clear()
+	if col.ext != nil {
+		col.ext = newExtCache(col.name, col.ext.cache)
+	}
+	col.leases.clear()
+	return col.clearIndexBuilds()
+}
+
 // Close all collection files. Do not use the collection afterwards!
 func (col *Col) close() error {
-	errs := make([]error, 0, 0)
+	errs := col.abortIndexBuilds()
+	col.applyEventual()
 	for i := 0; i < col.db.numParts; i++ {
+		if col.parts == nil || col.parts[i] == nil {
+			// The collection failed to open the partition
+			continue
+		}
 		col.parts[i].DataLock.Lock()
 		if err := col.parts[i].Close(); err != nil {
 			errs = append(errs, err)
+		} else if err = col.parts[i].SaveCount(path.Join(col.db.path, col.name, DOC_COUNT_FILE+strconv.Itoa(i))); err != nil {
+			errs = append(errs, err)
+		}
+		if col.strIDs != nil && col.strIDs[i] != nil {
+			if err := col.strIDs[i].Close(); err != nil {
+				errs = append(errs, err)
+			}
 		}
 		for _, ht := range col.hts[i] {
 			if err := ht.Close(); err != nil {
@@ -99,7 +208,77 @@ func (col *Col) close() error {
 	return fmt.Errorf("%v", errs)
 }
 
+// Apply the current memory usage settings to all open files, including those of indexes being built.
+// Does not place schema lock.
+func (col *Col) applySettings() error {
+	for i := 0; i < col.db.numParts; i++ {
+		if err := col.parts[i].ApplySettings(); err != nil {
+			return err
+		} else if err := col.strIDs[i].ApplySettings(); err != nil {
+			return err
+		}
+		for _, ht := range col.hts[i] {
+			if err := ht.ApplySettings(); err != nil {
+				return err
+			}
+		}
+	}
+	for _, build := range col.building {
+		for _, ht := range build.hts {
+			if err := ht.ApplySettings(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Trim the pre-allocated space beyond the space in-use of all files of the collection - documents, ID and string ID
+// lookup and indexes - so that the space no longer occupies disk. The files grow again as documents are written.
+// Indexes being built are left as they are.
+func (col *Col) Shrink() error {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	for i := 0; i < col.db.numParts; i++ {
+		part := col.parts[i]
+		part.DataLock.Lock()
+		err := part.Shrink()
+		part.DataLock.Unlock()
+		if err != nil {
+			return err
+		}
+		hts := []*data.HashTable{col.strIDs[i]}
+		for _, ht := range col.hts[i] {
+			hts = append(hts, ht)
+		}
+		for _, ht := range hts {
+			ht.Lock.Lock()
+			err := ht.Shrink()
+			ht.Lock.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Do fun for all documents in the collection. Documents are not copied out of the data files, each is only valid
+// during the call to fun, which must neither retain nor modify it.
 func (col *Col) forEachDoc(fun func(id int, doc []byte) (moveOn bool), placeSchemaLock bool) {
+	col.scanDocs(context.Background(), fun, placeSchemaLock, false)
+}
+
+// Do fun for all documents in a one-off scan (such as index build and scrub), which releases memory pages of the
+// scanned partitions if DontNeedAfterScan is set, so that the scan does not push regularly accessed data out of memory.
+// Like forEachDoc, documents are only valid during the call to fun.
+func (col *Col) scanOnce(fun func(id int, doc []byte) (moveOn bool), placeSchemaLock bool) {
+	col.scanDocs(context.Background(), fun, placeSchemaLock, true)
+}
+
+// Do fun for all documents, see forEachDoc and scanOnce. The scan stops once the context is done, between partitions and
+// between chunks of approx.4k documents, and then returns the context's error.
+func (col *Col) scanDocs(ctx context.Context, fun func(id int, doc []byte) (moveOn bool), placeSchemaLock, oneOff bool) error {
 	if placeSchemaLock {
 		col.db.schemaLock.RLock()
 		defer col.db.schemaLock.RUnlock()
@@ -111,56 +290,48 @@ func (col *Col) forEachDoc(fun func(id int, doc []byte) (moveOn bool), placeSche
 	}
 	for iteratePart := 0; iteratePart < col.db.numParts; iteratePart++ {
 		part := col.parts[iteratePart]
-		part.DataLock.RLock()
+		if done := ctx.Done(); done == nil {
+			part.DataLock.RLock()
+		} else {
+			// Scans are not subject to the lock timeout, only to the context
+			for !part.RLockData(done) {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+		}
 		for i := 0; i < partDiv; i++ {
-			if !part.ForEachDoc(i, partDiv, fun) {
+			if err := ctx.Err(); err != nil {
 				part.DataLock.RUnlock()
-				return
+				return err
+			} else if !part.ForEachDocView(i, partDiv, fun) {
+				part.DataLock.RUnlock()
+				return nil
+			}
+		}
+		if oneOff {
+			if err := part.AfterScan(); err != nil {
+				tdlog.Noticef("Failed to release memory of collection %s after scan: %v", col.name, err)
 			}
 		}
 		part.DataLock.RUnlock()
 	}
+	return nil
 }
 
 // Do fun for all documents in the collection.
 func (col *Col) ForEachDoc(fun func(id int, doc []byte) (moveOn bool)) {
-	col.forEachDoc(fun, true)
+	col.forEachDoc(func(id int, doc []byte) bool {
+		docCopy := make([]byte, len(doc))
+		copy(docCopy, doc)
+		return fun(id, docCopy)
+	}, true)
 }
 
-// Create an index on the path.
-func (col *Col) Index(idxPath []string) (err error) {
-	col.db.schemaLock.Lock()
-	defer col.db.schemaLock.Unlock()
-	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
-	if _, exists := col.indexPaths[idxName]; exists {
-		return fmt.Errorf("Path %v is already indexed", idxPath)
-	}
-	col.indexPaths[idxName] = idxPath
-	idxDir := path.Join(col.db.path, col.name, idxName)
-	if err = os.MkdirAll(idxDir, 0700); err != nil {
-		return err
-	}
-	for i := 0; i < col.db.numParts; i++ {
-		if col.hts[i][idxName], err = col.db.Config.OpenHashTable(path.Join(idxDir, strconv.Itoa(i))); err != nil {
-			return err
-		}
-	}
-	// Put all documents on the new index
-	col.forEachDoc(func(id int, doc []byte) (moveOn bool) {
-		var docObj map[string]interface{}
-		if err := json.Unmarshal(doc, &docObj); err != nil {
-			// Skip corrupted document
-			return true
-		}
-		for _, idxVal := range GetIn(docObj, idxPath) {
-			if idxVal != nil {
-				hashKey := StrHash(fmt.Sprint(idxVal))
-				col.hts[hashKey%col.db.numParts][idxName].Put(hashKey, id)
-			}
-		}
-		return true
-	}, false)
-	return
+// Do fun for all documents in the collection without copying them out of the data files. Each document is only valid
+// during the call to fun, which must neither retain nor modify it, nor write to the collection.
+func (col *Col) ForEachDocView(fun func(id int, doc []byte) (moveOn bool)) {
+	col.forEachDoc(fun, true)
 }
 
 // Return all indexed paths.
@@ -184,9 +355,12 @@ func (col *Col) Unindex(idxPath []string) error {
 	defer col.db.schemaLock.Unlock()
 	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
 	if _, exists := col.indexPaths[idxName]; !exists {
-		return fmt.Errorf("Path %v is not indexed", idxPath)
+		return dberr.New(dberr.ErrorNoIndex, idxPath)
 	}
 	delete(col.indexPaths, idxName)
+	delete(col.idxUsage, idxName)
+	col.eventual.discard(idxName)
+	col.resetPlans()
 	for i := 0; i < col.db.numParts; i++ {
 		col.hts[i][idxName].Close()
 		delete(col.hts[i], idxName)
@@ -205,17 +379,22 @@ func (col *Col) approxDocCount(placeSchemaLock bool) int {
 	total := 0
 	for _, part := range col.parts {
 		part.DataLock.RLock()
-		total += part.ApproxDocCount()
+		total += part.Count()
 		part.DataLock.RUnlock()
 	}
 	return total
 }
 
-// Return approximate number of documents in the collection.
+// Return number of documents in the collection, which is now the same as Count.
 func (col *Col) ApproxDocCount() int {
 	return col.approxDocCount(true)
 }
 
+// Return the exact number of documents in the collection without scanning it.
+func (col *Col) Count() int {
+	return col.approxDocCount(true)
+}
+
 // Divide the collection into roughly equally sized pages, and do fun on all documents in the specified page.
 func (col *Col) ForEachDocInPage(page, total int, fun func(id int, doc []byte) bool) {
 	col.db.schemaLock.RLock()
@@ -0,0 +1,283 @@
+// Collection settings.
+
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cankansin/tiedot/data"
+	"github.com/cankansin/tiedot/dberr"
+)
+
+const (
+	COL_CONFIG_FILE = "col-config.json" // Name of collection settings file in collection directory.
+	CREATED_ATTR    = "_created"        // Reserved document attribute holding the document's creation time.
+	UPDATED_ATTR    = "_updated"        // Reserved document attribute holding the document's last update time.
+)
+
+// ColConfig consists of optional features of a collection, persisted in the collection directory.
+type ColConfig struct {
+	Timestamps      bool       // Timestamps makes insert/update stamp documents' "_created" and "_updated" time (Unix seconds).
+	MaxDocs         int        // MaxDocs caps the number of documents, the oldest documents are evicted beyond it (0 - unlimited).
+	MaxBytes        int        // MaxBytes caps the total size of documents, the oldest documents are evicted beyond it (0 - unlimited).
+	Relations       []Relation // Relations declare the paths referring to documents of other collections.
+	MaxWriteRate    int        // MaxWriteRate limits the number of writes per second (0 - unlimited).
+	MaxWrites       int        // MaxWrites limits the number of writes in progress (0 - unlimited).
+	RejectOverload  bool       // RejectOverload makes writes beyond the limits fail with ErrorOverloaded rather than wait.
+	DocCacheSize    int        // DocCacheSize is the number of decoded documents kept in memory for reads (0 - no cache).
+	ColFileGrowth   int        // ColFileGrowth is the size (in bytes) to grow document data files by (0 - ColFileGrowth of the database).
+	ColInitialSize  int        // ColInitialSize is the size (in bytes) of new document data files (0 - ColInitialSize of the database).
+	HTFileGrowth    int        // HTFileGrowth is the size (in bytes) to grow ID lookup and index files by (0 - HTFileGrowth of the database).
+	HTInitialSize   int        // HTInitialSize is the size (in bytes) of new ID lookup and index files (0 - HTInitialSize of the database).
+	ACLPath         []string   // ACLPath is the path of the attribute listing the principals allowed to access a document (nil - no access control).
+	ArchiveCol      string     // ArchiveCol is the collection receiving documents older than ArchiveAfter ("" - no archive).
+	ArchiveAfter    int        // ArchiveAfter is the age (in seconds) of documents moved to the archive collection.
+	ArchivePath     []string   // ArchivePath is the indexed path of document time, Unix seconds or RFC 3339 string.
+	QueryArchive    bool       // QueryArchive makes queries and reads of the collection include the archive collection.
+	Retention       int        // Retention is the number of seconds documents are kept for (0 - forever).
+	RetentionPath   []string   // RetentionPath is the indexed path of document time, Unix seconds or RFC 3339 string.
+	RetentionMove   bool       // RetentionMove makes documents beyond retention move to the archive collection rather than be deleted.
+	ExactNumbers    bool       // ExactNumbers makes integers beyond 2^53 read as json.Number rather than rounded float64.
+	ResultOrder     string     // ResultOrder is the order of paged query results, RESULT_ORDER_ID ("" - the same) or RESULT_ORDER_INSERTION.
+	InsertOrder     bool       // InsertOrder makes the collection track the insertion order of documents for Latest and InsertedAfter.
+	MaxIndexBytes   int        // MaxIndexBytes caps the total size of index files, beyond which new indexes are refused (0 - unlimited).
+	EventualIndexes [][]string // EventualIndexes are the paths of indexes updated in background batches after writes return.
+}
+
+// Read collection settings from the collection directory, a missing settings file means default settings.
+func (col *Col) loadConfig() error {
+	var err error
+	col.conf, err = col.readConfig()
+	col.throttle.configure(col.conf)
+	col.eventual.configure(col.conf)
+	col.cache = newDocCache(col.conf.DocCacheSize)
+	col.fileConf = new(data.Config)
+	col.applyFileConfig()
+	return err
+}
+
+// Read collection settings file from the collection directory, a missing settings file means default settings.
+func (col *Col) readConfig() (conf ColConfig, err error) {
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, COL_CONFIG_FILE))
+	if os.IsNotExist(err) {
+		return ColConfig{}, nil
+	} else if err == nil {
+		err = json.Unmarshal(content, &conf)
+	}
+	return
+}
+
+// Validate collection settings.
+func checkConfig(conf ColConfig) error {
+	if conf.MaxDocs < 0 {
+		return dberr.New(dberr.ErrorInvalidParam, "maximum number of documents", conf.MaxDocs)
+	} else if conf.MaxBytes < 0 {
+		return dberr.New(dberr.ErrorInvalidParam, "maximum size of documents", conf.MaxBytes)
+	} else if conf.MaxWriteRate < 0 {
+		return dberr.New(dberr.ErrorInvalidParam, "maximum write rate", conf.MaxWriteRate)
+	} else if conf.MaxWrites < 0 {
+		return dberr.New(dberr.ErrorInvalidParam, "maximum writes in progress", conf.MaxWrites)
+	} else if conf.DocCacheSize < 0 {
+		return dberr.New(dberr.ErrorInvalidParam, "document cache size", conf.DocCacheSize)
+	} else if conf.MaxIndexBytes < 0 {
+		return dberr.New(dberr.ErrorInvalidParam, "maximum size of indexes", conf.MaxIndexBytes)
+	} else if conf.ResultOrder != "" && conf.ResultOrder != RESULT_ORDER_ID && conf.ResultOrder != RESULT_ORDER_INSERTION {
+		return dberr.New(dberr.ErrorInvalidParam, "result order", conf.ResultOrder)
+	}
+	for name, size := range map[string]int{"ColFileGrowth": conf.ColFileGrowth, "ColInitialSize": conf.ColInitialSize,
+		"HTFileGrowth": conf.HTFileGrowth, "HTInitialSize": conf.HTInitialSize} {
+		if size < 0 {
+			return dberr.New(dberr.ErrorInvalidParam, name, size)
+		}
+	}
+	for _, seg := range conf.ACLPath {
+		if seg == "" {
+			return dberr.New(dberr.ErrorInvalidParam, "ACL path", conf.ACLPath)
+		}
+	}
+	for _, idxPath := range conf.EventualIndexes {
+		if len(idxPath) == 0 {
+			return dberr.New(dberr.ErrorInvalidParam, "eventual index", idxPath)
+		}
+		// Referrers of a deleted document must be found by their relation's index right away
+		for _, rel := range conf.Relations {
+			if strings.Join(rel.Path, INDEX_PATH_SEP) == strings.Join(idxPath, INDEX_PATH_SEP) {
+				return dberr.New(dberr.ErrorInvalidParam, "eventual index", idxPath)
+			}
+		}
+	}
+	if conf.ArchiveCol != "" && conf.ArchiveAfter <= 0 {
+		return dberr.New(dberr.ErrorInvalidParam, "archive after", conf.ArchiveAfter)
+	} else if conf.ArchiveCol != "" && len(conf.ArchivePath) == 0 {
+		return dberr.New(dberr.ErrorInvalidParam, "archive path", conf.ArchivePath)
+	} else if conf.Retention < 0 {
+		return dberr.New(dberr.ErrorInvalidParam, "retention", conf.Retention)
+	} else if conf.Retention > 0 && len(conf.RetentionPath) == 0 {
+		return dberr.New(dberr.ErrorInvalidParam, "retention path", conf.RetentionPath)
+	} else if conf.RetentionMove && conf.ArchiveCol == "" {
+		return dberr.New(dberr.ErrorMissing, "archive collection")
+	}
+	return checkRelations(conf.Relations)
+}
+
+// Apply collection settings without persisting them. Does not place schema lock.
+func (col *Col) applyConfig(conf ColConfig) {
+	// An index no longer eventual is updated right away from now on, after the changes queued so far
+	col.applyEventual()
+	wasTracking := col.conf.tracksOrder()
+	wasExact := col.conf.ExactNumbers
+	col.conf = conf
+	col.conf.Relations = append([]Relation(nil), conf.Relations...)
+	col.conf.ACLPath = append([]string(nil), conf.ACLPath...)
+	col.conf.ArchivePath = append([]string(nil), conf.ArchivePath...)
+	col.conf.RetentionPath = append([]string(nil), conf.RetentionPath...)
+	col.conf.EventualIndexes = append([][]string(nil), conf.EventualIndexes...)
+	if wasTracking != conf.tracksOrder() {
+		col.loadCapped()
+	}
+	col.throttle.configure(conf)
+	col.eventual.configure(conf)
+	// Cached documents were decoded the way numbers were
+	if col.cache == nil || col.cache.size != conf.DocCacheSize || wasExact != conf.ExactNumbers {
+		col.cache = newDocCache(conf.DocCacheSize)
+	}
+	col.applyFileConfig()
+}
+
+// Derive the settings of the collection's files from those of the database, overridden by the file sizes of the
+// collection settings. The files refer to the derived settings, which are updated in place. Does not place schema lock.
+func (col *Col) applyFileConfig() {
+	*col.fileConf = *col.db.Config
+	if col.conf.ColFileGrowth > 0 {
+		col.fileConf.ColFileGrowth = col.conf.ColFileGrowth
+	}
+	if col.conf.ColInitialSize > 0 {
+		col.fileConf.ColInitialSize = col.conf.ColInitialSize
+	}
+	if col.conf.HTFileGrowth > 0 {
+		col.fileConf.HTFileGrowth = col.conf.HTFileGrowth
+	}
+	if col.conf.HTInitialSize > 0 {
+		col.fileConf.HTInitialSize = col.conf.HTInitialSize
+	}
+}
+
+// Write collection settings into the collection directory. Does not place schema lock.
+func (col *Col) saveConfig() error {
+	content, err := json.MarshalIndent(col.conf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(col.db.path, col.name, COL_CONFIG_FILE), content, 0600)
+}
+
+// Return collection settings.
+func (col *Col) Config() ColConfig {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	return col.copyConfig()
+}
+
+// Return a copy of collection settings. Does not place schema lock.
+func (col *Col) copyConfig() ColConfig {
+	conf := col.conf
+	// The caller may modify the relations and the paths
+	conf.Relations = append([]Relation(nil), conf.Relations...)
+	conf.ACLPath = append([]string(nil), conf.ACLPath...)
+	conf.ArchivePath = append([]string(nil), conf.ArchivePath...)
+	conf.RetentionPath = append([]string(nil), conf.RetentionPath...)
+	conf.EventualIndexes = append([][]string(nil), conf.EventualIndexes...)
+	return conf
+}
+
+// Change and persist collection settings. Documents beyond a newly lowered cap are evicted right away, the file growth
+// applies to open files right away, and the initial file size to files created from now on.
+func (col *Col) SetConfig(conf ColConfig) error {
+	if err := checkConfig(conf); err != nil {
+		return err
+	}
+	col.db.schemaLock.Lock()
+	if err := col.checkTimePaths(conf); err != nil {
+		col.db.schemaLock.Unlock()
+		return err
+	}
+	oldConf := col.conf
+	col.applyConfig(conf)
+	if err := col.saveConfig(); err != nil {
+		col.applyConfig(oldConf)
+		col.db.schemaLock.Unlock()
+		return err
+	}
+	err := col.applySettings()
+	col.db.schemaLock.Unlock()
+	col.evictCapped()
+	return err
+}
+
+// Return the current time in the representation of timestamp attributes.
+func timestampNow() float64 {
+	// Stored as float64 so that the indexed value is identical before and after the document is serialised
+	return float64(time.Now().Unix())
+}
+
+// Return a shallow copy of the document for stamping, so that the caller's document remains as it is.
+func copyForStamps(doc map[string]interface{}) map[string]interface{} {
+	stamped := make(map[string]interface{}, len(doc)+2)
+	for key, val := range doc {
+		stamped[key] = val
+	}
+	return stamped
+}
+
+// Return the new document stamped with creation and update time if timestamps are enabled, and with its insertion
+// sequence number if the collection tracks insertion order. The input document is not modified. Does not place
+// schema lock.
+func (col *Col) stampInsert(doc map[string]interface{}) map[string]interface{} {
+	if !col.conf.Timestamps && col.capped == nil {
+		return doc
+	}
+	doc = copyForStamps(doc)
+	if col.conf.Timestamps {
+		now := timestampNow()
+		doc[CREATED_ATTR] = now
+		doc[UPDATED_ATTR] = now
+	}
+	col.stampSeq(doc)
+	return doc
+}
+
+// Return true if updated documents carry over attributes from their original. Does not place schema lock.
+func (col *Col) stampsUpdate() bool {
+	return col.conf.Timestamps || col.capped != nil
+}
+
+// Return the updated document stamped with update time and the creation time carried over from its original if
+// timestamps are enabled, and with the insertion sequence number carried over if the collection tracks insertion
+// order. The input document is not modified. Does not place schema lock.
+func (col *Col) stampUpdate(doc, original map[string]interface{}) map[string]interface{} {
+	if doc == nil || !col.stampsUpdate() {
+		return doc
+	}
+	doc = copyForStamps(doc)
+	if col.conf.Timestamps {
+		if created, exists := original[CREATED_ATTR]; exists {
+			doc[CREATED_ATTR] = created
+		} else {
+			delete(doc, CREATED_ATTR)
+		}
+		doc[UPDATED_ATTR] = timestampNow()
+	}
+	if col.capped != nil {
+		if seq, exists := original[SEQ_ATTR]; exists {
+			doc[SEQ_ATTR] = seq
+		} else {
+			delete(doc, SEQ_ATTR)
+		}
+	}
+	return doc
+}
@@ -0,0 +1,193 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestColConfigTimestamps(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	// Timestamps are disabled by default
+	if col.Config().Timestamps {
+		t.Fatal(col.Config())
+	}
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, _ := col.Read(id); doc[CREATED_ATTR] != nil || doc[UPDATED_ATTR] != nil {
+		t.Fatal(doc)
+	}
+	// Enable timestamps and verify that the setting persists
+	if err = col.SetConfig(ColConfig{Timestamps: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.Index([]string{CREATED_ATTR}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col = db.Use("col")
+	if !col.Config().Timestamps {
+		t.Fatal(col.Config())
+	}
+	before := timestampNow()
+	// The caller's document is not stamped
+	newDoc := map[string]interface{}{"a": 2}
+	if id, err = col.Insert(newDoc); err != nil {
+		t.Fatal(err)
+	} else if len(newDoc) != 1 {
+		t.Fatal(newDoc)
+	}
+	doc, err := col.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, ok := doc[CREATED_ATTR].(float64)
+	if !ok || created < before || doc[UPDATED_ATTR] != doc[CREATED_ATTR] {
+		t.Fatal(doc)
+	}
+	// Update carries over creation time, even if the new document attempts to change it
+	updatedDoc := map[string]interface{}{"a": 3, CREATED_ATTR: 0}
+	if err = col.Update(id, updatedDoc); err != nil {
+		t.Fatal(err)
+	} else if len(updatedDoc) != 2 || updatedDoc[CREATED_ATTR] != 0 {
+		t.Fatal(updatedDoc)
+	}
+	if err = col.UpdateFunc(id, func(orig map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"a": 4}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.UpdateBytesFunc(id, func(orig []byte) ([]byte, error) {
+		return []byte(`{"a": 5}`), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if doc, err = col.Read(id); err != nil || doc[CREATED_ATTR] != created || doc["a"] != 5.0 {
+		t.Fatal(doc, err)
+	}
+	if updated, ok := doc[UPDATED_ATTR].(float64); !ok || updated < created {
+		t.Fatal(doc)
+	}
+	// Timestamps are indexed like any other attribute
+	q := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": created, "in": []interface{}{CREATED_ATTR}}, col, &q); err != nil || !ensureMapHasKeys(q, id) {
+		t.Fatal(q, err)
+	}
+	// Settings survive scrub
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	if !db.Use("col").Config().Timestamps {
+		t.Fatal("Lost settings during scrub")
+	}
+}
+
+func TestColConfigFileSizes(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	dataSize := func() int64 {
+		info, err := os.Stat(path.Join(TEST_DATA_DIR, "col", DOC_DATA_FILE+"0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	if dataSize() != int64(db.Config.ColFileGrowth) {
+		t.Fatal(dataSize())
+	}
+	if err = col.SetConfig(ColConfig{ColInitialSize: -1}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+	pageSize := os.Getpagesize()
+	if err = col.SetConfig(ColConfig{ColFileGrowth: 2 * pageSize, ColInitialSize: pageSize}); err != nil {
+		t.Fatal(err)
+	}
+	// The initial size applies to cleared files, the growth to open files right away
+	if err = db.Truncate("col"); err != nil {
+		t.Fatal(err)
+	} else if dataSize() != int64(pageSize) {
+		t.Fatal(dataSize())
+	}
+	for i := 0; i < 100; i++ {
+		if _, err = col.Insert(map[string]interface{}{"a": strings.Repeat("x", 100)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size := dataSize(); size <= int64(pageSize) || size%int64(2*pageSize) != int64(pageSize) {
+		t.Fatal(size)
+	}
+	// Shrinking keeps less than a page beyond the space in use
+	if err = col.SetConfig(ColConfig{ColFileGrowth: 64 * pageSize}); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.Insert(map[string]interface{}{"a": strings.Repeat("x", 100)}); err != nil {
+		t.Fatal(err)
+	}
+	for col.Count() < 200 {
+		if _, err = col.Insert(map[string]interface{}{"a": strings.Repeat("x", 100)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grown := dataSize()
+	if err = col.Shrink(); err != nil {
+		t.Fatal(err)
+	} else if shrunk := dataSize(); shrunk >= grown || shrunk%int64(pageSize) != 0 || shrunk > int64(col.parts[0].Count()*256+pageSize) {
+		t.Fatal(grown, shrunk)
+	}
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	// Documents remain readable and writable after shrinking
+	if _, err = col.Insert(map[string]interface{}{"a": "y"}); err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": "y", "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != 1 {
+		t.Fatal(err, result)
+	} else if col.Count() != 201 {
+		t.Fatal(col.Count())
+	}
+}
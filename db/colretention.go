@@ -0,0 +1,72 @@
+// Retention of collection documents.
+//
+// A collection with a retention period, such as a collection of logs, has the documents older than the period removed
+// by their time along an indexed path - Unix seconds or an RFC 3339 string. Once a minute the documents beyond
+// retention are deleted, or moved to the archive collection of the collection (see tiering), alongside the segments of
+// time series collections beyond their retention. Statistics of the documents removed are kept in memory since the
+// collection was opened.
+
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// RetentionStats tells the documents removed by the retention of a collection.
+type RetentionStats struct {
+	Runs        int64  // Number of times retention was applied
+	Deleted     int64  // Number of documents deleted
+	Moved       int64  // Number of documents moved to the archive collection
+	LastRun     int64  // Time (Unix seconds) retention was last applied, 0 if it is not yet applied
+	LastRemoved int    // Number of documents removed by the last run
+	LastError   string // Error of the last run, "" if it succeeded
+}
+
+// Retention statistics of a collection.
+type retentionStats struct {
+	lock  *sync.Mutex
+	stats RetentionStats
+}
+
+// Remove the documents beyond retention right away, return the number of documents removed. Fail with ErrorMissing if
+// the collection has no retention.
+func (col *Col) ApplyRetention() (removed int, err error) {
+	if err = col.db.checkWritable(); err != nil {
+		return
+	}
+	conf := col.Config()
+	if conf.Retention == 0 {
+		return 0, dberr.New(dberr.ErrorMissing, "retention")
+	}
+	archiveName := ""
+	if conf.RetentionMove {
+		archiveName = conf.ArchiveCol
+	}
+	removed, err = col.removeOld(conf.RetentionPath, conf.Retention, archiveName)
+	col.retention.lock.Lock()
+	defer col.retention.lock.Unlock()
+	stats := &col.retention.stats
+	stats.Runs++
+	if conf.RetentionMove {
+		stats.Moved += int64(removed)
+	} else {
+		stats.Deleted += int64(removed)
+	}
+	stats.LastRun = time.Now().Unix()
+	stats.LastRemoved = removed
+	stats.LastError = ""
+	if err != nil {
+		stats.LastError = err.Error()
+	}
+	return
+}
+
+// Return the retention statistics since the collection was opened.
+func (col *Col) RetentionStats() RetentionStats {
+	col.retention.lock.Lock()
+	defer col.retention.lock.Unlock()
+	return col.retention.stats
+}
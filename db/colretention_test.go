@@ -0,0 +1,65 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestColRetention(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("logs"); err != nil {
+		t.Fatal(err)
+	}
+	logs := db.Use("logs")
+	conf := ColConfig{Retention: 3600, RetentionPath: []string{"time"}}
+	if _, err = logs.ApplyRetention(); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	} else if err = logs.SetConfig(conf); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	} else if err = logs.Index([]string{"time"}); err != nil {
+		t.Fatal(err)
+	} else if err = logs.SetConfig(ColConfig{Retention: -1}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if err = logs.SetConfig(ColConfig{Retention: 60}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if err = logs.SetConfig(ColConfig{Retention: 60, RetentionPath: []string{"time"}, RetentionMove: true}); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	} else if err = logs.SetConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	insert := func(times ...time.Time) {
+		for _, at := range times {
+			if _, err := logs.Insert(map[string]interface{}{"time": float64(at.Unix())}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Documents beyond retention are deleted
+	insert(now.Add(-2*time.Hour), now.Add(-3*time.Hour), now)
+	if removed, err := logs.ApplyRetention(); err != nil || removed != 2 || logs.Count() != 1 {
+		t.Fatal(removed, err, logs.Count())
+	} else if stats := logs.RetentionStats(); stats.Runs != 1 || stats.Deleted != 2 || stats.Moved != 0 || stats.LastRemoved != 2 || stats.LastRun == 0 {
+		t.Fatal(stats)
+	}
+	// Or moved to the archive collection
+	conf.ArchiveCol, conf.ArchiveAfter, conf.ArchivePath, conf.RetentionMove = "old", 7200, []string{"time"}, true
+	if err = logs.SetConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	insert(now.Add(-2 * time.Hour))
+	if removed, err := logs.ApplyRetention(); err != nil || removed != 1 || logs.Count() != 1 || db.Use("old").Count() != 1 {
+		t.Fatal(removed, err, logs.Count())
+	} else if stats := logs.RetentionStats(); stats.Runs != 2 || stats.Deleted != 2 || stats.Moved != 1 || stats.LastRemoved != 1 {
+		t.Fatal(stats)
+	}
+}
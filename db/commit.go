@@ -0,0 +1,78 @@
+// Group commit.
+//
+// When DurableWrites is enabled (data-config.json), a write returns only once the extents it wrote are flushed to
+// disk. Flushing after every write would cost a disk flush per write, so concurrent writers are coalesced: the first
+// writer of a batch waits GroupCommitWait for others to join, then a single flush covers the writes of the entire batch
+// and every writer of the batch returns. Writers arriving while a batch is flushed form the next batch.
+
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// Writes waiting for the same flush.
+type commitBatch struct {
+	done chan struct{} // Closed once the batch is flushed
+	err  error         // Result of the flush
+}
+
+// Batches of durable writes.
+type groupCommit struct {
+	lock      *sync.Mutex  // Protects batch
+	batch     *commitBatch // Batch open to writers, nil if there is none
+	flushLock *sync.Mutex  // Only one batch is flushed at a time
+}
+
+func newGroupCommit() *groupCommit {
+	return &groupCommit{lock: new(sync.Mutex), flushLock: new(sync.Mutex)}
+}
+
+// Wait until the writes made by the caller are flushed to disk, if durable writes are enabled. Must be called without
+// holding schema lock.
+func (db *DB) commitWrite() error {
+	db.schemaLock.RLock()
+	durable, wait := db.Config.DurableWrites, time.Duration(db.Config.GroupCommitWait)*time.Microsecond
+	db.schemaLock.RUnlock()
+	if !durable {
+		return nil
+	}
+	gc := db.commits
+	gc.lock.Lock()
+	batch := gc.batch
+	if batch == nil {
+		batch = &commitBatch{done: make(chan struct{})}
+		gc.batch = batch
+		go db.flushBatch(batch, wait)
+	}
+	gc.lock.Unlock()
+	<-batch.done
+	return batch.err
+}
+
+// Flush a batch once the wait is over and the previous batch is flushed. The batch is closed to writers right before
+// the flush, so that the flush covers the writes of every writer in the batch.
+func (db *DB) flushBatch(batch *commitBatch, wait time.Duration) {
+	time.Sleep(wait)
+	gc := db.commits
+	gc.flushLock.Lock()
+	gc.lock.Lock()
+	gc.batch = nil
+	gc.lock.Unlock()
+	batch.err = db.Flush()
+	gc.flushLock.Unlock()
+	close(batch.done)
+}
+
+// Wait until the writes of a batch operation are flushed to disk, and report a failed flush as the error of every
+// document written.
+func (db *DB) commitBatchWrite(errs []error) {
+	if err := db.commitWrite(); err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+}
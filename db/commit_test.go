@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGroupCommit(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	wait := 50 * time.Millisecond
+	db.schemaLock.Lock()
+	db.Config.DurableWrites = true
+	db.Config.GroupCommitWait = int(wait / time.Microsecond)
+	db.schemaLock.Unlock()
+	// A durable write waits for its flush
+	start := time.Now()
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if elapsed := time.Since(start); elapsed < wait {
+		t.Fatal(elapsed)
+	}
+	// Concurrent writers share flushes, rather than waiting for one flush each
+	writers := 16
+	wg := new(sync.WaitGroup)
+	start = time.Now()
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := col.Insert(map[string]interface{}{"i": i}); err != nil {
+				t.Error(err)
+			} else if err = col.Update(id, map[string]interface{}{"a": i}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > time.Duration(writers)*wait/2 {
+		t.Fatal("writes are not committed in groups", elapsed)
+	}
+	errs := col.deleteBatch(context.Background(), []int{id}, nil)
+	if errs[0] != nil {
+		t.Fatal(errs)
+	}
+	count := 0
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		count++
+		return true
+	})
+	if count != writers {
+		t.Fatal(count)
+	}
+	// Writes do not wait when durable writes are disabled
+	db.schemaLock.Lock()
+	db.Config.DurableWrites = false
+	db.schemaLock.Unlock()
+	start = time.Now()
+	if _, err = col.Insert(map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	} else if elapsed := time.Since(start); elapsed >= wait {
+		t.Fatal(elapsed)
+	}
+}
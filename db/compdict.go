@@ -0,0 +1,203 @@
+// Compression dictionaries of archive collections.
+//
+// Archived documents (see tiering) are compressed one by one, and a small document compresses poorly on its own: the
+// attribute names and recurring values making up most of it are new to the compressor every time. A collection may
+// be given a dictionary trained from a sample of similar documents - the JSON fragments they have in common - and the
+// documents archived into the collection from then on are compressed by DEFLATE with the dictionary preset, so that
+// they refer back to the fragments instead of spelling them out. A document compressed with a dictionary carries the
+// number of the dictionary in attribute "_dict". The dictionaries are kept in file COMPRESS_DICTS_FILE of the
+// collection directory and never removed, training again adds a dictionary and leaves documents compressed earlier
+// readable.
+//
+// Only archive collections compress their documents, so a dictionary has no effect on an ordinary collection. The
+// dictionaries are DEFLATE preset dictionaries rather than zstd ones, as the Go standard library has no zstd.
+
+package db
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+const (
+	COMPRESS_DICTS_FILE = "compress-dicts.json" // Name of compression dictionaries file in collection directory.
+	ARCHIVED_DICT_ATTR  = "_dict"               // Reserved document attribute holding the number of the dictionary an archived document is compressed with.
+	MAX_DICT_SIZE       = 32 * 1024             // Maximum size of a compression dictionary, the DEFLATE window.
+)
+
+// Compression dictionaries of a collection, the number of a dictionary is its position plus one.
+type compressDicts struct {
+	lock  *sync.RWMutex
+	dicts [][]byte
+}
+
+// Read the compression dictionaries from the collection directory, a missing file means no dictionary.
+func (col *Col) loadDicts() error {
+	col.dicts = &compressDicts{lock: new(sync.RWMutex)}
+	content, err := ioutil.ReadFile(path.Join(col.db.path, col.name, COMPRESS_DICTS_FILE))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err == nil {
+		err = json.Unmarshal(content, &col.dicts.dicts)
+	}
+	return err
+}
+
+// Return the number and content of the latest compression dictionary, 0 and nil if there is none.
+func (col *Col) latestDict() (num int, dict []byte) {
+	col.dicts.lock.RLock()
+	defer col.dicts.lock.RUnlock()
+	if num = len(col.dicts.dicts); num > 0 {
+		dict = col.dicts.dicts[num-1]
+	}
+	return
+}
+
+// Train a compression dictionary for the documents archived into the collection from then on, out of up to sampleSize
+// documents of collection src (the collection itself if nil); archived documents of the sample are decompressed
+// first. Return the size of the dictionary. Fail with ErrorMissing if the sample has no fragments in common.
+func (col *Col) TrainDict(src *Col, sampleSize int) (dictSize int, err error) {
+	if err = col.db.checkWritable(); err != nil {
+		return
+	} else if sampleSize < 1 {
+		return 0, dberr.New(dberr.ErrorInvalidParam, "sample size", sampleSize)
+	} else if src == nil {
+		src = col
+	}
+	sample := make([]map[string]interface{}, 0, sampleSize)
+	err = src.ForEachDocCtx(context.Background(), func(id int, docB []byte) bool {
+		var doc map[string]interface{}
+		if json.Unmarshal(docB, &doc) == nil {
+			if doc, err := src.Unarchive(doc); err == nil {
+				sample = append(sample, doc)
+			}
+		}
+		return len(sample) < sampleSize
+	})
+	if err != nil {
+		return
+	}
+	dict := trainDict(sample)
+	if len(dict) == 0 {
+		return 0, dberr.New(dberr.ErrorMissing, "fragments common to the sample documents")
+	}
+	col.dicts.lock.Lock()
+	defer col.dicts.lock.Unlock()
+	dicts := append(col.dicts.dicts[:len(col.dicts.dicts):len(col.dicts.dicts)], dict)
+	content, err := json.Marshal(dicts)
+	if err == nil {
+		err = ioutil.WriteFile(path.Join(col.db.path, col.name, COMPRESS_DICTS_FILE), content, 0600)
+	}
+	if err != nil {
+		return
+	}
+	col.dicts.dicts = dicts
+	return len(dict), nil
+}
+
+// Return a dictionary of the JSON fragments - attribute names, and attribute names along with scalar values - found in
+// at least two of the documents (in the only document of a sample of one), up to MAX_DICT_SIZE bytes. The fragments
+// worth the most (occurrences × length) are chosen and placed last, where DEFLATE refers to them most cheaply.
+func trainDict(docs []map[string]interface{}) []byte {
+	occurs := make(map[string]int)
+	for _, doc := range docs {
+		fragments := make(map[string]struct{})
+		var walk func(obj map[string]interface{})
+		walk = func(obj map[string]interface{}) {
+			for key, val := range obj {
+				keyJS, _ := json.Marshal(key)
+				name := string(keyJS) + ":"
+				fragments[name] = struct{}{}
+				switch val := val.(type) {
+				case map[string]interface{}:
+					walk(val)
+				case []interface{}:
+					for _, elem := range val {
+						if obj, isObj := elem.(map[string]interface{}); isObj {
+							walk(obj)
+						}
+					}
+				default:
+					valJS, _ := json.Marshal(val)
+					fragments[name+string(valJS)] = struct{}{}
+				}
+			}
+		}
+		walk(doc)
+		for fragment := range fragments {
+			occurs[fragment]++
+		}
+	}
+	minOccurs := 2
+	if len(docs) == 1 {
+		minOccurs = 1
+	}
+	common := make([]string, 0, len(occurs))
+	for fragment, n := range occurs {
+		if n >= minOccurs {
+			common = append(common, fragment)
+		}
+	}
+	sort.Slice(common, func(i, j int) bool {
+		worthI, worthJ := occurs[common[i]]*len(common[i]), occurs[common[j]]*len(common[j])
+		if worthI != worthJ {
+			return worthI > worthJ
+		}
+		return common[i] < common[j]
+	})
+	size := 0
+	for i, fragment := range common {
+		if size+len(fragment) > MAX_DICT_SIZE {
+			common = common[:i]
+			break
+		}
+		size += len(fragment)
+	}
+	var dict bytes.Buffer
+	for i := len(common) - 1; i >= 0; i-- {
+		dict.WriteString(common[i])
+	}
+	return dict.Bytes()
+}
+
+// Return the document JSON compressed by DEFLATE with the dictionary preset.
+func compressWithDict(docJS, dict []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	compressor, err := flate.NewWriterDict(&compressed, flate.BestCompression, dict)
+	if err != nil {
+		return nil, err
+	} else if _, err = compressor.Write(docJS); err == nil {
+		err = compressor.Close()
+	}
+	return compressed.Bytes(), err
+}
+
+// Return the document kept by a document of the archive collection, decompressing it with the collection's
+// dictionary if it was compressed with one. A document that is not archived is returned as it is.
+func (col *Col) Unarchive(archived map[string]interface{}) (doc map[string]interface{}, err error) {
+	num, hasDict := archived[ARCHIVED_DICT_ATTR].(float64)
+	if !hasDict {
+		return Unarchive(archived)
+	}
+	col.dicts.lock.RLock()
+	var dict []byte
+	if num >= 1 && int(num) <= len(col.dicts.dicts) && num == float64(int(num)) {
+		dict = col.dicts.dicts[int(num)-1]
+	}
+	col.dicts.lock.RUnlock()
+	if dict == nil {
+		return nil, dberr.New(dberr.ErrorInvalidParam, ARCHIVED_DICT_ATTR, archived[ARCHIVED_DICT_ATTR])
+	}
+	return decodeArchived(archived, func(compressed []byte) ([]byte, error) {
+		return ioutil.ReadAll(flate.NewReaderDict(bytes.NewReader(compressed), dict))
+	})
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestTrainDict(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("hot"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("cold"); err != nil {
+		t.Fatal(err)
+	}
+	hot, cold := db.Use("hot"), db.Use("cold")
+	if err = hot.Index([]string{"time"}); err != nil {
+		t.Fatal(err)
+	} else if err = hot.SetConfig(ColConfig{ArchiveCol: "cold", ArchiveAfter: 3600, ArchivePath: []string{"time"}, QueryArchive: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cold.TrainDict(hot, 0); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if _, err = cold.TrainDict(nil, 10); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	}
+	old := float64(time.Now().Add(-2 * time.Hour).Unix())
+	ids := make([]int, 50)
+	for i := range ids {
+		doc := map[string]interface{}{"time": old, "level": "info", "service": "checkout", "message": fmt.Sprintf("order %d placed", i)}
+		if ids[i], err = hot.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Documents compress far better with the dictionary than on their own
+	size, err := cold.TrainDict(hot, 20)
+	if err != nil || size == 0 || size > MAX_DICT_SIZE {
+		t.Fatal(size, err)
+	}
+	doc, err := hot.Read(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	num, dict := cold.latestDict()
+	withDict, err := archiveDoc(doc, nil, num, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alone, err := archiveDoc(doc, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(withDict[ARCHIVED_ATTR].(string))*2 > len(alone[ARCHIVED_ATTR].(string)) {
+		t.Fatal(withDict, alone)
+	}
+	// Documents archived from then on are compressed with the dictionary, and read transparently
+	if moved, err := hot.Archive(); err != nil || moved != len(ids) {
+		t.Fatal(moved, err)
+	}
+	archived, err := cold.Read(ids[1])
+	if err != nil || archived[ARCHIVED_DICT_ATTR] != 1.0 {
+		t.Fatal(archived, err)
+	} else if _, err = Unarchive(archived); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	} else if doc, err := cold.Unarchive(archived); err != nil || doc["message"] != "order 1 placed" {
+		t.Fatal(doc, err)
+	}
+	// Training again, here from the archive itself, leaves the documents compressed earlier readable
+	if _, err = cold.TrainDict(nil, 50); err != nil {
+		t.Fatal(err)
+	} else if num, _ = cold.latestDict(); num != 2 {
+		t.Fatal(num)
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	hot = db.Use("hot")
+	if num, _ = db.Use("cold").latestDict(); num != 2 {
+		t.Fatal(num)
+	} else if doc, err := hot.Read(ids[2]); err != nil || doc["message"] != "order 2 placed" || doc["service"] != "checkout" {
+		t.Fatal(doc, err)
+	}
+}
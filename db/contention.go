@@ -0,0 +1,77 @@
+// Lock contention report.
+//
+// Every write locks its document while the indexes are maintained, so that concurrent writes of the same document wait
+// for each other; a document written by many clients at once - a counter, a shared status document - serialises them.
+// The partitions count the waits for document locks since the collection was opened (see data.Partition.Contention),
+// and Contention sums them up by collection, along with the documents waited for the most, so that hotspots can be
+// found and the documents split or the writes batched.
+
+package db
+
+import (
+	"sort"
+	"time"
+)
+
+// ContentionInfo tells how often and how long the writes of a collection waited for the locks of their documents.
+type ContentionInfo struct {
+	Col       string       `json:"col"`           // Collection name
+	Waits     int64        `json:"waits"`         // Number of times a document lock was waited for
+	TotalWait float64      `json:"total_wait_ms"` // Total time (in milliseconds) waited
+	AvgWait   float64      `json:"avg_wait_ms"`   // Average time (in milliseconds) of a wait
+	HotDocs   []HotDocInfo `json:"hot_docs"`      // Documents waited for the most, most waits first
+}
+
+// HotDocInfo tells how often and how long the lock of a document was waited for.
+type HotDocInfo struct {
+	ID      int     `json:"id"`          // Document ID
+	Waits   int64   `json:"waits"`       // Number of times the lock was waited for
+	AvgWait float64 `json:"avg_wait_ms"` // Average time (in milliseconds) of a wait
+}
+
+// Return the time in milliseconds.
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Return the lock waits of the collections whose document locks were waited for, the longest total wait first, each
+// with its top (0 - all tracked) documents waited for the most. Counting starts over if reset is true.
+func (db *DB) Contention(top int, reset bool) (report []ContentionInfo) {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	report = make([]ContentionInfo, 0)
+	for name, col := range db.cols {
+		var waits int64
+		var wait time.Duration
+		var docs []HotDocInfo
+		for _, part := range col.parts {
+			partWaits, partWait, partDocs := part.Contention(reset)
+			waits += partWaits
+			wait += partWait
+			for _, doc := range partDocs {
+				docs = append(docs, HotDocInfo{ID: doc.ID, Waits: doc.Waits, AvgWait: millis(doc.Wait) / float64(doc.Waits)})
+			}
+		}
+		if waits == 0 {
+			continue
+		}
+		sort.Slice(docs, func(i, j int) bool {
+			if docs[i].Waits != docs[j].Waits {
+				return docs[i].Waits > docs[j].Waits
+			}
+			return docs[i].ID < docs[j].ID
+		})
+		if top > 0 && len(docs) > top {
+			docs = docs[:top]
+		}
+		report = append(report, ContentionInfo{Col: name, Waits: waits, TotalWait: millis(wait),
+			AvgWait: millis(wait) / float64(waits), HotDocs: docs})
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].TotalWait != report[j].TotalWait {
+			return report[i].TotalWait > report[j].TotalWait
+		}
+		return report[i].Col < report[j].Col
+	})
+	return
+}
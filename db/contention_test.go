@@ -0,0 +1,60 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestContention(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, name := range []string{"hot", "cold"} {
+		if err = db.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hot := db.Use("hot")
+	id, err := hot.Insert(map[string]interface{}{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = db.Use("cold").Insert(map[string]interface{}{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if report := db.Contention(0, false); len(report) != 0 {
+		t.Fatal(report)
+	}
+	// Writes of the document wait while it is locked
+	part := hot.parts[id%db.numParts]
+	part.LockUpdate(id)
+	done := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- hot.Update(id, map[string]interface{}{"n": 2})
+		}()
+	}
+	for waiters := 0; waiters < 2; {
+		time.Sleep(time.Millisecond)
+		docs, _ := part.Locks()
+		waiters = docs[0].Waiters
+	}
+	part.UnlockUpdate(id)
+	for i := 0; i < 2; i++ {
+		if err = <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	report := db.Contention(1, true)
+	if len(report) != 1 || report[0].Col != "hot" || report[0].Waits < 2 || report[0].AvgWait <= 0 ||
+		len(report[0].HotDocs) != 1 || report[0].HotDocs[0].ID != id || report[0].HotDocs[0].Waits != report[0].Waits {
+		t.Fatal(report)
+	}
+	if report = db.Contention(0, false); len(report) != 0 {
+		t.Fatal(report)
+	}
+}
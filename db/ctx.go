@@ -0,0 +1,74 @@
+// Context-aware document operations.
+//
+// The ...Ctx functions act like their namesakes, and give up once the context is done - cancelled or past its deadline
+// - returning the context's error. Waiting for the collection's write limits and for partition locks is given up, and
+// queries and scans stop between partitions, index values and chunks of documents; the result of a query given up is
+// incomplete. The context is not consulted once a document is being written: index maintenance and hooks run to
+// completion, and so does a batch of deletion or update by query, which is given up only before its next batch. Schema
+// changes (such as creating an index) are not waited for by context either.
+
+package db
+
+import (
+	"context"
+)
+
+// Insert a document into the collection, see Insert.
+func (col *Col) InsertCtx(ctx context.Context, doc map[string]interface{}) (id int, err error) {
+	if strID, hasStrID := doc[STR_ID_ATTR].(string); hasStrID {
+		return col.insertStrID(ctx, strID, doc)
+	}
+	return col.insert(ctx, doc, func() {})
+}
+
+// Find and retrieve a document by ID, see Read.
+func (col *Col) ReadCtx(ctx context.Context, id int) (doc map[string]interface{}, err error) {
+	return col.read(ctx, id, true)
+}
+
+// Update a document, see Update.
+func (col *Col) UpdateCtx(ctx context.Context, id int, doc map[string]interface{}) error {
+	return col.update(ctx, id, doc)
+}
+
+// Delete a document, see Delete.
+func (col *Col) DeleteCtx(ctx context.Context, id int) error {
+	release, err := col.throttleWriteCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	_, err = col.deleteIf(ctx, id, release, true, nil)
+	return err
+}
+
+// Evaluate a query and put result into result map, see EvalQuery.
+func EvalQueryCtx(ctx context.Context, q interface{}, src *Col, result *map[int]struct{}) (err error) {
+	return evalQueryArchived(ctx, q, src, result)
+}
+
+// Do fun for all documents in the collection, see ForEachDoc.
+func (col *Col) ForEachDocCtx(ctx context.Context, fun func(id int, doc []byte) (moveOn bool)) error {
+	return col.scanDocs(ctx, func(id int, doc []byte) bool {
+		docCopy := make([]byte, len(doc))
+		copy(docCopy, doc)
+		return fun(id, docCopy)
+	}, true, false)
+}
+
+// Delete all documents matching the query, see DeleteByQuery.
+func (col *Col) DeleteByQueryCtx(ctx context.Context, q interface{}, progress func(QueryOpProgress)) (QueryOpProgress, error) {
+	return col.byQuery(ctx, q, func(ids []int) []error {
+		return col.deleteBatch(ctx, ids, nil)
+	}, progress)
+}
+
+// Patch all documents matching the query, see UpdateByQuery.
+func (col *Col) UpdateByQueryCtx(ctx context.Context, q interface{}, patch map[string]interface{}, progress func(QueryOpProgress)) (QueryOpProgress, error) {
+	if err := checkPatch(patch); err != nil {
+		return QueryOpProgress{}, err
+	}
+	return col.byQuery(ctx, q, func(ids []int) []error {
+		return col.patchBatch(ctx, ids, patch, nil)
+	}, progress)
+}
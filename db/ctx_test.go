@@ -0,0 +1,93 @@
+package db
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCtx(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	id, err := col.InsertCtx(ctx, map[string]interface{}{"a": 1.0})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = col.InsertCtx(ctx, map[string]interface{}{"_id": "x", "a": 2.0}); err != nil {
+		t.Fatal(err)
+	} else if err = col.UpdateCtx(ctx, id, map[string]interface{}{"a": 3.0}); err != nil {
+		t.Fatal(err)
+	} else if doc, err := col.ReadCtx(ctx, id); err != nil || doc["a"] != 3.0 {
+		t.Fatal(doc, err)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQueryCtx(ctx, map[string]interface{}{"eq": 3.0, "in": []interface{}{"a"}}, col, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	// Cancelled operations do nothing
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	result = make(map[int]struct{})
+	if err = EvalQueryCtx(cancelled, map[string]interface{}{"eq": 3.0, "in": []interface{}{"a"}}, col, &result); err != context.Canceled {
+		t.Fatal(err)
+	} else if err = EvalQueryCtx(cancelled, "all", col, &result); err != context.Canceled {
+		t.Fatal(err)
+	} else if err = col.ForEachDocCtx(cancelled, func(int, []byte) bool { return true }); err != context.Canceled {
+		t.Fatal(err)
+	} else if _, err = col.DeleteByQueryCtx(cancelled, "all", nil); err != context.Canceled {
+		t.Fatal(err)
+	} else if _, err = col.UpdateByQueryCtx(cancelled, "all", map[string]interface{}{"b": 1.0}, nil); err != context.Canceled {
+		t.Fatal(err)
+	} else if col.ApproxDocCount() != 2 {
+		t.Fatal(col.ApproxDocCount())
+	}
+	// Waiting for the partition lock ends at the deadline
+	part := col.parts[id%db.numParts]
+	part.DataLock.Lock()
+	deadline, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err = col.ReadCtx(deadline, id); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	} else if err = col.DeleteCtx(deadline, id); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	part.DataLock.Unlock()
+	// Waiting for the write limits ends at the deadline
+	if err = col.SetConfig(ColConfig{MaxWrites: 1}); err != nil {
+		t.Fatal(err)
+	}
+	release, err := col.throttleWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline, cancel = context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err = col.InsertCtx(deadline, map[string]interface{}{"a": 4.0}); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	release()
+	if err = col.DeleteCtx(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	if err = col.ForEachDocCtx(ctx, func(int, []byte) bool { count++; return true }); err != nil || count != 1 {
+		t.Fatal(count, err)
+	} else if prog, err := col.UpdateByQueryCtx(ctx, "all", map[string]interface{}{"b": 1.0}, nil); err != nil || prog.Done != 1 {
+		t.Fatal(prog, err)
+	} else if prog, err = col.DeleteByQueryCtx(ctx, "all", nil); err != nil || prog.Done != 1 {
+		t.Fatal(prog, err)
+	}
+}
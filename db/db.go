@@ -5,7 +5,6 @@ package db
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -18,36 +17,105 @@ import (
 	"time"
 
 	"github.com/cankansin/tiedot/data"
+	"github.com/cankansin/tiedot/dberr"
 	"github.com/cankansin/tiedot/tdlog"
 )
 
 const (
 	PART_NUM_FILE = "number_of_partitions" // DB-collection-partition-number-configuration file name
+	LOCK_FILE     = "lock"                 // DB-directory-lock file name, it holds the owner process ID and host name
 )
 
 // Database structures.
 type DB struct {
-	Config     *data.Config
-	path       string          // Root path of database directory
-	numParts   int             // Total number of partitions
-	cols       map[string]*Col // All collections
-	schemaLock *sync.RWMutex   // Control access to collection instances.
+	Config        *data.Config
+	path          string                 // Root path of database directory
+	numParts      int                    // Total number of partitions
+	cols          map[string]*Col        // All collections
+	schemaLock    *sync.RWMutex          // Control access to collection instances.
+	lock          *data.LockFile         // Prevent other processes from opening the database
+	views         map[string]*view       // Materialized views by name
+	changes       *changeLog             // Sequence numbers of changes for incremental backup
+	follower      *follower              // Backups followed by a read replica, nil if the database accepts writes
+	flushStop     chan struct{}          // Closed to stop the background flush goroutines
+	flushers      *sync.WaitGroup        // Background flush goroutines
+	commits       *groupCommit           // Batches of durable writes waiting for a flush
+	series        map[string]*TimeSeries // Time series collections
+	retentionStop chan struct{}          // Closed to stop dropping time series segments beyond retention
+	retentionDone chan struct{}          // Closed once segments beyond retention are no longer dropped
+	tieringStop   chan struct{}          // Closed to stop moving documents to archive collections
+	tieringDone   chan struct{}          // Closed once documents are no longer moved to archive collections
+	eventualStop  chan struct{}          // Closed to stop applying the queued changes of eventual indexes
+	eventualDone  chan struct{}          // Closed once queued changes are no longer applied in background
+	queries       map[string]StoredQuery // Stored queries by name
+	docLocks      *docLockTable          // Documents locked by LockUpdateMany
+	openSlots     chan struct{}          // Limit the number of files opened at a time
 }
 
-// Open database and load all collections & indexes.
+// Open database and load all collections & indexes. Fail if the database is in use by another process.
 func OpenDB(dbPath string) (*DB, error) {
+	return OpenDBProfile(dbPath, data.PROFILE_DEFAULT)
+}
+
+// Open database like OpenDB, a new database is created with the configuration profile (data.PROFILE_DEFAULT or
+// data.PROFILE_SMALL). The small profile also makes a new database store each collection in a single partition. An
+// existing database keeps its configuration and partitions.
+func OpenDBProfile(dbPath, profile string) (*DB, error) {
 	rand.Seed(time.Now().UnixNano()) // document ID generation relies on this RNG
-	d, err := data.CreateOrReadConfig(dbPath)
+	if err := os.MkdirAll(dbPath, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := data.AcquireLockFile(path.Join(dbPath, LOCK_FILE))
+	if err != nil {
+		return nil, err
+	}
+	d, err := data.CreateOrReadProfileConfig(dbPath, profile)
 	if err != nil {
+		lock.Release()
 		return nil, err
 	}
-	db := &DB{Config: d, path: dbPath, schemaLock: new(sync.RWMutex)}
+	changes, err := openChangeLog(dbPath)
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
+	db := &DB{Config: d, path: dbPath, schemaLock: new(sync.RWMutex), lock: lock, changes: changes, commits: newGroupCommit(),
+		docLocks: newDocLockTable()}
 	db.Config.CalculateConfigConstants()
-	return db, db.load()
+	db.openSlots = db.newOpenSlots()
+	// A new database has as many partitions as number of CPUs recognized by OS
+	newParts := runtime.NumCPU()
+	if profile == data.PROFILE_SMALL {
+		newParts = 1
+	}
+	if err = db.load(newParts); err != nil {
+		// Leave the database to another process, which may repair it
+		for _, col := range db.cols {
+			if col != nil {
+				col.hooks.removeAll()
+				col.close()
+			}
+		}
+		for _, ts := range db.series {
+			ts.close()
+		}
+		db.cols = make(map[string]*Col)
+		db.series = make(map[string]*TimeSeries)
+		changes.close()
+		lock.Release()
+	} else {
+		db.recoverTransactions()
+		db.startFlushers()
+		db.startRetention()
+		db.startTiering()
+		db.startEventual()
+		db.ensureRegisteredIndexes()
+	}
+	return db, err
 }
 
-// Load all collection schema.
-func (db *DB) load() error {
+// Load all collection schema. A new database has the number of partitions.
+func (db *DB) load(newParts int) error {
 	// Create DB directory and PART_NUM_FILE if necessary
 	var numPartsAssumed = false
 	numPartsFilePath := path.Join(db.path, PART_NUM_FILE)
@@ -55,8 +123,7 @@ func (db *DB) load() error {
 		return err
 	}
 	if partNumFile, err := os.Stat(numPartsFilePath); err != nil {
-		// The new database has as many partitions as number of CPUs recognized by OS
-		if err := ioutil.WriteFile(numPartsFilePath, []byte(strconv.Itoa(runtime.NumCPU())), 0600); err != nil {
+		if err := ioutil.WriteFile(numPartsFilePath, []byte(strconv.Itoa(newParts)), 0600); err != nil {
 			return err
 		}
 		numPartsAssumed = true
@@ -71,57 +138,171 @@ func (db *DB) load() error {
 	}
 	// Look for collection directories and open the collections
 	db.cols = make(map[string]*Col)
+	db.series = make(map[string]*TimeSeries)
 	dirContent, err := ioutil.ReadDir(db.path)
 	if err != nil {
 		return err
 	}
+	var jobs []func() error
+	opened := new(sync.Mutex) // Protect the collections and time series opened so far
 	for _, maybeColDir := range dirContent {
+		if maybeColDir.Mode()&os.ModeSymlink != 0 {
+			// The collection is placed elsewhere, its directory must be available
+			if maybeColDir, err = os.Stat(path.Join(db.path, maybeColDir.Name())); err != nil {
+				return err
+			}
+		}
 		if !maybeColDir.IsDir() {
 			continue
 		}
 		if numPartsAssumed {
 			return fmt.Errorf("Please manually repair database partition number config file %s", numPartsFilePath)
 		}
-		if db.cols[maybeColDir.Name()], err = OpenCol(db, maybeColDir.Name()); err != nil {
-			return err
+		name := maybeColDir.Name()
+		if _, err := os.Stat(path.Join(db.path, name, TIME_SERIES_CONFIG_FILE)); err == nil {
+			jobs = append(jobs, func() error {
+				ts, err := openTimeSeries(db, name)
+				if err == nil {
+					opened.Lock()
+					db.series[name] = ts
+					opened.Unlock()
+				}
+				return err
+			})
+			continue
 		}
+		jobs = append(jobs, func() error {
+			col, err := OpenCol(db, name)
+			// A collection that failed to open is kept as well, so that its files opened so far are closed
+			opened.Lock()
+			db.cols[name] = col
+			opened.Unlock()
+			return err
+		})
+	}
+	// Collections open their files through the open slots, they do not take a slot themselves
+	if err = runJobs(nil, jobs); err != nil {
+		return err
+	} else if err = db.loadViews(); err != nil {
+		return err
 	}
+	db.queries, err = readStoredQueries(db.path)
 	return err
 }
 
 // Close all database files. Do not use the DB afterwards!
 func (db *DB) Close() error {
+	if db.follower != nil {
+		db.follower.halt()
+	}
+	db.stopFlushers()
+	db.stopRetention()
+	db.stopTiering()
+	db.stopEventual()
 	db.schemaLock.Lock()
 	defer db.schemaLock.Unlock()
 	errs := make([]error, 0, 0)
 	for _, col := range db.cols {
+		col.hooks.removeAll()
 		if err := col.close(); err != nil {
 			errs = append(errs, err)
 		}
 	}
+	for _, ts := range db.series {
+		if err := ts.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := db.changes.close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := db.lock.Release(); err != nil {
+		errs = append(errs, err)
+	}
 	if len(errs) == 0 {
 		return nil
 	}
 	return fmt.Errorf("%v", errs)
 }
 
+// Reload the memory usage settings and document limits from data-config.json and apply them to all open files without
+// re-mapping them, reload the settings of each collection (such as write limits and caps) from its directory, and the
+// stored queries. The other data-config.json settings only take effect upon next start. Nothing is applied unless all
+// settings are valid.
+func (db *DB) ReloadConfig() error {
+	db.schemaLock.Lock()
+	queries, err := readStoredQueries(db.path)
+	if err != nil {
+		db.schemaLock.Unlock()
+		return fmt.Errorf("Stored queries: %v", err)
+	}
+	colConfs := make(map[*Col]ColConfig, len(db.cols))
+	for name, col := range db.cols {
+		conf, err := col.readConfig()
+		if err == nil {
+			err = checkConfig(conf)
+		}
+		if err != nil {
+			db.schemaLock.Unlock()
+			return fmt.Errorf("Settings of collection %s: %v", name, err)
+		}
+		colConfs[col] = conf
+	}
+	if err := db.Config.Reload(db.path); err != nil {
+		db.schemaLock.Unlock()
+		return err
+	}
+	db.queries = queries
+	for col, conf := range colConfs {
+		col.applyConfig(conf)
+		if err := col.applySettings(); err != nil {
+			db.schemaLock.Unlock()
+			return err
+		}
+	}
+	for _, ts := range db.series {
+		if err := ts.applySettings(); err != nil {
+			db.schemaLock.Unlock()
+			return err
+		}
+	}
+	db.schemaLock.Unlock()
+	// Documents beyond a newly lowered cap are evicted right away
+	for col := range colConfs {
+		col.evictCapped()
+	}
+	tdlog.Noticef("Reloaded configuration of %s", db.path)
+	return nil
+}
+
 // create creates collection files. The function does not place a schema lock.
 func (db *DB) create(name string) error {
 	if _, exists := db.cols[name]; exists {
-		return fmt.Errorf("Collection %s already exists", name)
+		return dberr.New(dberr.ErrorColExists, name)
+	} else if _, exists := db.series[name]; exists {
+		return dberr.New(dberr.ErrorColExists, name)
 	} else if err := os.MkdirAll(path.Join(db.path, name), 0700); err != nil {
 		return err
 	} else if db.cols[name], err = OpenCol(db, name); err != nil {
 		return err
 	}
+	db.logReset(name)
 	return nil
 }
 
-// Create a new collection.
+// Create a new collection, along with its indexes registered by RegisterIndexes.
 func (db *DB) Create(name string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
 	db.schemaLock.Lock()
-	defer db.schemaLock.Unlock()
-	return db.create(name)
+	err := db.create(name)
+	col := db.cols[name]
+	db.schemaLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return col.ensureIndexes(registeredIndexes(name))
 }
 
 // Return all collection names.
@@ -145,44 +326,58 @@ func (db *DB) Use(name string) *Col {
 	return nil
 }
 
+// Return the collection as a Collection, or nil (rather than a nil *Col) if the collection does not exist. Code taking
+// a Collection may be tested against MemCol or a mock, and the collection may be wrapped by decorators.
+func (db *DB) Collection(name string) Collection {
+	if col := db.Use(name); col != nil {
+		return col
+	}
+	return nil
+}
+
 // Rename a collection.
 func (db *DB) Rename(oldName, newName string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
 	db.schemaLock.Lock()
 	defer db.schemaLock.Unlock()
 	if _, exists := db.cols[oldName]; !exists {
-		return fmt.Errorf("Collection %s does not exist", oldName)
+		return dberr.New(dberr.ErrorNoCol, oldName)
 	} else if _, exists := db.cols[newName]; exists {
-		return fmt.Errorf("Collection %s already exists", newName)
-	} else if err := db.cols[oldName].close(); err != nil {
+		return dberr.New(dberr.ErrorColExists, newName)
+	} else if _, exists := db.series[newName]; exists {
+		return dberr.New(dberr.ErrorColExists, newName)
+	}
+	if err := db.cols[oldName].close(); err != nil {
 		return err
-	} else if err := os.Rename(path.Join(db.path, oldName), path.Join(db.path, newName)); err != nil {
+	} else if err := db.renameColDir(oldName, newName); err != nil {
 		return err
 	} else if db.cols[newName], err = OpenCol(db, newName); err != nil {
 		return err
 	}
+	// Hooks and external cache remain registered on the renamed collection
+	db.cols[newName].hooks = db.cols[oldName].hooks
+	db.cols[newName].ext = db.cols[oldName].ext
 	delete(db.cols, oldName)
-	return nil
+	db.logReset(newName)
+	db.renameInViews(oldName, newName)
+	return db.renameInRelations(oldName, newName)
 }
 
 // Truncate a collection - delete all documents and clear
 func (db *DB) Truncate(name string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
 	db.schemaLock.Lock()
 	defer db.schemaLock.Unlock()
 	if _, exists := db.cols[name]; !exists {
-		return fmt.Errorf("Collection %s does not exist", name)
+		return dberr.New(dberr.ErrorNoCol, name)
 	}
-	col := db.cols[name]
-	for i := 0; i < db.numParts; i++ {
-		if err := col.parts[i].Clear(); err != nil {
-			return err
-		}
-		for _, ht := range col.hts[i] {
-			if err := ht.Clear(); err != nil {
-				return err
-			}
-		}
-	}
-	return nil
+	err := db.cols[name].truncate()
+	db.logReset(name)
+	return err
 }
 
 // Scrub a collection - fix corrupted documents and de-fragment free space.
@@ -190,12 +385,12 @@ func (db *DB) Scrub(name string) error {
 	db.schemaLock.Lock()
 	defer db.schemaLock.Unlock()
 	if _, exists := db.cols[name]; !exists {
-		return fmt.Errorf("Collection %s does not exist", name)
+		return dberr.New(dberr.ErrorNoCol, name)
 	}
 	// Prepare a temporary collection in file system
 	tmpColName := fmt.Sprintf("scrub-%s-%d", name, time.Now().UnixNano())
-	tmpColDir := path.Join(db.path, tmpColName)
-	if err := os.MkdirAll(tmpColDir, 0700); err != nil {
+	tmpColDir, err := db.mkTmpColDir(name, tmpColName)
+	if err != nil {
 		return err
 	}
 	// Mirror indexes from original collection
@@ -209,7 +404,11 @@ func (db *DB) Scrub(name string) error {
 	if err != nil {
 		return err
 	}
-	db.cols[name].forEachDoc(func(id int, doc []byte) bool {
+	tmpCol.conf = db.cols[name].conf
+	if err := tmpCol.saveConfig(); err != nil {
+		return err
+	}
+	db.cols[name].scanOnce(func(id int, doc []byte) bool {
 		var docObj map[string]interface{}
 		if err := json.Unmarshal([]byte(doc), &docObj); err != nil {
 			// Skip corrupted document
@@ -223,32 +422,51 @@ func (db *DB) Scrub(name string) error {
 	if err := tmpCol.close(); err != nil {
 		return err
 	}
-	// Replace the original collection with the "temporary" one
+	// Replace the original collection with the "temporary" one, hooks and external cache remain registered
+	hooks, ext := db.cols[name].hooks, db.cols[name].ext
 	db.cols[name].close()
-	if err := os.RemoveAll(path.Join(db.path, name)); err != nil {
+	colDir, err := db.colDir(name)
+	if err != nil {
 		return err
-	}
-	if err := os.Rename(path.Join(db.path, tmpColName), path.Join(db.path, name)); err != nil {
+	} else if err := os.RemoveAll(colDir); err != nil {
+		return err
+	} else if err := os.Rename(tmpColDir, colDir); err != nil {
 		return err
 	}
+	// A collection placed elsewhere was scrubbed in place, the link to the temporary collection is no longer needed
+	os.Remove(path.Join(db.path, tmpColName))
 	if db.cols[name], err = OpenCol(db, name); err != nil {
 		return err
 	}
+	db.cols[name].hooks, db.cols[name].ext = hooks, ext
 	return nil
 }
 
-// Drop a collection and lose all of its documents and indexes.
+// Drop a collection and lose all of its documents and indexes, or drop a time series collection.
 func (db *DB) Drop(name string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
 	db.schemaLock.Lock()
 	defer db.schemaLock.Unlock()
-	if _, exists := db.cols[name]; !exists {
-		return fmt.Errorf("Collection %s does not exist", name)
+	return db.drop(name)
+}
+
+// Drop a collection and lose all of its documents and indexes, or drop a time series collection. Does not place schema
+// lock.
+func (db *DB) drop(name string) error {
+	if _, exists := db.series[name]; exists {
+		return db.dropTimeSeries(name)
+	} else if _, exists := db.cols[name]; !exists {
+		return dberr.New(dberr.ErrorNoCol, name)
 	} else if err := db.cols[name].close(); err != nil {
 		return err
-	} else if err := os.RemoveAll(path.Join(db.path, name)); err != nil {
+	} else if err := db.removeColDir(name); err != nil {
 		return err
 	}
+	db.cols[name].hooks.removeAll()
 	delete(db.cols, name)
+	db.forgetView(name)
 	return nil
 }
 
@@ -256,48 +474,18 @@ func (db *DB) Drop(name string) error {
 func (db *DB) Dump(dest string) error {
 	db.schemaLock.Lock()
 	defer db.schemaLock.Unlock()
-	cpFun := func(currPath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			relPath, err := filepath.Rel(db.path, currPath)
-			if err != nil {
-				return err
-			}
-			destDir := path.Join(dest, relPath)
-			if err := os.MkdirAll(destDir, 0700); err != nil {
-				return err
-			}
-			tdlog.Noticef("Dump: created directory %s", destDir)
-		} else {
-			src, err := os.Open(currPath)
-			if err != nil {
-				return err
-			}
-			relPath, err := filepath.Rel(db.path, currPath)
-			if err != nil {
-				return err
-			}
-			destPath := path.Join(dest, relPath)
-			if _, fileExists := os.Open(destPath); fileExists == nil {
-				return fmt.Errorf("Destination file %s already exists", destPath)
-			}
-			destFile, err := os.Create(destPath)
-			if err != nil {
-				return err
-			}
-			written, err := io.Copy(destFile, src)
-			if err != nil {
-				return err
-			}
-			_ = destFile.Close()
-			_ = src.Close()
-			tdlog.Noticef("Dump: copied file %s, size is %d", destPath, written)
-		}
-		return nil
+	// Files copied into memory rather than mapped (see gommap.Portable) hold the data written only once flushed
+	if err := db.flushAll(); err != nil {
+		return err
 	}
-	return filepath.Walk(db.path, cpFun)
+	cpFun := copyDirFun(db.path, dest)
+	return filepath.Walk(db.path, func(currPath string, info os.FileInfo, err error) error {
+		if currPath == path.Join(db.path, LOCK_FILE) {
+			// The copy is not in use by this process
+			return nil
+		}
+		return cpFun(currPath, info, err)
+	})
 }
 
 // ForceUse creates a collection if one does not yet exist. Returns collection handle. Panics on error.
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"reflect"
@@ -17,6 +19,8 @@ import (
 
 	"bou.ke/monkey"
 	"github.com/cankansin/tiedot/data"
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/gommap"
 	"github.com/pkg/errors"
 )
 
@@ -33,6 +37,19 @@ func touchFile(dir, filename string) {
 	}
 }
 
+// Close the database a test leaves open, so that the next test may open the directory again. The test may have left
+// the collections in pieces, the lock of the database directory is released nevertheless.
+func closeTestDB(db *DB) {
+	if db == nil {
+		return
+	}
+	defer db.lock.Release()
+	defer func() {
+		recover()
+	}()
+	db.Close()
+}
+
 func TestOpenEmptyDB(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
@@ -66,6 +83,12 @@ func TestOpenErrDB(t *testing.T) {
 	} else if err := db.Close(); err != nil {
 		t.Fatal(err)
 	}
+	// The failed attempt does not keep the database locked, and the number of partitions is now known
+	if db, err := OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
 }
 func TestOpenCloseDB(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
@@ -355,12 +378,15 @@ func TestOpenColErr(t *testing.T) {
 		t.Fatal(err)
 	} else if err := db.Create("b"); err != nil {
 		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
 	}
 	patch := monkey.Patch(OpenCol, func(db *DB, name string) (*Col, error) {
 		return nil, errors.New(errMessage)
 	})
 	defer patch.Unpatch()
-	if _, err := OpenDB(TEST_DATA_DIR); err.Error() != errMessage {
+	// The errors of both collections are returned together
+	if _, err := OpenDB(TEST_DATA_DIR); err.Error() != fmt.Sprintf("[%s %s]", errMessage, errMessage) {
 		t.Errorf("Expected error : '%s'", errMessage)
 	}
 }
@@ -368,6 +394,7 @@ func TestCreateErrorMkDir(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	errMessage := "Make dir is unpossible"
 	patch := monkey.Patch(os.MkdirAll, func(path string, perm os.FileMode) error {
 		return errors.New(errMessage)
@@ -390,6 +417,8 @@ func TestCreateErrOpenCol(t *testing.T) {
 		t.Fatal(err)
 	} else if err := db.Create("b"); err != nil {
 		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
 	}
 	patch := monkey.Patch(OpenCol, func(db *DB, name string) (*Col, error) {
 		return nil, errors.New(errMessage)
@@ -403,6 +432,7 @@ func TestRenameCloseError(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	col, _ := OpenCol(db, "test")
 	db.cols = map[string]*Col{"test": col}
 	var c *data.DataFile
@@ -416,6 +446,7 @@ func TestRenameOSErr(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	col, _ := OpenCol(db, "test")
 	db.cols = map[string]*Col{"test": col}
 	errMessage := "Error rename file"
@@ -433,6 +464,7 @@ func TestRenameOpenColError(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	col, _ := OpenCol(db, "test")
 	db.cols = map[string]*Col{"test": col}
 	patch := monkey.Patch(OpenCol, func(db *DB, name string) (*Col, error) {
@@ -447,6 +479,7 @@ func TestTruncateColNotExist(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	colName := "a"
 	if db.Truncate(colName).Error() != fmt.Sprintf("Collection %s does not exist", colName) {
 		t.Errorf("Expected error : collection not exist")
@@ -456,6 +489,7 @@ func TestTruncatePartitionClear(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, err := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	col, _ := OpenCol(db, "test")
 	db.cols = map[string]*Col{"test": col}
 	col.parts = []*data.Partition{&data.Partition{}}
@@ -486,6 +520,7 @@ func TestTruncateHashClearErr(t *testing.T) {
 	errMessage := "Error clear hash"
 	collectName := "test"
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	col, _ := OpenCol(db, collectName)
 	db.cols = map[string]*Col{collectName: col}
 	col.parts = []*data.Partition{&data.Partition{}}
@@ -512,6 +547,7 @@ func TestScrubCollectNotExist(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	colName := "a"
 	if db.Scrub(colName).Error() != fmt.Sprintf("Collection %s does not exist", colName) {
 		t.Errorf("Expected error : collection not exist")
@@ -524,6 +560,7 @@ func TestScrubMkDirAllWhichIndex(t *testing.T) {
 	errMessage := "Make dir is unpossible"
 
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	label := "label"
 	db.cols = map[string]*Col{collectName: &Col{name: collectName, db: db, indexPaths: map[string][]string{collectName: []string{label}}}}
 
@@ -545,6 +582,7 @@ func TestScrubMDirAll(t *testing.T) {
 	errMessage := "Make dir is unpossible"
 
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	db.cols = map[string]*Col{collectName: &Col{name: collectName, db: db, indexPaths: map[string][]string{collectName: []string{}}}}
 
 	patch := monkey.Patch(os.MkdirAll, func(path string, perm os.FileMode) error {
@@ -562,6 +600,7 @@ func TestScrubErrOpenCol(t *testing.T) {
 	collectName := "test"
 	errMessage := "Error open col"
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	col, _ := OpenCol(db, collectName)
 	db.cols = map[string]*Col{collectName: col}
 	patch := monkey.Patch(OpenCol, func(db *DB, name string) (*Col, error) {
@@ -579,6 +618,7 @@ func TestScrubCorrupted(t *testing.T) {
 	defer os.RemoveAll(TEST_DATA_DIR)
 	collectName := "test"
 	database, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(database)
 	col, _ := OpenCol(database, collectName)
 	database.cols = map[string]*Col{collectName: col}
 
@@ -596,6 +636,7 @@ func TestScrubInsertRecoveryErr(t *testing.T) {
 	collectName := "test"
 	errMessage := "Error InsertRecovery"
 	database, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(database)
 	col, _ := OpenCol(database, collectName)
 	database.cols = map[string]*Col{collectName: col}
 
@@ -605,7 +646,7 @@ func TestScrubInsertRecoveryErr(t *testing.T) {
 		str    bytes.Buffer
 	)
 	log.SetOutput(&str)
-	objPatch := monkey.PatchInstanceMethod(reflect.TypeOf(Obj), "ForEachDoc", func(_ *data.Partition, partNum, totalPart int, fun func(id int, doc []byte) bool) (moveOn bool) {
+	objPatch := monkey.PatchInstanceMethod(reflect.TypeOf(Obj), "ForEachDocView", func(_ *data.Partition, partNum, totalPart int, fun func(id int, doc []byte) bool) (moveOn bool) {
 		fun(0, []byte{})
 		return
 	})
@@ -631,6 +672,7 @@ func TestScrubErrRemoveAll(t *testing.T) {
 	collectName := "test"
 	errMessage := "Remove error"
 	database, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(database)
 	col, _ := OpenCol(database, collectName)
 	database.cols = map[string]*Col{collectName: col}
 
@@ -649,6 +691,7 @@ func TestScrubErrRename(t *testing.T) {
 	collectName := "test"
 	errMessage := "Rename error"
 	database, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(database)
 	col, _ := OpenCol(database, collectName)
 	database.cols = map[string]*Col{collectName: col}
 
@@ -667,6 +710,7 @@ func TestScrubTmpColClose(t *testing.T) {
 	collectName := "test"
 	errMessage := "tmp close error"
 	database, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(database)
 	col, _ := OpenCol(database, collectName)
 	database.cols = map[string]*Col{collectName: col}
 
@@ -685,6 +729,7 @@ func TestDropColNotExist(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	colName := "a"
 	if db.Drop(colName).Error() != fmt.Sprintf("Collection %s does not exist", colName) {
 		t.Errorf("Expected error : collection not exist")
@@ -696,6 +741,7 @@ func TestDropErrRemoveAll(t *testing.T) {
 	collectName := "test"
 	errMessage := "Remove error"
 	database, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(database)
 	col, _ := OpenCol(database, collectName)
 	database.cols = map[string]*Col{collectName: col}
 
@@ -714,6 +760,7 @@ func TestDropCloseColErr(t *testing.T) {
 	collectName := "test"
 	errMessage := "error"
 	database, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(database)
 	col, _ := OpenCol(database, collectName)
 	database.cols = map[string]*Col{collectName: col}
 	var (
@@ -753,6 +800,7 @@ func TestDumpRelErr(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	database, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(database)
 	database.Create("test")
 
 	errMessage := "error rel return"
@@ -769,6 +817,7 @@ func TestDumpMkDirErr(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	database, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(database)
 	database.Create("test")
 
 	errMessage := "error make dir"
@@ -781,3 +830,271 @@ func TestDumpMkDirErr(t *testing.T) {
 		t.Error("Expected error make dir error")
 	}
 }
+func TestOpenDBInUseByAnotherProcess(t *testing.T) {
+	if os.Getenv("TIEDOT_TEST_LOCK_HOLDER") != "" {
+		// Hold the database open until the parent test closes stdin
+		db, err := OpenDB(TEST_DATA_DIR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Println("opened")
+		ioutil.ReadAll(os.Stdin)
+		db.Close()
+		return
+	}
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	holder := exec.Command(os.Args[0], "-test.run=^TestOpenDBInUseByAnotherProcess$")
+	holder.Env = append(os.Environ(), "TIEDOT_TEST_LOCK_HOLDER=1")
+	stdin, err := holder.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := holder.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = holder.Start(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err = io.ReadFull(stdout, buf); err != nil || string(buf) != "opened" {
+		t.Fatal(string(buf), err)
+	}
+	if _, err = OpenDB(TEST_DATA_DIR); dberr.Type(err) != dberr.ErrorDirLocked {
+		t.Fatal(err)
+	} else if !strings.Contains(err.Error(), strconv.Itoa(holder.Process.Pid)) {
+		t.Fatal(err)
+	}
+	stdin.Close()
+	if err = holder.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// The database is free once the holder is gone, yet this process may not open it twice
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = OpenDB(TEST_DATA_DIR); dberr.Type(err) != dberr.ErrorDirLocked {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+func TestReloadConfig(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	colFileGrowth := db.Config.ColFileGrowth
+	content, err := ioutil.ReadFile(TEST_DATA_DIR + "/data-config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conf map[string]interface{}
+	if err = json.Unmarshal(content, &conf); err != nil {
+		t.Fatal(err)
+	}
+	conf["HTMapAdvice"] = "random"
+	conf["MaxPrealloc"] = 65536
+	conf["ColFileGrowth"] = 1048576
+	conf["MaxDocDepth"] = 5
+	if content, err = json.Marshal(conf); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	// Memory usage settings apply to open files right away, the other settings wait for next start
+	if db.Config.HTMapAdvice != "random" || db.Config.MaxPrealloc != 65536 || db.Config.MaxDocDepth != 5 || db.Config.ColFileGrowth != colFileGrowth {
+		t.Fatal(db.Config)
+	}
+	for i := 0; i < db.numParts; i++ {
+		if ht := col.hts[i]["a"]; ht.Growth != 65536 || ht.Advice != gommap.ADVICE_RANDOM {
+			t.Fatal(ht.Growth, ht.Advice)
+		}
+	}
+	if _, err = col.Insert(map[string]interface{}{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	// A broken configuration file is not applied
+	if err = ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = db.ReloadConfig(); err == nil {
+		t.Fatal("Did not error")
+	} else if db.Config.HTMapAdvice != "random" {
+		t.Fatal(db.Config)
+	}
+	// Collection settings are reloaded as well
+	if _, err = col.Insert(map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", content, 0600); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(TEST_DATA_DIR+"/col/"+COL_CONFIG_FILE, []byte(`{"MaxWriteRate": 100, "MaxDocs": 1}`), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = db.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	} else if conf := col.Config(); conf.MaxWriteRate != 100 || conf.MaxDocs != 1 {
+		t.Fatal(conf)
+	} else if n, _ := countDocs(col); n != 1 {
+		t.Fatal(n)
+	}
+	// Nothing is applied if the settings of a collection are invalid
+	if err = db.Create("other"); err != nil {
+		t.Fatal(err)
+	}
+	conf["MaxPrealloc"] = 4096
+	if content, err = json.Marshal(conf); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", content, 0600); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(TEST_DATA_DIR+"/col/"+COL_CONFIG_FILE, []byte(`{"MaxWriteRate": 200}`), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(TEST_DATA_DIR+"/other/"+COL_CONFIG_FILE, []byte(`{"MaxWrites": -1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.ReloadConfig(); err == nil {
+		t.Fatal("Did not error")
+	} else if conf := col.Config(); conf.MaxWriteRate != 100 || db.Config.MaxPrealloc != 65536 {
+		t.Fatal(conf, db.Config.MaxPrealloc)
+	}
+	// Nor if a reloaded setting of the database is invalid
+	conf["MaxDocSize"] = -1
+	if content, err = json.Marshal(conf); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", content, 0600); err != nil {
+		t.Fatal(err)
+	} else if err = os.Remove(TEST_DATA_DIR + "/other/" + COL_CONFIG_FILE); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.ReloadConfig(); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if conf := col.Config(); conf.MaxWriteRate != 100 || db.Config.MaxPrealloc != 65536 {
+		t.Fatal(conf, db.Config.MaxPrealloc)
+	}
+}
+func TestOpenDBParallel(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(TEST_DATA_DIR+"/data-config.json", []byte(`{"OpenWorkers": 2}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	} else if cap(db.openSlots) != 2 {
+		t.Fatal(cap(db.openSlots))
+	}
+	ids := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("col%d", i)
+		if err = db.Create(name); err != nil {
+			t.Fatal(err)
+		} else if err = db.Use(name).Index([]string{"a"}); err != nil {
+			t.Fatal(err)
+		} else if ids[name], err = db.Use(name).Insert(map[string]interface{}{"a": i, STR_ID_ATTR: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Every collection opens along with its partitions, string IDs and indexes
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	for name, id := range ids {
+		col := db.Use(name)
+		if doc, err := col.Read(id); err != nil || doc["a"] != float64(name[3]-'0') {
+			t.Fatal(doc, err)
+		} else if strID, found := col.strIDLookup(name); !found || strID != id {
+			t.Fatal(strID, found)
+		} else if col.hts[0]["a"] == nil || col.hts[1]["a"] == nil {
+			t.Fatal(col.hts)
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The failures of all collections are returned, and the database is left closed
+	for _, name := range []string{"col2", "col5"} {
+		if err = os.Remove(path.Join(TEST_DATA_DIR, name, DOC_DATA_FILE+"1")); err != nil {
+			t.Fatal(err)
+		} else if err = os.Mkdir(path.Join(TEST_DATA_DIR, name, DOC_DATA_FILE+"1"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = OpenDB(TEST_DATA_DIR); err == nil || !strings.Contains(err.Error(), "col2") || !strings.Contains(err.Error(), "col5") {
+		t.Fatal(err)
+	}
+	if err = os.RemoveAll(path.Join(TEST_DATA_DIR, "col2")); err != nil {
+		t.Fatal(err)
+	} else if err = os.RemoveAll(path.Join(TEST_DATA_DIR, "col5")); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	} else if len(db.AllCols()) != 6 {
+		t.Fatal(db.AllCols())
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenDBProfile(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if _, err := OpenDBProfile(TEST_DATA_DIR, "tiny"); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+	os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDBProfile(TEST_DATA_DIR, data.PROFILE_SMALL)
+	if err != nil {
+		t.Fatal(err)
+	} else if db.numParts != 1 || db.Config.HashBits != 8 {
+		t.Fatal(db.numParts, db.Config)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if doc, err := col.Read(id); err != nil || doc["a"] != 1.0 {
+		t.Fatal(doc, err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// An existing database keeps its configuration and partitions
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.numParts != 1 || db.Config.HashBits != 8 || db.Use("col") == nil {
+		t.Fatal(db.numParts, db.Config)
+	}
+}
@@ -3,10 +3,11 @@
 package db
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"math/rand"
 
+	"github.com/cankansin/tiedot/dberr"
 	"github.com/cankansin/tiedot/tdlog"
 )
 
@@ -50,12 +51,18 @@ func StrHash(str string) int {
 	return hash
 }
 
-// Put a document on all user-created indexes.
+// Put a document on all user-created indexes, the entries of eventual indexes are queued.
 func (col *Col) indexDoc(id int, doc map[string]interface{}) {
+	col.recordIndexChange(id, doc, false)
+	var queued []eventualChange
 	for idxName, idxPath := range col.indexPaths {
-		for _, idxVal := range GetIn(doc, idxPath) {
+		for _, idxVal := range indexValues(doc, idxPath) {
 			if idxVal != nil {
-				hashKey := StrHash(fmt.Sprint(idxVal))
+				hashKey := StrHash(valueText(idxVal))
+				if col.eventual.maintains(idxName) {
+					queued = append(queued, eventualChange{idxName: idxName, key: hashKey, id: id})
+					continue
+				}
 				partNum := hashKey % col.db.numParts
 				ht := col.hts[partNum][idxName]
 				ht.Lock.Lock()
@@ -64,14 +71,21 @@ func (col *Col) indexDoc(id int, doc map[string]interface{}) {
 			}
 		}
 	}
+	col.queueIndexChanges(queued)
 }
 
-// Remove a document from all user-created indexes.
+// Remove a document from all user-created indexes, the removal of entries of eventual indexes is queued.
 func (col *Col) unindexDoc(id int, doc map[string]interface{}) {
+	col.recordIndexChange(id, doc, true)
+	var queued []eventualChange
 	for idxName, idxPath := range col.indexPaths {
-		for _, idxVal := range GetIn(doc, idxPath) {
+		for _, idxVal := range indexValues(doc, idxPath) {
 			if idxVal != nil {
-				hashKey := StrHash(fmt.Sprint(idxVal))
+				hashKey := StrHash(valueText(idxVal))
+				if col.eventual.maintains(idxName) {
+					queued = append(queued, eventualChange{idxName: idxName, key: hashKey, id: id, remove: true})
+					continue
+				}
 				partNum := hashKey % col.db.numParts
 				ht := col.hts[partNum][idxName]
 				ht.Lock.Lock()
@@ -80,11 +94,14 @@ func (col *Col) unindexDoc(id int, doc map[string]interface{}) {
 			}
 		}
 	}
+	col.queueIndexChanges(queued)
 }
 
 // Insert a document with the specified ID into the collection (incl. index). Does not place partition/schema lock.
 func (col *Col) InsertRecovery(id int, doc map[string]interface{}) (err error) {
-	docJS, err := json.Marshal(doc)
+	buf := getDocBuf()
+	defer buf.free()
+	docJS, err := buf.marshal(doc)
 	if err != nil {
 		return
 	}
@@ -94,30 +111,65 @@ func (col *Col) InsertRecovery(id int, doc map[string]interface{}) (err error) {
 	if _, err = part.Insert(id, []byte(docJS)); err != nil {
 		return
 	}
+	col.putStrID(id, doc)
 	// Index the document
 	col.indexDoc(id, doc)
 	return
 }
 
-// Insert a document into the collection.
+// Insert a document into the collection. If the document carries a string ID in attribute "_id", the string ID must not be in use.
 func (col *Col) Insert(doc map[string]interface{}) (id int, err error) {
-	docJS, err := json.Marshal(doc)
+	if strID, hasStrID := doc[STR_ID_ATTR].(string); hasStrID {
+		return col.InsertStrID(strID, doc)
+	}
+	return col.insert(context.Background(), doc, func() {})
+}
+
+// Insert a document into the collection without checking its string ID. The string ID lock held by the caller is
+// unlocked by calling unlockStrID before hooks are fired. Waiting for the write limits and the partition lock is given
+// up once the context is done.
+func (col *Col) insert(ctx context.Context, doc map[string]interface{}, unlockStrID func()) (id int, err error) {
+	return col.insertWithID(ctx, rand.Int(), doc, unlockStrID)
+}
+
+// Insert a document under the ID, which must not be in use, like insert does.
+func (col *Col) insertWithID(ctx context.Context, id int, doc map[string]interface{}, unlockStrID func()) (int, error) {
+	release, err := col.throttleWriteCtx(ctx)
 	if err != nil {
-		return
+		return 0, err
 	}
-	id = rand.Int()
-	partNum := id % col.db.numParts
+	defer release()
 	col.db.schemaLock.RLock()
+	doc = col.stampInsert(doc)
+	buf := getDocBuf()
+	defer buf.free()
+	docJS, err := buf.marshal(doc)
+	if err == nil {
+		err = col.db.checkDocLimits(docJS)
+	}
+	if err == nil {
+		err = col.checkRefs(doc)
+	}
+	if err != nil {
+		col.db.schemaLock.RUnlock()
+		return 0, err
+	}
+	partNum := id % col.db.numParts
 	part := col.parts[partNum]
 
 	// Put document data into collection
-	part.DataLock.Lock()
+	if !part.LockData(ctx.Done()) {
+		col.db.schemaLock.RUnlock()
+		return 0, col.lockGivenUp(ctx, id)
+	}
 	_, err = part.Insert(id, []byte(docJS))
 	part.DataLock.Unlock()
 	if err != nil {
 		col.db.schemaLock.RUnlock()
-		return
+		return 0, err
 	}
+	col.cappedPut(id, len(docJS))
+	col.putStrID(id, doc)
 
 	part.LockUpdate(id)
 	// Index the document
@@ -125,26 +177,61 @@ func (col *Col) Insert(doc map[string]interface{}) (id int, err error) {
 	part.UnlockUpdate(id)
 
 	col.db.schemaLock.RUnlock()
-	return
+	release()
+	unlockStrID()
+	col.fireHooks(hookInsert, id, doc, nil)
+	col.evictCapped()
+	return id, col.db.commitWrite()
 }
 
-func (col *Col) read(id int, placeSchemaLock bool) (doc map[string]interface{}, err error) {
+// Read a document, waiting for the partition lock until the context is done. A document not in the collection is read
+// from its archive collection if queries include the archive.
+func (col *Col) read(ctx context.Context, id int, placeSchemaLock bool) (doc map[string]interface{}, err error) {
 	if placeSchemaLock {
 		col.db.schemaLock.RLock()
 	}
 	part := col.parts[id%col.db.numParts]
 
-	part.DataLock.RLock()
+	if !part.RLockData(ctx.Done()) {
+		if placeSchemaLock {
+			col.db.schemaLock.RUnlock()
+		}
+		return nil, col.lockGivenUp(ctx, id)
+	}
+	doc, gen, cached := col.cache.get(id)
+	if cached {
+		part.DataLock.RUnlock()
+		if placeSchemaLock {
+			col.db.schemaLock.RUnlock()
+		}
+		return
+	}
+	if doc = col.ext.get(id, col.unmarshalDoc); doc != nil {
+		part.DataLock.RUnlock()
+		col.cache.put(id, doc, gen)
+		if placeSchemaLock {
+			col.db.schemaLock.RUnlock()
+		}
+		return
+	}
 	docB, err := part.Read(id)
+	if err == nil {
+		col.ext.put(id, docB)
+	}
 	part.DataLock.RUnlock()
 	if err != nil {
+		if dberr.Type(err) == dberr.ErrorNoDoc {
+			doc, err = col.readArchived(ctx, id, err)
+		}
 		if placeSchemaLock {
 			col.db.schemaLock.RUnlock()
 		}
 		return
 	}
 
-	err = json.Unmarshal(docB, &doc)
+	if err = col.unmarshalDoc(docB, &doc); err == nil {
+		col.cache.put(id, doc, gen)
+	}
 	if placeSchemaLock {
 		col.db.schemaLock.RUnlock()
 	}
@@ -153,39 +240,227 @@ func (col *Col) read(id int, placeSchemaLock bool) (doc map[string]interface{},
 
 // Find and retrieve a document by ID.
 func (col *Col) Read(id int) (doc map[string]interface{}, err error) {
-	return col.read(id, true)
+	return col.read(context.Background(), id, true)
+}
+
+// Run the function on the serialised document without copying it out of the data file. The document is only valid
+// during the call, which must neither retain nor modify it, nor write to the collection.
+func (col *Col) ReadView(id int, fun func(doc []byte)) error {
+	if id < 0 {
+		return dberr.New(dberr.ErrorNoDoc, id)
+	}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	part := col.parts[id%col.db.numParts]
+	if !part.RLockData(nil) {
+		return col.lockTimedOut(id)
+	}
+	defer part.DataLock.RUnlock()
+	return part.ReadView(id, fun)
+}
+
+// Find and retrieve documents by ID. IDs are grouped by partition, so that each partition is locked once regardless of
+// the number of IDs in it. Documents that do not exist or cannot be deserialised are absent from the result.
+func (col *Col) ReadBatch(ids []int) (docs map[int]map[string]interface{}) {
+	col.db.schemaLock.RLock()
+	docs = col.readDecoded(ids)
+	col.db.schemaLock.RUnlock()
+	return
+}
+
+// Find and retrieve documents by string ID, the result is keyed by string ID. The string IDs are resolved to the
+// documents that may carry them first, and the documents are then read like ReadBatch does. Documents that do not
+// exist are absent from the result.
+func (col *Col) ReadBatchStrID(strIDs []string) (docs map[string]map[string]interface{}) {
+	// String IDs each candidate document may carry, hash collisions are filtered out after reading
+	candidates := make(map[int][]string, len(strIDs))
+	ids := make([]int, 0, len(strIDs))
+	col.db.schemaLock.RLock()
+	for _, strID := range strIDs {
+		for _, id := range col.strIDCandidates(strID) {
+			if _, seen := candidates[id]; !seen {
+				ids = append(ids, id)
+			}
+			candidates[id] = append(candidates[id], strID)
+		}
+	}
+	decoded := col.readDecoded(ids)
+	col.db.schemaLock.RUnlock()
+	docs = make(map[string]map[string]interface{}, len(strIDs))
+	for id, doc := range decoded {
+		for _, strID := range candidates[id] {
+			if doc[STR_ID_ATTR] == strID {
+				docs[strID] = doc
+			}
+		}
+	}
+	return
+}
+
+// Read the serialised documents, locking each partition once. Does not place schema lock.
+func (col *Col) readBatch(ids []int) (docsB map[int][]byte) {
+	partIDs := make([][]int, col.db.numParts)
+	for _, id := range ids {
+		if id >= 0 {
+			partIDs[id%col.db.numParts] = append(partIDs[id%col.db.numParts], id)
+		}
+	}
+	docsB = make(map[int][]byte, len(ids))
+	for partNum, idsInPart := range partIDs {
+		if len(idsInPart) == 0 {
+			continue
+		}
+		part := col.parts[partNum]
+		part.DataLock.RLock()
+		for _, id := range idsInPart {
+			if docB, err := part.Read(id); err == nil {
+				docsB[id] = docB
+			}
+		}
+		part.DataLock.RUnlock()
+	}
+	return
+}
+
+// Read and deserialise the documents, locking each partition once. Cached documents are not read again. Documents that
+// do not exist or cannot be deserialised are left out. Does not place schema lock.
+func (col *Col) readDecoded(ids []int) (docs map[int]map[string]interface{}) {
+	partIDs := make([][]int, col.db.numParts)
+	for _, id := range ids {
+		if id >= 0 {
+			partIDs[id%col.db.numParts] = append(partIDs[id%col.db.numParts], id)
+		}
+	}
+	docs = make(map[int]map[string]interface{}, len(ids))
+	docsB := make(map[int][]byte, len(ids))
+	gens := make(map[int]uint64, len(ids))
+	for partNum, idsInPart := range partIDs {
+		if len(idsInPart) == 0 {
+			continue
+		}
+		part := col.parts[partNum]
+		part.DataLock.RLock()
+		for _, id := range idsInPart {
+			if doc, gen, cached := col.cache.get(id); cached {
+				docs[id] = doc
+			} else if doc = col.ext.get(id, col.unmarshalDoc); doc != nil {
+				docs[id] = doc
+				col.cache.put(id, doc, gen)
+			} else if docB, err := part.Read(id); err == nil {
+				docsB[id], gens[id] = docB, gen
+				col.ext.put(id, docB)
+			}
+		}
+		part.DataLock.RUnlock()
+	}
+	for id, docB := range docsB {
+		var doc map[string]interface{}
+		if err := col.unmarshalDoc(docB, &doc); err == nil {
+			docs[id] = doc
+			col.cache.put(id, doc, gens[id])
+		}
+	}
+	return
 }
 
 // Update a document.
 func (col *Col) Update(id int, doc map[string]interface{}) error {
+	return col.update(context.Background(), id, doc)
+}
+
+// Update a document, waiting for the write limits and the partition lock until the context is done.
+func (col *Col) update(ctx context.Context, id int, doc map[string]interface{}) error {
+	_, err := col.updateIf(ctx, id, doc, nil)
+	return err
+}
+
+// Update a document like update, provided that the match function (optional) returns nil for the document as it is
+// under the partition lock; otherwise the document is left alone and the error is the one returned by the match
+// function. Return the updated document as it is stored.
+func (col *Col) updateIf(ctx context.Context, id int, doc map[string]interface{}, match func(original map[string]interface{}) error) (map[string]interface{}, error) {
 	if doc == nil {
-		return fmt.Errorf("Updating %d: input doc may not be nil", id)
+		return nil, fmt.Errorf("Updating %d: input doc may not be nil", id)
 	}
-	docJS, err := json.Marshal(doc)
+	// The string ID may not be in use by another document
+	unlockStrID := func() {}
+	strID, hasStrID := doc[STR_ID_ATTR].(string)
+	if hasStrID {
+		unlockStrID = col.lockStrID(strID)
+		defer unlockStrID()
+	}
+	release, err := col.throttleWriteCtx(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer release()
 	col.db.schemaLock.RLock()
+	if other, found := col.strIDLookup(strID); hasStrID && found && other != id {
+		col.db.schemaLock.RUnlock()
+		return nil, dberr.New(dberr.ErrorDupStrID, strID)
+	} else if err := col.checkRefs(doc); err != nil {
+		col.db.schemaLock.RUnlock()
+		return nil, err
+	}
+	// With timestamps enabled or capped, the document is serialised after its original creation time/sequence is known
+	var docJS []byte
+	buf := getDocBuf()
+	defer buf.free()
+	if !col.stampsUpdate() {
+		if docJS, err = buf.marshal(doc); err != nil {
+			col.db.schemaLock.RUnlock()
+			return nil, err
+		}
+	}
 	part := col.parts[id%col.db.numParts]
 
 	// Place lock, read back original document and update
-	part.DataLock.Lock()
+	if !part.LockData(ctx.Done()) {
+		col.db.schemaLock.RUnlock()
+		return nil, col.lockGivenUp(ctx, id)
+	}
 	originalB, err := part.Read(id)
 	if err != nil {
 		part.DataLock.Unlock()
 		col.db.schemaLock.RUnlock()
-		return err
+		return nil, err
+	}
+	var original map[string]interface{}
+	if match != nil {
+		col.unmarshalDoc(originalB, &original)
+		if err = match(original); err != nil {
+			part.DataLock.Unlock()
+			col.db.schemaLock.RUnlock()
+			return nil, err
+		}
+	}
+	if col.stampsUpdate() {
+		if original == nil {
+			col.unmarshalDoc(originalB, &original)
+		}
+		doc = col.stampUpdate(doc, original)
+		if docJS, err = buf.marshal(doc); err != nil {
+			part.DataLock.Unlock()
+			col.db.schemaLock.RUnlock()
+			return nil, err
+		}
+	}
+	if err = col.db.checkDocLimits(docJS); err == nil {
+		err = part.Update(id, []byte(docJS))
+		col.cache.invalidate(id)
+		col.ext.update(id, docJS, err)
 	}
-	err = part.Update(id, []byte(docJS))
 	part.DataLock.Unlock()
 	if err != nil {
 		col.db.schemaLock.RUnlock()
-		return err
+		return nil, err
 	}
+	col.cappedPut(id, len(docJS))
 
 	// Done with the collection data, next is to maintain indexed values
-	var original map[string]interface{}
-	json.Unmarshal(originalB, &original)
+	if original == nil {
+		col.unmarshalDoc(originalB, &original)
+	}
+	col.moveStrID(id, original, doc)
 	part.LockUpdate(id)
 	if original != nil {
 		col.unindexDoc(id, original)
@@ -197,6 +472,19 @@ func (col *Col) Update(id int, doc map[string]interface{}) error {
 	part.UnlockUpdate(id)
 
 	col.db.schemaLock.RUnlock()
+	release()
+	unlockStrID()
+	col.fireHooks(hookUpdate, id, doc, original)
+	return doc, col.db.commitWrite()
+}
+
+// Return an error if an update function changed the string ID. String ID may only be changed by Update, which guards
+// against concurrent assignment of the same string ID.
+func checkStrIDKept(id int, original, doc map[string]interface{}) error {
+	origStrID, _ := original[STR_ID_ATTR].(string)
+	if strID, hasStrID := doc[STR_ID_ATTR].(string); hasStrID && strID != origStrID {
+		return fmt.Errorf("Updating %d: update function may not change string ID attribute %s, use Update instead", id, STR_ID_ATTR)
+	}
 	return nil
 }
 
@@ -204,39 +492,84 @@ func (col *Col) Update(id int, doc map[string]interface{}) error {
 // update func will get current document bytes and should return bytes of updated document;
 // updated document should be valid JSON;
 // provided buffer could be modified (reused for returned value);
-// non-nil error will be propagated back and returned from UpdateBytesFunc.
+// non-nil error will be propagated back and returned from UpdateBytesFunc;
+// update func may be called again if the collection has relations and the document changes while they are verified.
 func (col *Col) UpdateBytesFunc(id int, update func(origDoc []byte) (newDoc []byte, err error)) error {
+	release, err := col.throttleWrite()
+	if err != nil {
+		return err
+	}
+	defer release()
 	col.db.schemaLock.RLock()
 	part := col.parts[id%col.db.numParts]
 
 	// Place lock, read back original document and update
-	part.DataLock.Lock()
-	originalB, err := part.Read(id)
-	if err != nil {
-		part.DataLock.Unlock()
-		col.db.schemaLock.RUnlock()
-		return err
-	}
-	var original map[string]interface{}
-	json.Unmarshal(originalB, &original) // Unmarshal originalB before passing it to update
-	docB, err := update(originalB)
-	if err != nil {
-		part.DataLock.Unlock()
+	if !part.LockData(nil) {
 		col.db.schemaLock.RUnlock()
-		return err
-	}
-	var doc map[string]interface{} // check if docB are valid JSON before Update
-	if err = json.Unmarshal(docB, &doc); err != nil {
-		part.DataLock.Unlock()
-		col.db.schemaLock.RUnlock()
-		return err
+		return col.lockTimedOut(id)
+	}
+	var original, doc map[string]interface{}
+	var docB []byte
+	for {
+		var originalB []byte
+		if originalB, err = part.Read(id); err != nil {
+			part.DataLock.Unlock()
+			col.db.schemaLock.RUnlock()
+			return err
+		}
+		original = nil
+		col.unmarshalDoc(originalB, &original) // Unmarshal originalB before passing it to update
+		// update may modify the buffer, the original is compared with by checkRefsUnlocked
+		compareB := originalB
+		if len(col.conf.Relations) > 0 {
+			compareB = append([]byte(nil), originalB...)
+		}
+		docB, err = update(originalB)
+		if err == nil {
+			err = col.db.checkDocLimits(docB)
+		}
+		if err != nil {
+			part.DataLock.Unlock()
+			col.db.schemaLock.RUnlock()
+			return err
+		}
+		doc = nil // check if docB are valid JSON before Update
+		if err = col.unmarshalDoc(docB, &doc); err == nil {
+			err = checkStrIDKept(id, original, doc)
+		}
+		if err == nil {
+			var changed bool
+			if changed, err = col.checkRefsUnlocked(part, id, compareB, doc); changed {
+				continue
+			}
+		}
+		if err != nil {
+			part.DataLock.Unlock()
+			col.db.schemaLock.RUnlock()
+			return err
+		}
+		break
+	}
+	if col.stampsUpdate() {
+		buf := getDocBuf()
+		defer buf.free()
+		doc = col.stampUpdate(doc, original)
+		if docB, err = buf.marshal(doc); err != nil {
+			part.DataLock.Unlock()
+			col.db.schemaLock.RUnlock()
+			return err
+		}
 	}
 	err = part.Update(id, docB)
+	col.cache.invalidate(id)
+	col.ext.update(id, docB, err)
 	part.DataLock.Unlock()
 	if err != nil {
 		col.db.schemaLock.RUnlock()
 		return err
 	}
+	col.cappedPut(id, len(docB))
+	col.moveStrID(id, original, doc)
 
 	// Done with the collection data, next is to maintain indexed values
 	part.LockUpdate(id)
@@ -250,50 +583,81 @@ func (col *Col) UpdateBytesFunc(id int, update func(origDoc []byte) (newDoc []by
 	part.UnlockUpdate(id)
 
 	col.db.schemaLock.RUnlock()
-	return nil
+	release()
+	col.fireHooks(hookUpdate, id, doc, original)
+	return col.db.commitWrite()
 }
 
 // UpdateFunc will update a document.
 // update func will get current document and should return updated document;
 // provided document should NOT be modified;
-// non-nil error will be propagated back and returned from UpdateFunc.
+// non-nil error will be propagated back and returned from UpdateFunc;
+// update func may be called again if the collection has relations and the document changes while they are verified.
 func (col *Col) UpdateFunc(id int, update func(origDoc map[string]interface{}) (newDoc map[string]interface{}, err error)) error {
+	release, err := col.throttleWrite()
+	if err != nil {
+		return err
+	}
+	defer release()
 	col.db.schemaLock.RLock()
 	part := col.parts[id%col.db.numParts]
 
 	// Place lock, read back original document and update
-	part.DataLock.Lock()
-	originalB, err := part.Read(id)
-	if err != nil {
-		part.DataLock.Unlock()
-		col.db.schemaLock.RUnlock()
-		return err
-	}
-	var original map[string]interface{}
-	err = json.Unmarshal(originalB, &original)
-	if err != nil {
-		part.DataLock.Unlock()
+	if !part.LockData(nil) {
 		col.db.schemaLock.RUnlock()
-		return err
-	}
-	doc, err := update(original)
-	if err != nil {
-		part.DataLock.Unlock()
-		col.db.schemaLock.RUnlock()
-		return err
-	}
-	docJS, err := json.Marshal(doc)
-	if err != nil {
-		part.DataLock.Unlock()
-		col.db.schemaLock.RUnlock()
-		return err
+		return col.lockTimedOut(id)
+	}
+	var original, doc map[string]interface{}
+	var docJS []byte
+	buf := getDocBuf()
+	defer buf.free()
+	for {
+		var originalB []byte
+		if originalB, err = part.Read(id); err == nil {
+			original = nil
+			err = col.unmarshalDoc(originalB, &original)
+		}
+		if err != nil {
+			part.DataLock.Unlock()
+			col.db.schemaLock.RUnlock()
+			return err
+		}
+		if doc, err = update(original); err != nil {
+			part.DataLock.Unlock()
+			col.db.schemaLock.RUnlock()
+			return err
+		}
+		doc = col.stampUpdate(doc, original)
+		docJS, err = buf.marshal(doc)
+		if err == nil {
+			err = col.db.checkDocLimits(docJS)
+		}
+		if err == nil {
+			err = checkStrIDKept(id, original, doc)
+		}
+		if err == nil {
+			var changed bool
+			if changed, err = col.checkRefsUnlocked(part, id, originalB, doc); changed {
+				continue
+			}
+		}
+		if err != nil {
+			part.DataLock.Unlock()
+			col.db.schemaLock.RUnlock()
+			return err
+		}
+		break
 	}
 	err = part.Update(id, []byte(docJS))
+	col.cache.invalidate(id)
+	col.ext.update(id, docJS, err)
 	part.DataLock.Unlock()
 	if err != nil {
 		col.db.schemaLock.RUnlock()
 		return err
 	}
+	col.cappedPut(id, len(docJS))
+	col.moveStrID(id, original, doc)
 
 	// Done with the collection data, next is to maintain indexed values
 	part.LockUpdate(id)
@@ -303,33 +667,73 @@ func (col *Col) UpdateFunc(id int, update func(origDoc map[string]interface{}) (
 	part.UnlockUpdate(id)
 
 	col.db.schemaLock.RUnlock()
-	return nil
+	release()
+	col.fireHooks(hookUpdate, id, doc, original)
+	return col.db.commitWrite()
 }
 
 // Delete a document.
 func (col *Col) Delete(id int) error {
+	release, err := col.throttleWrite()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return col.delete(id, release, true)
+}
+
+// Delete a document, the write is marked completed by calling release before hooks are fired. Unless the referring
+// documents were already verified by the caller, the deletion is refused or cascaded according to relations.
+func (col *Col) delete(id int, release func(), checkReferrers bool) error {
+	_, err := col.deleteIf(context.Background(), id, release, checkReferrers, nil)
+	return err
+}
+
+// Delete a document like delete, provided that the match function (optional) returns true for the document as it is
+// under the partition lock; otherwise the document is left alone and the error is ErrorNoDoc. Waiting for the partition
+// lock is given up once the context is done. Return the deleted document.
+func (col *Col) deleteIf(ctx context.Context, id int, release func(), checkReferrers bool, match func(original map[string]interface{}) bool) (original map[string]interface{}, err error) {
 	col.db.schemaLock.RLock()
+	var cascade map[*Col][]int
+	if checkReferrers {
+		if cascade, err = col.checkReferrers(id); err != nil {
+			col.db.schemaLock.RUnlock()
+			return nil, err
+		}
+	}
 	part := col.parts[id%col.db.numParts]
 
 	// Place lock, read back original document and delete document
-	part.DataLock.Lock()
+	if !part.LockData(ctx.Done()) {
+		col.db.schemaLock.RUnlock()
+		return nil, col.lockGivenUp(ctx, id)
+	}
 	originalB, err := part.Read(id)
 	if err != nil {
 		part.DataLock.Unlock()
 		col.db.schemaLock.RUnlock()
-		return err
+		return nil, err
 	}
+	err = col.unmarshalDoc(originalB, &original)
+	if match != nil && (err != nil || !match(original)) {
+		part.DataLock.Unlock()
+		col.db.schemaLock.RUnlock()
+		return nil, dberr.New(dberr.ErrorNoDoc, id)
+	}
+	unmarshalErr := err
 	err = part.Delete(id)
+	col.cache.invalidate(id)
+	col.ext.update(id, nil, err)
 	part.DataLock.Unlock()
 	if err != nil {
 		col.db.schemaLock.RUnlock()
-		return err
+		return nil, err
 	}
+	col.cappedRemove(id)
 
 	// Done with the collection data, next is to remove indexed values
-	var original map[string]interface{}
-	err = json.Unmarshal(originalB, &original)
-	if err == nil {
+	if unmarshalErr == nil {
+		col.removeStrID(id, original)
 		part.LockUpdate(id)
 		col.unindexDoc(id, original)
 		part.UnlockUpdate(id)
@@ -338,5 +742,25 @@ func (col *Col) Delete(id int) error {
 	}
 
 	col.db.schemaLock.RUnlock()
-	return nil
+	release()
+	col.fireHooks(hookDelete, id, nil, original)
+	if err = cascadeDelete(cascade); err != nil {
+		return original, err
+	}
+	return original, col.db.commitWrite()
+}
+
+// Return the error of giving up on a lock of the document's partition or of the document itself, see LockTimeout of
+// data.Config.
+func (col *Col) lockTimedOut(id int) error {
+	return dberr.New(dberr.ErrorLockTimeout, id, col.name)
+}
+
+// Return the error of giving up on a lock of the document's partition: the context's error if the context is done,
+// otherwise ErrorLockTimeout.
+func (col *Col) lockGivenUp(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return col.lockTimedOut(id)
 }
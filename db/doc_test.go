@@ -418,6 +418,111 @@ func TestUpdate(t *testing.T) {
 	err = db.Close()
 	fatalIf(err)
 }
+func TestReadBatch(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 0, 10)
+	for i := 0; i < 10; i++ {
+		id, err := col.Insert(map[string]interface{}{"a": float64(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err = col.Delete(ids[9]); err != nil {
+		t.Fatal(err)
+	}
+	// Deleted, nonexistent and negative IDs are absent from result, duplicated IDs are read once
+	docs := col.ReadBatch(append(ids, ids[0], 12345, -1))
+	if len(docs) != 9 {
+		t.Fatal(docs)
+	}
+	for i, id := range ids[:9] {
+		if docs[id]["a"] != float64(i) {
+			t.Fatal(docs)
+		}
+	}
+	if docs := col.ReadBatch(nil); len(docs) != 0 {
+		t.Fatal(docs)
+	}
+	// By string ID, documents that do not carry the string ID are absent from result
+	if _, err = col.InsertStrID("x", map[string]interface{}{"a": "x"}); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.InsertStrID("y", map[string]interface{}{"a": "y"}); err != nil {
+		t.Fatal(err)
+	}
+	strDocs := col.ReadBatchStrID([]string{"x", "y", "x", "z", strconv.Itoa(ids[0])})
+	if len(strDocs) != 2 || strDocs["x"]["a"] != "x" || strDocs["y"]["a"] != "y" {
+		t.Fatal(strDocs)
+	}
+}
+func TestReadView(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make(map[int]float64)
+	for i := 0; i < 10; i++ {
+		id, err := col.Insert(map[string]interface{}{"a": float64(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[id] = float64(i)
+	}
+	for id, a := range ids {
+		var doc map[string]interface{}
+		if err = col.ReadView(id, func(docB []byte) {
+			err = json.Unmarshal(docB, &doc)
+		}); err != nil || doc["a"] != a {
+			t.Fatal(err, doc)
+		}
+	}
+	if err = col.ReadView(12345, func([]byte) { t.Fatal("viewed nonexistent document") }); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if err = col.ReadView(-1, func([]byte) { t.Fatal("viewed negative ID") }); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	// Documents viewed during a scan are the same as those copied
+	copied := make(map[int]string)
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		copied[id] = string(doc)
+		return true
+	})
+	viewed := 0
+	col.ForEachDocView(func(id int, doc []byte) bool {
+		if copied[id] != string(doc) {
+			t.Fatal(id, string(doc))
+		}
+		viewed++
+		return true
+	})
+	if len(copied) != 10 || viewed != 10 {
+		t.Fatal(len(copied), viewed)
+	}
+}
+
 func TestGetInTypeСonversionErr(t *testing.T) {
 	GetIn("typeError", []string{})
 }
@@ -428,6 +533,7 @@ func TestGetInPathIsEpmty(t *testing.T) {
 }
 func TestColInsertRecoveryMarshalJsErr(t *testing.T) {
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 
 	col, _ := OpenCol(db, "test")
@@ -443,6 +549,7 @@ func TestColInsertRecoveryInsertErr(t *testing.T) {
 		part *data.Partition
 	)
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 
 	col, _ := OpenCol(db, "test")
@@ -459,6 +566,7 @@ func TestColInsertRecoveryInsertErr(t *testing.T) {
 func TestInsertErr(t *testing.T) {
 	var part *data.Partition
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 
 	col, _ := OpenCol(db, "test")
@@ -474,20 +582,20 @@ func TestInsertErr(t *testing.T) {
 }
 func TestInsertJsMarshalErr(t *testing.T) {
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 
 	col, _ := OpenCol(db, "test")
-	errMessage := "Error json marshal"
-	patch := monkey.Patch(json.Marshal, func(v interface{}) ([]byte, error) {
-		return nil, errors.New(errMessage)
-	})
-	defer patch.Unpatch()
-	if _, err := col.Insert(map[string]interface{}{"test": "fail json"}); err.Error() != errMessage {
-		t.Errorf("Expected error : %s", errMessage)
+	// Documents are serialised into pooled buffers rather than by json.Marshal, a channel fails either way
+	if _, err := col.Insert(map[string]interface{}{"test": make(chan int)}); err == nil {
+		t.Error("Expected error json marshal")
+	} else if _, unsupported := err.(*json.UnsupportedTypeError); !unsupported {
+		t.Errorf("Expected error json marshal, got %v", err)
 	}
 }
 func TestUpdateDocIsNill(t *testing.T) {
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 
 	col, _ := OpenCol(db, "test")
@@ -498,21 +606,19 @@ func TestUpdateDocIsNill(t *testing.T) {
 }
 func TestUpdateJsMarshalErr(t *testing.T) {
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 
 	col, _ := OpenCol(db, "test")
-	errMessage := "Error json marshal"
-	patch := monkey.Patch(json.Marshal, func(v interface{}) ([]byte, error) {
-		return nil, errors.New(errMessage)
-	})
-	defer patch.Unpatch()
-	if col.Update(0, map[string]interface{}{"test": "fail json"}).Error() != errMessage {
-		t.Errorf("Expected error : %s", errMessage)
+	// Documents are serialised into pooled buffers rather than by json.Marshal, a channel fails either way
+	if _, unsupported := col.Update(0, map[string]interface{}{"test": make(chan int)}).(*json.UnsupportedTypeError); !unsupported {
+		t.Error("Expected error json marshal")
 	}
 }
 func TestUpdatePartError(t *testing.T) {
 	var part *data.Partition
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 
 	col, _ := OpenCol(db, "test")
@@ -532,6 +638,7 @@ func TestUpdatePartError(t *testing.T) {
 }
 func TestUpdateAttemptDoc(t *testing.T) {
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 
 	col, _ := OpenCol(db, "test")
@@ -561,6 +668,7 @@ func TestUpdateAttemptDoc(t *testing.T) {
 func TestUpdateBytesFunc(t *testing.T) {
 	var part *data.Partition
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 	errMessage := "error read"
 	col, _ := OpenCol(db, "test")
@@ -577,6 +685,7 @@ func TestUpdateBytesFunc(t *testing.T) {
 func TestUpdateBytesCallbackError(t *testing.T) {
 	var part *data.Partition
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 	errMessage := "error update"
 	col, _ := OpenCol(db, "test")
@@ -593,6 +702,7 @@ func TestUpdateBytesCallbackError(t *testing.T) {
 func TestUpdateBytesJsMarshalErr(t *testing.T) {
 	var part *data.Partition
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 	errMessage := "error update"
 	col, _ := OpenCol(db, "test")
@@ -613,6 +723,7 @@ func TestUpdateBytesJsMarshalErr(t *testing.T) {
 func TestUpdateBytesPartUpdateErr(t *testing.T) {
 	var part *data.Partition
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 	errMessage := "error update"
 	col, _ := OpenCol(db, "test")
@@ -642,6 +753,7 @@ func TestUpdateBytesFuncIsLog(t *testing.T) {
 	log.SetOutput(&str)
 
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 
 	defer os.RemoveAll(tempDir)
 	//errMessage := "error update"
@@ -675,6 +787,7 @@ func TestUpdateBytesFuncIsLog(t *testing.T) {
 }
 func TestUpdateFuncDocNotExistError(t *testing.T) {
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 	col, _ := OpenCol(db, "test")
 	err := col.UpdateFunc(0, func(origDoc map[string]interface{}) (newDoc map[string]interface{}, err error) {
@@ -687,6 +800,7 @@ func TestUpdateFuncDocNotExistError(t *testing.T) {
 }
 func TestUpdateFuncUnmarshalError(t *testing.T) {
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 	col, _ := OpenCol(db, "test")
 	id, _ := col.Insert(map[string]interface{}{"test": "test"})
@@ -707,26 +821,23 @@ func TestUpdateFuncUnmarshalError(t *testing.T) {
 }
 func TestUpdateFuncMarshalError(t *testing.T) {
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 	col, _ := OpenCol(db, "test")
 	id, _ := col.Insert(map[string]interface{}{"test": "test"})
 
-	errMessage := "Error json marshal"
-	patchMarshal := monkey.Patch(json.Marshal, func(v interface{}) ([]byte, error) {
-		return nil, errors.New(errMessage)
-	})
-	defer patchMarshal.Unpatch()
-
+	// Documents are serialised into pooled buffers rather than by json.Marshal, a channel fails either way
 	err := col.UpdateFunc(id, func(origDoc map[string]interface{}) (newDoc map[string]interface{}, err error) {
-		return nil, nil
+		return map[string]interface{}{"test": make(chan int)}, nil
 	})
 
-	if err.Error() != errMessage {
+	if _, unsupported := err.(*json.UnsupportedTypeError); !unsupported {
 		t.Error("Expected error json marshaling")
 	}
 }
 func TestUpdateFuncUpdateError(t *testing.T) {
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 	col, _ := OpenCol(db, "test")
 	id, _ := col.Insert(map[string]interface{}{"test": "test"})
@@ -743,6 +854,7 @@ func TestUpdateFuncUpdateError(t *testing.T) {
 func TestUpdateFuncPartUpdateError(t *testing.T) {
 	var part *data.Partition
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 	errMessage := "Error update"
 	col, _ := OpenCol(db, "test")
@@ -762,6 +874,7 @@ func TestUpdateFuncPartUpdateError(t *testing.T) {
 func TestDeleteError(t *testing.T) {
 	var part *data.Partition
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 	errMessage := "Error delete"
 	col, _ := OpenCol(db, "test")
@@ -784,6 +897,7 @@ func TestDeleteMarshalJsError(t *testing.T) {
 	)
 	log.SetOutput(&str)
 	db, _ := OpenDB(tempDir)
+	defer closeTestDB(db)
 	defer os.RemoveAll(tempDir)
 	errMessage := "Error json marshal"
 	col, _ := OpenCol(db, "test")
@@ -0,0 +1,48 @@
+// Pooled serialisation buffers.
+//
+// Inserts and updates serialise each document into a buffer taken from a pool instead of a freshly allocated slice.
+// Partitions copy the serialised document into their data files, so that the buffer is given back to the pool as soon
+// as the write is done, which spares the garbage collector most of the allocations of a heavy write load. Buffers
+// grown by unusually large documents are left to the garbage collector rather than kept in the pool.
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+const (
+	DOC_BUF_MAX_POOLED = 64 * 1024 // Buffers grown larger than this (in bytes) are not put back into the pool.
+)
+
+var docBufPool = sync.Pool{New: func() interface{} { return new(docBuf) }}
+
+// Buffer holding a serialised document.
+type docBuf struct {
+	bytes.Buffer
+}
+
+// Take a buffer from the pool, give it back by calling free.
+func getDocBuf() *docBuf {
+	return docBufPool.Get().(*docBuf)
+}
+
+// Serialise the document into the buffer, replacing the previous content. The result is the same as that of
+// json.Marshal, and is only valid until the buffer is used again or given back.
+func (buf *docBuf) marshal(doc interface{}) ([]byte, error) {
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(doc); err != nil {
+		return nil, err
+	}
+	// Encode terminates the document by a new line
+	return buf.Bytes()[:buf.Len()-1], nil
+}
+
+// Give the buffer back to the pool.
+func (buf *docBuf) free() {
+	if buf.Cap() <= DOC_BUF_MAX_POOLED {
+		docBufPool.Put(buf)
+	}
+}
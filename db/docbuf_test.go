@@ -0,0 +1,38 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDocBuf(t *testing.T) {
+	buf := getDocBuf()
+	for _, doc := range []map[string]interface{}{
+		{"a": 1.0, "b": []interface{}{"<c>", nil}},
+		{},
+		{"long": strings.Repeat("x", 1000)},
+		{"a": 2.0},
+	} {
+		expected, _ := json.Marshal(doc)
+		if docJS, err := buf.marshal(doc); err != nil || !bytes.Equal(docJS, expected) {
+			t.Fatal(err, string(docJS))
+		}
+	}
+	if _, err := buf.marshal(map[string]interface{}{"a": make(chan int)}); err == nil {
+		t.Fatal("did not error")
+	}
+	buf.free()
+	// Buffers grown too large are not kept
+	large := getDocBuf()
+	if _, err := large.marshal(map[string]interface{}{"a": strings.Repeat("x", DOC_BUF_MAX_POOLED)}); err != nil {
+		t.Fatal(err)
+	}
+	large.free()
+	for i := 0; i < 10; i++ {
+		if getDocBuf() == large {
+			t.Fatal("large buffer was pooled")
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Decoded document cache.
+//
+// A collection with DocCacheSize set (col-config.json) keeps up to that many of the documents read most recently in
+// decoded form, so that reading a hot document again - by Read, ReadBatch or ReadBatchStrID, such as in a hook or a
+// query pipeline - does not deserialise it again. Writers invalidate a document while its partition is locked for the
+// write, and a document read before an invalidation is not cached after it, so that the cache never returns an outdated
+// document. Callers receive their own copy of a cached document, which they may modify.
+
+package db
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Decoded documents of a collection, least recently read are evicted first. Methods of a nil cache do nothing.
+type docCache struct {
+	lock  *sync.Mutex
+	size  int                   // Maximum number of documents
+	docs  map[int]*list.Element // Document ID - element of order
+	order *list.List            // Cached documents, most recently read first
+	gen   uint64                // Incremented upon every invalidation
+}
+
+// A cached document.
+type cachedDoc struct {
+	id  int
+	doc map[string]interface{}
+}
+
+// Return a cache of the size, or nil if the size is 0.
+func newDocCache(size int) *docCache {
+	if size <= 0 {
+		return nil
+	}
+	return &docCache{lock: new(sync.Mutex), size: size, docs: make(map[int]*list.Element), order: list.New()}
+}
+
+// Return a copy of the cached document. Otherwise return the generation to be passed to put once the document is read
+// and decoded. Must be called while the document's partition is locked.
+func (c *docCache) get(id int) (doc map[string]interface{}, gen uint64, cached bool) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, exists := c.docs[id]
+	if !exists {
+		return nil, c.gen, false
+	}
+	c.order.MoveToFront(elem)
+	return copyDoc(elem.Value.(*cachedDoc).doc), c.gen, true
+}
+
+// Cache a copy of the document read at the generation, unless a document was invalidated since.
+func (c *docCache) put(id int, doc map[string]interface{}, gen uint64) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.gen != gen {
+		return
+	} else if elem, exists := c.docs[id]; exists {
+		elem.Value.(*cachedDoc).doc = copyDoc(doc)
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.docs[id] = c.order.PushFront(&cachedDoc{id: id, doc: copyDoc(doc)})
+	for c.order.Len() > c.size {
+		delete(c.docs, c.order.Remove(c.order.Back()).(*cachedDoc).id)
+	}
+}
+
+// Remove the document from cache. Must be called while the document's partition is locked for writing.
+func (c *docCache) invalidate(id int) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	c.gen++
+	if elem, exists := c.docs[id]; exists {
+		c.order.Remove(elem)
+		delete(c.docs, id)
+	}
+	c.lock.Unlock()
+}
+
+// Remove all documents from cache.
+func (c *docCache) clear() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	c.gen++
+	c.docs = make(map[int]*list.Element)
+	c.order.Init()
+	c.lock.Unlock()
+}
+
+// Return the number of cached documents. Does not place schema lock.
+func (col *Col) cachedDocs() int {
+	if col.cache == nil {
+		return 0
+	}
+	col.cache.lock.Lock()
+	defer col.cache.lock.Unlock()
+	return len(col.cache.docs)
+}
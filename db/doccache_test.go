@@ -0,0 +1,106 @@
+package db
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestDocCache(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 4)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"a": float64(i), "nested": map[string]interface{}{"b": "c"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Documents are not cached by default
+	if _, err = col.Read(ids[0]); err != nil || col.cachedDocs() != 0 {
+		t.Fatal(err, col.cachedDocs())
+	}
+	if err = col.SetConfig(ColConfig{DocCacheSize: -1}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if err = col.SetConfig(ColConfig{DocCacheSize: 3}); err != nil {
+		t.Fatal(err)
+	}
+	// Reads fill the cache up to its size, the callers may modify their documents
+	for _, id := range ids {
+		doc, err := col.Read(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc["a"] = "modified"
+		doc["nested"].(map[string]interface{})["b"] = "modified"
+	}
+	if col.cachedDocs() != 3 {
+		t.Fatal(col.cachedDocs())
+	}
+	docs := col.ReadBatch(ids)
+	for i, id := range ids {
+		if docs[id]["a"] != float64(i) || docs[id]["nested"].(map[string]interface{})["b"] != "c" {
+			t.Fatal(docs)
+		}
+	}
+	// Writes invalidate cached documents
+	if err = col.Update(ids[1], map[string]interface{}{"a": "updated"}); err != nil {
+		t.Fatal(err)
+	} else if doc, err := col.Read(ids[1]); err != nil || doc["a"] != "updated" {
+		t.Fatal(doc, err)
+	} else if err = col.Delete(ids[2]); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.Read(ids[2]); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if errs := col.patchBatch(context.Background(), []int{ids[3]}, map[string]interface{}{"a": "patched"}, nil); errs[0] != nil {
+		t.Fatal(errs)
+	} else if docs = col.ReadBatch([]int{ids[3]}); docs[ids[3]]["a"] != "patched" {
+		t.Fatal(docs)
+	}
+	if err = db.Truncate("col"); err != nil {
+		t.Fatal(err)
+	} else if col.cachedDocs() != 0 {
+		t.Fatal(col.cachedDocs())
+	}
+	// Concurrent reads never cache an outdated document
+	id, err := col.Insert(map[string]interface{}{"n": float64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := new(sync.WaitGroup)
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					col.Read(id)
+				}
+			}
+		}()
+	}
+	for n := 1; n <= 500; n++ {
+		if err = col.Update(id, map[string]interface{}{"n": float64(n)}); err != nil {
+			t.Fatal(err)
+		} else if doc, err := col.Read(id); err != nil || doc["n"] != float64(n) {
+			t.Fatal(n, doc, err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
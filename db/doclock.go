@@ -0,0 +1,204 @@
+// Document locks spanning several documents.
+//
+// Code that reads and writes several documents as a unit - such as a transfer between two accounts - locks them
+// together in a DocLocks set. LockUpdateMany locks the documents in ascending order of ID, so that callers locking the
+// same documents at once never deadlock one another. A set may lock more documents later on (two-phase locking: locks
+// are only acquired until the set is unlocked, which releases them all at once); as the later documents may come out of
+// order, waiting for a document held by a set that in turn waits, directly or through other sets, for a document of the
+// waiting set fails with ErrorDeadlock rather than block forever, and so does waiting for longer than the timeout, with
+// ErrorLockTimeout. Either way the documents already locked remain locked, and the caller should unlock the set and
+// retry.
+//
+// The locks are advisory: they exclude other sets, while the documents may still be read and written by ID. They are
+// kept in memory and do not survive closing the database.
+
+package db
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// A document of a collection.
+type docKey struct {
+	col *Col
+	id  int
+}
+
+// A locked document.
+type docLock struct {
+	owner    *DocLocks
+	released chan struct{} // Closed once the document is unlocked
+	since    time.Time     // Time the document was locked
+	waiters  int           // Number of sets waiting for the document
+}
+
+// Documents locked by sets of the database.
+type docLockTable struct {
+	lock  *sync.Mutex
+	locks map[docKey]*docLock
+}
+
+// Return a table without locked documents.
+func newDocLockTable() *docLockTable {
+	return &docLockTable{lock: new(sync.Mutex), locks: make(map[docKey]*docLock)}
+}
+
+// DocLocks is a set of documents locked together, see LockUpdateMany.
+type DocLocks struct {
+	db      *DB
+	timeout time.Duration
+	held    []docKey
+	waits   *docKey // Document the set waits for, guarded by the table lock
+}
+
+// Lock the documents for exclusive update, in ascending order of ID, and return the set holding them. The documents
+// need not exist. Should a document remain locked by another set for longer than the timeout (0 - wait indefinitely),
+// or should waiting for it deadlock, the documents locked so far are unlocked and the error is ErrorLockTimeout or
+// ErrorDeadlock.
+func (col *Col) LockUpdateMany(timeout time.Duration, ids ...int) (*DocLocks, error) {
+	locks := &DocLocks{db: col.db, timeout: timeout}
+	if err := locks.Lock(col, ids...); err != nil {
+		locks.Unlock()
+		return nil, err
+	}
+	return locks, nil
+}
+
+// Lock more documents of the collection for the set, in ascending order of ID. Documents already held by the set are
+// skipped. On ErrorLockTimeout or ErrorDeadlock the documents locked so far remain locked.
+func (locks *DocLocks) Lock(col *Col, ids ...int) error {
+	sorted := append([]int(nil), ids...)
+	sort.Ints(sorted)
+	for _, id := range sorted {
+		if err := locks.db.docLocks.acquire(locks, docKey{col, id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unlock all documents of the set. The set may lock documents again afterwards.
+func (locks *DocLocks) Unlock() {
+	table := locks.db.docLocks
+	table.lock.Lock()
+	for _, key := range locks.held {
+		close(table.locks[key].released)
+		delete(table.locks, key)
+	}
+	table.lock.Unlock()
+	locks.held = nil
+}
+
+// Return the number of documents locked by the set.
+func (locks *DocLocks) Len() int {
+	return len(locks.held)
+}
+
+// Lock the document for the set, waiting until other sets unlock it.
+func (table *docLockTable) acquire(locks *DocLocks, key docKey) error {
+	var expiry <-chan time.Time
+	if locks.timeout > 0 {
+		timer := time.NewTimer(locks.timeout)
+		defer timer.Stop()
+		expiry = timer.C
+	}
+	for {
+		table.lock.Lock()
+		held, isHeld := table.locks[key]
+		if !isHeld {
+			table.locks[key] = &docLock{owner: locks, released: make(chan struct{}), since: time.Now()}
+			locks.held = append(locks.held, key)
+			table.lock.Unlock()
+			return nil
+		} else if held.owner == locks {
+			table.lock.Unlock()
+			return nil
+		} else if table.waitsFor(held.owner, locks) {
+			table.lock.Unlock()
+			return dberr.New(dberr.ErrorDeadlock, key.id, key.col.name)
+		}
+		locks.waits = &key
+		held.waiters++
+		table.lock.Unlock()
+		timedOut := false
+		select {
+		case <-held.released:
+		case <-expiry:
+			timedOut = true
+		}
+		table.lock.Lock()
+		locks.waits = nil
+		held.waiters--
+		table.lock.Unlock()
+		if timedOut {
+			return key.col.lockTimedOut(key.id)
+		}
+	}
+}
+
+// Return true if the set waits for a document held by the other set, directly or through the sets holding the
+// documents waited for. Caller must hold the table lock.
+func (table *docLockTable) waitsFor(locks, other *DocLocks) bool {
+	// A set waits for a single document at a time, so that the sets waited for form a chain, which is no longer than
+	// the number of locked documents unless there is a cycle among other sets
+	for steps := 0; locks != nil && locks.waits != nil && steps <= len(table.locks); steps++ {
+		held, isHeld := table.locks[*locks.waits]
+		if !isHeld {
+			return false
+		} else if held.owner == other {
+			return true
+		}
+		locks = held.owner
+	}
+	return false
+}
+
+// LockInfo describes a document lock, or a partition data lock waited for.
+type LockInfo struct {
+	Kind      string `json:"kind"`         // "update" - document locked for index maintenance, "set" - document locked by LockUpdateMany, "data" - partition data lock
+	Col       string `json:"col"`          // Collection name
+	Partition int    `json:"partition"`    // Partition number
+	ID        int    `json:"id,omitempty"` // Document ID, absent from data locks
+	HeldFor   int64  `json:"held_ms"`      // Time (in milliseconds) the document has been locked for, 0 for data locks
+	Waiters   int    `json:"waiters"`      // Number of callers waiting for the lock
+}
+
+// Return the documents currently locked and the partition data locks being waited for, longest held first, for
+// debugging stuck workloads. Whether a data lock is held cannot be told, only the waits placed by document reads and
+// writes are counted.
+func (db *DB) Locks() (locks []LockInfo) {
+	now := time.Now()
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	for name, col := range db.cols {
+		for partNum, part := range col.parts {
+			docs, dataWaiters := part.Locks()
+			for _, doc := range docs {
+				locks = append(locks, LockInfo{Kind: "update", Col: name, Partition: partNum, ID: doc.ID,
+					HeldFor: now.Sub(doc.Since).Milliseconds(), Waiters: doc.Waiters})
+			}
+			if dataWaiters > 0 {
+				locks = append(locks, LockInfo{Kind: "data", Col: name, Partition: partNum, Waiters: dataWaiters})
+			}
+		}
+	}
+	db.docLocks.lock.Lock()
+	for key, held := range db.docLocks.locks {
+		locks = append(locks, LockInfo{Kind: "set", Col: key.col.name, Partition: key.id % db.numParts, ID: key.id,
+			HeldFor: now.Sub(held.since).Milliseconds(), Waiters: held.waiters})
+	}
+	db.docLocks.lock.Unlock()
+	sort.SliceStable(locks, func(i, j int) bool {
+		if locks[i].HeldFor != locks[j].HeldFor {
+			return locks[i].HeldFor > locks[j].HeldFor
+		} else if locks[i].Col != locks[j].Col {
+			return locks[i].Col < locks[j].Col
+		}
+		return locks[i].ID < locks[j].ID
+	})
+	return
+}
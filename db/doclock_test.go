@@ -0,0 +1,161 @@
+package db
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestDocLocks(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("accounts"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("accounts")
+	a, err := col.Insert(map[string]interface{}{"balance": 100.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := col.Insert(map[string]interface{}{"balance": 100.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Transfers in opposite directions lock the documents in the same order
+	transfer := func(from, to int) {
+		locks, err := col.LockUpdateMany(0, from, to)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer locks.Unlock()
+		fromDoc, _ := col.Read(from)
+		toDoc, _ := col.Read(to)
+		fromDoc["balance"] = fromDoc["balance"].(float64) - 1
+		toDoc["balance"] = toDoc["balance"].(float64) + 1
+		if err = col.Update(from, fromDoc); err == nil {
+			err = col.Update(to, toDoc)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			transfer(a, b)
+			wg.Done()
+		}()
+		go func() {
+			transfer(b, a)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if docA, err := col.Read(a); err != nil || docA["balance"] != 100.0 {
+		t.Fatal(docA, err)
+	} else if docB, err := col.Read(b); err != nil || docB["balance"] != 100.0 {
+		t.Fatal(docB, err)
+	}
+	// Locking more documents out of order is detected to deadlock
+	first, err := col.LockUpdateMany(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := col.LockUpdateMany(0, 2, 2)
+	if err != nil || second.Len() != 1 {
+		t.Fatal(second, err)
+	}
+	firstErr := make(chan error)
+	go func() {
+		firstErr <- first.Lock(col, 2)
+	}()
+	for waiting := false; !waiting; {
+		time.Sleep(time.Millisecond)
+		db.docLocks.lock.Lock()
+		waiting = first.waits != nil
+		db.docLocks.lock.Unlock()
+	}
+	if err = second.Lock(col, 1); dberr.Type(err) != dberr.ErrorDeadlock {
+		t.Fatal(err)
+	} else if err = second.Lock(col, 2, 3); err != nil || second.Len() != 2 {
+		t.Fatal(err)
+	}
+	second.Unlock()
+	if err = <-firstErr; err != nil || first.Len() != 2 {
+		t.Fatal(first, err)
+	}
+	// Waiting for longer than the timeout gives up, and releases the documents locked so far
+	if locks, err := col.LockUpdateMany(10*time.Millisecond, 0, 2); dberr.Type(err) != dberr.ErrorLockTimeout || locks != nil {
+		t.Fatal(locks, err)
+	}
+	first.Unlock()
+	if locks, err := col.LockUpdateMany(10*time.Millisecond, 0, 1, 2); err != nil || locks.Len() != 3 {
+		t.Fatal(locks, err)
+	} else {
+		locks.Unlock()
+	}
+	if len(db.docLocks.locks) != 0 {
+		t.Fatal(db.docLocks.locks)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	id, err := col.Insert(map[string]interface{}{"a": 1.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	col.fileConf.LockTimeout = 1000
+	part := col.parts[id%db.numParts]
+	part.DataLock.Lock()
+	// Reads and writes waiting for the partition are listed, and give up after the timeout
+	readErr := make(chan error)
+	go func() {
+		_, err := col.Read(id)
+		readErr <- err
+	}()
+	for waiting := false; !waiting; {
+		time.Sleep(time.Millisecond)
+		for _, lock := range db.Locks() {
+			waiting = waiting || lock.Kind == "data" && lock.Col == "col" && lock.Waiters == 1
+		}
+	}
+	col.fileConf.LockTimeout = 20
+	if err = <-readErr; dberr.Type(err) != dberr.ErrorLockTimeout {
+		t.Fatal(err)
+	} else if err = col.Update(id, map[string]interface{}{"a": 2.0}); dberr.Type(err) != dberr.ErrorLockTimeout {
+		t.Fatal(err)
+	} else if err = col.Delete(id); dberr.Type(err) != dberr.ErrorLockTimeout {
+		t.Fatal(err)
+	}
+	part.DataLock.Unlock()
+	if err = col.Update(id, map[string]interface{}{"a": 2.0}); err != nil {
+		t.Fatal(err)
+	}
+	// Documents locked for index maintenance are listed
+	part.LockUpdate(id)
+	if locks := db.Locks(); len(locks) != 1 || locks[0].Kind != "update" || locks[0].ID != id {
+		t.Fatal(locks)
+	}
+	part.UnlockUpdate(id)
+}
@@ -0,0 +1,118 @@
+// Dry runs of destructive operations.
+//
+// A dry run reports what deleting by query, dropping a collection or removing an index would affect, without making
+// the operation. The estimated duration is rough: deleting by query reads the matching documents like the dry run does,
+// then writes each of them and its entries of every index, so the estimate is the time of the dry run multiplied by the
+// number of indexes plus one; dropping a collection or removing an index removes the files that the dry run walked,
+// and the estimate is the time of the walk. Nothing is locked beyond the dry run, so the operation made afterwards may
+// find things changed.
+
+package db
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// DryRun reports what a destructive operation would affect.
+type DryRun struct {
+	Docs     int            `json:"docs"`                  // Number of documents that would be deleted
+	Bytes    int64          `json:"bytes"`                 // Size of the documents or files that would be deleted
+	Indexes  int            `json:"indexes"`               // Number of indexes that would be removed, or updated for each document deleted by query
+	Cascade  map[string]int `json:"cascade,omitempty"`     // Number of documents deleted along by relations, by collection name
+	Failed   int            `json:"failed"`                // Number of documents whose deletion relations would refuse
+	FirstErr string         `json:"first_error,omitempty"` // Error of the first document whose deletion would be refused
+	Duration time.Duration  `json:"estimated_duration_ns"` // Estimated duration of the operation
+}
+
+// Report what deleting the documents matching the query would affect, see DeleteByQuery.
+func (col *Col) DeleteByQueryDryRun(q interface{}) (report DryRun, err error) {
+	start := time.Now()
+	result := make(map[int]struct{})
+	if err = EvalQuery(q, col, &result); err != nil {
+		return
+	}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	for id := range result {
+		doc, err := col.readBytes(id)
+		if err != nil {
+			// Deleted since the query
+			continue
+		}
+		cascade, err := col.checkReferrers(id)
+		if err != nil {
+			if report.Failed == 0 {
+				report.FirstErr = err.Error()
+			}
+			report.Failed++
+			continue
+		}
+		report.Docs++
+		report.Bytes += int64(len(doc))
+		for referring, ids := range cascade {
+			if report.Cascade == nil {
+				report.Cascade = make(map[string]int)
+			}
+			report.Cascade[referring.name] += len(ids)
+		}
+	}
+	report.Indexes = len(col.indexPaths)
+	report.Duration = time.Since(start) * time.Duration(report.Indexes+1)
+	return report, nil
+}
+
+// Report what dropping the collection (or time series collection) would affect, see Drop.
+func (db *DB) DropDryRun(name string) (report DryRun, err error) {
+	start := time.Now()
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	dir := path.Join(db.path, name)
+	if col, exists := db.cols[name]; exists {
+		report.Docs = col.approxDocCount(false)
+		report.Indexes = len(col.indexPaths)
+		if dir, err = db.colDir(name); err != nil {
+			return
+		}
+	} else if _, exists := db.series[name]; !exists {
+		return report, dberr.New(dberr.ErrorNoCol, name)
+	}
+	if report.Bytes, err = dirSize(dir); err != nil {
+		return
+	}
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// Report what removing the index would affect, see Unindex.
+func (col *Col) UnindexDryRun(idxPath []string) (report DryRun, err error) {
+	start := time.Now()
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, exists := col.indexPaths[idxName]; !exists {
+		return report, dberr.New(dberr.ErrorNoIndex, idxPath)
+	}
+	report.Indexes = 1
+	if report.Bytes, err = dirSize(path.Join(col.db.path, col.name, idxName)); err != nil {
+		return
+	}
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// Return the total size of the files in the directory and its subdirectories.
+func dirSize(dir string) (size int64, err error) {
+	err = filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return err
+	})
+	return
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestDryRun(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, name := range []string{"users", "posts"} {
+		if err = db.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users, posts := db.Use("users"), db.Use("posts")
+	if err = posts.SetConfig(ColConfig{Relations: []Relation{{Path: []string{"author"}, Target: "users", OnDelete: REF_CASCADE}}}); err != nil {
+		t.Fatal(err)
+	} else if err = users.Index([]string{"name"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		id, err := users.Insert(map[string]interface{}{"name": name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err = posts.Insert(map[string]interface{}{"author": strconv.Itoa(id)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Deleting by query reports the cascade, and deletes nothing
+	report, err := users.DeleteByQueryDryRun(map[string]interface{}{"eq": "alice", "in": []interface{}{"name"}})
+	if err != nil || report.Docs != 1 || report.Bytes == 0 || report.Indexes != 1 || report.Cascade["posts"] != 3 || report.Failed != 0 {
+		t.Fatal(report, err)
+	} else if report, err = users.DeleteByQueryDryRun("all"); err != nil || report.Docs != 2 || report.Cascade["posts"] != 6 {
+		t.Fatal(report, err)
+	} else if users.ApproxDocCount() != 2 || posts.ApproxDocCount() != 6 {
+		t.Fatal(users.ApproxDocCount(), posts.ApproxDocCount())
+	} else if _, err = users.DeleteByQueryDryRun("abc"); err == nil {
+		t.Fatal("did not error")
+	}
+	// Dropping and removing an index report the files
+	if report, err = db.DropDryRun("users"); err != nil || report.Docs != 2 || report.Indexes != 1 || report.Bytes == 0 {
+		t.Fatal(report, err)
+	} else if _, err = db.DropDryRun("nope"); dberr.Type(err) != dberr.ErrorNoCol {
+		t.Fatal(err)
+	} else if report, err = users.UnindexDryRun([]string{"name"}); err != nil || report.Indexes != 1 || report.Bytes == 0 {
+		t.Fatal(report, err)
+	} else if _, err = users.UnindexDryRun([]string{"nope"}); dberr.Type(err) != dberr.ErrorNoIndex {
+		t.Fatal(err)
+	}
+	if db.Use("users") == nil || len(users.AllIndexes()) != 1 {
+		t.Fatal("dry run changed the collection")
+	}
+}
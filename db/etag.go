@@ -0,0 +1,44 @@
+// Entity tags of documents.
+//
+// The entity tag of a document is a hash of its JSON, which changes whenever the document changes. A client that read
+// a document along with its entity tag may update the document on condition that it still has the tag, and so detect
+// the updates of others in the meantime (optimistic concurrency) without locking the document.
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Return the entity tag of the document, a quoted string as used in HTTP header ETag.
+func DocETag(doc map[string]interface{}) string {
+	docJS, _ := json.Marshal(doc)
+	hash := fnv.New64a()
+	hash.Write(docJS)
+	return fmt.Sprintf(`"%016x"`, hash.Sum64())
+}
+
+// Update a document like Update, provided that the condition function (optional) returns true for the document as it
+// is right before the update; otherwise the document is left alone and the error is ErrorDocChanged. Return the entity
+// tag of the updated document.
+func (col *Col) UpdateIf(id int, doc map[string]interface{}, cond func(original map[string]interface{}) bool) (etag string, err error) {
+	var match func(original map[string]interface{}) error
+	if cond != nil {
+		match = func(original map[string]interface{}) error {
+			if !cond(original) {
+				return dberr.New(dberr.ErrorDocChanged, id)
+			}
+			return nil
+		}
+	}
+	updated, err := col.updateIf(context.Background(), id, doc, match)
+	if err != nil {
+		return
+	}
+	return DocETag(updated), nil
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestUpdateIf(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.SetConfig(ColConfig{Timestamps: true}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, _ := col.Read(id)
+	etag := DocETag(doc)
+	if etag != DocETag(map[string]interface{}{"a": 1.0, CREATED_ATTR: doc[CREATED_ATTR], UPDATED_ATTR: doc[UPDATED_ATTR]}) {
+		t.Fatal(etag)
+	}
+	isCurrent := func(original map[string]interface{}) bool {
+		return DocETag(original) == etag
+	}
+	// The first of two updates based on the same read wins
+	newETag, err := col.UpdateIf(id, map[string]interface{}{"a": 2}, isCurrent)
+	if err != nil || newETag == etag {
+		t.Fatal(newETag, err)
+	} else if doc, _ = col.Read(id); DocETag(doc) != newETag {
+		t.Fatal(doc, newETag)
+	} else if _, err = col.UpdateIf(id, map[string]interface{}{"a": 3}, isCurrent); dberr.Type(err) != dberr.ErrorDocChanged {
+		t.Fatal(err)
+	} else if doc, _ = col.Read(id); doc["a"] != 2.0 {
+		t.Fatal(doc)
+	}
+	// Without condition the update is unconditional
+	if _, err = col.UpdateIf(id, map[string]interface{}{"a": 4}, nil); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.UpdateIf(123, map[string]interface{}{"a": 4}, isCurrent); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,191 @@
+// Eventual index maintenance.
+//
+// A write puts the document on every index of the collection before it returns, so that queries find the document by
+// its new values right away; on a collection with many indexes, the index entries make up most of the cost of a write.
+// The indexes listed in collection setting EventualIndexes are maintained eventually instead: a write queues the
+// changes of their entries and returns, and a background goroutine applies the queued changes of all collections in
+// batches every EVENTUAL_INDEX_INTERVAL, grouped by index partition so that each partition is locked once per batch.
+// A writer finding EVENTUAL_INDEX_BACKLOG changes queued applies them itself, which bounds the staleness
+// when writes outpace the goroutine.
+//
+// Until its changes are applied, queries through an eventual index miss a written document, and find a document by
+// its old values only to drop it, as lookups verify the documents found. Col.WaitSeq waits for the changes queued by
+// the sequence number to be applied. The queue is held in memory: it is applied before the collection is closed or
+// dumped, while a crash loses the changes queued, which Scrub restores.
+
+package db
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/data"
+)
+
+const (
+	EVENTUAL_INDEX_INTERVAL = 100 * time.Millisecond // Interval of applying the queued changes of eventual indexes.
+	EVENTUAL_INDEX_BACKLOG  = 10000                  // A writer applies the queued changes once there are this many.
+)
+
+// Index entry change queued for an eventual index.
+type eventualChange struct {
+	idxName string
+	key, id int
+	remove  bool
+	seq     int // Sequence number of the changes the database reflected when the change was queued (see AppliedSeq)
+}
+
+// Changes of the eventual indexes of a collection waiting to be applied.
+type eventualQueue struct {
+	names     map[string]struct{} // Names of the eventual indexes, changed under schema lock
+	lock      *sync.Mutex         // Protect changes and applying
+	applyLock *sync.Mutex         // Apply one batch at a time, so that the changes are applied in the order they were queued
+	changes   []eventualChange
+	applying  []eventualChange // The batch being applied
+}
+
+// Return an empty queue.
+func newEventualQueue() *eventualQueue {
+	return &eventualQueue{names: make(map[string]struct{}), lock: new(sync.Mutex), applyLock: new(sync.Mutex)}
+}
+
+// Set the eventual indexes from collection settings. Does not place schema lock, the caller must hold it exclusively
+// unless the collection is being opened.
+func (q *eventualQueue) configure(conf ColConfig) {
+	q.names = make(map[string]struct{}, len(conf.EventualIndexes))
+	for _, idxPath := range conf.EventualIndexes {
+		q.names[strings.Join(idxPath, INDEX_PATH_SEP)] = struct{}{}
+	}
+}
+
+// Return true if the index is maintained eventually. Does not place schema lock.
+func (q *eventualQueue) maintains(idxName string) bool {
+	_, eventual := q.names[idxName]
+	return eventual
+}
+
+// Return the number of changes waiting to be applied to the index.
+func (q *eventualQueue) queued(idxName string) (n int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, batch := range [][]eventualChange{q.applying, q.changes} {
+		for _, change := range batch {
+			if change.idxName == idxName {
+				n++
+			}
+		}
+	}
+	return
+}
+
+// Return true if changes queued before the database reflected the sequence number are yet to be applied.
+func (q *eventualQueue) lagging(seq int) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.applying) > 0 && q.applying[0].seq < seq || len(q.changes) > 0 && q.changes[0].seq < seq
+}
+
+// Discard the queued changes of the index, or of all indexes if the name is empty. Does not place schema lock, the
+// caller must hold it exclusively.
+func (q *eventualQueue) discard(idxName string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	kept := q.changes[:0]
+	for _, change := range q.changes {
+		if idxName != "" && change.idxName != idxName {
+			kept = append(kept, change)
+		}
+	}
+	q.changes = kept
+}
+
+// Queue the index changes, and apply the queued changes if there are too many. Does not place schema lock.
+func (col *Col) queueIndexChanges(changes []eventualChange) {
+	if len(changes) == 0 {
+		return
+	}
+	q := col.eventual
+	q.lock.Lock()
+	// Read under the queue lock, so that the queued sequence numbers never decrease
+	seq := col.db.AppliedSeq()
+	for _, change := range changes {
+		change.seq = seq
+		q.changes = append(q.changes, change)
+	}
+	backlog := len(q.changes)
+	q.lock.Unlock()
+	if backlog >= EVENTUAL_INDEX_BACKLOG {
+		col.applyEventual()
+	}
+}
+
+// Apply the queued changes of the eventual indexes, and return the number of changes applied. Changes of an index
+// removed meanwhile are skipped. Does not place schema lock.
+func (col *Col) applyEventual() int {
+	q := col.eventual
+	q.applyLock.Lock()
+	defer q.applyLock.Unlock()
+	q.lock.Lock()
+	batch := q.changes
+	q.changes, q.applying = nil, batch
+	q.lock.Unlock()
+	if len(batch) == 0 {
+		return 0
+	}
+	// Changes of the same entry are in the same index partition, in the order they were queued
+	byTable := make(map[*data.HashTable][]eventualChange)
+	for _, change := range batch {
+		if ht := col.hts[change.key%col.db.numParts][change.idxName]; ht != nil {
+			byTable[ht] = append(byTable[ht], change)
+		}
+	}
+	for ht, changes := range byTable {
+		ht.Lock.Lock()
+		for _, change := range changes {
+			if change.remove {
+				ht.Remove(change.key, change.id)
+			} else {
+				ht.Put(change.key, change.id)
+			}
+		}
+		ht.Lock.Unlock()
+	}
+	q.lock.Lock()
+	q.applying = nil
+	q.lock.Unlock()
+	return len(batch)
+}
+
+// Start applying the queued changes of eventual indexes of all collections in background.
+func (db *DB) startEventual() {
+	db.eventualStop = make(chan struct{})
+	db.eventualDone = make(chan struct{})
+	go func() {
+		defer close(db.eventualDone)
+		ticker := time.NewTicker(EVENTUAL_INDEX_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.eventualStop:
+				return
+			case <-ticker.C:
+				db.schemaLock.RLock()
+				for _, col := range db.cols {
+					col.applyEventual()
+				}
+				db.schemaLock.RUnlock()
+			}
+		}
+	}()
+}
+
+// Stop applying queued changes in background, waiting for a round in progress to finish. The changes still queued are
+// applied when the collections are closed.
+func (db *DB) stopEventual() {
+	if db.eventualStop != nil {
+		close(db.eventualStop)
+		<-db.eventualDone
+		db.eventualStop = nil
+	}
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestEventualIndexes(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	for _, path := range [][]string{{"a"}, {"b"}, {"c"}} {
+		if err = col.Index(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Referrers must be found right away
+	if err = col.SetConfig(ColConfig{EventualIndexes: [][]string{{}}}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if err = col.SetConfig(ColConfig{EventualIndexes: [][]string{{"c"}},
+		Relations: []Relation{{Path: []string{"c"}, Target: "col"}}}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if err = col.SetConfig(ColConfig{EventualIndexes: [][]string{{"a"}, {"b"}}}); err != nil {
+		t.Fatal(err)
+	}
+	// Apply the queued changes by hand
+	db.stopEventual()
+	id, err := col.Insert(map[string]interface{}{"a": "1", "b": "1", "c": "1"})
+	if err != nil {
+		t.Fatal(err)
+	} else if countIndexed(t, col, "a", "1") != 0 || countIndexed(t, col, "c", "1") != 1 {
+		t.Fatal("Eventual index is updated right away")
+	}
+	stats := col.IndexStats()
+	if !stats[0].Eventual || stats[0].Queued != 1 || stats[2].Eventual || stats[2].Queued != 0 {
+		t.Fatal(stats)
+	}
+	if applied := col.applyEventual(); applied != 2 {
+		t.Fatal(applied)
+	} else if countIndexed(t, col, "a", "1") != 1 || countIndexed(t, col, "b", "1") != 1 {
+		t.Fatal("Queued changes are not applied")
+	}
+	// The old value is removed from the index along with the new value put, in the order of the writes
+	if err = col.Update(id, map[string]interface{}{"a": "2"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Update(id, map[string]interface{}{"a": "1", "b": "1"}); err != nil {
+		t.Fatal(err)
+	} else if col.applyEventual() != 6 || countIndexed(t, col, "a", "1") != 1 || countIndexed(t, col, "a", "2") != 0 {
+		t.Fatal("Queued changes are not applied in order")
+	}
+	// Removing an index discards its queued changes
+	if err = col.Delete(id); err != nil {
+		t.Fatal(err)
+	} else if err = col.Unindex([]string{"b"}); err != nil {
+		t.Fatal(err)
+	} else if applied := col.applyEventual(); applied != 1 {
+		t.Fatal(applied)
+	}
+	// Waiting for a sequence number waits for the changes queued by then
+	db.startEventual()
+	if _, err = col.Insert(map[string]interface{}{"a": "3"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.WaitSeq(context.Background(), db.ChangeSeq()); err != nil {
+		t.Fatal(err)
+	} else if countIndexed(t, col, "a", "3") != 1 {
+		t.Fatal("Queued changes are not applied by the sequence number")
+	}
+	// Closing the database applies the changes still queued
+	db.stopEventual()
+	if _, err = col.Insert(map[string]interface{}{"a": "4"}); err != nil {
+		t.Fatal(err)
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if countIndexed(t, db.Use("col"), "a", "4") != 1 {
+		t.Fatal("Queued changes are lost upon closing")
+	}
+}
@@ -0,0 +1,91 @@
+// External document cache.
+//
+// An application may plug an external cache, such as Redis or memcached, into a collection by SetExternalCache, and
+// leave it to tiedot to keep the cache coherent: Read and ReadBatch consult the external cache before the collection
+// files and cache the documents they read from the files (read-through); updates write the new document into the
+// cache, and deletions remove it (write-through). Both happen while the document's partition is locked, so that a
+// document read before a write is never cached after it. Queries and ReadView always read the collection files.
+//
+// Cache keys carry the collection name and a random token chosen anew when the cache is plugged in, and when the
+// collection is truncated or restored, so that entries left behind by those or by another process are never read -
+// they should expire by the cache's own eviction policy. Should the cache fail to remove an outdated document, the
+// failure is logged; a time-to-live on cached entries bounds the time it may be read.
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+// ExternalCache stores serialised documents under string keys. It must be safe for concurrent use.
+type ExternalCache interface {
+	// Return the document cached under the key, found is false if it is not cached or the cache is unavailable.
+	Get(key string) (doc []byte, found bool)
+	// Cache the document under the key, the document must be copied if it is retained.
+	Set(key string, doc []byte) error
+	// Remove the document cached under the key.
+	Delete(key string) error
+}
+
+// External cache of a collection. Methods of a nil cache do nothing.
+type extCache struct {
+	cache  ExternalCache
+	prefix string // Key prefix of the collection's documents
+}
+
+// Return an external cache of the collection with a new key prefix, or nil if the cache is nil.
+func newExtCache(name string, cache ExternalCache) *extCache {
+	if cache == nil {
+		return nil
+	}
+	return &extCache{cache: cache, prefix: fmt.Sprintf("tiedot:%s:%x:", name, rand.Int63())}
+}
+
+// Return the cached document decoded by the function, or nil if it is not cached. Must be called while the document's
+// partition is locked.
+func (c *extCache) get(id int, unmarshal func(docB []byte, doc *map[string]interface{}) error) (doc map[string]interface{}) {
+	if c == nil {
+		return nil
+	}
+	if docB, found := c.cache.Get(c.prefix + strconv.Itoa(id)); !found || unmarshal(docB, &doc) != nil {
+		return nil
+	}
+	return
+}
+
+// Cache the document read from the collection, without the padding that follows it in the data file. Must be called
+// while the document's partition is locked.
+func (c *extCache) put(id int, docB []byte) {
+	if c == nil {
+		return
+	} else if err := c.cache.Set(c.prefix+strconv.Itoa(id), bytes.TrimRight(docB, " ")); err != nil {
+		tdlog.CritNoRepeat("Failed to cache document %d in %s: %v", id, c.prefix, err)
+	}
+}
+
+// Write the updated document into the cache, or remove it from the cache if the document is nil (deleted) or the
+// write failed. Must be called while the document's partition is locked for writing.
+func (c *extCache) update(id int, docB []byte, writeErr error) {
+	if c == nil {
+		return
+	}
+	key := c.prefix + strconv.Itoa(id)
+	if docB != nil && writeErr == nil && c.cache.Set(key, docB) == nil {
+		return
+	} else if err := c.cache.Delete(key); err != nil {
+		tdlog.CritNoRepeat("Failed to remove outdated document %d from external cache %s: %v", id, c.prefix, err)
+	}
+}
+
+// Plug the external cache into the collection, or unplug the cache if it is nil. Entries cached before are never read
+// again.
+func (col *Col) SetExternalCache(cache ExternalCache) {
+	col.db.schemaLock.Lock()
+	col.ext = newExtCache(col.name, cache)
+	col.db.schemaLock.Unlock()
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// An in-memory external cache, it fails to set documents while failSet is true.
+type memCache struct {
+	lock    *sync.Mutex
+	docs    map[string][]byte
+	gets    int
+	failSet bool
+}
+
+func newMemCache() *memCache {
+	return &memCache{lock: new(sync.Mutex), docs: make(map[string][]byte)}
+}
+
+func (c *memCache) Get(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.gets++
+	doc, found := c.docs[key]
+	return doc, found
+}
+
+func (c *memCache) Set(key string, doc []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.failSet {
+		return errors.New("set failed")
+	}
+	c.docs[key] = append([]byte(nil), doc...)
+	return nil
+}
+
+func (c *memCache) Delete(key string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.docs, key)
+	return nil
+}
+
+// Return the cached document of the ID under any key prefix.
+func (c *memCache) cached(id int) (docs []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, doc := range c.docs {
+		if strings.HasSuffix(key, ":"+strconv.Itoa(id)) {
+			docs = append(docs, string(doc))
+		}
+	}
+	return
+}
+
+func TestExternalCache(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 3)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache := newMemCache()
+	col.SetExternalCache(cache)
+	// Reads fill the cache, and are served from it afterwards
+	if doc, err := col.Read(ids[0]); err != nil || doc["a"] != float64(0) {
+		t.Fatal(doc, err)
+	} else if cached := cache.cached(ids[0]); len(cached) != 1 || cached[0] != `{"a":0}` {
+		t.Fatal(cached)
+	}
+	for key := range cache.docs {
+		cache.docs[key] = []byte(`{"a":"cached"}`)
+	}
+	if doc, err := col.Read(ids[0]); err != nil || doc["a"] != "cached" {
+		t.Fatal(doc, err)
+	}
+	if docs := col.ReadBatch(ids); len(docs) != 3 || docs[ids[0]]["a"] != "cached" || docs[ids[1]]["a"] != float64(1) {
+		t.Fatal(docs)
+	} else if len(cache.docs) != 3 {
+		t.Fatal(cache.docs)
+	}
+	// Updates write through, deletions remove the document
+	if err = col.Update(ids[0], map[string]interface{}{"a": "updated"}); err != nil {
+		t.Fatal(err)
+	} else if cached := cache.cached(ids[0]); len(cached) != 1 || cached[0] != `{"a":"updated"}` {
+		t.Fatal(cached)
+	}
+	if err = col.UpdateFunc(ids[1], func(doc map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"a": "func"}, nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if cached := cache.cached(ids[1]); len(cached) != 1 || cached[0] != `{"a":"func"}` {
+		t.Fatal(cached)
+	}
+	if err = col.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	} else if cached := cache.cached(ids[1]); len(cached) != 0 {
+		t.Fatal(cached)
+	} else if _, err = col.Read(ids[1]); err == nil {
+		t.Fatal("did not error")
+	}
+	// A document that cannot be written through is removed
+	cache.failSet = true
+	if err = col.Update(ids[2], map[string]interface{}{"a": "uncached"}); err != nil {
+		t.Fatal(err)
+	} else if cached := cache.cached(ids[2]); len(cached) != 0 {
+		t.Fatal(cached)
+	} else if doc, err := col.Read(ids[2]); err != nil || doc["a"] != "uncached" {
+		t.Fatal(doc, err)
+	}
+	cache.failSet = false
+	// The cache remains plugged into the renamed collection, entries cached before truncation are not read
+	if err = db.Rename("col", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("renamed")
+	if doc, err := col.Read(ids[0]); err != nil || doc["a"] != "updated" {
+		t.Fatal(doc, err)
+	}
+	id, err := col.Insert(map[string]interface{}{"a": "new"})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = col.Read(id); err != nil {
+		t.Fatal(err)
+	} else if err = db.Truncate("renamed"); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.Read(id); err == nil {
+		t.Fatal("did not error")
+	}
+	// Unplugged cache is no longer consulted
+	gets := cache.gets
+	col.SetExternalCache(nil)
+	if _, err = col.Read(ids[0]); err == nil || cache.gets != gets {
+		t.Fatal(err, cache.gets)
+	}
+}
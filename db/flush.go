@@ -0,0 +1,118 @@
+// Background flush.
+//
+// Writes go to memory-mapped files, which the operating system writes to disk at its own pace, so a crash of the
+// machine may lose writes that have not reached the disk yet. Every data file keeps track of the extents written since
+// its last flush. A goroutine of each partition number flushes, every FlushInterval (data-config.json), the written
+// extents of the files of that partition number in all collections - the collection data and lookup files, the string
+// ID table and the index hash tables - which bounds the writes lost by a crash to roughly the interval. Writers do not
+// wait for a flush, except for a write that grows a file being flushed.
+
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/data"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+const (
+	FLUSH_DISABLED_RECHECK = time.Second // Interval of checking whether background flush is enabled again.
+)
+
+// Start a flush goroutine for each partition number.
+func (db *DB) startFlushers() {
+	db.flushStop = make(chan struct{})
+	db.flushers = new(sync.WaitGroup)
+	for i := 0; i < db.numParts; i++ {
+		db.flushers.Add(1)
+		go func(partNum int) {
+			defer db.flushers.Done()
+			for {
+				db.schemaLock.RLock()
+				interval := time.Duration(db.Config.FlushInterval) * time.Millisecond
+				db.schemaLock.RUnlock()
+				wait := interval
+				if wait <= 0 {
+					wait = FLUSH_DISABLED_RECHECK
+				}
+				select {
+				case <-db.flushStop:
+					return
+				case <-time.After(wait):
+				}
+				if interval > 0 {
+					if err := db.flushPart(partNum); err != nil {
+						tdlog.CritNoRepeat("Failed to flush partition %d of %s: %v", partNum, db.path, err)
+					}
+				}
+			}
+		}(i)
+	}
+}
+
+// Stop the flush goroutines, waiting for flushes in progress to finish.
+func (db *DB) stopFlushers() {
+	if db.flushStop != nil {
+		close(db.flushStop)
+		db.flushers.Wait()
+		db.flushStop = nil
+	}
+}
+
+// Return the files of the partition number in all collections, including the time series segments assigned to it.
+// Does not place schema lock.
+func (db *DB) partFiles(partNum int) (files []*data.DataFile) {
+	for _, col := range db.cols {
+		files = append(files, col.parts[partNum].DataFiles()...)
+		files = append(files, col.strIDs[partNum].DataFile)
+		for _, ht := range col.hts[partNum] {
+			files = append(files, ht.DataFile)
+		}
+	}
+	for _, ts := range db.series {
+		files = append(files, ts.partFiles(partNum)...)
+	}
+	return
+}
+
+// Flush the written extents of the files of the partition number in all collections. The files are flushed without
+// holding schema lock, a file closed meanwhile is skipped.
+func (db *DB) flushPart(partNum int) error {
+	db.schemaLock.RLock()
+	files := db.partFiles(partNum)
+	db.schemaLock.RUnlock()
+	for _, file := range files {
+		if err := file.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply the queued changes of eventual indexes and flush the written extents of the files of all collections. Does not
+// place schema lock.
+func (db *DB) flushAll() error {
+	for _, col := range db.cols {
+		col.applyEventual()
+	}
+	for i := 0; i < db.numParts; i++ {
+		for _, file := range db.partFiles(i) {
+			if err := file.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Flush the data written to all collections to disk, and wait for the writes to complete.
+func (db *DB) Flush() error {
+	for i := 0; i < db.numParts; i++ {
+		if err := db.flushPart(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
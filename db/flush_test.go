@@ -0,0 +1,78 @@
+package db
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFlush(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	// Flush constantly while documents are written, indexed and the collection is truncated
+	db.schemaLock.Lock()
+	db.Config.FlushInterval = 1
+	db.schemaLock.Unlock()
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 300; j++ {
+				id, err := col.Insert(map[string]interface{}{"a": j, "_id": string(rune('a'+i)) + string(rune(j))})
+				if err != nil {
+					t.Error(err)
+					return
+				} else if err = col.Update(id, map[string]interface{}{"a": j + 1, "b": "grown beyond the room of the document"}); err != nil {
+					t.Error(err)
+					return
+				} else if j%3 == 0 {
+					if err = col.Delete(id); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			if err := db.Flush(); err != nil {
+				t.Error(err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if err := db.Truncate("col"); err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+	time.Sleep(10 * time.Millisecond)
+	if err = db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Background flush may be disabled
+	db.schemaLock.Lock()
+	db.Config.FlushInterval = 0
+	db.schemaLock.Unlock()
+	if _, err = col.Insert(map[string]interface{}{"a": 1}); err != nil {
+		t.Fatal(err)
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
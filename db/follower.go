@@ -0,0 +1,322 @@
+// Read replica.
+//
+// A database opened by OpenFollower is a read replica of another database: it follows the backups of that database
+// dropped into a directory - such as the scheduled backups of package backup, synced via rsync or from object storage
+// - and refuses writes with ErrorReadOnly. Backups are ordered by file name; a backup since sequence number 0 is full,
+// the others are incremental. Upon every poll the follower looks for the last full backup. If the follower has not
+// applied it yet, every collection is restored (see RestoreCol) from it and the incremental backups following it, and
+// collections absent from them are dropped. Otherwise the incremental backups added since the last poll are applied in
+// place. Readers see a restored collection swapped in at once, and the changes of an incremental backup as they are
+// applied.
+//
+// Settings and indexes of the collections are the follower's own, they may be changed on the follower. Hooks do not
+// fire for replicated changes; materialized views are replicated as the collections holding them.
+
+package db
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+const (
+	FOLLOWER_BACKUP_EXT = ".jsonl" // Extension of the backup files followed by a read replica.
+)
+
+// The backups followed by a read replica.
+type follower struct {
+	lock    *sync.Mutex
+	source  string      // Directory of the backups
+	applied []string    // Backups applied, from the last full backup onwards
+	seq     int         // Sequence number covered by the last backup applied
+	seqLock *sync.Mutex // Guard seq, which readers ask for while backups are applied
+	stop    chan struct{}
+	stopped chan struct{}
+	once    *sync.Once
+}
+
+// Open database as a read replica of the backups in the source directory, and apply new backups at the interval. The
+// backups found upon opening are applied before returning; failing that, the replica opens nonetheless and retries at
+// the interval.
+func OpenFollower(dbPath, source string, interval time.Duration) (*DB, error) {
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		return db, err
+	}
+	f := &follower{lock: new(sync.Mutex), seqLock: new(sync.Mutex), source: source, stop: make(chan struct{}), stopped: make(chan struct{}), once: new(sync.Once)}
+	db.follower = f
+	if err = db.SyncFollower(); err != nil {
+		tdlog.Noticef("Replica %s failed to apply the backups in %s: %v", dbPath, source, err)
+	}
+	go func() {
+		defer close(f.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-f.stop:
+				return
+			case <-ticker.C:
+				if err := db.SyncFollower(); err != nil {
+					tdlog.CritNoRepeat("Replica %s failed to apply the backups in %s: %v", dbPath, source, err)
+				}
+			}
+		}
+	}()
+	return db, nil
+}
+
+// Stop polling for backups, waiting for a poll in progress to finish.
+func (f *follower) halt() {
+	f.once.Do(func() {
+		close(f.stop)
+		<-f.stopped
+	})
+}
+
+// Remember the sequence number covered by the last backup applied. The caller holds the follower's lock.
+func (f *follower) setSeq(seq int) {
+	f.seqLock.Lock()
+	f.seq = seq
+	f.seqLock.Unlock()
+}
+
+// Return ErrorReadOnly if the database is a read replica.
+func (db *DB) checkWritable() error {
+	if db.follower != nil {
+		return dberr.New(dberr.ErrorReadOnly)
+	}
+	return nil
+}
+
+// Return true if the database is a read replica.
+func (db *DB) IsFollower() bool {
+	return db.follower != nil
+}
+
+// Apply the backups added to the source directory of the read replica since the last poll.
+func (db *DB) SyncFollower() error {
+	f := db.follower
+	if f == nil {
+		return dberr.New(dberr.ErrorInvalidParam, "replica", db.path)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	files, err := ioutil.ReadDir(f.source)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), FOLLOWER_BACKUP_EXT) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	// Backups after the last one applied are incremental, unless a full backup is among them
+	for i := len(names) - 1; i >= 0; i-- {
+		if len(f.applied) > 0 && names[i] == f.applied[len(f.applied)-1] {
+			for _, name := range names[i+1:] {
+				if err = db.followIncremental(name); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		header, err := readBackupHeader(path.Join(f.source, names[i]))
+		if err != nil {
+			return err
+		} else if header.Since == 0 {
+			return db.followFull(names[i:])
+		}
+	}
+	// There is no full backup yet
+	return nil
+}
+
+// Read the header of a backup file.
+func readBackupHeader(filePath string) (header backupHeader, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	if err = json.NewDecoder(file).Decode(&header); err != nil {
+		err = dberr.New(dberr.ErrorInvalidJSON, filePath, err)
+	}
+	return
+}
+
+// Restore every collection of the replica from a full backup and the incremental backups following it.
+func (db *DB) followFull(chain []string) error {
+	f := db.follower
+	header, err := readBackupHeader(path.Join(f.source, chain[len(chain)-1]))
+	if err != nil {
+		return err
+	}
+	for _, name := range header.Cols {
+		readers := make([]io.Reader, 0, len(chain))
+		for _, backupName := range chain {
+			file, err := os.Open(path.Join(f.source, backupName))
+			if err != nil {
+				closeAll(readers)
+				return err
+			}
+			readers = append(readers, file)
+		}
+		err = db.restoreCol(name, io.MultiReader(readers...))
+		closeAll(readers)
+		if err != nil {
+			return err
+		}
+	}
+	if err = db.followDrops(header.Cols); err != nil {
+		return err
+	}
+	f.applied = chain
+	f.setSeq(header.Seq)
+	tdlog.Noticef("Replica %s restored from %s and %d incremental backups", db.path, chain[0], len(chain)-1)
+	return nil
+}
+
+// Close the files of a backup chain.
+func closeAll(readers []io.Reader) {
+	for _, reader := range readers {
+		reader.(*os.File).Close()
+	}
+}
+
+// Drop the collections of the replica that are absent from a backup.
+func (db *DB) followDrops(cols []string) error {
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	for name := range db.cols {
+		absent := true
+		for _, colName := range cols {
+			absent = absent && colName != name
+		}
+		if absent {
+			if err := db.drop(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Apply an incremental backup to the replica in place. Applying a backup again is harmless, so that a backup
+// interrupted by an error is applied again upon the next poll.
+func (db *DB) followIncremental(name string) error {
+	f := db.follower
+	file, err := os.Open(path.Join(f.source, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	var header backupHeader
+	if err = decoder.Decode(&header); err != nil {
+		return dberr.New(dberr.ErrorInvalidJSON, name, err)
+	} else if header.Since == 0 || header.Since > f.seq {
+		// The backup does not follow the ones applied
+		return dberr.New(dberr.ErrorInvalidParam, "backup since", header.Since)
+	} else if err = db.followDrops(header.Cols); err != nil {
+		return err
+	}
+	for lines := 1; ; lines++ {
+		var record backupRecord
+		if err = decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return dberr.New(dberr.ErrorInvalidJSON, name, err)
+		}
+		if record.Reset {
+			err = db.followReset(record.Col)
+		} else {
+			db.schemaLock.RLock()
+			if col, exists := db.cols[record.Col]; !exists {
+				err = dberr.New(dberr.ErrorNoCol, record.Col)
+			} else if record.Deleted {
+				err = col.replicate(record.ID, nil)
+			} else {
+				err = col.replicate(record.ID, record.Doc)
+			}
+			db.schemaLock.RUnlock()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	f.applied = append(f.applied, name)
+	f.setSeq(header.Seq)
+	return nil
+}
+
+// Create the collection if it does not exist, or empty it.
+func (db *DB) followReset(name string) error {
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	col, exists := db.cols[name]
+	if !exists {
+		return db.create(name)
+	}
+	err := col.truncate()
+	db.logReset(name)
+	return err
+}
+
+// Put a replicated document into the collection, or delete it if the document is nil. Unlike a write, the document is
+// not verified, and hooks do not fire. Does not place schema lock.
+func (col *Col) replicate(id int, docB []byte) error {
+	var doc, original map[string]interface{}
+	if docB != nil {
+		if err := col.unmarshalDoc(docB, &doc); err != nil {
+			return dberr.New(dberr.ErrorInvalidJSON, string(docB), err)
+		}
+	}
+	part := col.parts[id%col.db.numParts]
+	part.DataLock.Lock()
+	col.cache.invalidate(id)
+	originalB, readErr := part.Read(id)
+	var err error
+	if readErr != nil && doc == nil {
+		part.DataLock.Unlock()
+		return nil
+	} else if readErr != nil {
+		_, err = part.Insert(id, docB)
+	} else if doc == nil {
+		err = part.Delete(id)
+	} else {
+		err = part.Update(id, docB)
+	}
+	col.ext.update(id, docB, err)
+	part.DataLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if readErr == nil && col.unmarshalDoc(originalB, &original) == nil {
+		col.removeStrID(id, original)
+	}
+	if doc != nil {
+		col.putStrID(id, doc)
+	}
+	part.LockUpdate(id)
+	if original != nil {
+		col.unindexDoc(id, original)
+	}
+	if doc != nil {
+		col.indexDoc(id, doc)
+	}
+	part.UnlockUpdate(id)
+	return nil
+}
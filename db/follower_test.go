@@ -0,0 +1,171 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Write a backup of the leader into the source directory under the name.
+func writeBackup(t *testing.T, leader *DB, since int, source, name string) (seq int) {
+	file, err := os.Create(path.Join(source, name+FOLLOWER_BACKUP_EXT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if seq, err = leader.BackupSince(since, file); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// Return the number of documents whose path is indexed with the value.
+func countIndexed(t *testing.T, col *Col, path, value string) int {
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": value, "in": []interface{}{path}}, col, &result); err != nil {
+		t.Fatal(err)
+	}
+	return len(result)
+}
+
+func TestFollower(t *testing.T) {
+	leaderDir, followerDir, source := TEST_DATA_DIR+"/leader", TEST_DATA_DIR+"/follower", TEST_DATA_DIR+"/source"
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(source, 0700); err != nil {
+		t.Fatal(err)
+	}
+	leader, err := OpenDB(leaderDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	for _, name := range []string{"a", "b"} {
+		if err = leader.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := leader.Use("a")
+	ids := make([]int, 3)
+	for i := range ids {
+		if ids[i], err = a.Insert(map[string]interface{}{"n": fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = a.InsertStrID("x", map[string]interface{}{"n": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	// A replica without backups is empty, and applies the full backup once it appears
+	follower, err := OpenFollower(followerDir, source, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		follower.Close()
+	}()
+	if !follower.IsFollower() || leader.IsFollower() || len(follower.AllCols()) != 0 {
+		t.Fatal(follower.AllCols())
+	}
+	seq := writeBackup(t, leader, 0, source, "1")
+	if err = follower.SyncFollower(); err != nil {
+		t.Fatal(err)
+	} else if !follower.ColExists("a") || !follower.ColExists("b") {
+		t.Fatal(follower.AllCols())
+	}
+	fa := follower.Use("a")
+	if doc, err := fa.Read(ids[0]); err != nil || doc["n"] != "0" {
+		t.Fatal(doc, err)
+	} else if doc, err = fa.ReadStrID("x"); err != nil || doc["n"] != "x" {
+		t.Fatal(doc, err)
+	}
+	// Writes are refused, indexes are the replica's own
+	if _, err = fa.Insert(map[string]interface{}{}); dberr.Type(err) != dberr.ErrorReadOnly {
+		t.Fatal(err)
+	} else if err = fa.Update(ids[0], map[string]interface{}{}); dberr.Type(err) != dberr.ErrorReadOnly {
+		t.Fatal(err)
+	} else if err = fa.Delete(ids[0]); dberr.Type(err) != dberr.ErrorReadOnly {
+		t.Fatal(err)
+	} else if err = follower.Create("c"); dberr.Type(err) != dberr.ErrorReadOnly {
+		t.Fatal(err)
+	} else if err = follower.Drop("a"); dberr.Type(err) != dberr.ErrorReadOnly {
+		t.Fatal(err)
+	} else if err = fa.Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	} else if n := countIndexed(t, fa, "n", "1"); n != 1 {
+		t.Fatal(n)
+	}
+	// Incremental backups are applied in place
+	if err = a.Update(ids[0], map[string]interface{}{"n": "updated"}); err != nil {
+		t.Fatal(err)
+	} else if err = a.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	} else if err = a.UpdateStrID("x", map[string]interface{}{"n": "y"}); err != nil {
+		t.Fatal(err)
+	} else if err = leader.Drop("b"); err != nil {
+		t.Fatal(err)
+	} else if err = leader.Create("c"); err != nil {
+		t.Fatal(err)
+	}
+	cID, err := leader.Use("c").Insert(map[string]interface{}{"c": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq = writeBackup(t, leader, seq, source, "2")
+	if err = follower.SyncFollower(); err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := fa.Read(ids[0]); err != nil || doc["n"] != "updated" {
+		t.Fatal(doc, err)
+	} else if _, err = fa.Read(ids[1]); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if doc, err = fa.ReadStrID("x"); err != nil || doc["n"] != "y" {
+		t.Fatal(doc, err)
+	} else if follower.ColExists("b") || !follower.ColExists("c") {
+		t.Fatal(follower.AllCols())
+	} else if _, err = follower.Use("c").Read(cID); err != nil {
+		t.Fatal(err)
+	} else if countIndexed(t, fa, "n", "0") != 0 || countIndexed(t, fa, "n", "updated") != 1 || countIndexed(t, fa, "n", "1") != 0 {
+		t.Fatal("index is not maintained")
+	}
+	// Polling again applies nothing, a backup that does not follow the ones applied is refused
+	if err = follower.SyncFollower(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Insert(map[string]interface{}{"n": "skipped"}); err != nil {
+		t.Fatal(err)
+	}
+	skipped := leader.ChangeSeq()
+	if _, err = a.Insert(map[string]interface{}{"n": "gap"}); err != nil {
+		t.Fatal(err)
+	}
+	writeBackup(t, leader, skipped, source, "3")
+	if err = follower.SyncFollower(); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+	// A new full backup restores every collection
+	if err = leader.Rename("c", "d"); err != nil {
+		t.Fatal(err)
+	}
+	writeBackup(t, leader, 0, source, "4")
+	if err = follower.SyncFollower(); err != nil {
+		t.Fatal(err)
+	} else if follower.ColExists("c") || !follower.ColExists("d") {
+		t.Fatal(follower.AllCols())
+	}
+	fa = follower.Use("a")
+	if countIndexed(t, fa, "n", "gap") != 1 || countIndexed(t, fa, "n", "skipped") != 1 {
+		t.Fatal("restored collection is not indexed")
+	}
+	// The replica resumes from the last full backup after reopening
+	if err = follower.Close(); err != nil {
+		t.Fatal(err)
+	} else if follower, err = OpenFollower(followerDir, source, time.Hour); err != nil {
+		t.Fatal(err)
+	} else if _, err = follower.Use("d").Read(cID); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+// Read-your-writes consistency.
+//
+// Every change made to the database is assigned a sequence number (see backup.go), so that the sequence number after
+// a write tells the changes a client has seen. A client reading afterwards - from a read replica that applies backups
+// at intervals, or through an index built in the background - may demand that the read reflects at least those
+// changes: WaitSeq waits until a read replica has applied the backups covering the sequence number, and Col.WaitSeq
+// also until the indexes of the collection whose build started by the sequence number are published, and the changes
+// of its eventual indexes queued by then are applied (see eventual.go). A database accepting writes reflects its own
+// changes right away.
+
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+const (
+	SEQ_POLL_INTERVAL = 10 * time.Millisecond // Interval of checks whether the database caught up with a sequence number.
+)
+
+// Return the sequence number of the changes the database reflects: that of the last change made to the database, or
+// on a read replica, that of the source database covered by the last backup applied.
+func (db *DB) AppliedSeq() int {
+	if f := db.follower; f != nil {
+		f.seqLock.Lock()
+		defer f.seqLock.Unlock()
+		return f.seq
+	}
+	return db.ChangeSeq()
+}
+
+// Wait until the database reflects the changes up to the sequence number, fail with ErrorStale if the context is done
+// first. A database accepting writes never waits; it fails with ErrorInvalidParam if the sequence number is beyond
+// its last change, as the sequence number did not come from the database.
+func (db *DB) WaitSeq(ctx context.Context, seq int) error {
+	return db.waitSeq(ctx, seq, nil)
+}
+
+// Wait until the database reflects the changes up to the sequence number, the indexes of the collection whose build
+// started by then are published, and the changes of eventual indexes queued by then are applied, see WaitSeq.
+func (col *Col) WaitSeq(ctx context.Context, seq int) error {
+	return col.db.waitSeq(ctx, seq, func() bool {
+		col.db.schemaLock.RLock()
+		defer col.db.schemaLock.RUnlock()
+		for _, build := range col.building {
+			if build.seq <= seq {
+				return false
+			}
+		}
+		return !col.eventual.lagging(seq)
+	})
+}
+
+// Wait until the database reflects the changes up to the sequence number and published returns true (unless nil),
+// see WaitSeq.
+func (db *DB) waitSeq(ctx context.Context, seq int, published func() bool) error {
+	if seq < 0 || db.follower == nil && seq > db.ChangeSeq() {
+		return dberr.New(dberr.ErrorInvalidParam, "seq", seq)
+	}
+	ticker := time.NewTicker(SEQ_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		applied := db.AppliedSeq()
+		if applied >= seq && (published == nil || published()) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return dberr.New(dberr.ErrorStale, applied, seq)
+		case <-ticker.C:
+		}
+	}
+}
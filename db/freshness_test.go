@@ -0,0 +1,94 @@
+package db
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestWaitSeq(t *testing.T) {
+	leaderDir, followerDir, source := TEST_DATA_DIR+"/leader", TEST_DATA_DIR+"/follower", TEST_DATA_DIR+"/source"
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(source, 0700); err != nil {
+		t.Fatal(err)
+	}
+	leader, err := OpenDB(leaderDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	if err = leader.Create("a"); err != nil {
+		t.Fatal(err)
+	}
+	a := leader.Use("a")
+	if _, err = a.Insert(map[string]interface{}{"n": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	seq := leader.AppliedSeq()
+	if seq != leader.ChangeSeq() || seq == 0 {
+		t.Fatal(seq)
+	}
+	var cancels []context.CancelFunc
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+	short := func() context.Context {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		cancels = append(cancels, cancel)
+		return ctx
+	}
+	// The database accepting writes reflects them right away, and did not make changes beyond its last one
+	if err = leader.WaitSeq(short(), seq); err != nil {
+		t.Fatal(err)
+	} else if err = leader.WaitSeq(short(), seq+1); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if err = a.WaitSeq(short(), -1); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+	// An index built in the background is waited for
+	build, err := a.startIndexBuild([]string{"n"})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = a.WaitSeq(short(), seq); dberr.Type(err) != dberr.ErrorStale {
+		t.Fatal(err)
+	}
+	go a.runIndexBuild(build)
+	if err = a.WaitSeq(context.Background(), seq); err != nil {
+		t.Fatal(err)
+	} else if countIndexed(t, a, "n", "1") != 1 {
+		t.Fatal("Index is not published")
+	}
+	// A replica waits until it has applied the backups covering the sequence number
+	follower, err := OpenFollower(followerDir, source, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	if follower.AppliedSeq() != 0 {
+		t.Fatal(follower.AppliedSeq())
+	} else if err = follower.WaitSeq(short(), seq); dberr.Type(err) != dberr.ErrorStale {
+		t.Fatal(err)
+	}
+	writeBackup(t, leader, 0, source, "1")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		follower.SyncFollower()
+	}()
+	if err = follower.WaitSeq(context.Background(), seq); err != nil {
+		t.Fatal(err)
+	} else if follower.AppliedSeq() != seq {
+		t.Fatal(follower.AppliedSeq())
+	} else if err = follower.Use("a").WaitSeq(short(), seq); err != nil {
+		t.Fatal(err)
+	}
+	// A replica may be asked for changes it has yet to see
+	if err = follower.WaitSeq(short(), seq+1); dberr.Type(err) != dberr.ErrorStale {
+		t.Fatal(err)
+	}
+}
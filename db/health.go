@@ -0,0 +1,79 @@
+// Database health check.
+//
+// The check verifies that every collection partition and index file is open and still refers to the file on disk, it
+// optionally writes, reads back and removes a small file in the database directory to prove that the disk accepts
+// writes. The check places schema lock for reading, a wedged database will fail to answer it at all.
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+)
+
+const (
+	HEALTH_CHECK_FILE = "health-check-*" // Name pattern of the temporary file written and removed by read/write health check.
+)
+
+// Verify that all collection and index files are open and intact. If roundTrip is true, also verify that a file
+// written into the database directory reads back identically.
+func (db *DB) CheckHealth(roundTrip bool) error {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	for name, col := range db.cols {
+		for i, part := range col.parts {
+			if part == nil {
+				return fmt.Errorf("Partition %d of collection %s is not open", i, name)
+			} else if err := part.Check(); err != nil {
+				return err
+			} else if err := col.strIDs[i].Check(); err != nil {
+				return err
+			}
+			for _, ht := range col.hts[i] {
+				if err := ht.Check(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if roundTrip {
+		return db.checkRoundTrip()
+	}
+	return nil
+}
+
+// Write a uniquely named file into the database directory, read it back and remove it, concurrent checks do not get
+// in each other's way. Does not place schema lock.
+func (db *DB) checkRoundTrip() (err error) {
+	content := []byte(strconv.FormatInt(rand.Int63(), 10))
+	fh, err := os.CreateTemp(db.path, HEALTH_CHECK_FILE)
+	if err != nil {
+		return
+	}
+	checkPath := fh.Name()
+	defer func() {
+		if removeErr := os.Remove(checkPath); err == nil && removeErr != nil && !os.IsNotExist(removeErr) {
+			err = removeErr
+		}
+	}()
+	if _, err = fh.Write(content); err != nil {
+		fh.Close()
+		return
+	} else if err = fh.Sync(); err != nil {
+		fh.Close()
+		return
+	} else if err = fh.Close(); err != nil {
+		return
+	}
+	readBack, err := ioutil.ReadFile(checkPath)
+	if err != nil {
+		return
+	} else if !bytes.Equal(readBack, content) {
+		return fmt.Errorf("Health check file %s reads back %q instead of %q", checkPath, readBack, content)
+	}
+	return
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckHealth(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Use("col").Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.CheckHealth(false); err != nil {
+		t.Fatal(err)
+	} else if err = db.CheckHealth(true); err != nil {
+		t.Fatal(err)
+	}
+	if leftover, err := filepath.Glob(path.Join(TEST_DATA_DIR, HEALTH_CHECK_FILE)); err != nil || len(leftover) != 0 {
+		t.Fatal("Health check file is left behind", leftover, err)
+	}
+	// A removed index file is detected
+	if err = os.Rename(path.Join(TEST_DATA_DIR, "col", "a", "1"), path.Join(TEST_DATA_DIR, "col", "a", "x")); err != nil {
+		t.Fatal(err)
+	} else if err = db.CheckHealth(false); err == nil {
+		t.Fatal("Did not error")
+	}
+	if err = os.Rename(path.Join(TEST_DATA_DIR, "col", "a", "x"), path.Join(TEST_DATA_DIR, "col", "a", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.CheckHealth(false); err != nil {
+		t.Fatal(err)
+	}
+	// So is a removed document data file
+	if err = os.Remove(path.Join(TEST_DATA_DIR, "col", DOC_DATA_FILE+"0")); err != nil {
+		t.Fatal(err)
+	} else if err = db.CheckHealth(false); err == nil {
+		t.Fatal("Did not error")
+	}
+}
@@ -0,0 +1,195 @@
+// Document mutation hooks.
+//
+// Embedded users may register functions that are called after documents are inserted, updated or deleted, in order to
+// maintain derived data such as caches, denormalised views and external search indexes. A synchronous hook runs in the
+// goroutine that made the mutation, before the mutating method returns. An asynchronous hook runs in a goroutine of its
+// own and receives a copy of the document, so that the caller may reuse the document it gave to the mutating method;
+// the mutating method waits only if the hook falls behind by more than HOOK_QUEUE_LEN mutations. Hooks run after the
+// mutation is complete and locks are released, so they may use the collection. As a consequence, an asynchronous hook
+// receives the mutations made by one goroutine in order, yet mutations made concurrently - even to the same document -
+// may reach it in a different order than they were applied. The documents given to hooks must not be modified.
+
+package db
+
+import (
+	"sync"
+
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+const (
+	HOOK_QUEUE_LEN = 1024 // Number of mutations queued for an asynchronous hook before the mutating method waits.
+)
+
+const (
+	hookInsert = iota
+	hookUpdate
+	hookDelete
+	hookKinds
+)
+
+var hookKindNames = [hookKinds]string{"insert", "update", "delete"}
+
+// A mutation given to a hook. Doc is nil for deletion, original is nil for insertion.
+type hookEvent struct {
+	id            int
+	doc, original map[string]interface{}
+}
+
+// A registered hook.
+type hook struct {
+	fun     func(id int, doc, original map[string]interface{})
+	queue   chan hookEvent // Mutations not yet given to an asynchronous hook, nil for a synchronous hook
+	removed chan struct{}  // Closed when an asynchronous hook is removed, nil for a synchronous hook
+}
+
+// Hooks registered on a collection.
+type colHooks struct {
+	lock  *sync.RWMutex
+	hooks [hookKinds][]*hook
+}
+
+func newColHooks() *colHooks {
+	return &colHooks{lock: new(sync.RWMutex)}
+}
+
+// Call the hook function, a panic is logged rather than propagated into the mutating method.
+func (h *hook) call(kind, id int, doc, original map[string]interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			tdlog.Noticef("Hook on %s of document %d panicked: %v", hookKindNames[kind], id, r)
+		}
+	}()
+	h.fun(id, doc, original)
+}
+
+// Register a hook and return the function that removes it.
+func (hooks *colHooks) add(kind int, fun func(id int, doc, original map[string]interface{}), async bool) (remove func()) {
+	h := &hook{fun: fun}
+	if async {
+		h.queue, h.removed = make(chan hookEvent, HOOK_QUEUE_LEN), make(chan struct{})
+		go func() {
+			for {
+				select {
+				case event := <-h.queue:
+					h.call(kind, event.id, event.doc, event.original)
+				case <-h.removed:
+					// Mutations already queued are still given to the hook
+					for {
+						select {
+						case event := <-h.queue:
+							h.call(kind, event.id, event.doc, event.original)
+						default:
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+	hooks.lock.Lock()
+	hooks.hooks[kind] = append(hooks.hooks[kind], h)
+	hooks.lock.Unlock()
+	return func() {
+		hooks.lock.Lock()
+		defer hooks.lock.Unlock()
+		// The hook may be removed already
+		for i, registered := range hooks.hooks[kind] {
+			if registered == h {
+				hooks.hooks[kind] = append(hooks.hooks[kind][:i:i], hooks.hooks[kind][i+1:]...)
+				if h.removed != nil {
+					close(h.removed)
+				}
+				return
+			}
+		}
+	}
+}
+
+// Remove all hooks. Asynchronous hooks are still given the mutations already queued.
+func (hooks *colHooks) removeAll() {
+	hooks.lock.Lock()
+	defer hooks.lock.Unlock()
+	for kind, registered := range hooks.hooks {
+		for _, h := range registered {
+			if h.removed != nil {
+				close(h.removed)
+			}
+		}
+		hooks.hooks[kind] = nil
+	}
+}
+
+// Record a mutation in the change log and give it to the hooks registered for its kind. Must not be called while
+// holding schema or partition locks.
+func (col *Col) fireHooks(kind, id int, doc, original map[string]interface{}) {
+	col.logChange(id)
+	hooks := col.hooks
+	hooks.lock.RLock()
+	registered := hooks.hooks[kind]
+	hooks.lock.RUnlock()
+	// Hooks are called and queued without the lock, so that they may register and remove hooks, and so that a full
+	// queue does not hold up registration and removal of hooks
+	var asyncDoc map[string]interface{}
+	for _, h := range registered {
+		if h.queue == nil {
+			h.call(kind, id, doc, original)
+			continue
+		} else if asyncDoc == nil && doc != nil {
+			asyncDoc = copyDoc(doc)
+		}
+		// The mutation is not queued for a hook removed meanwhile
+		select {
+		case h.queue <- hookEvent{id: id, doc: asyncDoc, original: original}:
+		case <-h.removed:
+		}
+	}
+}
+
+// Return a deep copy of the document.
+func copyDoc(doc map[string]interface{}) map[string]interface{} {
+	docCopy := make(map[string]interface{}, len(doc))
+	for key, val := range doc {
+		docCopy[key] = copyDocValue(val)
+	}
+	return docCopy
+}
+
+// Return a deep copy of a document value.
+func copyDocValue(val interface{}) interface{} {
+	switch val := val.(type) {
+	case map[string]interface{}:
+		return copyDoc(val)
+	case []interface{}:
+		valCopy := make([]interface{}, len(val))
+		for i, elem := range val {
+			valCopy[i] = copyDocValue(elem)
+		}
+		return valCopy
+	}
+	return val
+}
+
+// Register a hook called with each newly inserted document, and return the function that removes the hook.
+// An asynchronous hook runs in a goroutine of its own, a synchronous hook runs before Insert returns.
+func (col *Col) OnInsert(fun func(id int, doc map[string]interface{}), async bool) (remove func()) {
+	return col.hooks.add(hookInsert, func(id int, doc, _ map[string]interface{}) {
+		fun(id, doc)
+	}, async)
+}
+
+// Register a hook called with each updated document and its original (nil if the original could not be deserialised),
+// and return the function that removes the hook.
+// An asynchronous hook runs in a goroutine of its own, a synchronous hook runs before the update method returns.
+func (col *Col) OnUpdate(fun func(id int, doc, original map[string]interface{}), async bool) (remove func()) {
+	return col.hooks.add(hookUpdate, fun, async)
+}
+
+// Register a hook called with each deleted document (nil if it could not be deserialised), and return the function that
+// removes the hook.
+// An asynchronous hook runs in a goroutine of its own, a synchronous hook runs before Delete returns.
+func (col *Col) OnDelete(fun func(id int, original map[string]interface{}), async bool) (remove func()) {
+	return col.hooks.add(hookDelete, func(id int, _, original map[string]interface{}) {
+		fun(id, original)
+	}, async)
+}
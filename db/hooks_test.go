@@ -0,0 +1,164 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("count"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	// Synchronous hooks see every mutation before the method returns
+	var events []string
+	removeInsert := col.OnInsert(func(id int, doc map[string]interface{}) {
+		events = append(events, "insert "+doc["a"].(string))
+	}, false)
+	removeUpdate := col.OnUpdate(func(id int, doc, original map[string]interface{}) {
+		events = append(events, "update "+original["a"].(string)+" "+doc["a"].(string))
+	}, false)
+	col.OnDelete(func(id int, original map[string]interface{}) {
+		events = append(events, "delete "+original["a"].(string))
+	}, false)
+	// Asynchronous hook maintains a derived collection
+	var wg sync.WaitGroup
+	counts := db.Use("count")
+	countID, err := counts.Insert(map[string]interface{}{"n": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeAsync := col.OnInsert(func(id int, doc map[string]interface{}) {
+		defer wg.Done()
+		if err := counts.UpdateFunc(countID, func(orig map[string]interface{}) (map[string]interface{}, error) {
+			return map[string]interface{}{"n": orig["n"].(float64) + 1}, nil
+		}); err != nil {
+			t.Error(err)
+		}
+	}, true)
+	wg.Add(2)
+	id, err := col.Insert(map[string]interface{}{"a": "1"})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = col.Insert(map[string]interface{}{"a": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.Update(id, map[string]interface{}{"a": "3"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.UpdateFunc(id, func(orig map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"a": "4"}, nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if err = col.UpdateBytesFunc(id, func(orig []byte) ([]byte, error) {
+		return []byte(`{"a": "5"}`), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Failed mutations are not given to hooks
+	if err = col.Update(12345, map[string]interface{}{"a": "x"}); err == nil {
+		t.Fatal("Did not error")
+	}
+	removeUpdate()
+	removeUpdate()
+	if err = col.Update(id, map[string]interface{}{"a": "6"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"insert 1", "insert 2", "update 1 3", "update 3 4", "update 4 5", "delete 6"}
+	if len(events) != len(expected) {
+		t.Fatal(events)
+	}
+	for i, event := range expected {
+		if events[i] != event {
+			t.Fatal(events)
+		}
+	}
+	wg.Wait()
+	if doc, err := counts.Read(countID); err != nil || doc["n"] != float64(2) {
+		t.Fatal(doc, err)
+	}
+	removeAsync()
+	// Hooks remain registered after scrub and rename
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Rename("col", "col2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Use("col2").Insert(map[string]interface{}{"a": "7"}); err != nil {
+		t.Fatal(err)
+	} else if events[len(events)-1] != "insert 7" {
+		t.Fatal(events)
+	}
+	removeInsert()
+	// A panicking hook does not fail the mutation
+	db.Use("col2").OnInsert(func(id int, doc map[string]interface{}) {
+		panic("hook panic")
+	}, false)
+	if _, err = db.Use("col2").Insert(map[string]interface{}{"a": "8"}); err != nil {
+		t.Fatal(err)
+	}
+	// An asynchronous hook receives a copy of the document
+	col2 := db.Use("col2")
+	proceed := make(chan struct{})
+	received := make(chan map[string]interface{}, 1)
+	removeSlow := col2.OnInsert(func(id int, doc map[string]interface{}) {
+		<-proceed
+		select {
+		case received <- doc:
+		default:
+		}
+	}, true)
+	doc := map[string]interface{}{"a": "9", "nested": map[string]interface{}{"b": "c"}}
+	if _, err = col2.Insert(doc); err != nil {
+		t.Fatal(err)
+	}
+	doc["nested"].(map[string]interface{})["b"] = "changed"
+	// A hook falling behind holds up mutations, yet not registration and removal of hooks
+	for i := 0; i < HOOK_QUEUE_LEN; i++ {
+		if _, err = col2.Insert(map[string]interface{}{"i": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inserted := make(chan error)
+	go func() {
+		_, err := col2.Insert(map[string]interface{}{"a": "10"})
+		inserted <- err
+	}()
+	registered := make(chan struct{})
+	go func() {
+		col2.OnDelete(func(id int, original map[string]interface{}) {}, false)()
+		close(registered)
+	}()
+	select {
+	case <-registered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Hook registration is held up by a full hook queue")
+	}
+	removeSlow()
+	if err = <-inserted; err != nil {
+		t.Fatal(err)
+	}
+	close(proceed)
+	if doc := <-received; doc["nested"].(map[string]interface{})["b"] != "c" {
+		t.Fatal(doc)
+	}
+}
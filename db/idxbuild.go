@@ -0,0 +1,346 @@
+// Online index build and removal.
+//
+// A new index is built in the background without blocking document writes: documents are scanned chunk by chunk,
+// while index changes made by concurrent inserts/updates/deletes are recorded in a side log. When the scan finishes,
+// the side log is replayed until it nearly runs dry, then the remaining entries are replayed and the index is
+// published under schema lock. Until then, the index is not visible to queries.
+// Likewise, an index may be removed without waiting for its files to be deleted.
+
+package db
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/data"
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+const (
+	INDEX_BUILD_PREFIX     = "~building~" // Prefix of index directory name while the index is being built.
+	INDEX_DROP_PREFIX      = "~dropped~"  // Prefix of index directory name while the removed index is being reclaimed.
+	INDEX_BUILD_CATCHUP    = 1000         // Publish the index once fewer side log entries than this were replayed in a round.
+	INDEX_BUILD_MAX_ROUNDS = 100          // Maximum number of side log replay rounds before the index is published regardless.
+)
+
+// Index change made by a concurrent document write during index build.
+type indexLogEntry struct {
+	id     int
+	keys   []int // Hash keys of the indexed values
+	remove bool  // Remove (instead of put) the entries
+}
+
+// An index being built.
+type indexBuild struct {
+	idxName string
+	idxPath []string
+	seq     int // Sequence number of the changes the database reflected when the build started (see AppliedSeq)
+	hts     []*data.HashTable
+	aborted bool // Set under schema lock when the collection is closed
+	logLock *sync.Mutex
+	log     []indexLogEntry
+}
+
+// Return the hash keys of the document's values on the index path.
+func (build *indexBuild) keys(doc map[string]interface{}) (keys []int) {
+	for _, idxVal := range indexValues(doc, build.idxPath) {
+		if idxVal != nil {
+			keys = append(keys, StrHash(valueText(idxVal)))
+		}
+	}
+	return
+}
+
+// Record an index change made to the document.
+func (build *indexBuild) record(id int, doc map[string]interface{}, remove bool) {
+	keys := build.keys(doc)
+	if len(keys) == 0 {
+		return
+	}
+	build.logLock.Lock()
+	build.log = append(build.log, indexLogEntry{id: id, keys: keys, remove: remove})
+	build.logLock.Unlock()
+}
+
+// Put an entry found by the document scan.
+func (build *indexBuild) scanned(key, id int) {
+	ht := build.hts[key%len(build.hts)]
+	ht.Lock.Lock()
+	ht.Put(key, id)
+	ht.Lock.Unlock()
+}
+
+// Put a logged entry unless it is already present, so that documents scanned and logged alike are indexed only once.
+func (build *indexBuild) put(key, id int) {
+	ht := build.hts[key%len(build.hts)]
+	ht.Lock.Lock()
+	for _, existing := range ht.Get(key, 0) {
+		if existing == id {
+			ht.Lock.Unlock()
+			return
+		}
+	}
+	ht.Put(key, id)
+	ht.Lock.Unlock()
+}
+
+// Remove an entry.
+func (build *indexBuild) remove(key, id int) {
+	ht := build.hts[key%len(build.hts)]
+	ht.Lock.Lock()
+	ht.Remove(key, id)
+	ht.Lock.Unlock()
+}
+
+// Apply and empty the side log, return the number of replayed entries.
+func (build *indexBuild) replay() int {
+	build.logLock.Lock()
+	log := build.log
+	build.log = nil
+	build.logLock.Unlock()
+	for _, entry := range log {
+		for _, key := range entry.keys {
+			if entry.remove {
+				build.remove(key, entry.id)
+			} else {
+				build.put(key, entry.id)
+			}
+		}
+	}
+	return len(log)
+}
+
+// Create an index on the path. Documents may be inserted, updated and deleted while the index is being built;
+// the function returns when the index is ready for queries.
+func (col *Col) Index(idxPath []string) error {
+	build, err := col.startIndexBuild(idxPath)
+	if err != nil {
+		return err
+	}
+	return col.runIndexBuild(build)
+}
+
+// Start building an index on the path in background and return immediately.
+// The index becomes available to queries when the build finishes, build failure is logged.
+func (col *Col) IndexInBackground(idxPath []string) error {
+	build, err := col.startIndexBuild(idxPath)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := col.runIndexBuild(build); err != nil {
+			tdlog.Noticef("Failed to build index %v in collection %s: %v", idxPath, col.name, err)
+		}
+	}()
+	return nil
+}
+
+// Return paths of the indexes being built.
+func (col *Col) PendingIndexes() (ret [][]string) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	ret = make([][]string, 0, len(col.building))
+	for _, build := range col.building {
+		pathCopy := make([]string, len(build.idxPath))
+		copy(pathCopy, build.idxPath)
+		ret = append(ret, pathCopy)
+	}
+	return
+}
+
+// Create index files and start recording concurrent index changes.
+func (col *Col) startIndexBuild(idxPath []string) (build *indexBuild, err error) {
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if err = checkIndexFuncs(idxPath); err != nil {
+		return
+	} else if _, exists := col.indexPaths[idxName]; exists {
+		return nil, dberr.New(dberr.ErrorIndexExists, idxPath)
+	} else if _, building := col.building[idxName]; building {
+		return nil, dberr.New(dberr.ErrorIndexBuilding, idxPath)
+	} else if err = col.checkIndexQuota(idxPath); err != nil {
+		return
+	}
+	buildDir := path.Join(col.db.path, col.name, INDEX_BUILD_PREFIX+idxName)
+	if err = os.MkdirAll(buildDir, 0700); err != nil {
+		return
+	}
+	build = &indexBuild{idxName: idxName, idxPath: idxPath, seq: col.db.AppliedSeq(), hts: make([]*data.HashTable, col.db.numParts), logLock: new(sync.Mutex)}
+	for i := 0; i < col.db.numParts; i++ {
+		if build.hts[i], err = col.fileConf.OpenHashTable(path.Join(buildDir, strconv.Itoa(i))); err != nil {
+			for _, ht := range build.hts[:i] {
+				ht.Close()
+			}
+			os.RemoveAll(buildDir)
+			return nil, err
+		}
+	}
+	col.building[idxName] = build
+	return
+}
+
+// Put all documents on the index being built, catch up with concurrent changes and publish the index.
+func (col *Col) runIndexBuild(build *indexBuild) error {
+	// Scan approx. 4k documents in each chunk, writers are blocked only for the duration of a chunk
+	col.db.schemaLock.RLock()
+	if build.aborted {
+		col.db.schemaLock.RUnlock()
+		return dberr.New(dberr.ErrorIndexAborted, build.idxPath, col.name)
+	}
+	partDiv := col.approxDocCount(false) / col.db.numParts / 4000
+	col.db.schemaLock.RUnlock()
+	if partDiv == 0 {
+		partDiv++
+	}
+	for iteratePart := 0; iteratePart < col.db.numParts; iteratePart++ {
+		for i := 0; i < partDiv; i++ {
+			col.db.schemaLock.RLock()
+			if build.aborted {
+				col.db.schemaLock.RUnlock()
+				return dberr.New(dberr.ErrorIndexAborted, build.idxPath, col.name)
+			}
+			part := col.parts[iteratePart]
+			part.DataLock.RLock()
+			part.ForEachDocView(i, partDiv, func(id int, doc []byte) bool {
+				var docObj map[string]interface{}
+				if err := col.unmarshalDoc(doc, &docObj); err != nil {
+					// Skip corrupted document
+					return true
+				}
+				for _, key := range build.keys(docObj) {
+					build.scanned(key, id)
+				}
+				return true
+			})
+			if i == partDiv-1 {
+				if err := part.AfterScan(); err != nil {
+					tdlog.Noticef("Failed to release memory of collection %s after scan: %v", col.name, err)
+				}
+			}
+			part.DataLock.RUnlock()
+			col.db.schemaLock.RUnlock()
+		}
+	}
+	// Catch up with concurrent changes without blocking writers
+	for round := 0; round < INDEX_BUILD_MAX_ROUNDS; round++ {
+		col.db.schemaLock.RLock()
+		if build.aborted {
+			col.db.schemaLock.RUnlock()
+			return dberr.New(dberr.ErrorIndexAborted, build.idxPath, col.name)
+		}
+		replayed := build.replay()
+		col.db.schemaLock.RUnlock()
+		if replayed < INDEX_BUILD_CATCHUP {
+			break
+		}
+	}
+	return col.publishIndex(build)
+}
+
+// Replay the remaining side log and make the index available to queries.
+func (col *Col) publishIndex(build *indexBuild) (err error) {
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	if build.aborted {
+		return dberr.New(dberr.ErrorIndexAborted, build.idxPath, col.name)
+	}
+	build.replay()
+	delete(col.building, build.idxName)
+	buildDir := path.Join(col.db.path, col.name, INDEX_BUILD_PREFIX+build.idxName)
+	for _, ht := range build.hts {
+		if err = ht.Close(); err != nil {
+			os.RemoveAll(buildDir)
+			return
+		}
+	}
+	idxDir := path.Join(col.db.path, col.name, build.idxName)
+	if err = os.Rename(buildDir, idxDir); err != nil {
+		os.RemoveAll(buildDir)
+		return
+	}
+	for i := 0; i < col.db.numParts; i++ {
+		if col.hts[i][build.idxName], err = col.fileConf.OpenHashTable(path.Join(idxDir, strconv.Itoa(i))); err != nil {
+			return
+		}
+	}
+	col.indexPaths[build.idxName] = build.idxPath
+	col.idxUsage[build.idxName] = new(indexUsage)
+	col.resetPlans()
+	return
+}
+
+// Remove an index without waiting for its files to be deleted. The index is immediately unavailable to queries and
+// no longer maintained by document writes, its files are reclaimed in background.
+func (col *Col) UnindexInBackground(idxPath []string) error {
+	col.db.schemaLock.Lock()
+	defer col.db.schemaLock.Unlock()
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, exists := col.indexPaths[idxName]; !exists {
+		return dberr.New(dberr.ErrorNoIndex, idxPath)
+	}
+	// Move the files out of the way so that the path may be indexed again right away
+	dropDir := path.Join(col.db.path, col.name, fmt.Sprintf("%s%d-%s", INDEX_DROP_PREFIX, time.Now().UnixNano(), idxName))
+	if err := os.Rename(path.Join(col.db.path, col.name, idxName), dropDir); err != nil {
+		return err
+	}
+	delete(col.indexPaths, idxName)
+	delete(col.idxUsage, idxName)
+	col.resetPlans()
+	hts := make([]*data.HashTable, col.db.numParts)
+	for i := 0; i < col.db.numParts; i++ {
+		hts[i] = col.hts[i][idxName]
+		delete(col.hts[i], idxName)
+	}
+	go func() {
+		for _, ht := range hts {
+			ht.Close()
+		}
+		if err := os.RemoveAll(dropDir); err != nil {
+			tdlog.Noticef("Failed to reclaim files of removed index %v in collection %s: %v", idxPath, col.name, err)
+		}
+	}()
+	return nil
+}
+
+// Record a document's index changes for the indexes being built. Does not place schema lock.
+func (col *Col) recordIndexChange(id int, doc map[string]interface{}, remove bool) {
+	for _, build := range col.building {
+		build.record(id, doc, remove)
+	}
+}
+
+// Abort all index builds and close their files. Does not place schema lock.
+func (col *Col) abortIndexBuilds() (errs []error) {
+	for idxName, build := range col.building {
+		build.aborted = true
+		for _, ht := range build.hts {
+			if err := ht.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		delete(col.building, idxName)
+	}
+	return
+}
+
+// Clear the indexes being built along with their side logs. Does not place schema lock.
+func (col *Col) clearIndexBuilds() error {
+	for _, build := range col.building {
+		build.logLock.Lock()
+		build.log = nil
+		build.logLock.Unlock()
+		for _, ht := range build.hts {
+			if err := ht.Clear(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestOnlineIndexBuild(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 5000)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"a": i % 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Write documents while the index is being built
+	if err = col.IndexInBackground([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.IndexInBackground([]string{"a"}); err == nil {
+		t.Fatal("Did not error")
+	}
+	wg := new(sync.WaitGroup)
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := worker; i < len(ids); i += 4 {
+				switch i % 3 {
+				case 0:
+					col.Update(ids[i], map[string]interface{}{"a": 1000 + i%100})
+				case 1:
+					col.Delete(ids[i])
+				default:
+					col.Insert(map[string]interface{}{"a": 2000 + i%100})
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	for len(col.PendingIndexes()) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(col.AllIndexes()) != 1 {
+		t.Fatal(col.AllIndexes())
+	}
+	// Every document must be found by its indexed value, and the index must not carry extra entries
+	expected := make(map[string]map[int]struct{})
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		var docObj map[string]interface{}
+		json.Unmarshal(doc, &docObj)
+		key, _ := json.Marshal(docObj["a"])
+		if expected[string(key)] == nil {
+			expected[string(key)] = make(map[int]struct{})
+		}
+		expected[string(key)][id] = struct{}{}
+		return true
+	})
+	for _, value := range []int{0, 1, 50, 1000, 1001, 1050, 2002, 2050} {
+		key, _ := json.Marshal(value)
+		q, err := runQuery(`{"eq": `+string(key)+`, "in": ["a"]}`, col)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(q) != len(expected[string(key)]) {
+			t.Fatal(value, len(q), len(expected[string(key)]))
+		}
+		for id := range expected[string(key)] {
+			if _, found := q[id]; !found {
+				t.Fatal(value, id)
+			}
+		}
+	}
+	// Scrubbing or dropping the collection aborts the build, and its caller is told so
+	for _, abort := range []func() error{func() error { return db.Scrub("col") }, func() error { return db.Drop("col") }} {
+		col := db.Use("col")
+		build, err := col.startIndexBuild([]string{"b"})
+		if err != nil {
+			t.Fatal(err)
+		} else if err = abort(); err != nil {
+			t.Fatal(err)
+		} else if err = col.runIndexBuild(build); dberr.Type(err) != dberr.ErrorIndexAborted {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIndexBuildLeftover(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	// An unfinished index build is neither loaded as an index nor kept around
+	leftover := path.Join(TEST_DATA_DIR, "col", INDEX_BUILD_PREFIX+"a")
+	if err = os.MkdirAll(leftover, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if len(db.Use("col").AllIndexes()) != 0 {
+		t.Fatal(db.Use("col").AllIndexes())
+	}
+	if _, err = os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err = db.Use("col").Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnindexInBackground(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = col.UnindexInBackground([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.UnindexInBackground([]string{"a"}); err == nil {
+		t.Fatal("Did not error")
+	}
+	if len(col.AllIndexes()) != 0 {
+		t.Fatal(col.AllIndexes())
+	}
+	// Writes carry on without the removed index, and the path may be indexed again right away
+	if err = col.Update(id, map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if q, err := runQuery(`{"eq": 2, "in": ["a"]}`, col); err != nil || !ensureMapHasKeys(q, id) {
+		t.Fatal(q, err)
+	}
+	// Files of the removed index are eventually reclaimed
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		content, err := ioutil.ReadDir(path.Join(TEST_DATA_DIR, "col"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reclaimed := true
+		for _, entry := range content {
+			if strings.HasPrefix(entry.Name(), INDEX_DROP_PREFIX) {
+				reclaimed = false
+			}
+		}
+		if reclaimed {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("Index files are not reclaimed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
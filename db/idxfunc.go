@@ -0,0 +1,135 @@
+// Indexes on derived values.
+//
+// An index path may start with the name of an index function prefixed by "@", the function derives the indexed values
+// from the document and the rest of the path. For example, path ["@lower", "email"] indexes the lower case of the
+// values along ["email"], and is queried like any other path: {"eq": "a@b.c", "in": ["@lower", "email"]}. Functions
+// may be chained, such as ["@year", "@trim", "date"]. Built-in functions are available in server mode; embedded usage
+// may register functions of its own by RegisterIndexFunc before opening the database.
+
+package db
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+const (
+	INDEX_FUNC_PREFIX = "@" // Prefix of index function name in an index path.
+)
+
+// IndexFunc derives the indexed values from a document and the rest of the index path following the function name.
+type IndexFunc func(doc map[string]interface{}, path []string) []interface{}
+
+var indexFuncs = make(map[string]IndexFunc)
+var indexFuncsLock = new(sync.RWMutex)
+
+// Register the built-in index functions. They are not in the initialiser of indexFuncs, which they refer to.
+func init() {
+	for name, fun := range map[string]IndexFunc{
+		"lower": mapIndexValues(func(val interface{}) interface{} {
+			if str, ok := val.(string); ok {
+				return strings.ToLower(str)
+			}
+			return val
+		}),
+		"upper": mapIndexValues(func(val interface{}) interface{} {
+			if str, ok := val.(string); ok {
+				return strings.ToUpper(str)
+			}
+			return val
+		}),
+		"trim": mapIndexValues(func(val interface{}) interface{} {
+			if str, ok := val.(string); ok {
+				return strings.TrimSpace(str)
+			}
+			return val
+		}),
+		"year": mapTimeValues(func(t time.Time) interface{} {
+			return float64(t.Year())
+		}),
+		"month": mapTimeValues(func(t time.Time) interface{} {
+			return float64(t.Month())
+		}),
+		"date": mapTimeValues(func(t time.Time) interface{} {
+			return t.Format("2006-01-02")
+		}),
+	} {
+		indexFuncs[name] = fun
+	}
+}
+
+// Register an index function under the name, replacing the function registered under the name, if any. Documents
+// written before a function is registered are not put on the indexes using it, so that functions should be registered
+// before opening databases.
+func RegisterIndexFunc(name string, fun IndexFunc) {
+	indexFuncsLock.Lock()
+	indexFuncs[name] = fun
+	indexFuncsLock.Unlock()
+}
+
+// Return the index function named by the path segment, or false if the segment does not name a registered function.
+func indexFunc(seg string) (fun IndexFunc, ok bool) {
+	if !strings.HasPrefix(seg, INDEX_FUNC_PREFIX) {
+		return nil, false
+	}
+	indexFuncsLock.RLock()
+	fun, ok = indexFuncs[strings.TrimPrefix(seg, INDEX_FUNC_PREFIX)]
+	indexFuncsLock.RUnlock()
+	return
+}
+
+// Return the values indexed on the path: the values along the path, or those derived by the index function the path
+// starts with. A path starting with an unknown function has no values.
+func indexValues(doc map[string]interface{}, path []string) []interface{} {
+	if len(path) == 0 || !strings.HasPrefix(path[0], INDEX_FUNC_PREFIX) {
+		return GetIn(doc, path)
+	} else if fun, ok := indexFunc(path[0]); ok {
+		return fun(doc, path[1:])
+	}
+	return nil
+}
+
+// Return an error if the path starts with an index function that is not registered.
+func checkIndexFuncs(path []string) error {
+	for _, seg := range path {
+		if !strings.HasPrefix(seg, INDEX_FUNC_PREFIX) {
+			break
+		} else if _, ok := indexFunc(seg); !ok {
+			return dberr.New(dberr.ErrorInvalidParam, "index function", seg)
+		}
+	}
+	return nil
+}
+
+// Return an index function applying the conversion to each value indexed on the rest of the path.
+func mapIndexValues(convert func(val interface{}) interface{}) IndexFunc {
+	return func(doc map[string]interface{}, path []string) (ret []interface{}) {
+		for _, val := range indexValues(doc, path) {
+			if val != nil {
+				ret = append(ret, convert(val))
+			}
+		}
+		return
+	}
+}
+
+// Return an index function applying the conversion to the time (UTC) of each value indexed on the rest of the path,
+// the values being Unix seconds or RFC 3339 strings. Other values are not indexed.
+func mapTimeValues(convert func(t time.Time) interface{}) IndexFunc {
+	return func(doc map[string]interface{}, path []string) (ret []interface{}) {
+		for _, val := range indexValues(doc, path) {
+			switch val := val.(type) {
+			case float64:
+				ret = append(ret, convert(time.Unix(int64(val), 0).UTC()))
+			case string:
+				if t, err := time.Parse(time.RFC3339, val); err == nil {
+					ret = append(ret, convert(t.UTC()))
+				}
+			}
+		}
+		return
+	}
+}
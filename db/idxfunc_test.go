@@ -0,0 +1,90 @@
+package db
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Return the IDs of documents whose value on the path equals the lookup value.
+func lookupIDs(t *testing.T, col *Col, value interface{}, path ...interface{}) map[int]struct{} {
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": value, "in": path}, col, &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestIndexFunc(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	RegisterIndexFunc("domain", func(doc map[string]interface{}, path []string) (ret []interface{}) {
+		for _, val := range indexValues(doc, path) {
+			if str, ok := val.(string); ok && strings.Contains(str, "@") {
+				ret = append(ret, str[strings.Index(str, "@")+1:])
+			}
+		}
+		return
+	})
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	// Documents written before the index is created are indexed by the build
+	ann, err := col.Insert(map[string]interface{}{"email": "Ann@Example.com", "joined": float64(1577836800)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = col.Index([]string{"@unknown", "email"}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+	for _, path := range [][]string{{"@lower", "email"}, {"@year", "joined"}, {"@domain", "@lower", "email"}, {"@date", "@trim", "since"}} {
+		if err = col.Index(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bob, err := col.Insert(map[string]interface{}{"email": "bob@example.COM", "joined": "2021-06-01T10:00:00+02:00", "since": " 2021-06-01T23:30:00-02:00 "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := lookupIDs(t, col, "ann@example.com", "@lower", "email"); len(result) != 1 {
+		t.Fatal(result)
+	} else if _, found := result[ann]; !found {
+		t.Fatal(result)
+	} else if result = lookupIDs(t, col, 2020, "@year", "joined"); len(result) != 1 {
+		t.Fatal(result)
+	} else if result = lookupIDs(t, col, 2021, "@year", "joined"); len(result) != 1 {
+		t.Fatal(result)
+	} else if result = lookupIDs(t, col, "example.com", "@domain", "@lower", "email"); len(result) != 2 {
+		t.Fatal(result)
+	} else if result = lookupIDs(t, col, "2021-06-02", "@date", "@trim", "since"); len(result) != 1 {
+		t.Fatal(result)
+	}
+	// Derived values are maintained upon update and delete
+	if err = col.Update(bob, map[string]interface{}{"email": "Bob@Other.org"}); err != nil {
+		t.Fatal(err)
+	} else if result := lookupIDs(t, col, "bob@example.com", "@lower", "email"); len(result) != 0 {
+		t.Fatal(result)
+	} else if result = lookupIDs(t, col, "bob@other.org", "@lower", "email"); len(result) != 1 {
+		t.Fatal(result)
+	} else if result = lookupIDs(t, col, 2021, "@year", "joined"); len(result) != 0 {
+		t.Fatal(result)
+	} else if err = col.Delete(ann); err != nil {
+		t.Fatal(err)
+	} else if result = lookupIDs(t, col, "example.com", "@domain", "@lower", "email"); len(result) != 0 {
+		t.Fatal(result)
+	}
+	// Materialized views match derived values
+	if err = db.CreateView("other", ViewDef{Source: "col", Query: map[string]interface{}{"eq": "other.org", "in": []interface{}{"@domain", "@lower", "email"}}}); err != nil {
+		t.Fatal(err)
+	} else if _, err = db.Use("other").Read(bob); err != nil {
+		t.Fatal(err)
+	}
+}
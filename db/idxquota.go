@@ -0,0 +1,56 @@
+// Index disk usage.
+//
+// Every index is a hash table file in each partition, pre-allocated ahead of its entries and grown as entries are
+// added. Index statistics report the size of each index's files, and a collection with MaxIndexBytes in its settings
+// refuses to create an index once the index files would exceed the quota: the new index is counted at the size of its
+// new, empty files, along with the indexes being built. An index that grows past the quota after its creation is not
+// removed; the quota keeps constrained devices from running out of space by indexes created carelessly.
+
+package db
+
+import (
+	"github.com/cankansin/tiedot/data"
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Return the size of the hash table file.
+func htBytes(ht *data.HashTable) int64 {
+	ht.Lock.RLock()
+	defer ht.Lock.RUnlock()
+	return int64(ht.Size)
+}
+
+// Return the total size of the files of the index in all partitions. Does not place schema lock.
+func (col *Col) indexBytes(idxName string) (size int64) {
+	for _, parts := range col.hts {
+		if ht, exists := parts[idxName]; exists {
+			size += htBytes(ht)
+		}
+	}
+	return
+}
+
+// Fail with ErrorIndexQuota if the collection's index files, those being built included, would exceed MaxIndexBytes
+// with the files of a new index. Does not place schema lock.
+func (col *Col) checkIndexQuota(idxPath []string) error {
+	if col.conf.MaxIndexBytes == 0 {
+		return nil
+	}
+	newSize := col.fileConf.HTInitialSize
+	if newSize == 0 {
+		newSize = col.fileConf.HTFileGrowth
+	}
+	total := int64(newSize) * int64(col.db.numParts)
+	for idxName := range col.indexPaths {
+		total += col.indexBytes(idxName)
+	}
+	for _, build := range col.building {
+		for _, ht := range build.hts {
+			total += htBytes(ht)
+		}
+	}
+	if total > int64(col.conf.MaxIndexBytes) {
+		return dberr.New(dberr.ErrorIndexQuota, idxPath, col.name, total, col.conf.MaxIndexBytes)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestIndexQuota(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	stats := col.IndexStats()
+	newIndex := int64(col.fileConf.HTInitialSize)
+	if newIndex == 0 {
+		newIndex = int64(col.fileConf.HTFileGrowth)
+	}
+	newIndex *= int64(db.numParts)
+	if len(stats) != 1 || stats[0].Bytes != newIndex {
+		t.Fatal(stats, newIndex)
+	}
+	// The quota counts the existing indexes and the files of the new one
+	if err = col.SetConfig(ColConfig{MaxIndexBytes: int(2*newIndex - 1)}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"b"}); dberr.Type(err) != dberr.ErrorIndexQuota {
+		t.Fatal(err)
+	} else if _, err = os.Stat(TEST_DATA_DIR + "/col/" + INDEX_BUILD_PREFIX + "b"); !os.IsNotExist(err) {
+		t.Fatal("Index files were created", err)
+	} else if err = col.SetConfig(ColConfig{MaxIndexBytes: int(2 * newIndex)}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"b"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.SetConfig(ColConfig{MaxIndexBytes: -1}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+// Index usage statistics.
+//
+// Queries count the hits of every index they use. Statistics are kept in memory since the collection was opened,
+// indexes that are rarely or never hit only slow down document writes and are candidates for removal. Internal lookups
+// - string IDs and the referrers of relations - are not hits; the indexes on relation paths are never unused, as
+// deleting a referenced document would have to scan the referring collection without them.
+
+package db
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Usage counters of an index, updated atomically.
+type indexUsage struct {
+	hits     int64
+	lastUsed int64 // Unix seconds
+}
+
+// IndexStats is the usage statistics of an index.
+type IndexStats struct {
+	Path     []string
+	Hits     int64 // Number of times queries used the index
+	LastUsed int64 // Time (Unix seconds) of the index's last use, 0 if it is not yet used
+	Bytes    int64 // Size of the index files, see MaxIndexBytes of ColConfig
+	Eventual bool  // True if the index is updated in background, see EventualIndexes of ColConfig
+	Queued   int   // Number of changes of the eventual index waiting to be applied
+}
+
+// Count a hit of the index. Does not place schema lock.
+func (col *Col) useIndex(idxName string) {
+	if usage, exists := col.idxUsage[idxName]; exists {
+		atomic.AddInt64(&usage.hits, 1)
+		atomic.StoreInt64(&usage.lastUsed, time.Now().Unix())
+	}
+}
+
+// Return usage statistics of all indexes, ordered by index path.
+func (col *Col) IndexStats() (ret []IndexStats) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	ret = make([]IndexStats, 0, len(col.indexPaths))
+	for idxName, idxPath := range col.indexPaths {
+		stats := IndexStats{Path: make([]string, len(idxPath)), Bytes: col.indexBytes(idxName), Eventual: col.eventual.maintains(idxName),
+			Queued: col.eventual.queued(idxName)}
+		copy(stats.Path, idxPath)
+		if usage, exists := col.idxUsage[idxName]; exists {
+			stats.Hits = atomic.LoadInt64(&usage.hits)
+			stats.LastUsed = atomic.LoadInt64(&usage.lastUsed)
+		}
+		ret = append(ret, stats)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return strings.Join(ret[i].Path, INDEX_PATH_SEP) < strings.Join(ret[j].Path, INDEX_PATH_SEP)
+	})
+	return
+}
+
+// Return paths of the indexes that were not used during the last idle duration (including those never used).
+func (col *Col) UnusedIndexes(idle time.Duration) (ret [][]string) {
+	ret = make([][]string, 0)
+	relPaths := make(map[string]struct{})
+	for _, rel := range col.Config().Relations {
+		relPaths[strings.Join(rel.Path, INDEX_PATH_SEP)] = struct{}{}
+	}
+	threshold := time.Now().Add(-idle).Unix()
+	for _, stats := range col.IndexStats() {
+		if _, isRelPath := relPaths[strings.Join(stats.Path, INDEX_PATH_SEP)]; stats.LastUsed < threshold && !isRelPath {
+			ret = append(ret, stats.Path)
+		}
+	}
+	return
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestIndexStats(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	for _, idxPath := range [][]string{{"a"}, {"b"}, {"c", "d"}} {
+		if err = col.Index(idxPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = col.Insert(map[string]interface{}{"a": 1, "b": 2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		`{"eq": 1, "in": ["a"]}`,
+		`{"has": ["a"]}`,
+		`{"n": [{"eq": 1, "in": ["a"]}, {"int-from": 1, "int-to": 3, "in": ["b"]}]}`,
+	} {
+		if _, err = runQuery(query, col); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := col.IndexStats()
+	if len(stats) != 3 || stats[0].Path[0] != "a" || stats[1].Path[0] != "b" || stats[2].Path[1] != "d" {
+		t.Fatal(stats)
+	}
+	if stats[0].Hits != 3 || stats[1].Hits != 1 || stats[2].Hits != 0 {
+		t.Fatal(stats)
+	}
+	if stats[0].LastUsed < time.Now().Add(-time.Minute).Unix() || stats[2].LastUsed != 0 {
+		t.Fatal(stats)
+	}
+	if unused := col.UnusedIndexes(time.Hour); len(unused) != 1 || unused[0][0] != "c" {
+		t.Fatal(unused)
+	}
+	// String ID lookups and relation checks are not hits, indexes on relation paths are never unused
+	if err = db.Create("other"); err != nil {
+		t.Fatal(err)
+	}
+	other := db.Use("other")
+	xID, err := other.InsertStrID("x", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = col.SetConfig(ColConfig{Relations: []Relation{{Path: []string{"c", "d"}, Target: "other"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = col.Insert(map[string]interface{}{"c": map[string]interface{}{"d": "x"}}); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.ReadStrID("nonexistent"); err == nil {
+		t.Fatal("Did not error")
+	} else if err = other.Delete(xID); dberr.Type(err) != dberr.ErrorReferenced {
+		t.Fatal(err)
+	}
+	if stats = col.IndexStats(); stats[2].Hits != 0 {
+		t.Fatal(stats)
+	} else if unused := col.UnusedIndexes(time.Hour); len(unused) != 0 {
+		t.Fatal(unused)
+	}
+	// Statistics start over when the path is indexed again
+	if err = col.Unindex([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if stats = col.IndexStats(); stats[0].Hits != 0 {
+		t.Fatal(stats)
+	}
+}
@@ -0,0 +1,90 @@
+// Reads in insertion order.
+//
+// Document IDs are random, so that neither they nor an index tell which documents were inserted last. A collection
+// with InsertOrder in its settings tracks the insertion order of its documents in memory, like capped collections and
+// those ordering query results by insertion do (see capped.go), and serves the most recently inserted documents by
+// Latest. A reader following the collection like "tail -f" remembers the last document it has seen and asks for those
+// inserted after it by InsertedAfter; the insertion order is that in which inserts completed, so that the reader does
+// not miss documents inserted concurrently. Updates keep a document's place in the order.
+
+package db
+
+import (
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Return the insertion order of the collection, fail with ErrorNoInsertOrder if the collection does not track it, or
+// with ErrorInvalidParam if the number of documents asked for is not positive.
+func (col *Col) insertOrder(n int) (*cappedDocs, error) {
+	col.db.schemaLock.RLock()
+	capped := col.capped
+	col.db.schemaLock.RUnlock()
+	if capped == nil {
+		return nil, dberr.New(dberr.ErrorNoInsertOrder, col.name)
+	} else if n < 1 {
+		return nil, dberr.New(dberr.ErrorInvalidParam, "number of documents", n)
+	}
+	return capped, nil
+}
+
+// Return the IDs of the n most recently inserted documents, newest first.
+func (col *Col) Latest(n int) ([]int, error) {
+	capped, err := col.insertOrder(n)
+	if err != nil {
+		return nil, err
+	}
+	capped.lock.Lock()
+	defer capped.lock.Unlock()
+	ids := make([]int, 0, n)
+	// The insertion order may still hold deleted documents, and the earlier insertions of an ID inserted again
+	seen := make(map[int]struct{}, n)
+	for i := len(capped.order) - 1; i >= 0 && len(ids) < n; i-- {
+		id := capped.order[i]
+		if _, exists := capped.sizes[id]; !exists {
+			continue
+		} else if _, dup := seen[id]; !dup {
+			seen[id] = struct{}{}
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Return the IDs of up to n documents inserted after the document, oldest first. Fail with ErrorNoDoc if the document
+// is no longer in the collection. Finding the document takes time in proportion to the number of documents inserted
+// after it.
+func (col *Col) InsertedAfter(id, n int) ([]int, error) {
+	capped, err := col.insertOrder(n)
+	if err != nil {
+		return nil, err
+	}
+	capped.lock.Lock()
+	defer capped.lock.Unlock()
+	if _, exists := capped.sizes[id]; !exists {
+		return nil, dberr.New(dberr.ErrorNoDoc, id)
+	}
+	// The latest insertion of the document is its place in the order
+	pos := len(capped.order) - 1
+	for capped.order[pos] != id {
+		pos--
+	}
+	// Collect the latest insertions backwards, then take the oldest of them
+	var ids []int
+	seen := make(map[int]struct{})
+	for i := len(capped.order) - 1; i > pos; i-- {
+		next := capped.order[i]
+		if _, exists := capped.sizes[next]; !exists {
+			continue
+		} else if _, dup := seen[next]; !dup {
+			seen[next] = struct{}{}
+			ids = append(ids, next)
+		}
+	}
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	return ids, nil
+}
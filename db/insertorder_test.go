@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestInsertOrder(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if _, err = col.Latest(1); dberr.Type(err) != dberr.ErrorNoInsertOrder {
+		t.Fatal(err)
+	} else if err = col.SetConfig(ColConfig{InsertOrder: true}); err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for i := 0; i < 6; i++ {
+		id, err := col.Insert(map[string]interface{}{"i": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if latest, err := col.Latest(3); err != nil || !reflect.DeepEqual(latest, []int{ids[5], ids[4], ids[3]}) {
+		t.Fatal(latest, err)
+	} else if latest, err = col.Latest(10); err != nil || len(latest) != 6 || latest[5] != ids[0] {
+		t.Fatal(latest, err)
+	} else if _, err = col.Latest(0); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+	if after, err := col.InsertedAfter(ids[1], 2); err != nil || !reflect.DeepEqual(after, []int{ids[2], ids[3]}) {
+		t.Fatal(after, err)
+	} else if after, err = col.InsertedAfter(ids[5], 2); err != nil || len(after) != 0 {
+		t.Fatal(after, err)
+	}
+	// Updates keep the place, deleted documents are left out, and a document inserted again moves to the end
+	doc, err := col.Read(ids[2])
+	if err != nil {
+		t.Fatal(err)
+	} else if err = col.Update(ids[3], map[string]interface{}{"i": 33}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(ids[4]); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(ids[2]); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.insertWithID(context.Background(), ids[2], doc, func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := col.InsertedAfter(ids[1], 10); err != nil || !reflect.DeepEqual(after, []int{ids[3], ids[5], ids[2]}) {
+		t.Fatal(after, err)
+	} else if after, err = col.InsertedAfter(ids[5], 10); err != nil || !reflect.DeepEqual(after, []int{ids[2]}) {
+		t.Fatal(after, err)
+	} else if _, err = col.InsertedAfter(ids[4], 10); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	if latest, err := col.Latest(2); err != nil || !reflect.DeepEqual(latest, []int{ids[2], ids[5]}) {
+		t.Fatal(latest, err)
+	}
+}
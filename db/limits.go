@@ -0,0 +1,76 @@
+// Document limits.
+//
+// Documents larger than MaxDocSize or nested deeper than MaxDocDepth (see data-config.json) are refused before they are
+// written, so that a pathological document cannot exhaust memory of the database or of the programs reading it. The
+// depth of a serialised document is measured without parsing it, HTTP API uses the check to refuse a payload before
+// parsing it.
+
+package db
+
+import (
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Return the maximum size (in bytes) of a serialised document.
+func (db *DB) MaxDocSize() int {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	return db.maxDocSize()
+}
+
+// Return the maximum size of a serialised document. Does not place schema lock.
+func (db *DB) maxDocSize() int {
+	if db.Config.MaxDocSize > 0 && db.Config.MaxDocSize < db.Config.DocMaxRoom {
+		return db.Config.MaxDocSize
+	}
+	return db.Config.DocMaxRoom
+}
+
+// Return an error if the serialised document exceeds the maximum size or nesting depth. The document does not have to
+// be valid JSON.
+func (db *DB) CheckDocLimits(docJS []byte) error {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	return db.checkDocLimits(docJS)
+}
+
+// Return an error if the serialised document exceeds the maximum size or nesting depth. Does not place schema lock.
+func (db *DB) checkDocLimits(docJS []byte) error {
+	// Without MaxDocSize, collection partitions refuse documents exceeding DocMaxRoom on their own
+	if maxSize := db.maxDocSize(); db.Config.MaxDocSize > 0 && len(docJS) > maxSize {
+		return dberr.New(dberr.ErrorDocTooLarge, maxSize, len(docJS))
+	} else if maxDepth := db.Config.MaxDocDepth; maxDepth > 0 && jsonDepthExceeds(docJS, maxDepth) {
+		return dberr.New(dberr.ErrorDocTooDeep, maxDepth)
+	}
+	return nil
+}
+
+// Return true if objects and arrays in the serialised JSON are nested deeper than the maximum depth. The top level
+// object is at depth 1.
+func jsonDepthExceeds(js []byte, maxDepth int) bool {
+	depth := 0
+	inString, escaped := false, false
+	for _, c := range js {
+		if inString {
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			if depth++; depth > maxDepth {
+				return true
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return false
+}
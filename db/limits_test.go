@@ -0,0 +1,95 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestJSONDepthExceeds(t *testing.T) {
+	cases := []struct {
+		js       string
+		maxDepth int
+		exceeds  bool
+	}{
+		{`{}`, 1, false},
+		{`{"a": {}}`, 1, true},
+		{`{"a": [1, {"b": 2}]}`, 3, false},
+		{`{"a": [1, {"b": 2}]}`, 2, true},
+		{`{"a": "[[[{{{"}`, 1, false},
+		{`{"a": "\"[[["}`, 1, false},
+		{`{"a": "\\", "b": [[]]}`, 2, true},
+	}
+	for _, c := range cases {
+		if exceeds := jsonDepthExceeds([]byte(c.js), c.maxDepth); exceeds != c.exceeds {
+			t.Fatal(c.js, c.maxDepth, exceeds)
+		}
+	}
+}
+
+func TestDocLimits(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if db.MaxDocSize() != db.Config.DocMaxRoom {
+		t.Fatal(db.MaxDocSize())
+	}
+	db.Config.MaxDocSize = 100
+	db.Config.MaxDocDepth = 3
+	if db.MaxDocSize() != 100 {
+		t.Fatal(db.MaxDocSize())
+	}
+	id, err := col.Insert(map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Too large
+	large := map[string]interface{}{"a": strings.Repeat("x", 100)}
+	if _, err = col.Insert(large); dberr.Type(err) != dberr.ErrorDocTooLarge {
+		t.Fatal(err)
+	} else if err = col.Update(id, large); dberr.Type(err) != dberr.ErrorDocTooLarge {
+		t.Fatal(err)
+	}
+	// Too deep
+	deep := map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{[]interface{}{1}}}}
+	if _, err = col.Insert(deep); dberr.Type(err) != dberr.ErrorDocTooDeep {
+		t.Fatal(err)
+	} else if err = col.Update(id, deep); dberr.Type(err) != dberr.ErrorDocTooDeep {
+		t.Fatal(err)
+	} else if err = col.UpdateBytesFunc(id, func(orig []byte) ([]byte, error) {
+		return []byte(`{"a": [[[[]]]]}`), nil
+	}); dberr.Type(err) != dberr.ErrorDocTooDeep {
+		t.Fatal(err)
+	} else if err = db.CheckDocLimits([]byte(`[[[[`)); dberr.Type(err) != dberr.ErrorDocTooDeep {
+		t.Fatal(err)
+	}
+	// The refused changes are not made
+	if doc, err := col.Read(id); err != nil || len(doc["a"].(map[string]interface{})["b"].([]interface{})) != 1 {
+		t.Fatal(doc, err)
+	}
+	// Limits are lifted
+	db.Config.MaxDocSize = 0
+	db.Config.MaxDocDepth = 0
+	if _, err = col.Insert(large); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.Insert(deep); err != nil {
+		t.Fatal(err)
+	}
+}
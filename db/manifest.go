@@ -0,0 +1,264 @@
+// Database layout manifests.
+//
+// A manifest describes the logical layout of a database without any of its documents: the number of partitions, the
+// data file settings, the collections along with their indexes and settings, views, time series collections and stored
+// queries. Saved as JSON, a manifest sets up the same layout in a new database directory - such as a test or staging
+// environment made like production - and tells the differences of a database from it, to detect drift. Placement of
+// collections in other directories depends on the machine and is not part of the manifest.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cankansin/tiedot/data"
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Manifest is the logical layout of a database.
+type Manifest struct {
+	NumParts      int                         // Number of partitions
+	DataConfig    data.Config                 // Data file settings, as in data-config.json
+	Cols          map[string]ColManifest      // Collections (including views) by name
+	TimeSeries    map[string]TimeSeriesConfig // Time series collections by name
+	StoredQueries map[string]StoredQuery      // Stored queries by name
+}
+
+// ColManifest is the layout of a collection.
+type ColManifest struct {
+	Indexes [][]string // Indexed paths, in the order of index names
+	Config  ColConfig  // Collection settings
+	View    *ViewDef   `json:",omitempty"` // Definition of the view, nil unless the collection is a view
+}
+
+// Return the manifest of the database layout.
+func (db *DB) Manifest() Manifest {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	m := Manifest{NumParts: db.numParts, DataConfig: *db.Config, Cols: make(map[string]ColManifest, len(db.cols)),
+		TimeSeries: make(map[string]TimeSeriesConfig, len(db.series)), StoredQueries: make(map[string]StoredQuery, len(db.queries))}
+	for name, col := range db.cols {
+		idxNames := make([]string, 0, len(col.indexPaths))
+		for idxName := range col.indexPaths {
+			idxNames = append(idxNames, idxName)
+		}
+		sort.Strings(idxNames)
+		colManifest := ColManifest{Indexes: make([][]string, len(idxNames)), Config: col.copyConfig()}
+		for i, idxName := range idxNames {
+			colManifest.Indexes[i] = append([]string(nil), col.indexPaths[idxName]...)
+		}
+		if v, isView := db.views[name]; isView {
+			def := v.def
+			colManifest.View = &def
+		}
+		m.Cols[name] = colManifest
+	}
+	for name, ts := range db.series {
+		m.TimeSeries[name] = ts.Config()
+	}
+	for name, sq := range db.queries {
+		m.StoredQueries[name] = sq
+	}
+	return m
+}
+
+// Set up the layout of the manifest in a new database directory, which must not exist or be empty, and return the
+// opened database. Collections and views are created along with their indexes first, their settings applied next, and
+// then the time series collections and stored queries. A database failing to set up is closed and left in the
+// directory as it is.
+func CreateFromManifest(dir string, m Manifest) (*DB, error) {
+	if entries, err := ioutil.ReadDir(dir); err == nil && len(entries) > 0 {
+		return nil, dberr.New(dberr.ErrorInvalidParam, "database directory (it is not empty)", dir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if m.NumParts < 1 {
+		return nil, dberr.New(dberr.ErrorInvalidParam, "number of partitions", m.NumParts)
+	}
+	dataConfig, err := json.MarshalIndent(m.DataConfig, "", "  ")
+	if err != nil {
+		return nil, err
+	} else if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	} else if err = ioutil.WriteFile(path.Join(dir, PART_NUM_FILE), []byte(strconv.Itoa(m.NumParts)), 0600); err != nil {
+		return nil, err
+	} else if err = ioutil.WriteFile(path.Join(dir, "data-config.json"), dataConfig, 0600); err != nil {
+		return nil, err
+	}
+	db, err := OpenDB(dir)
+	if err != nil {
+		return nil, err
+	} else if err = db.applyManifest(m); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Create the collections, views, time series collections and stored queries of the manifest in the database.
+func (db *DB) applyManifest(m Manifest) error {
+	names := make([]string, 0, len(m.Cols))
+	for name := range m.Cols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	index := func(name string) error {
+		for _, idxPath := range m.Cols[name].Indexes {
+			if err := db.Use(name).Index(idxPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, name := range names {
+		if m.Cols[name].View != nil {
+			continue
+		} else if err := db.Create(name); err != nil {
+			return err
+		} else if err = index(name); err != nil {
+			return err
+		}
+	}
+	// A view is created once its source exists, which may be another view
+	for created := true; created; {
+		created = false
+		for _, name := range names {
+			def := m.Cols[name].View
+			if def == nil || db.ColExists(name) || !db.ColExists(def.Source) {
+				continue
+			} else if err := db.CreateView(name, *def); err != nil {
+				return err
+			} else if err = index(name); err != nil {
+				return err
+			}
+			created = true
+		}
+	}
+	for _, name := range names {
+		if !db.ColExists(name) {
+			return dberr.New(dberr.ErrorNoCol, m.Cols[name].View.Source)
+		} else if err := db.Use(name).SetConfig(m.Cols[name].Config); err != nil {
+			return err
+		}
+	}
+	for name, conf := range m.TimeSeries {
+		if err := db.CreateTimeSeries(name, conf); err != nil {
+			return err
+		}
+	}
+	for name, sq := range m.StoredQueries {
+		if err := db.StoreQuery(name, sq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the differences of the database layout from the manifest, one sentence each, none if the layout matches.
+func (db *DB) ManifestDiff(m Manifest) (diffs []string) {
+	have := db.Manifest()
+	if have.NumParts != m.NumParts {
+		diffs = append(diffs, fmt.Sprintf("number of partitions is %d, the manifest has %d", have.NumParts, m.NumParts))
+	}
+	diffs = append(diffs, diffFields("data file setting", have.DataConfig, m.DataConfig)...)
+	for _, name := range unionNames(have.Cols, m.Cols) {
+		col, exists := have.Cols[name]
+		want, inManifest := m.Cols[name]
+		if !exists {
+			diffs = append(diffs, fmt.Sprintf("collection %s is missing", name))
+			continue
+		} else if !inManifest {
+			diffs = append(diffs, fmt.Sprintf("collection %s is not in the manifest", name))
+			continue
+		}
+		indexes, wantIndexes := make(map[string]bool), make(map[string]bool)
+		for _, idxPath := range col.Indexes {
+			indexes[strings.Join(idxPath, INDEX_PATH_SEP)] = true
+		}
+		for _, idxPath := range want.Indexes {
+			if idxName := strings.Join(idxPath, INDEX_PATH_SEP); !indexes[idxName] {
+				diffs = append(diffs, fmt.Sprintf("index %v of collection %s is missing", idxPath, name))
+			} else {
+				wantIndexes[idxName] = true
+			}
+		}
+		for _, idxPath := range col.Indexes {
+			if !wantIndexes[strings.Join(idxPath, INDEX_PATH_SEP)] {
+				diffs = append(diffs, fmt.Sprintf("index %v of collection %s is not in the manifest", idxPath, name))
+			}
+		}
+		diffs = append(diffs, diffFields("setting of collection "+name, col.Config, want.Config)...)
+		if viewJS, wantJS := toJSON(col.View), toJSON(want.View); viewJS != wantJS {
+			diffs = append(diffs, fmt.Sprintf("view definition of collection %s is %s, the manifest has %s", name, viewJS, wantJS))
+		}
+	}
+	for _, name := range unionNames(have.TimeSeries, m.TimeSeries) {
+		ts, exists := have.TimeSeries[name]
+		want, inManifest := m.TimeSeries[name]
+		if !exists {
+			diffs = append(diffs, fmt.Sprintf("time series collection %s is missing", name))
+		} else if !inManifest {
+			diffs = append(diffs, fmt.Sprintf("time series collection %s is not in the manifest", name))
+		} else {
+			diffs = append(diffs, diffFields("setting of time series collection "+name, ts, want)...)
+		}
+	}
+	for _, name := range unionNames(have.StoredQueries, m.StoredQueries) {
+		sq, exists := have.StoredQueries[name]
+		want, inManifest := m.StoredQueries[name]
+		if !exists {
+			diffs = append(diffs, fmt.Sprintf("stored query %s is missing", name))
+		} else if !inManifest {
+			diffs = append(diffs, fmt.Sprintf("stored query %s is not in the manifest", name))
+		} else if sqJS, wantJS := toJSON(sq), toJSON(want); sqJS != wantJS {
+			diffs = append(diffs, fmt.Sprintf("stored query %s is %s, the manifest has %s", name, sqJS, wantJS))
+		}
+	}
+	return
+}
+
+// Return the sorted names that are keys of either of the maps (of string keys).
+func unionNames(have, want interface{}) (names []string) {
+	seen := make(map[string]bool)
+	for _, m := range []interface{}{have, want} {
+		for _, key := range reflect.ValueOf(m).MapKeys() {
+			if name := key.String(); !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// Return the differences between the attributes of the JSON objects of the values, one sentence each.
+func diffFields(what string, have, want interface{}) (diffs []string) {
+	var haveFields, wantFields map[string]json.RawMessage
+	json.Unmarshal([]byte(toJSON(have)), &haveFields)
+	json.Unmarshal([]byte(toJSON(want)), &wantFields)
+	for _, name := range unionNames(haveFields, wantFields) {
+		haveJS, wantJS := toJSON(haveFields[name]), toJSON(wantFields[name])
+		if haveJS != wantJS {
+			diffs = append(diffs, fmt.Sprintf("%s %s is %s, the manifest has %s", what, name, haveJS, wantJS))
+		}
+	}
+	return
+}
+
+// Return the compact JSON of the value, objects have their attributes in order of name.
+func toJSON(val interface{}) string {
+	js, _ := json.Marshal(val)
+	var normal interface{}
+	if json.Unmarshal(js, &normal) == nil {
+		js, _ = json.Marshal(normal)
+	}
+	return string(js)
+}
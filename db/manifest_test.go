@@ -0,0 +1,105 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestManifest(t *testing.T) {
+	copyDir := TEST_DATA_DIR + "_manifest"
+	os.RemoveAll(TEST_DATA_DIR)
+	os.RemoveAll(copyDir)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(copyDir)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("3"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("src"); err != nil {
+		t.Fatal(err)
+	}
+	src := db.Use("src")
+	if err = src.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err = src.Index([]string{"b", "c"}); err != nil {
+		t.Fatal(err)
+	} else if err = src.SetConfig(ColConfig{MaxDocs: 100, Timestamps: true}); err != nil {
+		t.Fatal(err)
+	} else if _, err = src.Insert(map[string]interface{}{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.CreateView("view", ViewDef{Source: "src", Query: map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}, Fields: [][]string{{"a"}}}); err != nil {
+		t.Fatal(err)
+	} else if err = db.Use("view").Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err = db.CreateTimeSeries("metrics", TimeSeriesConfig{TimePath: []string{"t"}, Span: 3600}); err != nil {
+		t.Fatal(err)
+	} else if err = db.StoreQuery("byA", StoredQuery{Col: "src", Query: map[string]interface{}{"eq": "$a", "in": []interface{}{"a"}}, Params: map[string]string{"a": PARAM_INT}}); err != nil {
+		t.Fatal(err)
+	}
+	manifest := db.Manifest()
+	if manifest.NumParts != 3 || len(manifest.Cols) != 2 || manifest.Cols["view"].View == nil || manifest.Cols["src"].View != nil {
+		t.Fatal(manifest)
+	} else if !reflect.DeepEqual(manifest.Cols["src"].Indexes, [][]string{{"a"}, {"b", "c"}}) || manifest.Cols["src"].Config.MaxDocs != 100 {
+		t.Fatal(manifest.Cols["src"])
+	} else if diffs := db.ManifestDiff(manifest); len(diffs) != 0 {
+		t.Fatal(diffs)
+	}
+	// The manifest saved as JSON sets up the same layout, without the documents
+	manifestJS, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved Manifest
+	if err = json.Unmarshal(manifestJS, &saved); err != nil {
+		t.Fatal(err)
+	} else if _, err = CreateFromManifest(TEST_DATA_DIR, saved); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+	copied, err := CreateFromManifest(copyDir, saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	if diffs := copied.ManifestDiff(saved); len(diffs) != 0 {
+		t.Fatal(diffs)
+	} else if diffs = db.ManifestDiff(copied.Manifest()); len(diffs) != 0 {
+		t.Fatal(diffs)
+	} else if copied.Use("src").ApproxDocCount() != 0 {
+		t.Fatal("Documents copied")
+	} else if _, exists := copied.StoredQueries()["byA"]; !exists {
+		t.Fatal(copied.StoredQueries())
+	}
+	// Drift is told
+	if err = copied.Use("src").Index([]string{"d"}); err != nil {
+		t.Fatal(err)
+	} else if err = copied.Use("src").SetConfig(ColConfig{MaxDocs: 50, Timestamps: true}); err != nil {
+		t.Fatal(err)
+	} else if err = copied.Create("extra"); err != nil {
+		t.Fatal(err)
+	} else if err = copied.DropStoredQuery("byA"); err != nil {
+		t.Fatal(err)
+	}
+	diffs := copied.ManifestDiff(saved)
+	sort.Strings(diffs)
+	if !reflect.DeepEqual(diffs, []string{
+		"collection extra is not in the manifest",
+		"index [d] of collection src is not in the manifest",
+		"setting of collection src MaxDocs is 50, the manifest has 100",
+		"stored query byA is missing",
+	}) {
+		t.Fatal(diffs)
+	}
+}
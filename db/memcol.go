@@ -0,0 +1,328 @@
+// In-memory collection for unit tests.
+//
+// Collection is the interface of the document operations of a collection. Application code that takes a Collection
+// (see DB.Collection) rather than *Col may be unit tested against a mock, or against MemCol, which keeps its documents
+// in memory rather than in data files, and assigns document IDs 1, 2, 3... in the order of insertion so that tests may
+// expect IDs and results of their own.
+// MemCol behaves like Col: documents are stored serialised (numbers read back as float64), string IDs and the errors
+// of missing documents, string IDs and indexes are the same, and queries are validated by the same rules - a lookup
+// needs an index on its path unless hinted otherwise. Queries are evaluated by matching each document, in ascending
+// ID order, so a result limit keeps the documents of the lowest IDs.
+//
+// MemCol has no hooks, relations, settings or persistence; code relying on them is tested against a real database.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Collection is the interface of the document operations of a collection, implemented by Col and MemCol. DB.Collection
+// returns a collection as a Collection. Mocks and decorators (adding metrics, retries and such) implement it too, by
+// embedding the Collection they stand in for and overriding some of its methods.
+type Collection interface {
+	Insert(doc map[string]interface{}) (id int, err error)
+	InsertStrID(strID string, doc map[string]interface{}) (id int, err error)
+	Read(id int) (doc map[string]interface{}, err error)
+	ReadStrID(strID string) (doc map[string]interface{}, err error)
+	ReadBatch(ids []int) (docs map[int]map[string]interface{})
+	Update(id int, doc map[string]interface{}) error
+	UpdateStrID(strID string, doc map[string]interface{}) error
+	Delete(id int) error
+	DeleteStrID(strID string) error
+	StrIDToID(strID string) (id int, err error)
+	Index(idxPath []string) error
+	Unindex(idxPath []string) error
+	AllIndexes() [][]string
+	ForEachDoc(fun func(id int, doc []byte) (moveOn bool))
+	Count() int
+	ApproxDocCount() int
+	Query(q interface{}) (result map[int]struct{}, err error)
+}
+
+// MemCol is a collection kept in memory, for unit tests.
+type MemCol struct {
+	lock       *sync.RWMutex
+	nextID     int
+	docs       map[int][]byte      // Serialised documents by ID
+	strIDs     map[string]int      // Document IDs by string ID
+	indexPaths map[string][]string // Index names and paths
+}
+
+// Return a new empty in-memory collection, its first document ID is 1.
+func NewMemCol() *MemCol {
+	return &MemCol{
+		lock:       new(sync.RWMutex),
+		nextID:     1,
+		docs:       make(map[int][]byte),
+		strIDs:     make(map[string]int),
+		indexPaths: make(map[string][]string),
+	}
+}
+
+// Insert a document into the collection. If the document carries a string ID in attribute "_id", the string ID must not be in use.
+func (col *MemCol) Insert(doc map[string]interface{}) (id int, err error) {
+	if strID, hasStrID := doc[STR_ID_ATTR].(string); hasStrID {
+		return col.InsertStrID(strID, doc)
+	}
+	col.lock.Lock()
+	defer col.lock.Unlock()
+	return col.insert(doc)
+}
+
+// Insert a document identified by the string ID, which is stored in the document's "_id" attribute. Return the new document ID.
+func (col *MemCol) InsertStrID(strID string, doc map[string]interface{}) (id int, err error) {
+	if strID == "" {
+		return 0, dberr.New(dberr.ErrorMissing, STR_ID_ATTR)
+	}
+	col.lock.Lock()
+	defer col.lock.Unlock()
+	if _, exists := col.strIDs[strID]; exists {
+		return 0, dberr.New(dberr.ErrorDupStrID, strID)
+	}
+	doc[STR_ID_ATTR] = strID
+	return col.insert(doc)
+}
+
+// Insert a document under the next ID. Caller must hold the write lock.
+func (col *MemCol) insert(doc map[string]interface{}) (id int, err error) {
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return
+	}
+	id = col.nextID
+	col.nextID++
+	col.docs[id] = docJS
+	if strID, hasStrID := doc[STR_ID_ATTR].(string); hasStrID && strID != "" {
+		col.strIDs[strID] = id
+	}
+	return
+}
+
+// Find and retrieve a document by ID.
+func (col *MemCol) Read(id int) (doc map[string]interface{}, err error) {
+	col.lock.RLock()
+	docJS, exists := col.docs[id]
+	col.lock.RUnlock()
+	if !exists {
+		return nil, dberr.New(dberr.ErrorNoDoc, id)
+	}
+	err = json.Unmarshal(docJS, &doc)
+	return
+}
+
+// Find and retrieve a document by string ID.
+func (col *MemCol) ReadStrID(strID string) (doc map[string]interface{}, err error) {
+	id, err := col.StrIDToID(strID)
+	if err != nil {
+		return
+	}
+	return col.Read(id)
+}
+
+// Find and retrieve documents by ID. Documents that do not exist are absent from the result.
+func (col *MemCol) ReadBatch(ids []int) (docs map[int]map[string]interface{}) {
+	docs = make(map[int]map[string]interface{}, len(ids))
+	for _, id := range ids {
+		if doc, err := col.Read(id); err == nil {
+			docs[id] = doc
+		}
+	}
+	return
+}
+
+// Update a document.
+func (col *MemCol) Update(id int, doc map[string]interface{}) error {
+	if doc == nil {
+		return fmt.Errorf("Updating %d: input doc may not be nil", id)
+	}
+	col.lock.Lock()
+	defer col.lock.Unlock()
+	strID, hasStrID := doc[STR_ID_ATTR].(string)
+	if other, found := col.strIDs[strID]; hasStrID && found && other != id {
+		return dberr.New(dberr.ErrorDupStrID, strID)
+	}
+	originalJS, exists := col.docs[id]
+	if !exists {
+		return dberr.New(dberr.ErrorNoDoc, id)
+	}
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	var original map[string]interface{}
+	json.Unmarshal(originalJS, &original)
+	if originalStrID, _ := original[STR_ID_ATTR].(string); originalStrID != "" && originalStrID != strID {
+		delete(col.strIDs, originalStrID)
+	}
+	if hasStrID && strID != "" {
+		col.strIDs[strID] = id
+	}
+	col.docs[id] = docJS
+	return nil
+}
+
+// Update a document identified by the string ID. The string ID is retained in the updated document.
+func (col *MemCol) UpdateStrID(strID string, doc map[string]interface{}) error {
+	id, err := col.StrIDToID(strID)
+	if err != nil {
+		return err
+	}
+	if doc != nil {
+		doc[STR_ID_ATTR] = strID
+	}
+	return col.Update(id, doc)
+}
+
+// Delete a document.
+func (col *MemCol) Delete(id int) error {
+	col.lock.Lock()
+	defer col.lock.Unlock()
+	docJS, exists := col.docs[id]
+	if !exists {
+		return dberr.New(dberr.ErrorNoDoc, id)
+	}
+	var doc map[string]interface{}
+	json.Unmarshal(docJS, &doc)
+	if strID, _ := doc[STR_ID_ATTR].(string); strID != "" {
+		delete(col.strIDs, strID)
+	}
+	delete(col.docs, id)
+	return nil
+}
+
+// Delete a document identified by the string ID.
+func (col *MemCol) DeleteStrID(strID string) error {
+	id, err := col.StrIDToID(strID)
+	if err != nil {
+		return err
+	}
+	return col.Delete(id)
+}
+
+// Return the document ID of the document identified by the string ID.
+func (col *MemCol) StrIDToID(strID string) (id int, err error) {
+	col.lock.RLock()
+	defer col.lock.RUnlock()
+	if id, found := col.strIDs[strID]; found {
+		return id, nil
+	}
+	return 0, dberr.New(dberr.ErrorNoStrDoc, strID)
+}
+
+// Create an index on the path. Queries on the path are allowed from then on.
+func (col *MemCol) Index(idxPath []string) error {
+	col.lock.Lock()
+	defer col.lock.Unlock()
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if err := checkIndexFuncs(idxPath); err != nil {
+		return err
+	} else if _, exists := col.indexPaths[idxName]; exists {
+		return dberr.New(dberr.ErrorIndexExists, idxPath)
+	}
+	col.indexPaths[idxName] = append([]string{}, idxPath...)
+	return nil
+}
+
+// Remove an index.
+func (col *MemCol) Unindex(idxPath []string) error {
+	col.lock.Lock()
+	defer col.lock.Unlock()
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, exists := col.indexPaths[idxName]; !exists {
+		return dberr.New(dberr.ErrorNoIndex, idxPath)
+	}
+	delete(col.indexPaths, idxName)
+	return nil
+}
+
+// Return all indexed paths, ordered by index name.
+func (col *MemCol) AllIndexes() (ret [][]string) {
+	col.lock.RLock()
+	defer col.lock.RUnlock()
+	names := make([]string, 0, len(col.indexPaths))
+	for name := range col.indexPaths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ret = make([][]string, 0, len(names))
+	for _, name := range names {
+		ret = append(ret, append([]string{}, col.indexPaths[name]...))
+	}
+	return
+}
+
+// Return the IDs of all documents in ascending order, and a copy of the documents. Caller must hold the lock.
+func (col *MemCol) sortedDocs() (ids []int, docs map[int][]byte) {
+	ids = make([]int, 0, len(col.docs))
+	docs = make(map[int][]byte, len(col.docs))
+	for id, docJS := range col.docs {
+		ids = append(ids, id)
+		docs[id] = docJS
+	}
+	sort.Ints(ids)
+	return
+}
+
+// Do fun for all documents in the collection, in ascending ID order. Fun may write to the collection.
+func (col *MemCol) ForEachDoc(fun func(id int, doc []byte) (moveOn bool)) {
+	col.lock.RLock()
+	ids, docs := col.sortedDocs()
+	col.lock.RUnlock()
+	for _, id := range ids {
+		if !fun(id, append([]byte{}, docs[id]...)) {
+			return
+		}
+	}
+}
+
+// Return the number of documents in the collection.
+func (col *MemCol) Count() int {
+	col.lock.RLock()
+	defer col.lock.RUnlock()
+	return len(col.docs)
+}
+
+// Return the number of documents in the collection, the same as Count.
+func (col *MemCol) ApproxDocCount() int {
+	return col.Count()
+}
+
+// Evaluate the query on the collection and return the IDs of the documents in the result. The query is validated like
+// Col validates it, and then matched against each document.
+func (col *MemCol) Query(q interface{}) (result map[int]struct{}, err error) {
+	col.lock.RLock()
+	// Only the index paths of the collection are used in planning the query
+	plan, err := compileQuery(q, &Col{indexPaths: col.indexPaths}, "$", 0)
+	if err == nil {
+		err = plan.check(q)
+	}
+	ids, docs := col.sortedDocs()
+	col.lock.RUnlock()
+	if err != nil {
+		return
+	}
+	limit := -1
+	if expr, ok := q.(map[string]interface{}); ok && (plan.op == PLAN_LOOKUP || plan.op == PLAN_PATH_EXISTENCE || plan.op == PLAN_INT_RANGE || plan.op == PLAN_TIME_RANGE) {
+		if intLimit, _ := queryLimit(expr); intLimit > 0 {
+			limit = intLimit
+		}
+	}
+	result = make(map[int]struct{})
+	for _, id := range ids {
+		if limit == len(result) {
+			break
+		}
+		var doc map[string]interface{}
+		if json.Unmarshal(docs[id], &doc) == nil && matchQuery(q, id, doc) {
+			result[id] = struct{}{}
+		}
+	}
+	return
+}
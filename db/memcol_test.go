@@ -0,0 +1,175 @@
+package db
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Run the same operations on the collection and return the query results, to compare MemCol with Col.
+func exerciseCollection(t *testing.T, col Collection) (ids []int, results []map[int]struct{}) {
+	for i := 0; i < 5; i++ {
+		id, err := col.Insert(map[string]interface{}{"a": i % 2, "i": i, "b": map[string]interface{}{"c": i}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := col.Insert(map[string]interface{}{STR_ID_ATTR: "alice", "a": 1}); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.InsertStrID("alice", map[string]interface{}{}); dberr.Type(err) != dberr.ErrorDupStrID {
+		t.Fatal(err)
+	} else if _, err = col.InsertStrID("", map[string]interface{}{}); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	} else if err = col.Update(ids[0], map[string]interface{}{STR_ID_ATTR: "alice"}); dberr.Type(err) != dberr.ErrorDupStrID {
+		t.Fatal(err)
+	} else if err = col.Update(ids[0], nil); err == nil {
+		t.Fatal("Did not reject nil document")
+	} else if err = col.UpdateStrID("alice", map[string]interface{}{"a": 0}); err != nil {
+		t.Fatal(err)
+	} else if doc, err := col.ReadStrID("alice"); err != nil || doc["a"] != float64(0) || doc[STR_ID_ATTR] != "alice" {
+		t.Fatal(doc, err)
+	} else if err = col.DeleteStrID("alice"); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.StrIDToID("alice"); dberr.Type(err) != dberr.ErrorNoStrDoc {
+		t.Fatal(err)
+	} else if err = col.Delete(ids[4]); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.Read(ids[4]); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if err = col.Update(ids[4], map[string]interface{}{}); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if err = col.Delete(ids[4]); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if docs := col.ReadBatch([]int{ids[0], ids[4]}); len(docs) != 1 || docs[ids[0]]["b"].(map[string]interface{})["c"] != float64(0) {
+		t.Fatal(docs)
+	} else if col.Count() != 4 || col.ApproxDocCount() != 4 {
+		t.Fatal(col.Count())
+	}
+	// Queries need indexes
+	if _, err := col.Query(map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"a"}); dberr.Type(err) != dberr.ErrorIndexExists {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"b", "c"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"i"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Unindex([]string{"d"}); dberr.Type(err) != dberr.ErrorNoIndex {
+		t.Fatal(err)
+	} else if len(col.AllIndexes()) != 3 {
+		t.Fatal(col.AllIndexes())
+	}
+	for _, q := range []interface{}{
+		map[string]interface{}{"eq": 1, "in": []interface{}{"a"}},
+		map[string]interface{}{"int-from": 1, "int-to": 3, "in": []interface{}{"i"}},
+		map[string]interface{}{"n": []interface{}{map[string]interface{}{"has": []interface{}{"a"}}, map[string]interface{}{"eq": 0, "in": []interface{}{"a"}}}},
+		[]interface{}{map[string]interface{}{"eq": 3, "in": []interface{}{"b", "c"}}, map[string]interface{}{"eq": 0, "in": []interface{}{"b", "c"}}},
+		"all",
+	} {
+		result, err := col.Query(q)
+		if err != nil {
+			t.Fatal(q, err)
+		}
+		results = append(results, result)
+	}
+	if _, err := col.Query(map[string]interface{}{"eq": 1, "in": "a"}); err == nil {
+		t.Fatal("Did not reject invalid query")
+	}
+	docs := 0
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		docs++
+		return true
+	})
+	if docs != 4 {
+		t.Fatal(docs)
+	}
+	return
+}
+
+// Return the result with the document IDs replaced by their positions among the IDs.
+func resultPositions(ids []int, result map[int]struct{}) (positions []int) {
+	for i, id := range ids {
+		if _, found := result[id]; found {
+			positions = append(positions, i)
+		}
+	}
+	return
+}
+
+func TestMemCol(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	// MemCol behaves like Col
+	realIDs, realResults := exerciseCollection(t, db.Use("col"))
+	memIDs, memResults := exerciseCollection(t, NewMemCol())
+	if !reflect.DeepEqual(memIDs, []int{1, 2, 3, 4, 5}) {
+		t.Fatal(memIDs)
+	}
+	for i := range realResults {
+		if realPos, memPos := resultPositions(realIDs, realResults[i]), resultPositions(memIDs, memResults[i]); !reflect.DeepEqual(realPos, memPos) {
+			t.Fatal(i, realPos, memPos)
+		}
+	}
+	// Documents are iterated and limited in ID order
+	col := NewMemCol()
+	for i := 0; i < 5; i++ {
+		col.Insert(map[string]interface{}{"a": 1})
+	}
+	col.Index([]string{"a"})
+	var iterated []int
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		iterated = append(iterated, id)
+		return id < 3
+	})
+	if !reflect.DeepEqual(iterated, []int{1, 2, 3}) {
+		t.Fatal(iterated)
+	} else if result, err := col.Query(map[string]interface{}{"eq": 1, "in": []interface{}{"a"}, "limit": 2}); err != nil || !reflect.DeepEqual(result, map[int]struct{}{1: {}, 2: {}}) {
+		t.Fatal(result, err)
+	}
+}
+
+// A decorator counting the inserts into a collection.
+type countingCol struct {
+	Collection
+	inserts int
+}
+
+func (col *countingCol) Insert(doc map[string]interface{}) (int, error) {
+	col.inserts++
+	return col.Collection.Insert(doc)
+}
+
+func TestDBCollection(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Collection("col") != nil {
+		t.Fatal("Missing collection is not nil")
+	} else if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := &countingCol{Collection: db.Collection("col")}
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if doc, err := db.Use("col").Read(id); err != nil || doc["a"] != float64(1) || col.inserts != 1 {
+		t.Fatal(doc, err, col.inserts)
+	}
+}
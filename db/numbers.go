@@ -0,0 +1,99 @@
+// Exact JSON numbers.
+//
+// JSON numbers decode as float64, which holds integers exactly up to 2^53: larger integers, such as 64-bit IDs issued
+// elsewhere, read back rounded and look alike to indexes and queries. A collection with ExactNumbers in its settings
+// decodes such integers as json.Number instead, keeping their digits throughout - in the documents read, the values
+// indexed and the documents matched by queries. All other numbers remain float64, so that documents read back as
+// before but for the large integers. The HTTP API decodes the documents and queries of such a collection likewise.
+//
+// Indexes and queries compare values by their text. A json.Number reads like the float64 of the same value, unless it
+// is an integer float64 does not hold exactly, which reads as its digits like a Go integer does.
+
+package db
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const MAX_EXACT_INT = 1 << 53 // Largest magnitude of the integers float64 holds exactly.
+
+// Decode JSON into the value like json.Unmarshal does, except that the integers float64 does not hold exactly are
+// decoded as json.Number.
+func UnmarshalExact(js []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(js))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	} else if _, err = decoder.Token(); err != io.EOF {
+		return errors.New("invalid character after top-level value")
+	}
+	switch v := v.(type) {
+	case *map[string]interface{}:
+		exactNumbers(*v)
+	case *[]interface{}:
+		exactNumbers(*v)
+	case *interface{}:
+		*v = exactNumbers(*v)
+	}
+	return nil
+}
+
+// Convert the json.Number in the decoded value to float64, except for the integers float64 does not hold exactly.
+// Maps and slices are converted in place.
+func exactNumbers(val interface{}) interface{} {
+	switch val := val.(type) {
+	case json.Number:
+		if i, err := val.Int64(); err == nil && (i > MAX_EXACT_INT || i < -MAX_EXACT_INT) {
+			return val
+		} else if f, err := val.Float64(); err == nil {
+			return f
+		}
+	case map[string]interface{}:
+		for key, item := range val {
+			val[key] = exactNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = exactNumbers(item)
+		}
+	}
+	return val
+}
+
+// Return the text by which indexes and queries compare the value, a byte string compares by its encoding (see
+// BinaryValue).
+func valueText(val interface{}) string {
+	switch val := val.(type) {
+	case json.Number:
+		if i, err := val.Int64(); err == nil && (i > MAX_EXACT_INT || i < -MAX_EXACT_INT) {
+			return strconv.FormatInt(i, 10)
+		} else if f, err := val.Float64(); err == nil {
+			return fmt.Sprint(f)
+		}
+	case []byte:
+		return base64.StdEncoding.EncodeToString(val)
+	}
+	return fmt.Sprint(val)
+}
+
+// Return true if the collection keeps the integers float64 does not hold exactly as json.Number, see ExactNumbers of
+// ColConfig.
+func (col *Col) ExactNumbers() bool {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	return col.conf.ExactNumbers
+}
+
+// Decode the serialised document, keeping large integers exact if the collection is set to. Does not place schema lock.
+func (col *Col) unmarshalDoc(docB []byte, doc *map[string]interface{}) error {
+	if col.conf.ExactNumbers {
+		return UnmarshalExact(docB, doc)
+	}
+	return json.Unmarshal(docB, doc)
+}
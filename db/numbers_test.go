@@ -0,0 +1,92 @@
+package db
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshalExact(t *testing.T) {
+	var doc map[string]interface{}
+	if err := UnmarshalExact([]byte(`{"id": 1152921504606846977, "n": [1.5, 9007199254740992, {"m": -9007199254740993}]}`), &doc); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(doc, map[string]interface{}{
+		"id": json.Number("1152921504606846977"),
+		"n":  []interface{}{1.5, float64(9007199254740992), map[string]interface{}{"m": json.Number("-9007199254740993")}},
+	}) {
+		t.Fatal(doc)
+	} else if err = UnmarshalExact([]byte(`{} {}`), &doc); err == nil {
+		t.Fatal("Did not reject trailing data")
+	}
+	for _, same := range [][]interface{}{
+		{json.Number("1000000"), float64(1000000)},
+		{json.Number("1.50"), 1.5},
+		{json.Number("1152921504606846977"), int64(1152921504606846977)},
+	} {
+		if valueText(same[0]) != valueText(same[1]) {
+			t.Fatal(same, valueText(same[0]), valueText(same[1]))
+		}
+	}
+}
+
+func TestExactNumbers(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.SetConfig(ColConfig{ExactNumbers: true, DocCacheSize: 10}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"id"}); err != nil {
+		t.Fatal(err)
+	}
+	// Neighbouring 64-bit integers are told apart
+	const big = int64(1<<60 + 1)
+	id1, err := col.Insert(map[string]interface{}{"id": big})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := col.Insert(map[string]interface{}{"id": big + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(value interface{}) map[int]struct{} {
+		result, err := col.Query(map[string]interface{}{"eq": value, "in": []interface{}{"id"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	if doc, err := col.Read(id1); err != nil || doc["id"] != json.Number("1152921504606846977") {
+		t.Fatal(doc, err)
+	} else if result := lookup(big); len(result) != 1 {
+		t.Fatal(result)
+	} else if _, found := lookup(json.Number("1152921504606846978"))[id2]; !found {
+		t.Fatal("Lookup by json.Number")
+	}
+	// The exact value is unindexed by update, and indexed by a new index
+	if err = col.Update(id1, map[string]interface{}{"id": big + 2}); err != nil {
+		t.Fatal(err)
+	} else if result := lookup(big); len(result) != 0 {
+		t.Fatal(result)
+	} else if err = col.Unindex([]string{"id"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"id"}); err != nil {
+		t.Fatal(err)
+	} else if _, found := lookup(big + 2)[id1]; !found {
+		t.Fatal("Reindexed lookup")
+	}
+	// Without the setting, numbers read back as float64
+	if err = col.SetConfig(ColConfig{DocCacheSize: 10}); err != nil {
+		t.Fatal(err)
+	} else if doc, err := col.Read(id1); err != nil || doc["id"] != float64(big+2) {
+		t.Fatal(doc, err)
+	}
+}
@@ -0,0 +1,61 @@
+// Parallel opening of database files.
+//
+// A database has files of every partition of every collection to open - documents, ID and string ID lookup, and each
+// index - and opening one involves system calls, a memory map and a search for the end of its data. The collections
+// of a database are opened concurrently, and so are the files of each collection, while no more than OpenWorkers
+// (data-config.json) files are opened at a time across the database. All collections are opened even if some fail,
+// and the errors of all failures are returned together.
+
+package db
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// Return the slots of the files opened at a time, as many as the configured open workers or the number of CPUs.
+func (db *DB) newOpenSlots() chan struct{} {
+	workers := db.Config.OpenWorkers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	return make(chan struct{}, workers)
+}
+
+// Run the jobs concurrently and wait for all of them, each job takes one of the slots (unlimited if nil) as it runs.
+// Return the errors of the failed jobs together, in the order of jobs.
+func runJobs(slots chan struct{}, jobs []func() error) error {
+	errs := make([]error, len(jobs))
+	wg := new(sync.WaitGroup)
+	for i, job := range jobs {
+		wg.Add(1)
+		go func(i int, job func() error) {
+			defer wg.Done()
+			if slots != nil {
+				slots <- struct{}{}
+				defer func() { <-slots }()
+			}
+			errs[i] = job()
+		}(i, job)
+	}
+	wg.Wait()
+	return joinErrors(errs)
+}
+
+// Return nil if there is no error among errs, the error if there is only one, otherwise all of them in one error.
+func joinErrors(errs []error) error {
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	switch len(failed) {
+	case 0:
+		return nil
+	case 1:
+		return failed[0]
+	}
+	return fmt.Errorf("%v", failed)
+}
@@ -0,0 +1,85 @@
+// Partition-level read access.
+//
+// A collection spreads its documents over its partitions by document ID - a document lives in partition ID modulo the
+// number of partitions - and each partition is locked on its own. Applications building access patterns of their own,
+// such as scanning the partitions in parallel or reading many documents of a partition under a single lock, may read
+// a partition through a PartitionView, which is given to a function while the partition is read locked.
+//
+// Views are read only: writes go through Col, which maintains indexes, string IDs and hooks along with the documents.
+// PartitionView is the stable subset of data.Partition; the data package itself may change between releases.
+
+package db
+
+import (
+	"github.com/cankansin/tiedot/data"
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// PartitionView reads the documents of a read locked partition, it is only valid during the call it is given to.
+type PartitionView struct {
+	part *data.Partition
+	num  int
+}
+
+// Return the number of partitions of the collection, which is the same for all collections of the database.
+func (col *Col) NumPartitions() int {
+	return col.db.numParts
+}
+
+// Return the number of the partition holding the document ID.
+func (col *Col) PartitionOf(id int) int {
+	if id < 0 {
+		id = -id
+	}
+	return id % col.db.numParts
+}
+
+// Read lock the partition and run the function on its view, return the function's error. The function must not write
+// to the partition, nor create, drop or rename collections, both of which would wait for the locks held during the
+// call. Fail with ErrorPartLockTimeout if the partition remains write locked for longer than LockTimeout.
+func (col *Col) ViewPartition(num int, fun func(view PartitionView) error) error {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if num < 0 || num >= col.db.numParts {
+		return dberr.New(dberr.ErrorInvalidParam, "partition number", num)
+	}
+	part := col.parts[num]
+	if !part.RLockData(nil) {
+		return dberr.New(dberr.ErrorPartLockTimeout, num, col.name)
+	}
+	defer part.DataLock.RUnlock()
+	return fun(PartitionView{part: part, num: num})
+}
+
+// Return the number of the partition.
+func (view PartitionView) Num() int {
+	return view.num
+}
+
+// Return the exact number of documents in the partition.
+func (view PartitionView) Count() int {
+	return view.part.Count()
+}
+
+// Return a copy of the serialised document, fail with ErrorNoDoc if the document is not in the partition.
+func (view PartitionView) Read(id int) ([]byte, error) {
+	return view.part.Read(id)
+}
+
+// Run the function on the serialised document without copying it out of the data file. The document is only valid
+// during the call, which must neither retain nor modify it. Fail with ErrorNoDoc if the document is not in the partition.
+func (view PartitionView) ReadView(id int, fun func(doc []byte)) error {
+	return view.part.ReadView(id, fun)
+}
+
+// Run the function on a copy of every serialised document in the partition, until it returns false. Return false if
+// the iteration was stopped.
+func (view PartitionView) ForEachDoc(fun func(id int, doc []byte) (moveOn bool)) (moveOn bool) {
+	return view.part.ForEachDoc(0, 1, fun)
+}
+
+// Like ForEachDoc, but documents are not copied out of the data file. Each document is only valid during the call to
+// the function, which must neither retain nor modify it.
+func (view PartitionView) ForEachDocView(fun func(id int, doc []byte) (moveOn bool)) (moveOn bool) {
+	return view.part.ForEachDocView(0, 1, fun)
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestViewPartition(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("3"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make(map[int]int)
+	for i := 0; i < 30; i++ {
+		id, err := col.Insert(map[string]interface{}{"i": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[id] = i
+	}
+	if col.NumPartitions() != 3 {
+		t.Fatal(col.NumPartitions())
+	}
+	// Every document is found in its partition, and only there
+	total := 0
+	for num := 0; num < col.NumPartitions(); num++ {
+		err = col.ViewPartition(num, func(view PartitionView) error {
+			docs := 0
+			view.ForEachDoc(func(id int, doc []byte) bool {
+				var parsed map[string]interface{}
+				if col.PartitionOf(id) != view.Num() || json.Unmarshal(doc, &parsed) != nil || parsed["i"] != float64(ids[id]) {
+					t.Fatal(id, string(doc))
+				}
+				docs++
+				return true
+			})
+			if docs != view.Count() {
+				t.Fatal(docs, view.Count())
+			}
+			total += docs
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if total != len(ids) {
+		t.Fatal(total)
+	}
+	for id := range ids {
+		err = col.ViewPartition(col.PartitionOf(id), func(view PartitionView) error {
+			if _, err := view.Read(id); err != nil {
+				return err
+			}
+			return view.ReadView(id, func(doc []byte) {})
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if err = col.ViewPartition((col.PartitionOf(id)+1)%3, func(view PartitionView) error {
+			_, err := view.Read(id)
+			return err
+		}); dberr.Type(err) != dberr.ErrorNoDoc {
+			t.Fatal(err)
+		}
+		break
+	}
+	if err = col.ViewPartition(3, func(view PartitionView) error { return nil }); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,234 @@
+// Placement of collections in directories outside of the database directory.
+//
+// A collection may be placed in another directory, such as on a faster or a cheaper volume. Its files then live in a
+// directory of the same name inside the placement directory, and the database directory holds a symbolic link to it in
+// place of the collection directory. The placement is thereby recorded by the file system alone, it survives restarts,
+// and a collection whose placement directory is unavailable fails to open rather than being re-created empty.
+// Renaming, scrubbing and restoring a collection keep it in place; a dump copies the collection into the dump
+// directory itself.
+
+package db
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+// Return the directory holding the files of the collection, which is inside the database directory unless the
+// collection is placed elsewhere.
+func (db *DB) colDir(name string) (string, error) {
+	link := path.Join(db.path, name)
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return link, nil
+	}
+	target, err := os.Readlink(link)
+	if err != nil {
+		return "", err
+	} else if !filepath.IsAbs(target) {
+		target = filepath.Join(db.path, target)
+	}
+	return target, nil
+}
+
+// Create the directory of a temporary collection, which is to replace the collection, next to the collection's own
+// directory, so that the replacement remains in place. Return the directory.
+func (db *DB) mkTmpColDir(name, tmpName string) (string, error) {
+	dir, err := db.colDir(name)
+	if err != nil {
+		return "", err
+	}
+	tmpDir := path.Join(filepath.Dir(dir), tmpName)
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return "", err
+	}
+	if link := path.Join(db.path, tmpName); link != tmpDir {
+		if err := os.Symlink(tmpDir, link); err != nil {
+			os.RemoveAll(tmpDir)
+			return "", err
+		}
+	}
+	return tmpDir, nil
+}
+
+// Remove the directory of the collection, along with the link to it if the collection is placed elsewhere.
+func (db *DB) removeColDir(name string) error {
+	dir, err := db.colDir(name)
+	if err != nil {
+		return err
+	} else if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(path.Join(db.path, name))
+}
+
+// Rename the directory of the collection, a collection placed elsewhere remains in its placement directory.
+func (db *DB) renameColDir(oldName, newName string) error {
+	dir, err := db.colDir(oldName)
+	if err != nil {
+		return err
+	}
+	link := path.Join(db.path, oldName)
+	if dir == link {
+		return os.Rename(link, path.Join(db.path, newName))
+	}
+	newDir := path.Join(filepath.Dir(dir), newName)
+	if _, err := os.Lstat(newDir); err == nil {
+		return fmt.Errorf("Cannot rename collection %s, %s already exists", oldName, newDir)
+	} else if err := os.Rename(dir, newDir); err != nil {
+		return err
+	} else if err := os.Symlink(newDir, path.Join(db.path, newName)); err != nil {
+		os.Rename(newDir, dir)
+		return err
+	}
+	return os.Remove(link)
+}
+
+// Return the directory the collection is placed in, or an empty string if the collection lives in the database
+// directory.
+func (db *DB) Placement(name string) (string, error) {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	if _, exists := db.cols[name]; !exists {
+		return "", dberr.New(dberr.ErrorNoCol, name)
+	}
+	dir, err := db.colDir(name)
+	if err != nil || dir == path.Join(db.path, name) {
+		return "", err
+	}
+	return filepath.Dir(dir), nil
+}
+
+// Move the collection into the destination directory (such as on another volume) while the database remains open,
+// moving it into the database directory puts it back in place. Schema lock is held while the collection files are
+// copied over, so other requests wait for the move to finish. Hooks remain registered on the moved collection.
+func (db *DB) MoveCol(name, dest string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	col, exists := db.cols[name]
+	if !exists {
+		return dberr.New(dberr.ErrorNoCol, name)
+	}
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+	dbPath, err := filepath.Abs(db.path)
+	if err != nil {
+		return err
+	}
+	link := path.Join(db.path, name)
+	newDir := path.Join(dest, name)
+	if dest == dbPath {
+		newDir = link
+	}
+	dir, err := db.colDir(name)
+	if err != nil {
+		return err
+	} else if absDir, err := filepath.Abs(dir); err != nil {
+		return err
+	} else if absDir == newDir || dir == newDir {
+		return nil
+	} else if _, err := os.Lstat(newDir); err == nil && newDir != link {
+		return dberr.New(dberr.ErrorInvalidParam, "destination", newDir+" already exists")
+	} else if err := os.MkdirAll(dest, 0700); err != nil {
+		return err
+	}
+	// Copy the closed collection next to its new directory, and then swap the copy in place of the original
+	stamp := time.Now().UnixNano()
+	copyDir := path.Join(filepath.Dir(newDir), fmt.Sprintf("move-%s-%d", name, stamp))
+	asideLink := path.Join(db.path, fmt.Sprintf("moved-%s-%d", name, stamp))
+	if err = col.close(); err == nil {
+		err = filepath.Walk(dir, copyDirFun(dir, copyDir))
+	}
+	if err == nil {
+		if err = os.Rename(link, asideLink); err == nil {
+			if newDir == link {
+				err = os.Rename(copyDir, link)
+			} else if err = os.Rename(copyDir, newDir); err == nil {
+				if err = os.Symlink(newDir, link); err != nil {
+					os.Rename(newDir, copyDir)
+				}
+			}
+			if err != nil {
+				os.Rename(asideLink, link)
+			}
+		}
+	}
+	if err != nil {
+		os.RemoveAll(copyDir)
+	} else if removeErr := db.removeColDir(path.Base(asideLink)); removeErr != nil {
+		tdlog.Noticef("Move %s: failed to remove the original collection files: %v", name, removeErr)
+	}
+	// Reopen the collection from wherever it is now, hooks remain registered
+	moved, openErr := OpenCol(db, name)
+	if openErr != nil {
+		delete(db.cols, name)
+		return openErr
+	}
+	moved.hooks, moved.ext = col.hooks, col.ext
+	db.cols[name] = moved
+	if err == nil {
+		tdlog.Noticef("Moved collection %s into %s", name, dest)
+	}
+	return err
+}
+
+// Return a filepath.Walk function that copies the directory tree at src into dest. Links to the directories of
+// collections placed elsewhere are followed, so that the copy holds the collection files themselves. Existing files
+// are never overwritten.
+func copyDirFun(src, dest string) filepath.WalkFunc {
+	return func(currPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, currPath)
+		if err != nil {
+			return err
+		}
+		destPath := path.Join(dest, relPath)
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := filepath.EvalSymlinks(currPath)
+			if err != nil {
+				return err
+			}
+			return filepath.Walk(target, copyDirFun(target, destPath))
+		} else if info.IsDir() {
+			if err := os.MkdirAll(destPath, 0700); err != nil {
+				return err
+			}
+			tdlog.Noticef("Copy: created directory %s", destPath)
+			return nil
+		}
+		srcFile, err := os.Open(currPath)
+		if err != nil {
+			return err
+		}
+		defer srcFile.Close()
+		if _, err := os.Lstat(destPath); err == nil {
+			return fmt.Errorf("Destination file %s already exists", destPath)
+		}
+		destFile, err := os.OpenFile(destPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		written, err := io.Copy(destFile, srcFile)
+		if closeErr := destFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		tdlog.Noticef("Copy: copied file %s, size is %d", destPath, written)
+		return nil
+	}
+}
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMoveCol(t *testing.T) {
+	placeDir := TEST_DATA_DIR + "_placed"
+	os.RemoveAll(TEST_DATA_DIR)
+	os.RemoveAll(placeDir)
+	os.RemoveAll(TEST_DATA_DIR + "bak")
+	defer os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(placeDir)
+	defer os.RemoveAll(TEST_DATA_DIR + "bak")
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("a"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Use("a").Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 10)
+	for i := range ids {
+		if ids[i], err = db.Use("a").Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inserted := 0
+	db.Use("a").OnInsert(func(id int, doc map[string]interface{}) { inserted++ }, false)
+	checkDocs := func(col *Col) {
+		t.Helper()
+		if col.Count() != len(ids) {
+			t.Fatal(col.Count())
+		}
+		for i, id := range ids {
+			if doc, err := col.Read(id); err != nil || doc["n"].(float64) != float64(i) {
+				t.Fatal(doc, err)
+			}
+		}
+		if len(col.AllIndexes()) != 1 {
+			t.Fatal(col.AllIndexes())
+		}
+	}
+	if err = db.MoveCol("b", placeDir); err == nil {
+		t.Fatal("did not error")
+	}
+	// Move the collection elsewhere, it is left in place when moved there again
+	for i := 0; i < 2; i++ {
+		if err = db.MoveCol("a", placeDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dir, err := db.Placement("a"); err != nil || dir != placeDir {
+		t.Fatal(dir, err)
+	} else if info, err := os.Lstat(path.Join(TEST_DATA_DIR, "a")); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatal(info, err)
+	} else if _, err = os.Stat(path.Join(placeDir, "a", DOC_DATA_FILE+"0")); err != nil {
+		t.Fatal(err)
+	} else if files, _ := ioutil.ReadDir(TEST_DATA_DIR); len(files) != 5 {
+		// Only the link to the collection remains in the database directory, along with the database files
+		t.Fatal(files)
+	}
+	checkDocs(db.Use("a"))
+	if id, err := db.Use("a").Insert(map[string]interface{}{"n": len(ids)}); err != nil || inserted != 1 {
+		t.Fatal(err, inserted)
+	} else {
+		ids = append(ids, id)
+	}
+	// The placement survives rename, scrub and reopening the database
+	if err = db.Rename("a", "b"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Scrub("b"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	if dir, err := db.Placement("b"); err != nil || dir != placeDir {
+		t.Fatal(dir, err)
+	} else if files, _ := ioutil.ReadDir(placeDir); len(files) != 1 || files[0].Name() != "b" {
+		t.Fatal(files)
+	}
+	checkDocs(db.Use("b"))
+	// A restore keeps the collection in place
+	var backup bytes.Buffer
+	if _, err = db.BackupSince(0, &backup); err != nil {
+		t.Fatal(err)
+	} else if err = db.RestoreCol("b", &backup); err != nil {
+		t.Fatal(err)
+	} else if files, _ := ioutil.ReadDir(placeDir); len(files) != 1 || files[0].Name() != "b" {
+		t.Fatal(files)
+	} else if files, _ := ioutil.ReadDir(TEST_DATA_DIR); len(files) != 5 {
+		t.Fatal(files)
+	}
+	checkDocs(db.Use("b"))
+	// A dump holds the collection files themselves
+	if err = db.Dump(TEST_DATA_DIR + "bak"); err != nil {
+		t.Fatal(err)
+	} else if info, err := os.Lstat(path.Join(TEST_DATA_DIR+"bak", "b")); err != nil || !info.IsDir() {
+		t.Fatal(info, err)
+	}
+	// Move the collection back into the database directory
+	if err = db.MoveCol("b", TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	} else if dir, err := db.Placement("b"); err != nil || dir != "" {
+		t.Fatal(dir, err)
+	} else if info, err := os.Lstat(path.Join(TEST_DATA_DIR, "b")); err != nil || !info.IsDir() {
+		t.Fatal(info, err)
+	} else if files, _ := ioutil.ReadDir(placeDir); len(files) != 0 {
+		t.Fatal(files)
+	}
+	checkDocs(db.Use("b"))
+	// Dropping a collection placed elsewhere removes its files
+	if err = db.MoveCol("b", placeDir); err != nil {
+		t.Fatal(err)
+	} else if err = db.Drop("b"); err != nil {
+		t.Fatal(err)
+	} else if files, _ := ioutil.ReadDir(placeDir); len(files) != 0 {
+		t.Fatal(files)
+	} else if _, err = os.Lstat(path.Join(TEST_DATA_DIR, "b")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenPlacementUnavailable(t *testing.T) {
+	placeDir := TEST_DATA_DIR + "_placed"
+	os.RemoveAll(TEST_DATA_DIR)
+	os.RemoveAll(placeDir)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(placeDir)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("a"); err != nil {
+		t.Fatal(err)
+	} else if err = db.MoveCol("a", placeDir); err != nil {
+		t.Fatal(err)
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The collection is not re-created empty while its placement directory is missing
+	if err = os.Rename(placeDir, placeDir+"_unmounted"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(placeDir + "_unmounted")
+	if db, err = OpenDB(TEST_DATA_DIR); err == nil {
+		db.Close()
+		t.Fatal("did not error")
+	}
+	if err = os.Rename(placeDir+"_unmounted", placeDir); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	} else if db.Use("a") == nil {
+		t.Fatal("collection is missing")
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
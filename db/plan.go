@@ -0,0 +1,313 @@
+// Query plan cache.
+//
+// Queries of the same shape - the same operations on the same paths, regardless of the looked up values, ranges,
+// limits and document IDs - share one plan, which holds the validated paths and chosen indexes. Repeatedly running
+// queries of a shape only validates its values, the query structure is validated and planned once.
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+const (
+	MAX_CACHED_PLANS = 1024 // Maximum number of cached query plans in a collection, the cache is emptied when it is full.
+	MAX_PLAN_SHAPE   = 4096 // Plans of query shapes longer than this (in bytes) are not cached.
+)
+
+const (
+	PLAN_NOOP           = iota // Query that does nothing
+	PLAN_UNION                 // [sub query 1, sub query 2, etc]
+	PLAN_ALL_IDS               // "all"
+	PLAN_DOC_ID                // Single document ID
+	PLAN_LOOKUP                // eq - lookup
+	PLAN_PATH_EXISTENCE        // has - path existence test
+	PLAN_INTERSECT             // n - intersection
+	PLAN_COMPLEMENT            // c - complement
+	PLAN_INT_RANGE             // int-from, int-to - integer range query
+	PLAN_VERSIONED             // version, query - query of a syntax version
+	PLAN_DIFFERENCE            // d - difference
+	PLAN_SYM_DIFFERENCE        // x - symmetric difference
+	PLAN_TIME_RANGE            // time, after, before - time range query
+)
+
+// Attributes holding the sub-queries of set operations, by plan operation.
+var setOps = map[int]string{PLAN_INTERSECT: "n", PLAN_COMPLEMENT: "c", PLAN_DIFFERENCE: "d", PLAN_SYM_DIFFERENCE: "x"}
+
+// Plan of a query shape.
+type queryPlan struct {
+	op       int
+	vecPath  []string     // Path of lookup, existence test and range query
+	idxName  string       // Index used by lookup, existence test and range query
+	intFrom  string       // Name of the range query's "from" attribute
+	hint     string       // Index hint of lookup, existence test and range query
+	subPlans []*queryPlan // Plans of sub-queries
+}
+
+// Write the shape of the query - its structure without the looked up values, ranges, limits and document IDs.
+func writeQueryShape(shape *bytes.Buffer, q interface{}) {
+	switch expr := q.(type) {
+	case []interface{}:
+		shape.WriteByte('[')
+		for _, subExpr := range expr {
+			writeQueryShape(shape, subExpr)
+			shape.WriteByte(',')
+		}
+		shape.WriteByte(']')
+	case string:
+		if expr == "all" {
+			shape.WriteString(`"all"`)
+		} else {
+			shape.WriteByte('?')
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(expr))
+		for key := range expr {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		shape.WriteByte('{')
+		for _, key := range keys {
+			switch key {
+			case "eq", "int-from", "int from", "int-to", "int to", "after", "before", "limit":
+				fmt.Fprintf(shape, "%q:?", key)
+			case "n", "c", "d", "x", "query":
+				fmt.Fprintf(shape, "%q:", key)
+				writeQueryShape(shape, expr[key])
+			case "version", "hint":
+				// The version determines how the query is parsed, the hint how it is evaluated
+				fmt.Fprintf(shape, "%q:%v", key, expr[key])
+			case "in", "has", "time":
+				fmt.Fprintf(shape, "%q:", key)
+				writePathShape(shape, expr[key])
+			default:
+				// Unknown attributes make the query malformed, which is never cached, their values are irrelevant
+				shape.WriteByte('!')
+			}
+			shape.WriteByte(',')
+		}
+		shape.WriteByte('}')
+	default:
+		fmt.Fprintf(shape, "%T", expr)
+	}
+}
+
+// Write the path of a lookup, existence test or range query.
+func writePathShape(shape *bytes.Buffer, path interface{}) {
+	vecPath, ok := path.([]interface{})
+	if !ok {
+		shape.WriteByte('?')
+		return
+	}
+	shape.WriteByte('[')
+	for _, v := range vecPath {
+		fmt.Fprintf(shape, "%q,", fmt.Sprint(v))
+	}
+	shape.WriteByte(']')
+}
+
+// Return the plan of the query's shape, plan the query if the shape is not yet cached. Does not place schema lock.
+func (col *Col) planQuery(q interface{}) (plan *queryPlan, err error) {
+	var shape bytes.Buffer
+	writeQueryShape(&shape, q)
+	key := shape.String()
+	col.planLock.Lock()
+	plan, cached := col.plans[key]
+	col.planLock.Unlock()
+	if cached {
+		return
+	}
+	if plan, err = compileQuery(q, col, "$", 0); err != nil || len(key) > MAX_PLAN_SHAPE {
+		return
+	}
+	col.planLock.Lock()
+	if len(col.plans) >= MAX_CACHED_PLANS {
+		col.plans = make(map[string]*queryPlan)
+	}
+	col.plans[key] = plan
+	col.planLock.Unlock()
+	return
+}
+
+// Return the plan of the query's shape after validating the query's values. Does not place schema lock.
+func (col *Col) checkedPlan(q interface{}) (plan *queryPlan, err error) {
+	if plan, err = col.planQuery(q); err != nil {
+		return
+	}
+	if err = plan.check(q); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Forget all cached query plans, the plans may refer to indexes that were created or removed.
+func (col *Col) resetPlans() {
+	col.planLock.Lock()
+	col.plans = make(map[string]*queryPlan)
+	col.planLock.Unlock()
+}
+
+// Return the number of cached query plans.
+func (col *Col) cachedPlans() int {
+	col.planLock.Lock()
+	defer col.planLock.Unlock()
+	return len(col.plans)
+}
+
+// Validate the query structure and choose its indexes, errors tell the position (in JSON path notation) of the query
+// within the entire query. Values are validated by queryPlan.check instead. A query of a version (0 - unversioned) is
+// parsed in strict mode, see checkStrict. Does not place schema lock.
+func compileQuery(q interface{}, src *Col, position string, version int) (plan *queryPlan, err error) {
+	defer func() {
+		if _, positioned := err.(*QueryError); err != nil && !positioned {
+			err = queryErrorAt(position, err)
+		}
+	}()
+	switch expr := q.(type) {
+	case []interface{}: // [sub query 1, sub query 2, etc]
+		return compileSubQueries(PLAN_UNION, expr, src, position, version)
+	case string:
+		if expr == "all" {
+			return &queryPlan{op: PLAN_ALL_IDS}, nil
+		}
+		// Might be single document number
+		return &queryPlan{op: PLAN_DOC_ID}, nil
+	case map[string]interface{}:
+		if _, versioned := expr["version"]; versioned {
+			var subVersion int
+			if subVersion, err = checkQueryVersion(expr, position); err != nil {
+				return nil, err
+			}
+			plan = &queryPlan{op: PLAN_VERSIONED, subPlans: make([]*queryPlan, 1)}
+			if plan.subPlans[0], err = compileQuery(expr["query"], src, position+".query", subVersion); err != nil {
+				return nil, err
+			}
+			return
+		}
+		var op string
+		if op, err = queryOperation(expr, position); err != nil {
+			return nil, err
+		} else if version > 0 {
+			if err = checkStrict(expr, version, position); err != nil {
+				return nil, err
+			}
+		}
+		switch op {
+		case "eq": // eq - lookup
+			return planLookup(expr, src, position)
+		case "has": // has - path existence test
+			return planPathExistence(expr["has"], expr, src, position)
+		case "n", "c", "d", "x": // n - intersection, c - complement, d - difference, x - symmetric difference
+			subExprVecs, ok := expr[op].([]interface{})
+			if !ok {
+				return nil, queryErrorAt(position+"."+op, dberr.New(dberr.ErrorExpectingSubQuery, expr[op]))
+			}
+			planOp := PLAN_INTERSECT
+			switch op {
+			case "c":
+				planOp = PLAN_COMPLEMENT
+			case "d":
+				planOp = PLAN_DIFFERENCE
+			case "x":
+				planOp = PLAN_SYM_DIFFERENCE
+			}
+			return compileSubQueries(planOp, subExprVecs, src, position+"."+op, version)
+		case "int-from", "int from": // int-from, int-to - integer range query, or the same without dash
+			return planIntRange(expr[op], op, expr, src, position)
+		case "time": // time, after, before - time range query
+			return planTimeRange(expr, src, position)
+		}
+	}
+	if version > 0 {
+		// Other values are no query, which match nothing unless parsed strictly
+		return nil, queryErrorAt(position, fmt.Errorf("Expecting a query, but %v given", q))
+	}
+	return &queryPlan{op: PLAN_NOOP}, nil
+}
+
+// Plan the sub-queries of union, intersection or complement. Does not place schema lock.
+func compileSubQueries(op int, subExprs []interface{}, src *Col, position string, version int) (plan *queryPlan, err error) {
+	plan = &queryPlan{op: op, subPlans: make([]*queryPlan, len(subExprs))}
+	for i, subExpr := range subExprs {
+		if plan.subPlans[i], err = compileQuery(subExpr, src, fmt.Sprintf("%s[%d]", position, i), version); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// Evaluate the query of the plan's shape and put result into result map. Does not place schema lock.
+func (plan *queryPlan) eval(ctx context.Context, q interface{}, src *Col, result *map[int]struct{}) (err error) {
+	switch plan.op {
+	case PLAN_UNION:
+		for i, subExpr := range q.([]interface{}) {
+			if err = plan.subPlans[i].eval(ctx, subExpr, src, result); err != nil {
+				return
+			}
+		}
+	case PLAN_ALL_IDS:
+		return evalAllIDs(ctx, src, result)
+	case PLAN_DOC_ID:
+		docID, err := strconv.ParseInt(q.(string), 10, 64)
+		if err != nil {
+			return dberr.New(dberr.ErrorExpectingInt, "Single Document ID", q)
+		}
+		(*result)[int(docID)] = struct{}{}
+	case PLAN_LOOKUP:
+		expr := q.(map[string]interface{})
+		return plan.lookup(ctx, expr["eq"], expr, src, result)
+	case PLAN_PATH_EXISTENCE:
+		return plan.pathExistence(ctx, q.(map[string]interface{}), src, result)
+	case PLAN_INT_RANGE:
+		expr := q.(map[string]interface{})
+		return plan.intRange(ctx, expr[plan.intFrom], expr, src, result)
+	case PLAN_TIME_RANGE:
+		return plan.timeRange(ctx, q.(map[string]interface{}), src, result)
+	case PLAN_INTERSECT:
+		subExprs := q.(map[string]interface{})["n"].([]interface{})
+		lookups := make([]*eqLookup, 0, len(subExprs))
+		others := make([]func(*map[int]struct{}) error, 0, len(subExprs))
+		for i, subExpr := range subExprs {
+			subPlan := plan.subPlans[i]
+			subMap, _ := subExpr.(map[string]interface{})
+			if _, hasLimit := subMap["limit"]; subPlan.op == PLAN_LOOKUP && !hasLimit {
+				// Equality lookup without limit
+				if subPlan.hint != HINT_NOINDEX {
+					src.useIndex(subPlan.idxName)
+				}
+				lookups = append(lookups, &eqLookup{vecPath: subPlan.vecPath, idxName: subPlan.idxName, strValue: valueText(subMap["eq"]), hint: subPlan.hint})
+			} else {
+				subExpr := subExpr
+				others = append(others, func(subResult *map[int]struct{}) error {
+					return subPlan.eval(ctx, subExpr, src, subResult)
+				})
+			}
+		}
+		return intersect(ctx, lookups, others, src, result)
+	case PLAN_COMPLEMENT, PLAN_DIFFERENCE, PLAN_SYM_DIFFERENCE:
+		subExprs := q.(map[string]interface{})[setOps[plan.op]].([]interface{})
+		subQueries := make([]func(*map[int]struct{}) error, len(subExprs))
+		for i, subExpr := range subExprs {
+			subPlan, subExpr := plan.subPlans[i], subExpr
+			subQueries[i] = func(subResult *map[int]struct{}) error {
+				return subPlan.eval(ctx, subExpr, src, subResult)
+			}
+		}
+		switch plan.op {
+		case PLAN_DIFFERENCE:
+			return difference(subQueries, result)
+		case PLAN_SYM_DIFFERENCE:
+			return symDifference(subQueries, result)
+		}
+		return complement(subQueries, result)
+	case PLAN_VERSIONED:
+		return plan.subPlans[0].eval(ctx, q.(map[string]interface{})["query"], src, result)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestQueryShape(t *testing.T) {
+	shapeOf := func(q interface{}) string {
+		var shape bytes.Buffer
+		writeQueryShape(&shape, q)
+		return shape.String()
+	}
+	sameShape := [][2]interface{}{
+		{map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}, map[string]interface{}{"eq": "x", "in": []interface{}{"a"}}},
+		{map[string]interface{}{"int-from": 1, "int-to": 2, "in": []interface{}{"a"}, "limit": 1},
+			map[string]interface{}{"int-from": 5, "int-to": 10, "in": []interface{}{"a"}, "limit": 3}},
+		{[]interface{}{"1", map[string]interface{}{"n": []interface{}{"all"}}}, []interface{}{"2", map[string]interface{}{"n": []interface{}{"all"}}}},
+		// Values of unknown attributes do not make up the shape
+		{map[string]interface{}{"eq": 1, "in": []interface{}{"a"}, "z": strings.Repeat("x", 10000)}, map[string]interface{}{"eq": 1, "in": []interface{}{"a"}, "y": 1}},
+	}
+	for _, pair := range sameShape {
+		if shapeOf(pair[0]) != shapeOf(pair[1]) {
+			t.Fatal(shapeOf(pair[0]), shapeOf(pair[1]))
+		}
+	}
+	differentShape := [][2]interface{}{
+		{map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}, map[string]interface{}{"eq": 1, "in": []interface{}{"b"}}},
+		{map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}, map[string]interface{}{"eq": 1, "in": []interface{}{"a"}, "limit": 1}},
+		{"all", "1"},
+		{map[string]interface{}{"n": []interface{}{"1"}}, map[string]interface{}{"c": []interface{}{"1"}}},
+		{map[string]interface{}{"eq": 1, "in": []interface{}{"a"}}, map[string]interface{}{"eq": 1, "in": []interface{}{"a"}, "z": 1}},
+		{map[string]interface{}{"d": []interface{}{"1"}}, map[string]interface{}{"x": []interface{}{"1"}}},
+	}
+	for _, pair := range differentShape {
+		if shapeOf(pair[0]) == shapeOf(pair[1]) {
+			t.Fatal(shapeOf(pair[0]))
+		}
+	}
+}
+
+func TestQueryPlanCache(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"a"})
+	ids := make([]int, 10)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Queries of the same shape share a plan, yet their results follow their own values
+	for i := range ids {
+		q, err := runQuery(`{"n": [{"eq": `+strconv.Itoa(i)+`, "in": ["a"]}, {"has": ["a"]}]}`, col)
+		if err != nil || len(q) != 1 || !ensureMapHasKeys(q, ids[i]) {
+			t.Fatal(i, q, err)
+		}
+	}
+	if col.cachedPlans() != 1 {
+		t.Fatal(col.cachedPlans())
+	}
+	// Values are still validated when the plan is cached
+	if _, err = runQuery(`{"eq": 1, "in": ["a"], "limit": 1}`, col); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = runQuery(`{"eq": 1, "in": ["a"], "limit": "a"}`, col); dberr.Type(err) != dberr.ErrorExpectingInt {
+		t.Fatal(err)
+	}
+	if _, err = runQuery(`["1", "2"]`, col); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = runQuery(`["1", "a"]`, col); dberr.Type(err) != dberr.ErrorExpectingInt {
+		t.Fatal(err)
+	}
+	// Failed plans and very long shapes are not cached
+	before := col.cachedPlans()
+	if _, err = runQuery(`[`+strings.Repeat(`"1", `, MAX_PLAN_SHAPE)+`"1"]`, col); err != nil {
+		t.Fatal(err)
+	} else if col.cachedPlans() != before {
+		t.Fatal(col.cachedPlans())
+	}
+	if _, err = runQuery(`{"eq": 1, "in": ["b"]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	if col.cachedPlans() != before {
+		t.Fatal(col.cachedPlans())
+	}
+	// Index changes invalidate cached plans
+	if err = col.Index([]string{"b"}); err != nil {
+		t.Fatal(err)
+	} else if col.cachedPlans() != 0 {
+		t.Fatal(col.cachedPlans())
+	}
+	if _, err = runQuery(`{"eq": 1, "in": ["b"]}`, col); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.Unindex([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = runQuery(`{"eq": 1, "in": ["b"]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+}
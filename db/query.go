@@ -3,9 +3,9 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"strconv"
 	"strings"
 
 	"github.com/cankansin/tiedot/dberr"
@@ -15,7 +15,7 @@ import (
 // Calculate union of sub-query results.
 func EvalUnion(exprs []interface{}, src *Col, result *map[int]struct{}) (err error) {
 	for _, subExpr := range exprs {
-		if err = evalQuery(subExpr, src, result, false); err != nil {
+		if err = evalQuery(context.Background(), subExpr, src, result, false); err != nil {
 			return
 		}
 	}
@@ -24,19 +24,32 @@ func EvalUnion(exprs []interface{}, src *Col, result *map[int]struct{}) (err err
 
 // Put all document IDs into result.
 func EvalAllIDs(src *Col, result *map[int]struct{}) (err error) {
-	src.forEachDoc(func(id int, _ []byte) bool {
+	return evalAllIDs(context.Background(), src, result)
+}
+
+// Put all document IDs into result, the scan stops once the context is done. Does not place schema lock.
+func evalAllIDs(ctx context.Context, src *Col, result *map[int]struct{}) error {
+	return src.scanDocs(ctx, func(id int, _ []byte) bool {
 		(*result)[id] = struct{}{}
 		return true
-	}, false)
-	return
+	}, false, false)
 }
 
 // Value equity check ("attribute == value") using hash lookup.
 func Lookup(lookupValue interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	plan, err := planLookup(expr, src, "$")
+	if err != nil {
+		return unpositioned(err)
+	}
+	return plan.lookup(context.Background(), lookupValue, expr, src, result)
+}
+
+// Validate lookup path and limit of a value equity check, return its plan. Does not place schema lock.
+func planLookup(expr map[string]interface{}, src *Col, position string) (plan *queryPlan, err error) {
 	// Figure out lookup path - JSON array "in"
 	path, hasPath := expr["in"]
 	if !hasPath {
-		return errors.New("Missing lookup path `in`")
+		return nil, queryErrorAt(position, errors.New("Missing lookup path `in`"))
 	}
 	vecPath := make([]string, 0)
 	if vecPathInterface, ok := path.([]interface{}); ok {
@@ -44,45 +57,74 @@ func Lookup(lookupValue interface{}, expr map[string]interface{}, src *Col, resu
 			vecPath = append(vecPath, fmt.Sprint(v))
 		}
 	} else {
-		return fmt.Errorf("Expecting vector lookup path `in`, but %v given", path)
+		return nil, queryErrorAt(position+".in", fmt.Errorf("Expecting vector lookup path `in`, but %v given", path))
 	}
 	// Figure out result number limit
-	intLimit := int(0)
-	if limit, hasLimit := expr["limit"]; hasLimit {
-		if floatLimit, ok := limit.(float64); ok {
-			intLimit = int(floatLimit)
-		} else if _, ok := limit.(int); ok {
-			intLimit = limit.(int)
-		} else {
-			return dberr.New(dberr.ErrorExpectingInt, "limit", limit)
-		}
+	if err = checkLimit(expr, position); err != nil {
+		return
 	}
-	lookupStrValue := fmt.Sprint(lookupValue) // the value to look for
-	lookupValueHash := StrHash(lookupStrValue)
 	scanPath := strings.Join(vecPath, INDEX_PATH_SEP)
-	if _, indexed := src.indexPaths[scanPath]; !indexed {
-		return dberr.New(dberr.ErrorNeedIndex, scanPath, expr)
+	if _, indexed := src.indexPaths[scanPath]; !indexed && expr["hint"] != HINT_NOINDEX {
+		return nil, dberr.New(dberr.ErrorNeedIndex, scanPath, expr)
 	}
-	num := lookupValueHash % src.db.numParts
-	ht := src.hts[num][scanPath]
-	ht.Lock.RLock()
-	vals := ht.Get(lookupValueHash, intLimit)
-	ht.Lock.RUnlock()
+	return &queryPlan{op: PLAN_LOOKUP, vecPath: vecPath, idxName: scanPath, hint: hintOf(expr)}, nil
+}
+
+// Evaluate value equity check of the plan. Does not place schema lock.
+func (plan *queryPlan) lookup(ctx context.Context, lookupValue interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	intLimit, ok := queryLimit(expr)
+	if !ok {
+		return dberr.New(dberr.ErrorExpectingInt, "limit", expr["limit"])
+	} else if plan.hint == HINT_NOINDEX {
+		return plan.scan(ctx, expr, intLimit, src, result)
+	}
+	src.useIndex(plan.idxName)
+	lookupStrValue := valueText(lookupValue) // the value to look for
+	vals := src.hashScan(plan.idxName, StrHash(lookupStrValue), intLimit)
 	for _, match := range vals {
 		// Filter result to avoid hash collision
-		if doc, err := src.read(match, false); err == nil {
-			for _, v := range GetIn(doc, vecPath) {
-				if fmt.Sprint(v) == lookupStrValue {
+		if doc, err := src.read(ctx, match, false); err == nil {
+			for _, v := range indexValues(doc, plan.vecPath) {
+				if valueText(v) == lookupStrValue {
 					(*result)[match] = struct{}{}
 				}
 			}
 		}
 	}
-	return
+	return ctx.Err()
+}
+
+// Return the index hint of a query operation, an empty string if there is none.
+func hintOf(expr map[string]interface{}) string {
+	hint, _ := expr["hint"].(string)
+	return hint
+}
+
+// Evaluate the lookup, existence test or range query of the plan by scanning the documents instead of the index, up to
+// the result number limit (0 - unlimited). Does not place schema lock.
+func (plan *queryPlan) scan(ctx context.Context, expr map[string]interface{}, intLimit int, src *Col, result *map[int]struct{}) error {
+	counter := 0
+	return src.scanDocs(ctx, func(id int, docB []byte) bool {
+		var doc map[string]interface{}
+		if src.unmarshalDoc(docB, &doc) == nil && matchOperation(expr, id, doc) {
+			(*result)[id] = struct{}{}
+			counter++
+		}
+		return intLimit == 0 || counter < intLimit
+	}, false, false)
 }
 
 // Value existence check (value != nil) using hash lookup.
 func PathExistence(hasPath interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	plan, err := planPathExistence(hasPath, expr, src, "$")
+	if err != nil {
+		return unpositioned(err)
+	}
+	return plan.pathExistence(context.Background(), expr, src, result)
+}
+
+// Validate path and limit of a value existence check, return its plan. Does not place schema lock.
+func planPathExistence(hasPath interface{}, expr map[string]interface{}, src *Col, position string) (plan *queryPlan, err error) {
 	// Figure out the path
 	vecPath := make([]string, 0)
 	if vecPathInterface, ok := hasPath.([]interface{}); ok {
@@ -90,106 +132,307 @@ func PathExistence(hasPath interface{}, expr map[string]interface{}, src *Col, r
 			vecPath = append(vecPath, fmt.Sprint(v))
 		}
 	} else {
-		return errors.New(fmt.Sprintf("Expecting vector path, but %v given", hasPath))
+		return nil, queryErrorAt(position+".has", errors.New(fmt.Sprintf("Expecting vector path, but %v given", hasPath)))
 	}
 	// Figure out result number limit
-	intLimit := 0
-	if limit, hasLimit := expr["limit"]; hasLimit {
-		if floatLimit, ok := limit.(float64); ok {
-			intLimit = int(floatLimit)
-		} else if _, ok := limit.(int); ok {
-			intLimit = limit.(int)
-		} else {
-			return dberr.New(dberr.ErrorExpectingInt, "limit", limit)
-		}
+	if err = checkLimit(expr, position); err != nil {
+		return
 	}
 	jointPath := strings.Join(vecPath, INDEX_PATH_SEP)
-	if _, indexed := src.indexPaths[jointPath]; !indexed {
-		return dberr.New(dberr.ErrorNeedIndex, vecPath, expr)
+	if _, indexed := src.indexPaths[jointPath]; !indexed && expr["hint"] != HINT_NOINDEX {
+		return nil, dberr.New(dberr.ErrorNeedIndex, vecPath, expr)
 	}
-	counter := 0
-	partDiv := src.approxDocCount(false) / src.db.numParts / 4000 // collect approx. 4k document IDs in each iteration
-	if partDiv == 0 {
-		partDiv++
+	return &queryPlan{op: PLAN_PATH_EXISTENCE, vecPath: vecPath, idxName: jointPath, hint: hintOf(expr)}, nil
+}
+
+// Evaluate value existence check of the plan. Does not place schema lock.
+func (plan *queryPlan) pathExistence(ctx context.Context, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	intLimit, ok := queryLimit(expr)
+	if !ok {
+		return dberr.New(dberr.ErrorExpectingInt, "limit", expr["limit"])
+	} else if plan.hint == HINT_NOINDEX {
+		return plan.scan(ctx, expr, intLimit, src, result)
 	}
+	src.useIndex(plan.idxName)
+	counter := 0
 	for iteratePart := 0; iteratePart < src.db.numParts; iteratePart++ {
-		ht := src.hts[iteratePart][jointPath]
-		ht.Lock.RLock()
-		for i := 0; i < partDiv; i++ {
-			_, ids := ht.GetPartition(i, partDiv)
-			for _, id := range ids {
-				(*result)[id] = struct{}{}
-				counter++
-				if counter == intLimit {
-					ht.Lock.RUnlock()
-					return nil
-				}
-			}
+		if err = ctx.Err(); err != nil {
+			return
 		}
+		ht := src.hts[iteratePart][plan.idxName]
+		ht.Lock.RLock()
+		moveOn := ht.ForEachEntry(0, 1, func(_, id int) bool {
+			(*result)[id] = struct{}{}
+			counter++
+			return counter != intLimit
+		})
 		ht.Lock.RUnlock()
+		if !moveOn {
+			return nil
+		}
 	}
 	return nil
 }
 
+// Return the optional result number limit of a query, or false if the limit is not an integer.
+func queryLimit(expr map[string]interface{}) (intLimit int, ok bool) {
+	limit, hasLimit := expr["limit"]
+	if !hasLimit {
+		return 0, true
+	}
+	if floatLimit, ok := limit.(float64); ok {
+		return int(floatLimit), true
+	} else if intLimit, ok := limit.(int); ok {
+		return intLimit, true
+	}
+	return 0, false
+}
+
+// An indexed equality lookup taking part in an intersection.
+type eqLookup struct {
+	vecPath  []string
+	idxName  string
+	strValue string
+	hint     string
+}
+
+// Return true only if the document really has the looked up value.
+func (lookup *eqLookup) match(doc map[string]interface{}) bool {
+	for _, v := range indexValues(doc, lookup.vecPath) {
+		if valueText(v) == lookup.strValue {
+			return true
+		}
+	}
+	return false
+}
+
 // Calculate intersection of sub-query results.
+// Indexed equality lookups are evaluated first, starting from the most selective one (having the fewest index entries),
+// the documents found by it are verified against the other lookups instead of scanning their index entries. A lookup
+// hinted "index" is evaluated first regardless of selectivity, and a lookup hinted "noindex" only verifies documents.
 func Intersect(subExprs interface{}, src *Col, result *map[int]struct{}) (err error) {
+	return evalQuery(context.Background(), map[string]interface{}{"n": subExprs}, src, result, false)
+}
+
+// Intersect verified equality lookups and results of the other sub-queries, put the intersection into result. The
+// sub-queries must have been validated. Does not place schema lock.
+func intersect(ctx context.Context, lookups []*eqLookup, others []func(*map[int]struct{}) error, src *Col, result *map[int]struct{}) (err error) {
 	myResult := make(map[int]struct{})
-	if subExprVecs, ok := subExprs.([]interface{}); ok {
-		first := true
-		for _, subExpr := range subExprVecs {
-			subResult := make(map[int]struct{})
-			intersection := make(map[int]struct{})
-			if err = evalQuery(subExpr, src, &subResult, false); err != nil {
+	first := true
+	var indexed []*eqLookup
+	for _, lookup := range lookups {
+		if lookup.hint == HINT_INDEX {
+			// Forced to go first
+			indexed = []*eqLookup{lookup}
+			break
+		} else if lookup.hint != HINT_NOINDEX {
+			indexed = append(indexed, lookup)
+		}
+	}
+	// Lookups all hinted "noindex" verify the results of the other sub-queries, or every document if there are none
+	verifyLater := len(indexed) == 0 && len(others) > 0
+	if len(lookups) > 0 && !verifyLater {
+		// Find the most selective lookup, the index entries of each lookup are scanned only as far as it takes to tell
+		// that the lookup is not more selective than the best one so far.
+		var candidates []int
+		for i, lookup := range indexed {
+			limit := 0
+			if i > 0 {
+				if len(candidates) == 0 {
+					break
+				}
+				limit = len(candidates) + 1
+			}
+			if scanned := src.hashScan(lookup.idxName, StrHash(lookup.strValue), limit); i == 0 || len(scanned) < len(candidates) {
+				candidates = scanned
+			}
+		}
+		if len(indexed) == 0 {
+			allIDs := make(map[int]struct{})
+			if err = evalAllIDs(ctx, src, &allIDs); err != nil {
 				return
 			}
-			if first {
-				myResult = subResult
-				first = false
-			} else {
-				for k := range subResult {
-					if _, inBoth := myResult[k]; inBoth {
-						intersection[k] = struct{}{}
-					}
+			for id := range allIDs {
+				candidates = append(candidates, id)
+			}
+		}
+		for _, id := range candidates {
+			if matchLookups(ctx, lookups, id, src) {
+				myResult[id] = struct{}{}
+			}
+		}
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		first = false
+		if len(myResult) == 0 {
+			// Nothing will survive the remaining sub-queries
+			return
+		}
+	}
+	for _, evalSubQuery := range others {
+		subResult := make(map[int]struct{})
+		intersection := make(map[int]struct{})
+		if err = evalSubQuery(&subResult); err != nil {
+			return
+		}
+		if first {
+			myResult = subResult
+			first = false
+		} else {
+			for k := range subResult {
+				if _, inBoth := myResult[k]; inBoth {
+					intersection[k] = struct{}{}
 				}
-				myResult = intersection
 			}
+			myResult = intersection
 		}
-		for docID := range myResult {
-			(*result)[docID] = struct{}{}
+	}
+	if verifyLater {
+		for id := range myResult {
+			if !matchLookups(ctx, lookups, id, src) {
+				delete(myResult, id)
+			}
+		}
+		if err = ctx.Err(); err != nil {
+			return
 		}
-	} else {
-		return dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+	}
+	for docID := range myResult {
+		(*result)[docID] = struct{}{}
 	}
 	return
 }
 
+// Return true only if the document exists and has the values of all the lookups. Does not place schema lock.
+func matchLookups(ctx context.Context, lookups []*eqLookup, id int, src *Col) bool {
+	doc, err := src.read(ctx, id, false)
+	if err != nil {
+		return false
+	}
+	for _, lookup := range lookups {
+		if !lookup.match(doc) {
+			return false
+		}
+	}
+	return true
+}
+
 // Calculate complement of sub-query results.
 func Complement(subExprs interface{}, src *Col, result *map[int]struct{}) (err error) {
+	subExprVecs, ok := subExprs.([]interface{})
+	if !ok {
+		return dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+	}
+	subQueries := make([]func(*map[int]struct{}) error, len(subExprVecs))
+	for i, subExpr := range subExprVecs {
+		subExpr := subExpr
+		subQueries[i] = func(subResult *map[int]struct{}) error {
+			return evalQuery(context.Background(), subExpr, src, subResult, false)
+		}
+	}
+	return complement(subQueries, result)
+}
+
+// Calculate complement of the sub-queries' results, put it into result.
+func complement(subQueries []func(*map[int]struct{}) error, result *map[int]struct{}) (err error) {
 	myResult := make(map[int]struct{})
-	if subExprVecs, ok := subExprs.([]interface{}); ok {
-		for _, subExpr := range subExprVecs {
-			subResult := make(map[int]struct{})
-			complement := make(map[int]struct{})
-			if err = evalQuery(subExpr, src, &subResult, false); err != nil {
-				return
-			}
-			for k := range subResult {
-				if _, inBoth := myResult[k]; !inBoth {
-					complement[k] = struct{}{}
-				}
+	for _, evalSubQuery := range subQueries {
+		subResult := make(map[int]struct{})
+		complement := make(map[int]struct{})
+		if err = evalSubQuery(&subResult); err != nil {
+			return
+		}
+		for k := range subResult {
+			if _, inBoth := myResult[k]; !inBoth {
+				complement[k] = struct{}{}
 			}
-			for k := range myResult {
-				if _, inBoth := subResult[k]; !inBoth {
-					complement[k] = struct{}{}
-				}
+		}
+		for k := range myResult {
+			if _, inBoth := subResult[k]; !inBoth {
+				complement[k] = struct{}{}
 			}
-			myResult = complement
 		}
-		for docID := range myResult {
+		myResult = complement
+	}
+	for docID := range myResult {
+		(*result)[docID] = struct{}{}
+	}
+	return
+}
+
+// Calculate difference of sub-query results - the documents in the result of the first sub-query but in none of the
+// others.
+func Difference(subExprs interface{}, src *Col, result *map[int]struct{}) (err error) {
+	return evalSetOp(subExprs, src, result, difference)
+}
+
+// Calculate symmetric difference of sub-query results - the documents in the result of exactly one sub-query.
+func SymmetricDifference(subExprs interface{}, src *Col, result *map[int]struct{}) (err error) {
+	return evalSetOp(subExprs, src, result, symDifference)
+}
+
+// Evaluate the sub-queries by the set operation.
+func evalSetOp(subExprs interface{}, src *Col, result *map[int]struct{}, setOp func([]func(*map[int]struct{}) error, *map[int]struct{}) error) error {
+	subExprVecs, ok := subExprs.([]interface{})
+	if !ok {
+		return dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+	}
+	subQueries := make([]func(*map[int]struct{}) error, len(subExprVecs))
+	for i, subExpr := range subExprVecs {
+		subExpr := subExpr
+		subQueries[i] = func(subResult *map[int]struct{}) error {
+			return evalQuery(context.Background(), subExpr, src, subResult, false)
+		}
+	}
+	return setOp(subQueries, result)
+}
+
+// Calculate difference of the sub-queries' results, put it into result. Once nothing remains of the first result,
+// the remaining sub-queries are not evaluated.
+func difference(subQueries []func(*map[int]struct{}) error, result *map[int]struct{}) (err error) {
+	if len(subQueries) == 0 {
+		return
+	}
+	myResult := make(map[int]struct{})
+	if err = subQueries[0](&myResult); err != nil {
+		return
+	}
+	for _, evalSubQuery := range subQueries[1:] {
+		if len(myResult) == 0 {
+			break
+		}
+		subResult := make(map[int]struct{})
+		if err = evalSubQuery(&subResult); err != nil {
+			return
+		}
+		for k := range subResult {
+			delete(myResult, k)
+		}
+	}
+	for docID := range myResult {
+		(*result)[docID] = struct{}{}
+	}
+	return
+}
+
+// Calculate symmetric difference of the sub-queries' results, put it into result. Unlike complement, a document in
+// the results of three sub-queries is not in the symmetric difference.
+func symDifference(subQueries []func(*map[int]struct{}) error, result *map[int]struct{}) (err error) {
+	seen := make(map[int]int)
+	for _, evalSubQuery := range subQueries {
+		subResult := make(map[int]struct{})
+		if err = evalSubQuery(&subResult); err != nil {
+			return
+		}
+		for k := range subResult {
+			seen[k]++
+		}
+	}
+	for docID, times := range seen {
+		if times == 1 {
 			(*result)[docID] = struct{}{}
 		}
-	} else {
-		return dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
 	}
 	return
 }
@@ -204,9 +447,18 @@ func (col *Col) hashScan(idxName string, key, limit int) []int {
 
 // Look for indexed integer values within the specified integer range.
 func IntRange(intFrom interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	plan, err := planIntRange(intFrom, "int-from", expr, src, "$")
+	if err != nil {
+		return unpositioned(err)
+	}
+	return plan.intRange(context.Background(), intFrom, expr, src, result)
+}
+
+// Validate path, limit and range of an integer range query, return its plan. Does not place schema lock.
+func planIntRange(intFrom interface{}, fromAttr string, expr map[string]interface{}, src *Col, position string) (plan *queryPlan, err error) {
 	path, hasPath := expr["in"]
 	if !hasPath {
-		return errors.New("Missing path `in`")
+		return nil, queryErrorAt(position, errors.New("Missing path `in`"))
 	}
 	// Figure out the path
 	vecPath := make([]string, 0)
@@ -215,27 +467,34 @@ func IntRange(intFrom interface{}, expr map[string]interface{}, src *Col, result
 			vecPath = append(vecPath, fmt.Sprint(v))
 		}
 	} else {
-		return errors.New(fmt.Sprintf("Expecting vector path `in`, but %v given", path))
+		return nil, queryErrorAt(position+".in", errors.New(fmt.Sprintf("Expecting vector path `in`, but %v given", path)))
 	}
+	if err = checkIntRange(intFrom, fromAttr, expr, position); err != nil {
+		return
+	}
+	htPath := strings.Join(vecPath, ",")
+	if _, indexScan := src.indexPaths[htPath]; !indexScan && expr["hint"] != HINT_NOINDEX {
+		return nil, dberr.New(dberr.ErrorNeedIndex, vecPath, expr)
+	}
+	return &queryPlan{op: PLAN_INT_RANGE, vecPath: vecPath, idxName: htPath, intFrom: fromAttr, hint: hintOf(expr)}, nil
+}
+
+// Figure out result number limit and the range ("from" value & "to" value) of an integer range query.
+func intRangeBounds(intFrom interface{}, expr map[string]interface{}) (intLimit, from, to int, err error) {
 	// Figure out result number limit
-	intLimit := int(0)
-	if limit, hasLimit := expr["limit"]; hasLimit {
-		if floatLimit, ok := limit.(float64); ok {
-			intLimit = int(floatLimit)
-		} else if _, ok := limit.(int); ok {
-			intLimit = limit.(int)
-		} else {
-			return dberr.New(dberr.ErrorExpectingInt, limit)
-		}
+	var ok bool
+	if intLimit, ok = queryLimit(expr); !ok {
+		err = dberr.New(dberr.ErrorExpectingInt, expr["limit"])
+		return
 	}
 	// Figure out the range ("from" value & "to" value)
-	from, to := int(0), int(0)
 	if floatFrom, ok := intFrom.(float64); ok {
 		from = int(floatFrom)
 	} else if _, ok := intFrom.(int); ok {
 		from = intFrom.(int)
 	} else {
-		return dberr.New(dberr.ErrorExpectingInt, "int-from", from)
+		err = dberr.New(dberr.ErrorExpectingInt, "int-from", from)
+		return
 	}
 	if intTo, ok := expr["int-to"]; ok {
 		if floatTo, ok := intTo.(float64); ok {
@@ -243,7 +502,7 @@ func IntRange(intFrom interface{}, expr map[string]interface{}, src *Col, result
 		} else if _, ok := intTo.(int); ok {
 			to = intTo.(int)
 		} else {
-			return dberr.New(dberr.ErrorExpectingInt, "int-to", to)
+			err = dberr.New(dberr.ErrorExpectingInt, "int-to", to)
 		}
 	} else if intTo, ok := expr["int to"]; ok {
 		if floatTo, ok := intTo.(float64); ok {
@@ -251,25 +510,36 @@ func IntRange(intFrom interface{}, expr map[string]interface{}, src *Col, result
 		} else if _, ok := intTo.(int); ok {
 			to = intTo.(int)
 		} else {
-			return dberr.New(dberr.ErrorExpectingInt, "int to", to)
+			err = dberr.New(dberr.ErrorExpectingInt, "int to", to)
 		}
 	} else {
-		return dberr.New(dberr.ErrorMissing, "int-to")
+		err = dberr.New(dberr.ErrorMissing, "int-to")
+	}
+	return
+}
+
+// Evaluate integer range query of the plan. Does not place schema lock.
+func (plan *queryPlan) intRange(ctx context.Context, intFrom interface{}, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	intLimit, from, to, err := intRangeBounds(intFrom, expr)
+	if err != nil {
+		return
+	} else if plan.hint == HINT_NOINDEX {
+		return plan.scan(ctx, expr, intLimit, src, result)
 	}
 	if to > from && to-from > 1000 || from > to && from-to > 1000 {
 		tdlog.CritNoRepeat("Query %v involves index lookup on more than 1000 values, which can be very inefficient", expr)
 	}
+	src.useIndex(plan.idxName)
 	counter := int(0) // Number of results already collected
-	htPath := strings.Join(vecPath, ",")
-	if _, indexScan := src.indexPaths[htPath]; !indexScan {
-		return dberr.New(dberr.ErrorNeedIndex, vecPath, expr)
-	}
 	if from < to {
 		// Forward scan - from low value to high value
 		for lookupValue := from; lookupValue <= to; lookupValue++ {
+			if err = ctx.Err(); err != nil {
+				return
+			}
 			lookupStrValue := fmt.Sprint(float64(lookupValue))
 			hashValue := StrHash(lookupStrValue)
-			vals := src.hashScan(htPath, hashValue, int(intLimit))
+			vals := src.hashScan(plan.idxName, hashValue, int(intLimit))
 			for _, docID := range vals {
 				if intLimit > 0 && counter == intLimit {
 					break
@@ -281,9 +551,12 @@ func IntRange(intFrom interface{}, expr map[string]interface{}, src *Col, result
 	} else {
 		// Backward scan - from high value to low value
 		for lookupValue := from; lookupValue >= to; lookupValue-- {
+			if err = ctx.Err(); err != nil {
+				return
+			}
 			lookupStrValue := fmt.Sprint(float64(lookupValue))
 			hashValue := StrHash(lookupStrValue)
-			vals := src.hashScan(htPath, hashValue, int(intLimit))
+			vals := src.hashScan(plan.idxName, hashValue, int(intLimit))
 			for _, docID := range vals {
 				if intLimit > 0 && counter == intLimit {
 					break
@@ -296,47 +569,29 @@ func IntRange(intFrom interface{}, expr map[string]interface{}, src *Col, result
 	return
 }
 
-func evalQuery(q interface{}, src *Col, result *map[int]struct{}, placeSchemaLock bool) (err error) {
+// Evaluate the query, giving up once the context is done with the context's error. The result is then incomplete.
+func evalQuery(ctx context.Context, q interface{}, src *Col, result *map[int]struct{}, placeSchemaLock bool) (err error) {
 	if placeSchemaLock {
 		src.db.schemaLock.RLock()
 		defer src.db.schemaLock.RUnlock()
 	}
-	switch expr := q.(type) {
-	case []interface{}: // [sub query 1, sub query 2, etc]
-		return EvalUnion(expr, src, result)
-	case string:
-		if expr == "all" {
-			return EvalAllIDs(src, result)
-		}
-		// Might be single document number
-		docID, err := strconv.ParseInt(expr, 10, 64)
-		if err != nil {
-			return dberr.New(dberr.ErrorExpectingInt, "Single Document ID", docID)
-		}
-		(*result)[int(docID)] = struct{}{}
-	case map[string]interface{}:
-		if lookupValue, lookup := expr["eq"]; lookup { // eq - lookup
-			return Lookup(lookupValue, expr, src, result)
-		} else if hasPath, exist := expr["has"]; exist { // has - path existence test
-			return PathExistence(hasPath, expr, src, result)
-		} else if subExprs, intersect := expr["n"]; intersect { // n - intersection
-			return Intersect(subExprs, src, result)
-		} else if subExprs, complement := expr["c"]; complement { // c - complement
-			return Complement(subExprs, src, result)
-		} else if intFrom, htRange := expr["int-from"]; htRange { // int-from, int-to - integer range query
-			return IntRange(intFrom, expr, src, result)
-		} else if intFrom, htRange := expr["int from"]; htRange { // "int from, "int to" - integer range query - same as above, just without dash
-			return IntRange(intFrom, expr, src, result)
-		} else {
-			return errors.New(fmt.Sprintf("Query %v does not contain any operation (lookup/union/etc)", expr))
-		}
+	plan, err := src.checkedPlan(q)
+	if err != nil {
+		return
 	}
-	return nil
+	return plan.eval(ctx, q, src, result)
 }
 
 // Main entrance to query processor - evaluate a query and put result into result map (as map keys).
 func EvalQuery(q interface{}, src *Col, result *map[int]struct{}) (err error) {
-	return evalQuery(q, src, result, true)
+	return evalQueryArchived(context.Background(), q, src, result)
+}
+
+// Evaluate the query on the collection like EvalQuery does, and return the IDs of the documents in the result.
+func (col *Col) Query(q interface{}) (result map[int]struct{}, err error) {
+	result = make(map[int]struct{})
+	err = EvalQuery(q, col, &result)
+	return
 }
 
 // TODO: How to bring back regex matcher?
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -283,9 +284,10 @@ func TestEvalUnionQueryErr(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	col, _ := OpenCol(db, "test")
 	errMessage := "Error query"
-	patch := monkey.Patch(evalQuery, func(q interface{}, src *Col, result *map[int]struct{}, placeSchemaLock bool) (err error) {
+	patch := monkey.Patch(evalQuery, func(_ context.Context, q interface{}, src *Col, result *map[int]struct{}, placeSchemaLock bool) (err error) {
 		return errors.New(errMessage)
 	})
 	defer patch.Unpatch()
@@ -298,6 +300,7 @@ func TestLookupNotHasPat(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	col, _ := OpenCol(db, "test")
 	result := map[int]struct{}{0: struct{}{}}
 
@@ -309,6 +312,7 @@ func TestLookupVektorLookupErr(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	col, _ := OpenCol(db, "test")
 	result := map[int]struct{}{0: struct{}{}}
 
@@ -320,6 +324,7 @@ func TestPathExistenceVektorPAth(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	col, _ := OpenCol(db, "test")
 	result := map[int]struct{}{0: struct{}{}}
 
@@ -331,6 +336,7 @@ func TestPathExistenceLimitIsint(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	col, _ := OpenCol(db, "test")
 	result := map[int]struct{}{0: struct{}{}}
 
@@ -340,9 +346,10 @@ func TestIntersectEvalQueryErr(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	col, _ := OpenCol(db, "test")
 	errMessage := "Error query"
-	patch := monkey.Patch(evalQuery, func(q interface{}, src *Col, result *map[int]struct{}, placeSchemaLock bool) (err error) {
+	patch := monkey.Patch(evalQuery, func(_ context.Context, q interface{}, src *Col, result *map[int]struct{}, placeSchemaLock bool) (err error) {
 		return errors.New(errMessage)
 	})
 	defer patch.Unpatch()
@@ -355,6 +362,7 @@ func TestIntersectSubExprsNotValidType(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	col, _ := OpenCol(db, "test")
 
 	result := map[int]struct{}{0: struct{}{}}
@@ -366,9 +374,10 @@ func TestComplementEvalQueryErr(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	col, _ := OpenCol(db, "test")
 	errMessage := "Error query"
-	patch := monkey.Patch(evalQuery, func(q interface{}, src *Col, result *map[int]struct{}, placeSchemaLock bool) (err error) {
+	patch := monkey.Patch(evalQuery, func(_ context.Context, q interface{}, src *Col, result *map[int]struct{}, placeSchemaLock bool) (err error) {
 		return errors.New(errMessage)
 	})
 	defer patch.Unpatch()
@@ -381,6 +390,7 @@ func TestNameIntRange(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	col, _ := OpenCol(db, "test")
 
 	result := map[int]struct{}{0: struct{}{}}
@@ -392,6 +402,7 @@ func TestNameIntExpInNotFormat(t *testing.T) {
 	os.RemoveAll(TEST_DATA_DIR)
 	defer os.RemoveAll(TEST_DATA_DIR)
 	db, _ := OpenDB(TEST_DATA_DIR)
+	defer closeTestDB(db)
 	col, _ := OpenCol(db, "test")
 
 	result := map[int]struct{}{0: struct{}{}}
@@ -399,3 +410,203 @@ func TestNameIntExpInNotFormat(t *testing.T) {
 		t.Error("Expected error")
 	}
 }
+func TestIntersectPlan(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"common"})
+	col.Index([]string{"rare"})
+	col.Index([]string{"tag"})
+	// "common" matches every document, "rare" only matches a few
+	ids := make([]int, 200)
+	for i := range ids {
+		doc := map[string]interface{}{"common": 1, "rare": i % 50, "tag": []interface{}{i % 2, "x"}}
+		if ids[i], err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []int{ids[3], ids[53], ids[103], ids[153]}
+	for _, query := range []string{
+		`{"n": [{"eq": 1, "in": ["common"]}, {"eq": 3, "in": ["rare"]}]}`,
+		`{"n": [{"eq": 3, "in": ["rare"]}, {"eq": 1, "in": ["common"]}]}`,
+		`{"n": [{"eq": 1, "in": ["common"]}, {"eq": "x", "in": ["tag"]}, {"eq": 3, "in": ["rare"]}]}`,
+		`{"n": [{"eq": 1, "in": ["common"]}, {"eq": 3, "in": ["rare"]}, {"has": ["tag"]}]}`,
+	} {
+		q, err := runQuery(query, col)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ensureMapHasKeys(q, expected...) {
+			t.Fatal(query, q)
+		}
+	}
+	// Lookup with limit is evaluated on its own, just like a non-indexed sub-query
+	q, err := runQuery(`{"n": [{"eq": 1, "in": ["common"], "limit": 1}, {"eq": 1, "in": ["common"]}]}`, col)
+	if err != nil || len(q) != 1 {
+		t.Fatal(q, err)
+	}
+	// Empty intersection
+	q, err = runQuery(`{"n": [{"eq": 0, "in": ["tag"]}, {"eq": 3, "in": ["rare"]}]}`, col)
+	if err != nil || len(q) != 0 {
+		t.Fatal(q, err)
+	}
+	// Sub-query on a path without index still requires index
+	if _, err = runQuery(`{"n": [{"eq": 3, "in": ["rare"]}, {"eq": 1, "in": ["nonexistent"]}]}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	// Malformed sub-query following an empty intersection is still an error
+	if err = Intersect([]interface{}{
+		map[string]interface{}{"eq": "none", "in": []interface{}{"rare"}},
+		map[string]interface{}{"int-from": 1, "int-to": "x", "in": []interface{}{"rare"}},
+	}, col, &map[int]struct{}{}); dberr.Type(err) != dberr.ErrorExpectingInt {
+		t.Fatal(err)
+	}
+}
+
+func TestDifference(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"tag"})
+	// Tags 0 to 2 of each document are the bits of its number
+	ids := make([]int, 8)
+	docs := make([]map[string]interface{}, 8)
+	for i := range ids {
+		tags := []interface{}{}
+		for bit := 0; bit < 3; bit++ {
+			if i&(1<<bit) != 0 {
+				tags = append(tags, bit)
+			}
+		}
+		docs[i] = map[string]interface{}{"tag": tags}
+		if ids[i], err = col.Insert(docs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		query    string
+		expected []int
+	}{
+		// In 0 but not 1, and the other way around
+		{`{"d": [{"eq": 0, "in": ["tag"]}, {"eq": 1, "in": ["tag"]}]}`, []int{1, 5}},
+		{`{"d": [{"eq": 1, "in": ["tag"]}, {"eq": 0, "in": ["tag"]}]}`, []int{2, 6}},
+		{`{"d": ["all", {"eq": 0, "in": ["tag"]}, {"eq": 1, "in": ["tag"]}]}`, []int{0, 4}},
+		{`{"d": [{"eq": 2, "in": ["tag"]}]}`, []int{4, 5, 6, 7}},
+		{`{"d": [{"eq": 0, "in": ["tag"]}, "all", {"eq": 3, "in": ["tag"]}]}`, []int{}},
+		{`{"d": []}`, []int{}},
+		// In exactly one of 0, 1 and 2, unlike complement which also holds the documents in all three
+		{`{"x": [{"eq": 0, "in": ["tag"]}, {"eq": 1, "in": ["tag"]}, {"eq": 2, "in": ["tag"]}]}`, []int{1, 2, 4}},
+		{`{"c": [{"eq": 0, "in": ["tag"]}, {"eq": 1, "in": ["tag"]}, {"eq": 2, "in": ["tag"]}]}`, []int{1, 2, 4, 7}},
+		{`{"x": [{"eq": 0, "in": ["tag"]}, {"eq": 1, "in": ["tag"]}]}`, []int{1, 2, 5, 6}},
+		{`[{"x": []}, {"d": [{"n": [{"eq": 0, "in": ["tag"]}, {"eq": 1, "in": ["tag"]}]}, {"eq": 2, "in": ["tag"]}]}]`, []int{3}},
+	} {
+		q, err := runQuery(test.query, col)
+		if err != nil {
+			t.Fatal(test.query, err)
+		}
+		expected := make([]int, len(test.expected))
+		for i, num := range test.expected {
+			expected[i] = ids[num]
+		}
+		if !ensureMapHasKeys(q, expected...) {
+			t.Fatal(test.query, q)
+		}
+		// Views match the documents alike
+		var jq interface{}
+		json.Unmarshal([]byte(test.query), &jq)
+		for i, id := range ids {
+			if _, inResult := q[id]; matchQuery(jq, id, docs[i]) != inResult {
+				t.Fatal(test.query, i)
+			}
+		}
+	}
+	if _, err = runQuery(`{"d": {"eq": 0, "in": ["tag"]}}`, col); dberr.Type(err) != dberr.ErrorExpectingSubQuery {
+		t.Fatal(err)
+	} else if err = SymmetricDifference(nil, col, &map[int]struct{}{}); dberr.Type(err) != dberr.ErrorExpectingSubQuery {
+		t.Fatal(err)
+	}
+	// The operations came with query version 2
+	if _, err = runQuery(`{"version": 1, "query": {"d": ["all"]}}`, col); err == nil || !strings.Contains(err.Error(), "$.query.d") {
+		t.Fatal(err)
+	} else if q, err := runQuery(`{"version": 2, "query": {"x": ["all"]}}`, col); err != nil || len(q) != 8 {
+		t.Fatal(q, err)
+	}
+}
+
+func TestIndexHint(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	col.Index([]string{"common"})
+	col.Index([]string{"rare"})
+	ids := make([]int, 100)
+	for i := range ids {
+		doc := map[string]interface{}{"common": 1, "rare": i % 10, "n": i, "unindexed": i % 2}
+		if ids[i], err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []int{ids[3], ids[13], ids[23], ids[33], ids[43], ids[53], ids[63], ids[73], ids[83], ids[93]}
+	// Hints change how the intersection is evaluated, not its result
+	for _, query := range []string{
+		`{"n": [{"eq": 1, "in": ["common"], "hint": "index"}, {"eq": 3, "in": ["rare"]}]}`,
+		`{"n": [{"eq": 1, "in": ["common"]}, {"eq": 3, "in": ["rare"], "hint": "noindex"}]}`,
+		`{"n": [{"eq": 1, "in": ["common"], "hint": "noindex"}, {"eq": 3, "in": ["rare"], "hint": "noindex"}]}`,
+		`{"n": [{"eq": 1, "in": ["unindexed"], "hint": "noindex"}, {"eq": 3, "in": ["rare"]}]}`,
+		`{"n": [{"eq": 1, "in": ["common"], "hint": "noindex"}, {"int-from": 3, "int-to": 3, "in": ["rare"]}]}`,
+		`{"eq": 3, "in": ["rare"], "hint": "noindex"}`,
+		`{"int-from": 3, "int-to": 3, "in": ["rare"], "hint": "noindex"}`,
+		`{"n": [{"has": ["rare"], "hint": "noindex"}, {"eq": 3, "in": ["rare"], "hint": "index"}]}`,
+	} {
+		q, err := runQuery(query, col)
+		if err != nil {
+			t.Fatal(query, err)
+		} else if !ensureMapHasKeys(q, expected...) {
+			t.Fatal(query, q)
+		}
+	}
+	// Documents are scanned without index up to the limit
+	if q, err := runQuery(`{"has": ["n"], "hint": "noindex", "limit": 5}`, col); err != nil || len(q) != 5 {
+		t.Fatal(q, err)
+	} else if q, err = runQuery(`{"eq": 0, "in": ["unindexed"], "hint": "noindex"}`, col); err != nil || len(q) != 50 {
+		t.Fatal(q, err)
+	}
+	// An index may not be used without being there
+	if _, err = runQuery(`{"eq": 0, "in": ["unindexed"], "hint": "index"}`, col); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	} else if _, err = runQuery(`{"eq": 0, "in": ["rare"], "hint": "fast"}`, col); err == nil || !strings.Contains(err.Error(), "$.hint") {
+		t.Fatal(err)
+	} else if _, err = runQuery(`{"version": 2, "query": {"eq": 0, "in": ["rare"], "hint": "index"}}`, col); err == nil || !strings.Contains(err.Error(), "$.query.hint") {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,248 @@
+// Query validation.
+//
+// A query is validated in its entirety before any part of it is evaluated, so that a malformed query never returns
+// partial results or spends effort on its well-formed parts. The structure is validated once per query shape, when its
+// plan is made (see compileQuery), and the values are validated against the plan on every evaluation. Errors tell the
+// position of the malformed part using JSON path notation, e.g. `$[1].n[0].limit` is the limit of the first sub-query
+// of an intersection, which is the second sub-query of a union.
+
+package db
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Version of the query syntax understood, queries marked with a later version are refused. Operations added to the
+// syntax come with a new version, so that a query meant for a later version does not silently mean something else.
+const QUERY_VERSION = 4
+
+// Hints of a query operation on the use of its index, given in attribute "hint".
+const (
+	HINT_INDEX   = "index"   // Use the index; a lookup in an intersection is evaluated first, other lookups only verify its documents
+	HINT_NOINDEX = "noindex" // Scan the documents instead; a lookup in an intersection only verifies the documents found otherwise
+)
+
+// The operations a query object may carry, in the order of precedence, and the attributes allowed along with each.
+var (
+	queryOps   = []string{"eq", "has", "n", "c", "d", "x", "int-from", "int from", "time"}
+	queryAttrs = map[string]map[string]struct{}{
+		"eq":       {"eq": {}, "in": {}, "limit": {}, "hint": {}},
+		"has":      {"has": {}, "limit": {}, "hint": {}},
+		"n":        {"n": {}},
+		"c":        {"c": {}},
+		"d":        {"d": {}},
+		"x":        {"x": {}},
+		"int-from": {"int-from": {}, "int-to": {}, "int to": {}, "in": {}, "limit": {}, "hint": {}},
+		"int from": {"int from": {}, "int-to": {}, "int to": {}, "in": {}, "limit": {}, "hint": {}},
+		"time":     {"time": {}, "after": {}, "before": {}, "limit": {}, "hint": {}},
+	}
+	// The query version each operation or attribute was added in, those not listed are there since version 1
+	queryAttrVersions = map[string]int{"d": 2, "x": 2, "hint": 3, "time": 4}
+)
+
+// QueryError is a malformed query, it tells the position of the malformed part in the query.
+type QueryError struct {
+	Position string // Position in JSON path notation, "$" is the query itself
+	Err      error
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("Query error at %s: %v", e.Position, e.Err)
+}
+
+// Return the error at the position, so that dberr.Type recognises it.
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// Return a query error at the position.
+func queryErrorAt(position string, err error) error {
+	return &QueryError{Position: position, Err: err}
+}
+
+// Return the one operation carried by a query object, after making sure that the object has no other attributes than
+// those of the operation.
+func queryOperation(expr map[string]interface{}, position string) (op string, err error) {
+	for _, candidate := range queryOps {
+		if _, exists := expr[candidate]; !exists {
+			continue
+		} else if op != "" {
+			return "", queryErrorAt(position, fmt.Errorf("Query %v contains more than one operation (`%s` and `%s`)", expr, op, candidate))
+		}
+		op = candidate
+	}
+	if op == "" {
+		return "", queryErrorAt(position, fmt.Errorf("Query %v does not contain any operation (lookup/union/etc)", expr))
+	}
+	attrs := make([]string, 0, len(expr))
+	for attr := range expr {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+	for _, attr := range attrs {
+		if _, allowed := queryAttrs[op][attr]; !allowed {
+			return "", queryErrorAt(position+"."+attr, fmt.Errorf("Unknown attribute `%s` in `%s` operation", attr, op))
+		}
+	}
+	if hint, hasHint := expr["hint"]; hasHint && hint != HINT_INDEX && hint != HINT_NOINDEX {
+		return "", queryErrorAt(position+".hint", fmt.Errorf("Expecting hint `%s` or `%s`, but %v given", HINT_INDEX, HINT_NOINDEX, hint))
+	}
+	return
+}
+
+// Validate the values (document IDs, limits and ranges) of a query of the plan's shape. The error position is relative
+// to the query. Does not place schema lock.
+func (plan *queryPlan) check(q interface{}) error {
+	switch plan.op {
+	case PLAN_UNION:
+		for i, subExpr := range q.([]interface{}) {
+			if err := plan.subPlans[i].check(subExpr); err != nil {
+				return subQueryError(fmt.Sprintf("[%d]", i), err)
+			}
+		}
+	case PLAN_DOC_ID:
+		if _, err := strconv.ParseInt(q.(string), 10, 64); err != nil {
+			return queryErrorAt("$", dberr.New(dberr.ErrorExpectingInt, "Single Document ID", q))
+		}
+	case PLAN_LOOKUP, PLAN_PATH_EXISTENCE:
+		return checkLimit(q.(map[string]interface{}), "$")
+	case PLAN_INT_RANGE:
+		expr := q.(map[string]interface{})
+		return checkIntRange(expr[plan.intFrom], plan.intFrom, expr, "$")
+	case PLAN_TIME_RANGE:
+		return checkTimeRange(q.(map[string]interface{}), "$")
+	case PLAN_INTERSECT, PLAN_COMPLEMENT, PLAN_DIFFERENCE, PLAN_SYM_DIFFERENCE:
+		op := setOps[plan.op]
+		for i, subExpr := range q.(map[string]interface{})[op].([]interface{}) {
+			if err := plan.subPlans[i].check(subExpr); err != nil {
+				return subQueryError(fmt.Sprintf(".%s[%d]", op, i), err)
+			}
+		}
+	case PLAN_VERSIONED:
+		if err := plan.subPlans[0].check(q.(map[string]interface{})["query"]); err != nil {
+			return subQueryError(".query", err)
+		}
+	}
+	return nil
+}
+
+// Return the query marked with the current syntax version, unless it carries a version already. The query is then
+// parsed in strict mode.
+func VersionedQuery(q interface{}) interface{} {
+	if expr, isMap := q.(map[string]interface{}); isMap {
+		if _, versioned := expr["version"]; versioned {
+			return q
+		}
+	}
+	return map[string]interface{}{"version": float64(QUERY_VERSION), "query": q}
+}
+
+// Validate the version marker of a query of the form {"version": 1, "query": ...} and return the version. The version
+// must be understood, and the marker may not carry other attributes.
+func checkQueryVersion(expr map[string]interface{}, position string) (int, error) {
+	var version float64
+	switch v := expr["version"].(type) {
+	case float64:
+		version = v
+	case int:
+		version = float64(v)
+	default:
+		return 0, queryErrorAt(position+".version", dberr.New(dberr.ErrorExpectingInt, "version", v))
+	}
+	if version != math.Trunc(version) || version < 1 || version > QUERY_VERSION {
+		return 0, queryErrorAt(position+".version", fmt.Errorf("Query version %v is not supported, the latest is %d", version, QUERY_VERSION))
+	}
+	if _, hasQuery := expr["query"]; !hasQuery {
+		return 0, queryErrorAt(position, dberr.New(dberr.ErrorMissing, "query"))
+	}
+	for attr := range expr {
+		if attr != "version" && attr != "query" {
+			return 0, queryErrorAt(position+"."+attr, fmt.Errorf("Unknown attribute `%s` of a versioned query", attr))
+		}
+	}
+	return int(version), nil
+}
+
+// Validate a query operation in strict mode, which a query of the version is parsed in. Besides the checks made on
+// every query, strict mode refuses operations and attributes added after the version, values that are no query (which
+// otherwise match nothing), paths made of anything but strings (which are otherwise converted to strings), and objects
+// or arrays looked up (which otherwise match nothing).
+func checkStrict(expr map[string]interface{}, version int, position string) error {
+	for attr := range expr {
+		if attrVersion := queryAttrVersions[attr]; attrVersion > version {
+			return queryErrorAt(position+"."+attr, fmt.Errorf("`%s` requires query version %d", attr, attrVersion))
+		}
+	}
+	for _, pathAttr := range []string{"in", "has", "time"} {
+		path, hasPath := expr[pathAttr].([]interface{})
+		if !hasPath {
+			continue
+		}
+		for i, v := range path {
+			if _, isStr := v.(string); !isStr {
+				return queryErrorAt(fmt.Sprintf("%s.%s[%d]", position, pathAttr, i), fmt.Errorf("Expecting a string in path, but %v given", v))
+			}
+		}
+	}
+	switch expr["eq"].(type) {
+	case map[string]interface{}, []interface{}:
+		return queryErrorAt(position+".eq", fmt.Errorf("Expecting a value to look up, but %v given", expr["eq"]))
+	}
+	return nil
+}
+
+// Validate the optional result number limit of a query.
+func checkLimit(expr map[string]interface{}, position string) error {
+	if limit, hasLimit := expr["limit"]; hasLimit && !isQueryInt(limit) {
+		return queryErrorAt(position+".limit", dberr.New(dberr.ErrorExpectingInt, "limit", limit))
+	}
+	return nil
+}
+
+// Validate the limit and range of an integer range query, the range begins with the value of attribute fromAttr.
+func checkIntRange(intFrom interface{}, fromAttr string, expr map[string]interface{}, position string) error {
+	if err := checkLimit(expr, position); err != nil {
+		return err
+	} else if !isQueryInt(intFrom) {
+		return queryErrorAt(position+"."+fromAttr, dberr.New(dberr.ErrorExpectingInt, fromAttr, intFrom))
+	}
+	toAttr := "int-to"
+	if _, exists := expr[toAttr]; !exists {
+		toAttr = "int to"
+	}
+	if to, exists := expr[toAttr]; !exists {
+		return queryErrorAt(position, dberr.New(dberr.ErrorMissing, "int-to"))
+	} else if !isQueryInt(to) {
+		return queryErrorAt(position+"."+toAttr, dberr.New(dberr.ErrorExpectingInt, toAttr, to))
+	}
+	return nil
+}
+
+// Return the error without its position, for the functions evaluating a single query operation on their own.
+func unpositioned(err error) error {
+	if queryErr, ok := err.(*QueryError); ok {
+		return queryErr.Err
+	}
+	return err
+}
+
+// Move the position of a sub-query's error (relative to the sub-query) into the query containing the sub-query.
+func subQueryError(subPosition string, err error) error {
+	queryErr := err.(*QueryError)
+	queryErr.Position = "$" + subPosition + queryErr.Position[1:]
+	return queryErr
+}
+
+// Return true if the query value is an integer (JSON numbers are float64).
+func isQueryInt(val interface{}) bool {
+	switch val.(type) {
+	case float64, int:
+		return true
+	}
+	return false
+}
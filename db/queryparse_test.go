@@ -0,0 +1,227 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestCheckQuery(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	malformed := []struct {
+		query    string
+		position string
+		errType  interface{}
+	}{
+		{`"abc"`, "$", dberr.ErrorExpectingInt},
+		{`["1", "all", "x"]`, "$[2]", dberr.ErrorExpectingInt},
+		{`{"foo": 1}`, "$", nil},
+		{`{"eq": 1, "in": ["a"], "has": ["a"]}`, "$", nil},
+		{`{"eq": 1, "in": ["a"], "lmit": 1}`, "$.lmit", nil},
+		{`{"eq": 1}`, "$", nil},
+		{`{"eq": 1, "in": "a"}`, "$.in", nil},
+		{`{"eq": 1, "in": ["a"], "limit": "1"}`, "$.limit", dberr.ErrorExpectingInt},
+		{`{"has": "a"}`, "$.has", nil},
+		{`{"n": {"eq": 1}}`, "$.n", dberr.ErrorExpectingSubQuery},
+		{`[{"n": ["all", {"c": [{"eq": 1, "in": ["a"], "limit": true}]}]}]`, "$[0].n[1].c[0].limit", dberr.ErrorExpectingInt},
+		{`{"int-from": "1", "int-to": 2, "in": ["a"]}`, "$.int-from", dberr.ErrorExpectingInt},
+		{`{"int from": 1, "int to": [], "in": ["a"]}`, "$.int to", dberr.ErrorExpectingInt},
+		{`{"int-from": 1, "in": ["a"]}`, "$", dberr.ErrorMissing},
+		{`{"int-from": 1, "int-to": 2}`, "$", nil},
+		{`{"eq": 1, "in": ["b"]}`, "$", dberr.ErrorNeedIndex},
+	}
+	checkMalformed := func() {
+		for _, bad := range malformed {
+			var q interface{}
+			if err := json.Unmarshal([]byte(bad.query), &q); err != nil {
+				t.Fatal(err)
+			}
+			_, err := col.checkedPlan(q)
+			queryErr, ok := err.(*QueryError)
+			if !ok || queryErr.Position != bad.position || !strings.HasPrefix(err.Error(), "Query error at "+bad.position+": ") {
+				t.Fatal(bad.query, err)
+			}
+			if bad.errType != nil && dberr.Type(err) != bad.errType {
+				t.Fatal(bad.query, err)
+			}
+		}
+	}
+	checkMalformed()
+	for _, good := range []string{`"all"`, `"123"`, `1`, `null`, `[]`, `{"n": []}`, `{"eq": {"a": 1}, "in": ["a"], "limit": 1}`,
+		`{"int from": 1, "int-to": 2, "in": ["a"], "limit": 2}`, `[{"c": ["1", {"has": ["a"]}]}]`, `["1", "all", "2"]`,
+		`[{"n": ["all", {"c": [{"eq": 1, "in": ["a"], "limit": 1}]}]}]`, `{"int-from": 1, "int-to": 2, "in": ["a"]}`} {
+		var q interface{}
+		if err := json.Unmarshal([]byte(good), &q); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := col.checkedPlan(q); err != nil {
+			t.Fatal(good, err)
+		}
+	}
+	// Values are validated with the same positions when the plans of the malformed queries' shapes are cached
+	if col.cachedPlans() == 0 {
+		t.Fatal("Plans are not cached")
+	}
+	checkMalformed()
+}
+
+func TestVersionedQuery(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eval := func(query string) (map[int]struct{}, error) {
+		var q interface{}
+		if err := json.Unmarshal([]byte(query), &q); err != nil {
+			t.Fatal(err)
+		}
+		result := make(map[int]struct{})
+		return result, EvalQuery(q, col, &result)
+	}
+	// Versioned queries mean the same as unversioned ones
+	for _, query := range []string{`{"version": 1, "query": {"eq": 1, "in": ["a"]}}`, `[{"version": 1, "query": ["all"]}]`,
+		`{"n": [{"version": 1, "query": {"has": ["a"]}}, "all"]}`} {
+		if result, err := eval(query); err != nil || len(result) != 1 {
+			t.Fatal(query, result, err)
+		} else if _, found := result[id]; !found {
+			t.Fatal(query, result)
+		}
+	}
+	// What is otherwise ignored or converted is refused in strict mode
+	for _, lenient := range []string{`1`, `[null, "all"]`, `{"eq": 1, "in": [1]}`, `{"eq": [1], "in": ["a"]}`} {
+		if _, err := eval(lenient); err != nil {
+			t.Fatal(lenient, err)
+		}
+	}
+	malformed := []struct {
+		query    string
+		position string
+	}{
+		{`{"version": 1, "query": 1}`, "$.query"},
+		{`{"version": 1, "query": [null, "all"]}`, "$.query[0]"},
+		{`{"version": 1, "query": {"eq": 1, "in": [1]}}`, "$.query.in[0]"},
+		{`{"version": 1, "query": {"n": [{"eq": [1], "in": ["a"]}]}}`, "$.query.n[0].eq"},
+		{`{"version": 1, "query": {"eq": 1, "in": ["a"], "foo": 1}}`, "$.query.foo"},
+		{`{"version": 5, "query": "all"}`, "$.version"},
+		{`{"version": 0.5, "query": "all"}`, "$.version"},
+		{`{"version": "1", "query": "all"}`, "$.version"},
+		{`{"version": 1}`, "$"},
+		{`{"version": 1, "query": "all", "limit": 1}`, "$.limit"},
+		{`["all", {"version": 1, "query": {"version": 1, "query": "x"}}]`, "$[1].query.query"},
+	}
+	for _, bad := range malformed {
+		result, err := eval(bad.query)
+		if queryErr, ok := err.(*QueryError); !ok || queryErr.Position != bad.position || len(result) != 0 {
+			t.Fatal(bad.query, err)
+		}
+	}
+	// An unversioned query is marked with the current version, a versioned query is kept as it is
+	if q := VersionedQuery("all").(map[string]interface{}); q["version"] != float64(QUERY_VERSION) || q["query"] != "all" {
+		t.Fatal(q)
+	}
+	versioned := map[string]interface{}{"version": 1.0, "query": "all"}
+	if q := VersionedQuery(versioned).(map[string]interface{}); len(q) != 2 || q["query"] != "all" {
+		t.Fatal(q)
+	} else if _, err := eval(`{"version": 1, "query": 1}`); err == nil {
+		t.Fatal("Cached plan of a lenient query is used for a strict one")
+	}
+}
+
+// Return a random query-like structure made of operations, attributes and values valid and invalid alike.
+func randomQuery(rnd *rand.Rand, depth int) interface{} {
+	values := []interface{}{nil, true, 1.0, -3.5, "all", "12", "x", []interface{}{"a"}, []interface{}{}, map[string]interface{}{}}
+	if depth == 0 || rnd.Intn(3) == 0 {
+		return values[rnd.Intn(len(values))]
+	}
+	if rnd.Intn(3) == 0 {
+		vec := make([]interface{}, rnd.Intn(4))
+		for i := range vec {
+			vec[i] = randomQuery(rnd, depth-1)
+		}
+		return vec
+	}
+	obj := make(map[string]interface{})
+	attrs := []string{"eq", "in", "has", "n", "c", "int-from", "int from", "int-to", "int to", "limit", "version", "query", "foo"}
+	for i := rnd.Intn(4); i >= 0; i-- {
+		obj[attrs[rnd.Intn(len(attrs))]] = randomQuery(rnd, depth-1)
+	}
+	return obj
+}
+
+func TestQueryMalformedNoPanic(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = col.Insert(map[string]interface{}{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		q := randomQuery(rnd, 4)
+		result := make(map[int]struct{})
+		if err := EvalQuery(q, col, &result); err != nil {
+			if _, ok := err.(*QueryError); !ok {
+				t.Fatal(q, err)
+			} else if len(result) != 0 {
+				t.Fatal("Malformed query returned partial result", q, result)
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Queue primitives.
+//
+// A collection may serve as a job queue without an external broker. FindOneAndDelete removes a document matching a
+// query and returns it; FindOneAndLock leases a matching document to the caller for a while, during which both pass
+// the document over. Each checks under the partition lock that the document still matches the query and is not leased,
+// so that concurrent callers never claim the same document. A worker typically leases a job, processes it and deletes
+// it by ID; should the worker fail, the job becomes available again once its lease expires. Leases are kept in memory
+// and do not survive closing the database.
+
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Leased documents of a collection.
+type docLeases struct {
+	lock   *sync.Mutex
+	expiry map[int]time.Time // Document ID - end of lease
+}
+
+// Return an empty set of leases.
+func newDocLeases() *docLeases {
+	return &docLeases{lock: new(sync.Mutex), expiry: make(map[int]time.Time)}
+}
+
+// Lease the document until the time and return true, unless the document is already leased.
+func (l *docLeases) acquire(id int, now, until time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if expiry, leased := l.expiry[id]; leased && expiry.After(now) {
+		return false
+	}
+	l.expiry[id] = until
+	return true
+}
+
+// Return true if the document is leased at the time.
+func (l *docLeases) leased(id int, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	expiry, leased := l.expiry[id]
+	return leased && expiry.After(now)
+}
+
+// End the lease of the document.
+func (l *docLeases) release(id int) {
+	l.lock.Lock()
+	delete(l.expiry, id)
+	l.lock.Unlock()
+}
+
+// Forget the leases expired at the time.
+func (l *docLeases) prune(now time.Time) {
+	l.lock.Lock()
+	for id, expiry := range l.expiry {
+		if !expiry.After(now) {
+			delete(l.expiry, id)
+		}
+	}
+	l.lock.Unlock()
+}
+
+// End all leases.
+func (l *docLeases) clear() {
+	l.lock.Lock()
+	l.expiry = make(map[int]time.Time)
+	l.lock.Unlock()
+}
+
+// Return the IDs of the documents matching the query.
+func (col *Col) queueCandidates(q interface{}) (ids []int, err error) {
+	result := make(map[int]struct{})
+	if err = EvalQuery(q, col, &result); err != nil {
+		return
+	}
+	ids = make([]int, 0, len(result))
+	for id := range result {
+		if id >= 0 {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
+// Delete a document matching the query and return it, or return a nil document if no document matches. Documents
+// leased by FindOneAndLock are passed over. The deletion is refused or cascaded according to relations.
+func (col *Col) FindOneAndDelete(q interface{}) (id int, doc map[string]interface{}, err error) {
+	ids, err := col.queueCandidates(q)
+	if err != nil {
+		return
+	}
+	release, err := col.throttleWrite()
+	if err != nil {
+		return
+	}
+	defer release()
+	for _, id = range ids {
+		doc, err = col.deleteIf(context.Background(), id, release, true, func(original map[string]interface{}) bool {
+			return !col.leases.leased(id, time.Now()) && matchQuery(q, id, original)
+		})
+		if dberr.Type(err) != dberr.ErrorNoDoc {
+			// Claimed, or failed for a reason other than the document being claimed by others
+			return
+		}
+	}
+	return 0, nil, nil
+}
+
+// Lease a document matching the query to the caller for the duration and return it, or return a nil document if no
+// document matches. Until the lease expires or is ended by Unlock, FindOneAndLock and FindOneAndDelete pass the
+// document over; it may still be read, updated and deleted by ID.
+func (col *Col) FindOneAndLock(q interface{}, lease time.Duration) (id int, doc map[string]interface{}, err error) {
+	if lease <= 0 {
+		return 0, nil, dberr.New(dberr.ErrorInvalidParam, "lease", lease)
+	}
+	ids, err := col.queueCandidates(q)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	col.leases.prune(now)
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	for _, id = range ids {
+		part := col.parts[id%col.db.numParts]
+		// The lease is taken while the document is known to match, a concurrent deletion waits for the partition lock
+		part.DataLock.RLock()
+		doc = nil
+		docB, err := part.Read(id)
+		if err == nil && col.unmarshalDoc(docB, &doc) == nil && matchQuery(q, id, doc) && col.leases.acquire(id, now, now.Add(lease)) {
+			part.DataLock.RUnlock()
+			return id, doc, nil
+		}
+		part.DataLock.RUnlock()
+	}
+	return 0, nil, nil
+}
+
+// End the lease of a document taken by FindOneAndLock, making the document available to FindOneAndLock and
+// FindOneAndDelete again.
+func (col *Col) Unlock(id int) {
+	col.leases.release(id)
+}
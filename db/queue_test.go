@@ -0,0 +1,149 @@
+package db
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestQueue(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("jobs"); err != nil {
+		t.Fatal(err)
+	}
+	jobs := db.Use("jobs")
+	if err = jobs.Index([]string{"state"}); err != nil {
+		t.Fatal(err)
+	}
+	pending := map[string]interface{}{"eq": "pending", "in": []interface{}{"state"}}
+	// Nothing to claim in an empty queue
+	if id, doc, err := jobs.FindOneAndDelete(pending); err != nil || doc != nil || id != 0 {
+		t.Fatal(id, doc, err)
+	}
+	if _, _, err := jobs.FindOneAndLock(pending, 0); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+	if _, _, err := jobs.FindOneAndLock(map[string]interface{}{"eq": 1, "in": []interface{}{"unindexed"}}, time.Minute); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	done, err := jobs.Insert(map[string]interface{}{"state": "done"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := jobs.Insert(map[string]interface{}{"state": "pending", "n": 1.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := jobs.Insert(map[string]interface{}{"state": "pending", "n": 2.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leased documents are passed over until the lease ends
+	leased, doc, err := jobs.FindOneAndLock(pending, time.Minute)
+	if err != nil || (leased != first && leased != second) || doc["state"] != "pending" {
+		t.Fatal(leased, doc, err)
+	}
+	other, doc, err := jobs.FindOneAndLock(pending, 50*time.Millisecond)
+	if err != nil || other == leased || (other != first && other != second) || doc == nil {
+		t.Fatal(other, doc, err)
+	}
+	if id, doc, err := jobs.FindOneAndLock(pending, time.Minute); err != nil || doc != nil {
+		t.Fatal(id, doc, err)
+	} else if id, doc, err := jobs.FindOneAndDelete(pending); err != nil || doc != nil {
+		t.Fatal(id, doc, err)
+	}
+	// An expired lease makes the document available again
+	time.Sleep(100 * time.Millisecond)
+	if id, doc, err := jobs.FindOneAndDelete(pending); err != nil || id != other || doc["state"] != "pending" {
+		t.Fatal(id, doc, err)
+	} else if _, err = jobs.Read(other); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	// Leased documents remain available by ID
+	if err = jobs.Update(leased, map[string]interface{}{"state": "pending", "n": 3.0}); err != nil {
+		t.Fatal(err)
+	}
+	jobs.Unlock(leased)
+	if id, doc, err := jobs.FindOneAndDelete(pending); err != nil || id != leased || doc["n"] != 3.0 {
+		t.Fatal(id, doc, err)
+	}
+	// Documents no longer matching the query are not claimed
+	if id, doc, err := jobs.FindOneAndDelete(pending); err != nil || doc != nil {
+		t.Fatal(id, doc, err)
+	} else if _, err = jobs.Read(done); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = jobs.deleteIf(context.Background(), done, func() {}, true, func(map[string]interface{}) bool { return false }); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if _, err = jobs.Read(done); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueConcurrentClaims(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("jobs"); err != nil {
+		t.Fatal(err)
+	}
+	jobs := db.Use("jobs")
+	total := 100
+	for i := 0; i < total; i++ {
+		if _, err = jobs.Insert(map[string]interface{}{"n": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every document is claimed exactly once, by lease or by deletion
+	claimed := make(map[int]int)
+	claimedLock := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for {
+				var id int
+				var doc map[string]interface{}
+				var err error
+				if worker%2 == 0 {
+					id, doc, err = jobs.FindOneAndDelete("all")
+				} else {
+					id, doc, err = jobs.FindOneAndLock("all", time.Hour)
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				} else if doc == nil {
+					return
+				}
+				claimedLock.Lock()
+				claimed[id]++
+				claimedLock.Unlock()
+			}
+		}(worker)
+	}
+	wg.Wait()
+	if len(claimed) != total {
+		t.Fatal(len(claimed))
+	}
+	for id, times := range claimed {
+		if times != 1 {
+			t.Fatal(id, times)
+		}
+	}
+}
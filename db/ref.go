@@ -0,0 +1,256 @@
+// Referential integrity.
+//
+// A collection may declare relations - each is a path whose string values refer to documents of a target collection,
+// either by document ID or by string ID. Document IDs are not referred to by JSON numbers, which cannot represent
+// them precisely. Insert and update refuse a document referring to a
+// document that does not exist. Deleting a referenced document is refused (restrict), or deletes the referring
+// documents as well (cascade); a restricting relation anywhere in the cascade refuses the deletion altogether. Integrity is verified upon each mutation; mutations made concurrently to the referring
+// and the referenced collection are not isolated from each other.
+//
+// Deleting a referenced document looks for the referring documents of every relation targeting its collection. The
+// path of the relation should be indexed in the referring collection; otherwise each deletion scans the entire
+// referring collection, and a cascade scans it once for every document deleted along.
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cankansin/tiedot/data"
+	"github.com/cankansin/tiedot/dberr"
+)
+
+const (
+	REF_RESTRICT = "restrict" // Deleting a referenced document is refused.
+	REF_CASCADE  = "cascade"  // Deleting a referenced document deletes the referring documents as well.
+)
+
+// Relation declares that the values along a path refer to documents of the target collection.
+type Relation struct {
+	Path     []string // Path of the referring values
+	Target   string   // Name of the referenced collection
+	OnDelete string   // What happens to the referring documents when a referenced document is deleted, REF_RESTRICT by default
+}
+
+// Validate the relations of collection settings.
+func checkRelations(relations []Relation) error {
+	for _, rel := range relations {
+		if len(rel.Path) == 0 {
+			return dberr.New(dberr.ErrorMissing, "Path")
+		} else if rel.Target == "" {
+			return dberr.New(dberr.ErrorMissing, "Target")
+		} else if rel.OnDelete != "" && rel.OnDelete != REF_RESTRICT && rel.OnDelete != REF_CASCADE {
+			return dberr.New(dberr.ErrorInvalidParam, "OnDelete", rel.OnDelete)
+		}
+	}
+	return nil
+}
+
+// Read a serialised document. Does not place schema lock.
+func (col *Col) readBytes(id int) ([]byte, error) {
+	part := col.parts[id%col.db.numParts]
+	part.DataLock.RLock()
+	defer part.DataLock.RUnlock()
+	return part.Read(id)
+}
+
+// Return true if the referenced document exists. Does not place schema lock.
+func (col *Col) refExists(ref interface{}) bool {
+	strRef, isStr := ref.(string)
+	if !isStr {
+		return false
+	}
+	if id, err := strconv.Atoi(strRef); err == nil && id >= 0 {
+		if _, err := col.readBytes(id); err == nil {
+			return true
+		}
+	}
+	for _, match := range col.strIDCandidates(strRef) {
+		// Filter result to avoid hash collision
+		var doc map[string]interface{}
+		if docB, err := col.readBytes(match); err == nil && json.Unmarshal(docB, &doc) == nil && doc[STR_ID_ATTR] == strRef {
+			return true
+		}
+	}
+	return false
+}
+
+// Return an error if the document refers to a document that does not exist. Must not be called while holding
+// partition locks, as the referenced document may be in any partition. Does not place schema lock.
+func (col *Col) checkRefs(doc map[string]interface{}) error {
+	for _, rel := range col.conf.Relations {
+		target := col.db.cols[rel.Target]
+		for _, ref := range GetIn(doc, rel.Path) {
+			if ref == nil {
+				continue
+			} else if target == nil {
+				return dberr.New(dberr.ErrorNoCol, rel.Target)
+			} else if !target.refExists(ref) {
+				return dberr.New(dberr.ErrorNoRefDoc, rel.Path, ref, rel.Target)
+			}
+		}
+	}
+	return nil
+}
+
+// Verify the references of a document updated while holding the lock of its partition. The partition is unlocked
+// meanwhile, as a referenced document may be in the same partition, and locked again upon return. If the original
+// document was changed or deleted in the meantime, changed is true and the caller computes the update again. Does not
+// place schema lock.
+func (col *Col) checkRefsUnlocked(part *data.Partition, id int, originalB []byte, doc map[string]interface{}) (changed bool, err error) {
+	if len(col.conf.Relations) == 0 {
+		return false, nil
+	}
+	part.DataLock.Unlock()
+	err = col.checkRefs(doc)
+	part.DataLock.Lock()
+	currentB, readErr := part.Read(id)
+	return readErr != nil || !bytes.Equal(currentB, originalB), err
+}
+
+// Return true if the value refers to the document.
+func refersTo(ref interface{}, id int, strID string) bool {
+	strRef, isStr := ref.(string)
+	return isStr && (strRef == strconv.Itoa(id) || strID != "" && strRef == strID)
+}
+
+// Return the documents referring to the document via the path. The path index is used if there is one, otherwise the
+// entire collection is scanned. Does not place schema lock.
+func (col *Col) referrers(path []string, id int, strID string) (ids []int) {
+	refers := func(docB []byte) bool {
+		var doc map[string]interface{}
+		if json.Unmarshal(docB, &doc) != nil {
+			return false
+		}
+		for _, ref := range GetIn(doc, path) {
+			if refersTo(ref, id, strID) {
+				return true
+			}
+		}
+		return false
+	}
+	idxName := strings.Join(path, INDEX_PATH_SEP)
+	if _, indexed := col.indexPaths[idxName]; !indexed {
+		col.forEachDoc(func(referrer int, doc []byte) bool {
+			if refers(doc) {
+				ids = append(ids, referrer)
+			}
+			return true
+		}, false)
+		return
+	}
+	keys := []string{strconv.Itoa(id)}
+	if strID != "" {
+		keys = append(keys, strID)
+	}
+	found := make(map[int]struct{})
+	for _, key := range keys {
+		for _, referrer := range col.hashScan(idxName, StrHash(key), 0) {
+			if _, dup := found[referrer]; dup {
+				continue
+			}
+			// Filter result to avoid hash collision
+			if doc, err := col.readBytes(referrer); err == nil && refers(doc) {
+				found[referrer] = struct{}{}
+				ids = append(ids, referrer)
+			}
+		}
+	}
+	return
+}
+
+// Return the documents to be deleted along with the document, or an error if a restricting relation refers to it or
+// to any document deleted along with it. The entire cascade is found and verified before anything is deleted. Does not
+// place schema lock.
+func (col *Col) checkReferrers(id int) (cascade map[*Col][]int, err error) {
+	type docRef struct {
+		col *Col
+		id  int
+	}
+	pending := []docRef{{col, id}}
+	visited := map[docRef]struct{}{{col, id}: {}}
+	for len(pending) > 0 {
+		ref := pending[0]
+		pending = pending[1:]
+		var strID string
+		read := false
+		for _, referring := range col.db.cols {
+			for _, rel := range referring.conf.Relations {
+				if rel.Target != ref.col.name {
+					continue
+				}
+				if !read {
+					// The string ID is also a reference to the document
+					var doc map[string]interface{}
+					if docB, err := ref.col.readBytes(ref.id); err == nil && json.Unmarshal(docB, &doc) == nil {
+						strID, _ = doc[STR_ID_ATTR].(string)
+					}
+					read = true
+				}
+				ids := referring.referrers(rel.Path, ref.id, strID)
+				if len(ids) == 0 {
+					continue
+				} else if rel.OnDelete != REF_CASCADE {
+					return nil, dberr.New(dberr.ErrorReferenced, ref.id, referring.name)
+				}
+				for _, referrer := range ids {
+					next := docRef{referring, referrer}
+					if _, seen := visited[next]; seen {
+						continue
+					}
+					visited[next] = struct{}{}
+					pending = append(pending, next)
+					if cascade == nil {
+						cascade = make(map[*Col][]int)
+					}
+					cascade[referring] = append(cascade[referring], referrer)
+				}
+			}
+		}
+	}
+	return
+}
+
+// Delete the documents found by checkReferrers along with a deleted document. Their referrers were verified by
+// checkReferrers already, and are not looked for again.
+func cascadeDelete(cascade map[*Col][]int) error {
+	for referring, ids := range cascade {
+		for _, id := range ids {
+			release, err := referring.throttleWrite()
+			if err == nil {
+				err = referring.delete(id, release, false)
+				release()
+			}
+			// The document may have been deleted by an earlier cascade
+			if err != nil && dberr.Type(err) != dberr.ErrorNoDoc {
+				return fmt.Errorf("Failed to delete document %d referring to a deleted document: %v", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Follow a collection rename in relations. Does not place schema lock.
+func (db *DB) renameInRelations(oldName, newName string) error {
+	for _, col := range db.cols {
+		renamed := false
+		relations := make([]Relation, len(col.conf.Relations))
+		for i, rel := range col.conf.Relations {
+			if relations[i] = rel; rel.Target == oldName {
+				relations[i].Target = newName
+				renamed = true
+			}
+		}
+		if renamed {
+			col.conf.Relations = relations
+			if err := col.saveConfig(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
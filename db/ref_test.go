@@ -0,0 +1,260 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestRelations(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, name := range []string{"users", "posts", "comments"} {
+		if err = db.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users, posts, comments := db.Use("users"), db.Use("posts"), db.Use("comments")
+	if err = posts.SetConfig(ColConfig{Relations: []Relation{{Path: []string{"author"}, Target: "users", OnDelete: "x"}}}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if err = posts.SetConfig(ColConfig{Relations: []Relation{{Target: "users"}}}); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	}
+	if err = posts.SetConfig(ColConfig{Relations: []Relation{{Path: []string{"author"}, Target: "users"}}}); err != nil {
+		t.Fatal(err)
+	} else if err = comments.SetConfig(ColConfig{Relations: []Relation{
+		{Path: []string{"post"}, Target: "posts", OnDelete: REF_CASCADE},
+		{Path: []string{"replyTo"}, Target: "comments", OnDelete: REF_CASCADE},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	// References by document ID and by string ID must exist
+	alice, err := users.Insert(map[string]interface{}{"name": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = users.InsertStrID("bob", map[string]interface{}{"name": "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = posts.Insert(map[string]interface{}{"author": "carol"}); dberr.Type(err) != dberr.ErrorNoRefDoc {
+		t.Fatal(err)
+	} else if _, err = posts.Insert(map[string]interface{}{"author": 1}); dberr.Type(err) != dberr.ErrorNoRefDoc {
+		t.Fatal(err)
+	}
+	post, err := posts.Insert(map[string]interface{}{"author": strconv.Itoa(alice)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobPost, err := posts.Insert(map[string]interface{}{"author": "bob"})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = posts.Insert(map[string]interface{}{"title": "anonymous"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = posts.Update(post, map[string]interface{}{"author": "carol"}); dberr.Type(err) != dberr.ErrorNoRefDoc {
+		t.Fatal(err)
+	} else if err = posts.UpdateFunc(post, func(orig map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"author": "12345"}, nil
+	}); dberr.Type(err) != dberr.ErrorNoRefDoc {
+		t.Fatal(err)
+	} else if err = posts.UpdateBytesFunc(post, func(orig []byte) ([]byte, error) {
+		return []byte(`{"author": "carol"}`), nil
+	}); dberr.Type(err) != dberr.ErrorNoRefDoc {
+		t.Fatal(err)
+	}
+	// Comments refer to posts and to other comments, including one in the same partition
+	comment, err := comments.Insert(map[string]interface{}{"post": strconv.Itoa(post)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := comments.Insert(map[string]interface{}{"post": strconv.Itoa(bobPost), "replyTo": strconv.Itoa(comment)})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = comments.UpdateFunc(reply, func(orig map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"post": strconv.Itoa(bobPost), "replyTo": []interface{}{strconv.Itoa(comment), strconv.Itoa(reply)}}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Restricted deletion
+	if err = users.Delete(alice); dberr.Type(err) != dberr.ErrorReferenced {
+		t.Fatal(err)
+	} else if _, err = users.Read(alice); err != nil {
+		t.Fatal(err)
+	}
+	// Cascaded deletion, the reply goes along with the comment it replies to
+	if err = posts.Delete(post); err != nil {
+		t.Fatal(err)
+	} else if _, err = comments.Read(comment); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if _, err = comments.Read(reply); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	if err = users.Delete(alice); err != nil {
+		t.Fatal(err)
+	}
+	// Relations follow renames of the target collection
+	if err = db.Rename("users", "people"); err != nil {
+		t.Fatal(err)
+	} else if conf := db.Use("posts").Config(); conf.Relations[0].Target != "people" {
+		t.Fatal(conf)
+	}
+	bob, err := db.Use("people").ResolveID("bob")
+	if err != nil {
+		t.Fatal(err)
+	} else if err = db.Use("people").Delete(bob); dberr.Type(err) != dberr.ErrorReferenced {
+		t.Fatal(err)
+	}
+	// Relations are persisted
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Use("posts").Insert(map[string]interface{}{"author": "carol"}); dberr.Type(err) != dberr.ErrorNoRefDoc {
+		t.Fatal(err)
+	}
+}
+
+func TestRelationsCascadeRestrict(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, name := range []string{"users", "posts", "notes"} {
+		if err = db.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users, posts, notes := db.Use("users"), db.Use("posts"), db.Use("notes")
+	if err = posts.SetConfig(ColConfig{Relations: []Relation{{Path: []string{"author"}, Target: "users", OnDelete: REF_CASCADE}}}); err != nil {
+		t.Fatal(err)
+	} else if err = notes.SetConfig(ColConfig{Relations: []Relation{{Path: []string{"post"}, Target: "posts"}}}); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := users.Insert(map[string]interface{}{"name": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	post, err := posts.Insert(map[string]interface{}{"author": strconv.Itoa(alice)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := notes.Insert(map[string]interface{}{"post": strconv.Itoa(post)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A restricting relation further down the cascade refuses the deletion before anything is deleted
+	if err = users.Delete(alice); dberr.Type(err) != dberr.ErrorReferenced {
+		t.Fatal(err)
+	} else if _, err = users.Read(alice); err != nil {
+		t.Fatal(err)
+	} else if _, err = posts.Read(post); err != nil {
+		t.Fatal(err)
+	}
+	if err = notes.Delete(note); err != nil {
+		t.Fatal(err)
+	} else if err = users.Delete(alice); err != nil {
+		t.Fatal(err)
+	} else if _, err = posts.Read(post); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+}
+
+func TestRelationsUpdateFuncConcurrent(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, name := range []string{"a", "b"} {
+		if err = db.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Collections refer to each other, and to themselves
+	for _, name := range []string{"a", "b"} {
+		if err = db.Use(name).SetConfig(ColConfig{Relations: []Relation{
+			{Path: []string{"a"}, Target: "a"}, {Path: []string{"b"}, Target: "b"},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := make(map[string][]int)
+	for _, name := range []string{"a", "b"} {
+		for i := 0; i < 10; i++ {
+			id, err := db.Use(name).Insert(map[string]interface{}{"n": 0})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids[name] = append(ids[name], id)
+		}
+	}
+	// Updates referring to documents of other partitions and collections do not deadlock
+	done := make(chan error)
+	for _, name := range []string{"a", "b"} {
+		for i := range ids[name] {
+			go func(col *Col, id int, i int) {
+				var err error
+				for n := 0; n < 50 && err == nil; n++ {
+					err = col.UpdateFunc(id, func(orig map[string]interface{}) (map[string]interface{}, error) {
+						return map[string]interface{}{
+							"n": n,
+							"a": strconv.Itoa(ids["a"][(i+n)%len(ids["a"])]),
+							"b": strconv.Itoa(ids["b"][(i+n+1)%len(ids["b"])]),
+						}, nil
+					})
+				}
+				done <- err
+			}(db.Use(name), ids[name][i], i)
+		}
+	}
+	timeout := time.After(30 * time.Second)
+	for i := 0; i < len(ids["a"])+len(ids["b"]); i++ {
+		select {
+		case err = <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-timeout:
+			t.Fatal("Updates deadlocked")
+		}
+	}
+	for _, name := range []string{"a", "b"} {
+		for _, id := range ids[name] {
+			if doc, err := db.Use(name).Read(id); err != nil || doc["n"] != float64(49) {
+				t.Fatal(doc, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Indexes required by the application.
+//
+// Embedded usage may register the indexes its collections require, by path or by the `tiedot:"index"` struct tags of
+// the document type (see Typed), before opening the database. Opening the database and creating a collection then
+// create the registered indexes of the collection that do not exist yet, so that deploying the application needs no
+// separate index management. Registered indexes are never removed automatically.
+
+package db
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+var requiredIndexes = make(map[string][][]string) // Registered index paths by collection name
+var requiredIndexesLock = new(sync.RWMutex)
+
+// Register the index paths required by the collection. The indexes are created when the database is opened, or the
+// collection is created, should they not exist yet.
+func RegisterIndexes(colName string, idxPaths ...[]string) {
+	requiredIndexesLock.Lock()
+	defer requiredIndexesLock.Unlock()
+	for _, idxPath := range idxPaths {
+		requiredIndexes[colName] = append(requiredIndexes[colName], append([]string(nil), idxPath...))
+	}
+}
+
+// Register the indexes declared by the struct tags of the sample document's type, see RegisterIndexes.
+func RegisterSchema(colName string, sample interface{}) error {
+	typ := reflect.TypeOf(sample)
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return dberr.New(dberr.ErrorInvalidParam, "document type", typ)
+	}
+	RegisterIndexes(colName, taggedIndexes(typ, nil, make(map[reflect.Type]bool))...)
+	return nil
+}
+
+// Return the index paths registered for the collection.
+func registeredIndexes(colName string) [][]string {
+	requiredIndexesLock.RLock()
+	defer requiredIndexesLock.RUnlock()
+	return requiredIndexes[colName]
+}
+
+// Create the indexes on the paths that do not exist yet.
+func (col *Col) ensureIndexes(idxPaths [][]string) error {
+	indexed := make(map[string]bool)
+	for _, idxPath := range col.AllIndexes() {
+		indexed[strings.Join(idxPath, INDEX_PATH_SEP)] = true
+	}
+	for _, idxPath := range idxPaths {
+		if indexed[strings.Join(idxPath, INDEX_PATH_SEP)] {
+			continue
+		}
+		if err := col.Index(idxPath); err != nil && dberr.Type(err) != dberr.ErrorIndexExists {
+			return err
+		}
+		indexed[strings.Join(idxPath, INDEX_PATH_SEP)] = true
+	}
+	return nil
+}
+
+// Create the registered indexes of all collections that do not exist yet. Failures are logged, the indexes may be
+// created later on.
+func (db *DB) ensureRegisteredIndexes() {
+	for _, name := range db.AllCols() {
+		idxPaths := registeredIndexes(name)
+		if col := db.Use(name); col != nil && len(idxPaths) > 0 {
+			if err := col.ensureIndexes(idxPaths); err != nil {
+				tdlog.Noticef("Failed to create registered indexes of collection %s: %v", name, err)
+			}
+		}
+	}
+}
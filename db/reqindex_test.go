@@ -0,0 +1,49 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestRegisteredIndexes(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	defer func() {
+		requiredIndexesLock.Lock()
+		delete(requiredIndexes, "reg")
+		requiredIndexesLock.Unlock()
+	}()
+	if err := RegisterSchema("reg", 1); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if err = RegisterSchema("reg", &typedPerson{}); err != nil {
+		t.Fatal(err)
+	}
+	RegisterIndexes("reg", []string{"a"}, []string{"name"})
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Creating the collection creates its registered indexes
+	if err = db.Create("reg"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("other"); err != nil {
+		t.Fatal(err)
+	} else if indexes := db.Use("reg").AllIndexes(); len(indexes) != 4 {
+		t.Fatal(indexes)
+	} else if indexes = db.Use("other").AllIndexes(); len(indexes) != 0 {
+		t.Fatal(indexes)
+	} else if err = db.Use("reg").Unindex([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	// Opening the database creates the missing ones
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if indexes := db.Use("reg").AllIndexes(); len(indexes) != 4 {
+		t.Fatal(indexes)
+	}
+}
@@ -0,0 +1,218 @@
+// Restore of a collection from backup.
+//
+// RestoreCol reads a backup stream made by BackupSince - a full backup, optionally followed by incremental backups
+// taken since, one after another - and restores a single collection from it. The collection is rebuilt in a temporary
+// collection directory while the database keeps serving all collections, including the one being restored; once the
+// stream is read, the directory is swapped in place of the collection. Writes made to the collection during the
+// restore are lost. The restored collection keeps the settings and indexes of the collection it replaces.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+// A line of a backup stream, either the header or a record.
+type backupLine struct {
+	backupHeader
+	backupRecord
+}
+
+// Restore the collection from the backup stream, creating the collection if it does not exist.
+func (db *DB) RestoreCol(name string, backup io.Reader) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	return db.restoreCol(name, backup)
+}
+
+// Restore the collection from the backup stream, creating the collection if it does not exist. Does not verify that
+// the database accepts writes.
+func (db *DB) restoreCol(name string, backup io.Reader) error {
+	// Prepare a temporary collection with the settings and indexes of the restored one
+	db.schemaLock.RLock()
+	var conf ColConfig
+	var idxPaths [][]string
+	if col, exists := db.cols[name]; exists {
+		conf = col.conf
+		for _, idxPath := range col.indexPaths {
+			idxPaths = append(idxPaths, idxPath)
+		}
+	}
+	db.schemaLock.RUnlock()
+	tmpColName := fmt.Sprintf("restore-%s-%d", name, time.Now().UnixNano())
+	tmpColDir, err := db.mkTmpColDir(name, tmpColName)
+	if err != nil {
+		return err
+	}
+	for _, idxPath := range idxPaths {
+		if err := os.MkdirAll(path.Join(tmpColDir, strings.Join(idxPath, INDEX_PATH_SEP)), 0700); err != nil {
+			db.removeColDir(tmpColName)
+			return err
+		}
+	}
+	tmpCol, err := OpenCol(db, tmpColName)
+	if err != nil {
+		db.removeColDir(tmpColName)
+		return err
+	}
+	tmpCol.conf = conf
+	if err = tmpCol.saveConfig(); err == nil {
+		err = tmpCol.restoreFrom(name, backup)
+	}
+	if closeErr := tmpCol.close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		db.removeColDir(tmpColName)
+		return err
+	}
+	// Swap the restored collection in, hooks remain registered
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	colDir, err := db.colDir(name)
+	if err != nil {
+		db.removeColDir(tmpColName)
+		return err
+	}
+	// A collection placed elsewhere is restored in place, the link to the temporary collection is no longer needed
+	defer os.Remove(path.Join(db.path, tmpColName))
+	replaced := db.cols[name]
+	reopen := func() error {
+		col, err := OpenCol(db, name)
+		if err != nil {
+			delete(db.cols, name)
+			return err
+		}
+		if replaced != nil {
+			col.hooks = replaced.hooks
+			if replaced.ext != nil {
+				col.ext = newExtCache(name, replaced.ext.cache)
+			}
+		}
+		db.cols[name] = col
+		return nil
+	}
+	if replaced == nil {
+		if err = os.Rename(tmpColDir, colDir); err != nil {
+			db.removeColDir(tmpColName)
+			return err
+		}
+	} else {
+		if err = replaced.close(); err != nil {
+			tdlog.Noticef("Restore %s: failed to close the replaced collection: %v", name, err)
+		}
+		// The replaced collection is moved aside first, so that it is put back if the restored one cannot be moved in
+		replacedDir := tmpColDir + "-replaced"
+		if err = os.Rename(colDir, replacedDir); err == nil {
+			if err = os.Rename(tmpColDir, colDir); err != nil {
+				os.Rename(replacedDir, colDir)
+			}
+		}
+		if err != nil {
+			db.removeColDir(tmpColName)
+			if reopenErr := reopen(); reopenErr != nil {
+				tdlog.Noticef("Restore %s: failed to reopen the replaced collection: %v", name, reopenErr)
+			}
+			return err
+		}
+		if err = os.RemoveAll(replacedDir); err != nil {
+			tdlog.Noticef("Restore %s: failed to remove the replaced collection: %v", name, err)
+		}
+	}
+	if err = reopen(); err != nil {
+		return err
+	}
+	db.logReset(name)
+	return nil
+}
+
+// Apply the records of the collection in the backup stream to this (temporary) collection. Does not place
+// partition/schema lock.
+func (col *Col) restoreFrom(name string, backup io.Reader) error {
+	decoder := json.NewDecoder(backup)
+	exists, restored := false, false
+	seq := 0
+	for lines := 0; ; lines++ {
+		var line backupLine
+		if err := decoder.Decode(&line); err == io.EOF {
+			break
+		} else if err != nil {
+			return dberr.New(dberr.ErrorInvalidJSON, fmt.Sprintf("line %d", lines+1), err)
+		}
+		if line.Col == "" {
+			// Header of the next backup, which must not skip changes made after the previous one
+			if lines > 0 && line.Since > seq {
+				return dberr.New(dberr.ErrorInvalidParam, "backup since", line.Since)
+			}
+			seq = line.Seq
+			exists = false
+			for _, colName := range line.Cols {
+				exists = exists || colName == name
+			}
+			if !exists {
+				// The collection was dropped or renamed away
+				restored = false
+				if err := col.truncate(); err != nil {
+					return err
+				}
+			}
+			continue
+		} else if lines == 0 {
+			return dberr.New(dberr.ErrorMissing, "backup header")
+		} else if line.Col != name {
+			continue
+		}
+		if line.Reset {
+			restored = true
+			if err := col.truncate(); err != nil {
+				return err
+			}
+			continue
+		} else if !restored {
+			// An incremental backup does not hold the entire collection
+			return dberr.New(dberr.ErrorMissing, name)
+		}
+		if err := col.restoreDelete(line.ID); err != nil && dberr.Type(err) != dberr.ErrorNoDoc {
+			return err
+		}
+		if !line.Deleted {
+			var doc map[string]interface{}
+			if err := col.unmarshalDoc(line.Doc, &doc); err != nil {
+				return dberr.New(dberr.ErrorInvalidJSON, string(line.Doc), err)
+			} else if err = col.InsertRecovery(line.ID, doc); err != nil {
+				return err
+			}
+		}
+	}
+	if !exists || !restored {
+		return dberr.New(dberr.ErrorNoCol, name)
+	}
+	return nil
+}
+
+// Delete a document from a collection being restored. Does not place partition/schema lock.
+func (col *Col) restoreDelete(id int) error {
+	part := col.parts[id%col.db.numParts]
+	docB, err := part.Read(id)
+	if err != nil {
+		return err
+	} else if err = part.Delete(id); err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if col.unmarshalDoc(docB, &doc) == nil {
+		col.removeStrID(id, doc)
+		col.unindexDoc(id, doc)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestRestoreCol(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, name := range []string{"a", "b"} {
+		if err = db.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := db.Use("a")
+	if err = a.Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 3)
+	for i := range ids {
+		if ids[i], err = a.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	strID, err := a.InsertStrID("x", map[string]interface{}{"n": 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A full backup followed by an incremental one
+	var backup bytes.Buffer
+	seq, err := db.BackupSince(0, &backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Update(ids[0], map[string]interface{}{"n": 5}); err != nil {
+		t.Fatal(err)
+	} else if err = a.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	} else if _, err = db.BackupSince(seq, &backup); err != nil {
+		t.Fatal(err)
+	}
+	// Changes made after the backups are undone by the restore, hooks remain registered
+	if err = a.Delete(ids[2]); err != nil {
+		t.Fatal(err)
+	} else if _, err = a.Insert(map[string]interface{}{"n": 7}); err != nil {
+		t.Fatal(err)
+	}
+	hooked := 0
+	a.OnInsert(func(id int, doc map[string]interface{}) {
+		hooked++
+	}, false)
+	if err = db.RestoreCol("a", bytes.NewReader(backup.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	a = db.Use("a")
+	if n, _ := countDocs(a); n != 3 {
+		t.Fatal(n)
+	} else if doc, err := a.Read(ids[0]); err != nil || doc["n"] != float64(5) {
+		t.Fatal(doc, err)
+	} else if _, err = a.Read(ids[1]); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if _, err = a.Read(ids[2]); err != nil {
+		t.Fatal(err)
+	} else if id, err := a.ResolveID("x"); err != nil || id != strID {
+		t.Fatal(id, err)
+	}
+	// The index is rebuilt along
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": 7, "in": []interface{}{"n"}}, a, &result); err != nil || len(result) != 0 {
+		t.Fatal(result, err)
+	} else if err = EvalQuery(map[string]interface{}{"eq": 5, "in": []interface{}{"n"}}, a, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	if _, err = a.Insert(map[string]interface{}{"n": 8}); err != nil || hooked != 1 {
+		t.Fatal(hooked, err)
+	}
+	// A collection that does not exist is created
+	if err = db.RestoreCol("b", bytes.NewReader(backup.Bytes())); err != nil {
+		t.Fatal(err)
+	} else if err = db.Drop("b"); err != nil {
+		t.Fatal(err)
+	} else if err = db.RestoreCol("b", bytes.NewReader(backup.Bytes())); err != nil {
+		t.Fatal(err)
+	} else if db.Use("b") == nil {
+		t.Fatal("Collection was not restored")
+	}
+	// The stream must hold the collection in full
+	incremental := backup.Bytes()[strings.Index(backup.String(), "\n{\"since\"")+1:]
+	if err = db.RestoreCol("a", bytes.NewReader(incremental)); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	} else if err = db.RestoreCol("c", bytes.NewReader(backup.Bytes())); dberr.Type(err) != dberr.ErrorNoCol {
+		t.Fatal(err)
+	} else if err = db.RestoreCol("a", strings.NewReader("{")); dberr.Type(err) != dberr.ErrorInvalidJSON {
+		t.Fatal(err)
+	}
+	// Failed restores leave the collection and no temporary files behind
+	if n, _ := countDocs(db.Use("a")); n != 4 {
+		t.Fatal(n)
+	}
+	files, err := ioutil.ReadDir(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "restore-") {
+			t.Fatal(file.Name())
+		}
+	}
+}
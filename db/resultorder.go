@@ -0,0 +1,60 @@
+// Query result order.
+//
+// A query result is a set of document IDs; paged results (the HTTP API's query "offset" and "limit", and SQL without
+// ORDER BY) are put in the order set by ResultOrder of the collection settings, so that a client walking through the
+// pages sees each document once while the collection is not modified. RESULT_ORDER_ID, the default, orders by document
+// ID, which is random. RESULT_ORDER_INSERTION orders by insertion: the collection then tracks the insertion order like
+// capped collections do, stamping new documents with their sequence number in "_seq"; the documents inserted before the
+// setting came first in the order of their IDs.
+
+package db
+
+import (
+	"sort"
+)
+
+const (
+	RESULT_ORDER_ID        = "id"        // Order query results by document ID.
+	RESULT_ORDER_INSERTION = "insertion" // Order query results by insertion, oldest first.
+)
+
+// Return the document IDs of the query result in the order set by the collection's ResultOrder. Documents unknown to
+// the insertion order, such as those of the archive collection, follow in the order of their IDs.
+func (col *Col) SortResult(result map[int]struct{}) []int {
+	ids := make([]int, 0, len(result))
+	col.db.schemaLock.RLock()
+	capped, byInsertion := col.capped, col.conf.ResultOrder == RESULT_ORDER_INSERTION
+	col.db.schemaLock.RUnlock()
+	if !byInsertion || capped == nil {
+		for id := range result {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		return ids
+	}
+	// The insertion order may still hold deleted documents, and the earlier insertions of an ID inserted again, hence
+	// the latest insertion of each ID counts
+	ordered := make(map[int]struct{}, len(result))
+	capped.lock.Lock()
+	for i := len(capped.order) - 1; i >= 0; i-- {
+		id := capped.order[i]
+		if _, inResult := result[id]; inResult {
+			if _, dup := ordered[id]; !dup {
+				ordered[id] = struct{}{}
+				ids = append(ids, id)
+			}
+		}
+	}
+	capped.lock.Unlock()
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	rest := make([]int, 0, len(result)-len(ids))
+	for id := range result {
+		if _, inOrder := ordered[id]; !inOrder {
+			rest = append(rest, id)
+		}
+	}
+	sort.Ints(rest)
+	return append(ids, rest...)
+}
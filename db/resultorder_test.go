@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestSortResult(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	insert := func(n int) (ids []int) {
+		for i := 0; i < n; i++ {
+			id, err := col.Insert(map[string]interface{}{"i": i})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		return
+	}
+	all := func() map[int]struct{} {
+		result, err := col.Query("all")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	// By default results are ordered by ID
+	before := insert(3)
+	sort.Ints(before)
+	if ids := col.SortResult(all()); !reflect.DeepEqual(ids, before) {
+		t.Fatal(ids, before)
+	}
+	if err = col.SetConfig(ColConfig{ResultOrder: "random"}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if err = col.SetConfig(ColConfig{ResultOrder: RESULT_ORDER_INSERTION}); err != nil {
+		t.Fatal(err)
+	}
+	// Documents inserted before the setting come first, the others follow in insertion order
+	after := insert(5)
+	if ids := col.SortResult(all()); !reflect.DeepEqual(ids, append(append([]int{}, before...), after...)) {
+		t.Fatal(ids)
+	}
+	// A document inserted again under its ID moves to the end
+	doc, err := col.Read(after[0])
+	if err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(after[0]); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.insertWithID(context.Background(), after[0], doc, func() {}); err != nil {
+		t.Fatal(err)
+	}
+	expected := append(append(append([]int{}, before...), after[1:]...), after[0])
+	if ids := col.SortResult(all()); !reflect.DeepEqual(ids, expected) {
+		t.Fatal(ids, expected)
+	} else if ids = col.SortResult(map[int]struct{}{after[2]: {}, before[1]: {}, 12345: {}}); !reflect.DeepEqual(ids, []int{before[1], after[2], 12345}) {
+		t.Fatal(ids)
+	}
+	// The order survives reopening the database
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col = db.Use("col")
+	if ids := col.SortResult(all()); !reflect.DeepEqual(ids, expected) {
+		t.Fatal(ids, expected)
+	}
+}
@@ -0,0 +1,55 @@
+// Snapshot scan of a collection.
+//
+// ForEachDoc holds the read lock of each partition while it visits the partition's documents, and a long scan blocks
+// the writers of that partition for its entire duration. A snapshot scan instead captures the IDs and physical
+// locations of all documents first, holding each partition's lock only as long as it takes to collect them, and then
+// reads the documents in small batches, each under a brief read lock. The scan visits the documents that existed when
+// it began: documents inserted afterwards are not visited, documents deleted meanwhile are skipped, and documents
+// updated meanwhile are visited in their current version.
+
+package db
+
+const (
+	SNAPSHOT_READ_BATCH = 256 // Number of documents read under one lock of a partition during a snapshot scan.
+)
+
+// Do fun for the documents that exist in the collection when the scan begins, without holding partition locks while
+// fun runs. The schema lock is held throughout the scan, fun may not write to the database.
+func (col *Col) ForEachDocSnapshot(fun func(id int, doc []byte) (moveOn bool)) {
+	col.forEachDocSnapshot(fun, true)
+}
+
+func (col *Col) forEachDocSnapshot(fun func(id int, doc []byte) (moveOn bool), placeSchemaLock bool) {
+	if placeSchemaLock {
+		col.db.schemaLock.RLock()
+		defer col.db.schemaLock.RUnlock()
+	}
+	ids, physIDs := make([][]int, col.db.numParts), make([][]int, col.db.numParts)
+	for partNum, part := range col.parts {
+		part.DataLock.RLock()
+		ids[partNum], physIDs[partNum] = part.Snapshot()
+		part.DataLock.RUnlock()
+	}
+	docs := make([][]byte, 0, SNAPSHOT_READ_BATCH)
+	for partNum, part := range col.parts {
+		for start := 0; start < len(ids[partNum]); start += SNAPSHOT_READ_BATCH {
+			end := start + SNAPSHOT_READ_BATCH
+			if end > len(ids[partNum]) {
+				end = len(ids[partNum])
+			}
+			docs = docs[:0]
+			part.DataLock.RLock()
+			for i := start; i < end; i++ {
+				doc, _ := part.ReadSnapshot(ids[partNum][i], physIDs[partNum][i])
+				docs = append(docs, doc)
+			}
+			part.DataLock.RUnlock()
+			for i, doc := range docs {
+				// Deleted since the scan began
+				if doc != nil && !fun(ids[partNum][start+i], doc) {
+					return
+				}
+			}
+		}
+	}
+}
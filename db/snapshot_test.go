@@ -0,0 +1,103 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestForEachDocSnapshot(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make([]int, 0, 2*SNAPSHOT_READ_BATCH)
+	for i := 0; i < 2*SNAPSHOT_READ_BATCH; i++ {
+		id, err := col.Insert(map[string]interface{}{"n": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// Writers proceed while the scan is in progress
+	visited := make(map[int]float64)
+	written := false
+	col.ForEachDocSnapshot(func(id int, docB []byte) bool {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(docB, &doc); err != nil {
+			t.Fatal(err)
+		}
+		visited[id] = doc["n"].(float64)
+		if written {
+			return true
+		}
+		written = true
+		done := make(chan error)
+		go func() {
+			var err error
+			// Documents of the other partition are yet to be read, delete one and update another to grow it out of its place
+			for _, other := range ids {
+				if other%2 == id%2 {
+					continue
+				} else if err = col.Delete(other); err != nil {
+					break
+				}
+				for _, update := range ids {
+					if update%2 != id%2 && update != other {
+						err = col.Update(update, map[string]interface{}{"n": -1, "grown": make([]int, 100)})
+						break
+					}
+				}
+				break
+			}
+			if err == nil {
+				_, err = col.Insert(map[string]interface{}{"n": -2})
+			}
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Writers were blocked by the scan")
+		}
+		return true
+	})
+	updated := 0
+	for _, n := range visited {
+		if n == -2 {
+			t.Fatal("Visited a document inserted during the scan")
+		} else if n == -1 {
+			updated++
+		}
+	}
+	if len(visited) != len(ids)-1 || updated != 1 {
+		t.Fatal(len(visited), updated)
+	}
+	// Stop when fun returns false
+	count := 0
+	col.ForEachDocSnapshot(func(id int, doc []byte) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Fatal(count)
+	}
+}
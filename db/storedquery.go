@@ -0,0 +1,267 @@
+// Stored queries.
+//
+// A stored query is a named query of a collection with parameter placeholders: string "$name" anywhere in the query
+// stands for the argument of parameter "name", and "$$" at the beginning of a string stands for a literal "$". The
+// parameters are declared along with their types, and arguments are checked against them before the query is bound
+// and evaluated. Binding keeps the shape of the stored query, thus all invocations of a stored query share one cached
+// plan (see planQuery). Stored queries are kept in file STORED_QUERIES_FILE of the database directory, which may also
+// be edited by hand and reloaded by ReloadConfig.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+const (
+	STORED_QUERIES_FILE = "stored-queries.json" // Name of stored queries file in the database directory.
+)
+
+// Types of stored query parameters.
+const (
+	PARAM_STRING = "string"
+	PARAM_NUMBER = "number"
+	PARAM_INT    = "int"
+	PARAM_BOOL   = "bool"
+	PARAM_ANY    = "any"
+)
+
+// StoredQuery is a named query with parameters.
+type StoredQuery struct {
+	Col    string            `json:"col"`    // Collection the query runs on
+	Query  interface{}       `json:"query"`  // The query, "$name" strings are parameter placeholders
+	Params map[string]string `json:"params"` // Parameter name - type (PARAM_STRING, PARAM_NUMBER, PARAM_INT, PARAM_BOOL or PARAM_ANY)
+}
+
+// Return an error unless every placeholder of the stored query is a declared parameter and every parameter is used.
+func checkStoredQuery(name string, sq StoredQuery) error {
+	if name == "" {
+		return dberr.New(dberr.ErrorMissing, "stored query name")
+	} else if sq.Col == "" {
+		return dberr.New(dberr.ErrorMissing, "col")
+	}
+	for param, paramType := range sq.Params {
+		switch paramType {
+		case PARAM_STRING, PARAM_NUMBER, PARAM_INT, PARAM_BOOL, PARAM_ANY:
+		default:
+			return dberr.New(dberr.ErrorInvalidParam, "type of parameter "+param, paramType)
+		}
+	}
+	used := make(map[string]struct{})
+	var walk func(q interface{}) error
+	walk = func(q interface{}) error {
+		switch expr := q.(type) {
+		case string:
+			if strings.HasPrefix(expr, "$") && !strings.HasPrefix(expr, "$$") {
+				if _, declared := sq.Params[expr[1:]]; !declared {
+					return fmt.Errorf("Stored query %s uses undeclared parameter %s", name, expr[1:])
+				}
+				used[expr[1:]] = struct{}{}
+			}
+		case []interface{}:
+			for _, sub := range expr {
+				if err := walk(sub); err != nil {
+					return err
+				}
+			}
+		case map[string]interface{}:
+			for _, sub := range expr {
+				if err := walk(sub); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(sq.Query); err != nil {
+		return err
+	}
+	for param := range sq.Params {
+		if _, isUsed := used[param]; !isUsed {
+			return fmt.Errorf("Stored query %s declares parameter %s, which it does not use", name, param)
+		}
+	}
+	return nil
+}
+
+// Return the query with the placeholders replaced by the arguments, after checking them against the declared types.
+func (sq StoredQuery) bind(args map[string]interface{}) (q interface{}, err error) {
+	for param := range args {
+		if _, declared := sq.Params[param]; !declared {
+			return nil, dberr.New(dberr.ErrorInvalidParam, "parameter", param)
+		}
+	}
+	for param, paramType := range sq.Params {
+		arg, given := args[param]
+		if !given {
+			return nil, dberr.New(dberr.ErrorMissingParam, param)
+		}
+		valid := true
+		switch paramType {
+		case PARAM_STRING:
+			_, valid = arg.(string)
+		case PARAM_NUMBER:
+			_, valid = arg.(float64)
+		case PARAM_INT:
+			n, isNum := arg.(float64)
+			valid = isNum && n == math.Trunc(n)
+		case PARAM_BOOL:
+			_, valid = arg.(bool)
+		}
+		if !valid {
+			return nil, dberr.New(dberr.ErrorInvalidParam, "parameter "+param, arg)
+		}
+	}
+	var replace func(q interface{}) interface{}
+	replace = func(q interface{}) interface{} {
+		switch expr := q.(type) {
+		case string:
+			if strings.HasPrefix(expr, "$$") {
+				return expr[1:]
+			} else if strings.HasPrefix(expr, "$") {
+				return args[expr[1:]]
+			}
+		case []interface{}:
+			bound := make([]interface{}, len(expr))
+			for i, sub := range expr {
+				bound[i] = replace(sub)
+			}
+			return bound
+		case map[string]interface{}:
+			bound := make(map[string]interface{}, len(expr))
+			for key, sub := range expr {
+				bound[key] = replace(sub)
+			}
+			return bound
+		}
+		return q
+	}
+	return replace(sq.Query), nil
+}
+
+// Read stored queries from the database directory, a missing file means no stored queries.
+func readStoredQueries(dbPath string) (queries map[string]StoredQuery, err error) {
+	queries = make(map[string]StoredQuery)
+	content, err := ioutil.ReadFile(path.Join(dbPath, STORED_QUERIES_FILE))
+	if os.IsNotExist(err) {
+		return queries, nil
+	} else if err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(content, &queries); err != nil {
+		return nil, dberr.New(dberr.ErrorInvalidJSON, string(content), "of stored queries")
+	}
+	names := make([]string, 0, len(queries))
+	for name := range queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err = checkStoredQuery(name, queries[name]); err != nil {
+			return nil, err
+		}
+	}
+	return queries, nil
+}
+
+// Write the stored queries into the database directory. Does not place schema lock.
+func (db *DB) saveStoredQueries(queries map[string]StoredQuery) error {
+	content, err := json.MarshalIndent(queries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path.Join(db.path, STORED_QUERIES_FILE+".tmp")
+	if err = ioutil.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	} else if err = os.Rename(tmpPath, path.Join(db.path, STORED_QUERIES_FILE)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// Store the query under the name, replacing the query stored under the name before.
+func (db *DB) StoreQuery(name string, sq StoredQuery) error {
+	if err := checkStoredQuery(name, sq); err != nil {
+		return err
+	}
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	queries := make(map[string]StoredQuery, len(db.queries)+1)
+	for existing, existingQuery := range db.queries {
+		queries[existing] = existingQuery
+	}
+	queries[name] = sq
+	if err := db.saveStoredQueries(queries); err != nil {
+		return err
+	}
+	db.queries = queries
+	return nil
+}
+
+// Remove the stored query.
+func (db *DB) DropStoredQuery(name string) error {
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	if _, exists := db.queries[name]; !exists {
+		return dberr.New(dberr.ErrorNoStoredQuery, name)
+	}
+	queries := make(map[string]StoredQuery, len(db.queries))
+	for existing, existingQuery := range db.queries {
+		if existing != name {
+			queries[existing] = existingQuery
+		}
+	}
+	if err := db.saveStoredQueries(queries); err != nil {
+		return err
+	}
+	db.queries = queries
+	return nil
+}
+
+// Return all stored queries by name.
+func (db *DB) StoredQueries() map[string]StoredQuery {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	queries := make(map[string]StoredQuery, len(db.queries))
+	for name, sq := range db.queries {
+		queries[name] = sq
+	}
+	return queries
+}
+
+// Bind the arguments to the stored query, and return the collection it runs on along with the bound query.
+func (db *DB) BindStoredQuery(name string, args map[string]interface{}) (col *Col, q interface{}, err error) {
+	db.schemaLock.RLock()
+	sq, exists := db.queries[name]
+	if exists {
+		col = db.cols[sq.Col]
+	}
+	db.schemaLock.RUnlock()
+	if !exists {
+		return nil, nil, dberr.New(dberr.ErrorNoStoredQuery, name)
+	} else if col == nil {
+		return nil, nil, dberr.New(dberr.ErrorNoCol, sq.Col)
+	}
+	if q, err = sq.bind(args); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+// Evaluate the stored query with the arguments, and put result into result map (as map keys).
+func (db *DB) EvalStoredQuery(name string, args map[string]interface{}, result *map[int]struct{}) error {
+	col, q, err := db.BindStoredQuery(name, args)
+	if err != nil {
+		return err
+	}
+	return EvalQuery(q, col, result)
+}
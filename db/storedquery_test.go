@@ -0,0 +1,129 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestStoredQuery(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 5)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"a": i, "s": "$x"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var q interface{}
+	if err = json.Unmarshal([]byte(`{"int-from": "$from", "int-to": "$to", "in": ["a"], "limit": "$max"}`), &q); err != nil {
+		t.Fatal(err)
+	}
+	sq := StoredQuery{Col: "col", Query: q, Params: map[string]string{"from": PARAM_INT, "to": PARAM_INT, "max": PARAM_ANY}}
+	if err = db.StoreQuery("range", sq); err != nil {
+		t.Fatal(err)
+	}
+	// All runs share the plan
+	for i := 0; i < 3; i++ {
+		result := make(map[int]struct{})
+		if err = db.EvalStoredQuery("range", map[string]interface{}{"from": float64(i), "to": float64(4), "max": float64(2)}, &result); err != nil {
+			t.Fatal(err)
+		} else if len(result) != 2 {
+			t.Fatal(result)
+		}
+	}
+	if plans := col.cachedPlans(); plans != 1 {
+		t.Fatal(plans)
+	}
+	// Arguments are checked against the parameters
+	invalidArgs := map[string]interface{}{
+		`{"from": 1, "to": 2}`:                       dberr.ErrorMissingParam,
+		`{"from": 1.5, "to": 2, "max": 1}`:           dberr.ErrorInvalidParam,
+		`{"from": "1", "to": 2, "max": 1}`:           dberr.ErrorInvalidParam,
+		`{"from": 1, "to": 2, "max": 1, "other": 1}`: dberr.ErrorInvalidParam,
+		`{"from": 1, "to": 2, "max": "many"}`:        dberr.ErrorExpectingInt,
+	}
+	for argsJS, errType := range invalidArgs {
+		var args map[string]interface{}
+		if err = json.Unmarshal([]byte(argsJS), &args); err != nil {
+			t.Fatal(err)
+		}
+		result := make(map[int]struct{})
+		if err = db.EvalStoredQuery("range", args, &result); dberr.Type(err) != errType {
+			t.Fatal(argsJS, err)
+		}
+	}
+	if err = db.EvalStoredQuery("nope", nil, new(map[int]struct{})); dberr.Type(err) != dberr.ErrorNoStoredQuery {
+		t.Fatal(err)
+	}
+	// Placeholders must match the parameters, "$$" escapes a literal "$"
+	invalid := []StoredQuery{
+		{Col: "col", Query: map[string]interface{}{"eq": "$v", "in": []interface{}{"a"}}},
+		{Col: "col", Query: "all", Params: map[string]string{"v": PARAM_STRING}},
+		{Col: "col", Query: map[string]interface{}{"eq": "$v", "in": []interface{}{"a"}}, Params: map[string]string{"v": "date"}},
+		{Query: "all"},
+	}
+	for _, sq := range invalid {
+		if err = db.StoreQuery("invalid", sq); err == nil {
+			t.Fatal(sq)
+		}
+	}
+	if err = db.StoreQuery("literal", StoredQuery{Col: "col", Query: []interface{}{"$$x", map[string]interface{}{"eq": "$v", "in": []interface{}{"a"}}},
+		Params: map[string]string{"v": PARAM_NUMBER}}); err != nil {
+		t.Fatal(err)
+	}
+	col2, bound, err := db.BindStoredQuery("literal", map[string]interface{}{"v": float64(1)})
+	if err != nil || col2 != col {
+		t.Fatal(err)
+	} else if boundJS, _ := json.Marshal(bound); string(boundJS) != `["$x",{"eq":1,"in":["a"]}]` {
+		t.Fatal(string(boundJS))
+	}
+	// Stored queries survive reopening, and may be edited by hand and reloaded
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if queries := db.StoredQueries(); len(queries) != 2 || queries["range"].Params["from"] != PARAM_INT || queries["range"].Col != "col" {
+		t.Fatal(queries)
+	}
+	if err = db.DropStoredQuery("range"); err != nil {
+		t.Fatal(err)
+	} else if err = db.DropStoredQuery("range"); dberr.Type(err) != dberr.ErrorNoStoredQuery {
+		t.Fatal(err)
+	}
+	queriesPath := path.Join(TEST_DATA_DIR, STORED_QUERIES_FILE)
+	if err = ioutil.WriteFile(queriesPath, []byte(`{"edited": {"col": "col", "query": "$x"}}`), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = db.ReloadConfig(); err == nil {
+		t.Fatal("did not error")
+	} else if queries := db.StoredQueries(); len(queries) != 1 || queries["literal"].Col != "col" {
+		t.Fatal(queries)
+	}
+	if err = ioutil.WriteFile(queriesPath, []byte(`{"edited": {"col": "col", "query": "all"}}`), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = db.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[int]struct{})
+	if err = db.EvalStoredQuery("edited", nil, &result); err != nil || len(result) != 5 {
+		t.Fatal(result, err)
+	}
+}
@@ -0,0 +1,204 @@
+// String document ID (UUID, natural key) management.
+//
+// A document may be identified by a string ID in addition to its integer ID.
+// The string ID is stored in the reserved document attribute "_id". Each
+// collection keeps string ID lookup hash tables next to its ID lookup tables;
+// they key on the hashed string and lookups filter out hash collisions by
+// comparing the stored string ID. The lookup tables are internal, they are not
+// among the collection's indexes.
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/cankansin/tiedot/data"
+	"github.com/cankansin/tiedot/dberr"
+)
+
+const (
+	STR_ID_ATTR        = "_id"    // Reserved document attribute holding the document's string ID.
+	STR_ID_LOOKUP_FILE = "strid_" // Prefix of partition hash table (string ID lookup) file name.
+)
+
+// Open string ID lookup tables, they are built from the documents if the collection does not have them yet.
+// Does not place schema lock.
+func (col *Col) loadStrIDs() (err error) {
+	_, statErr := os.Stat(path.Join(col.db.path, col.name, STR_ID_LOOKUP_FILE+"0"))
+	col.strIDs = make([]*data.HashTable, col.db.numParts)
+	jobs := make([]func() error, col.db.numParts)
+	for i := range jobs {
+		i := i
+		jobs[i] = func() (err error) {
+			col.strIDs[i], err = col.fileConf.OpenHashTable(path.Join(col.db.path, col.name, STR_ID_LOOKUP_FILE+strconv.Itoa(i)))
+			return
+		}
+	}
+	if err = runJobs(col.db.openSlots, jobs); err != nil {
+		return
+	}
+	if os.IsNotExist(statErr) {
+		col.scanOnce(func(id int, docB []byte) bool {
+			var doc map[string]interface{}
+			if json.Unmarshal(docB, &doc) == nil {
+				col.putStrID(id, doc)
+			}
+			return true
+		}, false)
+	}
+	return nil
+}
+
+// Put the document's string ID (if any) into string ID lookup table.
+func (col *Col) putStrID(id int, doc map[string]interface{}) {
+	if strID, isStr := doc[STR_ID_ATTR].(string); isStr {
+		hashKey := StrHash(strID)
+		ht := col.strIDs[hashKey%col.db.numParts]
+		ht.Lock.Lock()
+		ht.Put(hashKey, id)
+		ht.Lock.Unlock()
+	}
+}
+
+// Remove the document's string ID (if any) from string ID lookup table.
+func (col *Col) removeStrID(id int, doc map[string]interface{}) {
+	if strID, isStr := doc[STR_ID_ATTR].(string); isStr {
+		hashKey := StrHash(strID)
+		ht := col.strIDs[hashKey%col.db.numParts]
+		ht.Lock.Lock()
+		ht.Remove(hashKey, id)
+		ht.Lock.Unlock()
+	}
+}
+
+// Follow a change of string ID in string ID lookup table. An original that could not be deserialised is nil.
+func (col *Col) moveStrID(id int, original, doc map[string]interface{}) {
+	origStrID, _ := original[STR_ID_ATTR].(string)
+	if strID, _ := doc[STR_ID_ATTR].(string); strID != origStrID {
+		col.removeStrID(id, original)
+		col.putStrID(id, doc)
+	}
+}
+
+// Return the documents that may carry the string ID, hash collisions are not filtered out.
+func (col *Col) strIDCandidates(strID string) []int {
+	hashKey := StrHash(strID)
+	ht := col.strIDs[hashKey%col.db.numParts]
+	ht.Lock.RLock()
+	defer ht.Lock.RUnlock()
+	return ht.Get(hashKey, 0)
+}
+
+// Look for the document carrying the string ID and return its document ID. Does not place schema lock.
+func (col *Col) strIDLookup(strID string) (id int, found bool) {
+	for _, match := range col.strIDCandidates(strID) {
+		// Filter result to avoid hash collision
+		if doc, err := col.read(context.Background(), match, false); err == nil && doc[STR_ID_ATTR] == strID {
+			return match, true
+		}
+	}
+	return
+}
+
+// Lock string ID against concurrent assignment to another document, and return the function that unlocks it. The
+// returned function may be called more than once.
+func (col *Col) lockStrID(strID string) (unlock func()) {
+	lock := col.strIDLocks[StrHash(strID)%col.db.numParts]
+	lock.Lock()
+	unlocked := false
+	return func() {
+		if !unlocked {
+			unlocked = true
+			lock.Unlock()
+		}
+	}
+}
+
+// Insert a document identified by the string ID, which is stored in the document's "_id" attribute. Return the new document ID.
+func (col *Col) InsertStrID(strID string, doc map[string]interface{}) (id int, err error) {
+	return col.insertStrID(context.Background(), strID, doc)
+}
+
+// Insert a document identified by the string ID, waiting for the write limits and the partition lock until the context
+// is done.
+func (col *Col) insertStrID(ctx context.Context, strID string, doc map[string]interface{}) (id int, err error) {
+	if strID == "" {
+		return 0, dberr.New(dberr.ErrorMissing, STR_ID_ATTR)
+	}
+	// Prevent concurrent insertion of the same string ID
+	unlock := col.lockStrID(strID)
+	defer unlock()
+	col.db.schemaLock.RLock()
+	_, exists := col.strIDLookup(strID)
+	col.db.schemaLock.RUnlock()
+	if exists {
+		return 0, dberr.New(dberr.ErrorDupStrID, strID)
+	}
+	doc[STR_ID_ATTR] = strID
+	return col.insert(ctx, doc, unlock)
+}
+
+// Return the document ID of the document identified by the string ID.
+func (col *Col) StrIDToID(strID string) (id int, err error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if id, found := col.strIDLookup(strID); found {
+		return id, nil
+	}
+	return 0, dberr.New(dberr.ErrorNoStrDoc, strID)
+}
+
+// Find and retrieve a document by string ID.
+func (col *Col) ReadStrID(strID string) (doc map[string]interface{}, err error) {
+	id, err := col.StrIDToID(strID)
+	if err != nil {
+		return
+	}
+	return col.Read(id)
+}
+
+// Update a document identified by the string ID. The string ID is retained in the updated document.
+func (col *Col) UpdateStrID(strID string, doc map[string]interface{}) error {
+	id, err := col.StrIDToID(strID)
+	if err != nil {
+		return err
+	}
+	if doc != nil {
+		doc[STR_ID_ATTR] = strID
+	}
+	return col.Update(id, doc)
+}
+
+// Delete a document identified by the string ID.
+func (col *Col) DeleteStrID(strID string) error {
+	id, err := col.StrIDToID(strID)
+	if err != nil {
+		return err
+	}
+	return col.Delete(id)
+}
+
+// Resolve document ID given in text form - either the integer ID of a document, or a string ID.
+// An integer that is neither the ID of an existing document nor a string ID in use is returned as-is.
+func (col *Col) ResolveID(id string) (docID int, err error) {
+	intID, intErr := strconv.Atoi(id)
+	if intErr == nil && intID >= 0 {
+		col.db.schemaLock.RLock()
+		part := col.parts[intID%col.db.numParts]
+		part.DataLock.RLock()
+		_, readErr := part.Read(intID)
+		part.DataLock.RUnlock()
+		col.db.schemaLock.RUnlock()
+		if readErr == nil {
+			return intID, nil
+		}
+	}
+	if docID, err = col.StrIDToID(id); err != nil && intErr == nil && intID >= 0 {
+		return intID, nil
+	}
+	return
+}
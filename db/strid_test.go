@@ -0,0 +1,172 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestStrIDCRUD(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	// Insert by string ID and read back
+	id, err := col.InsertStrID("alice@example.com", map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = col.InsertStrID("alice@example.com", map[string]interface{}{"a": 2}); dberr.Type(err) != dberr.ErrorDupStrID {
+		t.Fatal("Did not reject duplicated string ID", err)
+	}
+	if _, err = col.Insert(map[string]interface{}{STR_ID_ATTR: "alice@example.com"}); dberr.Type(err) != dberr.ErrorDupStrID {
+		t.Fatal("Did not reject duplicated string ID", err)
+	}
+	if _, err = col.InsertStrID("", map[string]interface{}{"a": 2}); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal("Did not reject empty string ID", err)
+	}
+	if readBack, err := col.ReadStrID("alice@example.com"); err != nil || readBack["a"].(float64) != 1 || readBack[STR_ID_ATTR] != "alice@example.com" {
+		t.Fatal(readBack, err)
+	}
+	if resolved, err := col.ResolveID("alice@example.com"); err != nil || resolved != id {
+		t.Fatal(resolved, err)
+	}
+	if resolved, err := col.ResolveID(strconv.Itoa(id)); err != nil || resolved != id {
+		t.Fatal(resolved, err)
+	}
+	if _, err := col.ReadStrID("bob@example.com"); dberr.Type(err) != dberr.ErrorNoStrDoc {
+		t.Fatal("Did not error", err)
+	}
+	// A purely numeric natural key is a valid string ID too
+	numericID, err := col.InsertStrID("12345", map[string]interface{}{"a": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved, err := col.ResolveID("12345"); err != nil || resolved != numericID {
+		t.Fatal(resolved, err)
+	}
+	// Update retains the string ID
+	if err = col.UpdateStrID("alice@example.com", map[string]interface{}{"a": 4}); err != nil {
+		t.Fatal(err)
+	}
+	if readBack, err := col.ReadStrID("alice@example.com"); err != nil || readBack["a"].(float64) != 4 {
+		t.Fatal(readBack, err)
+	}
+	// String ID survives scrub
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if readBack, err := col.ReadStrID("alice@example.com"); err != nil || readBack["a"].(float64) != 4 {
+		t.Fatal(readBack, err)
+	}
+	// Delete by string ID
+	if err = col.DeleteStrID("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := col.ReadStrID("alice@example.com"); dberr.Type(err) != dberr.ErrorNoStrDoc {
+		t.Fatal("Did not delete", err)
+	}
+	if err = col.DeleteStrID("alice@example.com"); dberr.Type(err) != dberr.ErrorNoStrDoc {
+		t.Fatal("Did not error", err)
+	}
+	// The string ID may be reused after deletion
+	if _, err = col.InsertStrID("alice@example.com", map[string]interface{}{"a": 5}); err != nil {
+		t.Fatal(err)
+	}
+	// String ID lookup is not a user index
+	if indexes := col.AllIndexes(); len(indexes) != 0 {
+		t.Fatal(indexes)
+	}
+}
+
+func TestStrIDUpdate(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	alice, err := col.InsertStrID("alice", map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := col.Insert(map[string]interface{}{"a": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Update may not take a string ID in use by another document
+	if err = col.Update(bob, map[string]interface{}{STR_ID_ATTR: "alice"}); dberr.Type(err) != dberr.ErrorDupStrID {
+		t.Fatal(err)
+	} else if err = col.Update(alice, map[string]interface{}{STR_ID_ATTR: "alice", "a": 3}); err != nil {
+		t.Fatal(err)
+	}
+	// Update may assign a new string ID, and the old one is no longer in use
+	if err = col.Update(bob, map[string]interface{}{STR_ID_ATTR: "bob"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Update(alice, map[string]interface{}{STR_ID_ATTR: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := col.StrIDToID("carol"); err != nil || id != alice {
+		t.Fatal(id, err)
+	} else if _, err = col.StrIDToID("alice"); dberr.Type(err) != dberr.ErrorNoStrDoc {
+		t.Fatal(err)
+	}
+	// Update functions may not change the string ID
+	if err = col.UpdateFunc(bob, func(orig map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{STR_ID_ATTR: "carol"}, nil
+	}); err == nil {
+		t.Fatal("Did not error")
+	} else if err = col.UpdateBytesFunc(bob, func(orig []byte) ([]byte, error) {
+		return []byte(`{"_id": "carol"}`), nil
+	}); err == nil {
+		t.Fatal("Did not error")
+	} else if err = col.UpdateFunc(bob, func(orig map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{STR_ID_ATTR: "bob", "a": 4}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// String ID lookup is rebuilt if missing, e.g. in a database made by an older version
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = os.Remove(path.Join(TEST_DATA_DIR, "col", STR_ID_LOOKUP_FILE+strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := db.Use("col").StrIDToID("bob"); err != nil || id != bob {
+		t.Fatal(id, err)
+	}
+}
@@ -0,0 +1,137 @@
+// Write throttling.
+//
+// A collection may limit the rate of writes (insert, update and delete) and the number of writes in progress, so that a
+// bulk load cannot starve the reads sharing its partitions. A write beyond the limits waits for its turn, or fails
+// with ErrorOverloaded if the collection is configured to reject overload. Writes wait before placing any lock, and a
+// write made with a context gives up waiting once the context is done.
+
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Limits of concurrent and per-second writes of a collection.
+type writeThrottle struct {
+	lock     *sync.Mutex
+	released *sync.Cond // Signaled when a write completes or limits change
+	maxRate  int        // Maximum writes per second, 0 - unlimited
+	maxWrite int        // Maximum writes in progress, 0 - unlimited
+	reject   bool       // Writes beyond the limits fail rather than wait
+	inFlight int        // Writes in progress
+	tokens   float64    // Writes allowed right now by the rate limit, negative if writes wait for them
+	refilled time.Time  // Last time tokens were refilled
+}
+
+func newWriteThrottle() *writeThrottle {
+	throttle := &writeThrottle{lock: new(sync.Mutex)}
+	throttle.released = sync.NewCond(throttle.lock)
+	return throttle
+}
+
+// Apply the write limits of collection settings.
+func (throttle *writeThrottle) configure(conf ColConfig) {
+	throttle.lock.Lock()
+	defer throttle.lock.Unlock()
+	if conf.MaxWriteRate != throttle.maxRate {
+		// Allow up to a second's worth of writes in a burst
+		throttle.tokens = float64(conf.MaxWriteRate)
+		throttle.refilled = time.Now()
+	}
+	throttle.maxRate = conf.MaxWriteRate
+	throttle.maxWrite = conf.MaxWrites
+	throttle.reject = conf.RejectOverload
+	throttle.released.Broadcast()
+}
+
+// Wait until the write is allowed by the limits, and return the function that marks the write completed. The returned
+// function may be called more than once. An error is returned instead if the write exceeds the limits and overload
+// is rejected, or the context's error if the context is done while waiting.
+func (throttle *writeThrottle) acquire(ctx context.Context, colName string) (release func(), err error) {
+	throttle.lock.Lock()
+	tookToken := false
+	if throttle.maxRate > 0 {
+		now := time.Now()
+		throttle.tokens += now.Sub(throttle.refilled).Seconds() * float64(throttle.maxRate)
+		if throttle.tokens > float64(throttle.maxRate) {
+			throttle.tokens = float64(throttle.maxRate)
+		}
+		throttle.refilled = now
+		if throttle.tokens < 1 && throttle.reject {
+			throttle.lock.Unlock()
+			return nil, dberr.New(dberr.ErrorOverloaded, colName)
+		}
+		// Take the token in advance and wait for it to be refilled
+		throttle.tokens--
+		tookToken = true
+		if wait := time.Duration(-throttle.tokens / float64(throttle.maxRate) * float64(time.Second)); wait > 0 {
+			throttle.lock.Unlock()
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+			throttle.lock.Lock()
+		}
+	}
+	if done := ctx.Done(); done != nil && throttle.maxWrite > 0 {
+		// Wake up the waits below once the context is done
+		waited := make(chan struct{})
+		defer close(waited)
+		go func() {
+			select {
+			case <-done:
+				throttle.lock.Lock()
+				throttle.released.Broadcast()
+				throttle.lock.Unlock()
+			case <-waited:
+			}
+		}()
+	}
+	for throttle.maxWrite > 0 && throttle.inFlight >= throttle.maxWrite || ctx.Err() != nil {
+		if err = ctx.Err(); err != nil || throttle.reject {
+			// The rejected write gives back its token
+			if tookToken && throttle.maxRate > 0 {
+				throttle.tokens++
+			}
+			throttle.lock.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			return nil, dberr.New(dberr.ErrorOverloaded, colName)
+		}
+		throttle.released.Wait()
+	}
+	throttle.inFlight++
+	throttle.lock.Unlock()
+	released := false
+	return func() {
+		if !released {
+			released = true
+			throttle.lock.Lock()
+			throttle.inFlight--
+			throttle.released.Signal()
+			throttle.lock.Unlock()
+		}
+	}, nil
+}
+
+// Wait until a write is allowed by the collection's write limits, and return the function that marks the write
+// completed. Writes mark completion before firing hooks, which may write to the collection. Writes to a read replica
+// fail with ErrorReadOnly. Must not be called while holding schema or partition locks.
+func (col *Col) throttleWrite() (release func(), err error) {
+	return col.throttleWriteCtx(context.Background())
+}
+
+// Wait like throttleWrite until the write is allowed, or until the context is done.
+func (col *Col) throttleWriteCtx(ctx context.Context) (release func(), err error) {
+	if err = col.db.checkWritable(); err != nil {
+		return
+	}
+	return col.throttle.acquire(ctx, col.name)
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestWriteThrottle(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.SetConfig(ColConfig{MaxWriteRate: -1}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if err = col.SetConfig(ColConfig{MaxWrites: -1}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+	// Writes beyond the rate limit wait
+	if err = col.SetConfig(ColConfig{MaxWriteRate: 50}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 75; i++ {
+		if _, err = col.Insert(map[string]interface{}{"i": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatal("Writes were not throttled", elapsed)
+	}
+	// Or fail if overload is rejected
+	if err = col.SetConfig(ColConfig{MaxWriteRate: 5, RejectOverload: true}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err = col.Update(id, map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = col.Delete(id); dberr.Type(err) != dberr.ErrorOverloaded {
+		t.Fatal(err)
+	}
+	// Writes beyond the number of writes in progress wait or fail
+	updateInProgress := func() (finish func()) {
+		inUpdate, finishUpdate := make(chan struct{}), make(chan struct{})
+		updated := make(chan error)
+		go func() {
+			updated <- col.UpdateFunc(id, func(orig map[string]interface{}) (map[string]interface{}, error) {
+				close(inUpdate)
+				<-finishUpdate
+				return map[string]interface{}{"a": "updated"}, nil
+			})
+		}()
+		<-inUpdate
+		return func() {
+			close(finishUpdate)
+			if err := <-updated; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = col.SetConfig(ColConfig{MaxWrites: 1}); err != nil {
+		t.Fatal(err)
+	}
+	finishUpdate := updateInProgress()
+	inserted := make(chan error)
+	go func() {
+		_, err := col.Insert(map[string]interface{}{"a": 2})
+		inserted <- err
+	}()
+	select {
+	case err = <-inserted:
+		t.Fatal("Insert did not wait", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	finishUpdate()
+	if err = <-inserted; err != nil {
+		t.Fatal(err)
+	}
+	if err = col.SetConfig(ColConfig{MaxWrites: 1, RejectOverload: true}); err != nil {
+		t.Fatal(err)
+	}
+	finishUpdate = updateInProgress()
+	if _, err = col.Insert(map[string]interface{}{"a": 3}); dberr.Type(err) != dberr.ErrorOverloaded {
+		t.Fatal(err)
+	}
+	finishUpdate()
+	// A write rejected for the number of writes in progress does not use up the rate limit
+	if err = col.SetConfig(ColConfig{MaxWriteRate: 2, MaxWrites: 1, RejectOverload: true}); err != nil {
+		t.Fatal(err)
+	}
+	finishUpdate = updateInProgress()
+	if _, err = col.Insert(map[string]interface{}{"a": 3}); dberr.Type(err) != dberr.ErrorOverloaded {
+		t.Fatal(err)
+	}
+	finishUpdate()
+	if _, err = col.Insert(map[string]interface{}{"a": 3}); err != nil {
+		t.Fatal(err)
+	}
+	// Capped collection evicts documents regardless of write limits
+	if err = db.Create("capped"); err != nil {
+		t.Fatal(err)
+	}
+	capped := db.Use("capped")
+	if err = capped.SetConfig(ColConfig{MaxDocs: 2, MaxWriteRate: 3, RejectOverload: true}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = capped.Insert(map[string]interface{}{"i": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := countDocs(capped); n != 2 {
+		t.Fatal(n)
+	}
+	if err = col.SetConfig(ColConfig{MaxWrites: 1, RejectOverload: true}); err != nil {
+		t.Fatal(err)
+	}
+	// Hooks may write to the collection without exceeding the limit
+	col.OnInsert(func(id int, doc map[string]interface{}) {
+		if doc["a"] == 4 {
+			if err := col.Delete(id); err != nil {
+				t.Error(err)
+			}
+		}
+	}, false)
+	if _, err = col.Insert(map[string]interface{}{"a": 4}); err != nil {
+		t.Fatal(err)
+	}
+	// Limits are persisted
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	if conf := db.Use("col").Config(); conf.MaxWrites != 1 || !conf.RejectOverload {
+		t.Fatal(conf)
+	}
+}
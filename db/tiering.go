@@ -0,0 +1,318 @@
+// Hot/cold tiering of collections.
+//
+// A collection configured with an archive collection has its documents moved there once they grow older than a
+// threshold, by their time along an indexed path - Unix seconds or an RFC 3339 string, such as "_created" of a
+// collection with timestamps. The documents are moved in background every minute, or right away by Archive, and keep
+// their IDs. The archive collection is created with the indexes of the collection if it does not exist, and stores each
+// document compressed: the gzipped document is kept in attribute "_archived" next to plain copies of the indexed
+// attributes, so that the archive supports the queries of the collection.
+//
+// Queries of a collection may include its archive, reading archived documents transparently. Documents found in the
+// archive are read-only, updating or deleting them by the collection fails with ErrorNoDoc.
+
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+const (
+	ARCHIVED_ATTR = "_archived" // Reserved document attribute holding the compressed document in an archive collection.
+	TIERING_CHECK = time.Minute // Interval of moving documents to archive collections.
+)
+
+// Validate the archive and retention settings against the collection: the archive collection must be another one, and
+// the paths of document time must be indexed. Does not place schema lock.
+func (col *Col) checkTimePaths(conf ColConfig) error {
+	if conf.ArchiveCol == col.name {
+		return dberr.New(dberr.ErrorInvalidParam, "archive collection", conf.ArchiveCol)
+	}
+	for what, timePath := range map[string][]string{"archive path": conf.ArchivePath, "retention path": conf.RetentionPath} {
+		if _, indexed := col.indexPaths[strings.Join(timePath, INDEX_PATH_SEP)]; len(timePath) > 0 && !indexed {
+			return dberr.New(dberr.ErrorNeedIndex, timePath, what)
+		}
+	}
+	return nil
+}
+
+// Return the archive collection, creating it if it does not exist, with the indexes of the collection.
+func (col *Col) archiveCol(name string) (*Col, error) {
+	if err := col.db.Create(name); err != nil && dberr.Type(err) != dberr.ErrorColExists {
+		return nil, err
+	}
+	archive := col.db.Use(name)
+	if archive == nil {
+		return nil, dberr.New(dberr.ErrorNoCol, name)
+	}
+	return archive, archive.ensureIndexes(col.AllIndexes())
+}
+
+// Return the archived form of the document: the compressed document next to the top-level attributes of the index
+// paths and the string ID. The document is compressed with the numbered dictionary if there is one (see TrainDict),
+// otherwise by gzip.
+func archiveDoc(doc map[string]interface{}, idxPaths [][]string, dictNum int, dict []byte) (map[string]interface{}, error) {
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var compressed bytes.Buffer
+	if dict != nil {
+		var withDict []byte
+		withDict, err = compressWithDict(docJS, dict)
+		compressed.Write(withDict)
+	} else {
+		zipper := gzip.NewWriter(&compressed)
+		if _, err = zipper.Write(docJS); err == nil {
+			err = zipper.Close()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	archived := map[string]interface{}{ARCHIVED_ATTR: base64.StdEncoding.EncodeToString(compressed.Bytes())}
+	if dict != nil {
+		archived[ARCHIVED_DICT_ATTR] = float64(dictNum)
+	}
+	if strID, exists := doc[STR_ID_ATTR]; exists {
+		archived[STR_ID_ATTR] = strID
+	}
+	for _, idxPath := range idxPaths {
+		for _, seg := range idxPath {
+			if strings.HasPrefix(seg, INDEX_FUNC_PREFIX) {
+				continue
+			} else if val, exists := doc[seg]; exists {
+				archived[seg] = val
+			}
+			break
+		}
+	}
+	return archived, nil
+}
+
+// Return the document kept by a document of an archive collection. A document that is not archived is returned as it is.
+// A document compressed with a dictionary fails with ErrorMissing, the archive collection's Unarchive decompresses it.
+func Unarchive(archived map[string]interface{}) (doc map[string]interface{}, err error) {
+	if _, hasDict := archived[ARCHIVED_DICT_ATTR]; hasDict {
+		return nil, dberr.New(dberr.ErrorMissing, "compression dictionary")
+	}
+	return decodeArchived(archived, func(compressed []byte) ([]byte, error) {
+		unzipper, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(unzipper)
+	})
+}
+
+// Return the document kept by a document of an archive collection, decompressed by the function. A document that is
+// not archived is returned as it is.
+func decodeArchived(archived map[string]interface{}, decompress func(compressed []byte) ([]byte, error)) (doc map[string]interface{}, err error) {
+	encoded, isArchived := archived[ARCHIVED_ATTR].(string)
+	if !isArchived {
+		return archived, nil
+	}
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, dberr.New(dberr.ErrorInvalidParam, ARCHIVED_ATTR, err)
+	}
+	docJS, err := decompress(compressed)
+	if err != nil {
+		return nil, dberr.New(dberr.ErrorInvalidParam, ARCHIVED_ATTR, err)
+	} else if err = json.Unmarshal(docJS, &doc); err != nil {
+		return nil, dberr.New(dberr.ErrorInvalidJSON, string(docJS), ARCHIVED_ATTR)
+	}
+	return
+}
+
+// Return the archive collection included in queries of the collection, nil if there is none. Does not place schema
+// lock.
+func (col *Col) queriedArchive() *Col {
+	if !col.conf.QueryArchive || col.conf.ArchiveCol == col.name {
+		return nil
+	}
+	return col.db.cols[col.conf.ArchiveCol]
+}
+
+// Read the document from the archive collection included in queries, or return the error of reading it from the
+// collection. Does not place schema lock.
+func (col *Col) readArchived(ctx context.Context, id int, notFound error) (map[string]interface{}, error) {
+	archive := col.queriedArchive()
+	if archive == nil {
+		return nil, notFound
+	}
+	archived, err := archive.read(ctx, id, false)
+	if err != nil {
+		return nil, err
+	}
+	return archive.Unarchive(archived)
+}
+
+// Evaluate the query like evalQuery, and on the archive collection as well if queries of the collection include it.
+func evalQueryArchived(ctx context.Context, q interface{}, src *Col, result *map[int]struct{}) error {
+	src.db.schemaLock.RLock()
+	defer src.db.schemaLock.RUnlock()
+	if err := evalQuery(ctx, q, src, result, false); err != nil {
+		return err
+	} else if archive := src.queriedArchive(); archive != nil {
+		return evalQuery(ctx, q, archive, result, false)
+	}
+	return nil
+}
+
+// Move the documents older than ArchiveAfter to the archive collection right away, return the number of documents
+// moved. Fail with ErrorMissing if the collection has no archive collection.
+func (col *Col) Archive() (moved int, err error) {
+	if err = col.db.checkWritable(); err != nil {
+		return
+	}
+	conf := col.Config()
+	if conf.ArchiveCol == "" {
+		return 0, dberr.New(dberr.ErrorMissing, "archive collection")
+	}
+	return col.removeOld(conf.ArchivePath, conf.ArchiveAfter, conf.ArchiveCol)
+}
+
+// Remove the documents older than the age (in seconds) by their time along the indexed path: move them to the archive
+// collection, or delete them if the archive collection name is "". Return the number of documents removed. A document
+// that fails to be removed is left for the next time, and the first such error is returned.
+func (col *Col) removeOld(timePath []string, age int, archiveName string) (removed int, err error) {
+	var archive *Col
+	if archiveName != "" {
+		if archive, err = col.archiveCol(archiveName); err != nil {
+			return
+		}
+	}
+	idxPaths := col.AllIndexes()
+	// The documents to remove are among those having a time along the indexed path
+	hasPath := make([]interface{}, len(timePath))
+	for i, seg := range timePath {
+		hasPath[i] = seg
+	}
+	ids := make(map[int]struct{})
+	if err = evalQuery(context.Background(), map[string]interface{}{"has": hasPath}, col, &ids, true); err != nil {
+		return
+	}
+	before := time.Now().Add(-time.Duration(age) * time.Second).UnixNano()
+	isOld := func(doc map[string]interface{}) bool {
+		nanos, err := docTime(doc, timePath)
+		return err == nil && nanos < before
+	}
+	for id := range ids {
+		var doc map[string]interface{}
+		col.db.schemaLock.RLock()
+		if col.db.cols[col.name] != col || archive != nil && col.db.cols[archive.name] != archive {
+			// Dropped or renamed meanwhile
+			col.db.schemaLock.RUnlock()
+			return
+		}
+		docB, readErr := col.readBytes(id)
+		col.db.schemaLock.RUnlock()
+		if readErr != nil || json.Unmarshal(docB, &doc) != nil || !isOld(doc) {
+			continue
+		}
+		var docErr error
+		if archive != nil {
+			docErr = col.moveToArchive(id, doc, archive, idxPaths, isOld)
+		} else if release, throttleErr := col.throttleWrite(); throttleErr != nil {
+			docErr = throttleErr
+		} else {
+			_, docErr = col.deleteIf(context.Background(), id, release, true, isOld)
+			release()
+		}
+		if docErr == nil {
+			removed++
+		} else if dberr.Type(docErr) != dberr.ErrorNoDoc && err == nil {
+			err = docErr
+		}
+	}
+	return
+}
+
+// Move the document into the archive collection under the same ID, provided that it is still old by the time it is
+// deleted from the collection; otherwise the archived copy is removed and the error is ErrorNoDoc.
+func (col *Col) moveToArchive(id int, doc map[string]interface{}, archive *Col, idxPaths [][]string, isOld func(doc map[string]interface{}) bool) error {
+	dictNum, dict := archive.latestDict()
+	archived, err := archiveDoc(doc, idxPaths, dictNum, dict)
+	if err != nil {
+		return err
+	}
+	noRelease := func() {}
+	// The archive may hold the document already, should an earlier move have been interrupted
+	if err = archive.delete(id, noRelease, false); err != nil && dberr.Type(err) != dberr.ErrorNoDoc {
+		return err
+	} else if _, err = archive.insertWithID(context.Background(), id, archived, noRelease); err != nil {
+		return err
+	}
+	release, err := col.throttleWrite()
+	if err == nil {
+		_, err = col.deleteIf(context.Background(), id, release, false, isOld)
+		release()
+	}
+	if err != nil {
+		// Deleted or updated meanwhile, or not deleted at all
+		if undoErr := archive.delete(id, noRelease, false); undoErr != nil {
+			return undoErr
+		}
+	}
+	return err
+}
+
+// Start moving old documents of all collections to their archive collections in background.
+func (db *DB) startTiering() {
+	db.tieringStop = make(chan struct{})
+	db.tieringDone = make(chan struct{})
+	go func() {
+		defer close(db.tieringDone)
+		ticker := time.NewTicker(TIERING_CHECK)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.tieringStop:
+				return
+			case <-ticker.C:
+				db.applyTiering()
+			}
+		}
+	}()
+}
+
+// Stop moving old documents, waiting for a round in progress to finish.
+func (db *DB) stopTiering() {
+	if db.tieringStop != nil {
+		close(db.tieringStop)
+		<-db.tieringDone
+		db.tieringStop = nil
+	}
+}
+
+// Move old documents of all collections to their archive collections.
+func (db *DB) applyTiering() {
+	if db.checkWritable() != nil {
+		return
+	}
+	db.schemaLock.RLock()
+	var tiered []*Col
+	for _, col := range db.cols {
+		if col.conf.ArchiveCol != "" {
+			tiered = append(tiered, col)
+		}
+	}
+	db.schemaLock.RUnlock()
+	for _, col := range tiered {
+		if moved, err := col.Archive(); err != nil {
+			tdlog.CritNoRepeat("Failed to move documents of %s to archive collection: %v", col.name, err)
+		} else if moved > 0 {
+			tdlog.Infof("Moved %d documents of %s to archive collection", moved, col.name)
+		}
+	}
+}
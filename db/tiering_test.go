@@ -0,0 +1,101 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestArchive(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("hot"); err != nil {
+		t.Fatal(err)
+	}
+	hot := db.Use("hot")
+	conf := ColConfig{ArchiveCol: "cold", ArchiveAfter: 3600, ArchivePath: []string{"time"}}
+	if _, err = hot.Archive(); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	} else if err = hot.SetConfig(conf); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	} else if err = hot.Index([]string{"time"}); err != nil {
+		t.Fatal(err)
+	} else if err = hot.Index([]string{"@lower", "name"}); err != nil {
+		t.Fatal(err)
+	} else if err = hot.SetConfig(ColConfig{ArchiveCol: "cold", ArchivePath: []string{"time"}}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if err = hot.SetConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	oldID, err := hot.Insert(map[string]interface{}{"time": float64(now.Add(-2 * time.Hour).Unix()), "name": "Old", "text": "long text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStrID, err := hot.Insert(map[string]interface{}{"time": now.Add(-3 * time.Hour).Format(time.RFC3339), "name": "Older"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newID, err := hot.Insert(map[string]interface{}{"time": float64(now.Unix()), "name": "New"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = hot.Insert(map[string]interface{}{"name": "Timeless"}); err != nil {
+		t.Fatal(err)
+	}
+	// The old documents move to the archive collection, created with the indexes, compressed and under the same IDs
+	if moved, err := hot.Archive(); err != nil || moved != 2 {
+		t.Fatal(moved, err)
+	} else if hot.Count() != 2 {
+		t.Fatal(hot.Count())
+	}
+	cold := db.Use("cold")
+	if cold == nil || cold.Count() != 2 || len(cold.AllIndexes()) != 2 {
+		t.Fatal(cold)
+	}
+	archived, err := cold.Read(oldID)
+	if err != nil || archived["name"] != "Old" || archived["text"] != nil || archived[ARCHIVED_ATTR] == nil {
+		t.Fatal(archived, err)
+	} else if doc, err := Unarchive(archived); err != nil || doc["text"] != "long text" {
+		t.Fatal(doc, err)
+	} else if _, err = hot.Read(oldID); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	// Queries include the archive only if configured to
+	query := map[string]interface{}{"eq": "old", "in": []interface{}{"@lower", "name"}}
+	result := make(map[int]struct{})
+	if err = EvalQuery(query, hot, &result); err != nil || len(result) != 0 {
+		t.Fatal(result, err)
+	}
+	conf.QueryArchive = true
+	if err = hot.SetConfig(conf); err != nil {
+		t.Fatal(err)
+	} else if err = EvalQuery(query, hot, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	} else if _, found := result[oldID]; !found {
+		t.Fatal(result)
+	} else if doc, err := hot.Read(oldID); err != nil || doc["text"] != "long text" {
+		t.Fatal(doc, err)
+	}
+	result = make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"has": []interface{}{"time"}}, hot, &result); err != nil || len(result) != 3 {
+		t.Fatal(result, err)
+	} else if _, found := result[oldStrID]; !found {
+		t.Fatal(result)
+	} else if err = hot.Delete(oldID); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	// Nothing more to move
+	if moved, err := hot.Archive(); err != nil || moved != 0 {
+		t.Fatal(moved, err)
+	} else if _, err = hot.Read(newID); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,180 @@
+// Time range queries.
+//
+// {"time": ["created"], "after": "2024-01-01T00:00:00+02:00", "before": "2024-02-01T00:00:00Z"} finds the documents
+// holding a time along the path strictly after and strictly before the given times; either bound may be left out.
+// Times are RFC 3339 strings of any time zone, or Unix seconds, and are compared as instants, so that
+// "2024-01-01T00:00:00+02:00" comes before "2023-12-31T23:00:00Z" and clients need not convert them to numbers.
+//
+// The query is backed by the index on the UTC dates of the times, path ["@date", "created"]: the dates from one bound to
+// the other are looked up, or should there be too many of them or a bound be missing, every document having a date is
+// verified. Without the index the query needs hint "noindex", which scans the documents instead.
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+const (
+	TIME_INDEX_FUNC      = INDEX_FUNC_PREFIX + "date" // Index function of the index backing time range queries.
+	MAX_TIME_LOOKUP_DAYS = 1000                       // Time range queries spanning more days verify every document having a date.
+)
+
+// Return the instant of a time value: an RFC 3339 string, or Unix seconds. Return false if the value is neither.
+func timeValue(val interface{}) (t time.Time, ok bool) {
+	var seconds float64
+	switch val := val.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, val)
+		return t, err == nil
+	case float64:
+		seconds = val
+	case int:
+		seconds = float64(val)
+	case json.Number:
+		var err error
+		if seconds, err = val.Float64(); err != nil {
+			return time.Time{}, false
+		}
+	default:
+		return time.Time{}, false
+	}
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9)), true
+}
+
+// Return the bounds of a time range query, a missing bound is nil.
+func timeBounds(expr map[string]interface{}, position string) (after, before *time.Time, err error) {
+	for _, bound := range []struct {
+		attr string
+		dest **time.Time
+	}{{"after", &after}, {"before", &before}} {
+		val, exists := expr[bound.attr]
+		if !exists {
+			continue
+		}
+		t, ok := timeValue(val)
+		if !ok {
+			return nil, nil, queryErrorAt(position+"."+bound.attr, fmt.Errorf("Expecting `%s` as an RFC 3339 time or Unix seconds, but %v given", bound.attr, val))
+		}
+		*bound.dest = &t
+	}
+	if after == nil && before == nil {
+		return nil, nil, queryErrorAt(position, dberr.New(dberr.ErrorMissing, "after` or `before"))
+	}
+	return
+}
+
+// Validate the limit and bounds of a time range query.
+func checkTimeRange(expr map[string]interface{}, position string) error {
+	if err := checkLimit(expr, position); err != nil {
+		return err
+	}
+	_, _, err := timeBounds(expr, position)
+	return err
+}
+
+// Validate path, limit and bounds of a time range query, return its plan. Does not place schema lock.
+func planTimeRange(expr map[string]interface{}, src *Col, position string) (plan *queryPlan, err error) {
+	vecPathInterface, ok := expr["time"].([]interface{})
+	if !ok {
+		return nil, queryErrorAt(position+".time", errors.New(fmt.Sprintf("Expecting vector path `time`, but %v given", expr["time"])))
+	}
+	vecPath := make([]string, 0, len(vecPathInterface))
+	for _, v := range vecPathInterface {
+		vecPath = append(vecPath, fmt.Sprint(v))
+	}
+	if err = checkTimeRange(expr, position); err != nil {
+		return
+	}
+	idxPath := append([]string{TIME_INDEX_FUNC}, vecPath...)
+	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	if _, indexed := src.indexPaths[idxName]; !indexed && expr["hint"] != HINT_NOINDEX {
+		return nil, dberr.New(dberr.ErrorNeedIndex, idxPath, expr)
+	}
+	return &queryPlan{op: PLAN_TIME_RANGE, vecPath: vecPath, idxName: idxName, hint: hintOf(expr)}, nil
+}
+
+// Return true if the document holds a time along the path within the bounds (nil - unbounded).
+func matchTimeRange(doc map[string]interface{}, path []string, after, before *time.Time) bool {
+	for _, val := range indexValues(doc, path) {
+		if t, ok := timeValue(val); ok && (after == nil || t.After(*after)) && (before == nil || t.Before(*before)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate time range query of the plan. Does not place schema lock.
+func (plan *queryPlan) timeRange(ctx context.Context, expr map[string]interface{}, src *Col, result *map[int]struct{}) (err error) {
+	intLimit, ok := queryLimit(expr)
+	if !ok {
+		return dberr.New(dberr.ErrorExpectingInt, "limit", expr["limit"])
+	}
+	after, before, err := timeBounds(expr, "$")
+	if err != nil {
+		return unpositioned(err)
+	} else if plan.hint == HINT_NOINDEX {
+		return plan.scan(ctx, expr, intLimit, src, result)
+	}
+	src.useIndex(plan.idxName)
+	counter := 0
+	// Verify each candidate document once
+	verified := make(map[int]struct{})
+	verify := func(id int) bool {
+		if _, seen := verified[id]; seen {
+			return true
+		}
+		verified[id] = struct{}{}
+		if doc, err := src.read(ctx, id, false); err == nil && matchTimeRange(doc, plan.vecPath, after, before) {
+			(*result)[id] = struct{}{}
+			counter++
+		}
+		return intLimit == 0 || counter < intLimit
+	}
+	if after != nil && before != nil {
+		// The index truncates Unix seconds toward zero, which may date a time before 1970 a day later
+		from, to := after.UTC().Truncate(24*time.Hour).Add(-24*time.Hour), before.UTC()
+		if to.Sub(from) <= MAX_TIME_LOOKUP_DAYS*24*time.Hour {
+			// Look up the dates from one bound to the other
+			for date := from; !date.After(to); date = date.Add(24 * time.Hour) {
+				if err = ctx.Err(); err != nil {
+					return
+				}
+				for _, id := range src.hashScan(plan.idxName, StrHash(date.Format("2006-01-02")), 0) {
+					if !verify(id) {
+						return nil
+					}
+				}
+			}
+			return nil
+		}
+	}
+	// Verify every document having a date
+	var candidates []int
+	for iteratePart := 0; iteratePart < src.db.numParts; iteratePart++ {
+		ht := src.hts[iteratePart][plan.idxName]
+		ht.Lock.RLock()
+		ht.ForEachEntry(0, 1, func(_, id int) bool {
+			candidates = append(candidates, id)
+			return true
+		})
+		ht.Lock.RUnlock()
+	}
+	for _, id := range candidates {
+		if err = ctx.Err(); err != nil {
+			return
+		} else if !verify(id) {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestTimeRange(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	ids := make(map[string]int)
+	for name, created := range map[string]interface{}{
+		"utc":     "2024-01-01T12:00:00Z",
+		"east":    "2024-01-02T01:00:00+14:00", // 2024-01-01T11:00:00Z
+		"west":    "2023-12-31T23:30:00-12:00", // 2024-01-01T11:30:00Z
+		"seconds": float64(1704110400),         // 2024-01-01T12:00:00Z
+		"later":   []interface{}{"junk", "2024-03-01T00:00:00.5Z"},
+		"old":     "1969-12-31T23:00:00Z",
+		"none":    "yesterday",
+	} {
+		if ids[name], err = col.Insert(map[string]interface{}{"created": created}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	query := func(q map[string]interface{}) (names []string) {
+		result, err := col.Query(q)
+		if err != nil {
+			t.Fatal(q, err)
+		}
+		for _, name := range []string{"utc", "east", "west", "seconds", "later", "old", "none"} {
+			if _, found := result[ids[name]]; found {
+				names = append(names, name)
+			}
+		}
+		return
+	}
+	cases := []struct {
+		after, before interface{}
+		names         []string
+	}{
+		{"2024-01-01T11:15:00Z", "2024-01-01T13:00:00+01:00", []string{"west"}},
+		{"2024-01-01T07:00:00-05:00", nil, []string{"later"}},
+		{nil, "2024-01-01T11:30:00Z", []string{"east", "old"}},
+		{float64(1704100000), "2024-01-01T12:00:00.001Z", []string{"utc", "east", "west", "seconds"}},
+		{"1900-01-01T00:00:00Z", "2024-12-31T00:00:00Z", []string{"utc", "east", "west", "seconds", "later", "old"}},
+		{"1969-12-31T00:00:00Z", float64(0), []string{"old"}},
+	}
+	// Without the index, the query needs to scan
+	if _, err = col.Query(map[string]interface{}{"time": []interface{}{"created"}, "after": 0}); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		q := map[string]interface{}{"time": []interface{}{"created"}, "hint": "noindex"}
+		if c.after != nil {
+			q["after"] = c.after
+		}
+		if c.before != nil {
+			q["before"] = c.before
+		}
+		if names := query(q); !reflect.DeepEqual(names, c.names) {
+			t.Fatal(q, names)
+		}
+	}
+	// The index gives the same results
+	if err = col.Index([]string{"@date", "created"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		q := map[string]interface{}{"time": []interface{}{"created"}}
+		if c.after != nil {
+			q["after"] = c.after
+		}
+		if c.before != nil {
+			q["before"] = c.before
+		}
+		if names := query(q); !reflect.DeepEqual(names, c.names) {
+			t.Fatal(q, names)
+		}
+	}
+	if names := query(map[string]interface{}{"time": []interface{}{"created"}, "after": "2000-01-01T00:00:00Z", "limit": 2}); len(names) != 2 {
+		t.Fatal(names)
+	}
+	// Malformed bounds
+	for q, position := range map[string]string{
+		`{"time": ["created"]}`:                                      "$",
+		`{"time": ["created"], "after": "2024-01-01"}`:               "$.after",
+		`{"time": ["created"], "before": true}`:                      "$.before",
+		`{"time": "created", "after": 0}`:                            "$.time",
+		`{"version": 4, "query": {"time": [1], "after": 0}}`:         "$.query.time[0]",
+		`{"version": 3, "query": {"time": ["created"], "after": 0}}`: "$.query.time",
+	} {
+		var parsed interface{}
+		if err = json.Unmarshal([]byte(q), &parsed); err != nil {
+			t.Fatal(err)
+		} else if _, err = col.Query(parsed); err == nil || err.(*QueryError).Position != position {
+			t.Fatal(q, err)
+		}
+	}
+}
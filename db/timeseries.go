@@ -0,0 +1,466 @@
+// Time series collections.
+//
+// A time series collection stores documents by their time - Unix seconds or an RFC 3339 string along a path - in
+// segment files each covering a span of time, for ingestion of metrics and logs. A range scan reads only the segments
+// overlapping the range, and documents older than the retention period are dropped by removing entire segment files
+// rather than document by document. Documents are appended and never updated or deleted individually; time series
+// collections have no IDs, indexes or hooks, and are not part of backups.
+
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/data"
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+const (
+	TIME_SERIES_CONFIG_FILE     = "ts-config.json" // Name of time series settings file, it tells a time series collection directory.
+	SEGMENT_FILE_PREFIX         = "seg_"           // Prefix of segment file name, followed by the segment start in Unix seconds.
+	TIME_SERIES_RETENTION_CHECK = time.Minute      // Interval of dropping segments beyond retention.
+)
+
+// TimeSeriesConfig consists of the settings of a time series collection.
+type TimeSeriesConfig struct {
+	TimePath  []string // TimePath is the path of document time, Unix seconds or RFC 3339 string.
+	Span      int      // Span is the number of seconds covered by each segment, it may not be changed.
+	Retention int      // Retention is the number of seconds documents are kept for (0 - forever).
+}
+
+// TimeSeries is a collection of documents stored by time.
+type TimeSeries struct {
+	db       *DB
+	name     string
+	conf     TimeSeriesConfig
+	lock     *sync.RWMutex        // Guard segments
+	segments map[int64]*tsSegment // Segments by start (Unix seconds)
+}
+
+// A segment of time series.
+type tsSegment struct {
+	lock    *sync.RWMutex // Appending takes write lock, scanning takes read lock
+	file    *data.Segment
+	dropped bool // Set once the file is closed
+}
+
+// A document found by range scan.
+type tsDoc struct {
+	nanos int64
+	doc   []byte
+}
+
+// Validate time series settings.
+func checkTimeSeriesConfig(conf TimeSeriesConfig) error {
+	if len(conf.TimePath) == 0 {
+		return dberr.New(dberr.ErrorInvalidParam, "time path", conf.TimePath)
+	} else if conf.Span <= 0 {
+		return dberr.New(dberr.ErrorInvalidParam, "segment span", conf.Span)
+	} else if conf.Retention < 0 {
+		return dberr.New(dberr.ErrorInvalidParam, "retention", conf.Retention)
+	}
+	return nil
+}
+
+// Open a time series collection and all of its segments.
+func openTimeSeries(db *DB, name string) (*TimeSeries, error) {
+	ts := &TimeSeries{db: db, name: name, lock: new(sync.RWMutex), segments: make(map[int64]*tsSegment)}
+	content, err := ioutil.ReadFile(path.Join(db.path, name, TIME_SERIES_CONFIG_FILE))
+	if err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(content, &ts.conf); err != nil {
+		return nil, err
+	} else if err = checkTimeSeriesConfig(ts.conf); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(path.Join(db.path, name))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), SEGMENT_FILE_PREFIX) {
+			continue
+		}
+		start, err := strconv.ParseInt(strings.TrimPrefix(file.Name(), SEGMENT_FILE_PREFIX), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg := &tsSegment{lock: new(sync.RWMutex)}
+		if seg.file, err = db.Config.OpenSegment(path.Join(db.path, name, file.Name())); err != nil {
+			ts.close()
+			return nil, err
+		}
+		ts.segments[start] = seg
+	}
+	return ts, nil
+}
+
+// Close all segment files. Does not place schema lock.
+func (ts *TimeSeries) close() error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	var errs []error
+	for start, seg := range ts.segments {
+		seg.lock.Lock()
+		if err := seg.file.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		seg.dropped = true
+		seg.lock.Unlock()
+		delete(ts.segments, start)
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// Create a new time series collection.
+func (db *DB) CreateTimeSeries(name string, conf TimeSeriesConfig) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	} else if err := checkTimeSeriesConfig(conf); err != nil {
+		return err
+	}
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	if _, exists := db.cols[name]; exists {
+		return dberr.New(dberr.ErrorColExists, name)
+	} else if _, exists := db.series[name]; exists {
+		return dberr.New(dberr.ErrorColExists, name)
+	}
+	content, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
+	} else if err = os.MkdirAll(path.Join(db.path, name), 0700); err != nil {
+		return err
+	} else if err = ioutil.WriteFile(path.Join(db.path, name, TIME_SERIES_CONFIG_FILE), content, 0600); err != nil {
+		os.RemoveAll(path.Join(db.path, name))
+		return err
+	}
+	db.series[name], err = openTimeSeries(db, name)
+	return err
+}
+
+// Use the return value to interact with time series collection. Return value may be nil if it does not exist.
+func (db *DB) UseTimeSeries(name string) *TimeSeries {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	return db.series[name]
+}
+
+// Return all time series collection names.
+func (db *DB) AllTimeSeries() (ret []string) {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	ret = make([]string, 0, len(db.series))
+	for name := range db.series {
+		ret = append(ret, name)
+	}
+	return
+}
+
+// Drop a time series collection and lose all of its documents. Does not place schema lock.
+func (db *DB) dropTimeSeries(name string) error {
+	if err := db.series[name].close(); err != nil {
+		return err
+	} else if err = os.RemoveAll(path.Join(db.path, name)); err != nil {
+		return err
+	}
+	delete(db.series, name)
+	return nil
+}
+
+// Return the settings of the time series collection.
+func (ts *TimeSeries) Config() TimeSeriesConfig {
+	ts.db.schemaLock.RLock()
+	defer ts.db.schemaLock.RUnlock()
+	conf := ts.conf
+	conf.TimePath = append([]string(nil), ts.conf.TimePath...)
+	return conf
+}
+
+// Change and persist the retention (in seconds, 0 - forever) of the time series collection.
+func (ts *TimeSeries) SetRetention(retention int) error {
+	if err := ts.db.checkWritable(); err != nil {
+		return err
+	} else if retention < 0 {
+		return dberr.New(dberr.ErrorInvalidParam, "retention", retention)
+	}
+	ts.db.schemaLock.Lock()
+	defer ts.db.schemaLock.Unlock()
+	conf := ts.conf
+	conf.Retention = retention
+	content, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
+	} else if err = ioutil.WriteFile(path.Join(ts.db.path, ts.name, TIME_SERIES_CONFIG_FILE), content, 0600); err != nil {
+		return err
+	}
+	ts.conf = conf
+	return nil
+}
+
+// Return the time of the document in Unix nanoseconds. Embedded usage may give the time as an int or time.Time as well.
+func docTime(doc map[string]interface{}, timePath []string) (nanos int64, err error) {
+	for _, val := range GetIn(doc, timePath) {
+		switch val := val.(type) {
+		case float64:
+			if val >= 0 {
+				return int64(val * 1e9), nil
+			}
+		case int:
+			if val >= 0 {
+				return int64(val) * int64(time.Second), nil
+			}
+		case time.Time:
+			if val.UnixNano() >= 0 {
+				return val.UnixNano(), nil
+			}
+		case string:
+			if t, err := time.Parse(time.RFC3339Nano, val); err == nil && t.UnixNano() >= 0 {
+				return t.UnixNano(), nil
+			}
+		}
+	}
+	return 0, dberr.New(dberr.ErrorInvalidParam, "document time", timePath)
+}
+
+// Insert a document into the time series collection. A document older than the retention period is refused.
+func (ts *TimeSeries) Insert(doc map[string]interface{}) error {
+	if err := ts.db.checkWritable(); err != nil {
+		return err
+	}
+	nanos, err := docTime(doc, ts.conf.TimePath)
+	if err != nil {
+		return err
+	}
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	ts.db.schemaLock.RLock()
+	if err = ts.db.checkDocLimits(docJS); err == nil {
+		err = ts.append(nanos, docJS)
+	}
+	ts.db.schemaLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	return ts.db.commitWrite()
+}
+
+// Append the document to the segment covering its time, the segment is created if necessary. Does not place schema
+// lock.
+func (ts *TimeSeries) append(nanos int64, docJS []byte) error {
+	span := int64(ts.conf.Span)
+	start := nanos / int64(time.Second) / span * span
+	if ts.conf.Retention > 0 && start+span <= time.Now().Unix()-int64(ts.conf.Retention) {
+		return dberr.New(dberr.ErrorInvalidParam, "time beyond retention", time.Unix(0, nanos).UTC())
+	}
+	ts.lock.RLock()
+	seg, exists := ts.segments[start]
+	ts.lock.RUnlock()
+	if !exists {
+		ts.lock.Lock()
+		if seg, exists = ts.segments[start]; !exists {
+			seg = &tsSegment{lock: new(sync.RWMutex)}
+			var err error
+			if seg.file, err = ts.db.Config.OpenSegment(path.Join(ts.db.path, ts.name, SEGMENT_FILE_PREFIX+strconv.FormatInt(start, 10))); err != nil {
+				ts.lock.Unlock()
+				return err
+			}
+			ts.segments[start] = seg
+		}
+		ts.lock.Unlock()
+	}
+	seg.lock.Lock()
+	defer seg.lock.Unlock()
+	if seg.dropped {
+		return dberr.New(dberr.ErrorInvalidParam, "time beyond retention", time.Unix(0, nanos).UTC())
+	}
+	return seg.file.Append(nanos, docJS)
+}
+
+// Return the segments overlapping the time range [from, to), ordered by time. Does not place schema lock.
+func (ts *TimeSeries) overlapping(from, to time.Time) (segs []*tsSegment) {
+	span := int64(ts.conf.Span)
+	ts.lock.RLock()
+	starts := make([]int64, 0, len(ts.segments))
+	for start := range ts.segments {
+		if start < to.Unix()+1 && start+span > from.Unix() {
+			starts = append(starts, start)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i] < starts[j]
+	})
+	for _, start := range starts {
+		segs = append(segs, ts.segments[start])
+	}
+	ts.lock.RUnlock()
+	return
+}
+
+// Do fun for the documents of the time range [from, to) in time order, stop when fun returns false. Only the
+// segments overlapping the range are read.
+func (ts *TimeSeries) Range(from, to time.Time, fun func(doc map[string]interface{}) (moveOn bool)) {
+	ts.db.schemaLock.RLock()
+	defer ts.db.schemaLock.RUnlock()
+	fromNanos, toNanos := from.UnixNano(), to.UnixNano()
+	for _, seg := range ts.overlapping(from, to) {
+		var docs []tsDoc
+		seg.lock.RLock()
+		if !seg.dropped {
+			seg.file.ForEachDoc(func(nanos int64, doc []byte) bool {
+				if nanos >= fromNanos && nanos < toNanos {
+					docs = append(docs, tsDoc{nanos: nanos, doc: append([]byte(nil), doc...)})
+				}
+				return true
+			})
+		}
+		seg.lock.RUnlock()
+		// Documents are appended in the order of arrival, which may differ from time order
+		sort.SliceStable(docs, func(i, j int) bool {
+			return docs[i].nanos < docs[j].nanos
+		})
+		for _, found := range docs {
+			var doc map[string]interface{}
+			if json.Unmarshal(found.doc, &doc) == nil && !fun(doc) {
+				return
+			}
+		}
+	}
+}
+
+// Drop the segments covering time entirely before the time, return the number of segments dropped.
+func (ts *TimeSeries) DropBefore(before time.Time) (dropped int, err error) {
+	if err = ts.db.checkWritable(); err != nil {
+		return
+	}
+	ts.db.schemaLock.RLock()
+	defer ts.db.schemaLock.RUnlock()
+	return ts.dropBefore(before.Unix())
+}
+
+// Drop the segments ending at or before the time (Unix seconds). Does not place schema lock.
+func (ts *TimeSeries) dropBefore(before int64) (dropped int, err error) {
+	span := int64(ts.conf.Span)
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	for start, seg := range ts.segments {
+		if start+span > before {
+			continue
+		}
+		seg.lock.Lock()
+		err = seg.file.Close()
+		seg.dropped = true
+		seg.lock.Unlock()
+		delete(ts.segments, start)
+		if err == nil {
+			err = os.Remove(seg.file.Path)
+		}
+		if err != nil {
+			return
+		}
+		dropped++
+	}
+	return
+}
+
+// Apply the current memory usage settings to all segment files. Does not place schema lock.
+func (ts *TimeSeries) applySettings() error {
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+	for _, seg := range ts.segments {
+		if err := seg.file.ApplySettings(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the segment files flushed by the background flush goroutine of the partition number. Does not place schema
+// lock.
+func (ts *TimeSeries) partFiles(partNum int) (files []*data.DataFile) {
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+	for start, seg := range ts.segments {
+		if int(start/int64(ts.conf.Span))%ts.db.numParts == partNum {
+			files = append(files, seg.file.DataFile)
+		}
+	}
+	return
+}
+
+// Start dropping the segments beyond retention of all time series collections, and removing the documents beyond
+// retention of all collections, in background.
+func (db *DB) startRetention() {
+	db.retentionStop = make(chan struct{})
+	db.retentionDone = make(chan struct{})
+	go func() {
+		defer close(db.retentionDone)
+		ticker := time.NewTicker(TIME_SERIES_RETENTION_CHECK)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.retentionStop:
+				return
+			case <-ticker.C:
+				db.applyRetention()
+			}
+		}
+	}()
+}
+
+// Stop dropping segments beyond retention, waiting for a round in progress to finish.
+func (db *DB) stopRetention() {
+	if db.retentionStop != nil {
+		close(db.retentionStop)
+		<-db.retentionDone
+		db.retentionStop = nil
+	}
+}
+
+// Drop the segments beyond retention of all time series collections, and remove the documents beyond retention of all
+// collections.
+func (db *DB) applyRetention() {
+	db.schemaLock.RLock()
+	now := time.Now().Unix()
+	for name, ts := range db.series {
+		if ts.conf.Retention == 0 {
+			continue
+		}
+		if dropped, err := ts.dropBefore(now - int64(ts.conf.Retention)); err != nil {
+			tdlog.CritNoRepeat("Failed to drop segments of %s beyond retention: %v", name, err)
+		} else if dropped > 0 {
+			tdlog.Infof("Dropped %d segments of %s beyond retention", dropped, name)
+		}
+	}
+	var retained []*Col
+	for _, col := range db.cols {
+		if col.conf.Retention > 0 {
+			retained = append(retained, col)
+		}
+	}
+	db.schemaLock.RUnlock()
+	if db.checkWritable() != nil {
+		return
+	}
+	for _, col := range retained {
+		if removed, err := col.ApplyRetention(); err != nil {
+			tdlog.CritNoRepeat("Failed to remove documents of %s beyond retention: %v", col.name, err)
+		} else if removed > 0 {
+			tdlog.Infof("Removed %d documents of %s beyond retention", removed, col.name)
+		}
+	}
+}
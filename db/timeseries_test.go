@@ -0,0 +1,115 @@
+package db
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Return the values of attribute "v" of the documents in the time range.
+func rangeValues(ts *TimeSeries, from, to int64) (vals []float64) {
+	ts.Range(time.Unix(from, 0), time.Unix(to, 0), func(doc map[string]interface{}) bool {
+		vals = append(vals, doc["v"].(float64))
+		return true
+	})
+	return
+}
+
+func TestTimeSeries(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+	}()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	conf := TimeSeriesConfig{TimePath: []string{"t"}, Span: 3600}
+	if err = db.CreateTimeSeries("metrics", TimeSeriesConfig{TimePath: []string{"t"}}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if err = db.CreateTimeSeries("col", conf); dberr.Type(err) != dberr.ErrorColExists {
+		t.Fatal(err)
+	} else if err = db.CreateTimeSeries("metrics", conf); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("metrics"); dberr.Type(err) != dberr.ErrorColExists {
+		t.Fatal(err)
+	}
+	ts := db.UseTimeSeries("metrics")
+	// Documents arrive out of order, in three segments
+	base := int64(1600000000 / 3600 * 3600)
+	for i, offset := range []int64{7200, 10, 3600, 0, 7300, 3599} {
+		if err = ts.Insert(map[string]interface{}{"t": float64(base + offset), "v": float64(offset)}); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if err = ts.Insert(map[string]interface{}{"t": time.Unix(base+20, 0).UTC().Format(time.RFC3339), "v": float64(20)}); err != nil {
+		t.Fatal(err)
+	} else if err = ts.Insert(map[string]interface{}{"v": 1}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+	// Range scans read the overlapping segments only, and find documents in time order
+	if segs := ts.overlapping(time.Unix(base+3600, 0), time.Unix(base+7200, 0)); len(segs) != 2 {
+		t.Fatal(len(segs))
+	}
+	if vals := rangeValues(ts, base, base+7300); len(vals) != 6 || vals[0] != 0 || vals[1] != 10 || vals[2] != 20 || vals[3] != 3599 || vals[4] != 3600 || vals[5] != 7200 {
+		t.Fatal(vals)
+	} else if vals = rangeValues(ts, base+3599, base+3601); len(vals) != 2 || vals[0] != 3599 || vals[1] != 3600 {
+		t.Fatal(vals)
+	}
+	stopped := 0
+	ts.Range(time.Unix(base, 0), time.Unix(base+8000, 0), func(doc map[string]interface{}) bool {
+		stopped++
+		return stopped < 2
+	})
+	if stopped != 2 {
+		t.Fatal(stopped)
+	}
+	// The time series remains after reopening
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	} else if db.ColExists("metrics") || len(db.AllTimeSeries()) != 1 {
+		t.Fatal(db.AllCols(), db.AllTimeSeries())
+	}
+	ts = db.UseTimeSeries("metrics")
+	if vals := rangeValues(ts, base, base+8000); len(vals) != 7 {
+		t.Fatal(vals)
+	}
+	// Segments are dropped entirely
+	if dropped, err := ts.DropBefore(time.Unix(base+3600, 0)); err != nil || dropped != 1 {
+		t.Fatal(dropped, err)
+	} else if vals := rangeValues(ts, base, base+8000); len(vals) != 3 || vals[0] != 3600 {
+		t.Fatal(vals)
+	} else if _, err = os.Stat(path.Join(TEST_DATA_DIR, "metrics", SEGMENT_FILE_PREFIX+"1599998400")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	// Documents beyond retention are refused and dropped
+	if err = ts.SetRetention(86400); err != nil {
+		t.Fatal(err)
+	} else if err = ts.Insert(map[string]interface{}{"t": float64(base), "v": 1}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if err = ts.Insert(map[string]interface{}{"t": int(time.Now().Unix()), "v": float64(-1)}); err != nil {
+		t.Fatal(err)
+	}
+	db.applyRetention()
+	if vals := rangeValues(ts, 0, time.Now().Unix()+1); len(vals) != 1 || vals[0] != -1 {
+		t.Fatal(vals)
+	} else if ts.Config().Retention != 86400 {
+		t.Fatal(ts.Config())
+	}
+	if err = db.Drop("metrics"); err != nil {
+		t.Fatal(err)
+	} else if db.UseTimeSeries("metrics") != nil {
+		t.Fatal("not dropped")
+	} else if _, err = os.Stat(path.Join(TEST_DATA_DIR, "metrics")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
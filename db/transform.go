@@ -0,0 +1,170 @@
+// Rewriting all documents of a collection.
+//
+// A transformation rewrites every document of a collection by a function, for mass schema changes such as renaming an
+// attribute or changing its type. The documents to rewrite are those of the collection as the transformation starts;
+// they are rewritten in batches of ascending document ID within each partition, each document like UpdateBytesFunc
+// does, so that indexes follow the rewritten documents. After each batch, progress is reported and saved to a
+// checkpoint file in the collection directory. A transformation interrupted by a crash or by closing the database
+// resumes after its last saved batch by ResumeTransform, which must be given the same function. The checkpoint is
+// removed once the transformation finishes.
+//
+// Documents inserted or updated by others during the transformation are not rewritten unless their partition is yet
+// to be transformed, so that writers should write documents of the new schema by then.
+
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+const (
+	TRANSFORM_CHECKPOINT_FILE = "transform-checkpoint.json" // Name of interrupted transformation's checkpoint file in collection directory.
+	TRANSFORM_BATCH_SIZE      = 1000                        // Number of documents rewritten between checkpoints.
+)
+
+// Progress of a transformation.
+type TransformProgress struct {
+	Docs        int    `json:"docs"`                  // Number of documents to transform
+	Rewritten   int    `json:"rewritten"`             // Number of documents rewritten so far
+	Unchanged   int    `json:"unchanged"`             // Number of documents left alone by the function
+	Skipped     int    `json:"skipped"`               // Number of documents that no longer exist
+	Failed      int    `json:"failed"`                // Number of documents that could not be rewritten
+	FirstErr    string `json:"first_error,omitempty"` // Error of the first failed document
+	Batches     int    `json:"batches"`               // Total number of batches
+	BatchesDone int    `json:"batches_done"`          // Number of batches done so far
+	Finished    bool   `json:"finished"`              // True once all batches are done
+}
+
+// Saved position of a transformation, following its last done batch.
+type transformCheckpoint struct {
+	Partition int               `json:"partition"` // Partition of the last done batch
+	After     int               `json:"after"`     // Last document ID of the batch
+	Progress  TransformProgress `json:"progress"`
+}
+
+// Returned by the update function of a document left alone.
+var errTransformUnchanged = errors.New("document is unchanged")
+
+// Rewrite every document of the collection by the function, which returns the new document and true, or false to leave
+// the document alone. Like UpdateBytesFunc, the function may modify the buffer it is given and may be called again for
+// the same document. The progress function (optional) is called after each batch. An earlier transformation that was
+// interrupted is abandoned.
+func (col *Col) Transform(fun func(old []byte) (doc []byte, changed bool), progress func(TransformProgress)) (TransformProgress, error) {
+	if err := os.Remove(col.transformCheckpointPath()); err != nil && !os.IsNotExist(err) {
+		return TransformProgress{}, err
+	}
+	return col.transform(transformCheckpoint{Partition: -1}, fun, progress)
+}
+
+// Resume the interrupted transformation after its last done batch, see Transform. The progress carries on from the
+// interruption. Fail with ErrorMissing if there is no interrupted transformation.
+func (col *Col) ResumeTransform(fun func(old []byte) (doc []byte, changed bool), progress func(TransformProgress)) (TransformProgress, error) {
+	content, err := ioutil.ReadFile(col.transformCheckpointPath())
+	if os.IsNotExist(err) {
+		return TransformProgress{}, dberr.New(dberr.ErrorMissing, "transform checkpoint")
+	} else if err != nil {
+		return TransformProgress{}, err
+	}
+	var checkpoint transformCheckpoint
+	if err = json.Unmarshal(content, &checkpoint); err != nil {
+		return TransformProgress{}, dberr.New(dberr.ErrorInvalidJSON, string(content), "of transform checkpoint")
+	}
+	return col.transform(checkpoint, fun, progress)
+}
+
+// Return the path of the checkpoint file.
+func (col *Col) transformCheckpointPath() string {
+	return path.Join(col.db.path, col.name, TRANSFORM_CHECKPOINT_FILE)
+}
+
+// Replace the checkpoint file, so that a crash leaves either the previous or the new checkpoint.
+func (col *Col) saveTransformCheckpoint(checkpoint transformCheckpoint) error {
+	content, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	tmpPath := col.transformCheckpointPath() + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, col.transformCheckpointPath())
+}
+
+// Rewrite the documents following the checkpoint.
+func (col *Col) transform(checkpoint transformCheckpoint, fun func(old []byte) ([]byte, bool), progress func(TransformProgress)) (prog TransformProgress, err error) {
+	prog = checkpoint.Progress
+	prog.Docs = prog.Rewritten + prog.Unchanged + prog.Skipped + prog.Failed
+	prog.Batches = prog.BatchesDone
+	// Find the documents to rewrite, in ascending order of ID within each partition
+	col.db.schemaLock.RLock()
+	partIDs := make([][]int, col.db.numParts)
+	for partNum, part := range col.parts {
+		if partNum < checkpoint.Partition {
+			continue
+		}
+		part.DataLock.RLock()
+		ids, _ := part.Snapshot()
+		part.DataLock.RUnlock()
+		sort.Ints(ids)
+		if partNum == checkpoint.Partition {
+			ids = ids[sort.SearchInts(ids, checkpoint.After+1):]
+		}
+		partIDs[partNum] = ids
+		prog.Docs += len(ids)
+		prog.Batches += (len(ids) + TRANSFORM_BATCH_SIZE - 1) / TRANSFORM_BATCH_SIZE
+	}
+	col.db.schemaLock.RUnlock()
+	for partNum, ids := range partIDs {
+		for len(ids) > 0 {
+			batch := ids
+			if len(batch) > TRANSFORM_BATCH_SIZE {
+				batch = batch[:TRANSFORM_BATCH_SIZE]
+			}
+			ids = ids[len(batch):]
+			for _, id := range batch {
+				err := col.UpdateBytesFunc(id, func(old []byte) ([]byte, error) {
+					if doc, changed := fun(old); changed {
+						return doc, nil
+					}
+					return nil, errTransformUnchanged
+				})
+				switch {
+				case err == nil:
+					prog.Rewritten++
+				case err == errTransformUnchanged:
+					prog.Unchanged++
+				case dberr.Type(err) == dberr.ErrorNoDoc:
+					prog.Skipped++
+				default:
+					if prog.Failed == 0 {
+						prog.FirstErr = err.Error()
+					}
+					prog.Failed++
+				}
+			}
+			prog.BatchesDone++
+			prog.Finished = prog.BatchesDone == prog.Batches
+			if !prog.Finished {
+				checkpoint = transformCheckpoint{Partition: partNum, After: batch[len(batch)-1], Progress: prog}
+				if err = col.saveTransformCheckpoint(checkpoint); err != nil {
+					return
+				}
+			}
+			if progress != nil {
+				progress(prog)
+			}
+		}
+	}
+	prog.Finished = true
+	if err = os.Remove(col.transformCheckpointPath()); os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
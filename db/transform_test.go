@@ -0,0 +1,88 @@
+package db
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestTransform(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"num"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 10)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"n": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Rename the attribute of even numbers
+	reports := 0
+	prog, err := col.Transform(func(old []byte) ([]byte, bool) {
+		var doc map[string]interface{}
+		if json.Unmarshal(old, &doc) != nil || int(doc["n"].(float64))%2 != 0 {
+			return nil, false
+		}
+		doc["num"] = doc["n"]
+		delete(doc, "n")
+		newDoc, _ := json.Marshal(doc)
+		return newDoc, true
+	}, func(TransformProgress) { reports++ })
+	if err != nil || prog.Docs != 10 || prog.Rewritten != 5 || prog.Unchanged != 5 || !prog.Finished || reports != prog.Batches {
+		t.Fatal(prog, reports, err)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"int-from": 0, "int-to": 9, "in": []interface{}{"num"}}, col, &result); err != nil || len(result) != 5 {
+		t.Fatal(result, err)
+	} else if _, err = os.Stat(col.transformCheckpointPath()); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	// Resuming an interrupted transformation rewrites the documents following the checkpoint
+	if _, err = col.ResumeTransform(nil, nil); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	}
+	checkpoint := transformCheckpoint{Partition: ids[0] % db.numParts, After: ids[0], Progress: TransformProgress{Rewritten: 3, BatchesDone: 1}}
+	if err = col.saveTransformCheckpoint(checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	following := 0
+	for _, id := range ids {
+		if part := id % db.numParts; part > checkpoint.Partition || part == checkpoint.Partition && id > checkpoint.After {
+			following++
+		}
+	}
+	mark := func(old []byte) ([]byte, bool) {
+		var doc map[string]interface{}
+		json.Unmarshal(old, &doc)
+		doc["marked"] = true
+		newDoc, _ := json.Marshal(doc)
+		return newDoc, true
+	}
+	if prog, err = col.ResumeTransform(mark, nil); err != nil || prog.Rewritten != 3+following || prog.Docs != 3+following || !prog.Finished {
+		t.Fatal(prog, following, err)
+	}
+	marked := 0
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		var decoded map[string]interface{}
+		if json.Unmarshal(doc, &decoded) == nil && decoded["marked"] == true {
+			marked++
+		}
+		return true
+	})
+	if marked != following {
+		t.Fatal(marked, following)
+	}
+}
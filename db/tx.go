@@ -0,0 +1,228 @@
+// Transactions across collections.
+//
+// A transaction applies a list of writes - inserts, updates and deletes of documents in any collections - all or
+// nothing, using two-phase commit with the system collection TX_COL as its log. The documents are first locked (see
+// DocLocks) and the transaction is prepared: a record of it, holding the IDs chosen for the inserted documents and the
+// original of every updated and deleted document, is inserted into TX_COL and flushed to disk. Then the writes are
+// applied, and deleting the record commits the transaction. Should a write fail, the writes are undone from the record
+// and the record is deleted. A record found when the database is opened belongs to a transaction interrupted by a
+// crash, which is rolled back.
+//
+// Transactions are atomic but not isolated: readers may see the writes of a transaction in progress, and writers that
+// do not lock the documents may interleave with them.
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+const (
+	TX_COL          = "_transactions"  // Name of the system collection recording prepared transactions.
+	TX_LOCK_TIMEOUT = 10 * time.Second // Time a transaction waits for a document locked by another set.
+)
+
+// Writes of a transaction.
+const (
+	TX_INSERT = "insert"
+	TX_UPDATE = "update"
+	TX_DELETE = "delete"
+)
+
+// TxWrite is a write of a transaction.
+type TxWrite struct {
+	Op  string                 // TX_INSERT, TX_UPDATE or TX_DELETE
+	Col string                 // Collection of the document
+	ID  int                    // Document to update or delete
+	Doc map[string]interface{} // Document to insert, or the updated document
+}
+
+// A write as recorded in a prepared transaction. The IDs are kept in strings, as JSON numbers would round them.
+type txRecordWrite struct {
+	Op       string                 `json:"op"`
+	Col      string                 `json:"col"`
+	ID       int                    `json:"id,string"` // ID of the written document, chosen before insert
+	Original map[string]interface{} `json:"original"`  // Document before update or delete
+}
+
+// A prepared transaction.
+type txRecord struct {
+	Time   int64           `json:"time"` // Unix seconds the transaction was prepared
+	Writes []txRecordWrite `json:"writes"`
+}
+
+// Apply the writes all or nothing, return the IDs of the written documents in the order of writes. Fail with
+// ErrorLockTimeout or ErrorDeadlock if a document remains locked by another set, in which case nothing is written and
+// the caller may retry.
+func (db *DB) Transact(writes []TxWrite) (ids []int, err error) {
+	if err = db.checkWritable(); err != nil {
+		return
+	} else if len(writes) == 0 {
+		return nil, dberr.New(dberr.ErrorMissing, "writes")
+	}
+	rec := txRecord{Time: time.Now().Unix(), Writes: make([]txRecordWrite, len(writes))}
+	cols := make([]*Col, len(writes))
+	for i, write := range writes {
+		if cols[i] = db.Use(write.Col); cols[i] == nil || write.Col == TX_COL {
+			return nil, dberr.New(dberr.ErrorNoCol, write.Col)
+		}
+		rec.Writes[i] = txRecordWrite{Op: write.Op, Col: write.Col, ID: write.ID}
+		switch write.Op {
+		case TX_INSERT:
+			rec.Writes[i].ID = rand.Int()
+			fallthrough
+		case TX_UPDATE:
+			if write.Doc == nil {
+				return nil, dberr.New(dberr.ErrorMissing, "document")
+			}
+		case TX_DELETE:
+		default:
+			return nil, dberr.New(dberr.ErrorInvalidParam, "write", write.Op)
+		}
+	}
+	// Lock the documents and remember their originals
+	locks := &DocLocks{db: db, timeout: TX_LOCK_TIMEOUT}
+	defer locks.Unlock()
+	for i, write := range rec.Writes {
+		if err = locks.Lock(cols[i], write.ID); err != nil {
+			return
+		}
+	}
+	for i, write := range rec.Writes {
+		if write.Op != TX_INSERT {
+			if rec.Writes[i].Original, err = cols[i].Read(write.ID); err != nil {
+				return
+			}
+		}
+	}
+	// Prepare
+	txCol, err := db.txCol()
+	if err != nil {
+		return
+	}
+	recID, err := db.insertTxRecord(txCol, rec)
+	if err != nil {
+		return
+	} else if err = db.Flush(); err != nil {
+		db.endTx(txCol, recID, rec)
+		return
+	}
+	// Write, and commit by deleting the record
+	ids = make([]int, len(writes))
+	for i, write := range writes {
+		ids[i] = rec.Writes[i].ID
+		switch write.Op {
+		case TX_INSERT:
+			_, err = cols[i].insertTx(ids[i], write.Doc)
+		case TX_UPDATE:
+			err = cols[i].Update(ids[i], write.Doc)
+		case TX_DELETE:
+			err = cols[i].Delete(ids[i])
+		}
+		if err != nil {
+			db.endTx(txCol, recID, rec)
+			return nil, err
+		}
+	}
+	if err = txCol.Delete(recID); err != nil {
+		// The writes are done, the record is rolled back the next time the database is opened
+		tdlog.Noticef("Failed to commit transaction %d: %v", recID, err)
+	}
+	return
+}
+
+// Return the transaction log collection, create it if it does not exist yet.
+func (db *DB) txCol() (*Col, error) {
+	if col := db.Use(TX_COL); col != nil {
+		return col, nil
+	}
+	if err := db.Create(TX_COL); err != nil && dberr.Type(err) != dberr.ErrorColExists {
+		return nil, err
+	}
+	return db.Use(TX_COL), nil
+}
+
+// Insert the record of a prepared transaction, return its document ID.
+func (db *DB) insertTxRecord(txCol *Col, rec txRecord) (int, error) {
+	recJS, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	var doc map[string]interface{}
+	if err = json.Unmarshal(recJS, &doc); err != nil {
+		return 0, err
+	}
+	return txCol.Insert(doc)
+}
+
+// Insert a document of a transaction under the chosen ID, checking its string ID like Insert does.
+func (col *Col) insertTx(id int, doc map[string]interface{}) (int, error) {
+	strID, hasStrID := doc[STR_ID_ATTR].(string)
+	if !hasStrID {
+		return col.insertWithID(context.Background(), id, doc, func() {})
+	}
+	unlock := col.lockStrID(strID)
+	defer unlock()
+	col.db.schemaLock.RLock()
+	_, exists := col.strIDLookup(strID)
+	col.db.schemaLock.RUnlock()
+	if exists {
+		return 0, dberr.New(dberr.ErrorDupStrID, strID)
+	}
+	return col.insertWithID(context.Background(), id, doc, unlock)
+}
+
+// Undo the writes of the transaction in reverse order, whether or not they were applied, and delete its record. The
+// record is kept if undoing fails, so that the transaction is rolled back again when the database is next opened.
+func (db *DB) endTx(txCol *Col, recID int, rec txRecord) {
+	for i := len(rec.Writes) - 1; i >= 0; i-- {
+		write := rec.Writes[i]
+		col := db.Use(write.Col)
+		if col == nil {
+			continue
+		}
+		var err error
+		if write.Op == TX_INSERT {
+			if err = col.Delete(write.ID); dberr.Type(err) == dberr.ErrorNoDoc {
+				err = nil
+			}
+		} else if err = col.Update(write.ID, write.Original); dberr.Type(err) == dberr.ErrorNoDoc {
+			_, err = col.insertTx(write.ID, write.Original)
+		}
+		if err != nil {
+			tdlog.Noticef("Failed to roll back transaction %d in collection %s: %v", recID, write.Col, err)
+			return
+		}
+	}
+	if err := txCol.Delete(recID); err != nil {
+		tdlog.Noticef("Failed to delete rolled back transaction %d: %v", recID, err)
+	}
+}
+
+// Roll back the transactions left prepared by a crash.
+func (db *DB) recoverTransactions() {
+	txCol := db.Use(TX_COL)
+	if txCol == nil {
+		return
+	}
+	recs := make(map[int]txRecord)
+	txCol.ForEachDoc(func(id int, doc []byte) bool {
+		var rec txRecord
+		if err := json.Unmarshal(doc, &rec); err != nil {
+			tdlog.Noticef("Transaction %d has a malformed record: %v", id, err)
+		} else {
+			recs[id] = rec
+		}
+		return true
+	})
+	for recID, rec := range recs {
+		tdlog.Noticef("Rolling back transaction %d prepared at %s", recID, time.Unix(rec.Time, 0))
+		db.endTx(txCol, recID, rec)
+	}
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestTransact(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("orders"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("stock"); err != nil {
+		t.Fatal(err)
+	}
+	orders, stock := db.Use("orders"), db.Use("stock")
+	item, err := stock.Insert(map[string]interface{}{"_id": "apple", "left": 10.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone, err := stock.Insert(map[string]interface{}{"left": 0.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Transact(nil); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	} else if _, err = db.Transact([]TxWrite{{Op: "upsert", Col: "stock", ID: item}}); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if _, err = db.Transact([]TxWrite{{Op: TX_DELETE, Col: "nope", ID: item}}); dberr.Type(err) != dberr.ErrorNoCol {
+		t.Fatal(err)
+	} else if _, err = db.Transact([]TxWrite{{Op: TX_DELETE, Col: "stock", ID: 1}}); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	// The writes of a transaction are applied together
+	ids, err := db.Transact([]TxWrite{
+		{Op: TX_INSERT, Col: "orders", Doc: map[string]interface{}{"item": "apple"}},
+		{Op: TX_UPDATE, Col: "stock", ID: item, Doc: map[string]interface{}{"_id": "apple", "left": 9.0}},
+		{Op: TX_DELETE, Col: "stock", ID: gone},
+	})
+	if err != nil || len(ids) != 3 || ids[1] != item || ids[2] != gone {
+		t.Fatal(ids, err)
+	} else if order, err := orders.Read(ids[0]); err != nil || order["item"] != "apple" {
+		t.Fatal(order, err)
+	} else if doc, err := stock.Read(item); err != nil || doc["left"] != 9.0 || doc[STR_ID_ATTR] != "apple" {
+		t.Fatal(doc, err)
+	} else if _, err = stock.Read(gone); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if db.Use(TX_COL).Count() != 0 {
+		t.Fatal(db.Use(TX_COL).Count())
+	}
+	// A failed write undoes the writes before it
+	_, err = db.Transact([]TxWrite{
+		{Op: TX_INSERT, Col: "orders", Doc: map[string]interface{}{"item": "apple"}},
+		{Op: TX_UPDATE, Col: "stock", ID: item, Doc: map[string]interface{}{"_id": "apple", "left": 8.0}},
+		{Op: TX_DELETE, Col: "orders", ID: ids[0]},
+		{Op: TX_INSERT, Col: "stock", Doc: map[string]interface{}{"_id": "apple"}},
+	})
+	if dberr.Type(err) != dberr.ErrorDupStrID {
+		t.Fatal(err)
+	} else if orders.Count() != 1 || stock.Count() != 1 || db.Use(TX_COL).Count() != 0 {
+		t.Fatal(orders.Count(), stock.Count(), db.Use(TX_COL).Count())
+	} else if doc, err := stock.ReadStrID("apple"); err != nil || doc["left"] != 9.0 {
+		t.Fatal(doc, err)
+	} else if _, err = orders.Read(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	// A transaction interrupted by a crash is rolled back when the database is opened
+	rec := txRecord{Time: time.Now().Unix(), Writes: []txRecordWrite{
+		{Op: TX_UPDATE, Col: "stock", ID: item, Original: map[string]interface{}{"_id": "apple", "left": 9.0}},
+		{Op: TX_INSERT, Col: "orders", ID: 12345},
+		{Op: TX_DELETE, Col: "orders", ID: ids[0], Original: map[string]interface{}{"item": "apple"}},
+	}}
+	if _, err = db.insertTxRecord(db.Use(TX_COL), rec); err != nil {
+		t.Fatal(err)
+	} else if err = stock.Update(item, map[string]interface{}{"left": 1.0}); err != nil {
+		t.Fatal(err)
+	} else if _, err = orders.insertTx(12345, map[string]interface{}{"item": "pear"}); err != nil {
+		t.Fatal(err)
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	orders, stock = db.Use("orders"), db.Use("stock")
+	if doc, err := stock.ReadStrID("apple"); err != nil || doc["left"] != 9.0 {
+		t.Fatal(doc, err)
+	} else if _, err = orders.Read(12345); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	} else if order, err := orders.Read(ids[0]); err != nil || order["item"] != "apple" {
+		t.Fatal(order, err)
+	} else if db.Use(TX_COL).Count() != 0 {
+		t.Fatal(db.Use(TX_COL).Count())
+	}
+}
@@ -0,0 +1,146 @@
+// Typed collections.
+//
+// Typed wraps a collection whose documents are values of a Go type, so that embedding programs read and write the
+// values rather than generic maps. Values convert to and from documents by the rules of encoding/json, including the
+// "json" struct tags. A struct field tagged `tiedot:"index"` declares an index on the path of its JSON names, e.g. field
+// City of field Address declares index ["address", "city"]; fields of nested structs, pointers to them and slices of
+// them are declared likewise. NewTyped creates the declared indexes that do not exist yet; RegisterSchema has them
+// created whenever the database is opened.
+
+package db
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Typed is a collection of documents of type T, a struct or a map keyed by strings.
+type Typed[T any] struct {
+	col *Col
+}
+
+// Return the typed wrapper of the collection, after creating the indexes declared by struct tags of T.
+func NewTyped[T any](col *Col) (*Typed[T], error) {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct && (typ.Kind() != reflect.Map || typ.Key().Kind() != reflect.String) {
+		return nil, dberr.New(dberr.ErrorInvalidParam, "document type", typ)
+	}
+	if err := col.ensureIndexes(taggedIndexes(typ, nil, make(map[reflect.Type]bool))); err != nil {
+		return nil, err
+	}
+	return &Typed[T]{col: col}, nil
+}
+
+// Return the index paths declared by the fields of the struct type and its nested structs, prefixed by the path.
+func taggedIndexes(typ reflect.Type, prefix []string, visited map[reflect.Type]bool) (idxPaths [][]string) {
+	for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct || visited[typ] {
+		return
+	}
+	// A type referring to itself declares its indexes once
+	visited[typ] = true
+	defer delete(visited, typ)
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() && !field.Anonymous {
+			continue
+		} else if name == "" && field.Anonymous {
+			// Fields of an embedded struct are promoted into the document
+			idxPaths = append(idxPaths, taggedIndexes(field.Type, prefix, visited)...)
+			continue
+		} else if name == "" {
+			name = field.Name
+		}
+		path := append(append([]string(nil), prefix...), name)
+		if field.Tag.Get("tiedot") == "index" {
+			idxPaths = append(idxPaths, path)
+		}
+		idxPaths = append(idxPaths, taggedIndexes(field.Type, path, visited)...)
+	}
+	return
+}
+
+// Return the collection holding the documents.
+func (typed *Typed[T]) Col() *Col {
+	return typed.col
+}
+
+// Convert the value into a document.
+func toDoc(value interface{}) (doc map[string]interface{}, err error) {
+	docJS, err := json.Marshal(value)
+	if err != nil {
+		return
+	} else if err = json.Unmarshal(docJS, &doc); err == nil && doc == nil {
+		err = dberr.New(dberr.ErrorMissing, "document")
+	}
+	return
+}
+
+// Insert the value as a document, see Col.Insert. Return the new document ID.
+func (typed *Typed[T]) Insert(value T) (id int, err error) {
+	doc, err := toDoc(value)
+	if err != nil {
+		return
+	}
+	return typed.col.Insert(doc)
+}
+
+// Return the document of the ID as a value.
+func (typed *Typed[T]) Read(id int) (value T, err error) {
+	viewErr := typed.col.ReadView(id, func(doc []byte) {
+		err = json.Unmarshal(doc, &value)
+	})
+	if viewErr != nil {
+		err = viewErr
+	}
+	return
+}
+
+// Replace the document of the ID by the value, see Col.Update.
+func (typed *Typed[T]) Update(id int, value T) error {
+	doc, err := toDoc(value)
+	if err != nil {
+		return err
+	}
+	return typed.col.Update(id, doc)
+}
+
+// Delete the document of the ID, see Col.Delete.
+func (typed *Typed[T]) Delete(id int) error {
+	return typed.col.Delete(id)
+}
+
+// Evaluate the query and return the matching documents as values, in ascending order of document ID. Documents
+// deleted after the query was evaluated are left out.
+func (typed *Typed[T]) Query(q interface{}) (values []T, err error) {
+	result := make(map[int]struct{})
+	if err = EvalQuery(q, typed.col, &result); err != nil {
+		return
+	}
+	ids := make([]int, 0, len(result))
+	for id := range result {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	values = make([]T, 0, len(ids))
+	for _, id := range ids {
+		value, err := typed.Read(id)
+		if dberr.Type(err) == dberr.ErrorNoDoc {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
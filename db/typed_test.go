@@ -0,0 +1,86 @@
+package db
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+type typedAddress struct {
+	City string `json:"city" tiedot:"index"`
+}
+
+type typedPerson struct {
+	Name    string          `json:"name" tiedot:"index"`
+	Age     int             `json:"age,omitempty"`
+	Address typedAddress    `json:"address"`
+	Former  []*typedAddress `json:"former,omitempty"`
+	Friends []typedPerson   `json:"-"`
+	secret  string
+}
+
+func TestTyped(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("people"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewTyped[int](db.Use("people")); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+	people, err := NewTyped[typedPerson](db.Use("people"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Indexes are declared once
+	if _, err = NewTyped[*typedPerson](db.Use("people")); err != nil {
+		t.Fatal(err)
+	} else if indexes := people.Col().AllIndexes(); len(indexes) != 3 {
+		t.Fatal(indexes)
+	}
+	ann := typedPerson{Name: "ann", Age: 30, Address: typedAddress{City: "Oslo"}, secret: "x"}
+	annID, err := people.Insert(ann)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobID, err := people.Insert(typedPerson{Name: "bob", Address: typedAddress{City: "Oslo"}, Former: []*typedAddress{{City: "Rome"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ann.secret = ""
+	if read, err := people.Read(annID); err != nil || !reflect.DeepEqual(read, ann) {
+		t.Fatal(read, err)
+	} else if _, err = people.Read(-1); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	found, err := people.Query(map[string]interface{}{"eq": "Oslo", "in": []interface{}{"address", "city"}})
+	if err != nil || len(found) != 2 {
+		t.Fatal(found, err)
+	}
+	if found, err = people.Query(map[string]interface{}{"eq": "Rome", "in": []interface{}{"former", "city"}}); err != nil || len(found) != 1 || found[0].Name != "bob" {
+		t.Fatal(found, err)
+	}
+	ann.Age = 31
+	if err = people.Update(annID, ann); err != nil {
+		t.Fatal(err)
+	} else if read, err := people.Read(annID); err != nil || read.Age != 31 {
+		t.Fatal(read, err)
+	} else if err = people.Delete(bobID); err != nil {
+		t.Fatal(err)
+	} else if found, err = people.Query("all"); err != nil || len(found) != 1 {
+		t.Fatal(found, err)
+	}
+	// Nil maps are not documents
+	if byMap, err := NewTyped[map[string]interface{}](db.Use("people")); err != nil {
+		t.Fatal(err)
+	} else if _, err = byMap.Insert(nil); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,375 @@
+// Materialized views.
+//
+// A view is a collection holding the documents of a source collection that match a query, optionally projected onto
+// a few paths. The view is populated when it is created, and from then on maintained incrementally by hooks on the
+// source collection: each inserted/updated/deleted source document is read again, matched against the query and put
+// into or removed from the view. Refreshes of a view document are serialised, and each reads the source document as it
+// is at the time, so that concurrent mutations leave the view with the latest source document. View documents share
+// the document IDs of their source documents. The view definition is kept in the view
+// collection directory; a view should not be modified other than by its source.
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+const (
+	VIEW_DEF_FILE = "view.json" // Name of view definition file in view collection directory.
+)
+
+// ViewDef defines a materialized view.
+type ViewDef struct {
+	Source string      // Name of the source collection
+	Query  interface{} // Source documents matching the query are in the view; result limits are not applied
+	Fields [][]string  // Paths projected into view documents, the entire source documents are in the view if empty
+}
+
+// A view maintained by hooks on its source collection.
+type view struct {
+	name        string // Name of the view collection, changes upon rename
+	def         ViewDef
+	removeHooks func()
+	refreshLock []*sync.Mutex // Serialise refreshes of view documents, documents share the locks by ID
+}
+
+func newView(db *DB, name string, def ViewDef) *view {
+	v := &view{name: name, def: def, refreshLock: make([]*sync.Mutex, db.numParts)}
+	for i := range v.refreshLock {
+		v.refreshLock[i] = new(sync.Mutex)
+	}
+	return v
+}
+
+// Create a view collection, populate it with the source documents matching the query, and maintain it from then on.
+func (db *DB) CreateView(name string, def ViewDef) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	db.schemaLock.Lock()
+	src, exists := db.cols[def.Source]
+	if !exists {
+		db.schemaLock.Unlock()
+		return dberr.New(dberr.ErrorNoCol, def.Source)
+	} else if name == def.Source {
+		db.schemaLock.Unlock()
+		return dberr.New(dberr.ErrorColExists, name)
+	} else if _, err := src.checkedPlan(def.Query); err != nil {
+		db.schemaLock.Unlock()
+		return err
+	} else if err := db.create(name); err != nil {
+		db.schemaLock.Unlock()
+		return err
+	}
+	v := newView(db, name, def)
+	if err := v.save(db); err != nil {
+		db.drop(name)
+		db.schemaLock.Unlock()
+		return err
+	}
+	// Mutations made during population are applied by the hooks
+	db.maintainView(v, src)
+	db.schemaLock.Unlock()
+	result := make(map[int]struct{})
+	if err := EvalQuery(def.Query, src, &result); err != nil {
+		// Do not leave a half-built view behind, unless it was dropped or replaced meanwhile
+		db.schemaLock.Lock()
+		if db.views[v.name] == v {
+			if dropErr := db.drop(v.name); dropErr != nil {
+				tdlog.Noticef("Failed to drop view %s after failing to populate it: %v", v.name, dropErr)
+			}
+		}
+		db.schemaLock.Unlock()
+		return err
+	}
+	for id := range result {
+		db.refreshView(v, id)
+	}
+	return nil
+}
+
+// Return the definition of a view, or false if the collection is not a view.
+func (db *DB) ViewDef(name string) (def ViewDef, isView bool) {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	if v, exists := db.views[name]; exists {
+		return v.def, true
+	}
+	return
+}
+
+// Write view definition into the view collection directory. Does not place schema lock.
+func (v *view) save(db *DB) error {
+	content, err := json.MarshalIndent(v.def, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(db.path, v.name, VIEW_DEF_FILE), content, 0600)
+}
+
+// Read the definitions of all views and maintain them. Does not place schema lock.
+func (db *DB) loadViews() error {
+	db.views = make(map[string]*view)
+	for name := range db.cols {
+		content, err := ioutil.ReadFile(path.Join(db.path, name, VIEW_DEF_FILE))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		v := newView(db, name, ViewDef{})
+		if err := json.Unmarshal(content, &v.def); err != nil {
+			return err
+		}
+		if src, exists := db.cols[v.def.Source]; exists {
+			db.maintainView(v, src)
+		} else {
+			tdlog.Noticef("View %s will not be maintained, its source collection %s does not exist", name, v.def.Source)
+			db.views[name] = v
+		}
+	}
+	return nil
+}
+
+// Register the hooks on source collection that maintain the view. Does not place schema lock.
+func (db *DB) maintainView(v *view, src *Col) {
+	removeInsert := src.OnInsert(func(id int, _ map[string]interface{}) {
+		db.refreshView(v, id)
+	}, false)
+	removeUpdate := src.OnUpdate(func(id int, _, _ map[string]interface{}) {
+		db.refreshView(v, id)
+	}, false)
+	removeDelete := src.OnDelete(func(id int, _ map[string]interface{}) {
+		db.refreshView(v, id)
+	}, false)
+	v.removeHooks = func() {
+		removeInsert()
+		removeUpdate()
+		removeDelete()
+	}
+	db.views[v.name] = v
+}
+
+// Stop maintaining the view. Does not place schema lock.
+func (db *DB) forgetView(name string) {
+	if v, exists := db.views[name]; exists {
+		if v.removeHooks != nil {
+			v.removeHooks()
+		}
+		delete(db.views, name)
+	}
+}
+
+// Follow a collection rename in view definitions. Does not place schema lock.
+func (db *DB) renameInViews(oldName, newName string) {
+	if v, exists := db.views[oldName]; exists {
+		delete(db.views, oldName)
+		v.name = newName
+		db.views[newName] = v
+	}
+	for _, v := range db.views {
+		if v.def.Source == oldName {
+			v.def.Source = newName
+			if err := v.save(db); err != nil {
+				tdlog.Noticef("Failed to save definition of view %s: %v", v.name, err)
+			}
+		}
+	}
+}
+
+// Read the source document again, and put its projection into the view if the document matches the view query,
+// otherwise remove it from the view. A deleted source document is removed.
+func (db *DB) refreshView(v *view, id int) {
+	lock := v.refreshLock[id%len(v.refreshLock)]
+	lock.Lock()
+	defer lock.Unlock()
+	db.schemaLock.RLock()
+	viewCol, src := db.cols[v.name], db.cols[v.def.Source]
+	def := v.def
+	db.schemaLock.RUnlock()
+	if viewCol == nil || src == nil {
+		return
+	}
+	doc, err := src.read(context.Background(), id, true)
+	if err != nil {
+		doc = nil
+	}
+	if doc != nil && matchQuery(def.Query, id, doc) {
+		viewDoc := Project(doc, def.Fields)
+		if err = viewCol.Update(id, viewDoc); dberr.Type(err) == dberr.ErrorNoDoc {
+			err = viewCol.insertID(id, viewDoc)
+		}
+	} else if err = viewCol.Delete(id); dberr.Type(err) == dberr.ErrorNoDoc {
+		err = nil
+	}
+	if err != nil {
+		tdlog.Noticef("Failed to maintain document %d in view %s: %v", id, v.name, err)
+	}
+}
+
+// Insert a document with the specified ID into the collection (incl. index).
+func (col *Col) insertID(id int, doc map[string]interface{}) error {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	part := col.parts[id%col.db.numParts]
+	part.DataLock.Lock()
+	defer part.DataLock.Unlock()
+	return col.InsertRecovery(id, doc)
+}
+
+// Return a new document holding only the attributes along the paths, or all attributes if there are no paths.
+func Project(doc map[string]interface{}, fields [][]string) map[string]interface{} {
+	projection := make(map[string]interface{})
+	if len(fields) == 0 {
+		for key, val := range doc {
+			projection[key] = val
+		}
+		return projection
+	}
+	for _, field := range fields {
+		// Find the attribute, it is projected only if every segment but the last leads to an object
+		var val interface{} = doc
+		for _, seg := range field {
+			if obj, isObj := val.(map[string]interface{}); isObj {
+				val = obj[seg]
+			} else {
+				val = nil
+				break
+			}
+		}
+		if val == nil || len(field) == 0 {
+			continue
+		}
+		dest := projection
+		for _, seg := range field[:len(field)-1] {
+			if _, isObj := dest[seg].(map[string]interface{}); !isObj {
+				dest[seg] = make(map[string]interface{})
+			}
+			dest = dest[seg].(map[string]interface{})
+		}
+		dest[field[len(field)-1]] = val
+	}
+	return projection
+}
+
+// Return true if the document is in the query result, as far as the query can be answered by the document alone.
+// Result limits are not applied. The query must be valid.
+func matchQuery(q interface{}, id int, doc map[string]interface{}) bool {
+	switch expr := q.(type) {
+	case []interface{}: // Union
+		for _, subExpr := range expr {
+			if matchQuery(subExpr, id, doc) {
+				return true
+			}
+		}
+		return false
+	case string:
+		if expr == "all" {
+			return true
+		}
+		docID, err := strconv.Atoi(expr)
+		return err == nil && docID == id
+	case map[string]interface{}:
+		if _, versioned := expr["version"]; versioned {
+			return matchQuery(expr["query"], id, doc)
+		}
+		return matchOperation(expr, id, doc)
+	}
+	return false
+}
+
+// Return true if the document is in the result of the query operation.
+func matchOperation(expr map[string]interface{}, id int, doc map[string]interface{}) bool {
+	if lookupValue, isLookup := expr["eq"]; isLookup {
+		lookupStrValue := valueText(lookupValue)
+		for _, v := range indexValues(doc, queryPath(expr["in"])) {
+			if v != nil && valueText(v) == lookupStrValue {
+				return true
+			}
+		}
+		return false
+	} else if hasPath, isExistence := expr["has"]; isExistence {
+		for _, v := range indexValues(doc, queryPath(hasPath)) {
+			if v != nil {
+				return true
+			}
+		}
+		return false
+	} else if subExprs, isIntersect := expr["n"]; isIntersect {
+		for _, subExpr := range subExprs.([]interface{}) {
+			if !matchQuery(subExpr, id, doc) {
+				return false
+			}
+		}
+		return true
+	} else if subExprs, isComplement := expr["c"]; isComplement {
+		// Complement holds the documents in the results of an odd number of sub-queries
+		matches := 0
+		for _, subExpr := range subExprs.([]interface{}) {
+			if matchQuery(subExpr, id, doc) {
+				matches++
+			}
+		}
+		return matches%2 == 1
+	} else if subExprs, isDifference := expr["d"]; isDifference {
+		for i, subExpr := range subExprs.([]interface{}) {
+			if matchQuery(subExpr, id, doc) != (i == 0) {
+				return false
+			}
+		}
+		return len(subExprs.([]interface{})) > 0
+	} else if subExprs, isSymDifference := expr["x"]; isSymDifference {
+		matches := 0
+		for _, subExpr := range subExprs.([]interface{}) {
+			if matchQuery(subExpr, id, doc) {
+				matches++
+			}
+		}
+		return matches == 1
+	} else if timePath, isTimeRange := expr["time"]; isTimeRange {
+		after, before, err := timeBounds(expr, "$")
+		return err == nil && matchTimeRange(doc, queryPath(timePath), after, before)
+	}
+	intFrom, isRange := expr["int-from"]
+	if !isRange {
+		intFrom = expr["int from"]
+	}
+	_, from, to, err := intRangeBounds(intFrom, expr)
+	if err != nil {
+		return false
+	}
+	if from > to {
+		from, to = to, from
+	}
+	// Range lookup finds the indexed values that read like the integers in range
+	for _, v := range indexValues(doc, queryPath(expr["in"])) {
+		if v == nil {
+			continue
+		}
+		strValue := valueText(v)
+		if intValue, err := strconv.Atoi(strValue); err == nil && intValue >= from && intValue <= to && fmt.Sprint(float64(intValue)) == strValue {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the path of a query operation as strings.
+func queryPath(path interface{}) (vecPath []string) {
+	vecPathInterface, _ := path.([]interface{})
+	vecPath = make([]string, 0, len(vecPathInterface))
+	for _, v := range vecPathInterface {
+		vecPath = append(vecPath, fmt.Sprint(v))
+	}
+	return
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestMatchQuery(t *testing.T) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(`{"a": 1, "b": {"c": ["x", "y"]}, "d": null, "e": "3"}`), &doc); err != nil {
+		t.Fatal(err)
+	}
+	matches := map[string]bool{
+		`"all"`:                         true,
+		`"12"`:                          true,
+		`"13"`:                          false,
+		`1`:                             false,
+		`{"eq": 1, "in": ["a"]}`:        true,
+		`{"eq": "1", "in": ["a"]}`:      true,
+		`{"eq": "y", "in": ["b", "c"]}`: true,
+		`{"eq": "z", "in": ["b", "c"]}`: false,
+		`{"has": ["b", "c"]}`:           true,
+		`{"has": ["d"]}`:                false,
+		`{"int-from": 0, "int-to": 2, "in": ["a"]}`:                   true,
+		`{"int from": 5, "int to": 3, "in": ["e"]}`:                   true,
+		`{"int-from": 2, "int-to": 4, "in": ["a"]}`:                   false,
+		`[{"eq": 2, "in": ["a"]}, {"has": ["e"]}]`:                    true,
+		`{"n": [{"eq": 1, "in": ["a"]}, {"has": ["d"]}]}`:             false,
+		`{"n": [{"eq": 1, "in": ["a"]}, {"has": ["e"], "limit": 1}]}`: true,
+		`{"c": ["all", {"has": ["d"]}]}`:                              true,
+		`{"c": ["all", {"has": ["a"]}]}`:                              false,
+	}
+	for query, expected := range matches {
+		var q interface{}
+		if err := json.Unmarshal([]byte(query), &q); err != nil {
+			t.Fatal(err)
+		}
+		if matchQuery(q, 12, doc) != expected {
+			t.Error(query, !expected)
+		}
+	}
+}
+
+func TestProject(t *testing.T) {
+	doc := map[string]interface{}{"a": 1, "b": map[string]interface{}{"c": 2, "d": 3}, "e": []interface{}{4}}
+	projection := Project(doc, [][]string{{"a"}, {"b", "c"}, {"e", "f"}, {"g"}})
+	if !reflect.DeepEqual(projection, map[string]interface{}{"a": 1, "b": map[string]interface{}{"c": 2}}) {
+		t.Fatal(projection)
+	}
+	projection = Project(doc, nil)
+	projection["a"] = 5
+	if !reflect.DeepEqual(doc["a"], 1) || len(projection) != 3 {
+		t.Fatal(doc, projection)
+	}
+}
+
+func TestView(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("src"); err != nil {
+		t.Fatal(err)
+	}
+	src := db.Use("src")
+	if err = src.Index([]string{"kind"}); err != nil {
+		t.Fatal(err)
+	}
+	oldID, err := src.Insert(map[string]interface{}{"kind": "a", "n": 1, "other": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = src.Insert(map[string]interface{}{"kind": "b", "n": 2}); err != nil {
+		t.Fatal(err)
+	}
+	def := ViewDef{Source: "src", Query: map[string]interface{}{"eq": "a", "in": []interface{}{"kind"}}, Fields: [][]string{{"n"}}}
+	if err = db.CreateView("view", ViewDef{Source: "nonexistent"}); err == nil {
+		t.Fatal("Did not error")
+	} else if err = db.CreateView("view", ViewDef{Source: "src", Query: map[string]interface{}{"eq": 1}}); err == nil {
+		t.Fatal("Did not error")
+	} else if err = db.CreateView("view", ViewDef{Source: "src", Query: map[string]interface{}{"eq": 1, "in": []interface{}{"x"}}}); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	} else if db.Use("view") != nil {
+		t.Fatal("Failed view is left behind")
+	} else if err = db.CreateView("view", def); err != nil {
+		t.Fatal(err)
+	}
+	view := db.Use("view")
+	// Existing documents are in the view
+	if doc, err := view.Read(oldID); err != nil || !reflect.DeepEqual(doc, map[string]interface{}{"n": float64(1)}) {
+		t.Fatal(doc, err)
+	}
+	// Mutations are applied to the view
+	newID, err := src.Insert(map[string]interface{}{"kind": "a", "n": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = src.Update(oldID, map[string]interface{}{"kind": "b", "n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	viewDocs := func() map[int]float64 {
+		docs := make(map[int]float64)
+		view.ForEachDoc(func(id int, doc []byte) bool {
+			var viewDoc map[string]interface{}
+			json.Unmarshal(doc, &viewDoc)
+			docs[id] = viewDoc["n"].(float64)
+			return true
+		})
+		return docs
+	}
+	if docs := viewDocs(); !reflect.DeepEqual(docs, map[int]float64{newID: 3}) {
+		t.Fatal(docs)
+	}
+	// Concurrent updates of a document leave the view with the latest source document
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				kind := "a"
+				if (i+j)%2 == 1 {
+					kind = "b"
+				}
+				if err := src.Update(newID, map[string]interface{}{"kind": kind, "n": float64(i*100 + j)}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if doc, err := src.Read(newID); err != nil {
+		t.Fatal(err)
+	} else if docs := viewDocs(); doc["kind"] == "a" && !reflect.DeepEqual(docs, map[int]float64{newID: doc["n"].(float64)}) ||
+		doc["kind"] == "b" && len(docs) != 0 {
+		t.Fatal(doc, docs)
+	}
+	if err = src.UpdateFunc(newID, func(orig map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"kind": "a", "n": 4}, nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if docs := viewDocs(); !reflect.DeepEqual(docs, map[int]float64{newID: 4}) {
+		t.Fatal(docs)
+	}
+	// The view is maintained after reopening the database and renaming source and view
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Rename("src", "src2"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Rename("view", "view2"); err != nil {
+		t.Fatal(err)
+	}
+	if def, isView := db.ViewDef("view2"); !isView || def.Source != "src2" {
+		t.Fatal(def, isView)
+	} else if _, isView = db.ViewDef("src2"); isView {
+		t.Fatal("Source is not a view")
+	}
+	src, view = db.Use("src2"), db.Use("view2")
+	if err = src.Delete(newID); err != nil {
+		t.Fatal(err)
+	} else if docs := viewDocs(); len(docs) != 0 {
+		t.Fatal(docs)
+	}
+	// A dropped view is no longer maintained
+	if err = db.Drop("view2"); err != nil {
+		t.Fatal(err)
+	} else if _, isView := db.ViewDef("view2"); isView {
+		t.Fatal("View is not dropped")
+	} else if _, err = src.Insert(map[string]interface{}{"kind": "a", "n": 5}); err != nil {
+		t.Fatal(err)
+	}
+}
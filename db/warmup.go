@@ -0,0 +1,46 @@
+// Warm-up of collection files.
+//
+// Right after the database opens, its files are mapped into memory yet none of their pages are, and every first read
+// of a page waits for the disk - the reads and queries of the first minutes after a restart are much slower than
+// later. Warming up a collection reads its files into memory ahead of the traffic, a region of WARMUP_REGION bytes at
+// a time, so that writes proceed between the regions.
+
+package db
+
+import (
+	"sync"
+
+	"github.com/cankansin/tiedot/data"
+)
+
+const (
+	WARMUP_REGION = 4 * 1048576 // Size of the file region read into memory at a time while the file's lock is held.
+)
+
+// Read the files of the collection - documents, ID and string ID lookup, and indexes - into memory, up to the end of
+// the space in-use of each file. Return the number of bytes read in.
+func (col *Col) Warmup() (size int) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	warmup := func(file *data.DataFile, lock *sync.RWMutex) {
+		for from := 0; ; from += WARMUP_REGION {
+			lock.RLock()
+			size += file.Warmup(from, from+WARMUP_REGION)
+			done := from+WARMUP_REGION >= file.Used
+			lock.RUnlock()
+			if done {
+				return
+			}
+		}
+	}
+	for i := 0; i < col.db.numParts; i++ {
+		for _, file := range col.parts[i].DataFiles() {
+			warmup(file, col.parts[i].DataLock)
+		}
+		warmup(col.strIDs[i].DataFile, col.strIDs[i].Lock)
+		for _, ht := range col.hts[i] {
+			warmup(ht.DataFile, ht.Lock)
+		}
+	}
+	return
+}
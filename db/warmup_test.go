@@ -0,0 +1,39 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWarmup(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err = col.Insert(map[string]interface{}{"a": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every file is read in up to the end of its space in-use
+	used := 0
+	for i := 0; i < db.numParts; i++ {
+		for _, file := range col.parts[i].DataFiles() {
+			used += file.Used
+		}
+		used += col.strIDs[i].Used + col.hts[i]["a"].Used
+	}
+	if size := col.Warmup(); size != used {
+		t.Fatal(size, used)
+	}
+}
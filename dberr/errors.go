@@ -1,6 +1,9 @@
 package dberr
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 type errorType string
 
@@ -9,19 +12,110 @@ const (
 	ErrorUndefined errorType = "Unknown Error."
 
 	// IO error
-	ErrorIO    errorType = "IO error has occured, see log for more details."
-	ErrorNoDoc errorType = "Document `%d` does not exist"
+	ErrorIO         errorType = "IO error has occured, see log for more details."
+	ErrorFileLocked errorType = "File `%s` is in use by another process"
+	ErrorDirLocked  errorType = "Lock file `%s` is held by process %s on host %s"
+	ErrorInjected   errorType = "Fault injected into %s of `%s`"
+	ErrorNoDoc      errorType = "Document `%d` does not exist"
 
 	// Document errors
-	ErrorDocTooLarge errorType = "Document is too large. Max: `%d`, Given: `%d`"
+	ErrorNoStrDoc        errorType = "Document `%s` does not exist"
+	ErrorDupStrID        errorType = "Document ID `%s` is already in use"
+	ErrorDocTooLarge     errorType = "Document is too large. Max: `%d`, Given: `%d`"
+	ErrorDocTooDeep      errorType = "Document is nested too deeply. Max depth: `%d`"
+	ErrorNoRefDoc        errorType = "Path %v refers to document `%v`, which does not exist in collection %s"
+	ErrorReferenced      errorType = "Document `%v` is referenced by documents in collection %s"
+	ErrorOverloaded      errorType = "Collection %s is overloaded with writes, retry later"
+	ErrorACLDenied       errorType = "Document would not be accessible to %s, who may only write documents accessible to them"
+	ErrorDeadlock        errorType = "Waiting for the lock of document `%d` in collection %s would deadlock, please unlock and retry"
+	ErrorLockTimeout     errorType = "Timed out waiting for the lock of document `%d` in collection %s"
+	ErrorPartLockTimeout errorType = "Timed out waiting for the lock of partition `%d` in collection %s"
+	ErrorDocChanged      errorType = "Document `%v` does not match the given entity tag"
+
+	// Schema errors
+	ErrorNoCol         errorType = "Collection %s does not exist"
+	ErrorColExists     errorType = "Collection %s already exists"
+	ErrorNoIndex       errorType = "Path %v is not indexed"
+	ErrorIndexExists   errorType = "Path %v is already indexed"
+	ErrorIndexBuilding errorType = "Path %v is being indexed"
+	ErrorIndexAborted  errorType = "Index build of %v is aborted, collection %s was closed, scrubbed or dropped"
+	ErrorNoInsertOrder errorType = "Collection %s does not track insertion order"
+	ErrorIndexQuota    errorType = "Index %v would bring the index files of collection %s to %d bytes, beyond the quota of %d bytes"
 
 	// Query input errors
 	ErrorNeedIndex         errorType = "Please index %v and retry query %v."
 	ErrorExpectingSubQuery errorType = "Expecting a vector of sub-queries, but %v given."
 	ErrorExpectingInt      errorType = "Expecting `%s` as an integer, but %v given."
 	ErrorMissing           errorType = "Missing `%s`"
+	ErrorSQLSyntax         errorType = "SQL syntax error at offset %d: %s"
+	ErrorNoStoredQuery     errorType = "Stored query %s does not exist"
+	ErrorAdHocQuery        errorType = "Ad-hoc queries are not allowed, please run a stored query"
+
+	// Request parameter errors
+	ErrorMissingParam errorType = "Please pass POST/PUT/GET parameter value of '%s'."
+	ErrorInvalidParam errorType = "Invalid %s '%v'."
+	ErrorInvalidJSON  errorType = "'%v' is not valid JSON %s."
+	ErrorBodyTooLarge errorType = "Request body is too large. Max: `%d`"
+
+	// Backup errors
+	ErrorChangesDiscarded errorType = "Changes since `%d` are no longer recorded, please take a full backup"
+
+	// Replication errors
+	ErrorReadOnly errorType = "Database is a read replica, it does not accept writes"
+	ErrorStale    errorType = "Database reflects the changes up to `%d`, not yet those up to `%d`"
+
+	// Migration errors
+	ErrorMigration    errorType = "Migration %d (%s) failed: %v"
+	ErrorIrreversible errorType = "Migration %d (%s) cannot be undone"
 )
 
+// Stable machine-readable code of each error type. Unlike messages, codes never change between releases.
+var codes = map[errorType]string{
+	ErrorNil:               "",
+	ErrorUndefined:         "undefined",
+	ErrorIO:                "io",
+	ErrorFileLocked:        "file_locked",
+	ErrorDirLocked:         "dir_locked",
+	ErrorInjected:          "injected_fault",
+	ErrorNoDoc:             "no_doc",
+	ErrorNoStrDoc:          "no_doc",
+	ErrorDupStrID:          "dup_id",
+	ErrorDocTooLarge:       "doc_too_large",
+	ErrorDocTooDeep:        "doc_too_deep",
+	ErrorNoRefDoc:          "no_ref_doc",
+	ErrorReferenced:        "referenced",
+	ErrorOverloaded:        "overloaded",
+	ErrorACLDenied:         "acl_denied",
+	ErrorDeadlock:          "deadlock",
+	ErrorLockTimeout:       "lock_timeout",
+	ErrorPartLockTimeout:   "lock_timeout",
+	ErrorDocChanged:        "doc_changed",
+	ErrorNoCol:             "no_col",
+	ErrorColExists:         "col_exists",
+	ErrorNoIndex:           "no_index",
+	ErrorIndexExists:       "index_exists",
+	ErrorIndexBuilding:     "index_building",
+	ErrorIndexAborted:      "index_aborted",
+	ErrorNoInsertOrder:     "no_insert_order",
+	ErrorIndexQuota:        "index_quota",
+	ErrorNeedIndex:         "need_index",
+	ErrorExpectingSubQuery: "expecting_sub_query",
+	ErrorExpectingInt:      "expecting_int",
+	ErrorMissing:           "missing",
+	ErrorSQLSyntax:         "sql_syntax",
+	ErrorNoStoredQuery:     "no_stored_query",
+	ErrorAdHocQuery:        "ad_hoc_query",
+	ErrorMissingParam:      "missing_param",
+	ErrorInvalidParam:      "invalid_param",
+	ErrorInvalidJSON:       "invalid_json",
+	ErrorBodyTooLarge:      "body_too_large",
+	ErrorChangesDiscarded:  "changes_discarded",
+	ErrorReadOnly:          "read_only",
+	ErrorStale:             "stale",
+	ErrorMigration:         "migration_failed",
+	ErrorIrreversible:      "irreversible",
+}
+
 func New(err errorType, details ...interface{}) Error {
 	return Error{err, details}
 }
@@ -40,8 +134,23 @@ func Type(e error) errorType {
 		return ErrorNil
 	}
 
-	if err, ok := e.(Error); ok {
+	var err Error
+	if errors.As(e, &err) {
 		return err.err
 	}
 	return ErrorUndefined
 }
+
+// Return the stable code of the error's type, or "undefined" if the error is not made by this package.
+func Code(e error) string {
+	return codes[Type(e)]
+}
+
+// Return the values that were formatted into the error message, or nil if the error is not made by this package.
+func Details(e error) []interface{} {
+	var err Error
+	if e != nil && errors.As(e, &err) {
+		return err.details
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package dberr
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCode(t *testing.T) {
+	if code := Code(nil); code != "" {
+		t.Fatal(code)
+	} else if code := Code(errors.New("abc")); code != "undefined" {
+		t.Fatal(code)
+	} else if code := Code(New(ErrorNoDoc, 1)); code != "no_doc" {
+		t.Fatal(code)
+	} else if code := Code(New(ErrorNoStrDoc, "a")); code != "no_doc" {
+		t.Fatal(code)
+	} else if code := Code(fmt.Errorf("wrapped: %w", New(ErrorNoCol, "a"))); code != "no_col" {
+		t.Fatal(code)
+	}
+	// Every error type has a code
+	for errType, code := range codes {
+		if errType != ErrorNil && code == "" {
+			t.Fatal(errType)
+		}
+	}
+}
+
+func TestDetails(t *testing.T) {
+	if details := Details(errors.New("abc")); details != nil {
+		t.Fatal(details)
+	}
+	err := New(ErrorDocTooLarge, 1, 2)
+	if details := Details(err); len(details) != 2 || details[0] != 1 || details[1] != 2 {
+		t.Fatal(details)
+	} else if err.Error() != "Document is too large. Max: `1`, Given: `2`" {
+		t.Fatal(err)
+	}
+}
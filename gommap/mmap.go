@@ -21,14 +21,48 @@ import (
 	"unsafe"
 )
 
+// ErrNoReserve tells that address space may not be reserved on this platform.
+var ErrNoReserve = errors.New("address space reservation is not supported")
+
 // MMap represents a file mapped into memory.
 type MMap []byte
 
+// Backend maps files into memory on behalf of the functions and methods of this package.
+type Backend interface {
+	Map(f *os.File, length int) ([]byte, error)      // Map the first length bytes of the file
+	Reserve(size int) ([]byte, error)                // Reserve address space, or fail with ErrNoReserve
+	MapFixed(m []byte, f *os.File, offset int) error // Map the region of the file from offset into reserved address space
+	Advise(m []byte, advice Advice) error            // Advise the access pattern of the mapped region
+	Flush(m []byte) error                            // Write the mapped region to the file and wait for the writes to complete
+	Unmap(m []byte) error                            // Delete the map returned by Map or Reserve
+}
+
+// The backend mapping files from now on.
+var backend = Platform
+
+// SetBackend makes the backend map files from now on, and return the previous backend. A map must be flushed and
+// unmapped by the backend that made it, hence the backend is to be set before any file is mapped, e.g. before a
+// database is opened.
+func SetBackend(b Backend) (previous Backend) {
+	previous, backend = backend, b
+	return
+}
+
+// Advice tells the operating system how the mapped memory will be accessed.
+type Advice int
+
+const (
+	ADVICE_NORMAL     Advice = iota // No special treatment
+	ADVICE_RANDOM                   // Expect random access, read ahead is not useful
+	ADVICE_SEQUENTIAL               // Expect sequential access, read ahead aggressively
+	ADVICE_DONTNEED                 // The memory is not needed for now, its pages may be released
+	ADVICE_WILLNEED                 // The memory will be accessed soon, its pages may be read ahead
+)
+
 // Map maps an entire file into memory.
 // Note that because of runtime limitations, no file larger than about 2GB can
 // be completely mapped into memory.
 func Map(f *os.File) (MMap, error) {
-	fd := uintptr(f.Fd())
 	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
@@ -37,13 +71,55 @@ func Map(f *os.File) (MMap, error) {
 	if int64(length) != fi.Size() {
 		return nil, errors.New("memory map file length overflow")
 	}
-	return mmap(length, fd)
+	return backend.Map(f, length)
+}
+
+// Reserve reserves address space for a map of up to size bytes without mapping anything into it; the reserved space
+// may not be accessed until MapFile maps part of a file there. Unmap releases the reservation along with the parts of
+// files mapped into it. Reserving fails with ErrNoReserve where it is not supported.
+func Reserve(size int) (MMap, error) {
+	return backend.Reserve(size)
+}
+
+// MapFile maps the region of the file between offset and offset+length into the reserved address space (see Reserve)
+// at the same offset, replacing the reservation or an earlier map of the region there. The region is extended to the
+// page boundary before offset. Maps of other regions stay as they are.
+func (m MMap) MapFile(f *os.File, offset, length int) error {
+	end := offset + length
+	offset -= offset % os.Getpagesize()
+	if offset < 0 || offset >= end || end > len(m) {
+		return errors.New("mapped region lies outside the reserved address space")
+	}
+	return backend.MapFixed(m[offset:end], f, offset)
 }
 
 func (m *MMap) header() *reflect.SliceHeader {
 	return (*reflect.SliceHeader)(unsafe.Pointer(m))
 }
 
+// Advise the operating system about the access pattern of the mapped region.
+// The advice is a hint, which is silently ignored where it is not supported.
+func (m MMap) Advise(advice Advice) error {
+	if len(m) == 0 {
+		return nil
+	}
+	return backend.Advise(m, advice)
+}
+
+// Flush writes the modified pages of the mapped region between offset and offset+length to the file, and waits for
+// the writes to complete. The region is extended to the page boundary before offset.
+func (m MMap) Flush(offset, length int) error {
+	end := offset + length
+	if end > len(m) {
+		end = len(m)
+	}
+	offset -= offset % os.Getpagesize()
+	if offset < 0 || offset >= end {
+		return nil
+	}
+	return backend.Flush(m[offset:end])
+}
+
 // Unmap deletes the memory mapped region, flushes any remaining changes, and sets
 // m to nil.
 // Trying to read or write any remaining references to m after Unmap is called will
@@ -51,8 +127,7 @@ func (m *MMap) header() *reflect.SliceHeader {
 // Unmap should only be called on the slice value that was originally returned from
 // a call to Map. Calling Unmap on a derived slice may cause errors.
 func (m *MMap) Unmap() error {
-	dh := m.header()
-	err := unmap(dh.Data, uintptr(dh.Len))
+	err := backend.Unmap(*m)
 	*m = nil
 	return err
 }
@@ -0,0 +1,39 @@
+//go:build darwin || freebsd || linux || netbsd || openbsd || windows
+// +build darwin freebsd linux netbsd openbsd windows
+
+package gommap
+
+import (
+	"os"
+)
+
+// Platform is the backend of this platform, which maps files by the operating system's memory maps.
+var Platform Backend = osBackend{}
+
+// Backend of the operating system's memory maps.
+type osBackend struct{}
+
+func (osBackend) Map(f *os.File, length int) ([]byte, error) {
+	return mmap(length, f.Fd())
+}
+
+func (osBackend) Reserve(size int) ([]byte, error) {
+	return reserve(size)
+}
+
+func (osBackend) MapFixed(m []byte, f *os.File, offset int) error {
+	return mapFixed(m, f.Fd(), offset)
+}
+
+func (osBackend) Advise(m []byte, advice Advice) error {
+	return advise(m, advice)
+}
+
+func (osBackend) Flush(m []byte) error {
+	return flush(m)
+}
+
+func (osBackend) Unmap(m []byte) error {
+	dh := (*MMap)(&m).header()
+	return unmap(dh.Data, uintptr(dh.Len))
+}
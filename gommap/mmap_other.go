@@ -0,0 +1,8 @@
+//go:build !darwin && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package gommap
+
+// Platform is the backend of this platform, which has no memory maps (e.g. WebAssembly), hence files are copied into
+// memory instead.
+var Platform Backend = Portable
@@ -0,0 +1,105 @@
+// Portable backend copies files into memory in place of memory maps.
+
+package gommap
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// Portable maps a file by reading a copy of it into memory, the copy is written back to the file upon Flush and Unmap.
+// It is the backend of platforms without memory maps, such as WebAssembly, and may be set on any other platform (see
+// SetBackend). Unlike a memory map, a copy occupies memory in full, and what is written into it reaches the file only
+// once it is flushed or unmapped. Address space may not be reserved.
+var Portable Backend = &portable{copies: make(map[uintptr]*fileCopy)}
+
+// Portable backend keeps the copies so that it finds the file of a region to write back.
+type portable struct {
+	lock   sync.Mutex
+	copies map[uintptr]*fileCopy // Copies by the address of their first byte
+}
+
+// Copy of a file in memory.
+type fileCopy struct {
+	buf []byte
+	fh  *os.File // The copy's own handle of the file, so that the handle used to map the file may be closed meanwhile
+}
+
+// Return the address of the first byte of the region.
+func regionAddr(m []byte) uintptr {
+	return uintptr(unsafe.Pointer(&m[0]))
+}
+
+func (p *portable) Map(f *os.File, length int) ([]byte, error) {
+	if length <= 0 {
+		return nil, errors.New("memory map file length is zero")
+	}
+	fh, err := os.OpenFile(f.Name(), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Beyond the end of file, the copy reads as 0s
+	buf := make([]byte, length)
+	if _, err = fh.ReadAt(buf, 0); err != nil && err != io.EOF {
+		fh.Close()
+		return nil, err
+	}
+	p.lock.Lock()
+	p.copies[regionAddr(buf)] = &fileCopy{buf: buf, fh: fh}
+	p.lock.Unlock()
+	return buf, nil
+}
+
+func (p *portable) Reserve(size int) ([]byte, error) {
+	return nil, ErrNoReserve
+}
+
+func (p *portable) MapFixed(m []byte, f *os.File, offset int) error {
+	return ErrNoReserve
+}
+
+// Copies are in memory already, there is nothing to advise.
+func (p *portable) Advise(m []byte, advice Advice) error {
+	return nil
+}
+
+func (p *portable) Flush(m []byte) error {
+	addr := regionAddr(m)
+	p.lock.Lock()
+	var owner *fileCopy
+	var offset int
+	for start, copied := range p.copies {
+		if addr >= start && addr < start+uintptr(len(copied.buf)) {
+			owner, offset = copied, int(addr-start)
+			break
+		}
+	}
+	p.lock.Unlock()
+	if owner == nil {
+		return errors.New("flushed region does not belong to a file copy")
+	} else if _, err := owner.fh.WriteAt(m, int64(offset)); err != nil {
+		return err
+	}
+	return owner.fh.Sync()
+}
+
+func (p *portable) Unmap(m []byte) error {
+	if len(m) == 0 {
+		return nil
+	}
+	p.lock.Lock()
+	owner, exists := p.copies[regionAddr(m)]
+	delete(p.copies, regionAddr(m))
+	p.lock.Unlock()
+	if !exists {
+		return errors.New("unmapped region is not a file copy")
+	}
+	_, err := owner.fh.WriteAt(owner.buf, 0)
+	if closeErr := owner.fh.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -8,12 +8,40 @@ package gommap
 
 import (
 	"syscall"
+	"unsafe"
 )
 
 func mmap(len int, fd uintptr) ([]byte, error) {
 	return syscall.Mmap(int(fd), 0, len, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
 }
 
+func advise(m []byte, advice Advice) error {
+	flag := syscall.MADV_NORMAL
+	switch advice {
+	case ADVICE_RANDOM:
+		flag = syscall.MADV_RANDOM
+	case ADVICE_SEQUENTIAL:
+		flag = syscall.MADV_SEQUENTIAL
+	case ADVICE_DONTNEED:
+		flag = syscall.MADV_DONTNEED
+	case ADVICE_WILLNEED:
+		flag = syscall.MADV_WILLNEED
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_MADVISE, uintptr(unsafe.Pointer(&m[0])), uintptr(len(m)), uintptr(flag))
+	if errno != 0 {
+		return syscall.Errno(errno)
+	}
+	return nil
+}
+
+func flush(m []byte) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&m[0])), uintptr(len(m)), syscall.MS_SYNC)
+	if errno != 0 {
+		return syscall.Errno(errno)
+	}
+	return nil
+}
+
 func unmap(addr, len uintptr) error {
 	_, _, errno := syscall.Syscall(syscall.SYS_MUNMAP, addr, len, 0)
 	if errno != 0 {
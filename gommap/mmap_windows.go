@@ -8,6 +8,7 @@ import (
 	"os"
 	"sync"
 	"syscall"
+	"unsafe"
 )
 
 // mmap on Windows is a two-step process.
@@ -45,6 +46,16 @@ func mmap(length int, hfile uintptr) ([]byte, error) {
 	return m, nil
 }
 
+// Windows does not take access pattern advice for mapped views.
+func advise(m []byte, advice Advice) error {
+	return nil
+}
+
+// FlushViewOfFile starts writing the pages to the file, it does not wait for the disk to complete the writes.
+func flush(m []byte) error {
+	return os.NewSyscallError("FlushViewOfFile", syscall.FlushViewOfFile(uintptr(unsafe.Pointer(&m[0])), uintptr(len(m))))
+}
+
 func unmap(addr, len uintptr) error {
 	if err := syscall.UnmapViewOfFile(addr); err != nil {
 		return err
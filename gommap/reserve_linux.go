@@ -0,0 +1,28 @@
+//go:build linux && (amd64 || arm64 || ppc64le || riscv64)
+// +build linux
+// +build amd64 arm64 ppc64le riscv64
+
+package gommap
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Reserve inaccessible address space, which does not count as memory in use.
+func reserve(size int) ([]byte, error) {
+	return syscall.Mmap(-1, 0, size, syscall.PROT_NONE, syscall.MAP_PRIVATE|syscall.MAP_ANON|syscall.MAP_NORESERVE)
+}
+
+// Map the file from the offset over the region, which lies in reserved address space.
+func mapFixed(m []byte, fd uintptr, offset int) error {
+	addr := uintptr(unsafe.Pointer(&m[0]))
+	mapped, _, errno := syscall.Syscall6(syscall.SYS_MMAP, addr, uintptr(len(m)), syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_SHARED|syscall.MAP_FIXED, fd, uintptr(offset))
+	if errno != 0 {
+		return syscall.Errno(errno)
+	} else if mapped != addr {
+		return syscall.EINVAL
+	}
+	return nil
+}
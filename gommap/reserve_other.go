@@ -0,0 +1,13 @@
+//go:build !linux || !(amd64 || arm64 || ppc64le || riscv64)
+// +build !linux !amd64,!arm64,!ppc64le,!riscv64
+
+package gommap
+
+// Address space is only reserved on 64-bit Linux, elsewhere files are mapped again as they grow.
+func reserve(size int) ([]byte, error) {
+	return nil, ErrNoReserve
+}
+
+func mapFixed(m []byte, fd uintptr, offset int) error {
+	return ErrNoReserve
+}
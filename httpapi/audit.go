@@ -0,0 +1,233 @@
+// Audit log of administrative operations.
+//
+// Administrative requests are recorded once they are answered: collection, view, index and stored query management,
+// dumps, restores and configuration reloads, as well as writes to the JWT identity collection, which change users and
+// their access rights. A record tells the time, the JWT user (empty without JWT), the client address, the endpoint,
+// the request parameters less the secrets among them, and the response status. Records are appended to a dedicated
+// file as lines of JSON and never rewritten; they may be inserted into a collection as well, where they are indexed and
+// queried like any other documents.
+
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+var (
+	AuditLogPath string // Append records of administrative requests to this file, empty - no audit log
+	AuditCol     string // Insert records of administrative requests into this collection as well, empty - only the file
+
+	audit *auditLog // Open audit log, nil if there is none
+)
+
+var (
+	// Administrative endpoints, their requests are always recorded.
+	auditedEndpoints = map[string]bool{
+		"create": true, "rename": true, "drop": true, "scrub": true, "shrink": true, "movecol": true,
+		"setcolconfig": true, "traindict": true, "createview": true, "createts": true, "tsretention": true, "index": true,
+		"unindex": true, "storequery": true, "dropstoredquery": true, "dump": true, "restore": true, "reloadconfig": true}
+	// Document writing endpoints, their requests are recorded if they write to the JWT identity collection.
+	auditedUserEndpoints = map[string]bool{
+		"insert": true, "update": true, "delete": true, "deletebyquery": true, "updatebyquery": true}
+	// Request parameters left out of the records.
+	auditRedacted = map[string]bool{"access_token": true, "pass": true, "doc": true, "patch": true}
+)
+
+// AuditRecord describes an administrative request.
+type AuditRecord struct {
+	Time   int64             `json:"time"`   // Time of the response (Unix seconds)
+	User   string            `json:"user"`   // JWT user, empty without JWT
+	Addr   string            `json:"addr"`   // Client address
+	Action string            `json:"action"` // Endpoint name, e.g. "create"
+	Params map[string]string `json:"params"` // Request parameters
+	Status int               `json:"status"` // HTTP status of the response
+}
+
+// An open audit log.
+type auditLog struct {
+	lock *sync.Mutex
+	file *os.File
+	path string
+	col  string
+}
+
+// Open the audit log file for appending, and create the audit collection if it does not exist yet.
+func openAuditLog(path, col string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if col != "" && HttpDB.Use(col) == nil {
+		if err = HttpDB.Create(col); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return &auditLog{lock: new(sync.Mutex), file: file, path: path, col: col}, nil
+}
+
+// Append the record to the file, and insert it into the audit collection.
+func (log *auditLog) record(rec AuditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		tdlog.CritNoRepeat("Failed to encode audit record: %v", err)
+		return
+	}
+	log.lock.Lock()
+	_, err = log.file.Write(append(line, '\n'))
+	log.lock.Unlock()
+	if err != nil {
+		tdlog.CritNoRepeat("Failed to write audit log %s: %v", log.path, err)
+	}
+	if log.col == "" {
+		return
+	}
+	var doc map[string]interface{}
+	json.Unmarshal(line, &doc)
+	if dbcol := HttpDB.Use(log.col); dbcol == nil {
+		tdlog.CritNoRepeat("Audit collection %s does not exist", log.col)
+	} else if _, err = dbcol.Insert(doc); err != nil {
+		tdlog.CritNoRepeat("Failed to insert audit record into collection %s: %v", log.col, err)
+	}
+}
+
+// Response writer remembering the response status.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// Send and remember the status.
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Send the body, the status is OK unless sent before.
+func (sw *statusWriter) Write(data []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(data)
+}
+
+// Send the response written so far to the client.
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Return the handler recording its administrative requests in the audit log.
+func (log *auditLog) wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := strings.TrimPrefix(r.URL.Path, "/")
+		if !auditedEndpoints[action] && !auditedUserEndpoints[action] {
+			handler(w, r)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		handler(sw, r)
+		// The handler has parsed the parameters
+		params := r.Form
+		if params == nil {
+			params = r.URL.Query()
+		}
+		if !auditedEndpoints[action] && params.Get("col") != JWT_COL_NAME {
+			return
+		}
+		rec := AuditRecord{
+			Time:   time.Now().Unix(),
+			User:   requestUser(r),
+			Addr:   r.RemoteAddr,
+			Action: action,
+			Params: make(map[string]string),
+			Status: sw.status,
+		}
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		for key := range params {
+			if !auditRedacted[key] {
+				rec.Params[key] = params.Get(key)
+			}
+		}
+		log.record(rec)
+	}
+}
+
+// Return the records of the audit log, optionally those of an action or a user, since and until a time (Unix seconds
+// or RFC3339), and only the latest so many of them.
+func AuditLog(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	if audit == nil {
+		httpError(w, errors.New("Audit log is not enabled, please start the server with -auditlog"), http.StatusNotFound)
+		return
+	}
+	var since, until time.Time
+	var err error
+	if sinceStr := r.FormValue("since"); sinceStr != "" {
+		if since, err = parseTime(sinceStr); err != nil {
+			httpError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	if untilStr := r.FormValue("until"); untilStr != "" {
+		if until, err = parseTime(untilStr); err != nil {
+			httpError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	limit := -1
+	if limitStr := r.FormValue("limit"); limitStr != "" {
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 0 {
+			httpError(w, dberr.New(dberr.ErrorInvalidParam, "limit", limitStr), http.StatusBadRequest)
+			return
+		}
+	}
+	action, user := r.FormValue("action"), r.FormValue("user")
+	file, err := os.Open(audit.path)
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	records := make([]AuditRecord, 0)
+	decoder := json.NewDecoder(file)
+	for {
+		var rec AuditRecord
+		if err = decoder.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if action != "" && rec.Action != action || user != "" && rec.User != user ||
+			!since.IsZero() && rec.Time < since.Unix() || !until.IsZero() && rec.Time > until.Unix() {
+			continue
+		}
+		records = append(records, rec)
+	}
+	if limit >= 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	if err = writeResult(w, r, records); err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,106 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cankansin/tiedot/db"
+)
+
+var (
+	requestCreateCol = "http://localhost:8080/create?col=%s"
+	requestAuditLog  = "http://localhost:8080/auditlog"
+)
+
+func TestAuditLog(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(filepath.Join(tempDir, "db")); err != nil {
+		t.Fatal(err)
+	}
+	defer HttpDB.Close()
+	w := httptest.NewRecorder()
+	AuditLog(w, httptest.NewRequest("GET", requestAuditLog, nil))
+	if w.Code != 404 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	logPath := filepath.Join(tempDir, "audit.log")
+	if audit, err = openAuditLog(logPath, "audit"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		audit.file.Close()
+		audit = nil
+	}()
+	as := func(user, method, target, body string) *http.Request {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		return req.WithContext(context.WithValue(req.Context(), userKey{}, user))
+	}
+	// Administrative requests are recorded whether they succeed or not, document writes only to the JWT collection
+	for _, req := range []*http.Request{
+		as("ann", "GET", fmt.Sprintf(requestCreateCol, collection), ""),
+		as("bob", "GET", fmt.Sprintf(requestCreateCol, collection), ""),
+		as("ann", "POST", requestInsertWithoutDoc, `{"a": 1}`),
+		as("ann", "GET", fmt.Sprintf(requestCreateCol, JWT_COL_NAME), ""),
+		as("ann", "POST", "http://localhost:8080/insert?col="+JWT_COL_NAME+"&access_token=secret", `{"user": "bob", "pass": "secret"}`),
+		as("ann", "GET", fmt.Sprintf(requestQueryWithAll, JWT_COL_NAME, `"all"`), ""),
+	} {
+		var handler http.HandlerFunc
+		switch strings.TrimPrefix(req.URL.Path, "/") {
+		case "create":
+			handler = Create
+		case "insert":
+			handler = Insert
+		case "query":
+			handler = Query
+		}
+		audit.wrap(handler)(httptest.NewRecorder(), req)
+	}
+	content, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if strings.Contains(string(content), "secret") {
+		t.Fatal(string(content))
+	}
+	var records []AuditRecord
+	w = httptest.NewRecorder()
+	AuditLog(w, httptest.NewRequest("GET", requestAuditLog, nil))
+	if err = json.Unmarshal(w.Body.Bytes(), &records); err != nil || len(records) != 4 {
+		t.Fatal(w.Code, w.Body.String())
+	} else if rec := records[0]; rec.User != "ann" || rec.Action != "create" || rec.Params["col"] != collection || rec.Status != 201 || rec.Time == 0 {
+		t.Fatal(rec)
+	} else if rec := records[1]; rec.User != "bob" || rec.Status != 409 {
+		t.Fatal(rec)
+	} else if rec := records[3]; rec.Action != "insert" || rec.Params["col"] != JWT_COL_NAME || rec.Status != 201 {
+		t.Fatal(rec)
+	}
+	// Filters
+	w = httptest.NewRecorder()
+	AuditLog(w, httptest.NewRequest("GET", requestAuditLog+"?action=create&user=ann&limit=1&since=0", nil))
+	if err = json.Unmarshal(w.Body.Bytes(), &records); err != nil || len(records) != 1 || records[0].Params["col"] != JWT_COL_NAME {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	AuditLog(w, httptest.NewRequest("GET", requestAuditLog+"?until=2000-01-01T00:00:00Z", nil))
+	if w.Body.String() != "[]" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	AuditLog(w, httptest.NewRequest("GET", requestAuditLog+"?limit=x", nil))
+	if w.Code != 400 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// Records are inserted into the audit collection as well
+	result := make(map[int]struct{})
+	if err = db.EvalAllIDs(HttpDB.Use("audit"), &result); err != nil || len(result) != 4 {
+		t.Fatal(result, err)
+	}
+}
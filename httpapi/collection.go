@@ -4,8 +4,11 @@ package httpapi
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
+	"strconv"
+
+	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/dberr"
 )
 
 // Create a collection.
@@ -19,7 +22,7 @@ func Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err := HttpDB.Create(col); err != nil {
-		http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		httpError(w, err, http.StatusBadRequest)
 	} else {
 		w.WriteHeader(http.StatusCreated)
 	}
@@ -37,7 +40,7 @@ func All(w http.ResponseWriter, r *http.Request) {
 	}
 	resp, err := json.Marshal(cols)
 	if err != nil {
-		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		httpError(w, err, http.StatusInternalServerError)
 		return
 	}
 	w.Write(resp)
@@ -57,7 +60,7 @@ func Rename(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err := HttpDB.Rename(oldName, newName); err != nil {
-		http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		httpError(w, err, http.StatusBadRequest)
 	}
 }
 
@@ -71,8 +74,12 @@ func Drop(w http.ResponseWriter, r *http.Request) {
 	if !Require(w, r, "col", &col) {
 		return
 	}
+	if r.FormValue("dryrun") == "true" {
+		writeDryRun(w, r)(HttpDB.DropDryRun(col))
+		return
+	}
 	if err := HttpDB.Drop(col); err != nil {
-		http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		httpError(w, err, http.StatusBadRequest)
 	}
 }
 
@@ -88,16 +95,236 @@ func Scrub(w http.ResponseWriter, r *http.Request) {
 	}
 	dbCol := HttpDB.Use(col)
 	if dbCol == nil {
-		http.Error(w, fmt.Sprintf("Collection %s does not exist", col), http.StatusBadRequest)
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), http.StatusBadRequest)
 	} else {
 		HttpDB.Scrub(col)
 	}
 }
 
-/*
-Noop
-*/
+// Trim the pre-allocated space of collection files.
+func Shrink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbCol := HttpDB.Use(col)
+	if dbCol == nil {
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), http.StatusBadRequest)
+	} else if err := dbCol.Shrink(); err != nil {
+		httpError(w, err, 500)
+	}
+}
+
+// Read collection files into memory.
+func Warmup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbCol := HttpDB.Use(col)
+	if dbCol == nil {
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte(strconv.Itoa(dbCol.Warmup())))
+}
+
+// Move a collection into another directory.
+func MoveCol(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, dir string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "dir", &dir) {
+		return
+	}
+	if err := HttpDB.MoveCol(col, dir); err != nil {
+		httpError(w, err, http.StatusBadRequest)
+	}
+}
+
+// Return the directory a collection is placed in.
+func Placement(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dir, err := HttpDB.Placement(col)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte(dir))
+}
+
+// Return collection settings.
+func ColConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), http.StatusBadRequest)
+		return
+	}
+	resp, err := json.Marshal(dbcol.Config())
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Write(resp)
+}
+
+// Return the statistics of documents removed by retention of a collection.
+func RetentionStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), http.StatusBadRequest)
+		return
+	}
+	resp, err := json.Marshal(dbcol.RetentionStats())
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Write(resp)
+}
+
+// Train a compression dictionary for the documents archived into a collection, from a sample of the documents of
+// another collection or of its own.
+func TrainDict(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), http.StatusBadRequest)
+		return
+	}
+	var srcCol *db.Col
+	if src := r.FormValue("src"); src != "" {
+		if srcCol = HttpDB.Use(src); srcCol == nil {
+			httpError(w, dberr.New(dberr.ErrorNoCol, src), http.StatusBadRequest)
+			return
+		}
+	}
+	sampleSize := 1000
+	if sample := r.FormValue("sample"); sample != "" {
+		var err error
+		if sampleSize, err = strconv.Atoi(sample); err != nil || sampleSize < 1 {
+			httpError(w, dberr.New(dberr.ErrorInvalidParam, "sample size", sample), http.StatusBadRequest)
+			return
+		}
+	}
+	dictSize, err := dbcol.TrainDict(srcCol, sampleSize)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte(strconv.Itoa(dictSize)))
+}
+
+// Change collection settings, settings absent from the input remain unchanged.
+func SetColConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, config string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "config", &config) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), http.StatusBadRequest)
+		return
+	}
+	conf := dbcol.Config()
+	if err := json.Unmarshal([]byte(config), &conf); err != nil {
+		httpError(w, dberr.New(dberr.ErrorInvalidJSON, config, "collection settings"), http.StatusBadRequest)
+		return
+	}
+	if err := dbcol.SetConfig(conf); err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+	}
+}
+
+// Create a materialized view of the source collection's documents matching a query.
+func CreateView(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, src, q string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "src", &src) {
+		return
+	}
+	if !Require(w, r, "q", &q) {
+		return
+	}
+	def := db.ViewDef{Source: src}
+	if err := json.Unmarshal([]byte(q), &def.Query); err != nil {
+		httpError(w, dberr.New(dberr.ErrorInvalidJSON, q, "query"), http.StatusBadRequest)
+		return
+	}
+	if fields := r.FormValue("fields"); fields != "" {
+		if err := json.Unmarshal([]byte(fields), &def.Fields); err != nil {
+			httpError(w, dberr.New(dberr.ErrorInvalidJSON, fields, "array of paths"), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := HttpDB.CreateView(col, def); err != nil {
+		httpError(w, err, http.StatusBadRequest)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// Flush the data written to all collections to disk.
 func Sync(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
 	w.Header().Set("Content-Type", "text/plain")
+	if err := HttpDB.Flush(); err != nil {
+		httpError(w, err, 500)
+	}
 }
@@ -4,8 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/http/httptest"
-	"strings"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 
 	"bou.ke/monkey"
@@ -24,7 +28,16 @@ var (
 	requestDropMissingParamCol = "http://localhost:8080/drop"
 	requestScrubMissingColl    = "http://localhost:8080/scrub"
 	requestScrub               = fmt.Sprintf("http://localhost:8080/scrub?col=%s", collection)
+	requestMoveCol             = fmt.Sprintf("http://localhost:8080/movecol?col=%s&dir=%%s", collection)
+	requestMoveColMissingDir   = fmt.Sprintf("http://localhost:8080/movecol?col=%s", collection)
+	requestPlacement           = fmt.Sprintf("http://localhost:8080/placement?col=%s", collection)
 	requestSync                = "http://localhost:8080/sync"
+	requestColConfig           = fmt.Sprintf("http://localhost:8080/colconfig?col=%s", collection)
+	requestSetColConfig        = fmt.Sprintf("http://localhost:8080/setcolconfig?col=%s&config=%%s", collection)
+	requestRetentionStats      = "http://localhost:8080/retentionstats?col=%s"
+	requestTrainDict           = "http://localhost:8080/traindict?col=%s&src=%s&sample=%s"
+	requestWarmup              = "http://localhost:8080/warmup?col=%s"
+	requestCreateView          = fmt.Sprintf("http://localhost:8080/createview?col=%s&src=%s&q=%%s&fields=%%s", collectionNew, collection)
 
 	collection    = "Feeds"
 	collectionNew = "Points"
@@ -49,7 +62,15 @@ func TestCollection(t *testing.T) {
 		TScrubMissingCollectParam,
 		TScrubCollectionNotExist,
 		TScrub,
+		TMoveCol,
 		TSync,
+		TColConfig,
+		TSetColConfigInvalidJson,
+		TRetentionStats,
+		TTrainDict,
+		TWarmup,
+		TCreateView,
+		TCreateViewInvalid,
 		TAllErrorMarshal,
 	}
 	managerSubTests(testsCollection, "collection_test", t)
@@ -82,8 +103,8 @@ func TCreateDuplicateCollection(t *testing.T) {
 	Create(w, req)
 	Create(wDubl, req)
 
-	if wDubl.Code != 400 || strings.TrimSpace(wDubl.Body.String()) != fmt.Sprintf("Collection %s already exists", collection) {
-		t.Error("Expected code 400 if collection create duplicate")
+	if wDubl.Code != http.StatusConflict || errorMessage(wDubl) != fmt.Sprintf("Collection %s already exists", collection) {
+		t.Error("Expected code 409 if collection create duplicate")
 	}
 }
 
@@ -141,7 +162,7 @@ func TAllErrorMarshal(t *testing.T) {
 	})
 	defer patch.Unpatch()
 	All(wAll, reqAll)
-	if wAll.Code != 500 || strings.TrimSpace(wAll.Body.String()) != textError {
+	if wAll.Code != 500 || errorMessage(wAll) != textError {
 		t.Error("Expected code 500 and message server error.")
 	}
 }
@@ -186,7 +207,7 @@ func TRenameMissingOldParameter(t *testing.T) {
 	Create(w, reqCreate)
 	Rename(wRename, reqRename)
 
-	if wRename.Code != 400 || strings.TrimSpace(wRename.Body.String()) != "Please pass POST/PUT/GET parameter value of 'old'." {
+	if wRename.Code != 400 || errorMessage(wRename) != "Please pass POST/PUT/GET parameter value of 'old'." {
 		t.Error("Expected error code 400 and message missing parameter old")
 	}
 }
@@ -206,7 +227,7 @@ func TRenameMissingNewParameter(t *testing.T) {
 	Create(w, reqCreate)
 	Rename(wRename, reqRename)
 
-	if wRename.Code != 400 || strings.TrimSpace(wRename.Body.String()) != "Please pass POST/PUT/GET parameter value of 'new'." {
+	if wRename.Code != 400 || errorMessage(wRename) != "Please pass POST/PUT/GET parameter value of 'new'." {
 		t.Error("Expected error code 400 and message missing parameter new")
 	}
 }
@@ -222,7 +243,7 @@ func TRenameError(t *testing.T) {
 	}
 
 	Rename(wRename, reqRename)
-	if wRename.Code != 400 || strings.TrimSpace(wRename.Body.String()) != fmt.Sprintf("Collection %s does not exist", collection) {
+	if wRename.Code != http.StatusNotFound || errorMessage(wRename) != fmt.Sprintf("Collection %s does not exist", collection) {
 		t.Error("Expected error code 400 and message missing collection")
 	}
 }
@@ -267,7 +288,7 @@ func TDropMissingParameterCol(t *testing.T) {
 	Create(w, reqCreate)
 	Drop(wDrop, reqDrop)
 
-	if wDrop.Code != 400 || strings.TrimSpace(wDrop.Body.String()) != "Please pass POST/PUT/GET parameter value of 'col'." {
+	if wDrop.Code != 400 || errorMessage(wDrop) != "Please pass POST/PUT/GET parameter value of 'col'." {
 		t.Error("Expected code 400 and error message missing parameter 'col'")
 	}
 }
@@ -284,8 +305,8 @@ func TDropMissingCol(t *testing.T) {
 
 	Drop(wDrop, reqDrop)
 
-	if wDrop.Code != 400 || strings.TrimSpace(wDrop.Body.String()) != fmt.Sprintf("Collection %s does not exist", collection) {
-		t.Error("Expected code 400 and error message missing collecion")
+	if wDrop.Code != http.StatusNotFound || errorMessage(wDrop) != fmt.Sprintf("Collection %s does not exist", collection) {
+		t.Error("Expected code 404 and error message missing collecion")
 	}
 }
 
@@ -303,7 +324,7 @@ func TScrubMissingCollectParam(t *testing.T) {
 
 	Scrub(w, req)
 
-	if w.Code != 400 || strings.TrimSpace(w.Body.String()) != "Please pass POST/PUT/GET parameter value of 'col'." {
+	if w.Code != 400 || errorMessage(w) != "Please pass POST/PUT/GET parameter value of 'col'." {
 		t.Error("Expected code 400 and error message missing collecion")
 	}
 }
@@ -318,8 +339,8 @@ func TScrubCollectionNotExist(t *testing.T) {
 		panic(err)
 	}
 	Scrub(w, req)
-	if w.Code != 400 || strings.TrimSpace(w.Body.String()) != fmt.Sprintf("Collection %s does not exist", collection) {
-		t.Error("Expected code 400 and error message collecion not exist")
+	if w.Code != http.StatusNotFound || errorMessage(w) != fmt.Sprintf("Collection %s does not exist", collection) {
+		t.Error("Expected code 404 and error message collecion not exist")
 	}
 }
 func TScrub(t *testing.T) {
@@ -343,6 +364,47 @@ func TScrub(t *testing.T) {
 	}
 }
 
+// Test MoveCol and Placement
+func TMoveCol(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	placeDir, err := filepath.Abs(tempDir + "_placed")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(placeDir)
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	defer HttpDB.Close()
+	w := httptest.NewRecorder()
+	MoveCol(w, httptest.NewRequest("GET", fmt.Sprintf(requestMoveCol, url.QueryEscape(placeDir)), nil))
+	if w.Code != http.StatusNotFound {
+		t.Error("Expected code 404 when moving a collection that does not exist")
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest("GET", requestCreate, nil))
+	w = httptest.NewRecorder()
+	MoveCol(w, httptest.NewRequest("GET", requestMoveColMissingDir, nil))
+	if w.Code != 400 || errorMessage(w) != "Please pass POST/PUT/GET parameter value of 'dir'." {
+		t.Error("Expected code 400 and error message missing parameter 'dir'")
+	}
+	w = httptest.NewRecorder()
+	Placement(w, httptest.NewRequest("GET", requestPlacement, nil))
+	if w.Code != 200 || w.Body.String() != "" {
+		t.Error("Expected code 200 and no placement", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	MoveCol(w, httptest.NewRequest("GET", fmt.Sprintf(requestMoveCol, url.QueryEscape(placeDir)), nil))
+	if w.Code != 200 {
+		t.Error("Expected code 200 after call movecol", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	Placement(w, httptest.NewRequest("GET", requestPlacement, nil))
+	if w.Code != 200 || w.Body.String() != placeDir {
+		t.Error("Expected code 200 and the placement directory", w.Code, w.Body.String())
+	}
+}
+
 // Test Sync
 func TSync(t *testing.T) {
 	rSync := httptest.NewRequest("GET", requestSync, nil)
@@ -352,3 +414,195 @@ func TSync(t *testing.T) {
 		t.Error("Expected code 200 and Content-Type: text/plain and Cache-Control : must-revalidate")
 	}
 }
+
+// Test collection settings
+func TColConfig(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	reqCreate := httptest.NewRequest("GET", requestCreate, nil)
+	reqSet := httptest.NewRequest("GET", fmt.Sprintf(requestSetColConfig, url.QueryEscape(`{"Timestamps": true}`)), nil)
+	reqGet := httptest.NewRequest("GET", requestColConfig, nil)
+	wCreate := httptest.NewRecorder()
+	wSet := httptest.NewRecorder()
+	wGet := httptest.NewRecorder()
+
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+
+	Create(wCreate, reqCreate)
+	SetColConfig(wSet, reqSet)
+	ColConfig(wGet, reqGet)
+
+	var conf db.ColConfig
+	if err := json.Unmarshal(wGet.Body.Bytes(), &conf); wSet.Code != 200 || wGet.Code != 200 || err != nil || !conf.Timestamps {
+		t.Error("Expected code 200 and timestamps enabled", wGet.Body.String())
+	}
+}
+func TSetColConfigInvalidJson(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	reqCreate := httptest.NewRequest("GET", requestCreate, nil)
+	reqSet := httptest.NewRequest("GET", fmt.Sprintf(requestSetColConfig, "abc"), nil)
+	wCreate := httptest.NewRecorder()
+	wSet := httptest.NewRecorder()
+
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+
+	Create(wCreate, reqCreate)
+	SetColConfig(wSet, reqSet)
+
+	if wSet.Code != 400 || errorMessage(wSet) != "'abc' is not valid JSON collection settings." {
+		t.Error("Expected code 400 and message error invalid settings")
+	}
+}
+
+// Test retention statistics
+func TRetentionStats(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	dbcol := HttpDB.Use(collection)
+	if err = dbcol.Index([]string{"time"}); err != nil {
+		t.Fatal(err)
+	} else if err = dbcol.SetConfig(db.ColConfig{Retention: 60, RetentionPath: []string{"time"}}); err != nil {
+		t.Fatal(err)
+	} else if _, err = dbcol.Insert(map[string]interface{}{"time": 1}); err != nil {
+		t.Fatal(err)
+	} else if _, err = dbcol.ApplyRetention(); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	RetentionStats(w, httptest.NewRequest("GET", fmt.Sprintf(requestRetentionStats, collection), nil))
+	var stats db.RetentionStats
+	if err = json.Unmarshal(w.Body.Bytes(), &stats); w.Code != 200 || err != nil || stats.Runs != 1 || stats.Deleted != 1 {
+		t.Error("Expected code 200 and one document deleted", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	RetentionStats(w, httptest.NewRequest("GET", fmt.Sprintf(requestRetentionStats, "nosuchcol"), nil))
+	if w.Code != 404 {
+		t.Error("Expected code 404", w.Body.String())
+	}
+}
+
+// Test compression dictionary training
+func TTrainDict(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	} else if err = HttpDB.Create(collectionNew); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err = HttpDB.Use(collection).Insert(map[string]interface{}{"kind": "feed", "n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		col, src, sample string
+		code             int
+	}{
+		{collectionNew, collection, "5", 200},
+		{collectionNew, collection, "0", 400},
+		{collectionNew, "nosuchcol", "5", 404},
+		{collectionNew, "", "5", 400}, // No documents of its own
+	} {
+		w := httptest.NewRecorder()
+		TrainDict(w, httptest.NewRequest("GET", fmt.Sprintf(requestTrainDict, tc.col, tc.src, tc.sample), nil))
+		if w.Code != tc.code {
+			t.Error("Expected code", tc.code, w.Code, w.Body.String())
+		} else if size, err := strconv.Atoi(w.Body.String()); tc.code == 200 && (err != nil || size == 0) {
+			t.Error("Expected dictionary size", w.Body.String())
+		}
+	}
+}
+
+func TWarmup(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	} else if _, err = HttpDB.Use(collection).Insert(map[string]interface{}{"kind": "feed"}); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	Warmup(w, httptest.NewRequest("GET", fmt.Sprintf(requestWarmup, collection), nil))
+	if size, err := strconv.Atoi(w.Body.String()); w.Code != 200 || err != nil || size == 0 {
+		t.Error("Expected size read into memory", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	Warmup(w, httptest.NewRequest("GET", fmt.Sprintf(requestWarmup, "nosuchcol"), nil))
+	if w.Code != 404 {
+		t.Error("Expected code 404", w.Code)
+	}
+}
+
+// Test materialized view
+func TCreateView(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	id, err := HttpDB.Use(collection).Insert(map[string]interface{}{"a": 1, "b": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	CreateView(w, httptest.NewRequest("GET", fmt.Sprintf(requestCreateView, url.QueryEscape(`"all"`), url.QueryEscape(`[["a"]]`)), nil))
+	if w.Code != http.StatusCreated {
+		t.Fatal("Expected code 201", w.Body.String())
+	}
+	if doc, err := HttpDB.Use(collectionNew).Read(id); err != nil || len(doc) != 1 || doc["a"] != float64(1) {
+		t.Error("Expected projected document in view", doc, err)
+	}
+}
+func TCreateViewInvalid(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	w := httptest.NewRecorder()
+	CreateView(w, httptest.NewRequest("GET", fmt.Sprintf(requestCreateView, url.QueryEscape(`"all"`), ""), nil))
+	if w.Code != http.StatusNotFound || errorCode(w) != "no_col" {
+		t.Error("Expected code 404 and collection does not exist", w.Body.String())
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	CreateView(w, httptest.NewRequest("GET", fmt.Sprintf(requestCreateView, "abc", ""), nil))
+	if w.Code != 400 || errorMessage(w) != "'abc' is not valid JSON query." {
+		t.Error("Expected code 400 and invalid query", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	CreateView(w, httptest.NewRequest("GET", fmt.Sprintf(requestCreateView, url.QueryEscape(`"all"`), "abc"), nil))
+	if w.Code != 400 || errorMessage(w) != "'abc' is not valid JSON array of paths." {
+		t.Error("Expected code 400 and invalid fields", w.Body.String())
+	}
+}
@@ -0,0 +1,121 @@
+// Response compression.
+//
+// Responses are compressed by gzip or deflate if the client accepts either by the Accept-Encoding header, and the
+// response body is at least CompressMinSize bytes - smaller bodies are not worth the effort. The body is held back until
+// it reaches the threshold or the response ends, so that the decision is made before anything is sent. A response
+// flushed early by its handler, such as the progress reports of a query operation, is sent as it is unless it already
+// reached the threshold.
+
+package httpapi
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+)
+
+var (
+	CompressMinSize = 1024 // Compress response bodies of at least this many bytes, negative - never compress
+)
+
+// Return the handler compressing the responses of the handler, or the handler itself if compression is disabled.
+func compressHandler(handler http.Handler) http.Handler {
+	if CompressMinSize < 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := acceptable(r, "Accept-Encoding", "gzip", "deflate")
+		if encoding == "" || r.Method == http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: CompressMinSize, status: http.StatusOK}
+		defer cw.close()
+		handler.ServeHTTP(cw, r)
+	})
+}
+
+// Response writer holding back the body until it decides whether to compress the body.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding   string         // Content encoding accepted by the client
+	minSize    int            // Minimum size of compressed body
+	buf        []byte         // Body held back until decided
+	status     int            // Status held back until decided
+	decided    bool           // Set once the status is sent
+	compressor io.WriteCloser // Compresses the body, nil if the body is not compressed
+}
+
+// Hold back the status until deciding whether to compress the body.
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+}
+
+// Hold back the body until it reaches the minimum size for compression, then send it compressed.
+func (cw *compressWriter) Write(data []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, data...)
+		if len(cw.buf) >= cw.minSize {
+			if err := cw.decide(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(data), nil
+	} else if cw.compressor != nil {
+		return cw.compressor.Write(data)
+	}
+	return cw.ResponseWriter.Write(data)
+}
+
+// Send the status and the body held back so far, compressed or not. The body is not compressed if the handler gave it
+// an encoding of its own.
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+	if compress && cw.Header().Get("Content-Encoding") == "" {
+		cw.Header().Set("Content-Encoding", cw.encoding)
+		cw.Header().Del("Content-Length")
+		if cw.encoding == "gzip" {
+			cw.compressor = gzip.NewWriter(cw.ResponseWriter)
+		} else {
+			cw.compressor = zlib.NewWriter(cw.ResponseWriter)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := cw.Write(buf)
+	return err
+}
+
+// Send the response written so far to the client. The body held back is sent without compression.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(false)
+	}
+	if flusher, ok := cw.compressor.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Finish the response once the handler returns.
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		// The body is smaller than the minimum size
+		cw.decide(false)
+	}
+	if cw.compressor != nil {
+		cw.compressor.Close()
+	}
+}
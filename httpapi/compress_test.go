@@ -0,0 +1,93 @@
+package httpapi
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompressHandler(t *testing.T) {
+	defer func(minSize int) {
+		CompressMinSize = minSize
+	}(CompressMinSize)
+	CompressMinSize = 100
+	large := strings.Repeat("tiedot ", 100)
+	handler := compressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		switch r.URL.Path {
+		case "/large":
+			w.WriteHeader(http.StatusCreated)
+			// Written in pieces smaller than the threshold
+			for i := 0; i < len(large); i += 10 {
+				w.Write([]byte(large[i : i+10]))
+			}
+		case "/small":
+			w.Write([]byte("small"))
+		case "/flushed":
+			w.Write([]byte("progress\n"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(large))
+		}
+	}))
+	serve := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost:8080"+path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if !strings.Contains(strings.Join(w.Header()["Vary"], ","), "Accept-Encoding") {
+			t.Fatal(w.Header())
+		}
+		return w
+	}
+	// Large bodies are compressed by the encoding accepted, along with the status
+	w := serve("/large", "gzip, deflate")
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Encoding") != "gzip" || w.Body.Len() >= len(large) {
+		t.Fatal(w.Code, w.Header(), w.Body.Len())
+	}
+	gzipReader, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	} else if body, err := ioutil.ReadAll(gzipReader); err != nil || string(body) != large {
+		t.Fatal(err, string(body))
+	}
+	w = serve("/large", "gzip;q=0, deflate")
+	if w.Header().Get("Content-Encoding") != "deflate" {
+		t.Fatal(w.Header())
+	}
+	zlibReader, err := zlib.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	} else if body, err := ioutil.ReadAll(zlibReader); err != nil || string(body) != large {
+		t.Fatal(err, string(body))
+	}
+	if w = serve("/large", "*"); w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal(w.Header())
+	}
+	// Nothing is compressed without an accepted encoding, nor below the threshold, nor once flushed below it
+	for path, acceptEncoding := range map[string]string{"/large": "", "/small": "gzip", "/flushed": "gzip"} {
+		w = serve(path, acceptEncoding)
+		if w.Code != http.StatusOK && path != "/large" || w.Header().Get("Content-Encoding") != "" {
+			t.Fatal(path, w.Code, w.Header())
+		}
+	}
+	if w = serve("/large", "br"); w.Header().Get("Content-Encoding") != "" || w.Body.String() != large {
+		t.Fatal(w.Header())
+	}
+	// Compression may be disabled
+	CompressMinSize = -1
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://localhost:8080/large", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	compressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(large))
+	})).ServeHTTP(w, req)
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != large {
+		t.Fatal(w.Header())
+	}
+}
@@ -0,0 +1,124 @@
+// Cross-origin resource sharing (CORS).
+//
+// Without configuration, endpoints allow requests from any origin by their own response headers. Once CORSOrigins is
+// configured, only the listed origins are allowed: preflight requests (OPTIONS carrying Access-Control-Request-Method)
+// are answered here without reaching the endpoints - nor authorization, which browsers do not send along - and the
+// CORS headers of other responses are replaced by the configured ones, or removed if the origin is not allowed.
+
+package httpapi
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	CORSOrigins []string      // Origins allowed to make cross-origin requests, "*" - any origin, empty - endpoints allow any origin
+	CORSMethods []string      // Methods allowed in cross-origin requests, empty - GET, POST, PUT, DELETE and OPTIONS
+	CORSHeaders []string      // Request headers allowed in cross-origin requests, empty - the headers used by the API
+	CORSMaxAge  time.Duration // Time browsers may cache the answer to a preflight request, 0 - browser default
+)
+
+const (
+	CORS_EXPOSED_HEADERS = "Authorization, X-Total-Count, Link, ETag, " + SEQ_HEADER // Response headers revealed to cross-origin clients.
+)
+
+// Return the handler applying the configured CORS policy to the handler, or the handler itself if there is none.
+func corsHandler(handler http.Handler) http.Handler {
+	if len(CORSOrigins) == 0 {
+		return handler
+	}
+	methods, headers := CORSMethods, CORSHeaders
+	if len(methods) == 0 {
+		methods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+	}
+	if len(headers) == 0 {
+		headers = []string{"Content-Type", "Content-Length", "Accept", "Accept-Encoding", "X-CSRF-Token", "Authorization", IDEMPOTENCY_HEADER,
+			"If-Match", "If-None-Match", MIN_SEQ_HEADER}
+	}
+	allowMethods, allowHeaders := strings.Join(methods, ", "), strings.Join(headers, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowOrigin := corsAllowOrigin(r.Header.Get("Origin"))
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			// Preflight request
+			w.Header().Add("Vary", "Origin")
+			if allowOrigin != "" {
+				w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+				w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+				w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+				if CORSMaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(CORSMaxAge/time.Second)))
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		cw := &corsWriter{ResponseWriter: w, allowOrigin: allowOrigin}
+		handler.ServeHTTP(cw, r)
+		// The response without body is sent once the handler returns
+		cw.applyHeaders()
+	})
+}
+
+// Return the value of Access-Control-Allow-Origin for the origin, or an empty string if the origin is not allowed.
+func corsAllowOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, allowed := range CORSOrigins {
+		if allowed == "*" {
+			return "*"
+		} else if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// Response writer replacing the CORS headers set by endpoints with those of the configured policy.
+type corsWriter struct {
+	http.ResponseWriter
+	allowOrigin string // Access-Control-Allow-Origin, empty if the origin is not allowed
+	applied     bool   // Set once the headers are replaced
+}
+
+// Replace the CORS headers of the response before the headers are sent.
+func (cw *corsWriter) applyHeaders() {
+	if cw.applied {
+		return
+	}
+	cw.applied = true
+	header := cw.Header()
+	for key := range header {
+		if strings.HasPrefix(key, "Access-Control-") {
+			header.Del(key)
+		}
+	}
+	header.Add("Vary", "Origin")
+	if cw.allowOrigin != "" {
+		header.Set("Access-Control-Allow-Origin", cw.allowOrigin)
+		header.Set("Access-Control-Expose-Headers", CORS_EXPOSED_HEADERS)
+	}
+}
+
+// Send the status along with the CORS headers of the policy.
+func (cw *corsWriter) WriteHeader(status int) {
+	cw.applyHeaders()
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+// Send the body, the headers are sent first if not yet sent.
+func (cw *corsWriter) Write(data []byte) (int, error) {
+	cw.applyHeaders()
+	return cw.ResponseWriter.Write(data)
+}
+
+// Send the response written so far to the client.
+func (cw *corsWriter) Flush() {
+	cw.applyHeaders()
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,85 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORSHandler(t *testing.T) {
+	defer func(origins, methods, headers []string, maxAge time.Duration) {
+		CORSOrigins, CORSMethods, CORSHeaders, CORSMaxAge = origins, methods, headers, maxAge
+	}(CORSOrigins, CORSMethods, CORSHeaders, CORSMaxAge)
+	endpoint := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+		if r.URL.Path == "/unauthorized" {
+			w.WriteHeader(http.StatusUnauthorized)
+		} else if r.URL.Path == "/body" {
+			w.Write([]byte("body"))
+		}
+	})
+	serve := func(handler http.Handler, method, path, origin string, preflight bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://localhost:8080"+path, nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if preflight {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	// Without configuration endpoints answer for themselves
+	CORSOrigins = nil
+	if w := serve(corsHandler(endpoint), "GET", "/body", "http://app.example", false); w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatal(w.Header())
+	}
+	CORSOrigins = []string{"http://app.example"}
+	CORSMethods = []string{"GET", "POST"}
+	CORSMaxAge = time.Hour
+	handler := corsHandler(endpoint)
+	// Preflight requests are answered without reaching the endpoint, which would refuse them
+	w := serve(handler, "OPTIONS", "/unauthorized", "http://APP.example", true)
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "http://APP.example" ||
+		w.Header().Get("Access-Control-Allow-Methods") != "GET, POST" || w.Header().Get("Access-Control-Max-Age") != "3600" ||
+		w.Header().Get("Access-Control-Allow-Headers") == "" || w.Header().Get("Vary") != "Origin" {
+		t.Fatal(w.Code, w.Header())
+	}
+	w = serve(handler, "OPTIONS", "/unauthorized", "http://evil.example", true)
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Fatal(w.Code, w.Header())
+	}
+	// Other requests reach the endpoint, whose CORS headers are replaced - whether or not the response has a body
+	for _, path := range []string{"/body", "/unauthorized", "/empty"} {
+		w = serve(handler, "GET", path, "http://app.example", false)
+		if w.Header().Get("Access-Control-Allow-Origin") != "http://app.example" || w.Header().Get("Access-Control-Allow-Methods") != "" ||
+			w.Header().Get("Access-Control-Expose-Headers") != CORS_EXPOSED_HEADERS {
+			t.Fatal(path, w.Header())
+		}
+		w = serve(handler, "GET", path, "http://evil.example", false)
+		if w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Access-Control-Expose-Headers") != "" {
+			t.Fatal(path, w.Header())
+		}
+	}
+	if w = serve(handler, "OPTIONS", "/body", "http://app.example", false); w.Body.String() != "body" {
+		t.Fatal(w.Body.String())
+	}
+	// Any origin may be allowed
+	CORSOrigins = []string{"*"}
+	if w = serve(corsHandler(endpoint), "POST", "/body", "http://evil.example", false); w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatal(w.Header())
+	}
+	// Compressed responses carry the headers as well
+	CORSOrigins = []string{"http://app.example"}
+	req := httptest.NewRequest("GET", "http://localhost:8080/body", nil)
+	req.Header.Set("Origin", "http://app.example")
+	req.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	corsHandler(compressHandler(endpoint)).ServeHTTP(w, req)
+	if w.Header().Get("Access-Control-Allow-Origin") != "http://app.example" || w.Body.String() != "body" {
+		t.Fatal(w.Header(), w.Body.String())
+	}
+}
@@ -0,0 +1,78 @@
+// Runtime diagnostics.
+//
+// Given Diagnostics, the server serves the profiles of net/http/pprof under /debug/pprof/, the variables of expvar -
+// memory statistics among them - under /debug/vars, and a dump of the database locks and of the stacks of all
+// goroutines under /debug/dump, so that a hung or bloated server can be diagnosed as it runs. The endpoints reveal the
+// internals of the process: with JWT, only user "admin" may use them.
+
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"sync"
+)
+
+var (
+	Diagnostics          bool // Serve the runtime diagnostics endpoints under /debug/
+	MutexProfileFraction int  // Report 1 in this many mutex contention events in the mutex profile, 0 - none
+	BlockProfileRate     int  // Sample one blocking event per this many nanoseconds blocked in the block profile, 0 - none
+)
+
+var publishVars = new(sync.Once)
+
+// Install the diagnostics endpoints, each wrapped by the authorization wrapper.
+func handleDiagnostics(mux *http.ServeMux, authWrap func(http.HandlerFunc) http.HandlerFunc) {
+	runtime.SetMutexProfileFraction(MutexProfileFraction)
+	runtime.SetBlockProfileRate(BlockProfileRate)
+	publishVars.Do(func() {
+		expvar.Publish("tiedot", expvar.Func(func() interface{} {
+			return map[string]interface{}{"cols": len(HttpDB.AllCols()), "change_seq": HttpDB.ChangeSeq(),
+				"applied_seq": HttpDB.AppliedSeq(), "locks": len(HttpDB.Locks())}
+		}))
+	})
+	// Index serves the named profiles, such as /debug/pprof/heap and /debug/pprof/goroutine
+	mux.HandleFunc("/debug/pprof/", authWrap(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", authWrap(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", authWrap(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", authWrap(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", authWrap(pprof.Trace))
+	mux.HandleFunc("/debug/vars", authWrap(expvar.Handler().ServeHTTP))
+	mux.HandleFunc("/debug/dump", authWrap(DebugDump))
+}
+
+// Return the handler refusing requests of JWT users other than "admin".
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestUser(r) != JWT_USER_ADMIN {
+			httpError(w, errors.New("JWT does not authorize the request"), http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Respond with the database locks held and waited for, the lock contention of collections and the stacks of all
+// goroutines, in plain text.
+func DebugDump(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "# Locks")
+	for _, lock := range HttpDB.Locks() {
+		line, _ := json.Marshal(lock)
+		fmt.Fprintf(w, "%s\n", line)
+	}
+	fmt.Fprintln(w, "\n# Lock contention")
+	for _, info := range HttpDB.Contention(10, false) {
+		line, _ := json.Marshal(info)
+		fmt.Fprintf(w, "%s\n", line)
+	}
+	fmt.Fprintln(w, "\n# Goroutines")
+	runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+}
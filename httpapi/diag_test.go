@@ -0,0 +1,62 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cankansin/tiedot/db"
+)
+
+func TestDiagnostics(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		t.Fatal(err)
+	}
+	defer HttpDB.Close()
+	mux := http.NewServeMux()
+	handleDiagnostics(mux, func(handler http.HandlerFunc) http.HandlerFunc {
+		return handler
+	})
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080"+path, nil))
+		return w
+	}
+	if w := serve("/debug/pprof/"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine") {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if w := serve("/debug/pprof/heap"); w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatal(w.Code)
+	}
+	if w := serve("/debug/vars"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"memstats"`) ||
+		!strings.Contains(w.Body.String(), `"change_seq"`) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	locks, err := HttpDB.Use(collection).LockUpdateMany(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer locks.Unlock()
+	if w := serve("/debug/dump"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"kind":"set"`) ||
+		!strings.Contains(w.Body.String(), "TestDiagnostics") {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// JWT users other than admin are refused even if granted the endpoint
+	handler := requireAdmin(DebugDump)
+	for user, status := range map[string]int{"someone": http.StatusUnauthorized, JWT_USER_ADMIN: http.StatusOK} {
+		req := httptest.NewRequest("GET", "http://localhost:8080/debug/dump", nil)
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(context.WithValue(req.Context(), userKey{}, user)))
+		if w.Code != status {
+			t.Fatal(user, w.Code, w.Body.String())
+		}
+	}
+}
@@ -4,12 +4,47 @@ package httpapi
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+
+	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/dberr"
 )
 
+// Store the document given in request body or in parameter "doc" to *doc and return true; if the document is absent,
+// too large or nested too deeply, set HTTP error status and return false. The limits are checked before the document
+// is parsed.
+func requireDoc(w http.ResponseWriter, r *http.Request, doc *string) bool {
+	maxSize := HttpDB.MaxDocSize()
+	defer r.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(io.LimitReader(r.Body, int64(maxSize)+1))
+	*doc = string(bodyBytes)
+	if *doc == "" && !Require(w, r, "doc", doc) {
+		return false
+	}
+	if len(*doc) > maxSize {
+		httpError(w, dberr.New(dberr.ErrorBodyTooLarge, maxSize), http.StatusRequestEntityTooLarge)
+		return false
+	} else if err := HttpDB.CheckDocLimits([]byte(*doc)); err != nil {
+		httpError(w, err, 400)
+		return false
+	}
+	return true
+}
+
+// Parse the JSON (of a document or query) already parsed into *v once again keeping large integers exact, if the
+// collection is set to keep them so.
+func exactJSON(dbcol *db.Col, js string, v interface{}) {
+	if dbcol.ExactNumbers() {
+		db.UnmarshalExact([]byte(js), v)
+	}
+}
+
 // Insert a document into collection.
 func Insert(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
@@ -20,25 +55,35 @@ func Insert(w http.ResponseWriter, r *http.Request) {
 	if !Require(w, r, "col", &col) {
 		return
 	}
-	defer r.Body.Close()
-	bodyBytes, _ := ioutil.ReadAll(r.Body)
-	doc = string(bodyBytes)
-	if doc == "" && !Require(w, r, "doc", &doc) {
+	if !requireDoc(w, r, &doc) {
 		return
 	}
 	var jsonDoc map[string]interface{}
 	if err := json.Unmarshal([]byte(doc), &jsonDoc); err != nil {
-		http.Error(w, fmt.Sprintf("'%v' is not valid JSON document.", doc), 400)
+		httpError(w, dberr.New(dberr.ErrorInvalidJSON, doc, "document"), 400)
 		return
 	}
 	dbcol := HttpDB.Use(col)
 	if dbcol == nil {
-		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
 		return
 	}
-	id, err := dbcol.Insert(jsonDoc)
+	exactJSON(dbcol, doc, &jsonDoc)
+	var id int
+	var err error
+	strID := r.FormValue("id")
+	if principal, restricted := requestPrincipal(r); restricted {
+		if strID != "" {
+			jsonDoc[db.STR_ID_ATTR] = strID
+		}
+		id, err = dbcol.InsertAs(principal, jsonDoc)
+	} else if strID != "" {
+		id, err = dbcol.InsertStrID(strID, jsonDoc)
+	} else {
+		id, err = dbcol.Insert(jsonDoc)
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprint(err), 500)
+		httpError(w, err, 500)
 		return
 	}
 	w.WriteHeader(201)
@@ -58,27 +103,124 @@ func Get(w http.ResponseWriter, r *http.Request) {
 	if !Require(w, r, "id", &id) {
 		return
 	}
-	docID, err := strconv.Atoi(id)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Invalid document ID '%v'.", id), 400)
-		return
-	}
 	dbcol := HttpDB.Use(col)
 	if dbcol == nil {
-		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
 		return
 	}
-	doc, err := dbcol.Read(docID)
+	var doc map[string]interface{}
+	docID, err := dbcol.ResolveID(id)
+	if err == nil {
+		doc, err = readAs(r, dbcol, docID)
+	}
 	if doc == nil {
-		http.Error(w, fmt.Sprintf("No such document ID %d.", docID), 404)
+		httpError(w, dberr.New(dberr.ErrorNoStrDoc, id), 404)
 		return
 	}
-	resp, err := json.Marshal(doc)
-	if err != nil {
-		http.Error(w, fmt.Sprint(err), 500)
+	etag := db.DocETag(doc)
+	w.Header().Set("ETag", etag)
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !etagMatches(ifMatch, etag) {
+		httpError(w, dberr.New(dberr.ErrorDocChanged, id), http.StatusPreconditionFailed)
+		return
+	} else if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
-	w.Write(resp)
+	if err := writeResult(w, r, doc); err != nil {
+		httpError(w, err, 500)
+	}
+}
+
+// Return true if the If-Match or If-None-Match header lists the entity tag, or is "*". Weak tags match their strong
+// counterparts.
+func etagMatches(header, etag string) bool {
+	for _, listed := range strings.Split(header, ",") {
+		if listed = strings.TrimPrefix(strings.TrimSpace(listed), "W/"); listed == "*" || listed == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the condition on the original of a document imposed by the If-Match and If-None-Match headers of the update
+// request, nil if there is none.
+func updateCond(r *http.Request) func(original map[string]interface{}) bool {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+	return func(original map[string]interface{}) bool {
+		etag := db.DocETag(original)
+		return (ifMatch == "" || etagMatches(ifMatch, etag)) && (ifNoneMatch == "" || !etagMatches(ifNoneMatch, etag))
+	}
+}
+
+// Find and retrieve documents by a JSON array of IDs - numeric document IDs and/or string IDs. Return an object of the
+// found documents, keyed by ID.
+func GetBatch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, ids string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "ids", &ids) {
+		return
+	}
+	// Document IDs are too large for float64
+	var idVals []interface{}
+	decoder := json.NewDecoder(strings.NewReader(ids))
+	decoder.UseNumber()
+	if err := decoder.Decode(&idVals); err != nil {
+		httpError(w, dberr.New(dberr.ErrorInvalidJSON, ids, "array of IDs"), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
+		return
+	}
+	// Documents by string ID are reported by their string ID, a document requested both ways is reported under both
+	docIDs := make([]int, 0, len(idVals))
+	strIDs := make([]string, 0, len(idVals))
+	numeric := make(map[string]struct{}, len(idVals))
+	for _, idVal := range idVals {
+		switch idVal := idVal.(type) {
+		case json.Number:
+			docID, err := strconv.Atoi(idVal.String())
+			if err != nil {
+				httpError(w, dberr.New(dberr.ErrorInvalidParam, "document ID", idVal), 400)
+				return
+			}
+			docIDs = append(docIDs, docID)
+			numeric[strconv.Itoa(docID)] = struct{}{}
+		case string:
+			strIDs = append(strIDs, idVal)
+		default:
+			httpError(w, dberr.New(dberr.ErrorInvalidParam, "document ID", idVal), 400)
+			return
+		}
+	}
+	// The response could not tell a string ID looking like a number from the document ID
+	for _, strID := range strIDs {
+		if _, ambiguous := numeric[strID]; ambiguous {
+			httpError(w, dberr.New(dberr.ErrorInvalidParam, "document ID", strID), 400)
+			return
+		}
+	}
+	docs := make(map[string]interface{}, len(idVals))
+	for docID, doc := range dbcol.ReadBatch(docIDs) {
+		docs[strconv.Itoa(docID)] = doc
+	}
+	for strID, doc := range dbcol.ReadBatchStrID(strIDs) {
+		docs[strID] = doc
+	}
+	filterAllowed(r, dbcol, docs)
+	if err := writeResult(w, r, docs); err != nil {
+		httpError(w, err, 500)
+	}
 }
 
 // Divide documents into roughly equally sized pages, and return documents in the specified page.
@@ -99,17 +241,17 @@ func GetPage(w http.ResponseWriter, r *http.Request) {
 	}
 	totalPage, err := strconv.Atoi(total)
 	if err != nil || totalPage < 1 {
-		http.Error(w, fmt.Sprintf("Invalid total page number '%v'.", totalPage), 400)
+		httpError(w, dberr.New(dberr.ErrorInvalidParam, "total page number", totalPage), 400)
 		return
 	}
 	pageNum, err := strconv.Atoi(page)
 	if err != nil || pageNum < 0 || pageNum >= totalPage {
-		http.Error(w, fmt.Sprintf("Invalid page number '%v'.", page), 400)
+		httpError(w, dberr.New(dberr.ErrorInvalidParam, "page number", page), 400)
 		return
 	}
 	dbcol := HttpDB.Use(col)
 	if dbcol == nil {
-		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
 		return
 	}
 	docs := make(map[string]interface{})
@@ -120,12 +262,94 @@ func GetPage(w http.ResponseWriter, r *http.Request) {
 		}
 		return true
 	})
-	resp, err := json.Marshal(docs)
+	filterAllowed(r, dbcol, docs)
+	if err := writeResult(w, r, docs); err != nil {
+		httpError(w, err, 500)
+	}
+}
+
+// Return the most recently inserted documents, newest first.
+func Latest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, n string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "n", &n) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
+		return
+	}
+	num, err := strconv.Atoi(n)
 	if err != nil {
-		http.Error(w, fmt.Sprint(err), 500)
+		httpError(w, dberr.New(dberr.ErrorInvalidParam, "number of documents", n), 400)
 		return
 	}
-	w.Write(resp)
+	ids, err := dbcol.Latest(num)
+	if err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	writeDocList(w, r, dbcol, ids)
+}
+
+// Return the documents inserted after a document, oldest first.
+func Tail(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, after, n string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "after", &after) {
+		return
+	}
+	if !Require(w, r, "n", &n) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
+		return
+	}
+	afterID, err := strconv.Atoi(after)
+	if err != nil {
+		httpError(w, dberr.New(dberr.ErrorInvalidParam, "id", after), 400)
+		return
+	}
+	num, err := strconv.Atoi(n)
+	if err != nil {
+		httpError(w, dberr.New(dberr.ErrorInvalidParam, "number of documents", n), 400)
+		return
+	}
+	ids, err := dbcol.InsertedAfter(afterID, num)
+	if err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	writeDocList(w, r, dbcol, ids)
+}
+
+// Write the documents in order as a list of {"id": ..., "doc": ...}, leaving out those deleted meanwhile or not
+// accessible to the request's principal.
+func writeDocList(w http.ResponseWriter, r *http.Request, dbcol *db.Col, ids []int) {
+	result := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		if doc, err := readAs(r, dbcol, id); err == nil {
+			result = append(result, map[string]interface{}{"id": id, "doc": doc})
+		}
+	}
+	if err := writeResult(w, r, result); err != nil {
+		httpError(w, err, 500)
+	}
 }
 
 // Update a document.
@@ -141,30 +365,44 @@ func Update(w http.ResponseWriter, r *http.Request) {
 	if !Require(w, r, "id", &id) {
 		return
 	}
-	defer r.Body.Close()
-	bodyBytes, _ := ioutil.ReadAll(r.Body)
-	doc = string(bodyBytes)
-	if doc == "" && !Require(w, r, "doc", &doc) {
-		return
-	}
-	docID, err := strconv.Atoi(id)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Invalid document ID '%v'.", id), 400)
+	if !requireDoc(w, r, &doc) {
 		return
 	}
 	var newDoc map[string]interface{}
 	if err := json.Unmarshal([]byte(doc), &newDoc); err != nil {
-		http.Error(w, fmt.Sprintf("'%v' is not valid JSON document.", newDoc), 400)
+		httpError(w, dberr.New(dberr.ErrorInvalidJSON, doc, "document"), 400)
 		return
 	}
 	dbcol := HttpDB.Use(col)
 	if dbcol == nil {
-		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
 		return
 	}
-	err = dbcol.Update(docID, newDoc)
+	exactJSON(dbcol, doc, &newDoc)
+	docID, err := dbcol.ResolveID(id)
+	if err != nil {
+		httpError(w, dberr.New(dberr.ErrorNoStrDoc, id), 404)
+		return
+	}
+	if strconv.Itoa(docID) != id {
+		// The document is identified by string ID, retain it in the updated document
+		newDoc[db.STR_ID_ATTR] = id
+	} else if _, hasStrID := newDoc[db.STR_ID_ATTR]; !hasStrID {
+		// Retain the string ID of a document identified by integer ID
+		if original, err := readAs(r, dbcol, docID); err == nil && original[db.STR_ID_ATTR] != nil {
+			newDoc[db.STR_ID_ATTR] = original[db.STR_ID_ATTR]
+		}
+	}
+	if principal, restricted := requestPrincipal(r); restricted {
+		err = dbcol.UpdateAsIf(principal, docID, newDoc, updateCond(r))
+	} else {
+		var etag string
+		if etag, err = dbcol.UpdateIf(docID, newDoc, updateCond(r)); err == nil {
+			w.Header().Set("ETag", etag)
+		}
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprint(err), 500)
+		httpError(w, err, 500)
 		return
 	}
 }
@@ -182,17 +420,46 @@ func Delete(w http.ResponseWriter, r *http.Request) {
 	if !Require(w, r, "id", &id) {
 		return
 	}
-	docID, err := strconv.Atoi(id)
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
+		return
+	}
+	docID, err := dbcol.ResolveID(id)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Invalid document ID '%v'.", id), 400)
+		httpError(w, dberr.New(dberr.ErrorNoStrDoc, id), 404)
 		return
 	}
-	dbcol := HttpDB.Use(col)
-	if dbcol == nil {
-		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+	if principal, restricted := requestPrincipal(r); restricted {
+		err = dbcol.DeleteAs(principal, docID)
+	} else {
+		err = dbcol.Delete(docID)
+	}
+	if err != nil {
+		httpError(w, err, 500)
 		return
 	}
-	dbcol.Delete(docID)
+}
+
+// Read a document on behalf of the request's principal, see requestPrincipal.
+func readAs(r *http.Request, dbcol *db.Col, id int) (map[string]interface{}, error) {
+	if principal, restricted := requestPrincipal(r); restricted {
+		return dbcol.ReadAs(principal, id)
+	}
+	return dbcol.Read(id)
+}
+
+// Remove the documents the request's principal may not access from the documents keyed by ID.
+func filterAllowed(r *http.Request, dbcol *db.Col, docs map[string]interface{}) {
+	principal, restricted := requestPrincipal(r)
+	if !restricted {
+		return
+	}
+	for id, doc := range docs {
+		if docObj, _ := doc.(map[string]interface{}); !dbcol.Allows(principal, docObj) {
+			delete(docs, id)
+		}
+	}
 }
 
 // Return approximate number of documents in the collection.
@@ -207,8 +474,157 @@ func ApproxDocCount(w http.ResponseWriter, r *http.Request) {
 	}
 	dbcol := HttpDB.Use(col)
 	if dbcol == nil {
-		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
 		return
 	}
 	w.Write([]byte(strconv.Itoa(dbcol.ApproxDocCount())))
 }
+
+// A write of a transaction as given in request parameter "writes".
+type txWrite struct {
+	Op  string                 `json:"op"`
+	Col string                 `json:"col"`
+	ID  string                 `json:"id"` // Document ID or string ID of the document to update or delete
+	Doc map[string]interface{} `json:"doc"`
+}
+
+// Apply the writes given in parameter "writes", a JSON array of {"op": "insert", "update" or "delete", "col", "id",
+// "doc"}, all or nothing. Respond with the IDs of the written documents (strings) in the order of writes.
+func Transact(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var writesJS string
+	if !Require(w, r, "writes", &writesJS) {
+		return
+	}
+	var writes []txWrite
+	if err := json.Unmarshal([]byte(writesJS), &writes); err != nil {
+		httpError(w, dberr.New(dberr.ErrorInvalidJSON, writesJS, "writes"), 400)
+		return
+	}
+	if _, restricted := requestPrincipal(r); restricted {
+		httpError(w, errors.New("Transactions are not available to users restricted by document access control"), 403)
+		return
+	}
+	txWrites := make([]db.TxWrite, len(writes))
+	for i, write := range writes {
+		if !requestMayUse(r, write.Col) {
+			httpError(w, errors.New("JWT does not authorize the request"), http.StatusUnauthorized)
+			return
+		}
+		dbcol := HttpDB.Use(write.Col)
+		if dbcol == nil {
+			httpError(w, dberr.New(dberr.ErrorNoCol, write.Col), 400)
+			return
+		}
+		txWrites[i] = db.TxWrite{Op: write.Op, Col: write.Col, Doc: write.Doc}
+		if write.Op != db.TX_INSERT {
+			docID, err := dbcol.ResolveID(write.ID)
+			if err != nil {
+				httpError(w, dberr.New(dberr.ErrorNoStrDoc, write.ID), 404)
+				return
+			}
+			txWrites[i].ID = docID
+			if strconv.Itoa(docID) != write.ID && write.Doc != nil {
+				// The document is identified by string ID, retain it in the updated document
+				write.Doc[db.STR_ID_ATTR] = write.ID
+			}
+		}
+	}
+	ids, err := HttpDB.Transact(txWrites)
+	if err != nil {
+		httpError(w, err, 500)
+		return
+	}
+	strIDs := make([]string, len(ids))
+	for i, id := range ids {
+		strIDs[i] = strconv.Itoa(id)
+	}
+	resp, err := json.Marshal(strIDs)
+	if err != nil {
+		httpError(w, err, 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Outcome of a write of a bulk request.
+type bulkResult struct {
+	Status int            `json:"status"`          // HTTP status the write would have had on its own
+	ID     string         `json:"id,omitempty"`    // ID of the written document
+	Error  *errorResponse `json:"error,omitempty"` // Error of the failed write
+}
+
+// Apply the writes given in parameter "writes", a JSON array of {"op": "insert", "update" or "delete", "col", "id",
+// "doc"}, each on its own in batches. Respond with {"errors": true if any write failed, "items": the outcome of each
+// write in the order of writes}.
+func Bulk(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var writesJS string
+	if !Require(w, r, "writes", &writesJS) {
+		return
+	}
+	var writes []txWrite
+	if err := json.Unmarshal([]byte(writesJS), &writes); err != nil {
+		httpError(w, dberr.New(dberr.ErrorInvalidJSON, writesJS, "writes"), 400)
+		return
+	}
+	if _, restricted := requestPrincipal(r); restricted {
+		httpError(w, errors.New("Bulk writes are not available to users restricted by document access control"), 403)
+		return
+	}
+	// Writes that cannot be resolved fail on their own, the others are applied together
+	results := make([]bulkResult, len(writes))
+	fail := func(i int, err error, status int) {
+		resp, status := errorResponseOf(err, status)
+		results[i] = bulkResult{Status: status, Error: &resp}
+	}
+	var bulkWrites []db.TxWrite
+	var positions []int
+	for i, write := range writes {
+		if !requestMayUse(r, write.Col) {
+			fail(i, errors.New("JWT does not authorize the request"), http.StatusUnauthorized)
+			continue
+		}
+		bulkWrite := db.TxWrite{Op: write.Op, Col: write.Col, Doc: write.Doc}
+		if dbcol := HttpDB.Use(write.Col); dbcol != nil && write.Op != db.TX_INSERT {
+			docID, err := dbcol.ResolveID(write.ID)
+			if err != nil {
+				fail(i, dberr.New(dberr.ErrorNoStrDoc, write.ID), 404)
+				continue
+			}
+			bulkWrite.ID = docID
+			if strconv.Itoa(docID) != write.ID && write.Doc != nil {
+				// The document is identified by string ID, retain it in the updated document
+				write.Doc[db.STR_ID_ATTR] = write.ID
+			}
+		}
+		bulkWrites = append(bulkWrites, bulkWrite)
+		positions = append(positions, i)
+	}
+	ids, errs := HttpDB.Bulk(bulkWrites)
+	for j, i := range positions {
+		if errs[j] != nil {
+			fail(i, errs[j], 500)
+		} else if writes[i].Op == db.TX_INSERT {
+			results[i] = bulkResult{Status: http.StatusCreated, ID: strconv.Itoa(ids[j])}
+		} else {
+			results[i] = bulkResult{Status: http.StatusOK, ID: strconv.Itoa(ids[j])}
+		}
+	}
+	failed := false
+	for _, result := range results {
+		failed = failed || result.Error != nil
+	}
+	resp, err := json.Marshal(map[string]interface{}{"errors": failed, "items": results})
+	if err != nil {
+		httpError(w, err, 500)
+		return
+	}
+	w.Write(resp)
+}
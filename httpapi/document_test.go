@@ -2,11 +2,14 @@ package httpapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strconv"
 	"strings"
 	"testing"
@@ -19,8 +22,10 @@ import (
 var (
 	requestInsertWithoutDoc = fmt.Sprintf("http://localhost:8080/insert?col=%s", collection)
 	requestInsertWithoutCol = "http://localhost:8080/insert"
+	requestInsertStrId      = "http://localhost:8080/insert?col=%s&id=%s"
 
 	requestGet       = "http://localhost:8080/get?col=%s&id=%s"
+	requestGetBatch  = "http://localhost:8080/getbatch?col=%s&ids=%s"
 	requestGetNotCol = "http://localhost:8080/get?id=%s"
 	requestGetNotId  = "http://localhost:8080/get?col=%s"
 
@@ -38,6 +43,9 @@ var (
 	requestDeleteNotId  = "http://localhost:8080/delete?col=%s"
 	requestDelete       = "http://localhost:8080/delete?col=%s&id=%s"
 
+	requestTransact = "http://localhost:8080/transact?writes=%s"
+	requestBulk     = "http://localhost:8080/bulk?writes=%s"
+
 	requestApproxDocCountNotCol = "http://localhost:8080/approxdoccount"
 	requestApproxDocCount       = "http://localhost:8080/approxdoccount?col=%s"
 
@@ -54,9 +62,14 @@ func TestDocument(t *testing.T) {
 		TInsert,
 		TInsertCollectionNotExist,
 		TInsertError,
+		TInsertBodyTooLarge,
+		TInsertTooDeep,
 		TGet,
+		TGetBatch,
+		TGetBatchInvalid,
 		TGetMarshalError,
-		TGetInvalidId,
+		TGetUnknownStrId,
+		TInsertGetStrId,
 		TGetCollectionNotExist,
 		TGetNoSuchDocument,
 		TGetNotParamCol,
@@ -72,14 +85,15 @@ func TestDocument(t *testing.T) {
 		TUpdateNotCol,
 		TUpdateNotId,
 		TUpdateNotDoc,
-		TUpdateInvalidId,
+		TUpdateUnknownStrId,
 		TUpdateJsonError,
 		TUpdateCollectionNotExist,
 		TUpdate,
+		TUpdateKeepStrId,
 		TUpdateError,
 		TDeleteNotCol,
 		TDeleteNotId,
-		TDeleteInvalidId,
+		TDeleteUnknownStrId,
 		TDeleteCollectionNotExist,
 		TDelete,
 		TApproxDocCountNotCol,
@@ -102,7 +116,7 @@ func TInsertNotExistParamCol(t *testing.T) {
 	}
 	Insert(w, req)
 
-	if w.Code != 400 || strings.TrimSpace(w.Body.String()) != "Please pass POST/PUT/GET parameter value of 'col'." {
+	if w.Code != 400 || errorMessage(w) != "Please pass POST/PUT/GET parameter value of 'col'." {
 		t.Error("Expected code 400 and message error parameter col not exist")
 	}
 }
@@ -124,7 +138,7 @@ func TInsertEmptyDoc(t *testing.T) {
 	Create(wCreate, reqCreate)
 	Insert(wInsert, reqInsert)
 
-	if wInsert.Code != 400 || strings.TrimSpace(wInsert.Body.String()) != "Please pass POST/PUT/GET parameter value of 'doc'." {
+	if wInsert.Code != 400 || errorMessage(wInsert) != "Please pass POST/PUT/GET parameter value of 'doc'." {
 		t.Error("Expected code 400 and message error not exist parameter 'doc'")
 	}
 }
@@ -146,7 +160,7 @@ func TInsertErrorUnmarshal(t *testing.T) {
 	Create(wCreate, reqCreate)
 	Insert(wInsert, reqInsert)
 
-	if wInsert.Code != 400 || strings.TrimSpace(wInsert.Body.String()) != "'doc='{\"a\": 1, \"b\": 2}'' is not valid JSON document." {
+	if wInsert.Code != 400 || errorMessage(wInsert) != "'doc='{\"a\": 1, \"b\": 2}'' is not valid JSON document." {
 		t.Error("Expected code 400 and message error not valid json")
 	}
 }
@@ -191,15 +205,16 @@ func TInsertCollectionNotExist(t *testing.T) {
 	}
 	Insert(wInsert, reqInsert)
 
-	if wInsert.Code != 400 || strings.TrimSpace(wInsert.Body.String()) != fmt.Sprintf("Collection '%s' does not exist.", collection) {
-		t.Error("Expected code 400 and message error not exist is collection.")
+	if wInsert.Code != http.StatusNotFound || errorMessage(wInsert) != fmt.Sprintf("Collection %s does not exist", collection) {
+		t.Error("Expected code 404 and message error not exist is collection.")
 	}
 }
 func TInsertError(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
 
-	sizeByte := data.DefaultDocMaxRoom
+	// Small enough for request body, but documents are given twice the room on disk
+	sizeByte := data.DefaultDocMaxRoom / 2
 	stringJson := fmt.Sprintf("{\"a\": 1, \"b\": \"%s\"}", RandStringBytes(sizeByte))
 	b := bytes.NewBuffer([]byte(stringJson))
 	reqCreate := httptest.NewRequest(RandMethodRequest(), requestCreate, nil)
@@ -214,12 +229,130 @@ func TInsertError(t *testing.T) {
 	Create(wCreate, reqCreate)
 	Insert(wInsert, reqInsert)
 
-	if wInsert.Code != 500 || strings.TrimSpace(wInsert.Body.String()) != "Document is too large. Max: `2097152`, Given: `4194332`" {
-		t.Error("Expected code 500 and message document is too large.")
+	if wInsert.Code != http.StatusRequestEntityTooLarge || errorMessage(wInsert) != "Document is too large. Max: `2097152`, Given: `2097180`" {
+		t.Error("Expected code 413 and message document is too large.", wInsert.Body.String())
+	}
+}
+func TInsertBodyTooLarge(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+
+	stringJson := fmt.Sprintf("{\"a\": 1, \"b\": \"%s\"}", RandStringBytes(data.DefaultDocMaxRoom))
+	reqCreate := httptest.NewRequest(RandMethodRequest(), requestCreate, nil)
+	reqInsert := httptest.NewRequest(RandMethodRequest(), requestInsertWithoutDoc, bytes.NewBufferString(stringJson))
+	wInsert := httptest.NewRecorder()
+	wCreate := httptest.NewRecorder()
+
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(wCreate, reqCreate)
+	Insert(wInsert, reqInsert)
+
+	if wInsert.Code != http.StatusRequestEntityTooLarge || errorCode(wInsert) != "body_too_large" || errorMessage(wInsert) != "Request body is too large. Max: `2097152`" {
+		t.Error("Expected code 413 and message request body is too large.", wInsert.Body.String())
+	}
+}
+func TInsertTooDeep(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+
+	stringJson := "{\"a\": " + strings.Repeat("[", data.DefaultMaxDocDepth) + strings.Repeat("]", data.DefaultMaxDocDepth) + "}"
+	reqCreate := httptest.NewRequest(RandMethodRequest(), requestCreate, nil)
+	reqInsert := httptest.NewRequest(RandMethodRequest(), requestInsertWithoutDoc, bytes.NewBufferString(stringJson))
+	wInsert := httptest.NewRecorder()
+	wCreate := httptest.NewRecorder()
+
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(wCreate, reqCreate)
+	Insert(wInsert, reqInsert)
+
+	if wInsert.Code != 400 || errorCode(wInsert) != "doc_too_deep" || errorMessage(wInsert) != "Document is nested too deeply. Max depth: `100`" {
+		t.Error("Expected code 400 and message document is nested too deeply.", wInsert.Body.String())
 	}
 }
 
 // Test Get
+func TGetBatch(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	dbcol := HttpDB.Use(collection)
+	id, err := dbcol.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = dbcol.InsertStrID("str", map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	}
+	ids := url.QueryEscape(fmt.Sprintf(`[%d, "str", 12345, "nonexistent"]`, id))
+	w := httptest.NewRecorder()
+	GetBatch(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGetBatch, collection, ids), nil))
+	var docs map[string]map[string]interface{}
+	if err = json.Unmarshal(w.Body.Bytes(), &docs); err != nil {
+		t.Fatal(err, w.Body.String())
+	}
+	if w.Code != 200 || len(docs) != 2 || docs[strconv.Itoa(id)]["a"] != float64(1) || docs["str"]["a"] != float64(2) {
+		t.Error("Expected code 200 and the existing documents", w.Body.String())
+	}
+	// A document requested by both its IDs is reported under both
+	strDocID, err := dbcol.StrIDToID("str")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = url.QueryEscape(fmt.Sprintf(`["str", %d]`, strDocID))
+	w = httptest.NewRecorder()
+	GetBatch(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGetBatch, collection, ids), nil))
+	docs = nil
+	if err = json.Unmarshal(w.Body.Bytes(), &docs); err != nil {
+		t.Fatal(err, w.Body.String())
+	}
+	if w.Code != 200 || len(docs) != 2 || docs[strconv.Itoa(strDocID)]["a"] != float64(2) || docs["str"]["a"] != float64(2) {
+		t.Error("Expected code 200 and the document under both IDs", w.Body.String())
+	}
+	// A string ID cannot be told apart from the same document ID in the response
+	ids = url.QueryEscape(fmt.Sprintf(`[%d, "%d"]`, id, id))
+	w = httptest.NewRecorder()
+	GetBatch(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGetBatch, collection, ids), nil))
+	if w.Code != 400 || errorCode(w) != "invalid_param" {
+		t.Error("Expected code 400 and invalid document ID", w.Body.String())
+	}
+}
+func TGetBatchInvalid(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	w := httptest.NewRecorder()
+	GetBatch(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGetBatch, collection, "[1]"), nil))
+	if w.Code != http.StatusNotFound || errorCode(w) != "no_col" {
+		t.Error("Expected code 404 and collection does not exist", w.Body.String())
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	GetBatch(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGetBatch, collection, "abc"), nil))
+	if w.Code != 400 || errorMessage(w) != "'abc' is not valid JSON array of IDs." {
+		t.Error("Expected code 400 and invalid JSON", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	GetBatch(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGetBatch, collection, "[1.5]"), nil))
+	if w.Code != 400 || errorMessage(w) != "Invalid document ID '1.5'." {
+		t.Error("Expected code 400 and invalid document ID", w.Body.String())
+	}
+}
 func TGet(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
@@ -250,7 +383,7 @@ func TGet(t *testing.T) {
 		t.Error("Expected code 200 and get document from collection")
 	}
 }
-func TGetInvalidId(t *testing.T) {
+func TGetUnknownStrId(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
 	var err error
@@ -258,18 +391,47 @@ func TGetInvalidId(t *testing.T) {
 		panic(err)
 	}
 
-	b := &bytes.Buffer{}
-	jsonStr := "{\"a\":1,\"b\":2}"
-	b.WriteString(jsonStr)
+	reqCreate := httptest.NewRequest(RandMethodRequest(), requestCreate, nil)
+	wCreate := httptest.NewRecorder()
+	wGet := httptest.NewRecorder()
+
+	randStrId := RandStringBytes(5)
+	reqGet := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGet, collection, randStrId), nil)
+	Create(wCreate, reqCreate)
+	Get(wGet, reqGet)
 
+	if wGet.Code != http.StatusNotFound || errorMessage(wGet) != fmt.Sprintf("Document `%s` does not exist", randStrId) {
+		t.Error("Expected code 404 and message error not such document")
+	}
+}
+func TInsertGetStrId(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+
+	strId := "5f0b3c9e-6a4e-4b8e-9d0c-1f2e3d4c5b6a"
+	reqCreate := httptest.NewRequest(RandMethodRequest(), requestCreate, nil)
+	reqInsert := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestInsertStrId, collection, strId), bytes.NewBufferString("{\"a\":1}"))
+	reqInsertDup := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestInsertStrId, collection, strId), bytes.NewBufferString("{\"a\":2}"))
+	reqGet := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGet, collection, strId), nil)
+	wCreate := httptest.NewRecorder()
+	wInsert := httptest.NewRecorder()
+	wInsertDup := httptest.NewRecorder()
 	wGet := httptest.NewRecorder()
 
-	randIntStr := RandStringBytes(5)
-	reqGet := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGet, collection, randIntStr), b)
+	Create(wCreate, reqCreate)
+	Insert(wInsert, reqInsert)
+	Insert(wInsertDup, reqInsertDup)
 	Get(wGet, reqGet)
 
-	if wGet.Code != 400 || strings.TrimSpace(wGet.Body.String()) != fmt.Sprintf("Invalid document ID '%s'.", randIntStr) {
-		t.Error("Expected code 404 and message error invalid document ID")
+	if wInsert.Code != 201 || wInsertDup.Code != 409 {
+		t.Error("Expected code 201 for new string ID and 409 for duplicated string ID")
+	}
+	if wGet.Code != 200 || strings.TrimSpace(wGet.Body.String()) != fmt.Sprintf("{\"_id\":\"%s\",\"a\":1}", strId) {
+		t.Error("Expected code 200 and get document by string ID", wGet.Body.String())
 	}
 }
 func TGetCollectionNotExist(t *testing.T) {
@@ -295,8 +457,8 @@ func TGetCollectionNotExist(t *testing.T) {
 	Create(wCreate, reqCreate)
 	Get(wGet, reqGet)
 
-	if wGet.Code != 400 || strings.TrimSpace(wGet.Body.String()) != fmt.Sprintf("Collection '%s' does not exist.", collectionFake) {
-		t.Error("Expected code 400 and message error not exist collection")
+	if wGet.Code != http.StatusNotFound || errorMessage(wGet) != fmt.Sprintf("Collection %s does not exist", collectionFake) {
+		t.Error("Expected code 404 and message error not exist collection")
 	}
 }
 func TGetNoSuchDocument(t *testing.T) {
@@ -322,7 +484,7 @@ func TGetNoSuchDocument(t *testing.T) {
 	Create(wCreate, reqCreate)
 	Get(wGet, reqGet)
 
-	if wGet.Code != 404 || strings.TrimSpace(wGet.Body.String()) != fmt.Sprintf("No such document ID %s.", randIntStr) {
+	if wGet.Code != http.StatusNotFound || errorMessage(wGet) != fmt.Sprintf("Document `%s` does not exist", randIntStr) {
 		t.Error("Expected code 404 and message error not such document")
 	}
 }
@@ -341,7 +503,7 @@ func TGetNotParamCol(t *testing.T) {
 
 	Get(wGet, reqGet)
 
-	if wGet.Code != 400 || strings.TrimSpace(wGet.Body.String()) != "Please pass POST/PUT/GET parameter value of 'col'." {
+	if wGet.Code != 400 || errorMessage(wGet) != "Please pass POST/PUT/GET parameter value of 'col'." {
 		t.Error("Expected code 400 and message error not such param 'col'")
 	}
 }
@@ -357,7 +519,7 @@ func TGetNotParamId(t *testing.T) {
 	wGet := httptest.NewRecorder()
 	Get(wGet, reqGet)
 
-	if wGet.Code != 400 || strings.TrimSpace(wGet.Body.String()) != "Please pass POST/PUT/GET parameter value of 'id'." {
+	if wGet.Code != 400 || errorMessage(wGet) != "Please pass POST/PUT/GET parameter value of 'id'." {
 		t.Error("Expected code 400 and message error not such param 'id'")
 	}
 }
@@ -385,13 +547,13 @@ func TGetMarshalError(t *testing.T) {
 
 	textError := "Json marshal error"
 	reqGet := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGet, collection, strings.TrimSpace(wInsert.Body.String())), nil)
-	patch := monkey.Patch(json.Marshal, func(interface{}) ([]byte, error) {
-		return nil, errors.New(textError)
+	patch := monkey.Patch(encodeJSON, func(*bytes.Buffer, interface{}) error {
+		return errors.New(textError)
 	})
 	defer patch.Unpatch()
 	Get(wGet, reqGet)
 
-	if wGet.Code != 500 || strings.TrimSpace(wGet.Body.String()) != textError {
+	if wGet.Code != 500 || errorMessage(wGet) != textError {
 		t.Error("Expected code 500 and json marshal error.")
 	}
 }
@@ -411,7 +573,7 @@ func TGetPageNotCol(t *testing.T) {
 
 	GetPage(wGetPage, reqGetPage)
 
-	if wGetPage.Code != 400 || strings.TrimSpace(wGetPage.Body.String()) != "Please pass POST/PUT/GET parameter value of 'col'." {
+	if wGetPage.Code != 400 || errorMessage(wGetPage) != "Please pass POST/PUT/GET parameter value of 'col'." {
 		t.Error("Expected code 400 and message error value of 'col'")
 	}
 }
@@ -429,7 +591,7 @@ func TGetPageNotPage(t *testing.T) {
 
 	GetPage(wGetPage, reqGetPage)
 
-	if wGetPage.Code != 400 || strings.TrimSpace(wGetPage.Body.String()) != "Please pass POST/PUT/GET parameter value of 'page'." {
+	if wGetPage.Code != 400 || errorMessage(wGetPage) != "Please pass POST/PUT/GET parameter value of 'page'." {
 		t.Error("Expected code 400 and message error value of 'page'")
 	}
 }
@@ -447,7 +609,7 @@ func TGetPageNotTotal(t *testing.T) {
 
 	GetPage(wGetPage, reqGetPage)
 
-	if wGetPage.Code != 400 || strings.TrimSpace(wGetPage.Body.String()) != "Please pass POST/PUT/GET parameter value of 'total'." {
+	if wGetPage.Code != 400 || errorMessage(wGetPage) != "Please pass POST/PUT/GET parameter value of 'total'." {
 		t.Error("Expected code 400 and message error value of 'total'")
 	}
 }
@@ -465,7 +627,7 @@ func TGetPageErrorTotal(t *testing.T) {
 
 	GetPage(wGetPage, reqGetPage)
 
-	if wGetPage.Code != 400 || strings.TrimSpace(wGetPage.Body.String()) != "Invalid total page number '0'." {
+	if wGetPage.Code != 400 || errorMessage(wGetPage) != "Invalid total page number '0'." {
 		t.Error("Expected code 400 and message error invalid total page number 0")
 	}
 }
@@ -483,7 +645,7 @@ func TGetPageErrorPage(t *testing.T) {
 
 	GetPage(wGetPage, reqGetPage)
 
-	if wGetPage.Code != 400 || strings.TrimSpace(wGetPage.Body.String()) != "Invalid page number '-1'." {
+	if wGetPage.Code != 400 || errorMessage(wGetPage) != "Invalid page number '-1'." {
 		t.Error("Expected code 400 and message error invalid page number -1")
 	}
 }
@@ -504,8 +666,8 @@ func TGetPageCollectionNotExist(t *testing.T) {
 
 	GetPage(wGetPage, reqGetPage)
 
-	if wGetPage.Code != 400 || strings.TrimSpace(wGetPage.Body.String()) != fmt.Sprintf("Collection '%s' does not exist.", collection) {
-		t.Error("Expected code 400 and message error collection does not exist.")
+	if wGetPage.Code != http.StatusNotFound || errorMessage(wGetPage) != fmt.Sprintf("Collection %s does not exist", collection) {
+		t.Error("Expected code 404 and message error collection does not exist.")
 	}
 }
 func TGetPage(t *testing.T) {
@@ -560,13 +722,13 @@ func TGetPageErrMarshalJson(t *testing.T) {
 	Create(wCreate, reqCreate)
 	Insert(wInsert, reqInsert)
 	textError := "Json marshal error"
-	patch := monkey.Patch(json.Marshal, func(interface{}) ([]byte, error) {
-		return nil, errors.New(textError)
+	patch := monkey.Patch(encodeJSON, func(*bytes.Buffer, interface{}) error {
+		return errors.New(textError)
 	})
 	defer patch.Unpatch()
 	GetPage(wGetPage, reqGetPage)
 
-	if wGetPage.Code != 500 || strings.TrimSpace(wGetPage.Body.String()) != textError {
+	if wGetPage.Code != 500 || errorMessage(wGetPage) != textError {
 		t.Error("Expected code 500 and message error json marshal.")
 	}
 }
@@ -585,7 +747,7 @@ func TUpdateNotCol(t *testing.T) {
 	}
 
 	Update(wUpdate, reqUpdate)
-	if wUpdate.Code != 400 || strings.TrimSpace(wUpdate.Body.String()) != "Please pass POST/PUT/GET parameter value of 'col'." {
+	if wUpdate.Code != 400 || errorMessage(wUpdate) != "Please pass POST/PUT/GET parameter value of 'col'." {
 		t.Error("Expected code 400 and message error value of 'col'")
 	}
 }
@@ -602,7 +764,7 @@ func TUpdateNotId(t *testing.T) {
 	}
 
 	Update(wUpdate, reqUpdate)
-	if wUpdate.Code != 400 || strings.TrimSpace(wUpdate.Body.String()) != "Please pass POST/PUT/GET parameter value of 'id'." {
+	if wUpdate.Code != 400 || errorMessage(wUpdate) != "Please pass POST/PUT/GET parameter value of 'id'." {
 		t.Error("Expected code 400 and message error value of 'id'")
 	}
 }
@@ -620,14 +782,15 @@ func TUpdateNotDoc(t *testing.T) {
 	reqUpdate := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpdateNotDoc, collection, "1"), nil)
 	Update(wUpdate, reqUpdate)
 
-	if wUpdate.Code != 400 || strings.TrimSpace(wUpdate.Body.String()) != "Please pass POST/PUT/GET parameter value of 'doc'." {
+	if wUpdate.Code != 400 || errorMessage(wUpdate) != "Please pass POST/PUT/GET parameter value of 'doc'." {
 		t.Error("Expected code 400 and message error value of 'doc'")
 	}
 }
-func TUpdateInvalidId(t *testing.T) {
+func TUpdateUnknownStrId(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
 
+	wCreate := httptest.NewRecorder()
 	wUpdate := httptest.NewRecorder()
 
 	var err error
@@ -640,11 +803,13 @@ func TUpdateInvalidId(t *testing.T) {
 	b.WriteString(jsonStr)
 
 	randId := RandStringBytes(5)
+	reqCreate := httptest.NewRequest(RandMethodRequest(), requestCreate, nil)
 	reqUpdate := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpdate, collection, randId), b)
+	Create(wCreate, reqCreate)
 	Update(wUpdate, reqUpdate)
 
-	if wUpdate.Code != 400 || strings.TrimSpace(wUpdate.Body.String()) != fmt.Sprintf("Invalid document ID '%s'.", randId) {
-		t.Error("Expected code 400 and message error invalid document id.")
+	if wUpdate.Code != http.StatusNotFound || errorMessage(wUpdate) != fmt.Sprintf("Document `%s` does not exist", randId) {
+		t.Error("Expected code 404 and message error no such document.")
 	}
 }
 func TUpdateJsonError(t *testing.T) {
@@ -664,7 +829,7 @@ func TUpdateJsonError(t *testing.T) {
 	reqUpdate := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpdate, collection, "1"), b)
 	Update(wUpdate, reqUpdate)
 
-	if wUpdate.Code != 400 || strings.TrimSpace(wUpdate.Body.String()) != "'map[]' is not valid JSON document." {
+	if wUpdate.Code != 400 || errorMessage(wUpdate) != "'{\"a\":1,\"b\":asd}' is not valid JSON document." {
 		t.Error("Expected code 400 and message error is not valid json")
 	}
 }
@@ -685,8 +850,8 @@ func TUpdateCollectionNotExist(t *testing.T) {
 	reqUpdate := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpdate, collection, "1"), b)
 	Update(wUpdate, reqUpdate)
 
-	if wUpdate.Code != 400 || strings.TrimSpace(wUpdate.Body.String()) != fmt.Sprintf("Collection '%s' does not exist.", collection) {
-		t.Error("Expected code 400 and message error collection is not exist")
+	if wUpdate.Code != http.StatusNotFound || errorMessage(wUpdate) != fmt.Sprintf("Collection %s does not exist", collection) {
+		t.Error("Expected code 404 and message error collection is not exist")
 	}
 }
 func TUpdate(t *testing.T) {
@@ -727,6 +892,29 @@ func TUpdate(t *testing.T) {
 		t.Error("Expected code 200 and get update document")
 	}
 }
+func TUpdateKeepStrId(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	id, err := HttpDB.Use(collection).InsertStrID("str", map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wUpdate := httptest.NewRecorder()
+	Update(wUpdate, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpdate, collection, strconv.Itoa(id)), bytes.NewBufferString("{\"a\":2}")))
+	if wUpdate.Code != 200 {
+		t.Fatal(wUpdate.Code, wUpdate.Body.String())
+	}
+	if doc, err := HttpDB.Use(collection).ReadStrID("str"); err != nil || doc["a"] != float64(2) {
+		t.Error("Expected string ID to be kept by update by integer ID", doc, err)
+	}
+}
 func TUpdateError(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
@@ -750,8 +938,8 @@ func TUpdateError(t *testing.T) {
 	reqUpdate := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpdate, collection, "2"), b2)
 	Update(wUpdate, reqUpdate)
 
-	if wUpdate.Code != 500 || strings.TrimSpace(wUpdate.Body.String()) != "Document `2` does not exist" {
-		t.Error("Expected code 500 and message error document not exist")
+	if wUpdate.Code != http.StatusNotFound || errorMessage(wUpdate) != "Document `2` does not exist" {
+		t.Error("Expected code 404 and message error document not exist")
 	}
 }
 
@@ -769,7 +957,7 @@ func TDeleteNotCol(t *testing.T) {
 	}
 
 	Delete(wDelete, reqDelete)
-	if wDelete.Code != 400 || strings.TrimSpace(wDelete.Body.String()) != "Please pass POST/PUT/GET parameter value of 'col'." {
+	if wDelete.Code != 400 || errorMessage(wDelete) != "Please pass POST/PUT/GET parameter value of 'col'." {
 		t.Error("Expected code 400 and message error value of 'col'")
 	}
 }
@@ -786,25 +974,28 @@ func TDeleteNotId(t *testing.T) {
 	}
 	Delete(wDelete, reqDelete)
 
-	if wDelete.Code != 400 || strings.TrimSpace(wDelete.Body.String()) != "Please pass POST/PUT/GET parameter value of 'id'." {
+	if wDelete.Code != 400 || errorMessage(wDelete) != "Please pass POST/PUT/GET parameter value of 'id'." {
 		t.Error("Expected code 400 and message error value of 'id'")
 	}
 }
-func TDeleteInvalidId(t *testing.T) {
+func TDeleteUnknownStrId(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
 	randId := RandStringBytes(5)
+	reqCreate := httptest.NewRequest(RandMethodRequest(), requestCreate, nil)
 	reqDelete := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDelete, collection, randId), nil)
+	wCreate := httptest.NewRecorder()
 	wDelete := httptest.NewRecorder()
 
 	var err error
 	if HttpDB, err = db.OpenDB(tempDir); err != nil {
 		panic(err)
 	}
+	Create(wCreate, reqCreate)
 	Delete(wDelete, reqDelete)
 
-	if wDelete.Code != 400 || strings.TrimSpace(wDelete.Body.String()) != fmt.Sprintf("Invalid document ID '%s'.", randId) {
-		t.Error("Expected code 400 and message error invalid document id.")
+	if wDelete.Code != http.StatusNotFound || errorMessage(wDelete) != fmt.Sprintf("Document `%s` does not exist", randId) {
+		t.Error("Expected code 404 and message error no such document.")
 	}
 }
 func TDeleteCollectionNotExist(t *testing.T) {
@@ -819,8 +1010,8 @@ func TDeleteCollectionNotExist(t *testing.T) {
 	}
 	Delete(wDelete, reqDelete)
 
-	if wDelete.Code != 400 || strings.TrimSpace(wDelete.Body.String()) != fmt.Sprintf("Collection '%s' does not exist.", collection) {
-		t.Error("Expected code 400 and message error collection does not exist.")
+	if wDelete.Code != http.StatusNotFound || errorMessage(wDelete) != fmt.Sprintf("Collection %s does not exist", collection) {
+		t.Error("Expected code 404 and message error collection does not exist.")
 	}
 }
 func TDelete(t *testing.T) {
@@ -849,9 +1040,15 @@ func TDelete(t *testing.T) {
 	reqGet := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGet, collection, strings.TrimSpace(wInsert.Body.String())), nil)
 	Delete(wDelete, reqDelete)
 	Get(wGet, reqGet)
+	// Deleting it again fails
+	wDeleteAgain := httptest.NewRecorder()
+	Delete(wDeleteAgain, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDelete, collection, idRecord), nil))
 
-	if wDelete.Code != 200 || wGet.Code != 404 || strings.TrimSpace(wGet.Body.String()) != fmt.Sprintf("No such document ID %s.", idRecord) {
-		t.Error("Expected code 200 and after delete message error not such document with the specified 'id'")
+	if wDeleteAgain.Code != http.StatusNotFound {
+		t.Error("Expected code 404 deleting a deleted document.", wDeleteAgain.Code)
+	}
+	if wDelete.Code != 200 || wGet.Code != http.StatusNotFound || errorMessage(wGet) != fmt.Sprintf("Document `%s` does not exist", idRecord) {
+		t.Error("Expected code 404 and after delete message error not such document with the specified 'id'")
 	}
 }
 
@@ -870,7 +1067,7 @@ func TApproxDocCountNotCol(t *testing.T) {
 
 	ApproxDocCount(wApproxDocCount, reqApproxDocCount)
 
-	if wApproxDocCount.Code != 400 || strings.TrimSpace(wApproxDocCount.Body.String()) != "Please pass POST/PUT/GET parameter value of 'col'." {
+	if wApproxDocCount.Code != 400 || errorMessage(wApproxDocCount) != "Please pass POST/PUT/GET parameter value of 'col'." {
 		t.Error("Expected code 400 and message error value of 'col'")
 	}
 }
@@ -888,8 +1085,8 @@ func TApproxDocCountColNotExist(t *testing.T) {
 
 	ApproxDocCount(wApproxDocCount, reqApproxDocCount)
 
-	if wApproxDocCount.Code != 400 || strings.TrimSpace(wApproxDocCount.Body.String()) != fmt.Sprintf("Collection '%s' does not exist.", collection) {
-		t.Error("Expected code 400 and message error collection does not exist.")
+	if wApproxDocCount.Code != http.StatusNotFound || errorMessage(wApproxDocCount) != fmt.Sprintf("Collection %s does not exist", collection) {
+		t.Error("Expected code 404 and message error collection does not exist.")
 	}
 }
 func TApproxDocCount(t *testing.T) {
@@ -913,3 +1110,348 @@ func TApproxDocCount(t *testing.T) {
 		t.Error("Expected code 200 and count 0")
 	}
 }
+
+func TestDocACL(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	defer func() {
+		DocACL = false
+	}()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		t.Fatal(err)
+	}
+	defer HttpDB.Close()
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	dbcol := HttpDB.Use(collection)
+	if err = dbcol.SetConfig(db.ColConfig{ACLPath: []string{"owner"}}); err != nil {
+		t.Fatal(err)
+	} else if err = dbcol.Index([]string{"owner"}); err != nil {
+		t.Fatal(err)
+	}
+	DocACL = true
+	as := func(user, method, target, body string) *http.Request {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		return req.WithContext(context.WithValue(req.Context(), userKey{}, user))
+	}
+	// Documents are owned by the inserting user unless they say otherwise
+	w := httptest.NewRecorder()
+	Insert(w, as("alice", "POST", requestInsertWithoutDoc, `{"a": 1}`))
+	if w.Code != 201 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	aliceID := w.Body.String()
+	w = httptest.NewRecorder()
+	Insert(w, as("bob", "POST", requestInsertWithoutDoc, `{"a": 2, "owner": ["bob", "alice"]}`))
+	if w.Code != 201 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	sharedID := w.Body.String()
+	w = httptest.NewRecorder()
+	Insert(w, as("bob", "POST", requestInsertWithoutDoc, `{"a": 3, "owner": "alice"}`))
+	if w.Code != 403 || errorCode(w) != "acl_denied" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// Others' documents do not exist to a user
+	w = httptest.NewRecorder()
+	Get(w, as("alice", "GET", fmt.Sprintf(requestGet, collection, aliceID), ""))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"owner":"alice"`) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	Get(w, as("bob", "GET", fmt.Sprintf(requestGet, collection, aliceID), ""))
+	if w.Code != 404 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	GetBatch(w, as("bob", "GET", fmt.Sprintf(requestGetBatch, collection, "["+aliceID+","+sharedID+"]"), ""))
+	if w.Code != 200 || strings.Contains(w.Body.String(), aliceID) || !strings.Contains(w.Body.String(), sharedID) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	GetPage(w, as("bob", "GET", fmt.Sprintf(requestGetPage, collection, "0", 1), ""))
+	if w.Code != 200 || strings.Contains(w.Body.String(), aliceID) || !strings.Contains(w.Body.String(), sharedID) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	Query(w, as("bob", "GET", fmt.Sprintf(requestQueryWithAll, collection, `"all"`), ""))
+	if w.Code != 200 || w.Header().Get("X-Total-Count") != "1" || !strings.Contains(w.Body.String(), sharedID) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	Count(w, as("alice", "GET", fmt.Sprintf(requestCountWithAll, collection, `"all"`), ""))
+	if w.Body.String() != "2" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	SQL(w, as("bob", "GET", fmt.Sprintf(requestSQL, url.QueryEscape("SELECT a FROM "+collection)), ""))
+	if w.Code != 200 || w.Body.String() != `[{"doc":{"a":2},"id":`+sharedID+`}]` {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// Updates keep the owner, and may not give the document away
+	w = httptest.NewRecorder()
+	Update(w, as("bob", "POST", fmt.Sprintf(requestUpdate, collection, aliceID), `{"a": 4}`))
+	if w.Code != 404 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	Update(w, as("alice", "POST", fmt.Sprintf(requestUpdate, collection, aliceID), `{"a": 5}`))
+	if w.Code != 200 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	Update(w, as("alice", "POST", fmt.Sprintf(requestUpdate, collection, aliceID), `{"a": 6, "owner": "bob"}`))
+	if w.Code != 403 || errorCode(w) != "acl_denied" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	id, _ := strconv.Atoi(aliceID)
+	if doc, err := dbcol.Read(id); err != nil || doc["a"] != 5.0 || doc["owner"] != "alice" {
+		t.Fatal(doc, err)
+	}
+	w = httptest.NewRecorder()
+	UpdateByQuery(w, as("bob", "GET", fmt.Sprintf(requestUpdateByQuery, collection, `"all"`, url.QueryEscape(`{"owner": null}`)), ""))
+	if !strings.Contains(w.Body.String(), `"matched":1,"done":0,"skipped":0,"failed":1`) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// Deletion
+	w = httptest.NewRecorder()
+	Delete(w, as("bob", "GET", fmt.Sprintf(requestDelete, collection, aliceID), ""))
+	if w.Code != 404 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	DeleteByQuery(w, as("bob", "GET", fmt.Sprintf(requestDeleteByQuery, collection, `"all"`), ""))
+	if !strings.Contains(w.Body.String(), `"matched":1,"done":1`) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	Delete(w, as("alice", "GET", fmt.Sprintf(requestDelete, collection, aliceID), ""))
+	if w.Code != 200 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// Requests without a user (e.g. of admin) are not restricted
+	if _, err = dbcol.Insert(map[string]interface{}{"owner": "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	Count(w, httptest.NewRequest("GET", fmt.Sprintf(requestCountWithAll, collection, `"all"`), nil))
+	if w.Body.String() != "1" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+func TestTransact(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		t.Fatal(err)
+	}
+	defer HttpDB.Close()
+	if err = HttpDB.Create("orders"); err != nil {
+		t.Fatal(err)
+	} else if err = HttpDB.Create("stock"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = HttpDB.Use("stock").InsertStrID("apple", map[string]interface{}{"left": 10.0}); err != nil {
+		t.Fatal(err)
+	}
+	transact := func(writes string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		Transact(w, httptest.NewRequest("GET", fmt.Sprintf(requestTransact, url.QueryEscape(writes)), nil))
+		return w
+	}
+	if w := transact(`[{"op": "update"`); w.Code != 400 {
+		t.Fatal(w.Code, w.Body.String())
+	} else if w = transact(`[{"op": "insert", "col": "nope", "doc": {}}]`); w.Code != 404 || errorCode(w) != "no_col" {
+		t.Fatal(w.Code, w.Body.String())
+	} else if w = transact(`[{"op": "delete", "col": "stock", "id": "pear"}]`); w.Code != 404 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// Writes to both collections, the document identified by string ID keeps it
+	w := transact(`[{"op": "insert", "col": "orders", "doc": {"item": "apple"}}, {"op": "update", "col": "stock", "id": "apple", "doc": {"left": 9}}]`)
+	var ids []string
+	if err = json.Unmarshal(w.Body.Bytes(), &ids); err != nil || w.Code != 200 || len(ids) != 2 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	orderID, _ := strconv.Atoi(ids[0])
+	if order, err := HttpDB.Use("orders").Read(orderID); err != nil || order["item"] != "apple" {
+		t.Fatal(order, err)
+	} else if doc, err := HttpDB.Use("stock").ReadStrID("apple"); err != nil || doc["left"] != 9.0 {
+		t.Fatal(doc, err)
+	}
+	// A failed write leaves all collections as they were
+	if w = transact(`[{"op": "delete", "col": "orders", "id": "` + ids[0] + `"}, {"op": "insert", "col": "stock", "doc": {"_id": "apple"}}]`); w.Code != 409 || errorCode(w) != "dup_id" {
+		t.Fatal(w.Code, w.Body.String())
+	} else if HttpDB.Use("orders").Count() != 1 || HttpDB.Use("stock").Count() != 1 {
+		t.Fatal(HttpDB.Use("orders").Count(), HttpDB.Use("stock").Count())
+	}
+}
+
+func TestBulk(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		t.Fatal(err)
+	}
+	defer HttpDB.Close()
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = HttpDB.Use(collection).InsertStrID("a", map[string]interface{}{"n": 1.0}); err != nil {
+		t.Fatal(err)
+	}
+	bulk := func(writes string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		Bulk(w, httptest.NewRequest("GET", fmt.Sprintf(requestBulk, url.QueryEscape(writes)), nil))
+		return w
+	}
+	if w := bulk(`[{"op": "insert"`); w.Code != 400 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// Every write has its own outcome, a failed write does not stop the others
+	w := bulk(`[{"op": "insert", "col": "` + collection + `", "doc": {"n": 2}},
+		{"op": "update", "col": "` + collection + `", "id": "a", "doc": {"n": 3}},
+		{"op": "insert", "col": "` + collection + `", "doc": {"_id": "a"}},
+		{"op": "delete", "col": "` + collection + `", "id": "b"},
+		{"op": "insert", "col": "nope", "doc": {}}]`)
+	var resp struct {
+		Errors bool
+		Items  []bulkResult
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != 200 || !resp.Errors || len(resp.Items) != 5 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	for i, expected := range []struct {
+		status int
+		code   string
+	}{{201, ""}, {200, ""}, {409, "dup_id"}, {404, "no_doc"}, {404, "no_col"}} {
+		item := resp.Items[i]
+		if item.Status != expected.status || expected.code == "" && (item.ID == "" || item.Error != nil) || expected.code != "" && (item.Error == nil || item.Error.Code != expected.code) {
+			t.Fatal(i, w.Body.String())
+		}
+	}
+	insertedID, _ := strconv.Atoi(resp.Items[0].ID)
+	if doc, err := HttpDB.Use(collection).Read(insertedID); err != nil || doc["n"] != 2.0 {
+		t.Fatal(doc, err)
+	} else if doc, err := HttpDB.Use(collection).ReadStrID("a"); err != nil || doc["n"] != 3.0 {
+		t.Fatal(doc, err)
+	}
+	if w = bulk(`[{"op": "delete", "col": "` + collection + `", "id": "` + resp.Items[0].ID + `"}]`); w.Code != 200 || strings.Contains(w.Body.String(), `"errors":true`) {
+		t.Fatal(w.Code, w.Body.String())
+	} else if count := HttpDB.Use(collection).Count(); count != 1 {
+		t.Fatal(count)
+	}
+}
+
+func TestETag(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		t.Fatal(err)
+	}
+	defer HttpDB.Close()
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	id, err := HttpDB.Use(collection).InsertStrID("a", map[string]interface{}{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(handler http.HandlerFunc, target, header, etag, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", target, strings.NewReader(body))
+		if header != "" {
+			req.Header.Set(header, etag)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+	get := fmt.Sprintf(requestGet, collection, "a")
+	w := request(Get, get, "", "", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != 200 || len(etag) != 18 {
+		t.Fatal(w.Code, etag)
+	}
+	// Cache validation
+	if w = request(Get, get, "If-None-Match", `"x", W/`+etag, ""); w.Code != 304 || w.Body.Len() != 0 {
+		t.Fatal(w.Code, w.Body.String())
+	} else if w = request(Get, get, "If-None-Match", `"x"`, ""); w.Code != 200 {
+		t.Fatal(w.Code, w.Body.String())
+	} else if w = request(Get, get, "If-Match", `"x"`, ""); w.Code != 412 || errorCode(w) != "doc_changed" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// Optimistic concurrency: an update based on an outdated read fails
+	update := fmt.Sprintf(requestUpdate, collection, strconv.Itoa(id))
+	w = request(Update, update, "If-Match", etag, `{"n": 2}`)
+	newETag := w.Header().Get("ETag")
+	if w.Code != 200 || newETag == "" || newETag == etag {
+		t.Fatal(w.Code, w.Body.String())
+	} else if w = request(Update, update, "If-Match", etag, `{"n": 3}`); w.Code != 412 || errorCode(w) != "doc_changed" {
+		t.Fatal(w.Code, w.Body.String())
+	} else if w = request(Update, update, "If-None-Match", "*", `{"n": 3}`); w.Code != 412 {
+		t.Fatal(w.Code, w.Body.String())
+	} else if w = request(Get, get, "", "", ""); w.Header().Get("ETag") != newETag || !strings.Contains(w.Body.String(), `"n":2`) {
+		t.Fatal(w.Header().Get("ETag"), w.Body.String())
+	}
+}
+
+func TestLatestTail(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	dbcol := HttpDB.Use(collection)
+	request := func(handler http.HandlerFunc, url string) (w *httptest.ResponseRecorder, rows []map[string]interface{}) {
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", url, nil))
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &rows); err != nil {
+				t.Fatal(err, w.Body.String())
+			}
+		}
+		return
+	}
+	if w, _ := request(Latest, "http://localhost:8080/latest?col="+collection+"&n=1"); w.Code != 400 || errorCode(w) != "no_insert_order" {
+		t.Fatal(w.Code, w.Body.String())
+	} else if err = dbcol.SetConfig(db.ColConfig{InsertOrder: true}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 4)
+	for i := range ids {
+		if ids[i], err = dbcol.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, rows := request(Latest, "http://localhost:8080/latest?col="+collection+"&n=2")
+	if len(rows) != 2 || rows[0]["id"] != float64(ids[3]) || rows[1]["doc"].(map[string]interface{})["n"] != float64(2) {
+		t.Fatal(w.Body.String())
+	}
+	w, rows = request(Tail, fmt.Sprintf("http://localhost:8080/tail?col=%s&after=%d&n=5", collection, ids[1]))
+	if len(rows) != 2 || rows[0]["id"] != float64(ids[2]) || rows[1]["id"] != float64(ids[3]) {
+		t.Fatal(w.Body.String())
+	}
+	if err = dbcol.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	} else if w, _ = request(Tail, fmt.Sprintf("http://localhost:8080/tail?col=%s&after=%d&n=5", collection, ids[1])); w.Code != 404 || errorCode(w) != "no_doc" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	for _, url := range []string{"/latest?col=" + collection + "&n=x", "/latest?col=" + collection + "&n=0", "/tail?col=" + collection + "&after=x&n=1"} {
+		handler := Latest
+		if strings.HasPrefix(url, "/tail") {
+			handler = Tail
+		}
+		if w, _ = request(handler, "http://localhost:8080"+url); w.Code != 400 || errorCode(w) != "invalid_param" {
+			t.Fatal(url, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Read-your-writes consistency tokens.
+//
+// Every response carries header Tiedot-Seq, the sequence number of the changes the database reflects once the request
+// is processed (see db.DB.AppliedSeq); after a write, the token covers the write. A request carrying a token in header
+// Tiedot-Min-Seq is processed only once the database reflects the changes up to it - a read replica may need to apply
+// backups first - and the indexes of the collection (parameter "col") whose build started by then are published. A
+// request that would wait longer than FreshnessWait fails with error code "stale" instead.
+
+package httpapi
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+var (
+	FreshnessWait = 5 * time.Second // Time a request carrying MIN_SEQ_HEADER waits for the database to catch up
+)
+
+const (
+	SEQ_HEADER     = "Tiedot-Seq"     // Sequence number of the changes the database reflects, set in every response.
+	MIN_SEQ_HEADER = "Tiedot-Min-Seq" // Sequence number of the changes a request demands to be reflected.
+)
+
+// Return the handler setting SEQ_HEADER in the responses of the handler, and waiting for the database to reflect the
+// changes demanded by MIN_SEQ_HEADER before calling the handler.
+func freshHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if minSeq := r.Header.Get(MIN_SEQ_HEADER); minSeq != "" {
+			seq, err := strconv.Atoi(minSeq)
+			if err != nil {
+				httpError(w, dberr.New(dberr.ErrorInvalidParam, MIN_SEQ_HEADER, minSeq), http.StatusBadRequest)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), FreshnessWait)
+			if dbcol := HttpDB.Use(r.FormValue("col")); dbcol != nil {
+				err = dbcol.WaitSeq(ctx, seq)
+			} else {
+				err = HttpDB.WaitSeq(ctx, seq)
+			}
+			cancel()
+			if err != nil {
+				httpError(w, err, http.StatusServiceUnavailable)
+				return
+			}
+		}
+		sw := &seqWriter{ResponseWriter: w}
+		handler.ServeHTTP(sw, r)
+		// The response without body is sent once the handler returns
+		sw.setSeq()
+	})
+}
+
+// Response writer setting SEQ_HEADER once the handler is done with the database, as it starts the response.
+type seqWriter struct {
+	http.ResponseWriter
+	set bool // Set once the header is set
+}
+
+// Set the sequence number header unless it is set already.
+func (sw *seqWriter) setSeq() {
+	if !sw.set {
+		sw.set = true
+		sw.Header().Set(SEQ_HEADER, strconv.Itoa(HttpDB.AppliedSeq()))
+	}
+}
+
+// Send the status along with the sequence number.
+func (sw *seqWriter) WriteHeader(status int) {
+	sw.setSeq()
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Send the body, the headers are sent first if not yet sent.
+func (sw *seqWriter) Write(data []byte) (int, error) {
+	sw.setSeq()
+	return sw.ResponseWriter.Write(data)
+}
+
+// Send the response written so far to the client.
+func (sw *seqWriter) Flush() {
+	sw.setSeq()
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,59 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/db"
+)
+
+func TestFreshHandler(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		t.Fatal(err)
+	}
+	defer HttpDB.Close()
+	defer func(wait time.Duration) {
+		FreshnessWait = wait
+	}(FreshnessWait)
+	FreshnessWait = 50 * time.Millisecond
+	mux := http.NewServeMux()
+	mux.HandleFunc("/create", Create)
+	mux.HandleFunc("/insert", Insert)
+	mux.HandleFunc("/count", ApproxDocCount)
+	handler := freshHandler(mux)
+	serve := func(path, minSeq string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost:8080"+path, nil)
+		if minSeq != "" {
+			req.Header.Set(MIN_SEQ_HEADER, minSeq)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	if w := serve("/create?col=a", ""); w.Code != http.StatusCreated || w.Header().Get(SEQ_HEADER) != strconv.Itoa(HttpDB.ChangeSeq()) {
+		t.Fatal(w.Code, w.Header())
+	}
+	// The token of a write covers the write
+	w := serve("/insert?col=a&doc="+url.QueryEscape(`{"a": 1}`), "")
+	token := w.Header().Get(SEQ_HEADER)
+	if w.Code != http.StatusCreated || token != strconv.Itoa(HttpDB.ChangeSeq()) || token == "0" {
+		t.Fatal(w.Code, w.Header())
+	}
+	if w = serve("/count?col=a", token); w.Code != http.StatusOK || w.Header().Get(SEQ_HEADER) != token {
+		t.Fatal(w.Code, w.Header(), w.Body.String())
+	}
+	// A primary database never made the changes beyond its last one
+	if w = serve("/count?col=a", "1"+token); w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if w = serve("/count?col=a", "latest"); w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
@@ -1,9 +1,12 @@
 package httpapi
 
 import (
+	"encoding/json"
 	"log"
 	"math/rand"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -38,3 +41,19 @@ func managerSubTests(tests []func(t *testing.T), nameGroup string, t *testing.T)
 		t.Run(nameGroup, tc)
 	}
 }
+
+// Return the message of the JSON error response, or the entire response if it is not a JSON error.
+func errorMessage(w *httptest.ResponseRecorder) string {
+	var resp errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Code == "" {
+		return strings.TrimSpace(w.Body.String())
+	}
+	return resp.Message
+}
+
+// Return the code of the JSON error response.
+func errorCode(w *httptest.ResponseRecorder) string {
+	var resp errorResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.Code
+}
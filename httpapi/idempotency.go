@@ -0,0 +1,140 @@
+// Idempotency keys of writes.
+//
+// A client retrying an insert after a network failure cannot tell whether the first attempt created the document.
+// Writes carrying an Idempotency-Key header are therefore processed once: the successful response is remembered for
+// IdempotencyTTL, and a request repeating the key within that time is answered with the remembered response, marked by
+// header Idempotent-Replayed, instead of being processed again. A request repeating the key of a request still in
+// progress waits for its outcome. Failed requests are not remembered, so that they may be retried. Keys are held in
+// memory and apart for each JWT user; a key may not be reused for another endpoint or collection.
+
+package httpapi
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+var (
+	IdempotencyTTL = 24 * time.Hour // Time the responses to requests carrying an idempotency key are remembered, 0 - keys are ignored
+)
+
+const (
+	IDEMPOTENCY_HEADER = "Idempotency-Key"
+	REPLAYED_HEADER    = "Idempotent-Replayed" // Set to "true" in a remembered response.
+)
+
+// Response to a request carrying an idempotency key.
+type idemResponse struct {
+	request string        // Endpoint and collection of the request
+	done    chan struct{} // Closed once the request is processed
+	status  int           // HTTP status, 0 until processed and if the request failed
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// Responses by user and idempotency key.
+var idemKeys = struct {
+	lock      *sync.Mutex
+	responses map[string]*idemResponse
+	lastSweep time.Time
+}{lock: new(sync.Mutex), responses: make(map[string]*idemResponse)}
+
+// Response writer remembering the response.
+type idemWriter struct {
+	statusWriter
+	body bytes.Buffer
+}
+
+// Send and remember the body.
+func (iw *idemWriter) Write(data []byte) (int, error) {
+	iw.body.Write(data)
+	return iw.statusWriter.Write(data)
+}
+
+// Return the handler processing a request carrying an idempotency key once.
+func idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IDEMPOTENCY_HEADER)
+		if key == "" || IdempotencyTTL <= 0 {
+			handler(w, r)
+			return
+		}
+		scopedKey, request := requestUser(r)+"\x00"+key, r.URL.Path+"\x00"+r.FormValue("col")
+		var mine *idemResponse
+		for {
+			now := time.Now()
+			idemKeys.lock.Lock()
+			if now.Sub(idemKeys.lastSweep) > time.Minute {
+				for expiredKey, resp := range idemKeys.responses {
+					if resp.status != 0 && now.After(resp.expires) {
+						delete(idemKeys.responses, expiredKey)
+					}
+				}
+				idemKeys.lastSweep = now
+			}
+			resp, exists := idemKeys.responses[scopedKey]
+			if !exists || resp.status != 0 && now.After(resp.expires) {
+				mine = &idemResponse{request: request, done: make(chan struct{})}
+				idemKeys.responses[scopedKey] = mine
+				idemKeys.lock.Unlock()
+				break
+			}
+			idemKeys.lock.Unlock()
+			if resp.request != request {
+				httpError(w, dberr.New(dberr.ErrorInvalidParam, IDEMPOTENCY_HEADER, key), 400)
+				return
+			}
+			<-resp.done
+			if resp.status != 0 {
+				for name, values := range resp.header {
+					w.Header()[name] = values
+				}
+				w.Header().Set(REPLAYED_HEADER, "true")
+				w.WriteHeader(resp.status)
+				w.Write(resp.body)
+				return
+			}
+			// The request failed, process this one instead
+		}
+		iw := &idemWriter{statusWriter: statusWriter{ResponseWriter: w}}
+		completed := false
+		// Requests waiting for this one proceed even if the handler panics, which forgets the key
+		defer func() {
+			idemKeys.lock.Lock()
+			if completed && iw.status/100 == 2 {
+				mine.status, mine.header, mine.body = iw.status, handlerHeader(w.Header()), iw.body.Bytes()
+				mine.expires = time.Now().Add(IdempotencyTTL)
+			} else {
+				delete(idemKeys.responses, scopedKey)
+			}
+			idemKeys.lock.Unlock()
+			close(mine.done)
+		}()
+		handler(iw, r)
+		if iw.status == 0 {
+			iw.status = http.StatusOK
+		}
+		completed = true
+	}
+}
+
+// Return a copy of the response headers without those set by the handlers wrapped around the endpoints, such as
+// compression, which set them again for the remembered response. The remembered body is not compressed.
+func handlerHeader(header http.Header) http.Header {
+	header = header.Clone()
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	vary := header.Values("Vary")
+	header.Del("Vary")
+	for _, value := range vary {
+		if value != "Accept-Encoding" && value != "Origin" {
+			header.Add("Vary", value)
+		}
+	}
+	return header
+}
@@ -0,0 +1,140 @@
+package httpapi
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/db"
+)
+
+func TestIdempotent(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		t.Fatal(err)
+	}
+	defer HttpDB.Close()
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	insert := func(user, key, doc string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", fmt.Sprintf("http://localhost:8080/insert?col=%s", collection), strings.NewReader(doc))
+		req.Header.Set(IDEMPOTENCY_HEADER, key)
+		w := httptest.NewRecorder()
+		idempotent(Insert)(w, req.WithContext(context.WithValue(req.Context(), userKey{}, user)))
+		return w
+	}
+	// A retry is answered with the first response
+	first := insert("", "k1", `{"a": 1}`)
+	if first.Code != 201 || first.Header().Get(REPLAYED_HEADER) != "" {
+		t.Fatal(first.Code, first.Body.String())
+	}
+	retry := insert("", "k1", `{"a": 1}`)
+	if retry.Code != 201 || retry.Body.String() != first.Body.String() || retry.Header().Get(REPLAYED_HEADER) != "true" {
+		t.Fatal(retry.Code, retry.Body.String())
+	} else if count := HttpDB.Use(collection).Count(); count != 1 {
+		t.Fatal(count)
+	}
+	// Keys are apart for each user and may not be reused for another endpoint
+	if w := insert("alice", "k1", `{"a": 1}`); w.Code != 201 || w.Body.String() == first.Body.String() {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	req := httptest.NewRequest("POST", fmt.Sprintf(requestUpdate, collection, first.Body.String()), strings.NewReader(`{"a": 2}`))
+	req.Header.Set(IDEMPOTENCY_HEADER, "k1")
+	w := httptest.NewRecorder()
+	idempotent(Update)(w, req)
+	if w.Code != 400 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// A failed request is processed again
+	if w := insert("", "k2", `{"a":`); w.Code != 400 {
+		t.Fatal(w.Code, w.Body.String())
+	} else if w = insert("", "k2", `{"a": 3}`); w.Code != 201 || w.Header().Get(REPLAYED_HEADER) != "" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// Keys expire
+	defer func(ttl time.Duration) {
+		IdempotencyTTL = ttl
+	}(IdempotencyTTL)
+	IdempotencyTTL = time.Millisecond
+	insert("", "k3", `{"a": 4}`)
+	time.Sleep(10 * time.Millisecond)
+	if w := insert("", "k3", `{"a": 4}`); w.Code != 201 || w.Header().Get(REPLAYED_HEADER) != "" {
+		t.Fatal(w.Code, w.Body.String())
+	} else if count := HttpDB.Use(collection).Count(); count != 5 {
+		t.Fatal(count)
+	}
+	// Without a key every request is processed
+	req = httptest.NewRequest("POST", fmt.Sprintf("http://localhost:8080/insert?col=%s", collection), strings.NewReader(`{}`))
+	idempotent(Insert)(httptest.NewRecorder(), req)
+	if count := HttpDB.Use(collection).Count(); count != 6 {
+		t.Fatal(count)
+	}
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	post := func(handler http.Handler, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://localhost:8080/bulk", nil)
+		req.Header.Set(IDEMPOTENCY_HEADER, key)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	// A compressed response is compressed again when replayed
+	body := strings.Repeat(`{"a": 1}`, CompressMinSize)
+	handler := compressHandler(idempotent(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		w.Write([]byte(body))
+	}))
+	for _, replayed := range []string{"", "true"} {
+		w := post(handler, "compressed")
+		if w.Code != 201 || w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get(REPLAYED_HEADER) != replayed {
+			t.Fatal(w.Code, w.Header())
+		} else if vary := w.Header().Values("Vary"); len(vary) != 1 {
+			t.Fatal(vary)
+		}
+		reader, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decompressed, err := ioutil.ReadAll(reader); err != nil || string(decompressed) != body {
+			t.Fatal(err, len(decompressed))
+		}
+	}
+	// A request whose handler panicked is processed again
+	panicked := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler")
+	})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Did not panic")
+			}
+		}()
+		post(panicked, "panicked")
+	}()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- post(idempotent(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(201)
+		}), "panicked")
+	}()
+	select {
+	case w := <-done:
+		if w.Code != 201 || w.Header().Get(REPLAYED_HEADER) != "" {
+			t.Fatal(w.Code, w.Header())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Retry is blocked")
+	}
+}
@@ -4,9 +4,13 @@ package httpapi
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/cankansin/tiedot/dberr"
 )
 
 // Put an index on a document path.
@@ -24,11 +28,20 @@ func Index(w http.ResponseWriter, r *http.Request) {
 	}
 	dbcol := HttpDB.Use(col)
 	if dbcol == nil {
-		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
+		return
+	}
+	if r.FormValue("background") == "true" {
+		// Build the index without waiting for it to become available
+		if err := dbcol.IndexInBackground(strings.Split(path, ",")); err != nil {
+			httpError(w, err, 400)
+			return
+		}
+		w.WriteHeader(202)
 		return
 	}
 	if err := dbcol.Index(strings.Split(path, ",")); err != nil {
-		http.Error(w, fmt.Sprint(err), 400)
+		httpError(w, err, 400)
 		return
 	}
 	w.WriteHeader(201)
@@ -46,7 +59,7 @@ func Indexes(w http.ResponseWriter, r *http.Request) {
 	}
 	dbcol := HttpDB.Use(col)
 	if dbcol == nil {
-		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
 		return
 	}
 	indexes := make([][]string, 0)
@@ -55,7 +68,7 @@ func Indexes(w http.ResponseWriter, r *http.Request) {
 	}
 	resp, err := json.Marshal(indexes)
 	if err != nil {
-		http.Error(w, fmt.Sprint("Server error."), 500)
+		httpError(w, errors.New("Server error."), 500)
 		return
 	}
 	w.Write(resp)
@@ -76,11 +89,58 @@ func Unindex(w http.ResponseWriter, r *http.Request) {
 	}
 	dbcol := HttpDB.Use(col)
 	if dbcol == nil {
-		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
+		return
+	}
+	if r.FormValue("dryrun") == "true" {
+		writeDryRun(w, r)(dbcol.UnindexDryRun(strings.Split(path, ",")))
+		return
+	}
+	if r.FormValue("background") == "true" {
+		// Reclaim index files without waiting for them to be deleted
+		if err := dbcol.UnindexInBackground(strings.Split(path, ",")); err != nil {
+			httpError(w, err, 400)
+			return
+		}
+		w.WriteHeader(202)
 		return
 	}
 	if err := dbcol.Unindex(strings.Split(path, ",")); err != nil {
-		http.Error(w, fmt.Sprint(err), 400)
+		httpError(w, err, 400)
+		return
+	}
+}
+
+// Return usage statistics of all indexes, or only paths of the indexes unused for the specified number of seconds.
+func IndexStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
 		return
 	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
+		return
+	}
+	var stats interface{}
+	if unused := r.FormValue("unused"); unused != "" {
+		idleSec, err := strconv.Atoi(unused)
+		if err != nil || idleSec < 0 {
+			httpError(w, dberr.New(dberr.ErrorInvalidParam, "number of seconds", unused), 400)
+			return
+		}
+		stats = dbcol.UnusedIndexes(time.Duration(idleSec) * time.Second)
+	} else {
+		stats = dbcol.IndexStats()
+	}
+	resp, err := json.Marshal(stats)
+	if err != nil {
+		httpError(w, errors.New("Server error."), 500)
+		return
+	}
+	w.Write(resp)
 }
@@ -4,9 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/http/httptest"
-	"strings"
 	"testing"
+	"time"
 
 	"bou.ke/monkey"
 	"github.com/cankansin/tiedot/db"
@@ -15,8 +16,11 @@ import (
 
 var (
 	requestIndex     = "http://localhost:8080/index?col=%s&path=%s"
+	requestIndexBg   = "http://localhost:8080/index?col=%s&path=%s&background=true"
 	requestIndexes   = "http://localhost:8080/indexes?col=%s"
 	requestUnIndexes = "http://localhost:8080/unindex?col=%s&path=%s"
+	requestUnIndexBg = "http://localhost:8080/unindex?col=%s&path=%s&background=true"
+	requestIdxStats  = "http://localhost:8080/indexstats?col=%s&unused=%s"
 
 	path = "a"
 )
@@ -24,6 +28,7 @@ var (
 func TestIndex(t *testing.T) {
 	testsIndex := []func(t *testing.T){
 		TIndex,
+		TIndexBackground,
 		TIndexNotCol,
 		TIndexNotPath,
 		TIndexError,
@@ -33,6 +38,9 @@ func TestIndex(t *testing.T) {
 		TIndexesCollNotExist,
 		TIndexErrMarshalJson,
 		TUnIndexes,
+		TUnIndexBackground,
+		TIndexStats,
+		TIndexStatsInvalidUnused,
 		TUnIndexesColNotExist,
 		TUnIndexNotCol,
 		TUnIndexNotPath,
@@ -72,6 +80,35 @@ func TIndex(t *testing.T) {
 		t.Error("Expected code 201 and get list Indexes after insert")
 	}
 }
+func TIndexBackground(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+
+	reqCreate := httptest.NewRequest("GET", requestCreate, nil)
+	reqIndex := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIndexBg, collection, path), nil)
+	reqIndexAgain := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIndex, collection, path), nil)
+
+	wCreate := httptest.NewRecorder()
+	wIndex := httptest.NewRecorder()
+	wIndexAgain := httptest.NewRecorder()
+
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(wCreate, reqCreate)
+	Index(wIndex, reqIndex)
+	if wIndex.Code != 202 {
+		t.Error("Expected code 202 after starting background index build")
+	}
+	for len(HttpDB.Use(collection).PendingIndexes()) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	Index(wIndexAgain, reqIndexAgain)
+	if wIndexAgain.Code != http.StatusConflict || errorCode(wIndexAgain) != "index_exists" {
+		t.Error("Expected code 409 after the index is built")
+	}
+}
 func TIndexNotCol(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
@@ -84,7 +121,7 @@ func TIndexNotCol(t *testing.T) {
 		panic(err)
 	}
 	Index(wIndex, reqIndex)
-	if wIndex.Code != 400 || strings.TrimSpace(wIndex.Body.String()) != "Please pass POST/PUT/GET parameter value of 'col'." {
+	if wIndex.Code != 400 || errorMessage(wIndex) != "Please pass POST/PUT/GET parameter value of 'col'." {
 		t.Error("Expected code 400 and get message error not parameter 'col'")
 	}
 }
@@ -100,7 +137,7 @@ func TIndexNotPath(t *testing.T) {
 		panic(err)
 	}
 	Index(wIndex, reqIndex)
-	if wIndex.Code != 400 || strings.TrimSpace(wIndex.Body.String()) != "Please pass POST/PUT/GET parameter value of 'path'." {
+	if wIndex.Code != 400 || errorMessage(wIndex) != "Please pass POST/PUT/GET parameter value of 'path'." {
 		t.Error("Expected code 400 and get message error not parameter 'path'")
 	}
 }
@@ -130,8 +167,8 @@ func TIndexError(t *testing.T) {
 	Index(wIndex, reqIndex)
 	Index(wIndexErr, reqIndexErr)
 
-	if wIndexErr.Code != 400 || strings.TrimSpace(wIndexErr.Body.String()) != "Path [a] is already indexed" {
-		t.Error("Expected code 400 and message is already indexed.")
+	if wIndexErr.Code != http.StatusConflict || errorMessage(wIndexErr) != "Path [a] is already indexed" {
+		t.Error("Expected code 409 and message is already indexed.")
 	}
 }
 func TIndexCollNotExist(t *testing.T) {
@@ -150,8 +187,8 @@ func TIndexCollNotExist(t *testing.T) {
 	}
 	Index(wIndex, reqIndex)
 
-	if wIndex.Code != 400 || strings.TrimSpace(wIndex.Body.String()) != fmt.Sprintf("Collection '%s' does not exist.", collection) {
-		t.Error("Expected code 400 and message collection does not exist.")
+	if wIndex.Code != http.StatusNotFound || errorMessage(wIndex) != fmt.Sprintf("Collection %s does not exist", collection) {
+		t.Error("Expected code 404 and message collection does not exist.")
 	}
 }
 
@@ -169,7 +206,7 @@ func TIndexesNotCol(t *testing.T) {
 	}
 	Indexes(wIndexes, reqIndexes)
 
-	if wIndexes.Code != 400 || strings.TrimSpace(wIndexes.Body.String()) != "Please pass POST/PUT/GET parameter value of 'col'." {
+	if wIndexes.Code != 400 || errorMessage(wIndexes) != "Please pass POST/PUT/GET parameter value of 'col'." {
 		t.Error("Expected code 400 and error message not parameter 'col'.")
 	}
 }
@@ -185,8 +222,8 @@ func TIndexesCollNotExist(t *testing.T) {
 		panic(err)
 	}
 	Indexes(wIndexes, reqIndexes)
-	if wIndexes.Code != 400 || strings.TrimSpace(wIndexes.Body.String()) != fmt.Sprintf("Collection '%s' does not exist.", collection) {
-		t.Error("Expected code 400 and error message 'collection does not exist' .")
+	if wIndexes.Code != http.StatusNotFound || errorMessage(wIndexes) != fmt.Sprintf("Collection %s does not exist", collection) {
+		t.Error("Expected code 404 and error message 'collection does not exist' .")
 	}
 }
 func TIndexErrMarshalJson(t *testing.T) {
@@ -219,7 +256,7 @@ func TIndexErrMarshalJson(t *testing.T) {
 	defer patch.Unpatch()
 
 	Indexes(wIndexes, reqIndexes)
-	if wIndexes.Code != 500 || strings.TrimSpace(wIndexes.Body.String()) != "Server error." {
+	if wIndexes.Code != 500 || errorMessage(wIndexes) != "Server error." {
 		t.Error("Expected code 500 and message server error.")
 	}
 }
@@ -258,6 +295,85 @@ func TUnIndexes(t *testing.T) {
 		t.Error("Expected code 200 and get empty message []")
 	}
 }
+func TUnIndexBackground(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+
+	reqCreate := httptest.NewRequest("GET", requestCreate, nil)
+	reqIndex := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIndex, collection, path), nil)
+	reqUnIndex := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUnIndexBg, collection, path), nil)
+	reqIndexes := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIndexes, collection), nil)
+
+	wCreate := httptest.NewRecorder()
+	wIndex := httptest.NewRecorder()
+	wUnIndex := httptest.NewRecorder()
+	wIndexes := httptest.NewRecorder()
+
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(wCreate, reqCreate)
+	Index(wIndex, reqIndex)
+	Unindex(wUnIndex, reqUnIndex)
+	Indexes(wIndexes, reqIndexes)
+
+	if wUnIndex.Code != 202 || wIndexes.Code != 200 || wIndexes.Body.String() != "[]" {
+		t.Error("Expected code 202 and get empty message []")
+	}
+}
+func TIndexStats(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+
+	reqCreate := httptest.NewRequest("GET", requestCreate, nil)
+	reqIndex := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIndex, collection, path), nil)
+	reqStats := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIdxStats, collection, ""), nil)
+	reqUnused := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIdxStats, collection, "60"), nil)
+
+	wCreate := httptest.NewRecorder()
+	wIndex := httptest.NewRecorder()
+	wStats := httptest.NewRecorder()
+	wUnused := httptest.NewRecorder()
+
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(wCreate, reqCreate)
+	Index(wIndex, reqIndex)
+	IndexStats(wStats, reqStats)
+	IndexStats(wUnused, reqUnused)
+
+	idxBytes := HttpDB.Use(collection).IndexStats()[0].Bytes
+	if wStats.Code != 200 || idxBytes == 0 || wStats.Body.String() != fmt.Sprintf(`[{"Path":["a"],"Hits":0,"LastUsed":0,"Bytes":%d,"Eventual":false,"Queued":0}]`, idxBytes) {
+		t.Error("Expected code 200 and statistics of the unused index", wStats.Body.String())
+	}
+	if wUnused.Code != 200 || wUnused.Body.String() != `[["a"]]` {
+		t.Error("Expected code 200 and the unused index path", wUnused.Body.String())
+	}
+}
+func TIndexStatsInvalidUnused(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+
+	reqCreate := httptest.NewRequest("GET", requestCreate, nil)
+	reqStats := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIdxStats, collection, "abc"), nil)
+
+	wCreate := httptest.NewRecorder()
+	wStats := httptest.NewRecorder()
+
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(wCreate, reqCreate)
+	IndexStats(wStats, reqStats)
+
+	if wStats.Code != 400 || errorMessage(wStats) != "Invalid number of seconds 'abc'." {
+		t.Error("Expected code 400 and invalid number of seconds", wStats.Body.String())
+	}
+}
 func TUnIndexesColNotExist(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
@@ -271,8 +387,8 @@ func TUnIndexesColNotExist(t *testing.T) {
 	}
 	Unindex(wUnIndexes, reqUnIndexes)
 
-	if wUnIndexes.Code != 400 || strings.TrimSpace(wUnIndexes.Body.String()) != fmt.Sprintf("Collection '%s' does not exist.", collection) {
-		t.Error("Expected code 400 and error message 'collection does not exist' .")
+	if wUnIndexes.Code != http.StatusNotFound || errorMessage(wUnIndexes) != fmt.Sprintf("Collection %s does not exist", collection) {
+		t.Error("Expected code 404 and error message 'collection does not exist' .")
 	}
 }
 func TUnIndexNotCol(t *testing.T) {
@@ -287,7 +403,7 @@ func TUnIndexNotCol(t *testing.T) {
 		panic(err)
 	}
 	Unindex(wUnIndex, reqUnIndex)
-	if wUnIndex.Code != 400 || strings.TrimSpace(wUnIndex.Body.String()) != "Please pass POST/PUT/GET parameter value of 'col'." {
+	if wUnIndex.Code != 400 || errorMessage(wUnIndex) != "Please pass POST/PUT/GET parameter value of 'col'." {
 		t.Error("Expected code 400 and get message error not parameter 'col'")
 	}
 }
@@ -303,7 +419,7 @@ func TUnIndexNotPath(t *testing.T) {
 		panic(err)
 	}
 	Unindex(wUnIndex, reqUnIndex)
-	if wUnIndex.Code != 400 || strings.TrimSpace(wUnIndex.Body.String()) != "Please pass POST/PUT/GET parameter value of 'path'." {
+	if wUnIndex.Code != 400 || errorMessage(wUnIndex) != "Please pass POST/PUT/GET parameter value of 'path'." {
 		t.Error("Expected code 400 and get message error not parameter 'path'")
 	}
 }
@@ -330,7 +446,7 @@ func TUnIndexErrorNotHave(t *testing.T) {
 	Insert(wInsert, reqInsert)
 	Unindex(wUnIndex, reqUnIndex)
 
-	if wUnIndex.Code != 400 || strings.TrimSpace(wUnIndex.Body.String()) != fmt.Sprintf("Path [%s] is not indexed", path) {
-		t.Error("Expected code 400 and get message error indexed not exist.")
+	if wUnIndex.Code != http.StatusNotFound || errorMessage(wUnIndex) != fmt.Sprintf("Path [%s] is not indexed", path) {
+		t.Error("Expected code 404 and get message error indexed not exist.")
 	}
 }
@@ -33,6 +33,8 @@ The special user identity "admin" allows access to all features and collection d
 package httpapi
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -63,6 +65,17 @@ const (
 	JWT_EXPIRY = "exp"
 )
 
+// Key of the request context value holding the JWT user.
+type userKey struct{}
+
+// Key of the request context value holding the collections the JWT user other than "admin" may access.
+type colsKey struct{}
+
+// Collections a JWT user may access, as listed by the JWT.
+type jwtCols struct {
+	cols interface{}
+}
+
 // If necessary, create the JWT identity collection, indexes, and the default/special user identity "admin".
 func jwtInitSetup() {
 	// Create collection
@@ -120,12 +133,12 @@ func getJWT(w http.ResponseWriter, r *http.Request) {
 	// Verify identity
 	user := r.FormValue(JWT_USER_ATTR)
 	if user == "" {
-		http.Error(w, "Please pass JWT 'user' parameter", http.StatusBadRequest)
+		httpError(w, errors.New("Please pass JWT 'user' parameter"), http.StatusBadRequest)
 		return
 	}
 	jwtCol := HttpDB.Use(JWT_COL_NAME)
 	if jwtCol == nil {
-		http.Error(w, "Server is missing JWT identity collection, please restart the server.", http.StatusInternalServerError)
+		httpError(w, errors.New("Server is missing JWT identity collection, please restart the server."), http.StatusInternalServerError)
 		return
 	}
 	userQuery := map[string]interface{}{
@@ -134,7 +147,7 @@ func getJWT(w http.ResponseWriter, r *http.Request) {
 	userQueryResult := make(map[int]struct{})
 	if err := db.EvalQuery(userQuery, jwtCol, &userQueryResult); err != nil {
 		tdlog.CritNoRepeat("Query failed in JWT identity collection : %v", err)
-		http.Error(w, "Query failed in JWT identity collection", http.StatusInternalServerError)
+		httpError(w, errors.New("Query failed in JWT identity collection"), http.StatusInternalServerError)
 		return
 	}
 	// Verify password
@@ -166,7 +179,7 @@ func getJWT(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// ... password mismatch
-	http.Error(w, "Invalid password", http.StatusUnauthorized)
+	httpError(w, errors.New("Invalid password"), http.StatusUnauthorized)
 }
 
 // Extract JWT from Authorization header or "access_token" attribute.
@@ -198,7 +211,7 @@ func checkJWT(w http.ResponseWriter, r *http.Request) {
 		return publicKey, nil
 	})
 	if err != nil || !token.Valid {
-		http.Error(w, fmt.Sprintf("{\"error\": \"%s %s\"}", "JWT not valid,", err), http.StatusUnauthorized)
+		httpError(w, fmt.Errorf("JWT not valid, %v", err), http.StatusUnauthorized)
 	} else {
 		w.WriteHeader(http.StatusOK)
 	}
@@ -217,10 +230,13 @@ func jwtWrap(originalHandler http.HandlerFunc) http.HandlerFunc {
 			return publicKey, nil
 		})
 		if err != nil || !token.Valid {
-			http.Error(w, "", http.StatusUnauthorized)
+			httpError(w, errors.New("JWT is missing or not valid"), http.StatusUnauthorized)
 			return
 		}
 		tokenClaims := token.Claims.(jwt.MapClaims)
+		if user, isStr := tokenClaims[JWT_USER_ATTR].(string); isStr {
+			r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+		}
 		var url = strings.TrimPrefix(r.URL.Path, "/")
 		var col = r.FormValue("col")
 		// Call the API endpoint handler if authorization allows
@@ -229,17 +245,40 @@ func jwtWrap(originalHandler http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 		if !sliceContainsStr(tokenClaims[JWT_ENDPOINTS_ATTR], url) {
-			http.Error(w, "", http.StatusUnauthorized)
+			httpError(w, errors.New("JWT does not authorize the request"), http.StatusUnauthorized)
 			return
 		} else if col != "" && !sliceContainsStr(tokenClaims[JWT_COLLECTIONS_ATTR], col) {
-			http.Error(w, "", http.StatusUnauthorized)
+			httpError(w, errors.New("JWT does not authorize the request"), http.StatusUnauthorized)
 			return
 		}
-		originalHandler(w, r)
+		originalHandler(w, r.WithContext(context.WithValue(r.Context(), colsKey{}, jwtCols{tokenClaims[JWT_COLLECTIONS_ATTR]})))
+	}
+}
+
+// Return the JWT user making the request, empty without JWT.
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+// Return true if the request may access the collection, which is not given in parameter "col" and thus not checked by
+// jwtWrap.
+func requestMayUse(r *http.Request, col string) bool {
+	cols, restricted := r.Context().Value(colsKey{}).(jwtCols)
+	return !restricted || sliceContainsStr(cols.cols, col)
+}
+
+// Return the principal the request acts on behalf of, if document access control is enforced: the JWT user other
+// than "admin". Return false if the request may access all documents.
+func requestPrincipal(r *http.Request) (principal string, restricted bool) {
+	if !DocACL {
+		return "", false
 	}
+	principal = requestUser(r)
+	return principal, principal != "" && principal != JWT_USER_ADMIN
 }
 
-// Return true if the string appears in string slice.
+// Return true if the string appears in string slice, or in a slice decoded from JSON array.
 func sliceContainsStr(possibleSlice interface{}, str string) bool {
 	switch possibleSlice.(type) {
 	case []string:
@@ -248,6 +287,12 @@ func sliceContainsStr(possibleSlice interface{}, str string) bool {
 				return true
 			}
 		}
+	case []interface{}:
+		for _, elem := range possibleSlice.([]interface{}) {
+			if elem == str {
+				return true
+			}
+		}
 	}
 	return false
 }
@@ -194,7 +194,7 @@ func TestGetJWTNotUserParameter(t *testing.T) {
 
 	w := httptest.NewRecorder()
 	getJWT(w, req)
-	if w.Code != http.StatusBadRequest || strings.TrimSpace(w.Body.String()) != "Please pass JWT 'user' parameter" {
+	if w.Code != http.StatusBadRequest || errorMessage(w) != "Please pass JWT 'user' parameter" {
 		t.Errorf("Expeceted code %d and error message.", http.StatusBadRequest)
 	}
 }
@@ -209,7 +209,7 @@ func TestGetJWTNotCollection(t *testing.T) {
 	}
 	getJWT(w, req)
 
-	if w.Code != http.StatusInternalServerError || strings.TrimSpace(w.Body.String()) != "Server is missing JWT identity collection, please restart the server." {
+	if w.Code != http.StatusInternalServerError || errorMessage(w) != "Server is missing JWT identity collection, please restart the server." {
 		t.Errorf("Expeceted code %d and error message : server is missing JWT.", http.StatusInternalServerError)
 	}
 }
@@ -251,7 +251,7 @@ func TestGetJWTPasswordError(t *testing.T) {
 	jwtInitSetup()
 	getJWT(w, req)
 
-	if w.Code != http.StatusUnauthorized || strings.TrimSpace(w.Body.String()) != "Invalid password" || !strings.Contains(str.String(), "JWT: successfully initialized DB for JWT features. The default user 'admin' has been created.") {
+	if w.Code != http.StatusUnauthorized || errorMessage(w) != "Invalid password" || !strings.Contains(str.String(), "JWT: successfully initialized DB for JWT features. The default user 'admin' has been created.") {
 		t.Error("Expected StatusUnauthorized and error message jwt verification")
 	}
 }
@@ -334,7 +334,7 @@ func TestCheckJWTErrorJwt(t *testing.T) {
 	w := httptest.NewRecorder()
 	checkJWT(w, req)
 
-	if w.Code != http.StatusUnauthorized || strings.TrimSpace(w.Body.String()) != `{"error": "JWT not valid, no token present in request"}` {
+	if w.Code != http.StatusUnauthorized || errorMessage(w) != "JWT not valid, no token present in request" {
 		t.Error("Expected error jwt not valid")
 	}
 }
@@ -386,7 +386,7 @@ func TestCheckJWTMethodErrorAccessType(t *testing.T) {
 	w := httptest.NewRecorder()
 	checkJWT(w, req)
 
-	if w.Code != http.StatusUnauthorized || strings.TrimSpace(w.Body.String()) != `{"error": "JWT not valid, Unexpected signing method: PS256"}` {
+	if w.Code != http.StatusUnauthorized || errorMessage(w) != "JWT not valid, Unexpected signing method: PS256" {
 		t.Error("Expected status 401 message error method")
 	}
 }
@@ -512,3 +512,47 @@ func TestSliceContainsStr(t *testing.T) {
 		t.Error("Expected false from function `sliceContainsStr`")
 	}
 }
+func TestJwtWrapPrincipal(t *testing.T) {
+	var err error
+	var privateKeyContent, publicKeyContent []byte
+	if privateKeyContent, err = ioutil.ReadFile("jwt-test.key"); err != nil {
+		t.Fatal(err)
+	}
+	if publicKeyContent, err = ioutil.ReadFile("jwt-test.pub"); err != nil {
+		t.Fatal(err)
+	}
+	if privateKey, err = jwt.ParseRSAPrivateKeyFromPEM(privateKeyContent); err != nil {
+		t.Fatal(err)
+	}
+	if publicKey, err = jwt.ParseRSAPublicKeyFromPEM(publicKeyContent); err != nil {
+		t.Fatal(err)
+	}
+	DocACL = true
+	defer func() {
+		DocACL = false
+	}()
+	for _, user := range []string{JWT_USER_ADMIN, "alice"} {
+		token := jwt.New(jwt.GetSigningMethod("RS256"))
+		token.Claims = jwt.MapClaims{
+			JWT_USER_ATTR:        user,
+			JWT_ENDPOINTS_ATTR:   []string{"get"},
+			JWT_COLLECTIONS_ATTR: []string{"col"},
+			"exp":                time.Now().Add(time.Hour * 72).Unix(),
+		}
+		ts, err := token.SignedString(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var principal string
+		var restricted bool
+		req := httptest.NewRequest("GET", "http://localhost:8080/get?col=col&id=1", nil)
+		req.Header.Set("Authorization", "Bearer "+ts)
+		w := httptest.NewRecorder()
+		jwtWrap(func(w http.ResponseWriter, r *http.Request) {
+			principal, restricted = requestPrincipal(r)
+		})(w, req)
+		if w.Code != http.StatusOK || user == JWT_USER_ADMIN && restricted || user != JWT_USER_ADMIN && (!restricted || principal != user) {
+			t.Fatal(user, w.Code, w.Body.String(), principal, restricted)
+		}
+	}
+}
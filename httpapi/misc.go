@@ -4,10 +4,28 @@ package httpapi
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
 	"os"
 	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/shadow"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+const (
+	READYZ_ROUNDTRIP_INTERVAL = time.Second // Readiness probes write to disk at most once in this interval, and reuse the result meanwhile.
+)
+
+var (
+	roundTripLock = new(sync.Mutex)
+	roundTripAt   time.Time // Time of the last readiness round trip
+	roundTripErr  error     // Result of the last readiness round trip
 )
 
 // Flush and close all data files and shutdown the entire program.
@@ -16,6 +34,18 @@ func Shutdown(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	if Backups != nil {
+		Backups.Stop()
+	}
+	if CDC != nil {
+		CDC.Stop()
+	}
+	if ESSync != nil {
+		ESSync.Stop()
+	}
+	for _, s := range Shadows {
+		s.Stop()
+	}
 	HttpDB.Close()
 	os.Exit(0)
 }
@@ -31,9 +61,206 @@ func Dump(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err := HttpDB.Dump(dest); err != nil {
-		http.Error(w, fmt.Sprint(err), 500)
+		httpError(w, err, 500)
+		return
+	}
+}
+
+// Restore a collection from the backup stream in the request body, while other collections remain in service.
+func Restore(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	defer r.Body.Close()
+	if err := HttpDB.RestoreCol(col, r.Body); err != nil {
+		httpError(w, err, 500)
+		return
+	}
+}
+
+// Reload settings of the database and its collections, and optionally turn verbose logging on/off.
+func ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	verbose := r.FormValue("verbose")
+	verboseOn, err := strconv.ParseBool(verbose)
+	if verbose != "" && err != nil {
+		httpError(w, dberr.New(dberr.ErrorInvalidParam, "verbose", verbose), 400)
+		return
+	}
+	if err := HttpDB.ReloadConfig(); err != nil {
+		httpError(w, err, 500)
+		return
+	}
+	if verbose != "" {
+		tdlog.SetVerbose(verboseOn)
+	}
+}
+
+// Return the documents currently locked and the partition locks waited for, optionally those of a collection.
+func Locks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	col := r.FormValue("col")
+	locks := make([]db.LockInfo, 0)
+	for _, lock := range HttpDB.Locks() {
+		if col == "" || lock.Col == col {
+			locks = append(locks, lock)
+		}
+	}
+	if err := writeResult(w, r, locks); err != nil {
+		httpError(w, err, 500)
+	}
+}
+
+// Return the lock waits of the collections and their documents waited for the most, optionally those of a collection,
+// and optionally start counting over.
+func Contention(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	col, top, reset := r.FormValue("col"), 10, false
+	if topStr := r.FormValue("top"); topStr != "" {
+		var err error
+		if top, err = strconv.Atoi(topStr); err != nil || top < 0 {
+			httpError(w, dberr.New(dberr.ErrorInvalidParam, "top", topStr), 400)
+			return
+		}
+	}
+	if resetStr := r.FormValue("reset"); resetStr != "" {
+		var err error
+		if reset, err = strconv.ParseBool(resetStr); err != nil {
+			httpError(w, dberr.New(dberr.ErrorInvalidParam, "reset", resetStr), 400)
+			return
+		}
+	}
+	report := make([]db.ContentionInfo, 0)
+	for _, info := range HttpDB.Contention(top, reset) {
+		if col == "" || info.Col == col {
+			report = append(report, info)
+		}
+	}
+	if err := writeResult(w, r, report); err != nil {
+		httpError(w, err, 500)
+	}
+}
+
+// Return the manifest of the database layout - collections, indexes, settings, views, time series and stored queries.
+func Manifest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	if err := writeResult(w, r, HttpDB.Manifest()); err != nil {
+		httpError(w, err, 500)
+	}
+}
+
+// Return the differences of the database layout from a manifest, an empty array if the layout matches.
+func ManifestDiff(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var manifestStr string
+	if !Require(w, r, "manifest", &manifestStr) {
+		return
+	}
+	var manifest db.Manifest
+	if err := json.Unmarshal([]byte(manifestStr), &manifest); err != nil {
+		httpError(w, dberr.New(dberr.ErrorInvalidJSON, manifestStr, "manifest"), 400)
 		return
 	}
+	diffs := HttpDB.ManifestDiff(manifest)
+	if diffs == nil {
+		diffs = []string{}
+	}
+	if err := writeResult(w, r, diffs); err != nil {
+		httpError(w, err, 500)
+	}
+}
+
+// Return the statistics of the collections whose writes are mirrored.
+func ShadowStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	stats := make([]shadow.Stats, len(Shadows))
+	for i, s := range Shadows {
+		stats[i] = s.Stats()
+	}
+	if err := writeResult(w, r, stats); err != nil {
+		httpError(w, err, 500)
+	}
+}
+
+// Report whether the database files are open and intact (liveness probe).
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	if HttpDB == nil {
+		httpError(w, errors.New("Database is not open"), 503)
+		return
+	} else if err := HttpDB.CheckHealth(false); err != nil {
+		httpError(w, err, 503)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// Report whether the database is ready to serve requests, optionally proving that the disk accepts writes (readiness probe).
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	roundTrip := false
+	if roundTripVal := r.FormValue("roundtrip"); roundTripVal != "" {
+		var err error
+		if roundTrip, err = strconv.ParseBool(roundTripVal); err != nil {
+			httpError(w, dberr.New(dberr.ErrorInvalidParam, "roundtrip", roundTripVal), 400)
+			return
+		}
+	}
+	if HttpDB == nil {
+		httpError(w, errors.New("Database is not open"), 503)
+		return
+	} else if err := checkReadiness(roundTrip); err != nil {
+		httpError(w, err, 503)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// Check database health. Round trips to disk are limited to one in READYZ_ROUNDTRIP_INTERVAL, so that frequent
+// probes do not keep the disk busy; more frequent probes reuse the result of the last round trip.
+func checkReadiness(roundTrip bool) error {
+	if !roundTrip {
+		return HttpDB.CheckHealth(false)
+	}
+	roundTripLock.Lock()
+	defer roundTripLock.Unlock()
+	if time.Since(roundTripAt) >= READYZ_ROUNDTRIP_INTERVAL {
+		roundTripErr = HttpDB.CheckHealth(true)
+		roundTripAt = time.Now()
+		return roundTripErr
+	} else if roundTripErr != nil {
+		return roundTripErr
+	}
+	return HttpDB.CheckHealth(false)
 }
 
 // Return server memory statistics.
@@ -47,7 +274,7 @@ func MemStats(w http.ResponseWriter, r *http.Request) {
 
 	resp, err := json.Marshal(stats)
 	if err != nil {
-		http.Error(w, "Cannot serialize MemStats to JSON.", 500)
+		httpError(w, errors.New("Cannot serialize MemStats to JSON."), 500)
 		return
 	}
 	w.Write(resp)
@@ -59,5 +286,5 @@ func Version(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
-	w.Write([]byte("6"))
+	w.Write([]byte("7"))
 }
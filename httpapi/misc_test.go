@@ -1,25 +1,39 @@
 package httpapi
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"bou.ke/monkey"
 	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/shadow"
+	"github.com/cankansin/tiedot/tdlog"
 )
 
 var (
 	requestShutDown    = "http://localhost:8080/shutdown"
 	requestDumpNotDest = "http://localhost:8080/dump"
 	requestDump        = "http://localhost:8080/dump?dest=%s"
+	requestRestore     = "http://localhost:8080/restore?col=%s"
 	requestMemstats    = "http://localhost:8080/memstats"
 	requestVersion     = "http://localhost:8080/version"
+	requestReload      = "http://localhost:8080/reloadconfig?verbose=%s"
+	requestHealthz     = "http://localhost:8080/healthz"
+	requestReadyz      = "http://localhost:8080/readyz?roundtrip=%s"
+	requestLocks       = "http://localhost:8080/locks?col=%s"
+	requestContention  = "http://localhost:8080/contention?top=%s&reset=%s"
+	requestManifest    = "http://localhost:8080/manifest"
+	requestManiDiff    = "http://localhost:8080/manifestdiff?manifest=%s"
+	requestShadowStats = "http://localhost:8080/shadowstats"
 
 	listStats = []string{
 		"Alloc", "TotalAlloc", "Sys",
@@ -38,9 +52,19 @@ func TestMisc(t *testing.T) {
 		TDumpNotDest,
 		TDump,
 		TDumpError,
+		TRestore,
+		TRestoreNotCol,
 		TMemStats,
 		TVersion,
 		TMemStatsErrJsonMarshal,
+		TReloadConfig,
+		TReloadConfigInvalidVerbose,
+		THealthz,
+		TReadyz,
+		TLocks,
+		TContention,
+		TManifest,
+		TShadowStats,
 	}
 	managerSubTests(testsMisc, "misc_test", t)
 }
@@ -77,7 +101,7 @@ func TDumpNotDest(t *testing.T) {
 	reqDump := httptest.NewRequest(RandMethodRequest(), requestDumpNotDest, nil)
 	Dump(wDump, reqDump)
 
-	if wDump.Code != 400 || strings.TrimSpace(wDump.Body.String()) != "Please pass POST/PUT/GET parameter value of 'dest'." {
+	if wDump.Code != 400 || errorMessage(wDump) != "Please pass POST/PUT/GET parameter value of 'dest'." {
 		t.Error("Expected code 400 and message error not such param 'dest'")
 	}
 }
@@ -114,10 +138,60 @@ func TDumpError(t *testing.T) {
 	reqDump := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDump, tempDir), nil)
 
 	Dump(wDump, reqDump)
-	if wDump.Code != 500 || strings.TrimSpace(wDump.Body.String()) != "Destination file tmp/data-config.json already exists" {
+	if wDump.Code != 500 || errorMessage(wDump) != "Destination file tmp/changes already exists" {
 		t.Error("Expected code 500 and error message folder exists.", wDump.Code, wDump.Body.String())
 	}
 }
+func TRestore(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	id, err := HttpDB.Use(collection).Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backup bytes.Buffer
+	if _, err = HttpDB.BackupSince(0, &backup); err != nil {
+		t.Fatal(err)
+	} else if err = HttpDB.Use(collection).Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	wRestore := httptest.NewRecorder()
+	reqRestore := httptest.NewRequest("POST", fmt.Sprintf(requestRestore, collection), &backup)
+	Restore(wRestore, reqRestore)
+	if wRestore.Code != 200 {
+		t.Fatal(wRestore.Code, wRestore.Body.String())
+	} else if doc, err := HttpDB.Use(collection).Read(id); err != nil || doc["a"] != float64(1) {
+		t.Fatal(doc, err)
+	}
+	// The backup must hold the collection
+	wRestore = httptest.NewRecorder()
+	reqRestore = httptest.NewRequest("POST", fmt.Sprintf(requestRestore, "other"), strings.NewReader(`{"since": 0, "seq": 0, "cols": []}`))
+	Restore(wRestore, reqRestore)
+	if wRestore.Code != 404 || errorMessage(wRestore) != "Collection other does not exist" {
+		t.Fatal(wRestore.Code, wRestore.Body.String())
+	}
+}
+func TRestoreNotCol(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	wRestore := httptest.NewRecorder()
+	reqRestore := httptest.NewRequest("POST", "http://localhost:8080/restore", nil)
+	Restore(wRestore, reqRestore)
+	if wRestore.Code != 400 || errorMessage(wRestore) != "Please pass POST/PUT/GET parameter value of 'col'." {
+		t.Fatal(wRestore.Code, wRestore.Body.String())
+	}
+}
 func TMemStats(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
@@ -152,7 +226,7 @@ func TMemStatsErrJsonMarshal(t *testing.T) {
 	defer patch.Unpatch()
 	MemStats(wMemStats, reqMemStats)
 
-	if wMemStats.Code != 500 || strings.TrimSpace(wMemStats.Body.String()) != "Cannot serialize MemStats to JSON." {
+	if wMemStats.Code != 500 || errorMessage(wMemStats) != "Cannot serialize MemStats to JSON." {
 		t.Error("Expected code 500 and message error serialize json.")
 	}
 }
@@ -168,7 +242,215 @@ func TVersion(t *testing.T) {
 	reqVersion := httptest.NewRequest(RandMethodRequest(), requestVersion, nil)
 	Version(wVersion, reqVersion)
 
-	if wVersion.Code != 200 || strings.TrimSpace(wVersion.Body.String()) != "6" {
+	if wVersion.Code != 200 || strings.TrimSpace(wVersion.Body.String()) != "7" {
 		t.Error("Expected code 200 and return version '6'.")
 	}
 }
+func TReloadConfig(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	defer tdlog.SetVerbose(tdlog.IsVerbose())
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	for _, verbose := range []bool{true, false} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestReload, fmt.Sprint(verbose)), nil)
+		ReloadConfig(w, req)
+		if w.Code != 200 || tdlog.IsVerbose() != verbose {
+			t.Fatal(w.Code, w.Body.String())
+		}
+	}
+}
+func TReloadConfigInvalidVerbose(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestReload, "maybe"), nil)
+	ReloadConfig(w, req)
+	if w.Code != 400 || errorMessage(w) != "Invalid verbose 'maybe'." {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+func THealthz(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	HttpDB = nil
+	w := httptest.NewRecorder()
+	Healthz(w, httptest.NewRequest(RandMethodRequest(), requestHealthz, nil))
+	if w.Code != 503 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	w = httptest.NewRecorder()
+	Healthz(w, httptest.NewRequest(RandMethodRequest(), requestHealthz, nil))
+	if w.Code != 200 || w.Body.String() != "OK" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+func TReadyz(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	for _, roundTrip := range []string{"", "true", "false"} {
+		w := httptest.NewRecorder()
+		Readyz(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestReadyz, roundTrip), nil))
+		if w.Code != 200 || w.Body.String() != "OK" {
+			t.Fatal(roundTrip, w.Code, w.Body.String())
+		}
+	}
+	// Round trips in quick succession reuse the result of the first one
+	roundTripAt = time.Time{}
+	var firstRoundTrip time.Time
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		Readyz(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestReadyz, "true"), nil))
+		if w.Code != 200 || w.Body.String() != "OK" {
+			t.Fatal(w.Code, w.Body.String())
+		} else if i == 0 {
+			firstRoundTrip = roundTripAt
+		} else if roundTripAt != firstRoundTrip {
+			t.Fatal("Round trip is repeated", i)
+		}
+	}
+	w := httptest.NewRecorder()
+	Readyz(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestReadyz, "maybe"), nil))
+	if w.Code != 400 || errorMessage(w) != "Invalid roundtrip 'maybe'." {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+func TLocks(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	defer HttpDB.Close()
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	locks, err := HttpDB.Use(collection).LockUpdateMany(0, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer locks.Unlock()
+	var held []db.LockInfo
+	w := httptest.NewRecorder()
+	Locks(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestLocks, collection), nil))
+	if err = json.Unmarshal(w.Body.Bytes(), &held); err != nil || w.Code != 200 || len(held) != 2 || held[0].Kind != "set" || held[0].ID != 1 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	Locks(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestLocks, "other"), nil))
+	if w.Code != 200 || w.Body.String() != "[]" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+func TContention(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	defer HttpDB.Close()
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	Contention(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestContention, "5", "true"), nil))
+	if w.Code != 200 || w.Body.String() != "[]" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	Contention(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestContention, "-1", ""), nil))
+	if w.Code != 400 || errorMessage(w) != "Invalid top '-1'." {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	Contention(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestContention, "", "maybe"), nil))
+	if w.Code != 400 || errorMessage(w) != "Invalid reset 'maybe'." {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+func TManifest(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	defer HttpDB.Close()
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	} else if err = HttpDB.Use(collection).Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	var manifest db.Manifest
+	w := httptest.NewRecorder()
+	Manifest(w, httptest.NewRequest(RandMethodRequest(), requestManifest, nil))
+	if err = json.Unmarshal(w.Body.Bytes(), &manifest); err != nil || w.Code != 200 || len(manifest.Cols[collection].Indexes) != 1 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	ManifestDiff(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestManiDiff, url.QueryEscape("{")), nil))
+	if w.Code != 400 || errorMessage(w) != "'{' is not valid JSON manifest." {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	manifestJS, _ := json.Marshal(manifest)
+	w = httptest.NewRecorder()
+	ManifestDiff(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestManiDiff, url.QueryEscape(string(manifestJS))), nil))
+	if w.Code != 200 || w.Body.String() != "[]" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if err = HttpDB.Use(collection).Unindex([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	ManifestDiff(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestManiDiff, url.QueryEscape(string(manifestJS))), nil))
+	if w.Code != 200 || w.Body.String() != fmt.Sprintf(`["index [a] of collection %s is missing"]`, collection) {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+func TShadowStats(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	defer HttpDB.Close()
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	} else if err = HttpDB.Create("shadow"); err != nil {
+		t.Fatal(err)
+	}
+	Shadows = []*shadow.Shadow{shadow.New(shadow.Config{Col: collection, TargetCol: "shadow"})}
+	defer func() {
+		Shadows = nil
+	}()
+	if err = Shadows[0].Start(HttpDB); err != nil {
+		t.Fatal(err)
+	} else if _, err = HttpDB.Use(collection).Insert(map[string]interface{}{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	Shadows[0].Stop()
+	var stats []shadow.Stats
+	w := httptest.NewRecorder()
+	ShadowStats(w, httptest.NewRequest(RandMethodRequest(), requestShadowStats, nil))
+	if err = json.Unmarshal(w.Body.Bytes(), &stats); err != nil || w.Code != 200 || len(stats) != 1 || stats[0].Mirrored != 1 || stats[0].Target != "shadow" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
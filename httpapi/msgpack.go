@@ -0,0 +1,188 @@
+// MessagePack responses.
+//
+// Clients may ask for query results and documents in MessagePack (https://msgpack.org) rather than JSON by the Accept
+// header, which makes large results smaller and cheaper to parse. JSON remains the default, and errors are always
+// reported in JSON. Numbers that JSON would write as integers are encoded as MessagePack integers, other numbers as
+// 64-bit floats; map keys are written in sorted order.
+
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	MSGPACK_CONTENT_TYPE = "application/msgpack" // Media type of MessagePack responses.
+	RESP_BUF_MAX_POOLED  = 1024 * 1024           // Response buffers grown larger than this (in bytes) are not pooled.
+)
+
+// Buffers for serialising responses, which are written before the buffer is put back.
+var respBufPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// Return true if the Accept header of the request asks for MessagePack.
+func acceptsMsgpack(r *http.Request) bool {
+	return acceptable(r, "Accept", MSGPACK_CONTENT_TYPE, "application/x-msgpack") != ""
+}
+
+// Serialise the result in the encoding asked for by the request - MessagePack or JSON - and write it as the response
+// along with its content type. The result is serialised into a pooled buffer, nothing is written if serialisation fails.
+func writeResult(w http.ResponseWriter, r *http.Request, result interface{}) (err error) {
+	w.Header().Add("Vary", "Accept")
+	buf := respBufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	var resp []byte
+	if !acceptsMsgpack(r) {
+		if err = encodeJSON(buf, result); err == nil {
+			// Encode terminates the result by a new line
+			resp = buf.Bytes()[:buf.Len()-1]
+		}
+	} else if resp, err = appendMsgpack(buf.Bytes(), result); err == nil {
+		w.Header().Set("Content-Type", MSGPACK_CONTENT_TYPE)
+		if cap(resp) > buf.Cap() {
+			// Keep the grown buffer
+			buf = bytes.NewBuffer(resp[:0])
+		}
+	}
+	if err == nil {
+		w.Write(resp)
+	}
+	if buf.Cap() <= RESP_BUF_MAX_POOLED {
+		respBufPool.Put(buf)
+	}
+	return
+}
+
+// Serialise the result into the buffer in JSON, terminated by a new line.
+func encodeJSON(buf *bytes.Buffer, result interface{}) error {
+	return json.NewEncoder(buf).Encode(result)
+}
+
+// Serialise a value made of JSON types into MessagePack. Values of other types are serialised as their JSON
+// representation would be.
+func marshalMsgpack(val interface{}) ([]byte, error) {
+	return appendMsgpack(make([]byte, 0, 512), val)
+}
+
+// Append the MessagePack serialisation of the value to the buffer.
+func appendMsgpack(buf []byte, val interface{}) ([]byte, error) {
+	var err error
+	switch val := val.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if val {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case int:
+		return appendMsgpackInt(buf, int64(val)), nil
+	case float64:
+		if val == math.Trunc(val) && math.Abs(val) < 1e15 {
+			return appendMsgpackInt(buf, int64(val)), nil
+		}
+		buf = append(buf, 0xcb)
+		return appendBigEndian(buf, math.Float64bits(val), 8), nil
+	case json.Number:
+		if intVal, err := val.Int64(); err == nil {
+			return appendMsgpackInt(buf, intVal), nil
+		}
+		floatVal, err := val.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return appendMsgpack(buf, floatVal)
+	case string:
+		buf = appendMsgpackHeader(buf, len(val), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		return append(buf, val...), nil
+	case []interface{}:
+		buf = appendMsgpackHeader(buf, len(val), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, elem := range val {
+			if buf, err = appendMsgpack(buf, elem); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf = appendMsgpackHeader(buf, len(val), 0x80, 16, 0, 0xde, 0xdf)
+		for _, key := range keys {
+			if buf, err = appendMsgpack(buf, key); err != nil {
+				return nil, err
+			} else if buf, err = appendMsgpack(buf, val[key]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	// Other types are brought to JSON types by their JSON representation
+	valJS, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	var jsonVal interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(valJS)))
+	decoder.UseNumber()
+	if err = decoder.Decode(&jsonVal); err != nil {
+		return nil, err
+	}
+	return appendMsgpack(buf, jsonVal)
+}
+
+// Append the header of a string, array or map of the length to the buffer: the fix format (its first byte and the
+// length it is limited to), or the 8-bit (if there is one), 16-bit or 32-bit format.
+func appendMsgpackHeader(buf []byte, length int, fix byte, fixLimit int, format8, format16, format32 byte) []byte {
+	switch {
+	case length < fixLimit:
+		return append(buf, fix|byte(length))
+	case format8 != 0 && length <= math.MaxUint8:
+		return append(buf, format8, byte(length))
+	case length <= math.MaxUint16:
+		return appendBigEndian(append(buf, format16), uint64(length), 2)
+	}
+	return appendBigEndian(append(buf, format32), uint64(length), 4)
+}
+
+// Append an integer in its shortest MessagePack format to the buffer.
+func appendMsgpackInt(buf []byte, val int64) []byte {
+	switch {
+	case val >= 0 && val <= math.MaxInt8:
+		return append(buf, byte(val))
+	case val >= -32 && val < 0:
+		return append(buf, byte(val))
+	case val >= 0 && val <= math.MaxUint8:
+		return append(buf, 0xcc, byte(val))
+	case val >= 0 && val <= math.MaxUint16:
+		return appendBigEndian(append(buf, 0xcd), uint64(val), 2)
+	case val >= 0 && val <= math.MaxUint32:
+		return appendBigEndian(append(buf, 0xce), uint64(val), 4)
+	case val >= 0:
+		return appendBigEndian(append(buf, 0xcf), uint64(val), 8)
+	case val >= math.MinInt8:
+		return append(buf, 0xd0, byte(val))
+	case val >= math.MinInt16:
+		return appendBigEndian(append(buf, 0xd1), uint64(val), 2)
+	case val >= math.MinInt32:
+		return appendBigEndian(append(buf, 0xd2), uint64(val), 4)
+	}
+	return appendBigEndian(append(buf, 0xd3), uint64(val), 8)
+}
+
+// Append the lowest bytes of the value to the buffer, most significant byte first.
+func appendBigEndian(buf []byte, val uint64, size int) []byte {
+	for shift := uint(size-1) * 8; ; shift -= 8 {
+		buf = append(buf, byte(val>>shift))
+		if shift == 0 {
+			return buf
+		}
+	}
+}
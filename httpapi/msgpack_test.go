@@ -0,0 +1,134 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cankansin/tiedot/db"
+)
+
+func TestMarshalMsgpack(t *testing.T) {
+	for _, test := range []struct {
+		val     interface{}
+		encoded []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{false, []byte{0xc2}},
+		{float64(0), []byte{0x00}},
+		{float64(127), []byte{0x7f}},
+		{float64(-1), []byte{0xff}},
+		{float64(-32), []byte{0xe0}},
+		{float64(200), []byte{0xcc, 0xc8}},
+		{float64(-100), []byte{0xd0, 0x9c}},
+		{float64(65535), []byte{0xcd, 0xff, 0xff}},
+		{float64(-1000), []byte{0xd1, 0xfc, 0x18}},
+		{float64(100000), []byte{0xce, 0x00, 0x01, 0x86, 0xa0}},
+		{float64(1 << 40), []byte{0xcf, 0, 0, 0x01, 0, 0, 0, 0, 0}},
+		{1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{json.Number("-3"), []byte{0xfd}},
+		{"a", []byte{0xa1, 'a'}},
+		{strings.Repeat("a", 40), append([]byte{0xd9, 40}, strings.Repeat("a", 40)...)},
+		{[]interface{}{1.0, "a"}, []byte{0x92, 0x01, 0xa1, 'a'}},
+		{map[string]interface{}{"b": nil, "a": true}, []byte{0x82, 0xa1, 'a', 0xc3, 0xa1, 'b', 0xc0}},
+		// Other types are encoded by their JSON representation
+		{map[string]map[string]interface{}{"a": {"b": 1}}, []byte{0x81, 0xa1, 'a', 0x81, 0xa1, 'b', 0x01}},
+	} {
+		if encoded, err := marshalMsgpack(test.val); err != nil || !bytes.Equal(encoded, test.encoded) {
+			t.Fatalf("%v: % x, %v", test.val, encoded, err)
+		}
+	}
+	long := make([]interface{}, 20)
+	if encoded, err := marshalMsgpack(long); err != nil || !bytes.Equal(encoded[:3], []byte{0xdc, 0, 20}) || len(encoded) != 23 {
+		t.Fatalf("% x, %v", encoded, err)
+	}
+	if _, err := marshalMsgpack(map[string]interface{}{"a": make(chan int)}); err == nil {
+		t.Fatal("did not fail")
+	}
+}
+
+func TestAcceptsMsgpack(t *testing.T) {
+	for accept, expected := range map[string]bool{
+		"":                                     false,
+		"application/json":                     false,
+		"application/msgpack":                  true,
+		"application/x-msgpack":                true,
+		"text/html, Application/MsgPack;q=0.9": true,
+		"application/msgpack;q=0, application/json": false,
+	} {
+		req := httptest.NewRequest("GET", "http://localhost:8080/get", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if acceptsMsgpack(req) != expected {
+			t.Fatal(accept)
+		}
+	}
+}
+
+func TestGetMsgpack(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	doc := map[string]interface{}{"a": 1.0, "b": []interface{}{"c"}}
+	id, err := HttpDB.Use(collection).Insert(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := marshalMsgpack(doc)
+	req := httptest.NewRequest("GET", fmt.Sprintf(requestGet, collection, strconv.Itoa(id)), nil)
+	req.Header.Set("Accept", "application/msgpack")
+	w := httptest.NewRecorder()
+	Get(w, req)
+	if w.Code != 200 || w.Header().Get("Content-Type") != MSGPACK_CONTENT_TYPE || !bytes.Equal(w.Body.Bytes(), expected) {
+		t.Fatal(w.Code, w.Header(), w.Body.Bytes())
+	}
+	// JSON remains the default, errors are always in JSON
+	w = httptest.NewRecorder()
+	Get(w, httptest.NewRequest("GET", fmt.Sprintf(requestGet, collection, strconv.Itoa(id)), nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/json" || strings.TrimSpace(w.Body.String()) != `{"a":1,"b":["c"]}` {
+		t.Fatal(w.Code, w.Header(), w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	Query(w, req)
+	if w.Code != 400 || w.Header().Get("Content-Type") != "application/json" || errorCode(w) != "missing_param" {
+		t.Fatal(w.Code, w.Header(), w.Body.String())
+	}
+}
+
+func TestWriteResult(t *testing.T) {
+	result := map[string]interface{}{"a": 1.0, "b": "<c>"}
+	expectedJS, _ := json.Marshal(result)
+	expectedMsgpack, _ := marshalMsgpack(result)
+	// Pooled buffers are reused without leaking previous responses
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		if err := writeResult(w, httptest.NewRequest("GET", "http://localhost:8080/get", nil), result); err != nil ||
+			!bytes.Equal(w.Body.Bytes(), expectedJS) {
+			t.Fatal(err, w.Body.String())
+		}
+		req := httptest.NewRequest("GET", "http://localhost:8080/get", nil)
+		req.Header.Set("Accept", MSGPACK_CONTENT_TYPE)
+		w = httptest.NewRecorder()
+		if err := writeResult(w, req, result); err != nil || !bytes.Equal(w.Body.Bytes(), expectedMsgpack) ||
+			w.Header().Get("Content-Type") != MSGPACK_CONTENT_TYPE {
+			t.Fatal(err, w.Header(), w.Body.Bytes())
+		}
+	}
+	// Nothing is written if the result cannot be serialised
+	w := httptest.NewRecorder()
+	if err := writeResult(w, httptest.NewRequest("GET", "http://localhost:8080/get", nil), make(chan int)); err == nil || w.Body.Len() != 0 {
+		t.Fatal(err, w.Body.String())
+	}
+}
@@ -4,11 +4,16 @@ package httpapi
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdsql"
 )
 
 // Execute a query and return documents from the result.
@@ -17,6 +22,9 @@ func Query(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	if !adHocQueryAllowed(w) {
+		return
+	}
 	var col, q string
 	if !Require(w, r, "col", &col) {
 		return
@@ -26,37 +34,109 @@ func Query(w http.ResponseWriter, r *http.Request) {
 	}
 	var qJson interface{}
 	if err := json.Unmarshal([]byte(q), &qJson); err != nil {
-		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
+		httpError(w, dberr.New(dberr.ErrorInvalidJSON, q, "query"), 400)
 		return
 	}
 	dbcol := HttpDB.Use(col)
 	if dbcol == nil {
-		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
 		return
 	}
+	exactJSON(dbcol, q, &qJson)
+	qJson = strictQuery(qJson)
 	// Evaluate the query
 	queryResult := make(map[int]struct{})
-	if err := db.EvalQuery(qJson, dbcol, &queryResult); err != nil {
-		http.Error(w, fmt.Sprint(err), 400)
+	if err := db.EvalQuery(aclQuery(r, dbcol, qJson), dbcol, &queryResult); err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	writeQueryResult(w, r, dbcol, queryResult)
+}
+
+// Return the documents on the page of query result, see queryPage.
+func writeQueryResult(w http.ResponseWriter, r *http.Request, dbcol *db.Col, queryResult map[int]struct{}) {
+	pageIDs, ok := queryPage(w, r, dbcol, queryResult)
+	if !ok {
 		return
 	}
 	// Construct array of result
-	resultDocs := make(map[string]interface{}, len(queryResult))
+	resultDocs := make(map[string]interface{}, len(pageIDs))
 	counter := 0
-	for docID := range queryResult {
-		doc, _ := dbcol.Read(docID)
+	for _, docID := range pageIDs {
+		doc, _ := readAs(r, dbcol, docID)
 		if doc != nil {
 			resultDocs[strconv.Itoa(docID)] = doc
 			counter++
 		}
 	}
 	// Serialize the array
-	resp, err := json.Marshal(resultDocs)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Server error: query returned invalid structure"), 500)
-		return
+	if err := writeResult(w, r, resultDocs); err != nil {
+		httpError(w, errors.New("Server error: query returned invalid structure"), 500)
+	}
+}
+
+// Return the IDs of the page of query result given by optional parameters "offset" and "limit", and set the headers
+// telling the total number of documents and the links to the previous and next pages. Pages follow the result order
+// of the collection (see db.ColConfig.ResultOrder). If either parameter is invalid, set HTTP error status and return
+// false.
+func queryPage(w http.ResponseWriter, r *http.Request, dbcol *db.Col, queryResult map[int]struct{}) (ids []int, ok bool) {
+	w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, Link")
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(queryResult)))
+	ids = make([]int, 0, len(queryResult))
+	for id := range queryResult {
+		ids = append(ids, id)
+	}
+	offsetStr, limitStr := r.FormValue("offset"), r.FormValue("limit")
+	if offsetStr == "" && limitStr == "" {
+		return ids, true
+	}
+	offset, limit := 0, len(ids)
+	var err error
+	if offsetStr != "" {
+		if offset, err = strconv.Atoi(offsetStr); err != nil || offset < 0 {
+			httpError(w, dberr.New(dberr.ErrorInvalidParam, "offset", offsetStr), 400)
+			return nil, false
+		}
+	}
+	if limitStr != "" {
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 1 {
+			httpError(w, dberr.New(dberr.ErrorInvalidParam, "limit", limitStr), 400)
+			return nil, false
+		}
+	}
+	ids = dbcol.SortResult(queryResult)
+	if offset > len(ids) {
+		offset = len(ids)
+	}
+	end := len(ids)
+	if limit < end-offset {
+		end = offset + limit
+	}
+	var links []string
+	if offset > 0 {
+		links = append(links, pageLink(r, offset-limit, limit, "prev"))
+	}
+	if end < len(ids) {
+		links = append(links, pageLink(r, end, limit, "next"))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	return ids[offset:end], true
+}
+
+// Return the Link header value of the query page at the offset, requested by the same parameters otherwise.
+func pageLink(r *http.Request, offset, limit int, rel string) string {
+	if offset < 0 {
+		offset = 0
 	}
-	w.Write([]byte(string(resp)))
+	params := make(url.Values)
+	for key, vals := range r.Form {
+		params[key] = vals
+	}
+	params.Set("offset", strconv.Itoa(offset))
+	params.Set("limit", strconv.Itoa(limit))
+	return fmt.Sprintf("<%s?%s>; rel=\"%s\"", r.URL.Path, params.Encode(), rel)
 }
 
 // Execute a query and return number of documents from the result.
@@ -65,6 +145,9 @@ func Count(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	if !adHocQueryAllowed(w) {
+		return
+	}
 	var col, q string
 	if !Require(w, r, "col", &col) {
 		return
@@ -74,18 +157,352 @@ func Count(w http.ResponseWriter, r *http.Request) {
 	}
 	var qJson interface{}
 	if err := json.Unmarshal([]byte(q), &qJson); err != nil {
-		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
+		httpError(w, dberr.New(dberr.ErrorInvalidJSON, q, "query"), 400)
 		return
 	}
 	dbcol := HttpDB.Use(col)
 	if dbcol == nil {
-		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
 		return
 	}
+	exactJSON(dbcol, q, &qJson)
+	qJson = strictQuery(qJson)
 	queryResult := make(map[int]struct{})
-	if err := db.EvalQuery(qJson, dbcol, &queryResult); err != nil {
-		http.Error(w, fmt.Sprint(err), 400)
+	if err := db.EvalQuery(aclQuery(r, dbcol, qJson), dbcol, &queryResult); err != nil {
+		httpError(w, err, 400)
 		return
 	}
 	w.Write([]byte(strconv.Itoa(len(queryResult))))
 }
+
+// Return approximate distinct counts and percentiles of the values along the paths (each separated by comma) in all
+// documents, see db.Col.Analyze.
+func Analyze(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	if !adHocQueryAllowed(w) {
+		return
+	}
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	r.ParseForm()
+	if len(r.Form["path"]) == 0 {
+		httpError(w, dberr.New(dberr.ErrorMissingParam, "path"), 400)
+		return
+	}
+	paths := make([][]string, len(r.Form["path"]))
+	for i, path := range r.Form["path"] {
+		paths[i] = strings.Split(path, ",")
+	}
+	percentiles := []float64{50, 90, 99}
+	if percentilesStr := r.FormValue("percentiles"); percentilesStr != "" {
+		percentiles = nil
+		for _, percentileStr := range strings.Split(percentilesStr, ",") {
+			percentile, err := strconv.ParseFloat(percentileStr, 64)
+			if err != nil {
+				httpError(w, dberr.New(dberr.ErrorInvalidParam, "percentile", percentileStr), 400)
+				return
+			}
+			percentiles = append(percentiles, percentile)
+		}
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
+		return
+	}
+	var analysis db.Analysis
+	var err error
+	if principal, restricted := requestPrincipal(r); restricted {
+		analysis, err = dbcol.AnalyzeAs(principal, paths, percentiles)
+	} else {
+		analysis, err = dbcol.Analyze(paths, percentiles)
+	}
+	if err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	if err = writeResult(w, r, analysis); err != nil {
+		httpError(w, err, 500)
+	}
+}
+
+// Run a SELECT statement and return the result documents in order.
+func SQL(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	if !adHocQueryAllowed(w) {
+		return
+	}
+	var q string
+	if !Require(w, r, "q", &q) {
+		return
+	}
+	sel, err := tdsql.Parse(q)
+	if err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	if dbcol := HttpDB.Use(sel.Col); dbcol != nil {
+		sel.Where = aclQuery(r, dbcol, sel.Where)
+	}
+	rows, err := sel.Run(HttpDB)
+	if err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	result := make([]interface{}, len(rows))
+	for i, row := range rows {
+		result[i] = map[string]interface{}{"id": row.ID, "doc": row.Doc}
+	}
+	if err = writeResult(w, r, result); err != nil {
+		httpError(w, errors.New("Server error: query returned invalid structure"), 500)
+	}
+}
+
+// Parse the query given in parameter "q" and return collection "col" it runs on; if either is invalid, or ad-hoc
+// queries are not allowed, set HTTP error status and return nil.
+func requireQuery(w http.ResponseWriter, r *http.Request, qJson *interface{}) *db.Col {
+	if !adHocQueryAllowed(w) {
+		return nil
+	}
+	var col, q string
+	if !Require(w, r, "col", &col) {
+		return nil
+	}
+	if !Require(w, r, "q", &q) {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(q), qJson); err != nil {
+		httpError(w, dberr.New(dberr.ErrorInvalidJSON, q, "query"), 400)
+		return nil
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), 400)
+		return nil
+	}
+	exactJSON(dbcol, q, qJson)
+	*qJson = strictQuery(*qJson)
+	return dbcol
+}
+
+// Write the progress of an operation on query result as a line of JSON, and flush it to the client.
+func writeProgress(w http.ResponseWriter, prog db.QueryOpProgress) {
+	line, _ := json.Marshal(prog)
+	w.Write(append(line, '\n'))
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Delete all documents matching a query, reporting the progress after each batch.
+func DeleteByQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var qJson interface{}
+	dbcol := requireQuery(w, r, &qJson)
+	if dbcol == nil {
+		return
+	}
+	if r.FormValue("dryrun") == "true" {
+		writeDryRun(w, r)(dbcol.DeleteByQueryDryRun(aclQuery(r, dbcol, qJson)))
+		return
+	}
+	progress := func(prog db.QueryOpProgress) {
+		writeProgress(w, prog)
+	}
+	var prog db.QueryOpProgress
+	var err error
+	if principal, restricted := requestPrincipal(r); restricted {
+		prog, err = dbcol.DeleteByQueryAs(principal, qJson, progress)
+	} else {
+		prog, err = dbcol.DeleteByQuery(qJson, progress)
+	}
+	if err != nil {
+		httpError(w, err, 400)
+	} else if prog.Batches == 0 {
+		writeProgress(w, prog)
+	}
+}
+
+// Patch all documents matching a query, reporting the progress after each batch.
+func UpdateByQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var qJson interface{}
+	dbcol := requireQuery(w, r, &qJson)
+	if dbcol == nil {
+		return
+	}
+	var patch string
+	if !Require(w, r, "patch", &patch) {
+		return
+	}
+	if err := HttpDB.CheckDocLimits([]byte(patch)); err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	var patchJson map[string]interface{}
+	if err := json.Unmarshal([]byte(patch), &patchJson); err != nil {
+		httpError(w, dberr.New(dberr.ErrorInvalidJSON, patch, "patch"), 400)
+		return
+	}
+	progress := func(prog db.QueryOpProgress) {
+		writeProgress(w, prog)
+	}
+	var prog db.QueryOpProgress
+	var err error
+	if principal, restricted := requestPrincipal(r); restricted {
+		prog, err = dbcol.UpdateByQueryAs(principal, qJson, patchJson, progress)
+	} else {
+		prog, err = dbcol.UpdateByQuery(qJson, patchJson, progress)
+	}
+	if err != nil {
+		httpError(w, err, 400)
+	} else if prog.Batches == 0 {
+		writeProgress(w, prog)
+	}
+}
+
+// Return the function responding with the report of a dry run, or with its error.
+func writeDryRun(w http.ResponseWriter, r *http.Request) func(db.DryRun, error) {
+	return func(report db.DryRun, err error) {
+		if err != nil {
+			httpError(w, err, 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err = writeResult(w, r, report); err != nil {
+			httpError(w, err, 500)
+		}
+	}
+}
+
+// Return the query restricted to the documents the request's principal may access, see requestPrincipal.
+func aclQuery(r *http.Request, dbcol *db.Col, q interface{}) interface{} {
+	if principal, restricted := requestPrincipal(r); restricted {
+		return dbcol.ACLQuery(principal, q)
+	}
+	return q
+}
+
+// Return the ad-hoc query to run, marked with the current version if StrictQueries is set, see db.VersionedQuery.
+func strictQuery(q interface{}) interface{} {
+	if StrictQueries {
+		return db.VersionedQuery(q)
+	}
+	return q
+}
+
+// Return true if ad-hoc queries are allowed, otherwise set HTTP error status and return false.
+func adHocQueryAllowed(w http.ResponseWriter) bool {
+	if StoredQueriesOnly {
+		httpError(w, dberr.New(dberr.ErrorAdHocQuery), 403)
+		return false
+	}
+	return true
+}
+
+// Store a query with parameters under a name.
+func StoreQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var name, col, q string
+	if !Require(w, r, "name", &name) {
+		return
+	}
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "q", &q) {
+		return
+	}
+	sq := db.StoredQuery{Col: col}
+	if err := json.Unmarshal([]byte(q), &sq.Query); err != nil {
+		httpError(w, dberr.New(dberr.ErrorInvalidJSON, q, "query"), 400)
+		return
+	}
+	if params := r.FormValue("params"); params != "" {
+		if err := json.Unmarshal([]byte(params), &sq.Params); err != nil {
+			httpError(w, dberr.New(dberr.ErrorInvalidJSON, params, "parameters"), 400)
+			return
+		}
+	}
+	if err := HttpDB.StoreQuery(name, sq); err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	w.WriteHeader(201)
+}
+
+// Return all stored queries.
+func StoredQueries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	resp, err := json.Marshal(HttpDB.StoredQueries())
+	if err != nil {
+		httpError(w, err, 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Remove a stored query.
+func DropStoredQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var name string
+	if !Require(w, r, "name", &name) {
+		return
+	}
+	if err := HttpDB.DropStoredQuery(name); err != nil {
+		httpError(w, err, 400)
+	}
+}
+
+// Run a stored query with arguments and return documents from the result.
+func RunQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var name string
+	if !Require(w, r, "name", &name) {
+		return
+	}
+	var args map[string]interface{}
+	if argsStr := r.FormValue("args"); argsStr != "" {
+		if err := json.Unmarshal([]byte(argsStr), &args); err != nil {
+			httpError(w, dberr.New(dberr.ErrorInvalidJSON, argsStr, "arguments"), 400)
+			return
+		}
+	}
+	dbcol, q, err := HttpDB.BindStoredQuery(name, args)
+	if err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	queryResult := make(map[int]struct{})
+	if err := db.EvalQuery(aclQuery(r, dbcol, q), dbcol, &queryResult); err != nil {
+		httpError(w, err, 400)
+		return
+	}
+	writeQueryResult(w, r, dbcol, queryResult)
+}
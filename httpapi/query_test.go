@@ -1,11 +1,15 @@
 package httpapi
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -22,6 +26,18 @@ var (
 	requestCount        = "http://localhost:8080/count"
 	requestCountWithCol = "http://localhost:8080/count?col=%s"
 	requestCountWithAll = "http://localhost:8080/count?col=%s&q=%s"
+
+	requestSQL = "http://localhost:8080/sql?q=%s"
+
+	requestStoreQuery      = "http://localhost:8080/storequery?name=%s&col=%s&q=%s&params=%s"
+	requestStoredQueries   = "http://localhost:8080/storedqueries"
+	requestDropStoredQuery = "http://localhost:8080/dropstoredquery?name=%s"
+	requestRunQuery        = "http://localhost:8080/runquery?name=%s&args=%s"
+
+	requestAnalyze = "http://localhost:8080/analyze?col=%s&path=%s"
+
+	requestDeleteByQuery = "http://localhost:8080/deletebyquery?col=%s&q=%s"
+	requestUpdateByQuery = "http://localhost:8080/updatebyquery?col=%s&q=%s&patch=%s"
 )
 
 func TestQueryNotCol(t *testing.T) {
@@ -83,8 +99,8 @@ func TestQueryCollectionNot(t *testing.T) {
 	}
 	Create(w, reqCreate)
 	Query(wQuery, req)
-	if wQuery.Code != http.StatusBadRequest || strings.TrimSpace(wQuery.Body.String()) != fmt.Sprintf("Collection '%s' does not exist.", badColl) {
-		t.Errorf("Expected status %d and error message collection not exist", http.StatusBadRequest)
+	if wQuery.Code != http.StatusNotFound || errorMessage(wQuery) != fmt.Sprintf("Collection %s does not exist", badColl) {
+		t.Errorf("Expected status %d and error message collection not exist", http.StatusNotFound)
 	}
 }
 func TestQueryJsonIsNotValid(t *testing.T) {
@@ -101,7 +117,7 @@ func TestQueryJsonIsNotValid(t *testing.T) {
 	}
 	Create(w, reqCreate)
 	Query(wQuery, req)
-	if wQuery.Code != http.StatusBadRequest || strings.TrimSpace(wQuery.Body.String()) != fmt.Sprintf("'%s' is not valid JSON.", badJson) {
+	if wQuery.Code != http.StatusBadRequest || errorMessage(wQuery) != fmt.Sprintf("'%s' is not valid JSON query.", badJson) {
 		t.Errorf("Expected status %d and error message json is not valid", http.StatusOK)
 	}
 }
@@ -125,7 +141,7 @@ func TestQueryErrEvalQuery(t *testing.T) {
 	Create(w, reqCreate)
 	Query(wQuery, req)
 
-	if wQuery.Code != http.StatusBadRequest || strings.TrimSpace(wQuery.Body.String()) != errMessage {
+	if wQuery.Code != http.StatusBadRequest || errorMessage(wQuery) != errMessage {
 		t.Errorf("Expected status %d and error message eval query", http.StatusBadRequest)
 	}
 }
@@ -142,13 +158,13 @@ func TestQuerySerializeError(t *testing.T) {
 		panic(err)
 	}
 
-	path := monkey.Patch(json.Marshal, func(v interface{}) ([]byte, error) {
-		return nil, errors.New("error marshal")
+	path := monkey.Patch(encodeJSON, func(buf *bytes.Buffer, v interface{}) error {
+		return errors.New("error marshal")
 	})
 	defer path.Unpatch()
 	Create(w, reqCreate)
 	Query(wQuery, req)
-	if wQuery.Code != http.StatusInternalServerError || strings.TrimSpace(wQuery.Body.String()) != "Server error: query returned invalid structure" {
+	if wQuery.Code != http.StatusInternalServerError || errorMessage(wQuery) != "Server error: query returned invalid structure" {
 		t.Errorf("Expected status %d and error message invalid structure", http.StatusInternalServerError)
 	}
 }
@@ -158,7 +174,7 @@ func TestCountNotCol(t *testing.T) {
 	w := httptest.NewRecorder()
 	Count(w, req)
 
-	if w.Code != http.StatusBadRequest || strings.TrimSpace(w.Body.String()) != "Please pass POST/PUT/GET parameter value of 'col'." {
+	if w.Code != http.StatusBadRequest || errorMessage(w) != "Please pass POST/PUT/GET parameter value of 'col'." {
 		t.Errorf("Expected status %d and error message not parameter 'col' ", http.StatusBadRequest)
 	}
 }
@@ -167,7 +183,7 @@ func TestCountNotParameterQ(t *testing.T) {
 	w := httptest.NewRecorder()
 	Count(w, req)
 
-	if w.Code != http.StatusBadRequest || strings.TrimSpace(w.Body.String()) != "Please pass POST/PUT/GET parameter value of 'q'." {
+	if w.Code != http.StatusBadRequest || errorMessage(w) != "Please pass POST/PUT/GET parameter value of 'q'." {
 		t.Errorf("Expected status %d and error message not parameter 'col' ", http.StatusBadRequest)
 	}
 }
@@ -182,8 +198,8 @@ func TestCountCollNotExist(t *testing.T) {
 	}
 	Count(w, req)
 
-	if w.Code != http.StatusBadRequest || strings.TrimSpace(w.Body.String()) != fmt.Sprintf("Collection '%s' does not exist.", collection) {
-		t.Errorf("Expected status %d and error message collection not exist", http.StatusBadRequest)
+	if w.Code != http.StatusNotFound || errorMessage(w) != fmt.Sprintf("Collection %s does not exist", collection) {
+		t.Errorf("Expected status %d and error message collection not exist", http.StatusNotFound)
 	}
 }
 func TestCount(t *testing.T) {
@@ -220,7 +236,7 @@ func TestCountJsonIsNotValid(t *testing.T) {
 	Create(w, reqCreate)
 	Count(wCount, req)
 
-	if wCount.Code != http.StatusBadRequest || strings.TrimSpace(wCount.Body.String()) != fmt.Sprintf("'%s' is not valid JSON.", badJson) {
+	if wCount.Code != http.StatusBadRequest || errorMessage(wCount) != fmt.Sprintf("'%s' is not valid JSON query.", badJson) {
 		t.Errorf("Expected status %d and json is not valid ", http.StatusBadRequest)
 	}
 }
@@ -243,7 +259,362 @@ func TestCountErrEvalQuery(t *testing.T) {
 	}
 	Create(w, reqCreate)
 	Count(wCount, req)
-	if wCount.Code != http.StatusBadRequest || strings.TrimSpace(wCount.Body.String()) != errMessage {
+	if wCount.Code != http.StatusBadRequest || errorMessage(wCount) != errMessage {
 		t.Errorf("Expected status %d and error message eval query", http.StatusBadRequest)
 	}
 }
+func TestDeleteAndUpdateByQuery(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	dbcol := HttpDB.Use(collection)
+	for i := 0; i < 10; i++ {
+		if _, err = dbcol.Insert(map[string]interface{}{"n": i, "a": map[string]interface{}{"b": 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every line of the response is a progress report, the last one is final
+	lastProgress := func(w *httptest.ResponseRecorder) (prog db.QueryOpProgress) {
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		if err := json.Unmarshal([]byte(lines[len(lines)-1]), &prog); err != nil {
+			t.Fatal(err, w.Body.String())
+		}
+		return
+	}
+	w := httptest.NewRecorder()
+	UpdateByQuery(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpdateByQuery, collection, `"all"`,
+		url.QueryEscape(`{"a": {"b": null, "c": 2}}`)), nil))
+	if prog := lastProgress(w); w.Code != 200 || prog.Matched != 10 || prog.Done != 10 || !prog.Finished {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	dbcol.ForEachDoc(func(id int, doc []byte) bool {
+		if !strings.Contains(string(doc), `"a":{"c":2}`) {
+			t.Fatal(string(doc))
+		}
+		return true
+	})
+	// A dry run deletes nothing
+	w = httptest.NewRecorder()
+	DeleteByQuery(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDeleteByQuery, collection, `"all"`)+"&dryrun=true", nil))
+	var report db.DryRun
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Code != 200 || report.Docs != 10 || report.Bytes == 0 {
+		t.Fatal(w.Code, w.Body.String())
+	} else if dbcol.ApproxDocCount() != 10 {
+		t.Fatal(dbcol.ApproxDocCount())
+	}
+	w = httptest.NewRecorder()
+	DeleteByQuery(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDeleteByQuery, collection, `"all"`), nil))
+	if prog := lastProgress(w); w.Code != 200 || prog.Matched != 10 || prog.Done != 10 || !prog.Finished {
+		t.Fatal(w.Code, w.Body.String())
+	} else if dbcol.ApproxDocCount() != 0 {
+		t.Fatal(dbcol.ApproxDocCount())
+	}
+	// Nothing matches, the final report is still sent
+	w = httptest.NewRecorder()
+	DeleteByQuery(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDeleteByQuery, collection, `"all"`), nil))
+	if prog := lastProgress(w); w.Code != 200 || prog.Matched != 0 || !prog.Finished {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+func TestAnalyze(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err = HttpDB.Use(collection).Insert(map[string]interface{}{"a": map[string]interface{}{"n": i}, "b": i % 3}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := httptest.NewRecorder()
+	Analyze(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestAnalyze, collection, "a,n")+"&path=b&percentiles=50,99", nil))
+	var analysis db.Analysis
+	if err = json.Unmarshal(w.Body.Bytes(), &analysis); err != nil || w.Code != 200 || analysis.Docs != 100 || len(analysis.Paths) != 2 {
+		t.Fatal(w.Code, w.Body.String())
+	} else if a := analysis.Paths[0]; a.Distinct != 100 || a.Max != 99 || len(a.Percentiles) != 2 {
+		t.Fatal(a)
+	} else if b := analysis.Paths[1]; b.Distinct != 3 || b.Percentiles["p50"] != 1 {
+		t.Fatal(b)
+	}
+	for _, target := range []string{
+		fmt.Sprintf(requestAnalyze, collection, "a") + "&percentiles=x",
+		fmt.Sprintf(requestAnalyze, collection, "a") + "&percentiles=200",
+		"http://localhost:8080/analyze?col=" + collection,
+	} {
+		w = httptest.NewRecorder()
+		Analyze(w, httptest.NewRequest(RandMethodRequest(), target, nil))
+		if w.Code != 400 {
+			t.Fatal(target, w.Code, w.Body.String())
+		}
+	}
+	w = httptest.NewRecorder()
+	Analyze(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestAnalyze, "nosuchcol", "a"), nil))
+	if w.Code != 404 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+func TestDeleteAndUpdateByQueryInvalid(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	w := httptest.NewRecorder()
+	DeleteByQuery(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDeleteByQuery, collection, `"all"`), nil))
+	if w.Code != http.StatusNotFound || errorCode(w) != "no_col" {
+		t.Error("Expected code 404 and collection does not exist", w.Body.String())
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	DeleteByQuery(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDeleteByQuery, collection, "abc"), nil))
+	if w.Code != 400 || errorMessage(w) != "'abc' is not valid JSON query." {
+		t.Error("Expected code 400 and invalid JSON", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	UpdateByQuery(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpdateByQuery, collection, `"all"`, "abc"), nil))
+	if w.Code != 400 || errorMessage(w) != "'abc' is not valid JSON patch." {
+		t.Error("Expected code 400 and invalid JSON", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	UpdateByQuery(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpdateByQuery, collection, `"all"`,
+		url.QueryEscape(`{"_id": "a"}`)), nil))
+	if w.Code != 400 {
+		t.Error("Expected code 400 and string ID may not be patched", w.Body.String())
+	}
+}
+func TestQueryPage(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	dbcol := HttpDB.Use(collection)
+	ids := make([]int, 5)
+	for i := range ids {
+		if ids[i], err = dbcol.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Ints(ids)
+	pageOf := func(params string) (w *httptest.ResponseRecorder, docs map[string]interface{}) {
+		w = httptest.NewRecorder()
+		Query(w, httptest.NewRequest("GET", fmt.Sprintf(requestQueryWithAll, collection, `"all"`)+params, nil))
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &docs); err != nil {
+				t.Fatal(err, w.Body.String())
+			}
+		}
+		return
+	}
+	// Without paging parameters all documents are returned, along with the total count
+	w, docs := pageOf("")
+	if len(docs) != 5 || w.Header().Get("X-Total-Count") != "5" || w.Header().Get("Link") != "" {
+		t.Fatal(w.Body.String(), w.Header())
+	}
+	// Pages follow the order of document IDs
+	w, docs = pageOf("&limit=2")
+	if _, first := docs[strconv.Itoa(ids[0])]; !first || len(docs) != 2 || w.Header().Get("X-Total-Count") != "5" {
+		t.Fatal(w.Body.String(), w.Header())
+	} else if link := w.Header().Get("Link"); !strings.Contains(link, "offset=2") || !strings.Contains(link, `rel="next"`) || strings.Contains(link, `rel="prev"`) {
+		t.Fatal(link)
+	}
+	w, docs = pageOf("&limit=2&offset=2")
+	if _, third := docs[strconv.Itoa(ids[2])]; !third || len(docs) != 2 {
+		t.Fatal(w.Body.String())
+	} else if link := w.Header().Get("Link"); !strings.Contains(link, `offset=0&q=%22all%22>; rel="prev"`) || !strings.Contains(link, `offset=4&q=%22all%22>; rel="next"`) {
+		t.Fatal(link)
+	}
+	w, docs = pageOf("&limit=2&offset=4")
+	if _, last := docs[strconv.Itoa(ids[4])]; !last || len(docs) != 1 || strings.Contains(w.Header().Get("Link"), `rel="next"`) {
+		t.Fatal(w.Body.String(), w.Header())
+	}
+	if w, docs = pageOf("&offset=9"); w.Code != 200 || len(docs) != 0 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	for _, params := range []string{"&limit=0", "&limit=a", "&offset=-1"} {
+		if w, _ = pageOf(params); w.Code != 400 || errorCode(w) != "invalid_param" {
+			t.Fatal(params, w.Code, w.Body.String())
+		}
+	}
+	// Ordered by insertion, new documents land on the last page
+	if err = dbcol.SetConfig(db.ColConfig{ResultOrder: db.RESULT_ORDER_INSERTION}); err != nil {
+		t.Fatal(err)
+	}
+	newID, err := dbcol.Insert(map[string]interface{}{"n": 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, docs = pageOf("&limit=2&offset=5"); len(docs) != 1 || docs[strconv.Itoa(newID)] == nil {
+		t.Fatal(w.Body.String())
+	}
+}
+func TestSQL(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	dbcol := HttpDB.Use(collection)
+	if err = dbcol.Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err = dbcol.Insert(map[string]interface{}{"n": i, "s": fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := httptest.NewRecorder()
+	SQL(w, httptest.NewRequest("GET", fmt.Sprintf(requestSQL, url.QueryEscape("SELECT s FROM "+collection+" WHERE n BETWEEN 1 AND 3 ORDER BY n DESC LIMIT 2")), nil))
+	var rows []struct {
+		ID  int
+		Doc map[string]interface{}
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &rows); err != nil || w.Code != 200 {
+		t.Fatal(w.Code, w.Body.String())
+	} else if len(rows) != 2 || rows[0].ID == 0 || len(rows[0].Doc) != 1 || rows[0].Doc["s"] != "3" || rows[1].Doc["s"] != "2" {
+		t.Fatal(w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	SQL(w, httptest.NewRequest("GET", fmt.Sprintf(requestSQL, url.QueryEscape("SELECT * FROM "+collection+" WHERE")), nil))
+	if w.Code != 400 || errorCode(w) != "sql_syntax" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	SQL(w, httptest.NewRequest("GET", fmt.Sprintf(requestSQL, url.QueryEscape("SELECT * FROM nope")), nil))
+	if w.Code != 404 || errorCode(w) != "no_col" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+func TestStrictQueries(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	defer func() {
+		StrictQueries = false
+	}()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		t.Fatal(err)
+	}
+	defer HttpDB.Close()
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	} else if _, err = HttpDB.Use(collection).Insert(map[string]interface{}{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	count := func(q string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		Count(w, httptest.NewRequest("GET", fmt.Sprintf(requestCountWithAll, collection, url.QueryEscape(q)), nil))
+		return w
+	}
+	// A value that is no query matches nothing, unless queries are parsed strictly
+	if w := count(`[1, "all"]`); w.Code != 200 || w.Body.String() != "1" {
+		t.Fatal(w.Code, w.Body.String())
+	} else if w = count(`{"version": 1, "query": [1, "all"]}`); w.Code != 400 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	StrictQueries = true
+	if w := count(`[1, "all"]`); w.Code != 400 || !strings.Contains(w.Body.String(), "$.query[0]") {
+		t.Fatal(w.Code, w.Body.String())
+	} else if w = count(`{"version": 1, "query": "all"}`); w.Code != 200 || w.Body.String() != "1" {
+		t.Fatal(w.Code, w.Body.String())
+	} else if w = count(`{"version": 5, "query": "all"}`); w.Code != 400 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+func TestStoredQueries(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	defer func() {
+		StoredQueriesOnly = false
+	}()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	if err = HttpDB.Create(collection); err != nil {
+		t.Fatal(err)
+	}
+	dbcol := HttpDB.Use(collection)
+	if err = dbcol.Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err = dbcol.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := httptest.NewRecorder()
+	StoreQuery(w, httptest.NewRequest("GET", fmt.Sprintf(requestStoreQuery, "byN", collection,
+		url.QueryEscape(`[{"eq": "$a", "in": ["n"]}, {"eq": "$b", "in": ["n"]}]`), url.QueryEscape(`{"a": "int", "b": "int"}`)), nil))
+	if w.Code != 201 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	StoreQuery(w, httptest.NewRequest("GET", fmt.Sprintf(requestStoreQuery, "bad", collection, url.QueryEscape(`"$a"`), ""), nil))
+	if w.Code != 400 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	StoredQueries(w, httptest.NewRequest("GET", requestStoredQueries, nil))
+	var queries map[string]db.StoredQuery
+	if err = json.Unmarshal(w.Body.Bytes(), &queries); err != nil || len(queries) != 1 || queries["byN"].Params["a"] != "int" {
+		t.Fatal(w.Body.String())
+	}
+	// Ad-hoc queries are refused, stored queries run
+	StoredQueriesOnly = true
+	w = httptest.NewRecorder()
+	Query(w, httptest.NewRequest("GET", fmt.Sprintf(requestQueryWithAll, collection, `"all"`), nil))
+	if w.Code != 403 || errorCode(w) != "ad_hoc_query" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	DeleteByQuery(w, httptest.NewRequest("GET", fmt.Sprintf(requestDeleteByQuery, collection, `"all"`), nil))
+	if w.Code != 403 || errorCode(w) != "ad_hoc_query" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	RunQuery(w, httptest.NewRequest("GET", fmt.Sprintf(requestRunQuery, "byN", url.QueryEscape(`{"a": 1, "b": 3}`))+"&limit=1", nil))
+	var docs map[string]interface{}
+	if err = json.Unmarshal(w.Body.Bytes(), &docs); err != nil || w.Code != 200 || len(docs) != 1 || w.Header().Get("X-Total-Count") != "2" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	RunQuery(w, httptest.NewRequest("GET", fmt.Sprintf(requestRunQuery, "byN", url.QueryEscape(`{"a": 1}`)), nil))
+	if w.Code != 400 || errorCode(w) != "missing_param" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	RunQuery(w, httptest.NewRequest("GET", fmt.Sprintf(requestRunQuery, "nope", ""), nil))
+	if w.Code != 404 || errorCode(w) != "no_stored_query" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	DropStoredQuery(w, httptest.NewRequest("GET", fmt.Sprintf(requestDropStoredQuery, "byN"), nil))
+	if w.Code != 200 || len(HttpDB.StoredQueries()) != 0 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
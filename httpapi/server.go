@@ -0,0 +1,83 @@
+// HTTP server options.
+//
+// Timeouts guard the server against slow or stalled clients, 0 means no timeout. WriteTimeout covers the entire
+// response, so that it must be long enough for the longest responses, such as dumps and query operations streaming
+// their progress. HTTP/2 is negotiated with clients over TLS unless disabled. Connections beyond MaxConns wait to be
+// accepted until others are closed.
+
+package httpapi
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ReadTimeout       time.Duration // Maximum time to read a request including its body, 0 - no limit
+	ReadHeaderTimeout time.Duration // Maximum time to read request headers, 0 - ReadTimeout
+	WriteTimeout      time.Duration // Maximum time from the end of request headers to the end of the response, 0 - no limit
+	IdleTimeout       time.Duration // Maximum time a kept-alive connection waits for the next request, 0 - ReadTimeout
+	DisableKeepAlives bool          // Close every connection after its response
+	DisableHTTP2      bool          // Serve only HTTP/1.1 over TLS
+	MaxConns          int           // Maximum number of connections served at the same time, 0 - unlimited
+)
+
+// Return the server of the handler configured by the options.
+func newServer(handler http.Handler) *http.Server {
+	server := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       ReadTimeout,
+		ReadHeaderTimeout: ReadHeaderTimeout,
+		WriteTimeout:      WriteTimeout,
+		IdleTimeout:       IdleTimeout,
+	}
+	if DisableHTTP2 {
+		// A non-nil empty map turns off HTTP/2 negotiation
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	server.SetKeepAlivesEnabled(!DisableKeepAlives)
+	return server
+}
+
+// Return the listener accepting at most that many connections at the same time, or the listener itself if there is no
+// limit.
+func limitListener(listener net.Listener, maxConns int) net.Listener {
+	if maxConns <= 0 {
+		return listener
+	}
+	return &limitedListener{Listener: listener, slots: make(chan struct{}, maxConns)}
+}
+
+// Listener holding a slot for each accepted connection until the connection is closed.
+type limitedListener struct {
+	net.Listener
+	slots chan struct{}
+}
+
+// Wait for a free slot, then accept a connection.
+func (l *limitedListener) Accept() (net.Conn, error) {
+	l.slots <- struct{}{}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+// Connection giving back its slot upon closing.
+type limitedConn struct {
+	net.Conn
+	release     func()
+	releaseOnce sync.Once
+}
+
+// Close the connection and give back its slot.
+func (conn *limitedConn) Close() error {
+	err := conn.Conn.Close()
+	conn.releaseOnce.Do(conn.release)
+	return err
+}
@@ -0,0 +1,67 @@
+package httpapi
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewServer(t *testing.T) {
+	defer func(read, write, idle time.Duration, noKeepAlive, noHTTP2 bool) {
+		ReadTimeout, WriteTimeout, IdleTimeout, DisableKeepAlives, DisableHTTP2 = read, write, idle, noKeepAlive, noHTTP2
+	}(ReadTimeout, WriteTimeout, IdleTimeout, DisableKeepAlives, DisableHTTP2)
+	ReadTimeout, WriteTimeout, IdleTimeout = time.Second, 2*time.Second, 3*time.Second
+	server := newServer(http.NotFoundHandler())
+	if server.ReadTimeout != time.Second || server.WriteTimeout != 2*time.Second || server.IdleTimeout != 3*time.Second || server.TLSNextProto != nil {
+		t.Fatal(server)
+	}
+	DisableHTTP2 = true
+	if server = newServer(http.NotFoundHandler()); server.TLSNextProto == nil || len(server.TLSNextProto) != 0 {
+		t.Fatal(server.TLSNextProto)
+	}
+}
+
+func TestLimitListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if limitListener(listener, 0) != listener {
+		t.Fatal("unlimited listener should not be wrapped")
+	}
+	limited := limitListener(listener, 1)
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := limited.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	// The second connection waits until the first is closed
+	first := <-accepted
+	select {
+	case <-accepted:
+		t.Fatal("accepted beyond the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	first.Close()
+	first.Close()
+	select {
+	case second := <-accepted:
+		second.Close()
+	case <-time.After(time.Second):
+		t.Fatal("did not accept after a connection was closed")
+	}
+}
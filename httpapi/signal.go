@@ -0,0 +1,12 @@
+//go:build !js
+// +build !js
+
+package httpapi
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals making the server reload its configuration.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
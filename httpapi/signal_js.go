@@ -0,0 +1,8 @@
+package httpapi
+
+import (
+	"os"
+)
+
+// JavaScript hosts deliver no hang up signal, the configuration is reloaded by /reloadconfig only.
+var reloadSignals []os.Signal
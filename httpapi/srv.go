@@ -13,56 +13,259 @@ Client request example: curl -I -H "Authorization: token PRE_SHARED_TOKEN" http:
 The sophisticated mechanism offers finer-grained access control, separated by individual users.
 Access to specific endpoints are granted explicitly to each user.
 
-These API endpoints will never require authorization: / (root), /version, and /memstats
+These API endpoints will never require authorization: / (root), /version, /memstats, /healthz and /readyz
 */
 
 package httpapi
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/cankansin/tiedot/backup"
+	"github.com/cankansin/tiedot/cdc"
 	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/shadow"
 	"github.com/cankansin/tiedot/tdlog"
 	"github.com/dgrijalva/jwt-go"
 )
 
 var (
-	HttpDB *db.DB // HTTP API endpoints operate on this database
+	HttpDB  *db.DB            // HTTP API endpoints operate on this database
+	Backups *backup.Scheduler // Takes scheduled backups of the database once the server starts, nil - no scheduled backups
+	CDC     *cdc.Exporter     // Publishes the changes of the database once the server starts, nil - no change data capture export
+	ESSync  *cdc.Exporter     // Mirrors collections into Elasticsearch once the server starts, nil - no search sync
+	Shadows []*shadow.Shadow  // Mirror the writes of collections once the server starts
+
+	FollowDir      string        // The database is a read replica of the backups in this directory, empty - it accepts writes
+	FollowInterval time.Duration // Time between polls of the read replica for new backups
+
+	WarmupOnStart bool   // All collections are read into memory before the server starts listening
+	DBProfile     string // Configuration profile of a new database (see data.ProfileConfig), empty - the default profile
+
+	StoredQueriesOnly bool // Clients may only run stored queries, ad-hoc queries are refused
+	StrictQueries     bool // Ad-hoc queries without a version marker are parsed strictly, as queries of db.QUERY_VERSION
+	DocACL            bool // JWT users other than "admin" may only access documents whose ACL lists them (see ColConfig.ACLPath)
+
+	SocketPath string      // Listen on this Unix domain socket instead of a TCP port, empty - listen on the TCP port
+	SocketMode os.FileMode // Permission of the Unix domain socket file, which controls the users allowed to connect, 0 - 0600
 )
 
+// Return the HTTP status of the database error, or false if the error type does not determine a status.
+func errorStatus(err error) (status int, known bool) {
+	switch dberr.Type(err) {
+	case dberr.ErrorNoDoc, dberr.ErrorNoStrDoc, dberr.ErrorNoCol, dberr.ErrorNoIndex, dberr.ErrorNoStoredQuery:
+		return http.StatusNotFound, true
+	case dberr.ErrorDupStrID, dberr.ErrorColExists, dberr.ErrorIndexExists, dberr.ErrorIndexBuilding, dberr.ErrorIndexAborted,
+		dberr.ErrorReferenced, dberr.ErrorChangesDiscarded, dberr.ErrorDeadlock, dberr.ErrorLockTimeout:
+		return http.StatusConflict, true
+	case dberr.ErrorReadOnly, dberr.ErrorAdHocQuery, dberr.ErrorACLDenied:
+		return http.StatusForbidden, true
+	case dberr.ErrorOverloaded:
+		return http.StatusTooManyRequests, true
+	case dberr.ErrorDocChanged:
+		return http.StatusPreconditionFailed, true
+	case dberr.ErrorDocTooLarge, dberr.ErrorBodyTooLarge:
+		return http.StatusRequestEntityTooLarge, true
+	case dberr.ErrorFileLocked, dberr.ErrorDirLocked, dberr.ErrorStale:
+		return http.StatusServiceUnavailable, true
+	case dberr.ErrorIndexQuota:
+		return http.StatusInsufficientStorage, true
+	case dberr.ErrorDocTooDeep, dberr.ErrorNoRefDoc, dberr.ErrorNeedIndex, dberr.ErrorExpectingSubQuery, dberr.ErrorExpectingInt,
+		dberr.ErrorMissing, dberr.ErrorSQLSyntax, dberr.ErrorMissingParam, dberr.ErrorInvalidParam, dberr.ErrorInvalidJSON,
+		dberr.ErrorNoInsertOrder:
+		return http.StatusBadRequest, true
+	case dberr.ErrorIO:
+		return http.StatusInternalServerError, true
+	}
+	return 0, false
+}
+
+// Code of errors that do not carry a code of their own, named after the HTTP status.
+var statusCode = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusNotFound:              "not_found",
+	http.StatusConflict:              "conflict",
+	http.StatusPreconditionFailed:    "precondition_failed",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusInternalServerError:   "internal",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// JSON error response.
+type errorResponse struct {
+	Code     string        `json:"code"`               // Stable machine-readable code, e.g. "no_col"
+	Message  string        `json:"message"`            // Human-readable message
+	Details  []interface{} `json:"details"`            // Values mentioned in the message, e.g. collection name
+	Position string        `json:"position,omitempty"` // Position of the malformed part of a query
+}
+
+// Respond with the error in JSON. The HTTP status is determined by the error's code, the status is used only if the
+// code does not determine one.
+func httpError(w http.ResponseWriter, err error, status int) {
+	resp, status := errorResponseOf(err, status)
+	body, _ := encodeError(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// Return the JSON error response to the error and its HTTP status, see httpError.
+func errorResponseOf(err error, status int) (errorResponse, int) {
+	resp := errorResponse{Code: dberr.Code(err), Message: fmt.Sprint(err), Details: dberr.Details(err)}
+	if typeStatus, known := errorStatus(err); known {
+		status = typeStatus
+	} else if dberr.Type(err) == dberr.ErrorUndefined {
+		if resp.Code = statusCode[status]; resp.Code == "" {
+			resp.Code = "undefined"
+		}
+	}
+	var queryErr *db.QueryError
+	if errors.As(err, &queryErr) {
+		resp.Position = queryErr.Position
+	}
+	if resp.Details == nil {
+		resp.Details = []interface{}{}
+	}
+	if _, marshalErr := json.Marshal(resp.Details); marshalErr != nil {
+		// Details may not be serialisable, describe them in text instead
+		for i, detail := range resp.Details {
+			resp.Details[i] = fmt.Sprint(detail)
+		}
+	}
+	return resp, status
+}
+
+// Serialise an error response followed by a new line.
+func encodeError(resp errorResponse) ([]byte, error) {
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(resp)
+	return buf.Bytes(), err
+}
+
 // Store form parameter value of specified key to *val and return true; if key does not exist, set HTTP status 400 and return false.
 func Require(w http.ResponseWriter, r *http.Request, key string, val *string) bool {
 	*val = r.FormValue(key)
 	if *val == "" {
-		http.Error(w, fmt.Sprintf("Please pass POST/PUT/GET parameter value of '%s'.", key), 400)
+		httpError(w, dberr.New(dberr.ErrorMissingParam, key), 400)
 		return false
 	}
 	return true
 }
 
+// Return the first of the values (in lower case) listed by the request header, such as Accept or Accept-Encoding,
+// without quality 0. A wildcard in the header stands for any value. Return an empty string if none is acceptable.
+func acceptable(r *http.Request, header string, values ...string) string {
+	quality := make(map[string]float64)
+	for _, field := range r.Header[http.CanonicalHeaderKey(header)] {
+		for _, item := range strings.Split(field, ",") {
+			params := strings.Split(item, ";")
+			value, q := strings.ToLower(strings.TrimSpace(params[0])), 1.0
+			for _, param := range params[1:] {
+				if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+					if paramQ, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						q = paramQ
+					}
+				}
+			}
+			if value != "" {
+				quality[value] = q
+			}
+		}
+	}
+	for _, value := range values {
+		if q, listed := quality[value]; listed && q > 0 {
+			return value
+		} else if q, wildcard := quality["*"]; !listed && wildcard && q > 0 {
+			return value
+		}
+	}
+	return ""
+}
+
 // Start HTTP server and block until the server shuts down. Panic on error.
 func Start(dir string, port int, tlsCrt, tlsKey, jwtPubKey, jwtPrivateKey, bind, authToken string) {
 	var err error
-	HttpDB, err = db.OpenDB(dir)
+	if FollowDir != "" {
+		tdlog.Noticef("The database is a read replica of the backups in %s, it does not accept writes.", FollowDir)
+		HttpDB, err = db.OpenFollower(dir, FollowDir, FollowInterval)
+	} else {
+		HttpDB, err = db.OpenDBProfile(dir, DBProfile)
+	}
 	if err != nil {
 		panic(err)
 	}
+	if WarmupOnStart {
+		for _, name := range HttpDB.AllCols() {
+			if col := HttpDB.Use(name); col != nil {
+				tdlog.Noticef("Collection %s warmed up: %d bytes read into memory", name, col.Warmup())
+			}
+		}
+	}
+	if Backups != nil {
+		Backups.Start(HttpDB)
+	}
+	if CDC != nil {
+		CDC.Start(HttpDB)
+	}
+	if ESSync != nil {
+		ESSync.Start(HttpDB)
+	}
+	for _, s := range Shadows {
+		if err := s.Start(HttpDB); err != nil {
+			panic(err)
+		}
+	}
+	if AuditLogPath != "" {
+		if audit, err = openAuditLog(AuditLogPath, AuditCol); err != nil {
+			panic(err)
+		}
+	}
+	// Reload configuration upon receiving hang up signal
+	reload := make(chan os.Signal, 1)
+	if len(reloadSignals) > 0 {
+		signal.Notify(reload, reloadSignals...)
+	}
+	go func() {
+		for range reload {
+			if err := HttpDB.ReloadConfig(); err != nil {
+				tdlog.Noticef("Failed to reload configuration: %v", err)
+			}
+		}
+	}()
 
+	// Endpoints are served by a mux of their own, as packages such as net/http/pprof register unauthorized handlers with
+	// the default mux
+	mux := http.NewServeMux()
 	// These endpoints are always available and do not require authentication
-	http.HandleFunc("/", Welcome)
-	http.HandleFunc("/version", Version)
-	http.HandleFunc("/memstats", MemStats)
+	mux.HandleFunc("/", Welcome)
+	mux.HandleFunc("/version", Version)
+	mux.HandleFunc("/memstats", MemStats)
+	mux.HandleFunc("/healthz", Healthz)
+	mux.HandleFunc("/readyz", Readyz)
 
 	// Install API endpoint handlers that may require authorization
 	var authWrap func(http.HandlerFunc) http.HandlerFunc
+	jwtAuth := false
 	if authToken != "" {
 		tdlog.Noticef("API endpoints now require the pre-shared token in Authorization header.")
 		authWrap = func(originalHandler http.HandlerFunc) http.HandlerFunc {
 			return func(w http.ResponseWriter, r *http.Request) {
 				if "token "+authToken != r.Header.Get("Authorization") {
-					http.Error(w, "", http.StatusUnauthorized)
+					httpError(w, errors.New("Authorization token is missing or incorrect"), http.StatusUnauthorized)
 					return
 				}
 				originalHandler(w, r)
@@ -82,60 +285,154 @@ func Start(dir string, port int, tlsCrt, tlsKey, jwtPubKey, jwtPrivateKey, bind,
 		}
 		jwtInitSetup()
 		authWrap = jwtWrap
+		jwtAuth = true
 		// does not require JWT auth
-		http.HandleFunc("/getjwt", getJWT)
-		http.HandleFunc("/checkjwt", checkJWT)
+		mux.HandleFunc("/getjwt", getJWT)
+		mux.HandleFunc("/checkjwt", checkJWT)
 	} else {
 		tdlog.Noticef("API endpoints do not require Authorization header.")
 		authWrap = func(originalHandler http.HandlerFunc) http.HandlerFunc {
 			return originalHandler
 		}
 	}
+	if audit != nil {
+		// Administrative requests are recorded along with the user authorized for them
+		wrapAuth := authWrap
+		authWrap = func(originalHandler http.HandlerFunc) http.HandlerFunc {
+			return wrapAuth(audit.wrap(originalHandler))
+		}
+	}
 	// collection management (stop-the-world)
-	http.HandleFunc("/create", authWrap(Create))
-	http.HandleFunc("/rename", authWrap(Rename))
-	http.HandleFunc("/drop", authWrap(Drop))
-	http.HandleFunc("/all", authWrap(All))
-	http.HandleFunc("/scrub", authWrap(Scrub))
-	http.HandleFunc("/sync", authWrap(Sync))
+	mux.HandleFunc("/create", authWrap(Create))
+	mux.HandleFunc("/rename", authWrap(Rename))
+	mux.HandleFunc("/drop", authWrap(Drop))
+	mux.HandleFunc("/all", authWrap(All))
+	mux.HandleFunc("/scrub", authWrap(Scrub))
+	mux.HandleFunc("/shrink", authWrap(Shrink))
+	mux.HandleFunc("/warmup", authWrap(Warmup))
+	mux.HandleFunc("/movecol", authWrap(MoveCol))
+	mux.HandleFunc("/placement", authWrap(Placement))
+	mux.HandleFunc("/sync", authWrap(Sync))
+	mux.HandleFunc("/colconfig", authWrap(ColConfig))
+	mux.HandleFunc("/setcolconfig", authWrap(SetColConfig))
+	mux.HandleFunc("/retentionstats", authWrap(RetentionStats))
+	mux.HandleFunc("/traindict", authWrap(TrainDict))
+	mux.HandleFunc("/createview", authWrap(CreateView))
+	// time series collection management
+	mux.HandleFunc("/createts", authWrap(CreateTimeSeries))
+	mux.HandleFunc("/allts", authWrap(AllTimeSeries))
+	mux.HandleFunc("/tsretention", authWrap(SetTimeSeriesRetention))
+	mux.HandleFunc("/tsinsert", authWrap(TimeSeriesInsert))
+	mux.HandleFunc("/tsrange", authWrap(TimeSeriesRange))
 	// query
-	http.HandleFunc("/query", authWrap(Query))
-	http.HandleFunc("/count", authWrap(Count))
+	mux.HandleFunc("/query", authWrap(Query))
+	mux.HandleFunc("/count", authWrap(Count))
+	mux.HandleFunc("/analyze", authWrap(Analyze))
+	mux.HandleFunc("/sql", authWrap(SQL))
+	mux.HandleFunc("/storequery", authWrap(StoreQuery))
+	mux.HandleFunc("/storedqueries", authWrap(StoredQueries))
+	mux.HandleFunc("/dropstoredquery", authWrap(DropStoredQuery))
+	mux.HandleFunc("/runquery", authWrap(RunQuery))
+	mux.HandleFunc("/deletebyquery", authWrap(DeleteByQuery))
+	mux.HandleFunc("/updatebyquery", authWrap(UpdateByQuery))
 	// document management
-	http.HandleFunc("/insert", authWrap(Insert))
-	http.HandleFunc("/get", authWrap(Get))
-	http.HandleFunc("/getpage", authWrap(GetPage))
-	http.HandleFunc("/update", authWrap(Update))
-	http.HandleFunc("/delete", authWrap(Delete))
-	http.HandleFunc("/approxdoccount", authWrap(ApproxDocCount))
+	mux.HandleFunc("/insert", authWrap(idempotent(Insert)))
+	mux.HandleFunc("/get", authWrap(Get))
+	mux.HandleFunc("/getbatch", authWrap(GetBatch))
+	mux.HandleFunc("/getpage", authWrap(GetPage))
+	mux.HandleFunc("/latest", authWrap(Latest))
+	mux.HandleFunc("/tail", authWrap(Tail))
+	mux.HandleFunc("/update", authWrap(idempotent(Update)))
+	mux.HandleFunc("/delete", authWrap(Delete))
+	mux.HandleFunc("/transact", authWrap(idempotent(Transact)))
+	mux.HandleFunc("/bulk", authWrap(idempotent(Bulk)))
+	mux.HandleFunc("/approxdoccount", authWrap(ApproxDocCount))
 	// index management (stop-the-world)
-	http.HandleFunc("/index", authWrap(Index))
-	http.HandleFunc("/indexes", authWrap(Indexes))
-	http.HandleFunc("/unindex", authWrap(Unindex))
+	mux.HandleFunc("/index", authWrap(Index))
+	mux.HandleFunc("/indexes", authWrap(Indexes))
+	mux.HandleFunc("/unindex", authWrap(Unindex))
+	mux.HandleFunc("/indexstats", authWrap(IndexStats))
 	// misc (stop-the-world)
-	http.HandleFunc("/shutdown", authWrap(Shutdown))
-	http.HandleFunc("/dump", authWrap(Dump))
-
-	iface := "all interfaces"
-	if bind != "" {
-		iface = bind
+	mux.HandleFunc("/shutdown", authWrap(Shutdown))
+	mux.HandleFunc("/dump", authWrap(Dump))
+	mux.HandleFunc("/restore", authWrap(Restore))
+	mux.HandleFunc("/reloadconfig", authWrap(ReloadConfig))
+	mux.HandleFunc("/auditlog", authWrap(AuditLog))
+	mux.HandleFunc("/locks", authWrap(Locks))
+	mux.HandleFunc("/contention", authWrap(Contention))
+	mux.HandleFunc("/manifest", authWrap(Manifest))
+	mux.HandleFunc("/manifestdiff", authWrap(ManifestDiff))
+	mux.HandleFunc("/shadowstats", authWrap(ShadowStats))
+	if Diagnostics {
+		// Only the JWT user "admin" may use them, users may not be granted the endpoints
+		adminWrap := authWrap
+		if jwtAuth {
+			adminWrap = func(originalHandler http.HandlerFunc) http.HandlerFunc {
+				return authWrap(requireAdmin(originalHandler))
+			}
+		}
+		handleDiagnostics(mux, adminWrap)
 	}
 
-	if tlsCrt != "" {
-		tdlog.Noticef("Will listen on %s (HTTPS), port %d.", iface, port)
-		if err := http.ListenAndServeTLS(fmt.Sprintf("%s:%d", bind, port), tlsCrt, tlsKey, nil); err != nil {
-			tdlog.Panicf("Failed to start HTTPS service - %s", err)
+	server := newServer(corsHandler(compressHandler(freshHandler(mux))))
+	var listener net.Listener
+	var where string
+	if SocketPath != "" {
+		where = "Unix domain socket " + SocketPath
+		listener, err = listenUnix(SocketPath, SocketMode)
+	} else {
+		iface := "all interfaces"
+		if bind != "" {
+			iface = bind
 		}
+		where = fmt.Sprintf("%s, port %d", iface, port)
+		listener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", bind, port))
+	}
+	if err != nil {
+		tdlog.Panicf("Failed to listen on %s - %s", where, err)
+	}
+	listener = limitListener(listener, MaxConns)
+	if tlsCrt != "" {
+		tdlog.Noticef("Will listen on %s (HTTPS).", where)
+		err = server.ServeTLS(listener, tlsCrt, tlsKey)
 	} else {
-		tdlog.Noticef("Will listen on %s (HTTP), port %d.", iface, port)
-		http.ListenAndServe(fmt.Sprintf("%s:%d", bind, port), nil)
+		tdlog.Noticef("Will listen on %s (HTTP).", where)
+		err = server.Serve(listener)
+	}
+	tdlog.Panicf("Failed to serve on %s - %s", where, err)
+}
+
+// Listen on a Unix domain socket with the file permission, 0600 if 0. A socket file left behind by a server that is no longer
+// running is replaced, a socket in use by a running server is not.
+func listenUnix(socketPath string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socketPath)
+		} else if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", socketPath)
+		} else if err = os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if mode == 0 {
+		mode = 0600
+	}
+	if err = os.Chmod(socketPath, mode); err != nil {
+		listener.Close()
+		return nil, err
 	}
+	return listener, nil
 }
 
 // Greet user with a welcome message.
 func Welcome(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
-		http.Error(w, "Invalid API endpoint", 404)
+		httpError(w, errors.New("Invalid API endpoint"), 404)
 		return
 	}
 	w.Write([]byte("Welcome to tiedot"))
@@ -2,17 +2,23 @@ package httpapi
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
 
 	"bou.ke/monkey"
 	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/dberr"
 	"github.com/pkg/errors"
 )
 
@@ -27,6 +33,8 @@ func TestSrc(t *testing.T) {
 		TRequireFalse,
 		TRequireTrue,
 		TWelcomeError,
+		THttpError,
+		TListenUnix,
 	}
 	managerSubTests(testsSrc, "src_test", t)
 }
@@ -58,10 +66,102 @@ func TWelcomeError(t *testing.T) {
 		panic(err)
 	}
 	Welcome(w, req)
-	if w.Code != 404 || strings.TrimSpace(w.Body.String()) != "Invalid API endpoint" {
+	if w.Code != 404 || errorMessage(w) != "Invalid API endpoint" {
 		t.Error("Expected code 404 and error message api endpoint.")
 	}
 }
+func THttpError(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	// The error's code determines the status
+	w := httptest.NewRecorder()
+	httpError(w, dberr.New(dberr.ErrorNoCol, "abc"), 400)
+	var resp map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/json" ||
+		resp["code"] != "no_col" || resp["message"] != "Collection abc does not exist" ||
+		fmt.Sprint(resp["details"]) != "[abc]" {
+		t.Fatal(w.Code, w.Header(), resp)
+	}
+	// So does the type of a wrapped error
+	w = httptest.NewRecorder()
+	httpError(w, fmt.Errorf("Overloaded: %w", dberr.New(dberr.ErrorOverloaded, "abc")), 500)
+	if w.Code != http.StatusTooManyRequests || errorCode(w) != "overloaded" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// Errors without a code of their own are named after the status
+	w = httptest.NewRecorder()
+	httpError(w, fmt.Errorf("abc"), 500)
+	if w.Code != 500 || errorCode(w) != "internal" || errorMessage(w) != "abc" {
+		t.Fatal(w.Code, w.Body.String())
+	} else if !strings.Contains(w.Body.String(), `"details":[]`) {
+		t.Fatal(w.Body.String())
+	}
+	// Query errors tell the position of the malformed part
+	if err = HttpDB.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	queryErr := db.EvalQuery([]interface{}{"all", map[string]interface{}{"eq": 1, "in": []interface{}{"a"}, "limit": "x"}}, HttpDB.Use("col"), &map[int]struct{}{})
+	w = httptest.NewRecorder()
+	httpError(w, queryErr, 400)
+	resp = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 400 || resp["code"] != "expecting_int" || resp["position"] != "$[1].limit" {
+		t.Fatal(w.Code, resp)
+	}
+}
+func TListenUnix(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	socketPath := tempDir + "/tiedot.sock"
+	listener, err := listenUnix(socketPath, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Lstat(socketPath); err != nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0660 {
+		t.Fatal(info, err)
+	}
+	go http.Serve(listener, http.HandlerFunc(Welcome))
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+	}}}
+	resp, err := client.Get("http://tiedot/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "Welcome to tiedot" {
+		t.Fatal(resp.StatusCode, string(body))
+	}
+	// A socket in use is not replaced
+	if _, err = listenUnix(socketPath, 0600); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatal(err)
+	}
+	// A socket left behind is replaced
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	if listener, err = listenUnix(socketPath, 0); err != nil {
+		t.Fatal(err)
+	} else if info, err := os.Lstat(socketPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal(info, err)
+	}
+	listener.Close()
+	// Other files are not replaced
+	if err = ioutil.WriteFile(socketPath, []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	} else if _, err = listenUnix(socketPath, 0600); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Fatal(err)
+	}
+}
 func TRequireFalse(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
@@ -76,7 +176,7 @@ func TRequireFalse(t *testing.T) {
 	}
 	Require(w, req, "test", &test)
 
-	if w.Code != 400 || strings.TrimSpace(w.Body.String()) != "Please pass POST/PUT/GET parameter value of 'test'." {
+	if w.Code != 400 || errorCode(w) != "missing_param" || errorMessage(w) != "Please pass POST/PUT/GET parameter value of 'test'." {
 		t.Error("Expected code 400 and error message.")
 	}
 }
@@ -107,10 +207,16 @@ func TestStartListenAndServe(t *testing.T) {
 		s   *http.Server
 	)
 	log.SetOutput(&str)
-	pathSever := monkey.PatchInstanceMethod(reflect.TypeOf(s), "ListenAndServe", func(_ *http.Server) error {
+	pathSever := monkey.PatchInstanceMethod(reflect.TypeOf(s), "Serve", func(_ *http.Server, l net.Listener) error {
+		l.Close()
 		return errors.New("Error server")
 	})
 	defer pathSever.Unpatch()
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("Did not catch Panicf")
+		}
+	}()
 
 	Start(tempDir, 8000, "", "", "", "", "", "")
 }
@@ -123,13 +229,14 @@ func TestStartListenAndServeTLS(t *testing.T) {
 	)
 	log.SetOutput(&str)
 	errMessage := "error start serve"
-	pathSever := monkey.PatchInstanceMethod(reflect.TypeOf(s), "ListenAndServeTLS", func(_ *http.Server, certFile, keyFile string) error {
+	pathSever := monkey.PatchInstanceMethod(reflect.TypeOf(s), "ServeTLS", func(_ *http.Server, l net.Listener, certFile, keyFile string) error {
+		l.Close()
 		return errors.New(errMessage)
 	})
 	defer pathSever.Unpatch()
 	defer func() {
 		r := recover()
-		if r == nil && r == fmt.Sprintf("Failed to start HTTPS service - %s", errMessage) {
+		if r == nil && r == fmt.Sprintf("Failed to serve on all interfaces, port 8000 - %s", errMessage) {
 			t.Fatal("Did not catch Panicf")
 		}
 	}()
@@ -144,13 +251,14 @@ func TestStartNotAuthToken(t *testing.T) {
 	)
 	log.SetOutput(&str)
 	errMessage := "error start serve"
-	pathSever := monkey.PatchInstanceMethod(reflect.TypeOf(s), "ListenAndServeTLS", func(_ *http.Server, certFile, keyFile string) error {
+	pathSever := monkey.PatchInstanceMethod(reflect.TypeOf(s), "ServeTLS", func(_ *http.Server, l net.Listener, certFile, keyFile string) error {
+		l.Close()
 		return errors.New(errMessage)
 	})
 	defer pathSever.Unpatch()
 	defer func() {
 		r := recover()
-		if r == nil && r == fmt.Sprintf("Failed to start HTTPS service - %s", errMessage) {
+		if r == nil && r == fmt.Sprintf("Failed to serve on all interfaces, port 8000 - %s", errMessage) {
 			t.Fatal("Did not catch Panicf")
 		}
 	}()
@@ -165,13 +273,14 @@ func TestStartParseJwtKey(t *testing.T) {
 	)
 	log.SetOutput(&str)
 	errMessage := "error start serve"
-	pathSever := monkey.PatchInstanceMethod(reflect.TypeOf(s), "ListenAndServeTLS", func(_ *http.Server, certFile, keyFile string) error {
+	pathSever := monkey.PatchInstanceMethod(reflect.TypeOf(s), "ServeTLS", func(_ *http.Server, l net.Listener, certFile, keyFile string) error {
+		l.Close()
 		return errors.New(errMessage)
 	})
 	defer pathSever.Unpatch()
 	defer func() {
 		r := recover()
-		if r == nil && r == fmt.Sprintf("Failed to start HTTPS service - %s", errMessage) {
+		if r == nil && r == fmt.Sprintf("Failed to serve on all interfaces, port 8000 - %s", errMessage) {
 			t.Fatal("Did not catch Panicf")
 		}
 	}()
@@ -0,0 +1,171 @@
+// Time series collection handlers.
+
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Parse a time given in Unix seconds or as an RFC 3339 string.
+func parseTime(val string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(val, 64); err == nil {
+		return time.Unix(0, int64(seconds*1e9)), nil
+	} else if t, err := time.Parse(time.RFC3339Nano, val); err == nil {
+		return t, nil
+	}
+	return time.Time{}, dberr.New(dberr.ErrorInvalidParam, "time", val)
+}
+
+// Return the time series collection named by parameter "col", or respond with an error if it does not exist.
+func requireTimeSeries(w http.ResponseWriter, r *http.Request) *db.TimeSeries {
+	var col string
+	if !Require(w, r, "col", &col) {
+		return nil
+	}
+	ts := HttpDB.UseTimeSeries(col)
+	if ts == nil {
+		httpError(w, dberr.New(dberr.ErrorNoCol, col), http.StatusBadRequest)
+	}
+	return ts
+}
+
+// Create a time series collection.
+func CreateTimeSeries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, path, span string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "path", &path) {
+		return
+	}
+	if !Require(w, r, "span", &span) {
+		return
+	}
+	conf := db.TimeSeriesConfig{TimePath: strings.Split(path, ",")}
+	var err error
+	if conf.Span, err = strconv.Atoi(span); err != nil {
+		httpError(w, dberr.New(dberr.ErrorInvalidParam, "span", span), http.StatusBadRequest)
+		return
+	}
+	if retention := r.FormValue("retention"); retention != "" {
+		if conf.Retention, err = strconv.Atoi(retention); err != nil {
+			httpError(w, dberr.New(dberr.ErrorInvalidParam, "retention", retention), http.StatusBadRequest)
+			return
+		}
+	}
+	if err = HttpDB.CreateTimeSeries(col, conf); err != nil {
+		httpError(w, err, http.StatusBadRequest)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// Return all time series collection names.
+func AllTimeSeries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	resp, err := json.Marshal(HttpDB.AllTimeSeries())
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Write(resp)
+}
+
+// Change the retention of a time series collection.
+func SetTimeSeriesRetention(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var retention string
+	ts := requireTimeSeries(w, r)
+	if ts == nil || !Require(w, r, "retention", &retention) {
+		return
+	}
+	seconds, err := strconv.Atoi(retention)
+	if err != nil {
+		httpError(w, dberr.New(dberr.ErrorInvalidParam, "retention", retention), http.StatusBadRequest)
+		return
+	}
+	if err = ts.SetRetention(seconds); err != nil {
+		httpError(w, err, http.StatusBadRequest)
+	}
+}
+
+// Insert a document into a time series collection.
+func TimeSeriesInsert(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var doc string
+	ts := requireTimeSeries(w, r)
+	if ts == nil || !requireDoc(w, r, &doc) {
+		return
+	}
+	var jsonDoc map[string]interface{}
+	if err := json.Unmarshal([]byte(doc), &jsonDoc); err != nil {
+		httpError(w, dberr.New(dberr.ErrorInvalidJSON, doc, "document"), http.StatusBadRequest)
+		return
+	}
+	if err := ts.Insert(jsonDoc); err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Return the documents of a time range in a time series collection, in time order.
+func TimeSeriesRange(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var fromStr, toStr string
+	ts := requireTimeSeries(w, r)
+	if ts == nil || !Require(w, r, "from", &fromStr) || !Require(w, r, "to", &toStr) {
+		return
+	}
+	from, err := parseTime(fromStr)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+	to, err := parseTime(toStr)
+	if err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return
+	}
+	limit := 0
+	if limitStr := r.FormValue("limit"); limitStr != "" {
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 0 {
+			httpError(w, dberr.New(dberr.ErrorInvalidParam, "limit", limitStr), http.StatusBadRequest)
+			return
+		}
+	}
+	docs := make([]map[string]interface{}, 0)
+	ts.Range(from, to, func(doc map[string]interface{}) bool {
+		docs = append(docs, doc)
+		return limit == 0 || len(docs) < limit
+	})
+	resp, err := json.Marshal(docs)
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Write(resp)
+}
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"io/ioutil"
 	"os"
@@ -10,10 +11,15 @@ import (
 	"runtime/pprof"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/cankansin/tiedot/benchmark"
+	"github.com/cankansin/tiedot/backup"
+	"github.com/cankansin/tiedot/bench"
+	"github.com/cankansin/tiedot/cdc"
+	"github.com/cankansin/tiedot/db"
 	//"github.com/cankansin/tiedot/examples"
 	"github.com/cankansin/tiedot/httpapi"
+	"github.com/cankansin/tiedot/shadow"
 	"github.com/cankansin/tiedot/tdlog"
 )
 
@@ -41,6 +47,16 @@ func linuxPerfAdvice() {
 	}
 }
 
+// Return the non-empty items of a comma separated list.
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
 func main() {
 	var err error
 	var defaultMaxprocs int
@@ -51,9 +67,12 @@ func main() {
 	// Parse CLI parameters
 
 	// General params
-	var mode string
+	var mode, configFile string
 	var maxprocs int
-	flag.StringVar(&mode, "mode", "", "Mandatory - specify the execution mode [httpd|bench|bench2|example]")
+	var printConfig bool
+	flag.StringVar(&configFile, "config", "", "Read the settings from this configuration file (TOML), flags given on the command line override it")
+	flag.BoolVar(&printConfig, "print-effective-config", false, "Print the settings in effect - defaults, configuration file and command line combined - as a configuration file and exit")
+	flag.StringVar(&mode, "mode", "", "Mandatory - specify the execution mode [httpd|manifest|bench|bench2|benchrun|example]")
 	flag.IntVar(&maxprocs, "gomaxprocs", defaultMaxprocs, "GOMAXPROCS")
 	// Debug params
 	var profile, debug bool
@@ -67,17 +86,106 @@ func main() {
 	var authToken string
 	var tlsCrt, tlsKey string
 	flag.StringVar(&dir, "dir", "", "(HTTP server) database directory")
+	flag.StringVar(&httpapi.DBProfile, "dbprofile", "", "(HTTP server) Configuration profile of a new database, default or small (for small devices: small files, a single partition); an existing database keeps its configuration")
 	flag.StringVar(&bind, "bind", "", "(HTTP server) bind to IP address (all network interfaces by default)")
 	flag.IntVar(&port, "port", 8080, "(HTTP server) port number")
 	flag.StringVar(&tlsCrt, "tlscrt", "", "(HTTP server) TLS certificate (empty to disable TLS).")
 	flag.StringVar(&tlsKey, "tlskey", "", "(HTTP server) TLS certificate key (empty to disable TLS).")
 	flag.StringVar(&authToken, "authtoken", "", "(HTTP server) Only authorize requests carrying this token in 'Authorization: token TOKEN' header. (empty to disable)")
+	flag.IntVar(&httpapi.CompressMinSize, "compressminsize", httpapi.CompressMinSize, "(HTTP server) Compress responses of at least this many bytes by gzip or deflate if the client accepts either (negative to disable)")
+
+	// HTTP server tuning params
+	flag.DurationVar(&httpapi.ReadTimeout, "readtimeout", 0, "(HTTP server) Maximum time to read a request including its body (0 - no limit)")
+	flag.DurationVar(&httpapi.ReadHeaderTimeout, "readheadertimeout", 0, "(HTTP server) Maximum time to read request headers (0 - same as readtimeout)")
+	flag.DurationVar(&httpapi.WriteTimeout, "writetimeout", 0, "(HTTP server) Maximum time to write a response, it must cover the longest responses such as dumps (0 - no limit)")
+	flag.DurationVar(&httpapi.IdleTimeout, "idletimeout", 0, "(HTTP server) Maximum time a kept-alive connection waits for the next request (0 - same as readtimeout)")
+	flag.BoolVar(&httpapi.DisableKeepAlives, "nokeepalive", false, "(HTTP server) Close every connection after its response")
+	flag.BoolVar(&httpapi.DisableHTTP2, "nohttp2", false, "(HTTP server) Serve only HTTP/1.1 over TLS, rather than negotiating HTTP/2 with clients")
+	flag.IntVar(&httpapi.MaxConns, "maxconns", 0, "(HTTP server) Maximum number of connections served at the same time, others wait to be accepted (0 - unlimited)")
+	flag.DurationVar(&httpapi.FreshnessWait, "freshnesswait", httpapi.FreshnessWait, "(HTTP server) Maximum time a request carrying a Tiedot-Min-Seq header waits for the database to reflect the changes up to that sequence number")
+	flag.BoolVar(&httpapi.Diagnostics, "diagnostics", false, "(HTTP server) Serve pprof profiles, expvar variables and a lock and goroutine dump under /debug/ (JWT user admin only)")
+	flag.IntVar(&httpapi.MutexProfileFraction, "mutexprofilefraction", 0, "(HTTP server) Report 1 in this many mutex contention events in /debug/pprof/mutex (0 to disable)")
+	flag.IntVar(&httpapi.BlockProfileRate, "blockprofilerate", 0, "(HTTP server) Sample one blocking event per this many nanoseconds blocked in /debug/pprof/block (0 to disable)")
+	flag.BoolVar(&httpapi.WarmupOnStart, "warmup", false, "(HTTP server) Read all collections into memory before accepting connections")
+
+	// HTTP + Unix domain socket params
+	var socketMode string
+	flag.StringVar(&httpapi.SocketPath, "unixsocket", "", "(HTTP server) Listen on this Unix domain socket instead of the TCP port (empty to disable)")
+	flag.StringVar(&socketMode, "unixsocketmode", "0600", "(HTTP server) Permission of the Unix domain socket file in octal, only users allowed to write to it may connect")
+
+	// HTTP + CORS params
+	var corsOrigins, corsMethods, corsHeaders string
+	flag.StringVar(&corsOrigins, "corsorigins", "", "(HTTP server) Comma separated origins allowed to make cross-origin requests, * for any origin (empty to allow any origin without preflight handling)")
+	flag.StringVar(&corsMethods, "corsmethods", "", "(HTTP server) Comma separated methods allowed in cross-origin requests (default: GET,POST,PUT,DELETE,OPTIONS)")
+	flag.StringVar(&corsHeaders, "corsheaders", "", "(HTTP server) Comma separated request headers allowed in cross-origin requests (default: the headers used by the API)")
+	flag.DurationVar(&httpapi.CORSMaxAge, "corsmaxage", 0, "(HTTP server) Time browsers may cache the answer to a preflight request (0 - browser default)")
 
 	// HTTP + JWT params
 	var jwtPubKey, jwtPrivateKey string
 	flag.StringVar(&jwtPubKey, "jwtpubkey", "", "(HTTP JWT server) Public key for signing tokens (empty to disable JWT)")
 	flag.StringVar(&jwtPrivateKey, "jwtprivatekey", "", "(HTTP JWT server) Private key for decoding tokens (empty to disable JWT)")
 
+	// HTTP + scheduled backup params
+	var backupDest, backupEndpoint, backupRegion string
+	backupConf := backup.Config{Interval: time.Hour, FullEvery: 24}
+	flag.StringVar(&backupDest, "backupdest", "", "(HTTP server) Take scheduled backups to a directory, or to S3-compatible object storage at s3://bucket/prefix (empty to disable). S3 credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN")
+	flag.DurationVar(&backupConf.Interval, "backupinterval", backupConf.Interval, "(HTTP server) Time between scheduled backups")
+	flag.IntVar(&backupConf.FullEvery, "backupfullevery", backupConf.FullEvery, "(HTTP server) Every N-th scheduled backup is full, the others are incremental (0 - only the first)")
+	flag.StringVar(&backupEndpoint, "backups3endpoint", "https://s3.amazonaws.com", "(HTTP server) Base URL of the S3-compatible object storage")
+	flag.StringVar(&backupRegion, "backups3region", os.Getenv("AWS_REGION"), "(HTTP server) Region of the S3 bucket (default: us-east-1)")
+
+	// HTTP + change data capture export params
+	var cdcKafka, cdcNATS, cdcNATSUser, cdcNATSPassword, cdcNATSToken string
+	var cdcJetStream bool
+	cdcConf := cdc.Config{Interval: time.Second, TopicPrefix: cdc.DEFAULT_TOPIC_PREFIX}
+	flag.StringVar(&cdcKafka, "cdckafka", "", "(HTTP server) Publish change events to Kafka through the REST proxy at this URL, for example http://localhost:8082 (empty to disable)")
+	flag.StringVar(&cdcNATS, "cdcnats", "", "(HTTP server) Publish change events to the NATS server at this address, for example localhost:4222 (empty to disable)")
+	flag.StringVar(&cdcNATSUser, "cdcnatsuser", "", "(HTTP server) User name of the NATS server")
+	flag.StringVar(&cdcNATSPassword, "cdcnatspassword", os.Getenv("NATS_PASSWORD"), "(HTTP server) Password of the NATS user (default: NATS_PASSWORD)")
+	flag.StringVar(&cdcNATSToken, "cdcnatstoken", os.Getenv("NATS_TOKEN"), "(HTTP server) Authentication token of the NATS server (default: NATS_TOKEN)")
+	flag.BoolVar(&cdcJetStream, "cdcjetstream", false, "(HTTP server) Wait for NATS JetStream to store every change event, for delivery at-least-once")
+	flag.StringVar(&cdcConf.TopicPrefix, "cdctopicprefix", cdcConf.TopicPrefix, "(HTTP server) Change events of a collection go to the topic (NATS subject) of this prefix followed by the collection name")
+	flag.DurationVar(&cdcConf.Interval, "cdcinterval", cdcConf.Interval, "(HTTP server) Time between polls for changes to publish")
+	flag.StringVar(&cdcConf.Checkpoint, "cdccheckpoint", "", "(HTTP server) Remember the published changes in this file, so that the export resumes after restart (empty - publish the entire database after every start)")
+
+	// HTTP + Elasticsearch sync params
+	var esSync, esSyncUser, esSyncPassword, esSyncConfig, esSyncPrefix string
+	esSyncConf := cdc.Config{Interval: time.Second}
+	flag.StringVar(&esSync, "essync", "", "(HTTP server) Mirror collections into Elasticsearch (or OpenSearch) at this URL, for example http://localhost:9200 (empty to disable)")
+	flag.StringVar(&esSyncUser, "essyncuser", "", "(HTTP server) User name of Elasticsearch")
+	flag.StringVar(&esSyncPassword, "essyncpassword", os.Getenv("ES_PASSWORD"), "(HTTP server) Password of the Elasticsearch user (default: ES_PASSWORD)")
+	flag.StringVar(&esSyncPrefix, "essyncindexprefix", cdc.ES_DEFAULT_INDEX_PREFIX, "(HTTP server) Collections go to the index of this prefix followed by the lower case collection name")
+	flag.StringVar(&esSyncConfig, "essyncconfig", "", "(HTTP server) JSON file of the collections to mirror, with their index names, fields and mappings (empty to mirror all collections as they are)")
+	flag.DurationVar(&esSyncConf.Interval, "essyncinterval", esSyncConf.Interval, "(HTTP server) Time between polls for changes to mirror")
+	flag.StringVar(&esSyncConf.Checkpoint, "essynccheckpoint", "", "(HTTP server) Remember the mirrored changes in this file, so that the sync resumes after restart (empty - mirror the entire database after every start)")
+
+	// HTTP shadowing params
+	var shadowSpec, shadowToken string
+	flag.StringVar(&shadowSpec, "shadow", "", "(HTTP server) Mirror the writes of collections, comma-separated col=target, where target is another collection or a tiedot server URL optionally followed by /collection, for example Feeds=http://10.0.0.6:8080 (empty to disable)")
+	flag.StringVar(&shadowToken, "shadowtoken", os.Getenv("SHADOW_TOKEN"), "(HTTP server) JWT sent to the shadow servers (default: SHADOW_TOKEN)")
+
+	// HTTP stored query params
+	flag.BoolVar(&httpapi.StoredQueriesOnly, "storedqueriesonly", false, "(HTTP server) Refuse ad-hoc queries, clients may only run stored queries")
+	flag.BoolVar(&httpapi.StrictQueries, "strictqueries", false, "(HTTP server) Parse ad-hoc queries without a version marker strictly, as queries of the current version")
+
+	// HTTP audit log params
+	flag.StringVar(&httpapi.AuditLogPath, "auditlog", "", "(HTTP server) Append records of administrative requests to this file (empty to disable)")
+	flag.StringVar(&httpapi.AuditCol, "auditcol", "", "(HTTP server) Insert records of administrative requests into this collection as well (empty - only the audit log file)")
+
+	// HTTP idempotency key params
+	flag.DurationVar(&httpapi.IdempotencyTTL, "idempotencyttl", httpapi.IdempotencyTTL, "(HTTP server) Time the responses to insert/update requests carrying an Idempotency-Key header are remembered, so that retries are not processed again (0 to ignore the header)")
+
+	// HTTP document access control params
+	flag.BoolVar(&httpapi.DocACL, "docacl", false, "(HTTP JWT server) JWT users other than admin may only access documents listing them at the ACL path of the collection")
+
+	// HTTP read replica params
+	flag.StringVar(&httpapi.FollowDir, "followdir", "", "(HTTP server) Serve the database as a read replica of the backups dropped into this directory (empty to disable)")
+	flag.DurationVar(&httpapi.FollowInterval, "followinterval", time.Minute, "(HTTP server) Time between polls of the read replica for new backups")
+
+	// Manifest mode params
+	var manifestFile string
+	flag.StringVar(&manifestFile, "manifest", "", "(manifest) Set up the database layout of this manifest file (JSON of /manifest) in the new database directory -dir")
+
 	// Benchmark mode params
 	var (
 		// Size of benchmark sample
@@ -87,8 +195,30 @@ func main() {
 	)
 	flag.IntVar(&benchSize, "benchsize", 400000, "Benchmark sample size")
 	flag.BoolVar(&benchCleanup, "benchcleanup", true, "Whether to clean up (delete benchmark DB) after benchmark")
+	// Configurable benchmark mode params
+	benchConf := bench.DefaultConfig()
+	var benchMix string
+	flag.StringVar(&benchConf.Dir, "benchdir", benchConf.Dir, "(benchrun) Benchmark database directory, it must not exist or be empty (default: a temporary directory)")
+	flag.IntVar(&benchConf.InitialDocs, "benchdocs", benchConf.InitialDocs, "(benchrun) Number of documents inserted before the benchmark begins")
+	flag.IntVar(&benchConf.DocSize, "benchdocsize", benchConf.DocSize, "(benchrun) Approximate size of each document in bytes")
+	flag.StringVar(&benchMix, "benchmix", "insert:1,read:6,query:1,update:1,delete:1", "(benchrun) Relative weight of operations")
+	flag.IntVar(&benchConf.Concurrency, "benchconcurrency", benchConf.Concurrency, "(benchrun) Number of concurrent goroutines")
+	flag.DurationVar(&benchConf.Duration, "benchduration", benchConf.Duration, "(benchrun) Duration of the benchmark")
+	flag.BoolVar(&benchConf.Indexes, "benchindexes", benchConf.Indexes, "(benchrun) Whether to index the sample documents")
 	flag.Parse()
 
+	// Settings of the configuration file apply unless given on the command line
+	if configFile != "" {
+		if err = loadConfig(flag.CommandLine, configFile); err != nil {
+			tdlog.Noticef("Failed to read the configuration file: %v", err)
+			os.Exit(1)
+		}
+	}
+	if printConfig {
+		printEffectiveConfig(flag.CommandLine, os.Stdout)
+		return
+	}
+
 	// User must specify a mode to run
 	if mode == "" {
 		flag.PrintDefaults()
@@ -146,15 +276,150 @@ func main() {
 			tdlog.Notice("To enable JWT, please specify RSA private and public key.")
 			os.Exit(1)
 		}
+		if httpapi.AuditCol != "" && httpapi.AuditLogPath == "" {
+			tdlog.Notice("Please specify the audit log file along with the audit collection, for example -auditlog=/var/log/tiedot-audit.log")
+			os.Exit(1)
+		}
+		if httpapi.DocACL && jwtPubKey == "" {
+			tdlog.Notice("Document access control identifies users by JWT, please specify RSA private and public key.")
+			os.Exit(1)
+		}
+		if mode, err := strconv.ParseUint(socketMode, 8, 32); err != nil || mode > 0777 {
+			tdlog.Notice("Please specify the socket file permission in octal, for example -unixsocketmode=0660")
+			os.Exit(1)
+		} else {
+			httpapi.SocketMode = os.FileMode(mode)
+		}
+		if httpapi.MaxConns < 0 {
+			tdlog.Notice("Please specify a non-negative maximum number of connections, for example -maxconns=1000")
+			os.Exit(1)
+		}
+		httpapi.CORSOrigins = splitList(corsOrigins)
+		httpapi.CORSMethods = splitList(corsMethods)
+		httpapi.CORSHeaders = splitList(corsHeaders)
+		if httpapi.FollowDir != "" && httpapi.FollowInterval <= 0 {
+			tdlog.Notice("Please specify a positive replica poll interval, for example -followinterval=1m")
+			os.Exit(1)
+		}
+		if backupDest != "" {
+			if backupConf.Interval <= 0 {
+				tdlog.Notice("Please specify a positive backup interval, for example -backupinterval=1h")
+				os.Exit(1)
+			}
+			var target backup.Target = backup.DirTarget{Dir: backupDest}
+			if strings.HasPrefix(backupDest, "s3://") {
+				bucketPrefix := strings.SplitN(strings.TrimPrefix(backupDest, "s3://"), "/", 2)
+				s3Target := &backup.S3Target{
+					Endpoint:     backupEndpoint,
+					Region:       backupRegion,
+					Bucket:       bucketPrefix[0],
+					AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+					SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+					SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+				}
+				if len(bucketPrefix) > 1 && bucketPrefix[1] != "" {
+					s3Target.Prefix = strings.TrimSuffix(bucketPrefix[1], "/") + "/"
+				}
+				if s3Target.Bucket == "" || s3Target.AccessKey == "" || s3Target.SecretKey == "" {
+					tdlog.Notice("To back up to S3, please specify the bucket, for example -backupdest=s3://bucket/prefix, and credentials in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.")
+					os.Exit(1)
+				}
+				target = s3Target
+			}
+			httpapi.Backups = backup.NewScheduler(target, backupConf)
+		}
+		if cdcKafka != "" && cdcNATS != "" {
+			tdlog.Notice("Please publish change events to either Kafka or NATS, not both.")
+			os.Exit(1)
+		} else if cdcKafka != "" || cdcNATS != "" {
+			if cdcConf.Interval <= 0 {
+				tdlog.Notice("Please specify a positive change poll interval, for example -cdcinterval=1s")
+				os.Exit(1)
+			}
+			var publisher cdc.Publisher = &cdc.KafkaPublisher{Endpoint: cdcKafka}
+			if cdcNATS != "" {
+				publisher = &cdc.NATSPublisher{Addr: cdcNATS, User: cdcNATSUser, Password: cdcNATSPassword, Token: cdcNATSToken, JetStream: cdcJetStream}
+			}
+			httpapi.CDC = cdc.NewExporter(publisher, cdcConf)
+		}
+		if esSync != "" {
+			if esSyncConf.Interval <= 0 {
+				tdlog.Notice("Please specify a positive sync poll interval, for example -essyncinterval=1s")
+				os.Exit(1)
+			}
+			publisher := &cdc.ElasticsearchPublisher{Endpoint: esSync, User: esSyncUser, Password: esSyncPassword, IndexPrefix: esSyncPrefix}
+			if esSyncConfig != "" {
+				content, err := ioutil.ReadFile(esSyncConfig)
+				if err == nil {
+					err = json.Unmarshal(content, &publisher.Cols)
+				}
+				if err != nil {
+					tdlog.Noticef("Failed to read Elasticsearch sync configuration: %v", err)
+					os.Exit(1)
+				}
+			}
+			httpapi.ESSync = cdc.NewExporter(publisher, esSyncConf)
+		}
+		if shadowSpec != "" {
+			confs, err := shadow.ParseConfigs(shadowSpec)
+			if err != nil {
+				tdlog.Notice(err)
+				os.Exit(1)
+			}
+			for _, conf := range confs {
+				conf.Token = shadowToken
+				httpapi.Shadows = append(httpapi.Shadows, shadow.New(conf))
+			}
+		}
 		httpapi.Start(dir, port, tlsCrt, tlsKey, jwtPubKey, jwtPrivateKey, bind, authToken)
+	case "manifest":
+		// Set up a new database from a layout manifest
+		if dir == "" || manifestFile == "" {
+			tdlog.Notice("Please specify the manifest file and the new database directory, for example -manifest=layout.json -dir=/tmp/db")
+			os.Exit(1)
+		}
+		manifestJS, err := ioutil.ReadFile(manifestFile)
+		if err != nil {
+			tdlog.Noticef("Failed to read the manifest: %v", err)
+			os.Exit(1)
+		}
+		var manifest db.Manifest
+		if err = json.Unmarshal(manifestJS, &manifest); err != nil {
+			tdlog.Noticef("Failed to read the manifest: %v", err)
+			os.Exit(1)
+		}
+		newDB, err := db.CreateFromManifest(dir, manifest)
+		if err != nil {
+			tdlog.Noticef("Failed to set up the database: %v", err)
+			os.Exit(1)
+		}
+		if err = newDB.Close(); err != nil {
+			tdlog.Noticef("Failed to close the database: %v", err)
+			os.Exit(1)
+		}
+		tdlog.Noticef("Database layout of %s is set up in %s", manifestFile, dir)
 	//case "example":
 	//	// Run embedded usage examples
 	//	examples.EmbeddedExample()
 	case "bench":
 		// Benchmark scenarios
-		benchmark.Benchmark(benchSize, benchCleanup)
+		bench.Benchmark(benchSize, benchCleanup)
 	case "bench2":
-		benchmark.Benchmark2(benchSize, benchCleanup)
+		bench.Benchmark2(benchSize, benchCleanup)
+	case "benchrun":
+		// Configurable benchmark, the result is printed in JSON
+		if benchConf.Mix, err = bench.ParseMix(benchMix); err != nil {
+			tdlog.Notice(err)
+			os.Exit(1)
+		}
+		benchConf.KeepData = !benchCleanup
+		result, err := bench.Run(benchConf)
+		if err != nil {
+			tdlog.Noticef("Benchmark failed: %v", err)
+			os.Exit(1)
+		}
+		out, _ := json.MarshalIndent(result, "", "  ")
+		os.Stdout.Write(append(out, '\n'))
 	default:
 		flag.PrintDefaults()
 		return
@@ -0,0 +1,268 @@
+// Versioned schema migrations.
+//
+// A migrator brings the collections and indexes of a database to the schema version expected by the application, by
+// applying numbered steps in ascending order of version: creating collections, adding indexes and transforming
+// documents, or anything else a step function does. Each applied step is recorded by a document in the system
+// collection "_migrations", so that a step is applied once, and the schema version is the highest version applied. A
+// migrator may also bring the schema back to an earlier version, by undoing the steps beyond it in descending order of
+// version; every one of them must be reversible.
+//
+// Steps creating collections and adding indexes succeed if the collection or index already exists, and their undoing
+// succeeds if it no longer does, so that a step interrupted before it was recorded may be applied again. Transforming
+// documents is not atomic: documents transformed before a failure remain transformed.
+
+package migrate
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+const (
+	VERSION_COL = "_migrations" // Name of the system collection recording applied steps.
+)
+
+// Step is a migration from the previous schema version to its version.
+type Step struct {
+	Version int                // Schema version of the step, unique and greater than 0
+	Name    string             // Description of the step
+	Up      func(*db.DB) error // Apply the step
+	Down    func(*db.DB) error // Undo the step, nil if the step is irreversible
+}
+
+// Record of an applied step.
+type record struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	Applied int64  `json:"applied"` // Time the step was applied (Unix seconds)
+}
+
+// Migrator applies and undoes the steps of a database.
+type Migrator struct {
+	db    *db.DB
+	steps []Step // In ascending order of version
+	lock  *sync.Mutex
+}
+
+// Return the migrator of the database, creating the system collection if it does not exist yet.
+func New(database *db.DB, steps ...Step) (*Migrator, error) {
+	if database == nil {
+		return nil, dberr.New(dberr.ErrorMissing, "database")
+	}
+	sorted := append([]Step(nil), steps...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	for i, step := range sorted {
+		if step.Version < 1 || i > 0 && step.Version == sorted[i-1].Version {
+			return nil, dberr.New(dberr.ErrorInvalidParam, "migration version", step.Version)
+		} else if step.Up == nil {
+			return nil, dberr.New(dberr.ErrorMissing, "Up")
+		}
+	}
+	if !database.ColExists(VERSION_COL) {
+		if err := database.Create(VERSION_COL); err != nil && dberr.Type(err) != dberr.ErrorColExists {
+			return nil, err
+		}
+	}
+	return &Migrator{db: database, steps: sorted, lock: new(sync.Mutex)}, nil
+}
+
+// Return the records of the applied steps by version.
+func (m *Migrator) applied() (records map[int]int, err error) {
+	col := m.db.Use(VERSION_COL)
+	if col == nil {
+		return nil, dberr.New(dberr.ErrorNoCol, VERSION_COL)
+	}
+	records = make(map[int]int)
+	col.ForEachDoc(func(id int, doc []byte) bool {
+		var rec record
+		if err = json.Unmarshal(doc, &rec); err != nil {
+			return false
+		}
+		records[rec.Version] = id
+		return true
+	})
+	return
+}
+
+// Return the schema version: the highest version applied, 0 if none is.
+func (m *Migrator) Version() (version int, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	records, err := m.applied()
+	for applied := range records {
+		if applied > version {
+			version = applied
+		}
+	}
+	return
+}
+
+// Apply the steps not applied yet, bringing the schema to the latest version.
+func (m *Migrator) Up() error {
+	if len(m.steps) == 0 {
+		return nil
+	}
+	return m.MigrateTo(m.steps[len(m.steps)-1].Version)
+}
+
+// Bring the schema to the version: apply the steps up to the version that are not applied yet, or undo the applied steps
+// beyond the version. Should a step fail, the schema remains at the version of the step before it, and the error is
+// ErrorMigration. Undoing fails with ErrorIrreversible before undoing anything, if a step to undo is irreversible.
+func (m *Migrator) MigrateTo(version int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if version < 0 {
+		return dberr.New(dberr.ErrorInvalidParam, "migration version", version)
+	}
+	records, err := m.applied()
+	if err != nil {
+		return err
+	}
+	col := m.db.Use(VERSION_COL)
+	// Undo in descending order of version
+	var undo []Step
+	for i := len(m.steps) - 1; i >= 0; i-- {
+		if step := m.steps[i]; step.Version > version {
+			if _, isApplied := records[step.Version]; isApplied {
+				if step.Down == nil {
+					return dberr.New(dberr.ErrorIrreversible, step.Version, step.Name)
+				}
+				undo = append(undo, step)
+			}
+		}
+	}
+	for _, step := range undo {
+		if err := step.Down(m.db); err != nil {
+			return dberr.New(dberr.ErrorMigration, step.Version, step.Name, err)
+		} else if err = col.Delete(records[step.Version]); err != nil {
+			return err
+		}
+		tdlog.Noticef("Migration %d (%s) is undone", step.Version, step.Name)
+	}
+	// Apply in ascending order of version
+	for _, step := range m.steps {
+		if _, isApplied := records[step.Version]; isApplied || step.Version > version {
+			continue
+		}
+		if err := step.Up(m.db); err != nil {
+			return dberr.New(dberr.ErrorMigration, step.Version, step.Name, err)
+		} else if _, err = col.Insert(map[string]interface{}{
+			"version": step.Version, "name": step.Name, "applied": time.Now().Unix()}); err != nil {
+			return err
+		}
+		tdlog.Noticef("Migration %d (%s) is applied", step.Version, step.Name)
+	}
+	return nil
+}
+
+// Return the step creating the collection, undone by dropping the collection.
+func CreateCol(version int, name string) Step {
+	return Step{
+		Version: version,
+		Name:    "create collection " + name,
+		Up: func(database *db.DB) error {
+			if err := database.Create(name); err != nil && dberr.Type(err) != dberr.ErrorColExists {
+				return err
+			}
+			return nil
+		},
+		Down: func(database *db.DB) error {
+			if err := database.Drop(name); err != nil && dberr.Type(err) != dberr.ErrorNoCol {
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+// Return the step adding the index to the collection, undone by removing the index.
+func AddIndex(version int, colName string, idxPath ...string) Step {
+	return Step{
+		Version: version,
+		Name:    "add index " + colName + " " + joinPath(idxPath),
+		Up: func(database *db.DB) error {
+			col := database.Use(colName)
+			if col == nil {
+				return dberr.New(dberr.ErrorNoCol, colName)
+			} else if err := col.Index(idxPath); err != nil && dberr.Type(err) != dberr.ErrorIndexExists {
+				return err
+			}
+			return nil
+		},
+		Down: func(database *db.DB) error {
+			col := database.Use(colName)
+			if col == nil {
+				return nil
+			} else if err := col.Unindex(idxPath); err != nil && dberr.Type(err) != dberr.ErrorNoIndex {
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+// Return the step transforming every document of the collection by the up function, and undone by the down function
+// (nil - irreversible). A function may modify the document it is given, it returns the transformed document, or nil
+// to delete the document.
+func Transform(version int, colName string, up, down func(doc map[string]interface{}) (map[string]interface{}, error)) Step {
+	step := Step{Version: version, Name: "transform " + colName, Up: transformAll(colName, up)}
+	if down != nil {
+		step.Down = transformAll(colName, down)
+	}
+	return step
+}
+
+// Returned by update functions of a transformation to delete the document.
+var errDeleteDoc = errors.New("delete document")
+
+// Return the function transforming every document of the collection.
+func transformAll(colName string, fun func(doc map[string]interface{}) (map[string]interface{}, error)) func(*db.DB) error {
+	return func(database *db.DB) error {
+		col := database.Use(colName)
+		if col == nil {
+			return dberr.New(dberr.ErrorNoCol, colName)
+		}
+		ids := make(map[int]struct{})
+		if err := db.EvalAllIDs(col, &ids); err != nil {
+			return err
+		}
+		for id := range ids {
+			err := col.UpdateFunc(id, func(original map[string]interface{}) (map[string]interface{}, error) {
+				// The original must be left alone for unindexing
+				var doc map[string]interface{}
+				docJS, err := json.Marshal(original)
+				if err == nil {
+					err = json.Unmarshal(docJS, &doc)
+				}
+				if err == nil {
+					if doc, err = fun(doc); err == nil && doc == nil {
+						err = errDeleteDoc
+					}
+				}
+				return doc, err
+			})
+			if err == errDeleteDoc {
+				err = col.Delete(id)
+			}
+			if err != nil && dberr.Type(err) != dberr.ErrorNoDoc {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Return the index path as it is written in queries.
+func joinPath(idxPath []string) string {
+	pathJS, _ := json.Marshal(idxPath)
+	return string(pathJS)
+}
@@ -0,0 +1,106 @@
+package migrate
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestMigrate(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tiedot_migrate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	database, err := db.OpenDB(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if _, err = New(database, CreateCol(1, "a"), CreateCol(1, "b")); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+	rename := func(from, to string) func(map[string]interface{}) (map[string]interface{}, error) {
+		return func(doc map[string]interface{}) (map[string]interface{}, error) {
+			if doc["drop"] == true {
+				return nil, nil
+			}
+			doc[to] = doc[from]
+			delete(doc, from)
+			return doc, nil
+		}
+	}
+	seed := Step{Version: 3, Name: "seed", Up: func(database *db.DB) error {
+		col := database.Use("people")
+		if _, err := col.Insert(map[string]interface{}{"name": "ann"}); err != nil {
+			return err
+		}
+		_, err := col.Insert(map[string]interface{}{"name": "bob", "drop": true})
+		return err
+	}}
+	steps := []Step{
+		AddIndex(2, "people", "name"),
+		CreateCol(1, "people"),
+		seed,
+		Transform(4, "people", rename("name", "fullname"), rename("fullname", "name")),
+		AddIndex(5, "people", "fullname"),
+	}
+	m, err := New(database, steps...)
+	if err != nil {
+		t.Fatal(err)
+	} else if version, err := m.Version(); err != nil || version != 0 {
+		t.Fatal(version, err)
+	}
+	// Apply the steps up to a version, then the rest
+	if err = m.MigrateTo(2); err != nil {
+		t.Fatal(err)
+	} else if version, err := m.Version(); err != nil || version != 2 {
+		t.Fatal(version, err)
+	} else if indexes := database.Use("people").AllIndexes(); len(indexes) != 1 {
+		t.Fatal(indexes)
+	}
+	if err = m.Up(); err != nil {
+		t.Fatal(err)
+	} else if version, err := m.Version(); err != nil || version != 5 {
+		t.Fatal(version, err)
+	}
+	result := make(map[int]struct{})
+	if err = db.EvalQuery(map[string]interface{}{"eq": "ann", "in": []interface{}{"fullname"}}, database.Use("people"), &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	} else if database.Use("people").ApproxDocCount() != 1 {
+		t.Fatal(database.Use("people").ApproxDocCount())
+	}
+	// Steps are applied once, also by another migrator
+	if m, err = New(database, steps...); err != nil {
+		t.Fatal(err)
+	} else if err = m.Up(); err != nil || database.Use("people").ApproxDocCount() != 1 {
+		t.Fatal(err)
+	}
+	// Undo down to the seed, which is irreversible
+	if err = m.MigrateTo(3); err != nil {
+		t.Fatal(err)
+	} else if indexes := database.Use("people").AllIndexes(); len(indexes) != 1 {
+		t.Fatal(indexes)
+	}
+	result = make(map[int]struct{})
+	if err = db.EvalQuery(map[string]interface{}{"eq": "ann", "in": []interface{}{"name"}}, database.Use("people"), &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	} else if err = m.MigrateTo(0); dberr.Type(err) != dberr.ErrorIrreversible {
+		t.Fatal(err)
+	} else if version, err := m.Version(); err != nil || version != 3 {
+		t.Fatal(version, err)
+	}
+	// A failed step leaves the schema at the version before it
+	failing := append(steps, Step{Version: 6, Name: "fail", Up: func(*db.DB) error { return errors.New("boom") }})
+	if m, err = New(database, failing...); err != nil {
+		t.Fatal(err)
+	} else if err = m.Up(); dberr.Type(err) != dberr.ErrorMigration {
+		t.Fatal(err)
+	} else if version, err := m.Version(); err != nil || version != 5 {
+		t.Fatal(version, err)
+	}
+}
@@ -0,0 +1,359 @@
+// Dual-write shadowing of collections.
+//
+// A shadow mirrors the writes made to a collection into a second collection - of the same database, or of another
+// tiedot server - so that a new configuration or version of tiedot may be validated with production traffic before
+// cutting over to it. Writes are mirrored asynchronously by a goroutine of the shadow and never slow down or fail the
+// writes of the collection: a write that finds the queue of the shadow full is dropped, and a write that the target
+// fails is counted, the last error kept in the statistics of the shadow.
+//
+// The target assigns document IDs of its own; the shadow remembers the target ID of each document it mirrored, and
+// mirrors an update of a document it has not seen (such as one inserted before shadowing started) as an insert.
+// Deleting such a document is skipped. Writes made by one goroutine are mirrored in order, while writes made
+// concurrently - even to the same document - may be mirrored in a different order than they were applied, as with
+// asynchronous hooks (see db.OnUpdate).
+
+package shadow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/dberr"
+	"github.com/cankansin/tiedot/tdlog"
+)
+
+const (
+	DEFAULT_QUEUE_LEN = 10000 // Default number of writes queued for mirroring before further writes are dropped.
+)
+
+// Config describes a shadowed collection.
+type Config struct {
+	Col       string       // Collection whose writes are mirrored
+	TargetCol string       // Collection receiving the writes, Col if empty
+	Server    string       // Base URL of the tiedot server of TargetCol, such as http://10.0.0.6:8080; empty - the same database
+	Client    *http.Client // HTTP client of Server, http.DefaultClient if nil.
+	Token     string       // JWT sent to Server in header Authorization, optional.
+	QueueLen  int          // Number of writes queued for mirroring, DEFAULT_QUEUE_LEN if 0.
+}
+
+// Stats tells how mirroring went since the shadow started.
+type Stats struct {
+	Col       string `json:"col"`                  // Collection whose writes are mirrored
+	Target    string `json:"target"`               // Target collection, preceded by the server URL if remote
+	Mirrored  int    `json:"mirrored"`             // Writes applied to the target
+	Failed    int    `json:"failed"`               // Writes the target failed
+	Dropped   int    `json:"dropped"`              // Writes not mirrored as the queue was full
+	Skipped   int    `json:"skipped"`              // Deletions of documents the shadow has not seen
+	Pending   int    `json:"pending"`              // Writes queued for mirroring
+	LastError string `json:"last_error,omitempty"` // Error of the last failed write
+	FailedAt  int64  `json:"failed_at,omitempty"`  // Time (Unix seconds) of the last failed write
+}
+
+// Receives the mirrored writes.
+type target interface {
+	insert(doc map[string]interface{}) (id int, err error)
+	update(id int, doc map[string]interface{}) error
+	delete(id int) error
+}
+
+// A write to mirror. Doc is nil for deletion.
+type write struct {
+	id  int
+	doc []byte
+}
+
+// Shadow mirrors the writes of a collection.
+type Shadow struct {
+	conf      Config
+	lock      *sync.RWMutex // Protects queue, remove and stopped, held for reading while a write is queued
+	queue     chan write    // Writes not yet mirrored, nil unless started
+	remove    []func()      // Remove the hooks of the collection
+	stopped   chan struct{} // Closed once the queue is drained after stopping
+	ids       map[int]int   // Target document ID by document ID, used by the mirroring goroutine alone
+	statsLock *sync.Mutex
+	stats     Stats
+}
+
+// Return a shadow of the collection. It does nothing until started.
+func New(conf Config) *Shadow {
+	if conf.TargetCol == "" {
+		conf.TargetCol = conf.Col
+	}
+	if conf.QueueLen <= 0 {
+		conf.QueueLen = DEFAULT_QUEUE_LEN
+	}
+	conf.Server = strings.TrimSuffix(conf.Server, "/")
+	target := conf.TargetCol
+	if conf.Server != "" {
+		target = conf.Server + "/" + target
+	}
+	return &Shadow{conf: conf, lock: new(sync.RWMutex), statsLock: new(sync.Mutex), stats: Stats{Col: conf.Col, Target: target}}
+}
+
+// Parse the shadows of a comma-separated list of "col=target", where target is another collection of the same database
+// or the base URL of a tiedot server, optionally followed by the target collection name - such as
+// "Feeds=Feeds2,Votes=http://10.0.0.6:8080" or "Feeds=http://10.0.0.6:8080/Feeds2".
+func ParseConfigs(spec string) (confs []Config, err error) {
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		eq := strings.Index(item, "=")
+		if eq < 1 || eq == len(item)-1 {
+			return nil, dberr.New(dberr.ErrorInvalidParam, "shadow (col=target)", item)
+		}
+		conf := Config{Col: item[:eq], TargetCol: item[eq+1:]}
+		if strings.HasPrefix(conf.TargetCol, "http://") || strings.HasPrefix(conf.TargetCol, "https://") {
+			server, err := url.Parse(conf.TargetCol)
+			if err != nil || server.Host == "" {
+				return nil, dberr.New(dberr.ErrorInvalidParam, "shadow server", conf.TargetCol)
+			}
+			conf.TargetCol = strings.Trim(server.Path, "/")
+			server.Path = ""
+			conf.Server = server.String()
+		}
+		confs = append(confs, conf)
+	}
+	return
+}
+
+// Mirror the writes of the collection of the database from now on, until stopped. The collection must exist, and so
+// must the target collection if it is of the same database.
+func (s *Shadow) Start(database *db.DB) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.queue != nil {
+		return nil
+	}
+	col := database.Use(s.conf.Col)
+	if col == nil {
+		return dberr.New(dberr.ErrorNoCol, s.conf.Col)
+	}
+	var tgt target
+	if s.conf.Server != "" {
+		tgt = &remote{server: s.conf.Server, col: s.conf.TargetCol, client: s.conf.Client, token: s.conf.Token}
+	} else if s.conf.TargetCol == s.conf.Col {
+		return dberr.New(dberr.ErrorInvalidParam, "shadow target (it is the shadowed collection)", s.conf.TargetCol)
+	} else if !database.ColExists(s.conf.TargetCol) {
+		return dberr.New(dberr.ErrorNoCol, s.conf.TargetCol)
+	} else {
+		tgt = &local{db: database, col: s.conf.TargetCol}
+	}
+	s.queue, s.stopped = make(chan write, s.conf.QueueLen), make(chan struct{})
+	if s.ids == nil {
+		// A restarted shadow keeps the documents it mirrored before
+		s.ids = make(map[int]int)
+	}
+	s.remove = []func(){
+		col.OnInsert(func(id int, doc map[string]interface{}) {
+			s.enqueue(id, doc)
+		}, false),
+		col.OnUpdate(func(id int, doc, _ map[string]interface{}) {
+			s.enqueue(id, doc)
+		}, false),
+		col.OnDelete(func(id int, _ map[string]interface{}) {
+			s.enqueue(id, nil)
+		}, false),
+	}
+	go s.mirror(tgt, s.queue, s.stopped)
+	return nil
+}
+
+// Stop mirroring, waiting for the writes already queued to be mirrored.
+func (s *Shadow) Stop() {
+	s.lock.Lock()
+	queue, stopped := s.queue, s.stopped
+	for _, remove := range s.remove {
+		remove()
+	}
+	s.queue, s.remove = nil, nil
+	s.lock.Unlock()
+	if queue != nil {
+		close(queue)
+		<-stopped
+	}
+}
+
+// Return the statistics of mirroring.
+func (s *Shadow) Stats() Stats {
+	s.lock.RLock()
+	pending := len(s.queue)
+	s.lock.RUnlock()
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	stats := s.stats
+	stats.Pending = pending
+	return stats
+}
+
+// Queue the write for mirroring, unless the queue is full. Called by the hooks of the collection.
+func (s *Shadow) enqueue(id int, doc map[string]interface{}) {
+	w := write{id: id}
+	if doc != nil {
+		// The caller may reuse the document once the hook returns
+		var err error
+		if w.doc, err = json.Marshal(doc); err != nil {
+			s.count(&s.stats.Failed, err)
+			return
+		}
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.queue == nil {
+		return
+	}
+	select {
+	case s.queue <- w:
+	default:
+		s.count(&s.stats.Dropped, nil)
+	}
+}
+
+// Increase the counter of the statistics, and remember the error if there is one.
+func (s *Shadow) count(counter *int, err error) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	*counter++
+	if err != nil {
+		s.stats.LastError, s.stats.FailedAt = err.Error(), time.Now().Unix()
+	}
+}
+
+// Apply the queued writes to the target until the queue is closed.
+func (s *Shadow) mirror(tgt target, queue chan write, stopped chan struct{}) {
+	defer close(stopped)
+	for w := range queue {
+		targetID, seen := s.ids[w.id]
+		var doc map[string]interface{}
+		var err error
+		switch {
+		case w.doc != nil && json.Unmarshal(w.doc, &doc) != nil:
+			err = dberr.New(dberr.ErrorInvalidJSON, string(w.doc), "document")
+		case w.doc != nil && seen:
+			err = tgt.update(targetID, doc)
+		case w.doc != nil:
+			if targetID, err = tgt.insert(doc); err == nil {
+				s.ids[w.id] = targetID
+			}
+		case seen:
+			if err = tgt.delete(targetID); err == nil {
+				delete(s.ids, w.id)
+			}
+		default:
+			s.count(&s.stats.Skipped, nil)
+			continue
+		}
+		if err != nil {
+			tdlog.Infof("Shadow of collection %s failed to mirror a write of document %d: %v", s.conf.Col, w.id, err)
+			s.count(&s.stats.Failed, err)
+		} else {
+			s.count(&s.stats.Mirrored, nil)
+		}
+	}
+}
+
+// A target collection of the same database, looked up for every write as it may be renamed or dropped.
+type local struct {
+	db  *db.DB
+	col string
+}
+
+func (l *local) use() (*db.Col, error) {
+	if col := l.db.Use(l.col); col != nil {
+		return col, nil
+	}
+	return nil, dberr.New(dberr.ErrorNoCol, l.col)
+}
+
+func (l *local) insert(doc map[string]interface{}) (int, error) {
+	col, err := l.use()
+	if err != nil {
+		return 0, err
+	}
+	return col.Insert(doc)
+}
+
+func (l *local) update(id int, doc map[string]interface{}) error {
+	col, err := l.use()
+	if err != nil {
+		return err
+	}
+	return col.Update(id, doc)
+}
+
+func (l *local) delete(id int) error {
+	col, err := l.use()
+	if err != nil {
+		return err
+	}
+	return col.Delete(id)
+}
+
+// A target collection of a tiedot server.
+type remote struct {
+	server, col string
+	client      *http.Client
+	token       string
+}
+
+// Send the request to the server and return the response body, an error response is returned as an error.
+func (r *remote) request(endpoint string, params url.Values) ([]byte, error) {
+	req, err := http.NewRequest("POST", r.server+endpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	client := r.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("Server %s failed: %d %s", r.server, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func (r *remote) insert(doc map[string]interface{}) (int, error) {
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return 0, err
+	}
+	body, err := r.request("/insert", url.Values{"col": {r.col}, "doc": {string(docJS)}})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(body)))
+}
+
+func (r *remote) update(id int, doc map[string]interface{}) error {
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = r.request("/update", url.Values{"col": {r.col}, "id": {strconv.Itoa(id)}, "doc": {string(docJS)}})
+	return err
+}
+
+func (r *remote) delete(id int) error {
+	_, err := r.request("/delete", url.Values{"col": {r.col}, "id": {strconv.Itoa(id)}})
+	return err
+}
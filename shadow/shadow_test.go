@@ -0,0 +1,227 @@
+package shadow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func openDB(t *testing.T) (database *db.DB, cleanup func()) {
+	tmp, err := ioutil.TempDir("", "tiedot_shadow_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if database, err = db.OpenDB(path.Join(tmp, "db")); err != nil {
+		t.Fatal(err)
+	}
+	return database, func() {
+		database.Close()
+		os.RemoveAll(tmp)
+	}
+}
+
+// Wait for the shadow to have mirrored the number of writes.
+func waitMirrored(t *testing.T, shadow *Shadow, mirrored int) {
+	for start := time.Now(); shadow.Stats().Mirrored < mirrored; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal(shadow.Stats())
+		}
+	}
+}
+
+func TestParseConfigs(t *testing.T) {
+	confs, err := ParseConfigs("Feeds=Feeds2, Votes=http://10.0.0.6:8080,Users=https://new:8443/Users2/")
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(confs, []Config{
+		{Col: "Feeds", TargetCol: "Feeds2"},
+		{Col: "Votes", Server: "http://10.0.0.6:8080"},
+		{Col: "Users", TargetCol: "Users2", Server: "https://new:8443"},
+	}) {
+		t.Fatal(confs)
+	}
+	for _, spec := range []string{"Feeds", "=Feeds2", "Feeds=", "Feeds=http://"} {
+		if _, err = ParseConfigs(spec); dberr.Type(err) != dberr.ErrorInvalidParam {
+			t.Fatal(spec, err)
+		}
+	}
+}
+
+func TestShadowLocal(t *testing.T) {
+	database, cleanup := openDB(t)
+	defer cleanup()
+	if err := database.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := database.Use("col")
+	before, err := col.Insert(map[string]interface{}{"a": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadow := New(Config{Col: "col", TargetCol: "col2"})
+	if err = shadow.Start(database); dberr.Type(err) != dberr.ErrorNoCol {
+		t.Fatal(err)
+	} else if err = New(Config{Col: "col"}).Start(database); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	} else if err = database.Create("col2"); err != nil {
+		t.Fatal(err)
+	} else if err = shadow.Start(database); err != nil {
+		t.Fatal(err)
+	}
+	// The writes are mirrored in order
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = col.Update(id, map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Update(before, map[string]interface{}{"a": 3}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(before); err != nil {
+		t.Fatal(err)
+	}
+	unseen, err := database.Use("col").Insert(map[string]interface{}{"a": 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadow.Stop()
+	if err = col.Delete(unseen); err != nil {
+		t.Fatal(err)
+	}
+	if stats := shadow.Stats(); stats.Mirrored != 5 || stats.Failed != 0 || stats.Dropped != 0 || stats.Pending != 0 || stats.Target != "col2" {
+		t.Fatal(stats)
+	}
+	var docs []map[string]interface{}
+	database.Use("col2").ForEachDoc(func(_ int, doc []byte) bool {
+		var parsed map[string]interface{}
+		json.Unmarshal(doc, &parsed)
+		docs = append(docs, parsed)
+		return true
+	})
+	if len(docs) != 2 || docs[0]["a"].(float64)+docs[1]["a"].(float64) != 6 {
+		t.Fatal(docs)
+	}
+	// A restarted shadow skips deletion of documents it has not seen, and counts the failures of its target
+	if err = shadow.Start(database); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	waitMirrored(t, shadow, 6)
+	if err = database.Drop("col2"); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.Insert(map[string]interface{}{"a": 5}); err != nil {
+		t.Fatal(err)
+	}
+	shadow.Stop()
+	if stats := shadow.Stats(); stats.Mirrored != 6 || stats.Failed != 1 || stats.LastError == "" || stats.FailedAt == 0 {
+		t.Fatal(stats)
+	}
+}
+
+// A tiedot server keeping the documents of one collection in memory, its writes wait for release to be closed.
+type fake struct {
+	*httptest.Server
+	lock    *sync.Mutex
+	docs    map[int]map[string]interface{}
+	release chan struct{}
+}
+
+func fakeServer() *fake {
+	f := &fake{lock: new(sync.Mutex), docs: make(map[int]map[string]interface{}), release: make(chan struct{})}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-f.release
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if r.FormValue("col") != "Remote" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(400)
+			return
+		}
+		var doc map[string]interface{}
+		json.Unmarshal([]byte(r.FormValue("doc")), &doc)
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		switch r.URL.Path {
+		case "/insert":
+			id = 100 + len(f.docs)
+			f.docs[id] = doc
+			w.WriteHeader(201)
+			fmt.Fprint(w, id)
+		case "/update":
+			f.docs[id] = doc
+		case "/delete":
+			if _, exists := f.docs[id]; !exists {
+				w.WriteHeader(404)
+				fmt.Fprint(w, `{"code": "no_doc"}`)
+			}
+			delete(f.docs, id)
+		}
+	}))
+	return f
+}
+
+func TestShadowRemote(t *testing.T) {
+	database, cleanup := openDB(t)
+	defer cleanup()
+	server := fakeServer()
+	defer server.Close()
+	if err := database.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := database.Use("col")
+	shadow := New(Config{Col: "col", TargetCol: "Remote", Server: server.URL + "/", Token: "token", QueueLen: 2})
+	if err := shadow.Start(database); err != nil {
+		t.Fatal(err)
+	}
+	defer shadow.Stop()
+	// While the server is held up, writes beyond the queue are dropped rather than waited for
+	ids := make([]int, 5)
+	for i := range ids {
+		var err error
+		if ids[i], err = col.Insert(map[string]interface{}{"i": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := shadow.Stats(); stats.Dropped < 2 || stats.Target != server.URL+"/Remote" {
+		t.Fatal(stats)
+	}
+	close(server.release)
+	shadow.Stop()
+	stats := shadow.Stats()
+	if stats.Mirrored+stats.Dropped != 5 || stats.Failed != 0 || stats.Pending != 0 || len(server.docs) != stats.Mirrored {
+		t.Fatal(stats, server.docs)
+	}
+	// Updates and deletions go to the document mirrored, documents dropped before are inserted by their updates
+	if err := shadow.Start(database); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if err := col.Update(id, map[string]interface{}{"updated": true}); err != nil {
+			t.Fatal(err)
+		}
+		waitMirrored(t, shadow, stats.Mirrored+1)
+		stats = shadow.Stats()
+	}
+	if err := col.Delete(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	shadow.Stop()
+	if stats = shadow.Stats(); stats.Failed != 0 || stats.Skipped != 0 || len(server.docs) != 4 {
+		t.Fatal(stats, server.docs)
+	}
+	for _, doc := range server.docs {
+		if doc["updated"] != true {
+			t.Fatal(server.docs)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+// Client of documents sharded across tiedot servers.
+//
+// A cluster spreads the documents of each collection across several tiedot HTTP servers by consistent hashing of their
+// string IDs, so that a dataset may outgrow the disk of one machine. Every document inserted through the cluster carries
+// a string ID - the one given in "_id", or a random one - which routes it to its server; reading, updating and
+// deleting the document by string ID go to that server alone. Collections and indexes are created on every server, and
+// queries are sent to every server at once, their results merged.
+//
+// Adding or removing a server changes the server of about 1/n of the string IDs. Rebalance moves their documents to
+// their new servers online; documents of servers changed otherwise remain readable by queries but not by string ID.
+
+package shard
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Cluster sends the requests of a sharded dataset to its servers.
+type Cluster struct {
+	ring     *Ring
+	move     *move         // Rebalancing in progress, nil if none
+	lock     *sync.RWMutex // Protects ring and move, held for reading by document writes
+	moveLock *sync.Mutex   // Serialises rebalancing
+	Client   *http.Client  // HTTP client, http.DefaultClient if nil.
+	Token    string        // JWT sent to the servers in header Authorization, optional.
+}
+
+// ServerError is an error response of a server.
+type ServerError struct {
+	Server  string // Base URL of the server
+	Status  int    // HTTP status
+	Code    string // Error code, e.g. "no_doc", see the API reference
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("Server %s failed: %d %s", e.Server, e.Status, e.Message)
+}
+
+// Return the cluster of the servers, given by their base URLs such as http://10.0.0.5:8080.
+func New(servers ...string) (*Cluster, error) {
+	trimmed := make([]string, len(servers))
+	for i, server := range servers {
+		trimmed[i] = strings.TrimSuffix(server, "/")
+	}
+	ring, err := NewRing(trimmed...)
+	if err != nil {
+		return nil, err
+	}
+	return &Cluster{ring: ring, lock: new(sync.RWMutex), moveLock: new(sync.Mutex)}, nil
+}
+
+// Return the server of the string ID.
+func (c *Cluster) Server(strID string) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.ring.Server(strID)
+}
+
+// Return the servers of the cluster.
+func (c *Cluster) Servers() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.ring.Servers()
+}
+
+// Return the servers of the cluster, and during rebalancing also the servers documents are moved to.
+func (c *Cluster) allServers() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	servers := c.ring.Servers()
+	if c.move != nil {
+		for _, server := range c.move.ring.Servers() {
+			if !c.ring.has(server) {
+				servers = append(servers, server)
+			}
+		}
+	}
+	return servers
+}
+
+// Send the request to the server and return the response body. An error response is returned as *ServerError.
+func (c *Cluster) request(server, endpoint string, params url.Values) ([]byte, error) {
+	req, err := http.NewRequest("POST", server+endpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode/100 != 2 {
+		serverErr := &ServerError{Server: server, Status: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+		var errResp struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &errResp) == nil && errResp.Code != "" {
+			serverErr.Code, serverErr.Message = errResp.Code, errResp.Message
+		}
+		return nil, serverErr
+	}
+	return body, nil
+}
+
+// Call the function for every server at once, return the error of the first server that failed in the order of
+// servers.
+func (c *Cluster) fanOut(fun func(server string) error) error {
+	servers := c.allServers()
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+			errs[i] = fun(server)
+		}(i, server)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return true if the error is a server's error response of the code.
+func isCode(err error, code string) bool {
+	serverErr, ok := err.(*ServerError)
+	return ok && serverErr.Code == code
+}
+
+// Create the collection on every server, unless it already exists there.
+func (c *Cluster) Create(col string) error {
+	return c.fanOut(func(server string) error {
+		if _, err := c.request(server, "/create", url.Values{"col": {col}}); err != nil && !isCode(err, "col_exists") {
+			return err
+		}
+		return nil
+	})
+}
+
+// Drop the collection on every server that has it.
+func (c *Cluster) Drop(col string) error {
+	return c.fanOut(func(server string) error {
+		if _, err := c.request(server, "/drop", url.Values{"col": {col}}); err != nil && !isCode(err, "no_col") {
+			return err
+		}
+		return nil
+	})
+}
+
+// Create the index on every server, unless it already exists there.
+func (c *Cluster) Index(col string, idxPath ...string) error {
+	return c.fanOut(func(server string) error {
+		params := url.Values{"col": {col}, "path": {strings.Join(idxPath, ",")}}
+		if _, err := c.request(server, "/index", params); err != nil && !isCode(err, "index_exists") {
+			return err
+		}
+		return nil
+	})
+}
+
+// Return a random string ID.
+func newStrID() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// Insert the document into the server of its string ID, return the string ID. A document without string ID in "_id" is
+// given a random one.
+func (c *Cluster) Insert(col string, doc map[string]interface{}) (strID string, err error) {
+	if doc == nil {
+		return "", dberr.New(dberr.ErrorMissing, "document")
+	}
+	strID, hasStrID := doc[db.STR_ID_ATTR].(string)
+	if !hasStrID {
+		if strID, err = newStrID(); err != nil {
+			return
+		}
+	}
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	server, next := c.route(strID)
+	if _, err = c.request(server, "/insert", url.Values{"col": {col}, "id": {strID}, "doc": {string(docJS)}}); err == nil && next != "" {
+		err = c.put(next, col, strID, docJS)
+	}
+	return
+}
+
+// Read the document of the string ID from its server.
+func (c *Cluster) Read(col, strID string) (doc map[string]interface{}, err error) {
+	body, err := c.request(c.Server(strID), "/get", url.Values{"col": {col}, "id": {strID}})
+	if err == nil {
+		err = json.Unmarshal(body, &doc)
+	}
+	return
+}
+
+// Update the document of the string ID on its server.
+func (c *Cluster) Update(col, strID string, doc map[string]interface{}) error {
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	server, next := c.route(strID)
+	if _, err = c.request(server, "/update", url.Values{"col": {col}, "id": {strID}, "doc": {string(docJS)}}); err == nil && next != "" {
+		err = c.put(next, col, strID, docJS)
+	}
+	return err
+}
+
+// Delete the document of the string ID from its server.
+func (c *Cluster) Delete(col, strID string) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	server, next := c.route(strID)
+	_, err := c.request(server, "/delete", url.Values{"col": {col}, "id": {strID}})
+	if err == nil && next != "" {
+		c.move.setDeleted(col, strID)
+		if _, err = c.request(next, "/delete", url.Values{"col": {col}, "id": {strID}}); isCode(err, "no_doc") {
+			err = nil
+		}
+	}
+	return err
+}
+
+// Evaluate the query on every server, return the matching documents of all servers by string ID. Documents without
+// string ID, inserted into a server directly, are keyed by their document ID on the server. A limit in the query
+// applies to each server.
+func (c *Cluster) Query(col string, q interface{}) (map[string]map[string]interface{}, error) {
+	qJS, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	// During rebalancing documents are on two servers, only the copy on the server of the string ID counts
+	c.lock.RLock()
+	ring, moving := c.ring, c.move != nil
+	c.lock.RUnlock()
+	result := make(map[string]map[string]interface{})
+	lock := new(sync.Mutex)
+	err = c.fanOut(func(server string) error {
+		body, err := c.request(server, "/query", url.Values{"col": {col}, "q": {string(qJS)}})
+		if err != nil {
+			return err
+		}
+		var docs map[string]map[string]interface{}
+		if err = json.Unmarshal(body, &docs); err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for id, doc := range docs {
+			if strID, hasStrID := doc[db.STR_ID_ATTR].(string); hasStrID {
+				if moving && ring.Server(strID) != server {
+					continue
+				}
+				id = strID
+			}
+			result[id] = doc
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Evaluate the query on every server, return the total number of matching documents.
+func (c *Cluster) Count(col string, q interface{}) (int, error) {
+	c.lock.RLock()
+	moving := c.move != nil
+	c.lock.RUnlock()
+	if moving {
+		// Count documents on two servers once
+		docs, err := c.Query(col, q)
+		return len(docs), err
+	}
+	qJS, err := json.Marshal(q)
+	if err != nil {
+		return 0, err
+	}
+	counts := make(map[string]int)
+	lock := new(sync.Mutex)
+	err = c.fanOut(func(server string) error {
+		body, err := c.request(server, "/count", url.Values{"col": {col}, "q": {string(qJS)}})
+		if err != nil {
+			return err
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(string(body)))
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		counts[server] = count
+		lock.Unlock()
+		return nil
+	})
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	return total, err
+}
@@ -0,0 +1,201 @@
+// Online rebalancing of documents across servers.
+//
+// Rebalancing moves the documents of the hash ranges that change servers with the new set of servers - adding a
+// server moves to it about 1/n of the documents, removing a server moves its documents to the remaining servers.
+// While the documents are copied, the cluster keeps serving reads from their current servers and writes each document
+// to both its current and its new server. Once every document is copied, routing flips to the new servers at once, and
+// the documents are deleted from their old servers.
+//
+// Only writes made through the rebalancing Cluster are written to both servers, other clients of the servers must
+// pause writing for the duration.
+
+package shard
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/cankansin/tiedot/db"
+)
+
+// A document of a collection.
+type docKey struct {
+	col, strID string
+}
+
+// Rebalancing in progress.
+type move struct {
+	ring    *Ring // Servers after rebalancing
+	lock    *sync.Mutex
+	written map[docKey]bool // Documents written to their new servers, by copying or by writes to both servers
+	deleted map[docKey]bool // Documents deleted while copying, the copier may have copied them already
+}
+
+// Remember that the document was written to its new server.
+func (m *move) setWritten(col, strID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.written[docKey{col, strID}] = true
+	delete(m.deleted, docKey{col, strID})
+}
+
+// Remember that the document was copied to its new server. Unlike a write, copying does not undo a deletion in the
+// meantime.
+func (m *move) setCopied(col, strID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.written[docKey{col, strID}] = true
+}
+
+// Remember that the document was deleted from both servers.
+func (m *move) setDeleted(col, strID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.deleted[docKey{col, strID}] = true
+	delete(m.written, docKey{col, strID})
+}
+
+// Return true if the document was deleted while copying.
+func (m *move) isDeleted(col, strID string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.deleted[docKey{col, strID}]
+}
+
+// Return the server of the string ID, and during rebalancing also the new server if it is a different one. Caller
+// must hold the cluster lock for reading.
+func (c *Cluster) route(strID string) (server, next string) {
+	server = c.ring.Server(strID)
+	if c.move != nil {
+		if next = c.move.ring.Server(strID); next == server {
+			next = ""
+		}
+	}
+	return
+}
+
+// Write the document to the new server of its string ID, whether or not it was copied there already.
+func (c *Cluster) put(server, col, strID string, docJS []byte) (err error) {
+	c.move.setWritten(col, strID)
+	params := url.Values{"col": {col}, "id": {strID}, "doc": {string(docJS)}}
+	if _, err = c.request(server, "/update", params); isCode(err, "no_doc") {
+		if _, err = c.request(server, "/insert", params); isCode(err, "dup_id") {
+			// Copied in the meantime
+			_, err = c.request(server, "/update", params)
+		}
+	}
+	return
+}
+
+// Move the documents of the collections to their servers among the new servers, return the number of documents moved.
+// The collections and their indexes are created on the new servers first. Documents without string ID stay on their
+// servers. If copying fails, the cluster keeps its servers and the copies made are deleted.
+func (c *Cluster) Rebalance(servers []string, cols ...string) (moved int, err error) {
+	c.moveLock.Lock()
+	defer c.moveLock.Unlock()
+	trimmed := make([]string, len(servers))
+	for i, server := range servers {
+		trimmed[i] = strings.TrimSuffix(server, "/")
+	}
+	ring, err := NewRing(trimmed...)
+	if err != nil {
+		return
+	}
+	// Only rebalancing changes the ring, which is held by the move lock
+	oldRing := c.ring
+	mv := &move{ring: ring, lock: new(sync.Mutex), written: make(map[docKey]bool), deleted: make(map[docKey]bool)}
+	c.lock.Lock()
+	c.move = mv
+	c.lock.Unlock()
+	abort := func() {
+		c.lock.Lock()
+		c.move = nil
+		c.lock.Unlock()
+		for doc := range mv.written {
+			c.request(ring.Server(doc.strID), "/delete", url.Values{"col": {doc.col}, "id": {doc.strID}})
+		}
+	}
+	// Create the collections and indexes on the new servers
+	for _, col := range cols {
+		var body []byte
+		if body, err = c.request(oldRing.Servers()[0], "/indexes", url.Values{"col": {col}}); err != nil {
+			abort()
+			return
+		}
+		var indexes [][]string
+		if err = json.Unmarshal(body, &indexes); err != nil {
+			abort()
+			return
+		} else if err = c.Create(col); err != nil {
+			abort()
+			return
+		}
+		for _, idxPath := range indexes {
+			if err = c.Index(col, idxPath...); err != nil {
+				abort()
+				return
+			}
+		}
+	}
+	// Copy the documents while their writes go to both servers
+	for _, server := range oldRing.Servers() {
+		for _, col := range cols {
+			var body []byte
+			if body, err = c.request(server, "/query", url.Values{"col": {col}, "q": {`"all"`}}); err != nil {
+				abort()
+				return
+			}
+			var docs map[string]map[string]interface{}
+			if err = json.Unmarshal(body, &docs); err != nil {
+				abort()
+				return
+			}
+			for _, doc := range docs {
+				strID, hasStrID := doc[db.STR_ID_ATTR].(string)
+				if !hasStrID || ring.Server(strID) == server || mv.isDeleted(col, strID) {
+					continue
+				}
+				to := ring.Server(strID)
+				var docJS []byte
+				if docJS, err = json.Marshal(doc); err != nil {
+					abort()
+					return
+				}
+				_, err = c.request(to, "/insert", url.Values{"col": {col}, "id": {strID}, "doc": {string(docJS)}})
+				if isCode(err, "dup_id") {
+					// Written to both servers in the meantime, which is newer
+					err = nil
+				} else if err != nil {
+					abort()
+					return
+				}
+				mv.setCopied(col, strID)
+			}
+		}
+	}
+	// Cut over: delete the documents deleted while copying from their new servers, and route to the new servers
+	c.lock.Lock()
+	for doc := range mv.deleted {
+		if _, err = c.request(ring.Server(doc.strID), "/delete", url.Values{"col": {doc.col}, "id": {doc.strID}}); err != nil && !isCode(err, "no_doc") {
+			c.lock.Unlock()
+			abort()
+			return
+		}
+	}
+	err = nil
+	c.ring = ring
+	c.lock.Unlock()
+	// Delete the documents from their old servers
+	for doc := range mv.written {
+		params := url.Values{"col": {doc.col}, "id": {doc.strID}}
+		if _, deleteErr := c.request(oldRing.Server(doc.strID), "/delete", params); deleteErr != nil && !isCode(deleteErr, "no_doc") && err == nil {
+			err = deleteErr
+		}
+	}
+	c.lock.Lock()
+	c.move = nil
+	c.lock.Unlock()
+	return len(mv.written), err
+}
@@ -0,0 +1,91 @@
+// Consistent hashing of document IDs onto servers.
+//
+// Each server is placed on a hash ring at a number of points (virtual nodes), and a key belongs to the server of the
+// first point following the key's hash. Adding or removing a server moves only the keys between its points and the
+// points preceding them - about 1/n of all keys for n servers - and the virtual nodes even out the share of each server.
+
+package shard
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+const (
+	RING_VNODES = 128 // Number of points of each server on the hash ring.
+)
+
+// A point of a server on the ring.
+type ringPoint struct {
+	hash   uint64
+	server string
+}
+
+// Ring assigns keys to servers by consistent hashing.
+type Ring struct {
+	servers []string
+	points  []ringPoint // In ascending order of hash
+}
+
+// Return the ring of the servers, which must be distinct and not empty.
+func NewRing(servers ...string) (*Ring, error) {
+	if len(servers) == 0 {
+		return nil, dberr.New(dberr.ErrorMissing, "server")
+	}
+	ring := &Ring{servers: append([]string(nil), servers...), points: make([]ringPoint, 0, len(servers)*RING_VNODES)}
+	known := make(map[string]bool)
+	for _, server := range servers {
+		if server == "" || known[server] {
+			return nil, dberr.New(dberr.ErrorInvalidParam, "server", server)
+		}
+		known[server] = true
+		for i := 0; i < RING_VNODES; i++ {
+			ring.points = append(ring.points, ringPoint{hash: hashKey(server + "#" + strconv.Itoa(i)), server: server})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i].hash < ring.points[j].hash
+	})
+	return ring, nil
+}
+
+// Return the hash of the key.
+func hashKey(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	// Mix the bits (splitmix64 finaliser), as FNV spreads similar keys poorly
+	sum := hash.Sum64()
+	sum = (sum ^ sum>>30) * 0xbf58476d1ce4e5b9
+	sum = (sum ^ sum>>27) * 0x94d049bb133111eb
+	return sum ^ sum>>31
+}
+
+// Return the server the key belongs to.
+func (ring *Ring) Server(key string) string {
+	hash := hashKey(key)
+	i := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i].hash >= hash
+	})
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.points[i].server
+}
+
+// Return true if the server is on the ring.
+func (ring *Ring) has(server string) bool {
+	for _, known := range ring.servers {
+		if known == server {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the servers of the ring in the order they were given.
+func (ring *Ring) Servers() []string {
+	return append([]string(nil), ring.servers...)
+}
@@ -0,0 +1,281 @@
+package shard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestRing(t *testing.T) {
+	if _, err := NewRing(); dberr.Type(err) != dberr.ErrorMissing {
+		t.Fatal(err)
+	} else if _, err = NewRing("a", "a"); dberr.Type(err) != dberr.ErrorInvalidParam {
+		t.Fatal(err)
+	}
+	three, _ := NewRing("a", "b", "c")
+	four, _ := NewRing("a", "b", "c", "d")
+	shares := make(map[string]int)
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := strconv.Itoa(i)
+		shares[three.Server(key)]++
+		if owner := four.Server(key); owner != three.Server(key) {
+			if owner != "d" {
+				t.Fatal("key moved between remaining servers", key)
+			}
+			moved++
+		}
+	}
+	// Every server has its share, and the new server takes about a quarter of the keys
+	for _, server := range three.Servers() {
+		if shares[server] < 2500 || shares[server] > 4200 {
+			t.Fatal(shares)
+		}
+	}
+	if moved < 1500 || moved > 3500 {
+		t.Fatal(moved)
+	}
+}
+
+// A server keeping the documents and indexes of one collection in memory.
+type fake struct {
+	*httptest.Server
+	lock    *sync.Mutex
+	docs    map[string]map[string]interface{} // By string ID
+	indexes []string
+	onQuery func() // Called before answering a query, optional
+}
+
+func fakeServer() *fake {
+	f := &fake{lock: new(sync.Mutex), docs: make(map[string]map[string]interface{})}
+	noDoc := func(w http.ResponseWriter, strID string) {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, `{"code": "no_doc", "message": "Document %s does not exist"}`, strID)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/create", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(201)
+	})
+	mux.HandleFunc("/index", func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.indexes = append(f.indexes, r.FormValue("path"))
+		w.WriteHeader(201)
+	})
+	mux.HandleFunc("/indexes", func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		indexes := make([][]string, 0)
+		for _, path := range f.indexes {
+			indexes = append(indexes, strings.Split(path, ","))
+		}
+		json.NewEncoder(w).Encode(indexes)
+	})
+	mux.HandleFunc("/insert", func(w http.ResponseWriter, r *http.Request) {
+		var doc map[string]interface{}
+		json.Unmarshal([]byte(r.FormValue("doc")), &doc)
+		strID := r.FormValue("id")
+		doc["_id"] = strID
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if _, exists := f.docs[strID]; exists {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, `{"code": "dup_id", "message": "Document ID %s is already in use"}`, strID)
+			return
+		}
+		f.docs[strID] = doc
+		w.WriteHeader(201)
+		w.Write([]byte("1"))
+	})
+	mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if doc, exists := f.docs[r.FormValue("id")]; exists {
+			json.NewEncoder(w).Encode(doc)
+		} else {
+			noDoc(w, r.FormValue("id"))
+		}
+	})
+	mux.HandleFunc("/update", func(w http.ResponseWriter, r *http.Request) {
+		var doc map[string]interface{}
+		json.Unmarshal([]byte(r.FormValue("doc")), &doc)
+		strID := r.FormValue("id")
+		doc["_id"] = strID
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if _, exists := f.docs[strID]; exists {
+			f.docs[strID] = doc
+		} else {
+			noDoc(w, strID)
+		}
+	})
+	mux.HandleFunc("/delete", func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if _, exists := f.docs[r.FormValue("id")]; exists {
+			delete(f.docs, r.FormValue("id"))
+		} else {
+			noDoc(w, r.FormValue("id"))
+		}
+	})
+	mux.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		if f.onQuery != nil {
+			f.onQuery()
+		}
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		result := make(map[string]interface{})
+		for strID, doc := range f.docs {
+			result[strID] = doc
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	mux.HandleFunc("/count", func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		w.Write([]byte(strconv.Itoa(len(f.docs))))
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func TestCluster(t *testing.T) {
+	var servers []string
+	var stores []map[string]map[string]interface{}
+	for i := 0; i < 3; i++ {
+		server := fakeServer()
+		defer server.Close()
+		servers = append(servers, server.URL+"/")
+		stores = append(stores, server.docs)
+	}
+	cluster, err := New(servers...)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = cluster.Create("Feeds"); err != nil {
+		t.Fatal(err)
+	}
+	// Documents are spread across the servers by string ID
+	for i := 0; i < 30; i++ {
+		strID, err := cluster.Insert("Feeds", map[string]interface{}{"n": i})
+		if err != nil || len(strID) != 32 {
+			t.Fatal(strID, err)
+		}
+	}
+	if strID, err := cluster.Insert("Feeds", map[string]interface{}{"_id": "mine"}); err != nil || strID != "mine" {
+		t.Fatal(strID, err)
+	}
+	for i, docs := range stores {
+		if len(docs) == 0 {
+			t.Fatal("no documents on server", i)
+		}
+		for strID := range docs {
+			if cluster.Server(strID) != servers[i][:len(servers[i])-1] {
+				t.Fatal("document on the wrong server", strID)
+			}
+		}
+	}
+	if doc, err := cluster.Read("Feeds", "mine"); err != nil || doc["_id"] != "mine" {
+		t.Fatal(doc, err)
+	}
+	// Queries are answered by all servers
+	if docs, err := cluster.Query("Feeds", "all"); err != nil || len(docs) != 31 || docs["mine"] == nil {
+		t.Fatal(len(docs), err)
+	} else if count, err := cluster.Count("Feeds", "all"); err != nil || count != 31 {
+		t.Fatal(count, err)
+	}
+	if err = cluster.Delete("Feeds", "mine"); err != nil {
+		t.Fatal(err)
+	} else if _, err = cluster.Read("Feeds", "mine"); err == nil || !isCode(err, "no_doc") || err.(*ServerError).Status != 404 {
+		t.Fatal(err)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	var fakes []*fake
+	var servers []string
+	for i := 0; i < 3; i++ {
+		fakes = append(fakes, fakeServer())
+		defer fakes[i].Close()
+		servers = append(servers, fakes[i].URL)
+	}
+	cluster, err := New(servers[:2]...)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = cluster.Create("Feeds"); err != nil {
+		t.Fatal(err)
+	} else if err = cluster.Index("Feeds", "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 40; i++ {
+		if _, err = cluster.Insert("Feeds", map[string]interface{}{"_id": strconv.Itoa(i), "n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Find documents moving to the new server
+	ring, _ := NewRing(servers...)
+	var moving []string
+	for i := 0; i < 40; i++ {
+		if ring.Server(strconv.Itoa(i)) == servers[2] {
+			moving = append(moving, strconv.Itoa(i))
+		}
+	}
+	newStrID := ""
+	for i := 40; newStrID == ""; i++ {
+		if ring.Server(strconv.Itoa(i)) == servers[2] {
+			newStrID = strconv.Itoa(i)
+		}
+	}
+	if len(moving) < 2 {
+		t.Fatal(moving)
+	}
+	// Write the moving documents while they are copied
+	var written int32
+	fakes[0].onQuery = func() {
+		if atomic.CompareAndSwapInt32(&written, 0, 1) {
+			if err := cluster.Update("Feeds", moving[0], map[string]interface{}{"n": "updated"}); err != nil {
+				t.Error(err)
+			} else if err = cluster.Delete("Feeds", moving[1]); err != nil {
+				t.Error(err)
+			} else if _, err = cluster.Insert("Feeds", map[string]interface{}{"_id": newStrID}); err != nil {
+				t.Error(err)
+			} else if count, err := cluster.Count("Feeds", "all"); err != nil || count != 40 {
+				t.Error(count, err)
+			}
+		}
+	}
+	if moved, err := cluster.Rebalance(servers, "Feeds"); err != nil || moved != len(moving) {
+		t.Fatal(moved, len(moving), err)
+	} else if len(fakes[2].indexes) != 1 || fakes[2].indexes[0] != "a,b" {
+		t.Fatal(fakes[2].indexes)
+	}
+	// Every document is on its server alone
+	total := 0
+	for i, f := range fakes {
+		total += len(f.docs)
+		for strID := range f.docs {
+			if cluster.Server(strID) != servers[i] {
+				t.Fatal("document on the wrong server", strID)
+			}
+		}
+	}
+	if total != 40 || len(fakes[2].docs) != len(moving) {
+		t.Fatal(total, len(fakes[2].docs))
+	} else if count, err := cluster.Count("Feeds", "all"); err != nil || count != 40 {
+		t.Fatal(count, err)
+	}
+	if doc, err := cluster.Read("Feeds", moving[0]); err != nil || doc["n"] != "updated" {
+		t.Fatal(doc, err)
+	} else if _, err = cluster.Read("Feeds", moving[1]); !isCode(err, "no_doc") {
+		t.Fatal(err)
+	} else if _, err = cluster.Read("Feeds", newStrID); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,21 +6,36 @@ import (
 	"sync"
 )
 
-// Controls whether INFO log messages are generated
+// Controls whether INFO log messages are generated. Use SetVerbose to change it while logging may take place.
 var VerboseLog = false
+var verboseLock = new(sync.RWMutex)
 
 // const limit crit message
 const limitCritHistory = 100
 
+// Turn verbose logging on/off.
+func SetVerbose(verbose bool) {
+	verboseLock.Lock()
+	VerboseLog = verbose
+	verboseLock.Unlock()
+}
+
+// Return true if INFO log messages are generated.
+func IsVerbose() bool {
+	verboseLock.RLock()
+	defer verboseLock.RUnlock()
+	return VerboseLog
+}
+
 // LVL 6
 func Infof(template string, params ...interface{}) {
-	if VerboseLog {
+	if IsVerbose() {
 		log.Printf(template, params...)
 	}
 }
 
 func Info(params ...interface{}) {
-	if VerboseLog {
+	if IsVerbose() {
 		log.Print(params...)
 	}
 }
@@ -37,6 +37,21 @@ func TestInfo(t *testing.T) {
 		t.Error("Expected error not equal string from log")
 	}
 }
+func TestSetVerbose(t *testing.T) {
+	defer SetVerbose(true)
+	var str bytes.Buffer
+	log.SetOutput(&str)
+	SetVerbose(false)
+	Info("quiet")
+	if IsVerbose() || str.Len() != 0 {
+		t.Fatal(str.String())
+	}
+	SetVerbose(true)
+	Info("loud")
+	if !IsVerbose() || !strings.Contains(str.String(), "loud") {
+		t.Fatal(str.String())
+	}
+}
 func TestCritNoRepeatMoreLimit(t *testing.T) {
 	VerboseLog = true
 	for len(critHistory) < 100 {
@@ -0,0 +1,538 @@
+// SQL-ish query layer.
+//
+// A restricted, read-only SELECT statement is translated into a tiedot query, so that collections can be explored
+// without writing query structures by hand:
+//
+//     SELECT title, author.name FROM Feeds WHERE (lang = 'en' OR lang IN ('de', 'fr')) AND year BETWEEN 2000 AND 2010
+//         ORDER BY year DESC, title LIMIT 10 OFFSET 20
+//
+// Conditions translate into index lookups, thus every path compared in WHERE must be indexed:
+//
+//     path = value             {"eq": value, "in": path}
+//     path IN (v1, v2)         [{"eq": v1, "in": path}, {"eq": v2, "in": path}]
+//     path BETWEEN a AND b     {"int-from": a, "int-to": b, "in": path}
+//     path >= a AND path < b   {"int-from": a, "int-to": b - 1, "in": path}
+//     path IS NOT NULL         {"has": path}
+//     a AND b, a OR b          {"n": [a, b]}, [a, b]
+//     NOT a, path != value     {"c": ["all", a]}
+//
+// Ranges take integers, and a comparison by <, <=, > or >= must be bounded from both sides by comparisons of the same
+// path joined by AND. Keywords are case insensitive; paths are attribute names separated by dots, and names that are
+// not plain ASCII identifiers are quoted in double quotes or backticks. Strings are quoted in single quotes.
+
+package tdsql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Kinds of tokens.
+const (
+	tokenEOF = iota
+	tokenIdent
+	tokenQuoted // Quoted identifier
+	tokenString
+	tokenNumber
+	tokenSymbol
+)
+
+// Keywords, which are not taken for identifiers unless quoted.
+var keywords = map[string]struct{}{
+	"SELECT": {}, "FROM": {}, "WHERE": {}, "AND": {}, "OR": {}, "NOT": {}, "IN": {}, "BETWEEN": {}, "IS": {}, "NULL": {},
+	"TRUE": {}, "FALSE": {}, "ORDER": {}, "BY": {}, "ASC": {}, "DESC": {}, "LIMIT": {}, "OFFSET": {},
+}
+
+// Symbols, which are operators and punctuation.
+var symbols = map[string]struct{}{
+	"*": {}, ",": {}, ".": {}, "(": {}, ")": {}, "=": {}, "!=": {}, "<>": {}, "<": {}, "<=": {}, ">": {}, ">=": {},
+}
+
+// Select is a parsed SELECT statement.
+type Select struct {
+	Col     string      // Name of the collection
+	Fields  [][]string  // Paths projected into the result documents, nil - entire documents
+	Where   interface{} // The tiedot query, "all" without WHERE
+	OrderBy []Order     // Result documents are sorted by these paths, otherwise by document ID
+	Limit   int         // Maximum number of result documents, negative - no limit
+	Offset  int         // Number of result documents skipped
+}
+
+// Order sorts result documents by the value of a path.
+type Order struct {
+	Path []string
+	Desc bool
+}
+
+type token struct {
+	kind int
+	text string // Keywords are in upper case, strings and quoted identifiers are unquoted
+	pos  int    // Offset of the token in the statement
+}
+
+// A recursive descent parser of a tokenised statement.
+type parser struct {
+	tokens []token
+	next   int
+}
+
+// An integer bound of a range comparison.
+type bound struct {
+	path  []string
+	from  bool // Lower bound, otherwise upper bound
+	value int
+	pos   int
+}
+
+// Parse a SELECT statement.
+func Parse(stmt string) (sel *Select, err error) {
+	tokens, err := tokenise(stmt)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	sel = &Select{Where: "all", Limit: -1}
+	if err = p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	if p.peekSymbol("*") {
+		p.next++
+	} else {
+		for {
+			path, err := p.path()
+			if err != nil {
+				return nil, err
+			}
+			sel.Fields = append(sel.Fields, path)
+			if !p.peekSymbol(",") {
+				break
+			}
+			p.next++
+		}
+	}
+	if err = p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	if _, isKeyword := keywords[p.tokens[p.next].text]; p.tokens[p.next].kind == tokenQuoted || p.tokens[p.next].kind == tokenIdent && !isKeyword {
+		sel.Col = p.tokens[p.next].text
+		p.next++
+	} else {
+		return nil, p.syntaxError("collection name")
+	}
+	if p.peekKeyword("WHERE") {
+		p.next++
+		if sel.Where, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peekKeyword("ORDER") {
+		p.next++
+		if err = p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			path, err := p.path()
+			if err != nil {
+				return nil, err
+			}
+			order := Order{Path: path}
+			if p.peekKeyword("DESC") {
+				order.Desc = true
+				p.next++
+			} else if p.peekKeyword("ASC") {
+				p.next++
+			}
+			sel.OrderBy = append(sel.OrderBy, order)
+			if !p.peekSymbol(",") {
+				break
+			}
+			p.next++
+		}
+	}
+	if p.peekKeyword("LIMIT") {
+		p.next++
+		if sel.Limit, err = p.count(); err != nil {
+			return nil, err
+		}
+		if p.peekKeyword("OFFSET") {
+			p.next++
+			if sel.Offset, err = p.count(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.tokens[p.next].kind != tokenEOF {
+		return nil, p.syntaxError("end of statement")
+	}
+	return sel, nil
+}
+
+// Split the statement into tokens, the last of which is EOF.
+func tokenise(stmt string) (tokens []token, err error) {
+	for pos := 0; pos < len(stmt); {
+		c := stmt[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+		case c == '\'' || c == '"' || c == '`':
+			// Quotes are escaped by doubling them
+			var text strings.Builder
+			end := pos + 1
+			for ; end < len(stmt); end++ {
+				if stmt[end] != c {
+					text.WriteByte(stmt[end])
+				} else if end+1 < len(stmt) && stmt[end+1] == c {
+					text.WriteByte(stmt[end])
+					end++
+				} else {
+					break
+				}
+			}
+			if end == len(stmt) {
+				return nil, dberr.New(dberr.ErrorSQLSyntax, pos, "unterminated quote")
+			}
+			kind := tokenQuoted
+			if c == '\'' {
+				kind = tokenString
+			}
+			tokens = append(tokens, token{kind: kind, text: text.String(), pos: pos})
+			pos = end + 1
+		case c >= '0' && c <= '9' || c == '-' && pos+1 < len(stmt) && stmt[pos+1] >= '0' && stmt[pos+1] <= '9':
+			end := pos + 1
+			for end < len(stmt) && (stmt[end] >= '0' && stmt[end] <= '9' || stmt[end] == '.' || stmt[end] == 'e' || stmt[end] == 'E') {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: stmt[pos:end], pos: pos})
+			pos = end
+		case isIdentChar(c) && !(c >= '0' && c <= '9'):
+			end := pos + 1
+			for end < len(stmt) && isIdentChar(stmt[end]) {
+				end++
+			}
+			text := stmt[pos:end]
+			if _, isKeyword := keywords[strings.ToUpper(text)]; isKeyword {
+				text = strings.ToUpper(text)
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: text, pos: pos})
+			pos = end
+		default:
+			symbol := stmt[pos : pos+1]
+			if pos+1 < len(stmt) {
+				if two := stmt[pos : pos+2]; two == "!=" || two == "<>" || two == "<=" || two == ">=" {
+					symbol = two
+				}
+			}
+			if _, valid := symbols[symbol]; !valid {
+				return nil, dberr.New(dberr.ErrorSQLSyntax, pos, fmt.Sprintf("unexpected character %q", symbol))
+			}
+			tokens = append(tokens, token{kind: tokenSymbol, text: symbol, pos: pos})
+			pos += len(symbol)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(stmt)}), nil
+}
+
+// Return true if the character may appear in an identifier that is not quoted.
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// Return an error telling what was expected at the next token.
+func (p *parser) syntaxError(expected string) error {
+	tok := p.tokens[p.next]
+	if tok.kind == tokenEOF {
+		return dberr.New(dberr.ErrorSQLSyntax, tok.pos, "expecting "+expected+", but the statement ends")
+	}
+	return dberr.New(dberr.ErrorSQLSyntax, tok.pos, fmt.Sprintf("expecting %s, but %q given", expected, tok.text))
+}
+
+func (p *parser) peekKeyword(keyword string) bool {
+	tok := p.tokens[p.next]
+	return tok.kind == tokenIdent && tok.text == keyword
+}
+
+func (p *parser) peekSymbol(symbol string) bool {
+	tok := p.tokens[p.next]
+	return tok.kind == tokenSymbol && tok.text == symbol
+}
+
+func (p *parser) expectKeyword(keyword string) error {
+	if !p.peekKeyword(keyword) {
+		return p.syntaxError(keyword)
+	}
+	p.next++
+	return nil
+}
+
+func (p *parser) expectSymbol(symbol string) error {
+	if !p.peekSymbol(symbol) {
+		return p.syntaxError("`" + symbol + "`")
+	}
+	p.next++
+	return nil
+}
+
+// Parse a dot separated path.
+func (p *parser) path() (path []string, err error) {
+	for {
+		tok := p.tokens[p.next]
+		if _, isKeyword := keywords[tok.text]; tok.kind == tokenQuoted || tok.kind == tokenIdent && !isKeyword {
+			path = append(path, tok.text)
+			p.next++
+		} else {
+			return nil, p.syntaxError("attribute name")
+		}
+		if !p.peekSymbol(".") {
+			return path, nil
+		}
+		p.next++
+	}
+}
+
+// Parse a non-negative integer of LIMIT or OFFSET.
+func (p *parser) count() (int, error) {
+	tok := p.tokens[p.next]
+	n, err := strconv.Atoi(tok.text)
+	if tok.kind != tokenNumber || err != nil || n < 0 {
+		return 0, p.syntaxError("non-negative integer")
+	}
+	p.next++
+	return n, nil
+}
+
+// Parse a literal value.
+func (p *parser) value() (interface{}, error) {
+	tok := p.tokens[p.next]
+	switch {
+	case tok.kind == tokenString:
+		p.next++
+		return tok.text, nil
+	case tok.kind == tokenNumber:
+		// Documents hold numbers as float64, so do lookup values
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.syntaxError("number")
+		}
+		p.next++
+		return n, nil
+	case tok.kind == tokenIdent && (tok.text == "TRUE" || tok.text == "FALSE"):
+		p.next++
+		return tok.text == "TRUE", nil
+	}
+	return nil, p.syntaxError("value")
+}
+
+// Parse an integer of a range.
+func (p *parser) integer() (int, error) {
+	pos := p.tokens[p.next].pos
+	val, err := p.value()
+	if err != nil {
+		return 0, err
+	} else if n, isNum := val.(float64); !isNum || n != math.Trunc(n) {
+		return 0, dberr.New(dberr.ErrorSQLSyntax, pos, fmt.Sprintf("expecting an integer, but %v given", val))
+	}
+	return int(val.(float64)), nil
+}
+
+// Parse conditions joined by OR into a union.
+func (p *parser) or() (interface{}, error) {
+	var union []interface{}
+	for {
+		cond, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		union = append(union, cond)
+		if !p.peekKeyword("OR") {
+			break
+		}
+		p.next++
+	}
+	if len(union) == 1 {
+		return union[0], nil
+	}
+	return union, nil
+}
+
+// Parse conditions joined by AND into an intersection. Range comparisons of the same path are combined into one range.
+func (p *parser) and() (interface{}, error) {
+	var conds []interface{}
+	var bounds []bound
+	for {
+		cond, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		if b, isBound := cond.(bound); isBound {
+			bounds = append(bounds, b)
+		} else {
+			conds = append(conds, cond)
+		}
+		if !p.peekKeyword("AND") {
+			break
+		}
+		p.next++
+	}
+	// Pair up lower and upper bounds of each path, in order of appearance
+	for len(bounds) > 0 {
+		b := bounds[0]
+		var from, to *bound
+		rest := bounds[:0]
+		for i := range bounds {
+			other := bounds[i]
+			if strings.Join(other.path, ".") != strings.Join(b.path, ".") {
+				rest = append(rest, other)
+			} else if other.from && from == nil {
+				from = &other
+			} else if !other.from && to == nil {
+				to = &other
+			} else {
+				return nil, dberr.New(dberr.ErrorSQLSyntax, other.pos, fmt.Sprintf("%s is bounded more than once", strings.Join(b.path, ".")))
+			}
+		}
+		if from == nil || to == nil {
+			return nil, dberr.New(dberr.ErrorSQLSyntax, b.pos, fmt.Sprintf("%s must be bounded from both sides, e.g. by BETWEEN", strings.Join(b.path, ".")))
+		}
+		conds = append(conds, intRange(from.path, from.value, to.value))
+		bounds = rest
+	}
+	if len(conds) == 1 {
+		return conds[0], nil
+	}
+	return map[string]interface{}{"n": conds}, nil
+}
+
+// Parse a condition that may be negated.
+func (p *parser) not() (interface{}, error) {
+	if !p.peekKeyword("NOT") {
+		return p.comparison()
+	}
+	pos := p.tokens[p.next].pos
+	p.next++
+	cond, err := p.not()
+	if err != nil {
+		return nil, err
+	} else if _, isBound := cond.(bound); isBound {
+		return nil, dberr.New(dberr.ErrorSQLSyntax, pos, "range comparisons cannot be negated")
+	}
+	return negate(cond), nil
+}
+
+// Parse a parenthesised condition or a comparison of a path. A range comparison is returned as its bound, for the
+// intersection to combine.
+func (p *parser) comparison() (interface{}, error) {
+	if p.peekSymbol("(") {
+		p.next++
+		cond, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return cond, p.expectSymbol(")")
+	}
+	path, err := p.path()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.tokens[p.next]
+	switch {
+	case tok.kind == tokenSymbol && (tok.text == "=" || tok.text == "!=" || tok.text == "<>"):
+		p.next++
+		val, err := p.value()
+		if err != nil {
+			return nil, err
+		} else if tok.text == "=" {
+			return lookup(path, val), nil
+		}
+		return negate(lookup(path, val)), nil
+	case tok.kind == tokenSymbol && (tok.text == "<" || tok.text == "<=" || tok.text == ">" || tok.text == ">="):
+		p.next++
+		n, err := p.integer()
+		if err != nil {
+			return nil, err
+		}
+		// Ranges are inclusive
+		switch tok.text {
+		case "<":
+			n--
+		case ">":
+			n++
+		}
+		return bound{path: path, from: tok.text[0] == '>', value: n, pos: tok.pos}, nil
+	case p.peekKeyword("IN"):
+		p.next++
+		if err = p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		union := make([]interface{}, 0)
+		for {
+			val, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			union = append(union, lookup(path, val))
+			if !p.peekSymbol(",") {
+				break
+			}
+			p.next++
+		}
+		return union, p.expectSymbol(")")
+	case p.peekKeyword("BETWEEN"):
+		p.next++
+		from, err := p.integer()
+		if err != nil {
+			return nil, err
+		} else if err = p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		to, err := p.integer()
+		if err != nil {
+			return nil, err
+		}
+		return intRange(path, from, to), nil
+	case p.peekKeyword("IS"):
+		p.next++
+		negated := p.peekKeyword("NOT")
+		if negated {
+			p.next++
+		}
+		if err = p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		has := map[string]interface{}{"has": vecPath(path)}
+		if negated {
+			return has, nil
+		}
+		return negate(has), nil
+	}
+	return nil, p.syntaxError("comparison")
+}
+
+// Return the query path of an attribute path.
+func vecPath(path []string) []interface{} {
+	vec := make([]interface{}, len(path))
+	for i, seg := range path {
+		vec[i] = seg
+	}
+	return vec
+}
+
+func lookup(path []string, val interface{}) map[string]interface{} {
+	return map[string]interface{}{"eq": val, "in": vecPath(path)}
+}
+
+// Return the query of the inclusive range, which is empty if the lower bound exceeds the upper bound.
+func intRange(path []string, from, to int) map[string]interface{} {
+	if from > to {
+		return negate("all")
+	}
+	return map[string]interface{}{"int-from": float64(from), "int-to": float64(to), "in": vecPath(path)}
+}
+
+// Return the query of documents not in the result of the query.
+func negate(q interface{}) map[string]interface{} {
+	return map[string]interface{}{"c": []interface{}{"all", q}}
+}
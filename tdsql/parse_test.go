@@ -0,0 +1,83 @@
+package tdsql
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestParse(t *testing.T) {
+	sel, err := Parse(`select title, "author name".first FROM Feeds order by year desc, title Limit 10 offset 20`)
+	if err != nil {
+		t.Fatal(err)
+	} else if sel.Col != "Feeds" || len(sel.Fields) != 2 || sel.Fields[1][0] != "author name" || sel.Fields[1][1] != "first" ||
+		sel.Where != "all" || sel.Limit != 10 || sel.Offset != 20 {
+		t.Fatal(sel)
+	} else if len(sel.OrderBy) != 2 || !sel.OrderBy[0].Desc || sel.OrderBy[0].Path[0] != "year" || sel.OrderBy[1].Desc {
+		t.Fatal(sel.OrderBy)
+	}
+	if sel, err = Parse("SELECT * FROM `my col`"); err != nil || sel.Col != "my col" || sel.Fields != nil || sel.Limit != -1 {
+		t.Fatal(sel, err)
+	}
+}
+
+func TestParseWhere(t *testing.T) {
+	where := map[string]string{
+		`a = 'it''s'`:                   `{"eq":"it's","in":["a"]}`,
+		`a.b = -1.5`:                    `{"eq":-1.5,"in":["a","b"]}`,
+		`a = TRUE`:                      `{"eq":true,"in":["a"]}`,
+		`a != 1`:                        `{"c":["all",{"eq":1,"in":["a"]}]}`,
+		`a <> 1`:                        `{"c":["all",{"eq":1,"in":["a"]}]}`,
+		`a IN ('x', 2)`:                 `[{"eq":"x","in":["a"]},{"eq":2,"in":["a"]}]`,
+		`a BETWEEN 1 AND 3`:             `{"in":["a"],"int-from":1,"int-to":3}`,
+		`a BETWEEN 3 AND 1`:             `{"c":["all","all"]}`,
+		`a > 1 AND b = 2 AND a < 5`:     `{"n":[{"eq":2,"in":["b"]},{"in":["a"],"int-from":2,"int-to":4}]}`,
+		`a <= 5 AND a >= 1`:             `{"in":["a"],"int-from":1,"int-to":5}`,
+		`a IS NOT NULL`:                 `{"has":["a"]}`,
+		`a IS NULL`:                     `{"c":["all",{"has":["a"]}]}`,
+		`a = 1 OR b = 2 AND c = 3`:      `[{"eq":1,"in":["a"]},{"n":[{"eq":2,"in":["b"]},{"eq":3,"in":["c"]}]}]`,
+		`(a = 1 OR b = 2) AND c = 3`:    `{"n":[[{"eq":1,"in":["a"]},{"eq":2,"in":["b"]}],{"eq":3,"in":["c"]}]}`,
+		`NOT (a = 1 OR NOT b = 2)`:      `{"c":["all",[{"eq":1,"in":["a"]},{"c":["all",{"eq":2,"in":["b"]}]}]]}`,
+		`"select" = 1 and "and" = 'or'`: `{"n":[{"eq":1,"in":["select"]},{"eq":"or","in":["and"]}]}`,
+	}
+	for cond, expected := range where {
+		sel, err := Parse("SELECT * FROM col WHERE " + cond)
+		if err != nil {
+			t.Fatal(cond, err)
+		}
+		if q, _ := json.Marshal(sel.Where); string(q) != expected {
+			t.Fatal(cond, string(q))
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	invalid := map[string]string{
+		"":                                          "at offset 0: expecting SELECT, but the statement ends",
+		"DELETE FROM col":                           `at offset 0: expecting SELECT, but "DELETE" given`,
+		"SELECT FROM col":                           "at offset 7: expecting attribute name",
+		"SELECT * FROM WHERE":                       "at offset 14: expecting collection name",
+		"SELECT * FROM col WHERE a = 'abc":          "at offset 28: unterminated quote",
+		"SELECT * FROM col WHERE a = b":             `at offset 28: expecting value, but "b" given`,
+		"SELECT * FROM col WHERE a == 1":            `at offset 27: expecting value, but "=" given`,
+		"SELECT * FROM col WHERE a ! 1":             `at offset 26: unexpected character "!"`,
+		"SELECT * FROM col WHERE a > 1":             "at offset 26: a must be bounded from both sides",
+		"SELECT * FROM col WHERE a > 1 OR a < 3":    "at offset 26: a must be bounded from both sides",
+		"SELECT * FROM col WHERE a > 1 AND a > 2":   "at offset 36: a is bounded more than once",
+		"SELECT * FROM col WHERE a > 1.5 AND a < 3": "at offset 28: expecting an integer, but 1.5 given",
+		"SELECT * FROM col WHERE NOT a > 1":         "at offset 24: range comparisons cannot be negated",
+		"SELECT * FROM col WHERE (a = 1":            "expecting `)`, but the statement ends",
+		"SELECT * FROM col WHERE a IN ()":           `at offset 30: expecting value, but ")" given`,
+		"SELECT * FROM col WHERE a IS 1":            `at offset 29: expecting NULL, but "1" given`,
+		"SELECT * FROM col LIMIT -1":                `at offset 24: expecting non-negative integer, but "-1" given`,
+		"SELECT * FROM col ORDER year":              `at offset 24: expecting BY, but "year" given`,
+		"SELECT * FROM col LIMIT 1 WHERE a = 1":     `at offset 26: expecting end of statement, but "WHERE" given`,
+	}
+	for stmt, expected := range invalid {
+		if _, err := Parse(stmt); dberr.Type(err) != dberr.ErrorSQLSyntax || !strings.Contains(err.Error(), expected) {
+			t.Fatal(stmt, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Statement execution.
+//
+// The query of the statement finds the result documents by index, which are then read, sorted, paged and projected.
+// Sorting reads every document in the result, whereas without ORDER BY only the documents on the requested page are
+// read, in the result order of the collection (see db.ColConfig.ResultOrder), which also breaks ties of ORDER BY.
+
+package tdsql
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/dberr"
+)
+
+// Row is a result document.
+type Row struct {
+	ID  int                    `json:"id"`
+	Doc map[string]interface{} `json:"doc"`
+}
+
+// Parse the statement and run it against the database.
+func Query(database *db.DB, stmt string) ([]Row, error) {
+	sel, err := Parse(stmt)
+	if err != nil {
+		return nil, err
+	}
+	return sel.Run(database)
+}
+
+// Run the statement against the database, return the result documents in order.
+func (sel *Select) Run(database *db.DB) (rows []Row, err error) {
+	col := database.Use(sel.Col)
+	if col == nil {
+		return nil, dberr.New(dberr.ErrorNoCol, sel.Col)
+	}
+	result := make(map[int]struct{})
+	if err = db.EvalQuery(sel.Where, col, &result); err != nil {
+		return nil, err
+	}
+	ids := col.SortResult(result)
+	if len(sel.OrderBy) == 0 {
+		start, end := sel.pageBounds(len(ids))
+		ids = ids[start:end]
+	}
+	rows = make([]Row, 0, len(ids))
+	for _, id := range ids {
+		// The document may have been deleted since the query
+		if doc, err := col.Read(id); err == nil {
+			rows = append(rows, Row{ID: id, Doc: doc})
+		}
+	}
+	if len(sel.OrderBy) > 0 {
+		sort.SliceStable(rows, func(i, j int) bool {
+			for _, order := range sel.OrderBy {
+				cmp := compare(sortKey(rows[i].Doc, order.Path), sortKey(rows[j].Doc, order.Path))
+				if order.Desc {
+					cmp = -cmp
+				}
+				if cmp != 0 {
+					return cmp < 0
+				}
+			}
+			return false
+		})
+		start, end := sel.pageBounds(len(rows))
+		rows = rows[start:end]
+	}
+	if sel.Fields != nil {
+		for i := range rows {
+			rows[i].Doc = db.Project(rows[i].Doc, sel.Fields)
+		}
+	}
+	return rows, nil
+}
+
+// Return the bounds of the page given by LIMIT and OFFSET among the number of results.
+func (sel *Select) pageBounds(total int) (start, end int) {
+	start, end = sel.Offset, total
+	if start > total {
+		start = total
+	}
+	if sel.Limit >= 0 && sel.Limit < end-start {
+		end = start + sel.Limit
+	}
+	return
+}
+
+// Return the value of the path to sort the document by, the first value if the path leads to several.
+func sortKey(doc map[string]interface{}, path []string) interface{} {
+	if vals := db.GetIn(doc, path); len(vals) > 0 {
+		return vals[0]
+	}
+	return nil
+}
+
+// Rank of the value type in the sort order: missing values first, then booleans, numbers, strings and the others.
+func typeRank(val interface{}) int {
+	switch val.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	}
+	return 4
+}
+
+// Return a negative number if a sorts before b, a positive number if b sorts before a, and 0 if they are equal.
+func compare(a, b interface{}) int {
+	if rankA, rankB := typeRank(a), typeRank(b); rankA != rankB {
+		return rankA - rankB
+	}
+	switch a := a.(type) {
+	case bool:
+		if a == b.(bool) {
+			return 0
+		} else if !a {
+			return -1
+		}
+		return 1
+	case float64:
+		if b := b.(float64); a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+		return 0
+	case nil:
+		return 0
+	}
+	strA, strB := fmt.Sprint(a), fmt.Sprint(b)
+	if strA < strB {
+		return -1
+	} else if strA > strB {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,102 @@
+package tdsql
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/cankansin/tiedot/db"
+	"github.com/cankansin/tiedot/dberr"
+)
+
+func TestQuery(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tiedot_tdsql_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	database, err := db.OpenDB(path.Join(tmp, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if err = database.Create("Feeds"); err != nil {
+		t.Fatal(err)
+	}
+	col := database.Use("Feeds")
+	for _, idx := range [][]string{{"lang"}, {"year"}} {
+		if err = col.Index(idx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	docs := []map[string]interface{}{
+		{"title": "b", "lang": "en", "year": 2001, "author": map[string]interface{}{"name": "x", "age": 1}},
+		{"title": "a", "lang": "en", "year": 2001},
+		{"title": "c", "lang": "de", "year": 2005},
+		{"title": "d", "lang": "fr", "year": 1990},
+		{"title": "e", "year": 2003},
+	}
+	ids := make([]int, len(docs))
+	for i, doc := range docs {
+		if ids[i], err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	titles := func(rows []Row) (titles string) {
+		for _, row := range rows {
+			titles += row.Doc["title"].(string)
+		}
+		return
+	}
+	// Sorted by multiple paths, paged after sorting
+	rows, err := Query(database, "SELECT * FROM Feeds WHERE lang IN ('en', 'de') OR year BETWEEN 2000 AND 2010 ORDER BY year DESC, title")
+	if err != nil || titles(rows) != "ceab" {
+		t.Fatal(rows, err)
+	}
+	if rows, err = Query(database, "SELECT * FROM Feeds WHERE year >= 1990 AND year < 2005 ORDER BY title LIMIT 2 OFFSET 1"); err != nil || titles(rows) != "bd" {
+		t.Fatal(rows, err)
+	}
+	// Missing values sort first
+	if rows, err = Query(database, "SELECT * FROM Feeds ORDER BY lang, title"); err != nil || titles(rows) != "ecabd" {
+		t.Fatal(rows, err)
+	}
+	// Without ORDER BY, the result is paged in order of document IDs
+	notEn := []int{ids[2], ids[3], ids[4]}
+	sort.Ints(notEn)
+	if rows, err = Query(database, "SELECT title FROM Feeds WHERE NOT lang = 'en' LIMIT 2"); err != nil || len(rows) != 2 ||
+		rows[0].ID != notEn[0] || rows[1].ID != notEn[1] {
+		t.Fatal(rows, err)
+	}
+	// Projection
+	if rows, err = Query(database, "SELECT title, author.name FROM Feeds WHERE lang = 'en' AND year = 2001 ORDER BY title DESC"); err != nil || len(rows) != 2 {
+		t.Fatal(rows, err)
+	} else if author := rows[0].Doc["author"].(map[string]interface{}); len(rows[0].Doc) != 2 || len(author) != 1 || author["name"] != "x" {
+		t.Fatal(rows)
+	} else if len(rows[1].Doc) != 1 || rows[1].Doc["title"] != "a" {
+		t.Fatal(rows)
+	}
+	if rows, err = Query(database, "SELECT * FROM Feeds LIMIT 1 OFFSET 9"); err != nil || len(rows) != 0 {
+		t.Fatal(rows, err)
+	}
+	// Errors of the statement, the collection and the query
+	if _, err = Query(database, "SELECT *"); dberr.Type(err) != dberr.ErrorSQLSyntax {
+		t.Fatal(err)
+	} else if _, err = Query(database, "SELECT * FROM Nope"); dberr.Type(err) != dberr.ErrorNoCol {
+		t.Fatal(err)
+	} else if _, err = Query(database, "SELECT * FROM Feeds WHERE title = 'a'"); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	ordered := []interface{}{nil, false, true, -1.0, 2.0, "a", "b", []interface{}{1.0}}
+	for i := range ordered {
+		for j := range ordered {
+			if cmp := compare(ordered[i], ordered[j]); i < j && cmp >= 0 || i > j && cmp <= 0 || i == j && cmp != 0 {
+				t.Fatal(ordered[i], ordered[j], cmp)
+			}
+		}
+	}
+}